@@ -126,5 +126,9 @@ func NewAppContainer(db *gorm.DB, req *http.Request, golangContext *ctx.Context,
 		opt(container)
 	}
 
+	if container.OrderService != nil && container.WebsocketService != nil {
+		container.OrderService.MerchantService.SetWebsocketService(container.WebsocketService)
+	}
+
 	return container
 }
@@ -0,0 +1,86 @@
+package contact
+
+import (
+	"net/http"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// GetCustomerGroups retrieves a paginated list of customer groups, filtered by the company ID
+// header and the search query on name and description.
+func (s *ContactService) GetCustomerGroups(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.ctx.DB
+	if search != "" {
+		stmt = stmt.Where("customer_groups.name ILIKE ? OR customer_groups.description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	stmt = stmt.Model(&models.CustomerGroupModel{})
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.CustomerGroupModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetCustomerGroupByID retrieves a customer group with its contacts.
+func (s *ContactService) GetCustomerGroupByID(id string) (*models.CustomerGroupModel, error) {
+	var group models.CustomerGroupModel
+	err := s.ctx.DB.Preload("Contacts", func(db *gorm.DB) *gorm.DB {
+		return db.Select("contacts.id", "contacts.name", "contacts.email", "contacts.phone", "contacts.code")
+	}).Where("id = ?", id).First(&group).Error
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// CreateCustomerGroup creates a new customer group.
+func (s *ContactService) CreateCustomerGroup(data *models.CustomerGroupModel) error {
+	return s.ctx.DB.Omit("Contacts").Create(data).Error
+}
+
+// UpdateCustomerGroup updates the name and description of a customer group.
+func (s *ContactService) UpdateCustomerGroup(id string, data *models.CustomerGroupModel) error {
+	return s.ctx.DB.Model(&models.CustomerGroupModel{}).Where("id = ?", id).
+		Select("name", "description").Updates(data).Error
+}
+
+// DeleteCustomerGroup deletes a customer group and its memberships.
+func (s *ContactService) DeleteCustomerGroup(id string) error {
+	return s.ctx.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM contact_customer_groups WHERE customer_group_model_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.CustomerGroupModel{}).Error
+	})
+}
+
+// AddContactsToCustomerGroup adds contacts to a customer group.
+func (s *ContactService) AddContactsToCustomerGroup(groupID string, contactIDs []string) error {
+	group := models.CustomerGroupModel{}
+	group.ID = groupID
+	contacts := make([]models.ContactModel, len(contactIDs))
+	for i, v := range contactIDs {
+		contacts[i].ID = v
+	}
+	return s.ctx.DB.Model(&group).Omit("Contacts.*").Association("Contacts").Append(contacts)
+}
+
+// RemoveContactsFromCustomerGroup removes contacts from a customer group.
+func (s *ContactService) RemoveContactsFromCustomerGroup(groupID string, contactIDs []string) error {
+	group := models.CustomerGroupModel{}
+	group.ID = groupID
+	contacts := make([]models.ContactModel, len(contactIDs))
+	for i, v := range contactIDs {
+		contacts[i].ID = v
+	}
+	return s.ctx.DB.Model(&group).Association("Contacts").Delete(contacts)
+}
@@ -294,7 +294,7 @@ func (s *ContactService) Migrate() error {
 	if s.ctx.SkipMigration {
 		return nil
 	}
-	return s.ctx.DB.AutoMigrate(&models.ContactModel{})
+	return s.ctx.DB.AutoMigrate(&models.ContactModel{}, &models.CustomerGroupModel{})
 }
 
 // DB returns the underlying database connection.
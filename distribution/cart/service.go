@@ -3,9 +3,13 @@ package cart
 import (
 	"errors"
 	"fmt"
+	"log"
+	"strconv"
 
 	"github.com/AMETORY/ametory-erp-modules/context"
 	"github.com/AMETORY/ametory-erp-modules/inventory"
+	"github.com/AMETORY/ametory-erp-modules/inventory/product"
+	"github.com/AMETORY/ametory-erp-modules/order/promotion"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
 	"gorm.io/gorm"
 )
@@ -14,6 +18,7 @@ type CartService struct {
 	db               *gorm.DB
 	ctx              *context.ERPContext
 	inventoryService *inventory.InventoryService
+	promotionService *promotion.PromotionService
 	merchantID       *string
 }
 
@@ -45,6 +50,22 @@ func (s *CartService) SetMerchantID(merchantID string) {
 	s.merchantID = &merchantID
 }
 
+// SetPromotionService sets the promotion service. When it is set, the promotions of the merchant
+// company are applied to the cart totals, see PromotionDiscount.
+func (s *CartService) SetPromotionService(promotionService *promotion.PromotionService) {
+	s.promotionService = promotionService
+}
+
+// SetVoucherCode sets the voucher or promotion code entered on the active cart of the given user.
+// An empty code removes it.
+func (s *CartService) SetVoucherCode(userID string, code string) error {
+	cart, err := s.GetOrCreateActiveCart(userID)
+	if err != nil {
+		return err
+	}
+	return s.db.Model(&models.CartModel{}).Where("id = ?", cart.ID).Update("voucher_code", code).Error
+}
+
 // GetCartByID returns the cart with the given ID, preloaded with all its items.
 //
 // The function will return an error if the cart is not found or if there is a
@@ -87,6 +108,9 @@ func (s *CartService) GetCartByID(cartID string) (*models.CartModel, error) {
 	}
 	cart.CustomerData = "{}"
 	cart.DiscountAmount = discountAmount
+	if err := s.applyPromotions(&cart); err != nil {
+		log.Println("ERROR CART PROMOTION", err)
+	}
 	return &cart, nil
 }
 
@@ -171,9 +195,55 @@ func (s *CartService) GetOrCreateActiveCart(userID string) (*models.CartModel, e
 	}
 	cart.CustomerData = "{}"
 	cart.DiscountAmount = discountAmount
+	if err := s.applyPromotions(&cart); err != nil {
+		log.Println("ERROR CART PROMOTION", err)
+	}
 	return &cart, nil
 }
 
+// applyPromotions resolves the promotions of the merchant company for the cart and deducts
+// their discount from the subtotal. The cart getters only log its error and return the cart
+// without promotions, so a broken promotion does not lock the customer out of the cart. Nothing
+// is redeemed here; the promotions are resolved again
+// and redeemed when the sale is created from the cart (see pos.POSService.CreatePosFromCart).
+func (s *CartService) applyPromotions(cart *models.CartModel) error {
+	if s.promotionService == nil || cart.MerchantID == nil || len(cart.Items) == 0 {
+		return nil
+	}
+	var merchant models.MerchantModel
+	if err := s.db.Select("id", "company_id").First(&merchant, "id = ?", *cart.MerchantID).Error; err != nil {
+		return err
+	}
+	if merchant.CompanyID == nil {
+		return nil
+	}
+	promotionCart := promotion.PromotionCart{CompanyID: merchant.CompanyID}
+	if cart.VoucherCode != "" {
+		promotionCart.VoucherCodes = []string{cart.VoucherCode}
+	}
+	for i, v := range cart.Items {
+		if v.Quantity <= 0 {
+			continue
+		}
+		promotionCart.Items = append(promotionCart.Items, promotion.PromotionCartItem{
+			LineID:     strconv.Itoa(i),
+			ProductID:  v.ProductID,
+			VariantID:  v.VariantID,
+			CategoryID: v.CategoryID,
+			Quantity:   v.Quantity,
+			UnitPrice:  v.SubTotal / v.Quantity,
+		})
+	}
+	resolution, err := s.promotionService.ResolvePromotions(promotionCart)
+	if err != nil {
+		return err
+	}
+	cart.PromotionDiscount = resolution.Discount + resolution.ShippingDiscount
+	cart.SubTotal -= resolution.Discount
+	cart.DiscountAmount += resolution.Discount
+	return nil
+}
+
 // parseItem is a helper function that parses a cart item model.
 // It loads the product images, sets the display name, original price, discount amount, discount rate, and discount type.
 // It also calculates the subtotal and subtotal before discount, and sets the original price and adjustment price.
@@ -236,6 +306,9 @@ func (s *CartService) parseItem(v *models.CartItemModel, originalPrice, adjustme
 // If the item is already in the cart, it updates the quantity.
 // The function returns an error if there is a database error.
 // It also returns an error if the product is not active.
+// The price of the line is resolved against the price lists of the contact of the user, the
+// merchant and the online channel for the total quantity in the cart; a price list price replaces
+// the product discount.
 func (s *CartService) AddItemToCart(userID string, productID string, variantID *string, quantity float64) error {
 	// Dapatkan cart active
 	cart, err := s.GetOrCreateActiveCart(userID)
@@ -261,6 +334,7 @@ func (s *CartService) AddItemToCart(userID string, productID string, variantID *
 	var discountType string = product.DiscountType
 	var discountRate float64 = product.DiscountRate
 	var adjustmentPrice float64 = product.AdjustmentPrice
+	var priceListItemID *string
 
 	// Cek apakah item sudah ada di cart
 	var existingItem models.CartItemModel
@@ -293,6 +367,18 @@ func (s *CartService) AddItemToCart(userID string, productID string, variantID *
 		adjustmentPrice = variant.AdjustmentPrice
 		fmt.Println("PRICE #2", price, originalPrice, adjustmentPrice)
 	}
+	totalQuantity := quantity
+	if err == nil {
+		totalQuantity += existingItem.Quantity
+	}
+	// Daftar harga menggantikan diskon produk
+	if resolution := s.resolvePrice(cart, userID, productID, variantID, totalQuantity, originalPrice+adjustmentPrice); resolution != nil && resolution.Rule != nil {
+		price = resolution.Price
+		priceListItemID = &resolution.Rule.ItemID
+		discountAmount = 0
+		discountType = ""
+		discountRate = 0
+	}
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			// Tambahkan item baru ke cart
@@ -309,6 +395,7 @@ func (s *CartService) AddItemToCart(userID string, productID string, variantID *
 				DiscountRate:    discountRate,
 				OriginalPrice:   originalPrice,
 				AdjustmentPrice: adjustmentPrice,
+				PriceListItemID: priceListItemID,
 				Width:           width,
 				Height:          height,
 				Weight:          weight,
@@ -327,6 +414,7 @@ func (s *CartService) AddItemToCart(userID string, productID string, variantID *
 		// Update quantity jika item sudah ada
 		existingItem.Quantity += quantity
 		existingItem.Price = price
+		existingItem.PriceListItemID = priceListItemID
 		if err := s.db.Save(&existingItem).Error; err != nil {
 			return err
 		}
@@ -335,6 +423,58 @@ func (s *CartService) AddItemToCart(userID string, productID string, variantID *
 	return nil
 }
 
+// listPrice returns the price of a product, or of its variant, at the merchant of the cart service:
+// the price after the active product discount and the price before it.
+func (s *CartService) listPrice(productID string, variantID *string) (float64, float64, error) {
+	if variantID != nil {
+		variant := models.VariantModel{}
+		variant.MerchantID = s.merchantID
+		if err := s.db.Where("id = ?", *variantID).First(&variant).Error; err != nil {
+			return 0, 0, err
+		}
+		variant.GetPriceAndDiscount(s.db)
+		return variant.Price, variant.OriginalPrice + variant.AdjustmentPrice, nil
+	}
+	product := models.ProductModel{}
+	product.MerchantID = s.merchantID
+	if err := s.db.Where("id = ?", productID).First(&product).Error; err != nil {
+		return 0, 0, err
+	}
+	product.GetPriceAndDiscount(s.db)
+	return product.Price, product.OriginalPrice + product.AdjustmentPrice, nil
+}
+
+// resolvePrice resolves the price list price of a cart line for the contact of the user on the
+// online channel. It returns nil when the price cannot be resolved.
+func (s *CartService) resolvePrice(cart *models.CartModel, userID, productID string, variantID *string, quantity, basePrice float64) *product.PriceResolution {
+	if s.inventoryService == nil || s.inventoryService.PriceListService == nil {
+		return nil
+	}
+	merchantID := cart.MerchantID
+	if merchantID == nil {
+		merchantID = s.merchantID
+	}
+	var contactID *string
+	var contact models.ContactModel
+	if err := s.db.Select("id").Where("user_id = ?", userID).First(&contact).Error; err == nil {
+		contactID = &contact.ID
+	}
+	resolution, err := s.inventoryService.PriceListService.ResolvePrice(product.PriceRequest{
+		ProductID:  productID,
+		VariantID:  variantID,
+		ContactID:  contactID,
+		MerchantID: merchantID,
+		Channel:    models.PriceChannelOnline,
+		Quantity:   quantity,
+		BasePrice:  basePrice,
+	})
+	if err != nil {
+		log.Println("ERROR RESOLVE PRICE", err)
+		return nil
+	}
+	return resolution
+}
+
 // DeleteItemCart deletes an item from the active cart of the given user ID.
 //
 // The function will return an error if there is a database error.
@@ -358,6 +498,7 @@ func (s *CartService) DeleteItemCart(userID string, itemID string) error {
 // It takes the user ID, item ID, and quantity as arguments.
 //
 // It returns an error if there is a database error or if the item is not found in the active cart.
+// The price is resolved again for the new quantity, so quantity tiers of a price list apply.
 func (s *CartService) UpdateItemCart(userID string, itemID string, quantity float64) error {
 	// Dapatkan cart active
 	cart, err := s.GetOrCreateActiveCart(userID)
@@ -371,6 +512,14 @@ func (s *CartService) UpdateItemCart(userID string, itemID string, quantity floa
 		return err
 	}
 	existingItem.Quantity = quantity
+	if price, basePrice, err := s.listPrice(existingItem.ProductID, existingItem.VariantID); err == nil {
+		existingItem.Price = price
+		existingItem.PriceListItemID = nil
+		if resolution := s.resolvePrice(cart, userID, existingItem.ProductID, existingItem.VariantID, quantity, basePrice); resolution != nil && resolution.Rule != nil {
+			existingItem.Price = resolution.Price
+			existingItem.PriceListItemID = &resolution.Rule.ItemID
+		}
+	}
 	if err := s.db.Save(&existingItem).Error; err != nil {
 		return err
 	}
@@ -381,8 +530,10 @@ func (s *CartService) UpdateItemCart(userID string, itemID string, quantity floa
 // FinishCart changes the status of the active cart for the given user to "FINISHED".
 //
 // This function retrieves the active cart for the specified user and updates its
-// status to indicate that the cart is complete. It returns an error if there is a
-// database error or if the active cart cannot be retrieved.
+// status to indicate that the cart is complete. When the cart belongs to a merchant
+// with a default warehouse, the items are reserved in that warehouse until the order
+// is picked or the reservation expires. It returns an error if there is a database
+// error, if the active cart cannot be retrieved or if the stock cannot be reserved.
 
 func (s *CartService) FinishCart(userID string) error {
 	// Dapatkan cart active
@@ -391,12 +542,62 @@ func (s *CartService) FinishCart(userID string) error {
 		return err
 	}
 
-	// Ubah status cart menjadi finished
-	cart.Status = "FINISHED"
-	if err := s.db.Save(&cart).Error; err != nil {
-		return err
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.reserveCart(tx, cart); err != nil {
+			return err
+		}
+		// Ubah status cart menjadi finished
+		cart.Status = "FINISHED"
+		return tx.Save(cart).Error
+	})
+	if s.inventoryService != nil {
+		s.inventoryService.StockReservationService.SetDB(s.db)
+	}
+	return err
+}
+
+// ReleaseCart releases the stock reserved by a finished cart that did not become an order. Orders
+// created from the cart hold its reservations and release them themselves when they are cancelled
+// (see POSService.UpdatePaymentStatus).
+func (s *CartService) ReleaseCart(cartID, reason string) error {
+	if s.inventoryService == nil {
+		return errors.New("inventory service is not initialized")
 	}
+	return s.inventoryService.StockReservationService.Release("cart", cartID, reason)
+}
 
+func (s *CartService) reserveCart(tx *gorm.DB, cart *models.CartModel) error {
+	if s.inventoryService == nil || cart.MerchantID == nil {
+		return nil
+	}
+	var merchant models.MerchantModel
+	if err := tx.Select("id", "company_id", "default_warehouse_id").First(&merchant, "id = ?", *cart.MerchantID).Error; err != nil {
+		return err
+	}
+	if merchant.DefaultWarehouseID == nil {
+		return nil
+	}
+	reservationSrv := s.inventoryService.StockReservationService
+	reservationSrv.SetDB(tx)
+	secRefType := "cart_item"
+	for _, v := range cart.Items {
+		itemID := v.ID
+		if err := reservationSrv.Reserve(&models.StockReservationModel{
+			Description:      fmt.Sprintf("Cart %s", cart.Code),
+			ProductID:        v.ProductID,
+			VariantID:        v.VariantID,
+			WarehouseID:      merchant.DefaultWarehouseID,
+			MerchantID:       cart.MerchantID,
+			CompanyID:        merchant.CompanyID,
+			Quantity:         v.Quantity,
+			ReferenceID:      cart.ID,
+			ReferenceType:    "cart",
+			SecondaryRefID:   &itemID,
+			SecondaryRefType: &secRefType,
+		}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -52,6 +52,9 @@ func NewDistributionService(ctx *context.ERPContext, auditTrailService *audit_tr
 	service.OfferingService = offering.NewOfferingService(ctx.DB, ctx, auditTrailService)
 	service.ShippingService = shipping.NewShippingService(ctx.DB, ctx)
 	service.CartService = cart.NewCartService(ctx.DB, ctx, inventoryService)
+	if orderService != nil {
+		service.CartService.SetPromotionService(orderService.PromotionService)
+	}
 
 	return &service
 }
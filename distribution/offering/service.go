@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/inventory"
 	"github.com/AMETORY/ametory-erp-modules/shared/audit_trail"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
 	"gorm.io/gorm"
@@ -245,6 +246,10 @@ func (s *OfferingService) TakeOffer(offerID string, totalPrice, shippingFee, dis
 			return err
 		}
 
+		if err := s.reserveOffer(tx, &offer); err != nil {
+			return err
+		}
+
 		orderRequest.Status = "Accepted"
 		orderRequest.MerchantID = &offer.MerchantID
 		err = tx.Save(&orderRequest).Error
@@ -256,6 +261,78 @@ func (s *OfferingService) TakeOffer(offerID string, totalPrice, shippingFee, dis
 	})
 }
 
+// CancelOffer cancels a taken offer and releases the stock reserved for it.
+//
+// Params:
+// - offerID (string): The ID of the offer to be cancelled.
+// - reason (string): The reason for cancelling the offer.
+//
+// Returns:
+// - (error): An error object if the cancellation fails, or nil if the operation is successful.
+func (s *OfferingService) CancelOffer(offerID, reason string) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		offer := models.OfferModel{}
+		if err := tx.Where("id = ?", offerID).First(&offer).Error; err != nil {
+			return err
+		}
+		if offer.Status == "Cancelled" {
+			return fmt.Errorf("offer is already cancelled")
+		}
+		if inventorySrv, ok := s.ctx.InventoryService.(*inventory.InventoryService); ok {
+			inventorySrv.StockReservationService.SetDB(tx)
+			if err := inventorySrv.StockReservationService.Release("offer", offer.ID, reason); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&offer).Update("status", "Cancelled").Error
+	})
+	if inventorySrv, ok := s.ctx.InventoryService.(*inventory.InventoryService); ok {
+		inventorySrv.StockReservationService.SetDB(s.db)
+	}
+	return err
+}
+
+// reserveOffer reserves the offered items in the default warehouse of the merchant.
+func (s *OfferingService) reserveOffer(tx *gorm.DB, offer *models.OfferModel) error {
+	inventorySrv, ok := s.ctx.InventoryService.(*inventory.InventoryService)
+	if !ok {
+		return nil
+	}
+	var merchant models.MerchantModel
+	if err := tx.Select("id", "company_id", "default_warehouse_id").First(&merchant, "id = ?", offer.MerchantID).Error; err != nil {
+		return err
+	}
+	if merchant.DefaultWarehouseID == nil {
+		return nil
+	}
+	var available models.MerchantAvailableProduct
+	if err := json.Unmarshal([]byte(offer.MerchantAvailableProductData), &available); err != nil {
+		return err
+	}
+	reservationSrv := inventorySrv.StockReservationService
+	reservationSrv.SetDB(tx)
+	defer reservationSrv.SetDB(s.db)
+	for _, v := range available.Items {
+		if v.Quantity <= 0 || v.Status == "OUT_OF_STOCK" {
+			continue
+		}
+		if err := reservationSrv.Reserve(&models.StockReservationModel{
+			Description:   fmt.Sprintf("Offer %s", v.ProductDisplayName),
+			ProductID:     v.ProductID,
+			VariantID:     v.VariantID,
+			WarehouseID:   merchant.DefaultWarehouseID,
+			MerchantID:    &merchant.ID,
+			CompanyID:     merchant.CompanyID,
+			Quantity:      v.Quantity,
+			ReferenceID:   offer.ID,
+			ReferenceType: "offer",
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // func (s *OfferingService) TakeOrder(orderRequestID string, merchantID string) error {
 // 	return s.db.Transaction(func(tx *gorm.DB) error {
 // 		orderRequest := models.OrderRequestModel{}
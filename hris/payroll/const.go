@@ -6,6 +6,7 @@ const (
 	OVERTIME         = "OVERTIME"
 	DEDUCTION        = "DEDUCTION"
 	REIMBURSEMENT    = "REIMBURSEMENT"
+	COMMISSION       = "COMMISSION"
 	DRAFT            = "DRAFT"
 	RUNNING          = "RUNNING"
 	FINISHED         = "FINISHED"
@@ -0,0 +1,106 @@
+package payroll
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"gorm.io/gorm"
+)
+
+// AddSalesCommissions adds the approved sales commissions of the employee of a payroll as a
+// COMMISSION earning.
+//
+// All approved commissions dated up to the end of the payroll that are not paid yet are netted
+// (clawbacks included) into a single payroll item, and are marked as paid by it. When the net
+// amount is not positive nothing is added and the commissions are left for a later payroll.
+func (s *PayrollService) AddSalesCommissions(payRollID string) (*models.PayrollItemModel, error) {
+	var item *models.PayrollItemModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var payRoll models.PayRollModel
+		if err := tx.Where("id = ?", payRollID).First(&payRoll).Error; err != nil {
+			return err
+		}
+		if payRoll.IsLocked || payRoll.Status == FINISHED {
+			return errors.New("payroll is locked")
+		}
+		if payRoll.EmployeeID == nil {
+			return errors.New("employee not found")
+		}
+
+		var commissions []models.SalesCommissionModel
+		stmt := tx.Where("employee_id = ? AND status = ? AND payroll_item_id IS NULL", *payRoll.EmployeeID, models.SalesCommissionApproved).
+			Where("date < ?", payRoll.EndDate.AddDate(0, 0, 1))
+		if payRoll.CompanyID != nil {
+			stmt = stmt.Where("company_id = ?", *payRoll.CompanyID)
+		}
+		if err := stmt.Order("date asc").Find(&commissions).Error; err != nil {
+			return err
+		}
+		var amount float64
+		ids := []string{}
+		periods := map[string]bool{}
+		for _, v := range commissions {
+			amount += v.Amount
+			ids = append(ids, v.ID)
+			periods[v.Period] = true
+		}
+		amount = utils.AmountRound(amount, 2)
+		if amount <= 0 {
+			return errors.New("no approved sales commission to pay")
+		}
+
+		periodList := []string{}
+		for k := range periods {
+			periodList = append(periodList, k)
+		}
+		sort.Strings(periodList)
+		data, _ := json.Marshal(map[string]any{"sales_commission_ids": ids, "periods": periodList})
+		item = &models.PayrollItemModel{
+			ItemType:  COMMISSION,
+			Title:     "Komisi Penjualan",
+			Notes:     fmt.Sprintf("Komisi penjualan %v", periodList),
+			Amount:    amount,
+			PayRollID: payRoll.ID,
+			CompanyID: payRoll.CompanyID,
+			Data:      string(data),
+		}
+		if err := tx.Create(item).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.SalesCommissionModel{}).Where("id IN ?", ids).Updates(map[string]any{
+			"status":          models.SalesCommissionPaid,
+			"pay_roll_id":     payRoll.ID,
+			"payroll_item_id": item.ID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// RemoveSalesCommissions removes the sales commission earnings from a payroll. The commissions
+// they paid are approved again, so they are picked up by the next payroll.
+func (s *PayrollService) RemoveSalesCommissions(payRollID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var payRoll models.PayRollModel
+		if err := tx.Select("id", "is_locked", "status").Where("id = ?", payRollID).First(&payRoll).Error; err != nil {
+			return err
+		}
+		if payRoll.IsLocked || payRoll.Status == FINISHED {
+			return errors.New("payroll is locked")
+		}
+		if err := tx.Model(&models.SalesCommissionModel{}).Where("pay_roll_id = ?", payRollID).Updates(map[string]any{
+			"status":          models.SalesCommissionApproved,
+			"pay_roll_id":     nil,
+			"payroll_item_id": nil,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("pay_roll_id = ? AND item_type = ?", payRollID, COMMISSION).Delete(&models.PayrollItemModel{}).Error
+	})
+}
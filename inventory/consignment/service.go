@@ -0,0 +1,976 @@
+package consignment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/finance"
+	"github.com/AMETORY/ametory-erp-modules/inventory/purchase"
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// quantityEpsilon absorbs floating point noise when comparing quantities.
+const quantityEpsilon = 0.000001
+
+// ConsignmentService manages stock that suppliers leave with us on consignment.
+//
+// Consignment stock is received with stock movements owned by the supplier (OwnerID) and is
+// never booked on the inventory account. When a sales invoice or POS sale takes consignment
+// stock, the sale movement is moved to the supplier, the inventory cost booked by the sale is
+// reversed, and the payable to the supplier is booked at the consignment price or the sale price
+// less commission. Settlements collect the open consignment sales of a period into a posted bill
+// that is paid with PurchaseService.CreatePurchasePayment.
+type ConsignmentService struct {
+	db                   *gorm.DB
+	ctx                  *context.ERPContext
+	financeService       *finance.FinanceService
+	stockMovementService *stockmovement.StockMovementService
+	purchaseService      *purchase.PurchaseService
+}
+
+// NewConsignmentService creates a new instance of ConsignmentService with the given database connection, context, finance service, stock movement service and purchase service.
+func NewConsignmentService(db *gorm.DB, ctx *context.ERPContext, financeService *finance.FinanceService, stockMovementService *stockmovement.StockMovementService, purchaseService *purchase.PurchaseService) *ConsignmentService {
+	return &ConsignmentService{
+		db:                   db,
+		ctx:                  ctx,
+		financeService:       financeService,
+		stockMovementService: stockMovementService,
+		purchaseService:      purchaseService,
+	}
+}
+
+// Migrate migrates the consignment models.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.ConsignmentAgreementModel{},
+		&models.ConsignmentAgreementItemModel{},
+		&models.ConsignmentSaleModel{},
+		&models.ConsignmentSettlementModel{},
+	)
+}
+
+// StockLine is a product quantity received from or returned to a consignment supplier.
+type StockLine struct {
+	ProductID string  `json:"product_id"`
+	VariantID *string `json:"variant_id,omitempty"`
+	Quantity  float64 `json:"quantity"`
+}
+
+// StockBalance is the consignment stock of a product in a warehouse.
+type StockBalance struct {
+	ProductID   string  `json:"product_id"`
+	VariantID   *string `json:"variant_id,omitempty"`
+	WarehouseID string  `json:"warehouse_id"`
+	Quantity    float64 `json:"quantity"`
+}
+
+// SaleLine is a sold line of a sales document.
+//
+// UnitPrice is the net sale price per unit before tax. UnitCost is the inventory cost per unit
+// the document booked to COGS, which is reversed for consignment stock (0 when the document
+// books no cost).
+type SaleLine struct {
+	ItemID    string
+	ProductID string
+	VariantID *string
+	Quantity  float64
+	UnitPrice float64
+	UnitCost  float64
+}
+
+// SaleRequest is a sales document whose stock left the warehouse.
+type SaleRequest struct {
+	CompanyID     *string
+	ReferenceID   string
+	ReferenceType string
+	Number        string
+	Date          time.Time
+	Lines         []SaleLine
+	UserID        string
+}
+
+// CreateAgreement creates a consignment agreement with its products.
+func (s *ConsignmentService) CreateAgreement(data *models.ConsignmentAgreementModel) error {
+	if data.SupplierID == "" {
+		return errors.New("supplier is required")
+	}
+	if err := s.checkAgreement(data); err != nil {
+		return err
+	}
+	if data.Number == "" {
+		data.Number = fmt.Sprintf("CSG-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.StartDate.IsZero() {
+		data.StartDate = time.Now()
+	}
+	data.Status = models.ConsignmentActive
+	return s.db.Create(data).Error
+}
+
+// UpdateAgreement updates the terms of a consignment agreement. Consignment sales already
+// recorded keep their payable.
+func (s *ConsignmentService) UpdateAgreement(id string, data *models.ConsignmentAgreementModel) error {
+	if err := s.checkAgreement(data); err != nil {
+		return err
+	}
+	return s.db.Omit("Items").Where("id = ?", id).Updates(data).Error
+}
+
+// SetAgreementItem adds a product to a consignment agreement or updates its price.
+func (s *ConsignmentService) SetAgreementItem(agreementID string, item *models.ConsignmentAgreementItemModel) error {
+	item.AgreementID = agreementID
+	stmt := s.db.Where("agreement_id = ? AND product_id = ?", agreementID, item.ProductID)
+	if item.VariantID != nil {
+		stmt = stmt.Where("variant_id = ?", *item.VariantID)
+	} else {
+		stmt = stmt.Where("variant_id IS NULL")
+	}
+	var existing models.ConsignmentAgreementItemModel
+	if err := stmt.First(&existing).Error; err == nil {
+		item.ID = existing.ID
+		return s.db.Model(&existing).Updates(map[string]any{
+			"consignment_price":  item.ConsignmentPrice,
+			"commission_percent": item.CommissionPercent,
+		}).Error
+	}
+	return s.db.Create(item).Error
+}
+
+// DeleteAgreementItem removes a product from a consignment agreement.
+func (s *ConsignmentService) DeleteAgreementItem(agreementID string, itemID string) error {
+	return s.db.Where("agreement_id = ? AND id = ?", agreementID, itemID).Delete(&models.ConsignmentAgreementItemModel{}).Error
+}
+
+// EndAgreement ends a consignment agreement. Sales of its remaining stock are no longer
+// recorded as consignment; the stock should be returned to the supplier first.
+func (s *ConsignmentService) EndAgreement(id string, date time.Time) error {
+	return s.db.Model(&models.ConsignmentAgreementModel{}).Where("id = ?", id).Updates(map[string]any{
+		"status":   models.ConsignmentEnded,
+		"end_date": date,
+	}).Error
+}
+
+// GetAgreementByID retrieves a consignment agreement with its supplier and products.
+func (s *ConsignmentService) GetAgreementByID(id string) (*models.ConsignmentAgreementModel, error) {
+	var agreement models.ConsignmentAgreementModel
+	err := s.db.Preload("Supplier").Preload("PayableAccount").Preload("CostAccount").Preload("Items.Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "sku", "price")
+	}).Preload("Items.Variant").Where("id = ?", id).First(&agreement).Error
+	return &agreement, err
+}
+
+// GetAgreements retrieves a paginated list of consignment agreements.
+//
+// The list can be filtered with the supplier_id and status query parameters and is scoped to
+// the company in the ID-Company header.
+func (s *ConsignmentService) GetAgreements(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Supplier", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	})
+	if search != "" {
+		stmt = stmt.Where("number ILIKE ? OR notes ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("supplier_id") != "" {
+		stmt = stmt.Where("supplier_id = ?", request.URL.Query().Get("supplier_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Model(&models.ConsignmentAgreementModel{}).Order("start_date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.ConsignmentAgreementModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// ReceiveStock records consignment stock received from the supplier of an agreement into a
+// warehouse. The movements are owned by the supplier; no journal is posted.
+func (s *ConsignmentService) ReceiveStock(agreementID string, warehouseID string, lines []StockLine, date time.Time, description string) ([]models.StockMovementModel, error) {
+	return s.moveStock(agreementID, warehouseID, lines, date, description, models.MovementTypeConsignmentIn)
+}
+
+// ReturnStock records consignment stock returned to the supplier of an agreement. The
+// returned quantity cannot exceed the consignment stock of the supplier in the warehouse.
+func (s *ConsignmentService) ReturnStock(agreementID string, warehouseID string, lines []StockLine, date time.Time, description string) ([]models.StockMovementModel, error) {
+	return s.moveStock(agreementID, warehouseID, lines, date, description, models.MovementTypeConsignmentOut)
+}
+
+// GetStock retrieves the consignment stock of the supplier of an agreement per product and
+// warehouse.
+func (s *ConsignmentService) GetStock(agreementID string) ([]StockBalance, error) {
+	agreement, err := s.GetAgreementByID(agreementID)
+	if err != nil {
+		return nil, err
+	}
+	var balances []StockBalance
+	err = s.db.Model(&models.StockMovementModel{}).
+		Select("product_id, variant_id, warehouse_id, COALESCE(SUM(quantity), 0) AS quantity").
+		Where("owner_id = ?", agreement.SupplierID).
+		Where("company_id = ? OR company_id IS NULL", agreement.CompanyID).
+		Group("product_id, variant_id, warehouse_id").
+		Having("SUM(quantity) <> 0").
+		Scan(&balances).Error
+	return balances, err
+}
+
+// RecordSalesInvoice records the consignment stock sold by a posted sales invoice. It is called
+// after the invoice is posted and does nothing when the invoice sold no consignment stock.
+func (s *ConsignmentService) RecordSalesInvoice(salesID string, userID string) ([]models.ConsignmentSaleModel, error) {
+	var sales models.SalesModel
+	if err := s.db.Preload("Items").Where("id = ?", salesID).First(&sales).Error; err != nil {
+		return nil, err
+	}
+	req := SaleRequest{
+		CompanyID:     sales.CompanyID,
+		ReferenceID:   sales.ID,
+		ReferenceType: "sales",
+		Number:        sales.SalesNumber,
+		Date:          sales.SalesDate,
+		UserID:        userID,
+	}
+	for _, v := range sales.Items {
+		if v.ProductID == nil || v.RefItemID != nil || v.Quantity <= 0 {
+			continue
+		}
+		unitValue := v.UnitValue
+		if unitValue == 0 {
+			unitValue = 1
+		}
+		req.Lines = append(req.Lines, SaleLine{
+			ItemID:    v.ID,
+			ProductID: *v.ProductID,
+			VariantID: v.VariantID,
+			Quantity:  v.Quantity,
+			UnitPrice: v.SubTotal / v.Quantity,
+			UnitCost:  v.BasePrice * unitValue,
+		})
+	}
+	return s.RecordSale(req)
+}
+
+// RecordPOSSale records the consignment stock sold by a POS sale once its stock left the
+// warehouse. POS sales book no inventory cost, so only the payable is posted.
+func (s *ConsignmentService) RecordPOSSale(posID string, userID string) ([]models.ConsignmentSaleModel, error) {
+	var pos models.POSModel
+	if err := s.db.Preload("Items").Where("id = ?", posID).First(&pos).Error; err != nil {
+		return nil, err
+	}
+	req := SaleRequest{
+		CompanyID:     pos.CompanyID,
+		ReferenceID:   pos.ID,
+		ReferenceType: "pos_sales",
+		Number:        pos.SalesNumber,
+		Date:          pos.SalesDate,
+		UserID:        userID,
+	}
+	for _, v := range pos.Items {
+		if v.ProductID == nil || v.Quantity <= 0 {
+			continue
+		}
+		req.Lines = append(req.Lines, SaleLine{
+			ItemID:    v.ID,
+			ProductID: *v.ProductID,
+			VariantID: v.VariantID,
+			Quantity:  v.Quantity,
+			UnitPrice: v.Subtotal / v.Quantity,
+		})
+	}
+	return s.RecordSale(req)
+}
+
+// RecordSale records the consignment stock taken by the sale movements of a sales document.
+//
+// For every line, the stock that left the warehouse is taken from the consignment stock of the
+// active agreements covering the product (oldest agreement first) before the company's own
+// stock. The consignment part of the sale movement is moved to the supplier, the inventory cost
+// booked by the document is reversed (Dr inventory, Cr COGS) and the payable is booked
+// (Dr consignment cost, Cr consignment payable). Only the quantity of a line that is not recorded
+// yet is booked, from the sale movements made after its last recording, so the method can be
+// called again when more stock of the document leaves the warehouse.
+func (s *ConsignmentService) RecordSale(req SaleRequest) ([]models.ConsignmentSaleModel, error) {
+	if req.Date.IsZero() {
+		req.Date = time.Now()
+	}
+	var userID *string
+	if req.UserID != "" {
+		userID = &req.UserID
+	}
+	records := []models.ConsignmentSaleModel{}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for _, line := range req.Lines {
+			var recorded struct {
+				Quantity float64
+				LastAt   *time.Time
+			}
+			if err := tx.Model(&models.ConsignmentSaleModel{}).
+				Where("reference_id = ? AND reference_type = ? AND reference_item_id = ?", req.ReferenceID, req.ReferenceType, line.ItemID).
+				Select("COALESCE(SUM(quantity), 0) AS quantity, MAX(created_at) AS last_at").
+				Scan(&recorded).Error; err != nil {
+				return err
+			}
+			remaining := line.Quantity - recorded.Quantity
+			if remaining <= quantityEpsilon {
+				continue
+			}
+			agreements, err := s.activeAgreementItems(tx, req.CompanyID, line.ProductID, line.VariantID, req.Date)
+			if err != nil {
+				return err
+			}
+			if len(agreements) == 0 {
+				continue
+			}
+			var movements []models.StockMovementModel
+			stmt := tx.Where("reference_id = ? AND product_id = ? AND owner_id IS NULL AND quantity < 0", req.ReferenceID, line.ProductID).
+				Where("secondary_ref_id = ? OR secondary_ref_id IS NULL", line.ItemID)
+			if line.VariantID != nil {
+				stmt = stmt.Where("variant_id = ?", *line.VariantID)
+			}
+			if recorded.LastAt != nil {
+				stmt = stmt.Where("created_at > ?", *recorded.LastAt)
+			}
+			if err := stmt.Order("created_at asc").Find(&movements).Error; err != nil {
+				return err
+			}
+			for i := range movements {
+				movement := &movements[i]
+				for _, item := range agreements {
+					if remaining <= quantityEpsilon || movement.Quantity >= -quantityEpsilon {
+						break
+					}
+					onHand, err := s.ownerStock(tx, item.Agreement.SupplierID, line.ProductID, line.VariantID, movement.WarehouseID)
+					if err != nil {
+						return err
+					}
+					qty := math.Min(math.Min(remaining, -movement.Quantity), onHand)
+					if qty <= quantityEpsilon {
+						continue
+					}
+					ownerMovement, err := s.assignMovement(tx, movement, qty, item.Agreement.SupplierID)
+					if err != nil {
+						return err
+					}
+					record, err := s.bookSale(tx, req, line, item, ownerMovement, qty, userID)
+					if err != nil {
+						return err
+					}
+					records = append(records, *record)
+					remaining -= qty
+				}
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// ReverseSale reverses the consignment sale of qty units of a sales line whose goods were
+// returned to the stock of the supplier, e.g. a refunded POS line that was restocked. It runs
+// in tx, so the reversal is kept with the return.
+//
+// The open sales of the line are reduced, newest first, and the payable they booked is
+// reversed (Dr consignment payable, Cr consignment cost). Sales already settled are left to be
+// corrected with the supplier.
+func (s *ConsignmentService) ReverseSale(tx *gorm.DB, referenceID, referenceItemID, supplierID string, qty float64, date time.Time, description string, userID *string) error {
+	var sales []models.ConsignmentSaleModel
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Agreement").
+		Where("reference_id = ? AND reference_item_id = ? AND supplier_id = ? AND status = ?", referenceID, referenceItemID, supplierID, models.ConsignmentSaleOpen).
+		Order("date desc").Find(&sales).Error; err != nil {
+		return err
+	}
+	remaining := qty
+	for _, sale := range sales {
+		if remaining <= quantityEpsilon {
+			break
+		}
+		if sale.Quantity <= quantityEpsilon || sale.Agreement == nil {
+			continue
+		}
+		reversed := math.Min(remaining, sale.Quantity)
+		ratio := reversed / sale.Quantity
+		payable := sale.PayableAmount * ratio
+		if payable > 0 {
+			costAccountID := sale.Agreement.CostAccountID
+			if costAccountID == nil {
+				var cogsAccount models.AccountModel
+				if err := tx.Where("is_cogs_account = ? and company_id = ?", true, sale.CompanyID).First(&cogsAccount).Error; err != nil {
+					return errors.New("cogs account not found")
+				}
+				costAccountID = &cogsAccount.ID
+			}
+			if err := postJournal(tx, sale.CompanyID, date, "Batal Hutang Konsinyasi "+description, sale.Agreement.PayableAccountID, costAccountID, payable, sale.ID, userID); err != nil {
+				return err
+			}
+		}
+		updates := map[string]any{
+			"quantity":          sale.Quantity - reversed,
+			"sale_amount":       sale.SaleAmount * (1 - ratio),
+			"commission_amount": sale.CommissionAmount * (1 - ratio),
+			"payable_amount":    sale.PayableAmount - payable,
+		}
+		if sale.Quantity-reversed <= quantityEpsilon {
+			updates["status"] = models.ConsignmentSaleReversed
+		}
+		if err := tx.Model(&models.ConsignmentSaleModel{}).Where("id = ?", sale.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		remaining -= reversed
+	}
+	return nil
+}
+
+// GenerateSettlement settles the open consignment sales of an agreement between start and end.
+//
+// It creates the settlement statement and a posted bill of the supplier over the consignment
+// payable account, which is paid with PaySettlement (PurchaseService.CreatePurchasePayment).
+// The bill posts no journal: the payable was booked when the stock was sold.
+func (s *ConsignmentService) GenerateSettlement(agreementID string, start, end time.Time, userID string) (*models.ConsignmentSettlementModel, error) {
+	agreement, err := s.GetAgreementByID(agreementID)
+	if err != nil {
+		return nil, err
+	}
+	var sales []models.ConsignmentSaleModel
+	if err := s.db.Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Where("agreement_id = ? AND status = ? AND date >= ? AND date <= ?", agreementID, models.ConsignmentSaleOpen, start, end).
+		Order("date asc").Find(&sales).Error; err != nil {
+		return nil, err
+	}
+	if len(sales) == 0 {
+		return nil, errors.New("no consignment sales to settle")
+	}
+
+	settlement := models.ConsignmentSettlementModel{
+		Number:      fmt.Sprintf("CST-%s", utils.RandomStringNumber(8, false)),
+		AgreementID: agreement.ID,
+		CompanyID:   agreement.CompanyID,
+		SupplierID:  agreement.SupplierID,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Status:      models.ConsignmentSettlementPosted,
+	}
+	if userID != "" {
+		settlement.UserID = &userID
+	}
+	settlement.ID = utils.Uuid()
+
+	type billLine struct {
+		description string
+		quantity    float64
+		amount      float64
+	}
+	lines := []*billLine{}
+	byProduct := map[string]*billLine{}
+	ids := make([]string, len(sales))
+	for i, v := range sales {
+		ids[i] = v.ID
+		settlement.TotalQuantity += v.Quantity
+		settlement.TotalSales += v.SaleAmount
+		settlement.TotalCommission += v.CommissionAmount
+		settlement.TotalPayable += v.PayableAmount
+		key := v.ProductID
+		if v.VariantID != nil {
+			key += ":" + *v.VariantID
+		}
+		line, ok := byProduct[key]
+		if !ok {
+			name := v.ProductID
+			if v.Product != nil {
+				name = v.Product.Name
+			}
+			line = &billLine{description: name}
+			byProduct[key] = line
+			lines = append(lines, line)
+		}
+		line.quantity += v.Quantity
+		line.amount += v.PayableAmount
+	}
+
+	contactData, _ := json.Marshal(map[string]any{})
+	if agreement.Supplier != nil {
+		contactData, _ = json.Marshal(map[string]any{
+			"name":    agreement.Supplier.Name,
+			"email":   agreement.Supplier.Email,
+			"phone":   agreement.Supplier.Phone,
+			"address": agreement.Supplier.Address,
+		})
+	}
+	now := time.Now()
+	secondaryRefType := "consignment_settlement"
+	bill := models.PurchaseOrderModel{
+		PurchaseNumber:   fmt.Sprintf("BILL-%s", utils.RandomStringNumber(8, false)),
+		Code:             utils.RandString(10, false),
+		Description:      fmt.Sprintf("Konsinyasi %s", settlement.Number),
+		Notes:            fmt.Sprintf("Periode %s - %s", start.Format("02/01/2006"), end.Format("02/01/2006")),
+		Status:           "POSTED",
+		PurchaseDate:     end,
+		PaymentAccountID: agreement.PayableAccountID,
+		PaymentTermsCode: agreement.PaymentTermsCode,
+		CompanyID:        agreement.CompanyID,
+		ContactID:        &agreement.SupplierID,
+		ContactData:      string(contactData),
+		Type:             models.PURCHASE,
+		DocumentType:     models.BILL,
+		TaxBreakdown:     "{}",
+		PublishedAt:      &now,
+		SecondaryRefID:   &settlement.ID,
+		SecondaryRefType: &secondaryRefType,
+	}
+	if userID != "" {
+		bill.UserID = &userID
+		bill.PublishedByID = &userID
+	}
+	if agreement.PaymentTermsCode != "" {
+		var paymentTerms models.PaymentTermModel
+		if err := s.db.Where("code = ?", agreement.PaymentTermsCode).First(&paymentTerms).Error; err == nil && paymentTerms.DueDays != nil {
+			due := end.AddDate(0, 0, *paymentTerms.DueDays)
+			bill.DueDate = &due
+		}
+	}
+	for _, v := range lines {
+		unitPrice := 0.0
+		if v.quantity != 0 {
+			unitPrice = v.amount / v.quantity
+		}
+		bill.Items = append(bill.Items, models.PurchaseOrderItemModel{
+			Description:        v.description,
+			Quantity:           v.quantity,
+			UnitPrice:          unitPrice,
+			SubtotalBeforeDisc: v.amount,
+			SubTotal:           v.amount,
+			Total:              v.amount,
+			UnitValue:          1,
+		})
+	}
+	bill.TotalBeforeDisc = settlement.TotalPayable
+	bill.TotalBeforeTax = settlement.TotalPayable
+	bill.Subtotal = settlement.TotalPayable
+	bill.Total = settlement.TotalPayable
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Taxes").Create(&bill).Error; err != nil {
+			return err
+		}
+		settlement.PurchaseID = &bill.ID
+		if err := tx.Omit("Sales").Create(&settlement).Error; err != nil {
+			return err
+		}
+		result := tx.Model(&models.ConsignmentSaleModel{}).Where("id IN (?) AND status = ?", ids, models.ConsignmentSaleOpen).Updates(map[string]any{
+			"settlement_id": settlement.ID,
+			"status":        models.ConsignmentSaleSettled,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(ids)) {
+			return errors.New("consignment sales were settled concurrently")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	settlement.Sales = sales
+	settlement.Purchase = &bill
+	return &settlement, nil
+}
+
+// GenerateSettlements settles the open consignment sales between start and end of every active
+// agreement of a company. Agreements without sales to settle are skipped.
+func (s *ConsignmentService) GenerateSettlements(companyID string, start, end time.Time, userID string) ([]models.ConsignmentSettlementModel, error) {
+	var agreementIDs []string
+	if err := s.db.Model(&models.ConsignmentSaleModel{}).
+		Where("company_id = ? AND status = ? AND date >= ? AND date <= ?", companyID, models.ConsignmentSaleOpen, start, end).
+		Distinct("agreement_id").Pluck("agreement_id", &agreementIDs).Error; err != nil {
+		return nil, err
+	}
+	settlements := []models.ConsignmentSettlementModel{}
+	for _, id := range agreementIDs {
+		settlement, err := s.GenerateSettlement(id, start, end, userID)
+		if err != nil {
+			return settlements, err
+		}
+		settlements = append(settlements, *settlement)
+	}
+	return settlements, nil
+}
+
+// PaySettlement pays the bill of a consignment settlement with
+// PurchaseService.CreatePurchasePayment. The settlement is marked paid once its bill is paid in
+// full.
+func (s *ConsignmentService) PaySettlement(settlementID string, payment *models.PurchasePaymentModel) error {
+	var settlement models.ConsignmentSettlementModel
+	if err := s.db.Where("id = ?", settlementID).First(&settlement).Error; err != nil {
+		return err
+	}
+	if settlement.PurchaseID == nil {
+		return errors.New("settlement has no bill")
+	}
+	bill, err := s.purchaseService.GetPurchaseByID(*settlement.PurchaseID)
+	if err != nil {
+		return err
+	}
+	payment.PurchaseID = &bill.ID
+	payment.CompanyID = bill.CompanyID
+	if payment.PaymentDate.IsZero() {
+		payment.PaymentDate = time.Now()
+	}
+	if err := s.purchaseService.CreatePurchasePayment(bill, payment); err != nil {
+		return err
+	}
+	bill, err = s.purchaseService.GetPurchaseByID(bill.ID)
+	if err != nil {
+		return err
+	}
+	if bill.Paid+0.005 >= bill.Total {
+		return s.db.Model(&settlement).Update("status", models.ConsignmentSettlementPaid).Error
+	}
+	return nil
+}
+
+// GetSettlementByID retrieves the statement of a consignment settlement: the settled sales,
+// the supplier, the agreement and the bill.
+func (s *ConsignmentService) GetSettlementByID(id string) (*models.ConsignmentSettlementModel, error) {
+	var settlement models.ConsignmentSettlementModel
+	err := s.db.Preload("Supplier").Preload("Agreement").Preload("Purchase").Preload("Sales", func(db *gorm.DB) *gorm.DB {
+		return db.Order("date asc")
+	}).Preload("Sales.Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "sku")
+	}).Where("id = ?", id).First(&settlement).Error
+	return &settlement, err
+}
+
+// GetSettlements retrieves a paginated list of consignment settlements.
+//
+// The list can be filtered with the supplier_id, agreement_id and status query parameters and
+// is scoped to the company in the ID-Company header.
+func (s *ConsignmentService) GetSettlements(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Supplier", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	})
+	if search != "" {
+		stmt = stmt.Where("number ILIKE ?", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("supplier_id") != "" {
+		stmt = stmt.Where("supplier_id = ?", request.URL.Query().Get("supplier_id"))
+	}
+	if request.URL.Query().Get("agreement_id") != "" {
+		stmt = stmt.Where("agreement_id = ?", request.URL.Query().Get("agreement_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Model(&models.ConsignmentSettlementModel{}).Order("period_end desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.ConsignmentSettlementModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetSales retrieves a paginated list of consignment sales. The list can be filtered with the
+// agreement_id, supplier_id and status query parameters and is scoped to the company in the
+// ID-Company header.
+func (s *ConsignmentService) GetSales(request http.Request) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "sku")
+	}).Model(&models.ConsignmentSaleModel{})
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("agreement_id") != "" {
+		stmt = stmt.Where("agreement_id = ?", request.URL.Query().Get("agreement_id"))
+	}
+	if request.URL.Query().Get("supplier_id") != "" {
+		stmt = stmt.Where("supplier_id = ?", request.URL.Query().Get("supplier_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.ConsignmentSaleModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+func (s *ConsignmentService) checkAgreement(data *models.ConsignmentAgreementModel) error {
+	if data.PayableAccountID == nil {
+		return errors.New("payable account is required")
+	}
+	var account models.AccountModel
+	if err := s.db.Select("id", "type").Where("id = ?", *data.PayableAccountID).First(&account).Error; err != nil {
+		return err
+	}
+	if account.Type != models.LIABILITY {
+		return errors.New("payable account type must be LIABILITY")
+	}
+	if data.Basis == models.ConsignmentBasisCommission && (data.CommissionPercent < 0 || data.CommissionPercent > 100) {
+		return errors.New("commission percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (s *ConsignmentService) moveStock(agreementID string, warehouseID string, lines []StockLine, date time.Time, description string, movementType models.MovementType) ([]models.StockMovementModel, error) {
+	agreement, err := s.GetAgreementByID(agreementID)
+	if err != nil {
+		return nil, err
+	}
+	if movementType == models.MovementTypeConsignmentIn && agreement.Status != models.ConsignmentActive {
+		return nil, errors.New("agreement is not active")
+	}
+	covered := map[string]bool{}
+	for _, v := range agreement.Items {
+		covered[itemKey(v.ProductID, v.VariantID)] = true
+		if v.VariantID == nil {
+			covered[v.ProductID] = true
+		}
+	}
+	refType := "consignment"
+	movements := []models.StockMovementModel{}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, line := range lines {
+			if line.Quantity <= 0 {
+				return errors.New("quantity must be greater than 0")
+			}
+			if !covered[itemKey(line.ProductID, line.VariantID)] && !covered[line.ProductID] {
+				return fmt.Errorf("product %s is not part of the agreement", line.ProductID)
+			}
+			quantity := line.Quantity
+			if movementType == models.MovementTypeConsignmentOut {
+				onHand, err := s.ownerStock(tx, agreement.SupplierID, line.ProductID, line.VariantID, warehouseID)
+				if err != nil {
+					return err
+				}
+				if onHand+quantityEpsilon < quantity {
+					return fmt.Errorf("consignment stock of product %s is %v", line.ProductID, onHand)
+				}
+				quantity = -quantity
+			}
+			movement := models.StockMovementModel{
+				Date:          date,
+				Description:   description,
+				ProductID:     line.ProductID,
+				VariantID:     line.VariantID,
+				WarehouseID:   warehouseID,
+				CompanyID:     agreement.CompanyID,
+				Quantity:      quantity,
+				Type:          movementType,
+				ReferenceID:   agreement.ID,
+				ReferenceType: &refType,
+				OwnerID:       &agreement.SupplierID,
+			}
+			if err := tx.Create(&movement).Error; err != nil {
+				return err
+			}
+			movements = append(movements, movement)
+		}
+		return nil
+	})
+	return movements, err
+}
+
+// activeAgreementItems returns the products of the active agreements covering a product at a
+// date, oldest agreement first.
+func (s *ConsignmentService) activeAgreementItems(tx *gorm.DB, companyID *string, productID string, variantID *string, date time.Time) ([]models.ConsignmentAgreementItemModel, error) {
+	var items []models.ConsignmentAgreementItemModel
+	stmt := tx.Preload("Agreement").
+		Joins("JOIN consignment_agreements ON consignment_agreements.id = consignment_agreement_items.agreement_id").
+		Where("consignment_agreements.deleted_at IS NULL AND consignment_agreements.status = ?", models.ConsignmentActive).
+		Where("consignment_agreements.start_date <= ?", date).
+		Where("consignment_agreements.end_date IS NULL OR consignment_agreements.end_date >= ?", date).
+		Where("consignment_agreement_items.product_id = ?", productID)
+	if companyID != nil {
+		stmt = stmt.Where("consignment_agreements.company_id = ?", *companyID)
+	}
+	if variantID != nil {
+		stmt = stmt.Where("consignment_agreement_items.variant_id = ? OR consignment_agreement_items.variant_id IS NULL", *variantID)
+	} else {
+		stmt = stmt.Where("consignment_agreement_items.variant_id IS NULL")
+	}
+	err := stmt.Order("consignment_agreements.start_date asc").Find(&items).Error
+	return items, err
+}
+
+// ownerStock returns the stock of a product owned by a supplier in a warehouse.
+func (s *ConsignmentService) ownerStock(tx *gorm.DB, ownerID string, productID string, variantID *string, warehouseID string) (float64, error) {
+	var quantity float64
+	stmt := tx.Model(&models.StockMovementModel{}).
+		Where("owner_id = ? AND product_id = ? AND warehouse_id = ?", ownerID, productID, warehouseID)
+	if variantID != nil {
+		stmt = stmt.Where("variant_id = ?", *variantID)
+	}
+	err := stmt.Select("COALESCE(SUM(quantity), 0)").Scan(&quantity).Error
+	return quantity, err
+}
+
+// assignMovement moves qty of a sale movement to the stock of a supplier, splitting the
+// movement when only part of it is consignment stock.
+func (s *ConsignmentService) assignMovement(tx *gorm.DB, movement *models.StockMovementModel, qty float64, ownerID string) (*models.StockMovementModel, error) {
+	if math.Abs(movement.Quantity+qty) <= quantityEpsilon {
+		if err := tx.Model(&models.StockMovementModel{}).Where("id = ?", movement.ID).Update("owner_id", ownerID).Error; err != nil {
+			return nil, err
+		}
+		owned := *movement
+		owned.OwnerID = &ownerID
+		movement.Quantity = 0
+		return &owned, nil
+	}
+	movement.Quantity += qty
+	if err := tx.Model(&models.StockMovementModel{}).Where("id = ?", movement.ID).Update("quantity", movement.Quantity).Error; err != nil {
+		return nil, err
+	}
+	owned := models.StockMovementModel{
+		Date:             movement.Date,
+		Description:      movement.Description,
+		ProductID:        movement.ProductID,
+		VariantID:        movement.VariantID,
+		WarehouseID:      movement.WarehouseID,
+		MerchantID:       movement.MerchantID,
+		DistributorID:    movement.DistributorID,
+		CompanyID:        movement.CompanyID,
+		Quantity:         -qty,
+		Value:            movement.Value,
+		Type:             movement.Type,
+		ReferenceID:      movement.ReferenceID,
+		ReferenceType:    movement.ReferenceType,
+		SecondaryRefID:   movement.SecondaryRefID,
+		SecondaryRefType: movement.SecondaryRefType,
+		UnitID:           movement.UnitID,
+		OwnerID:          &ownerID,
+	}
+	if err := tx.Create(&owned).Error; err != nil {
+		return nil, err
+	}
+	return &owned, nil
+}
+
+// bookSale records a consignment sale and posts its journals.
+func (s *ConsignmentService) bookSale(tx *gorm.DB, req SaleRequest, line SaleLine, item models.ConsignmentAgreementItemModel, movement *models.StockMovementModel, qty float64, userID *string) (*models.ConsignmentSaleModel, error) {
+	agreement := item.Agreement
+	saleAmount := line.UnitPrice * qty
+	payable := item.ConsignmentPrice * qty
+	if agreement.Basis == models.ConsignmentBasisCommission {
+		percent := agreement.CommissionPercent
+		if item.CommissionPercent > 0 {
+			percent = item.CommissionPercent
+		}
+		payable = saleAmount * (1 - percent/100)
+	}
+	record := models.ConsignmentSaleModel{
+		AgreementID:      agreement.ID,
+		CompanyID:        agreement.CompanyID,
+		SupplierID:       agreement.SupplierID,
+		Date:             req.Date,
+		ProductID:        line.ProductID,
+		VariantID:        line.VariantID,
+		WarehouseID:      movement.WarehouseID,
+		Quantity:         qty,
+		SaleAmount:       saleAmount,
+		CommissionAmount: saleAmount - payable,
+		PayableAmount:    payable,
+		ReferenceID:      req.ReferenceID,
+		ReferenceType:    req.ReferenceType,
+		ReferenceItemID:  &line.ItemID,
+		StockMovementID:  &movement.ID,
+		Status:           models.ConsignmentSaleOpen,
+	}
+	record.ID = utils.Uuid()
+	if err := tx.Create(&record).Error; err != nil {
+		return nil, err
+	}
+
+	var cogsAccount models.AccountModel
+	if agreement.CostAccountID == nil || line.UnitCost > 0 {
+		if err := tx.Where("is_cogs_account = ? and company_id = ?", true, agreement.CompanyID).First(&cogsAccount).Error; err != nil {
+			return nil, errors.New("cogs account not found")
+		}
+	}
+	description := fmt.Sprintf("Konsinyasi %s", req.Number)
+	if cost := line.UnitCost * qty; cost > 0 {
+		var inventoryAccount models.AccountModel
+		if err := tx.Where("is_inventory_account = ? and company_id = ?", true, agreement.CompanyID).First(&inventoryAccount).Error; err != nil {
+			return nil, errors.New("inventory account not found")
+		}
+		// consignment stock was never valued, undo the cost the sale booked
+		if err := postJournal(tx, agreement.CompanyID, req.Date, "Koreksi HPP "+description, &inventoryAccount.ID, &cogsAccount.ID, cost, record.ID, userID); err != nil {
+			return nil, err
+		}
+	}
+	costAccountID := agreement.CostAccountID
+	if costAccountID == nil {
+		costAccountID = &cogsAccount.ID
+	}
+	if payable > 0 {
+		if err := postJournal(tx, agreement.CompanyID, req.Date, "Hutang "+description, costAccountID, agreement.PayableAccountID, payable, record.ID, userID); err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+func postJournal(tx *gorm.DB, companyID *string, date time.Time, description string, debitAccountID, creditAccountID *string, amount float64, refID string, userID *string) error {
+	if debitAccountID == nil || creditAccountID == nil {
+		return errors.New("journal accounts are required")
+	}
+	debitID := utils.Uuid()
+	creditID := utils.Uuid()
+	err := tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: debitID},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   debitAccountID,
+		Description:                 description,
+		TransactionRefID:            &creditID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &refID,
+		TransactionSecondaryRefType: "consignment_sale",
+		CompanyID:                   companyID,
+		Debit:                       amount,
+		Amount:                      amount,
+		UserID:                      userID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: creditID},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   creditAccountID,
+		Description:                 description,
+		TransactionRefID:            &debitID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &refID,
+		TransactionSecondaryRefType: "consignment_sale",
+		CompanyID:                   companyID,
+		Credit:                      amount,
+		Amount:                      amount,
+		UserID:                      userID,
+	}).Error
+}
+
+func itemKey(productID string, variantID *string) string {
+	if variantID == nil {
+		return productID
+	}
+	return productID + ":" + *variantID
+}
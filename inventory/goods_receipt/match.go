@@ -0,0 +1,496 @@
+package goods_receipt
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/inventory/purchase"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ThreeWayMatchService matches vendor bills against their purchase order lines and goods receipts.
+type ThreeWayMatchService struct {
+	db                  *gorm.DB
+	ctx                 *context.ERPContext
+	purchaseService     *purchase.PurchaseService
+	goodsReceiptService *GoodsReceiptService
+}
+
+// NewThreeWayMatchService creates a new instance of ThreeWayMatchService with the given database connection, context, purchase service and goods receipt service.
+func NewThreeWayMatchService(db *gorm.DB, ctx *context.ERPContext, purchaseService *purchase.PurchaseService, goodsReceiptService *GoodsReceiptService) *ThreeWayMatchService {
+	return &ThreeWayMatchService{
+		db:                  db,
+		ctx:                 ctx,
+		purchaseService:     purchaseService,
+		goodsReceiptService: goodsReceiptService,
+	}
+}
+
+// CreateBillFromPurchase creates a draft vendor bill for the received but not yet billed quantities of a purchase order.
+//
+// Every bill line references its purchase order line through RefItemID, so it can be
+// matched later. Lines without a product are billed for their unbilled ordered quantity.
+// The vendor's prices can be changed on the draft bill before calling MatchBill.
+func (s *ThreeWayMatchService) CreateBillFromPurchase(purchaseID string, userID string, date time.Time) (*models.PurchaseOrderModel, error) {
+	var po models.PurchaseOrderModel
+	if err := s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Tax").Order("created_at ASC")
+	}).Where("id = ?", purchaseID).First(&po).Error; err != nil {
+		return nil, err
+	}
+	if po.DocumentType == models.BILL {
+		return nil, errors.New("document is already a bill")
+	}
+	refType := "purchase_order"
+	bill := models.PurchaseOrderModel{
+		PurchaseNumber:   fmt.Sprintf("BILL-%s", utils.RandomStringNumber(8, false)),
+		Description:      po.Description,
+		PurchaseDate:     date,
+		Status:           "DRAFT",
+		PaymentAccountID: po.PaymentAccountID,
+		PaymentTerms:     po.PaymentTerms,
+		PaymentTermsCode: po.PaymentTermsCode,
+		CompanyID:        po.CompanyID,
+		UserID:           &userID,
+		ContactID:        po.ContactID,
+		ContactData:      po.ContactData,
+		Type:             po.Type,
+		DocumentType:     models.BILL,
+		RefID:            &po.ID,
+		RefType:          &refType,
+		TaxBreakdown:     "{}",
+		MatchStatus:      models.MatchStatusUnmatched,
+	}
+	for _, v := range po.Items {
+		qty := v.Quantity - v.BilledQuantity
+		if v.ProductID != nil && !v.IsCost {
+			qty = v.ReceivedQuantity - v.BilledQuantity
+		}
+		if qty <= 0 {
+			continue
+		}
+		item := models.PurchaseOrderItemModel{
+			Description:     v.Description,
+			Notes:           v.Notes,
+			Quantity:        qty,
+			UnitPrice:       v.UnitPrice,
+			DiscountPercent: v.DiscountPercent,
+			ProductID:       v.ProductID,
+			VariantID:       v.VariantID,
+			WarehouseID:     v.WarehouseID,
+			TaxID:           v.TaxID,
+			Tax:             v.Tax,
+			UnitID:          v.UnitID,
+			UnitValue:       v.UnitValue,
+			IsCost:          v.IsCost,
+			RefItemID:       &v.ID,
+		}
+		if v.DiscountPercent == 0 && v.Quantity > 0 {
+			item.DiscountAmount = v.DiscountAmount * qty / v.Quantity
+		}
+		calculateLine(&item)
+		item.Tax = nil
+		bill.Items = append(bill.Items, item)
+	}
+	if len(bill.Items) == 0 {
+		return nil, errors.New("purchase order has nothing to bill")
+	}
+	if err := s.db.Omit("Taxes").Create(&bill).Error; err != nil {
+		return nil, err
+	}
+	if err := s.purchaseService.UpdateTotal(&bill); err != nil {
+		return nil, err
+	}
+	return &bill, nil
+}
+
+// MatchBill compares every line of a vendor bill with its purchase order line and goods receipts.
+//
+// A line has a quantity variance when the quantity billed so far for the purchase
+// order line (including other bills that are not draft or cancelled) exceeds the received quantity beyond the quantity
+// tolerance. A line has a price variance when the billed net unit price differs from
+// the purchase order net unit price beyond the price tolerance (percentage, or the
+// absolute amount per unit when set). Lines without a purchase order reference are
+// unmatched, cost lines are ignored.
+//
+// The previous match results of the bill are replaced. The bill's match status is
+// updated and, when the company holds mismatched bills, the bill is put on payment
+// hold until the variances are resolved or the hold is released manually.
+func (s *ThreeWayMatchService) MatchBill(billID string) ([]models.PurchaseMatchModel, error) {
+	var bill models.PurchaseOrderModel
+	if err := s.db.Preload("Items").Where("id = ?", billID).First(&bill).Error; err != nil {
+		return nil, err
+	}
+	if bill.DocumentType != models.BILL {
+		return nil, errors.New("document type is not bill")
+	}
+	setting, err := s.goodsReceiptService.GetMatchSetting(bill.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	matches := []models.PurchaseMatchModel{}
+	hasQtyVariance := false
+	hasPriceVariance := false
+	reasons := []string{}
+	for _, v := range bill.Items {
+		if v.IsCost {
+			continue
+		}
+		match := models.PurchaseMatchModel{
+			BillID:          bill.ID,
+			BillItemID:      v.ID,
+			Description:     v.Description,
+			BilledQuantity:  v.Quantity,
+			BilledUnitPrice: PurchaseUnitPrice(v),
+			MatchedAt:       now,
+		}
+		if v.RefItemID == nil {
+			match.Status = models.MatchStatusUnmatched
+			match.Notes = "bill line has no purchase order reference"
+			hasQtyVariance = true
+			reasons = append(reasons, fmt.Sprintf("%s: no purchase order reference", v.Description))
+			matches = append(matches, match)
+			continue
+		}
+		var poItem models.PurchaseOrderItemModel
+		if err := s.db.Where("id = ?", *v.RefItemID).First(&poItem).Error; err != nil {
+			return nil, err
+		}
+		var otherBilled float64
+		if err := s.db.Model(&models.PurchaseOrderItemModel{}).
+			Where("ref_item_id = ? AND purchase_id <> ?", poItem.ID, bill.ID).
+			Where("purchase_id IN (?)", s.db.Model(&models.PurchaseOrderModel{}).Select("id").Where("status NOT IN ?", []string{"DRAFT", "cancelled"})).
+			Select("COALESCE(SUM(quantity), 0)").
+			Scan(&otherBilled).Error; err != nil {
+			return nil, err
+		}
+		received := poItem.ReceivedQuantity
+		if poItem.ProductID == nil {
+			received = poItem.Quantity
+		}
+		match.PurchaseID = poItem.PurchaseID
+		match.PurchaseItemID = &poItem.ID
+		match.OrderedQuantity = poItem.Quantity
+		match.ReceivedQuantity = received
+		match.BilledQuantity = otherBilled + v.Quantity
+		match.OrderedUnitPrice = PurchaseUnitPrice(poItem)
+		match.QuantityVariance = match.BilledQuantity - received
+		match.PriceVariance = match.BilledUnitPrice - match.OrderedUnitPrice
+		if match.OrderedUnitPrice != 0 {
+			match.PriceVariancePct = match.PriceVariance / match.OrderedUnitPrice * 100
+		}
+		match.PriceVarianceAmount = v.SubTotal - v.Quantity*s.goodsReceiptService.ReceiptUnitCost(setting, poItem)
+
+		qtyOK := match.QuantityVariance <= received*setting.QuantityTolerance/100+quantityEpsilon
+		priceOK := math.Abs(match.PriceVariancePct) <= setting.PriceTolerance+quantityEpsilon
+		if !priceOK && setting.PriceToleranceAmount > 0 {
+			priceOK = math.Abs(match.PriceVariance) <= setting.PriceToleranceAmount
+		}
+		switch {
+		case !qtyOK && !priceOK:
+			match.Status = models.MatchStatusQuantityPriceVariance
+		case !qtyOK:
+			match.Status = models.MatchStatusQuantityVariance
+		case !priceOK:
+			match.Status = models.MatchStatusPriceVariance
+		default:
+			match.Status = models.MatchStatusMatched
+		}
+		if !qtyOK {
+			hasQtyVariance = true
+			reasons = append(reasons, fmt.Sprintf("%s: billed %.2f, received %.2f", v.Description, match.BilledQuantity, received))
+		}
+		if !priceOK {
+			hasPriceVariance = true
+			reasons = append(reasons, fmt.Sprintf("%s: billed price %.2f, ordered %.2f", v.Description, match.BilledUnitPrice, match.OrderedUnitPrice))
+		}
+		matches = append(matches, match)
+	}
+
+	status := models.MatchStatusMatched
+	switch {
+	case hasQtyVariance && hasPriceVariance:
+		status = models.MatchStatusQuantityPriceVariance
+	case hasQtyVariance:
+		status = models.MatchStatusQuantityVariance
+	case hasPriceVariance:
+		status = models.MatchStatusPriceVariance
+	}
+	hold := setting.HoldOnMismatch && status != models.MatchStatusMatched
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("bill_id = ?", bill.ID).Unscoped().Delete(&models.PurchaseMatchModel{}).Error; err != nil {
+			return err
+		}
+		if len(matches) > 0 {
+			if err := tx.Create(&matches).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.PurchaseOrderModel{}).Where("id = ?", bill.ID).Updates(map[string]any{
+			"match_status":        status,
+			"payment_hold":        hold,
+			"payment_hold_reason": strings.Join(reasons, "; "),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// GetMatches returns the latest match results of a vendor bill.
+func (s *ThreeWayMatchService) GetMatches(billID string) ([]models.PurchaseMatchModel, error) {
+	var matches []models.PurchaseMatchModel
+	err := s.db.Where("bill_id = ?", billID).Order("created_at ASC").Find(&matches).Error
+	return matches, err
+}
+
+// HoldPayment puts a vendor bill on payment hold manually.
+func (s *ThreeWayMatchService) HoldPayment(billID string, reason string) error {
+	return s.db.Model(&models.PurchaseOrderModel{}).Where("id = ? AND document_type = ?", billID, models.BILL).Updates(map[string]any{
+		"payment_hold":        true,
+		"payment_hold_reason": reason,
+	}).Error
+}
+
+// ReleasePaymentHold releases the payment hold of a vendor bill, e.g. after the vendor
+// issued a credit note or the variance has been accepted.
+func (s *ThreeWayMatchService) ReleasePaymentHold(billID string, userID string, notes string) error {
+	var user models.UserModel
+	s.db.Select("id", "full_name").Where("id = ?", userID).First(&user)
+	return s.db.Model(&models.PurchaseOrderModel{}).Where("id = ? AND document_type = ?", billID, models.BILL).Updates(map[string]any{
+		"payment_hold":        false,
+		"payment_hold_reason": fmt.Sprintf("released by %s: %s", user.FullName, notes),
+	}).Error
+}
+
+// PostBill posts a vendor bill that references purchase order lines received through goods receipts.
+//
+// The bill is matched again before posting. For every referenced line the billed
+// quantity is allocated to the unbilled goods receipt lines (oldest first) and the
+// accrued payable account is debited with their receipt value. The difference between
+// the billed amount and the receipt value is posted to the purchase price variance
+// account. Lines without a reference are debited to the inventory account like
+// PurchaseService.PostPurchase does. The bill total is credited to the payment account.
+//
+// Stock is not moved here, it was already moved by the goods receipts. All entries are dated
+// with date. A posted bill is refused before it
+// is matched again, so its payment hold is kept.
+func (s *ThreeWayMatchService) PostBill(billID string, userID string, date time.Time) error {
+	var status string
+	if err := s.db.Model(&models.PurchaseOrderModel{}).Select("status").Where("id = ?", billID).Scan(&status).Error; err != nil {
+		return err
+	}
+	if status == "POSTED" {
+		return errors.New("bill already posted")
+	}
+	if _, err := s.MatchBill(billID); err != nil {
+		return err
+	}
+	var bill models.PurchaseOrderModel
+	if err := s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Tax").Order("created_at ASC")
+	}).Where("id = ?", billID).First(&bill).Error; err != nil {
+		return err
+	}
+	if bill.PaymentAccountID == nil {
+		return errors.New("payment account is required")
+	}
+	if len(bill.Items) == 0 {
+		return errors.New("items is required")
+	}
+	setting, err := s.goodsReceiptService.GetMatchSetting(bill.CompanyID)
+	if err != nil {
+		return err
+	}
+	if setting.AccruedPayableAccountID == nil {
+		return errors.New("accrued payable account is not set")
+	}
+	var inventoryAccount models.AccountModel
+	if err := s.db.Where("is_inventory_account = ? and company_id = ?", true, *bill.CompanyID).First(&inventoryAccount).Error; err != nil {
+		return errors.New("inventory account not found")
+	}
+
+	if bill.PaymentTermsCode != "" && bill.DueDate == nil {
+		var paymentTerms models.PaymentTermModel
+		if err := s.db.Find(&paymentTerms, "code = ?", bill.PaymentTermsCode).Error; err == nil && paymentTerms.DueDays != nil {
+			due := date.AddDate(0, 0, *paymentTerms.DueDays)
+			bill.DueDate = &due
+		}
+	}
+
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		totalPayment := 0.0
+		for _, v := range bill.Items {
+			totalPayment += v.SubTotal + v.TotalTax
+			if v.TaxID != nil && v.TotalTax != 0 {
+				if v.Tax == nil || v.Tax.AccountReceivableID == nil {
+					return errors.New("tax account receivable ID is required")
+				}
+				if err := s.createTransaction(tx, &bill, v, date, v.Tax.AccountReceivableID, "Piutang Pajak ", v.TotalTax, 0, userID, func(t *models.TransactionModel) {
+					t.IsAccountReceivable = true
+					t.IsTax = true
+				}); err != nil {
+					return err
+				}
+			}
+
+			if v.RefItemID == nil {
+				label := "Pembelian "
+				if v.IsCost {
+					label = "Biaya "
+				}
+				if err := s.createTransaction(tx, &bill, v, date, &inventoryAccount.ID, label, v.SubTotal, 0, userID, func(t *models.TransactionModel) {
+					t.IsPurchase = true
+					t.IsPurchaseCost = v.IsCost
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			var poItem models.PurchaseOrderItemModel
+			if err := tx.Where("id = ?", *v.RefItemID).First(&poItem).Error; err != nil {
+				return err
+			}
+			receiptValue, err := s.allocateReceipts(tx, poItem, v.Quantity, setting)
+			if err != nil {
+				return err
+			}
+			if receiptValue != 0 {
+				if err := s.createTransaction(tx, &bill, v, date, setting.AccruedPayableAccountID, "Pembelian ", receiptValue, 0, userID, func(t *models.TransactionModel) {
+					t.IsAccountPayable = true
+				}); err != nil {
+					return err
+				}
+			}
+			variance := utils.AmountRound(v.SubTotal-receiptValue, 2)
+			if variance != 0 {
+				if setting.PriceVarianceAccountID == nil {
+					return errors.New("purchase price variance account is not set")
+				}
+				debit, credit := variance, 0.0
+				if variance < 0 {
+					debit, credit = 0, -variance
+				}
+				if err := s.createTransaction(tx, &bill, v, date, setting.PriceVarianceAccountID, "Selisih Harga Pembelian ", debit, credit, userID, func(t *models.TransactionModel) {
+					t.IsPurchase = true
+				}); err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&models.PurchaseOrderItemModel{}).Where("id = ?", poItem.ID).
+				Update("billed_quantity", gorm.Expr("billed_quantity + ?", v.Quantity)).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Create(&models.TransactionModel{
+			Code:               utils.RandString(10, false),
+			Date:               date,
+			AccountID:          bill.PaymentAccountID,
+			Description:        "Pembelian " + bill.PurchaseNumber,
+			TransactionRefID:   &bill.ID,
+			TransactionRefType: "purchase",
+			CompanyID:          bill.CompanyID,
+			Credit:             totalPayment,
+			Amount:             totalPayment,
+			UserID:             &userID,
+			IsAccountPayable:   true,
+		}).Error; err != nil {
+			return err
+		}
+
+		bill.Status = "POSTED"
+		bill.PublishedAt = &now
+		bill.PublishedByID = &userID
+		return tx.Omit(clause.Associations).Save(&bill).Error
+	})
+}
+
+// allocateReceipts marks quantity of the unbilled goods receipt lines of a purchase order line
+// as billed (oldest first) and returns the receipt value of the allocated quantity.
+//
+// Quantity billed beyond the received quantity is valued at the current receipt unit cost.
+func (s *ThreeWayMatchService) allocateReceipts(tx *gorm.DB, poItem models.PurchaseOrderItemModel, quantity float64, setting *models.PurchaseMatchSettingModel) (float64, error) {
+	var receiptItems []models.GoodsReceiptItemModel
+	err := tx.Joins("JOIN goods_receipts ON goods_receipts.id = goods_receipt_items.goods_receipt_id").
+		Where("goods_receipt_items.purchase_item_id = ? AND goods_receipts.status = ? AND goods_receipt_items.quantity > goods_receipt_items.billed_quantity", poItem.ID, "POSTED").
+		Order("goods_receipts.date ASC").
+		Find(&receiptItems).Error
+	if err != nil {
+		return 0, err
+	}
+	remaining := quantity
+	value := 0.0
+	for _, r := range receiptItems {
+		if remaining <= quantityEpsilon {
+			break
+		}
+		qty := math.Min(remaining, r.Quantity-r.BilledQuantity)
+		value += qty * r.UnitCost
+		remaining -= qty
+		if err := tx.Model(&models.GoodsReceiptItemModel{}).Where("id = ?", r.ID).
+			Update("billed_quantity", r.BilledQuantity+qty).Error; err != nil {
+			return 0, err
+		}
+	}
+	if remaining > quantityEpsilon {
+		value += remaining * s.goodsReceiptService.ReceiptUnitCost(setting, poItem)
+	}
+	return utils.AmountRound(value, 2), nil
+}
+
+func (s *ThreeWayMatchService) createTransaction(tx *gorm.DB, bill *models.PurchaseOrderModel, item models.PurchaseOrderItemModel, date time.Time, accountID *string, label string, debit, credit float64, userID string, fn func(*models.TransactionModel)) error {
+	trans := models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: utils.Uuid()},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   accountID,
+		Description:                 label + bill.PurchaseNumber,
+		Notes:                       item.Description,
+		TransactionRefID:            &bill.ID,
+		TransactionRefType:          "purchase",
+		TransactionSecondaryRefID:   &item.ID,
+		TransactionSecondaryRefType: "purchase_item",
+		CompanyID:                   bill.CompanyID,
+		Debit:                       debit,
+		Credit:                      credit,
+		Amount:                      debit + credit,
+		UserID:                      &userID,
+	}
+	if fn != nil {
+		fn(&trans)
+	}
+	return tx.Create(&trans).Error
+}
+
+// calculateLine computes the totals of a purchase line the same way PurchaseService.UpdateItem does.
+func calculateLine(item *models.PurchaseOrderItemModel) {
+	taxPercent := 0.0
+	if item.Tax != nil {
+		taxPercent = item.Tax.Amount
+	}
+	if item.UnitValue == 0 {
+		item.UnitValue = 1
+	}
+	item.SubtotalBeforeDisc = (item.Quantity * item.UnitValue) * item.UnitPrice
+	if item.DiscountPercent > 0 {
+		item.DiscountAmount = item.SubtotalBeforeDisc * item.DiscountPercent / 100
+	}
+	item.SubTotal = item.SubtotalBeforeDisc - item.DiscountAmount
+	item.TotalTax = item.SubTotal * (taxPercent / 100)
+	item.Total = item.SubTotal + item.TotalTax
+}
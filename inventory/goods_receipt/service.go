@@ -0,0 +1,541 @@
+package goods_receipt
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/finance"
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// quantityEpsilon absorbs floating point noise when comparing quantities.
+const quantityEpsilon = 0.000001
+
+type GoodsReceiptService struct {
+	db                   *gorm.DB
+	ctx                  *context.ERPContext
+	financeService       *finance.FinanceService
+	stockMovementService *stockmovement.StockMovementService
+}
+
+// NewGoodsReceiptService creates a new instance of GoodsReceiptService with the given database connection, context, finance service and stock movement service.
+func NewGoodsReceiptService(db *gorm.DB, ctx *context.ERPContext, financeService *finance.FinanceService, stockMovementService *stockmovement.StockMovementService) *GoodsReceiptService {
+	return &GoodsReceiptService{
+		db:                   db,
+		ctx:                  ctx,
+		financeService:       financeService,
+		stockMovementService: stockMovementService,
+	}
+}
+
+// Migrate migrates the database schema needed for goods receipts and three-way matching.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.GoodsReceiptModel{},
+		&models.GoodsReceiptItemModel{},
+		&models.PurchaseMatchSettingModel{},
+		&models.PurchaseMatchModel{},
+	)
+}
+
+// GetMatchSetting returns the three-way matching setting of the company.
+//
+// When the company has no setting yet, a default setting (zero tolerance,
+// PO cost basis and payment hold on mismatch) is returned without being saved.
+func (s *GoodsReceiptService) GetMatchSetting(companyID *string) (*models.PurchaseMatchSettingModel, error) {
+	var setting models.PurchaseMatchSettingModel
+	if companyID == nil {
+		return nil, errors.New("company ID is required")
+	}
+	err := s.db.Where("company_id = ?", *companyID).First(&setting).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &models.PurchaseMatchSettingModel{
+			CompanyID:      companyID,
+			CostBasis:      "PO",
+			HoldOnMismatch: true,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+// SaveMatchSetting creates or updates the three-way matching setting of the company.
+func (s *GoodsReceiptService) SaveMatchSetting(data *models.PurchaseMatchSettingModel) error {
+	if data.CompanyID == nil {
+		return errors.New("company ID is required")
+	}
+	if data.CostBasis != "PO" && data.CostBasis != "STANDARD" {
+		return errors.New("cost basis must be PO or STANDARD")
+	}
+	var existing models.PurchaseMatchSettingModel
+	err := s.db.Where("company_id = ?", *data.CompanyID).First(&existing).Error
+	if err == nil {
+		data.ID = existing.ID
+		return s.db.Omit(clause.Associations).Save(data).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return s.db.Create(data).Error
+}
+
+// PurchaseUnitPrice returns the net unit price (after discount, before tax) of a purchase order line.
+func PurchaseUnitPrice(item models.PurchaseOrderItemModel) float64 {
+	if item.Quantity == 0 {
+		return item.UnitPrice * item.UnitValue
+	}
+	return item.SubTotal / item.Quantity
+}
+
+// ReceiptUnitCost returns the unit cost used to value received goods of a purchase order line.
+//
+// With the STANDARD cost basis the product's standard cost is used when it is set,
+// otherwise the net purchase order price is used.
+func (s *GoodsReceiptService) ReceiptUnitCost(setting *models.PurchaseMatchSettingModel, item models.PurchaseOrderItemModel) float64 {
+	if setting.CostBasis == "STANDARD" && item.ProductID != nil {
+		var product models.ProductModel
+		if err := s.db.Select("id", "standard_cost").Where("id = ?", *item.ProductID).First(&product).Error; err == nil && product.StandardCost > 0 {
+			unitValue := item.UnitValue
+			if unitValue == 0 {
+				unitValue = 1
+			}
+			return product.StandardCost * unitValue
+		}
+	}
+	return PurchaseUnitPrice(item)
+}
+
+// CreateReceipt creates a draft goods receipt.
+func (s *GoodsReceiptService) CreateReceipt(data *models.GoodsReceiptModel) error {
+	if data.ReceiptNumber == "" {
+		data.ReceiptNumber = fmt.Sprintf("GR-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.Date.IsZero() {
+		data.Date = time.Now()
+	}
+	data.Status = "DRAFT"
+	return s.db.Create(data).Error
+}
+
+// CreateReceiptFromPurchase creates a draft goods receipt for the outstanding quantities of a purchase order.
+//
+// quantities maps purchase order item IDs to the quantity received. When it is nil,
+// every line is received in full for its outstanding quantity. Lines without a product
+// and cost lines are skipped.
+func (s *GoodsReceiptService) CreateReceiptFromPurchase(purchaseID string, quantities map[string]float64, date time.Time, userID string, description string) (*models.GoodsReceiptModel, error) {
+	var purchase models.PurchaseOrderModel
+	if err := s.db.Preload("Items").Where("id = ?", purchaseID).First(&purchase).Error; err != nil {
+		return nil, err
+	}
+	if purchase.DocumentType == models.BILL {
+		return nil, errors.New("goods can only be received against a purchase order")
+	}
+	data := models.GoodsReceiptModel{
+		Date:        date,
+		PurchaseID:  purchase.ID,
+		ContactID:   purchase.ContactID,
+		Description: description,
+		UserID:      &userID,
+		CompanyID:   purchase.CompanyID,
+	}
+	for _, v := range purchase.Items {
+		if v.ProductID == nil || v.IsCost {
+			continue
+		}
+		qty := v.Quantity - v.ReceivedQuantity
+		if quantities != nil {
+			q, ok := quantities[v.ID]
+			if !ok {
+				continue
+			}
+			qty = q
+		}
+		if qty <= 0 {
+			continue
+		}
+		data.Items = append(data.Items, models.GoodsReceiptItemModel{
+			PurchaseItemID: v.ID,
+			Description:    v.Description,
+			ProductID:      v.ProductID,
+			VariantID:      v.VariantID,
+			WarehouseID:    v.WarehouseID,
+			UnitID:         v.UnitID,
+			UnitValue:      v.UnitValue,
+			Quantity:       qty,
+		})
+	}
+	if len(data.Items) == 0 {
+		return nil, errors.New("purchase order has no outstanding item to receive")
+	}
+	if err := s.CreateReceipt(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// UpdateReceipt updates the header of a draft goods receipt.
+func (s *GoodsReceiptService) UpdateReceipt(id string, data *models.GoodsReceiptModel) error {
+	return s.db.Omit(clause.Associations, "status", "purchase_id").Where("id = ? AND status = ?", id, "DRAFT").Updates(data).Error
+}
+
+// UpdateItemQuantity changes the received quantity of a line on a draft goods receipt.
+func (s *GoodsReceiptService) UpdateItemQuantity(receiptID, itemID string, quantity float64) error {
+	receipt, err := s.GetReceiptByID(receiptID)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != "DRAFT" {
+		return errors.New("only draft goods receipt can be changed")
+	}
+	if quantity <= 0 {
+		return errors.New("quantity must be greater than zero")
+	}
+	return s.db.Model(&models.GoodsReceiptItemModel{}).Where("id = ? AND goods_receipt_id = ?", itemID, receiptID).Update("quantity", quantity).Error
+}
+
+// DeleteReceipt deletes a draft goods receipt.
+func (s *GoodsReceiptService) DeleteReceipt(id string) error {
+	receipt, err := s.GetReceiptByID(id)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != "DRAFT" {
+		return errors.New("only draft goods receipt can be deleted")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("goods_receipt_id = ?", id).Delete(&models.GoodsReceiptItemModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.GoodsReceiptModel{}).Error
+	})
+}
+
+// GetReceipts retrieves a paginated list of goods receipts.
+//
+// The list can be filtered with the purchase_id and status query parameters.
+func (s *GoodsReceiptService) GetReceipts(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Contact").Preload("Purchase", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "purchase_number", "contact_data", "tax_breakdown")
+	})
+	if search != "" {
+		stmt = stmt.Where("receipt_number ILIKE ? OR description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("purchase_id") != "" {
+		stmt = stmt.Where("purchase_id = ?", request.URL.Query().Get("purchase_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	if request.URL.Query().Get("order") != "" {
+		stmt = stmt.Order(request.URL.Query().Get("order"))
+	} else {
+		stmt = stmt.Order("date DESC")
+	}
+	stmt = stmt.Model(&models.GoodsReceiptModel{})
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.GoodsReceiptModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetReceiptByID retrieves a goods receipt with its items.
+func (s *GoodsReceiptService) GetReceiptByID(id string) (*models.GoodsReceiptModel, error) {
+	var receipt models.GoodsReceiptModel
+	err := s.db.
+		Preload("Contact").
+		Preload("Items", func(db *gorm.DB) *gorm.DB {
+			return db.Preload("Product").Preload("Variant").Preload("Warehouse").Preload("Unit").Order("created_at ASC")
+		}).
+		Where("id = ?", id).First(&receipt).Error
+	if err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// GetReceiptsByPurchaseID retrieves all posted goods receipts of a purchase order.
+func (s *GoodsReceiptService) GetReceiptsByPurchaseID(purchaseID string) ([]models.GoodsReceiptModel, error) {
+	var receipts []models.GoodsReceiptModel
+	err := s.db.Preload("Items").
+		Where("purchase_id = ? AND status = ?", purchaseID, "POSTED").
+		Order("date ASC").Find(&receipts).Error
+	return receipts, err
+}
+
+// PostReceipt posts a draft goods receipt.
+//
+// Each line adds stock to its warehouse, updates the average cost of the product and
+// increases the received quantity of the purchase order line. Lines may not exceed the
+// outstanding quantity of the purchase order line plus the quantity tolerance of the
+// company. The received value is debited to the inventory account and credited to the
+// accrued payable (goods received not invoiced) account, which is cleared when the vendor
+// bill is posted.
+func (s *GoodsReceiptService) PostReceipt(id string, userID string) error {
+	receipt, err := s.GetReceiptByID(id)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != "DRAFT" {
+		return errors.New("goods receipt is not draft")
+	}
+	if len(receipt.Items) == 0 {
+		return errors.New("items is required")
+	}
+	if receipt.CompanyID == nil {
+		return errors.New("company ID is required")
+	}
+	setting, err := s.GetMatchSetting(receipt.CompanyID)
+	if err != nil {
+		return err
+	}
+	if setting.AccruedPayableAccountID == nil {
+		return errors.New("accrued payable account is not set")
+	}
+	var inventoryAccount models.AccountModel
+	if err := s.db.Where("is_inventory_account = ? and company_id = ?", true, *receipt.CompanyID).First(&inventoryAccount).Error; err != nil {
+		return errors.New("inventory account not found")
+	}
+	var purchase models.PurchaseOrderModel
+	if err := s.db.Preload("Items").Where("id = ?", receipt.PurchaseID).First(&purchase).Error; err != nil {
+		return err
+	}
+	poItems := map[string]*models.PurchaseOrderItemModel{}
+	for i := range purchase.Items {
+		poItems[purchase.Items[i].ID] = &purchase.Items[i]
+	}
+
+	refType := "purchase"
+	secRefType := "goods_receipt"
+	now := time.Now()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		s.stockMovementService.SetDB(tx)
+		total := 0.0
+		for _, v := range receipt.Items {
+			poItem, ok := poItems[v.PurchaseItemID]
+			if !ok {
+				return fmt.Errorf("purchase item %s not found", v.PurchaseItemID)
+			}
+			if v.Quantity <= 0 {
+				return errors.New("quantity must be greater than zero")
+			}
+			maxQty := poItem.Quantity*(1+setting.QuantityTolerance/100) - poItem.ReceivedQuantity
+			if v.Quantity > maxQty+quantityEpsilon {
+				return fmt.Errorf("received quantity of %s exceeds outstanding quantity %.2f", poItem.Description, poItem.Quantity-poItem.ReceivedQuantity)
+			}
+			if v.ProductID == nil || v.WarehouseID == nil {
+				return errors.New("product and warehouse are required")
+			}
+
+			v.UnitCost = s.ReceiptUnitCost(setting, *poItem)
+			v.Total = v.UnitCost * v.Quantity
+			v.LandedUnitCost = v.UnitCost
+			total += v.Total
+
+			movement, err := s.stockMovementService.AddMovement(
+				receipt.Date,
+				*v.ProductID,
+				*v.WarehouseID,
+				v.VariantID,
+				nil,
+				nil,
+				receipt.CompanyID,
+				v.Quantity,
+				models.MovementTypePurchase,
+				purchase.ID,
+				fmt.Sprintf("Goods Receipt %s (%s)", receipt.ReceiptNumber, v.Description))
+			if err != nil {
+				return err
+			}
+			movement.ReferenceType = &refType
+			movement.SecondaryRefID = &receipt.ID
+			movement.SecondaryRefType = &secRefType
+			movement.Value = v.UnitValue
+			movement.UnitID = v.UnitID
+			if err := tx.Save(movement).Error; err != nil {
+				return err
+			}
+
+			unitValue := v.UnitValue
+			if unitValue == 0 {
+				unitValue = 1
+			}
+			if err := stockmovement.UpdateAverageCost(tx, *v.ProductID, v.Quantity*unitValue, v.Total); err != nil {
+				return err
+			}
+
+			if err := tx.Omit(clause.Associations).Save(&v).Error; err != nil {
+				return err
+			}
+			poItem.ReceivedQuantity += v.Quantity
+			if err := tx.Model(&models.PurchaseOrderItemModel{}).Where("id = ?", poItem.ID).Update("received_quantity", poItem.ReceivedQuantity).Error; err != nil {
+				return err
+			}
+		}
+
+		if total > 0 {
+			if err := s.createJournal(tx, receipt, &inventoryAccount.ID, setting.AccruedPayableAccountID, total, userID); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&models.PurchaseOrderModel{}).Where("id = ?", purchase.ID).Update("stock_status", receivedStatus(purchase.Items)).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.GoodsReceiptModel{}).Where("id = ?", receipt.ID).Updates(map[string]any{
+			"status":       "POSTED",
+			"posted_at":    now,
+			"posted_by_id": userID,
+			"total":        total,
+		}).Error
+	})
+	s.stockMovementService.SetDB(s.db)
+	return err
+}
+
+// CancelReceipt reverses a posted goods receipt that has not been billed yet and has no posted
+// landed cost voucher; the vouchers must be cancelled first so their cost leaves the average
+// cost of the products.
+//
+// The stock movements and journal entries of the receipt are removed and the
+// received quantities of the purchase order lines are reduced again.
+func (s *GoodsReceiptService) CancelReceipt(id string) error {
+	receipt, err := s.GetReceiptByID(id)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != "POSTED" {
+		return errors.New("goods receipt is not posted")
+	}
+	for _, v := range receipt.Items {
+		if v.BilledQuantity > 0 {
+			return errors.New("goods receipt has been billed and cannot be cancelled")
+		}
+	}
+	var landedCosts int64
+	if err := s.db.Model(&models.LandedCostAllocationModel{}).
+		Joins("JOIN landed_cost_vouchers ON landed_cost_vouchers.id = landed_cost_allocations.voucher_id").
+		Joins("JOIN goods_receipt_items ON goods_receipt_items.id = landed_cost_allocations.goods_receipt_item_id").
+		Where("goods_receipt_items.goods_receipt_id = ? AND landed_cost_vouchers.status = ?", receipt.ID, "POSTED").
+		Count(&landedCosts).Error; err != nil {
+		return err
+	}
+	if landedCosts > 0 {
+		return errors.New("goods receipt has posted landed costs, cancel their vouchers first")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("secondary_ref_id = ? AND secondary_ref_type = ?", receipt.ID, "goods_receipt").Delete(&models.StockMovementModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("transaction_ref_id = ? AND transaction_ref_type = ?", receipt.ID, "goods_receipt").Delete(&models.TransactionModel{}).Error; err != nil {
+			return err
+		}
+		for _, v := range receipt.Items {
+			if v.ProductID != nil {
+				unitValue := v.UnitValue
+				if unitValue == 0 {
+					unitValue = 1
+				}
+				if err := stockmovement.UpdateAverageCost(tx, *v.ProductID, -v.Quantity*unitValue, -v.Total); err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&models.PurchaseOrderItemModel{}).Where("id = ?", v.PurchaseItemID).
+				Update("received_quantity", gorm.Expr("received_quantity - ?", v.Quantity)).Error; err != nil {
+				return err
+			}
+		}
+		var items []models.PurchaseOrderItemModel
+		if err := tx.Where("purchase_id = ?", receipt.PurchaseID).Find(&items).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.PurchaseOrderModel{}).Where("id = ?", receipt.PurchaseID).Update("stock_status", receivedStatus(items)).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.GoodsReceiptModel{}).Where("id = ?", receipt.ID).Update("status", "CANCELLED").Error
+	})
+}
+
+func (s *GoodsReceiptService) createJournal(tx *gorm.DB, receipt *models.GoodsReceiptModel, debitAccountID, creditAccountID *string, amount float64, userID string) error {
+	debitID := utils.Uuid()
+	creditID := utils.Uuid()
+	err := tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: debitID},
+		Code:                        utils.RandString(10, false),
+		Date:                        receipt.Date,
+		AccountID:                   debitAccountID,
+		Description:                 "Penerimaan Barang " + receipt.ReceiptNumber,
+		Notes:                       receipt.Description,
+		TransactionRefID:            &receipt.ID,
+		TransactionRefType:          "goods_receipt",
+		TransactionSecondaryRefID:   &receipt.PurchaseID,
+		TransactionSecondaryRefType: "purchase",
+		CompanyID:                   receipt.CompanyID,
+		Debit:                       amount,
+		Amount:                      amount,
+		UserID:                      &userID,
+		IsPurchase:                  true,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: creditID},
+		Code:                        utils.RandString(10, false),
+		Date:                        receipt.Date,
+		AccountID:                   creditAccountID,
+		Description:                 "Penerimaan Barang " + receipt.ReceiptNumber,
+		Notes:                       receipt.Description,
+		TransactionRefID:            &receipt.ID,
+		TransactionRefType:          "goods_receipt",
+		TransactionSecondaryRefID:   &receipt.PurchaseID,
+		TransactionSecondaryRefType: "purchase",
+		CompanyID:                   receipt.CompanyID,
+		Credit:                      amount,
+		Amount:                      amount,
+		UserID:                      &userID,
+		IsAccountPayable:            true,
+	}).Error
+}
+
+// receivedStatus returns the stock status of a purchase order based on the received quantities of its product lines.
+func receivedStatus(items []models.PurchaseOrderItemModel) string {
+	received := 0
+	complete := true
+	for _, v := range items {
+		if v.ProductID == nil || v.IsCost {
+			continue
+		}
+		if v.ReceivedQuantity > 0 {
+			received++
+		}
+		if v.ReceivedQuantity+quantityEpsilon < v.Quantity {
+			complete = false
+		}
+	}
+	if received == 0 {
+		return "pending"
+	}
+	if complete {
+		return "received"
+	}
+	return "partial"
+}
@@ -8,9 +8,15 @@ import (
 	"github.com/AMETORY/ametory-erp-modules/file"
 	"github.com/AMETORY/ametory-erp-modules/finance"
 	"github.com/AMETORY/ametory-erp-modules/inventory/brand"
+	"github.com/AMETORY/ametory-erp-modules/inventory/consignment"
+	"github.com/AMETORY/ametory-erp-modules/inventory/goods_receipt"
+	"github.com/AMETORY/ametory-erp-modules/inventory/landed_cost"
 	"github.com/AMETORY/ametory-erp-modules/inventory/product"
 	"github.com/AMETORY/ametory-erp-modules/inventory/purchase"
+	"github.com/AMETORY/ametory-erp-modules/inventory/purchase_requisition"
 	"github.com/AMETORY/ametory-erp-modules/inventory/purchase_return"
+	"github.com/AMETORY/ametory-erp-modules/inventory/quality_control"
+	"github.com/AMETORY/ametory-erp-modules/inventory/rfq"
 	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
 	"github.com/AMETORY/ametory-erp-modules/inventory/stock_opname"
 	"github.com/AMETORY/ametory-erp-modules/inventory/unit"
@@ -19,20 +25,29 @@ import (
 )
 
 type InventoryService struct {
-	ctx                     *context.ERPContext
-	MasterProductService    *product.MasterProductService
-	ProductService          *product.ProductService
-	ProductCategoryService  *product.ProductCategoryService
-	ProductAttributeService *product.ProductAttributeService
-	PriceCategoryService    *product.PriceCategoryService
-	WarehouseService        *warehouse.WarehouseService
-	StockMovementService    *stockmovement.StockMovementService
-	PurchaseService         *purchase.PurchaseService
-	PurchaseReturnService   *purchase_return.PurchaseReturnService
-	BrandService            *brand.BrandService
-	StockOpnameService      *stock_opname.StockOpnameService
-	TagService              *product.TagService
-	UnitService             *unit.UnitService
+	ctx                        *context.ERPContext
+	MasterProductService       *product.MasterProductService
+	ProductService             *product.ProductService
+	ProductCategoryService     *product.ProductCategoryService
+	ProductAttributeService    *product.ProductAttributeService
+	PriceCategoryService       *product.PriceCategoryService
+	PriceListService           *product.PriceListService
+	WarehouseService           *warehouse.WarehouseService
+	StockMovementService       *stockmovement.StockMovementService
+	StockReservationService    *stockmovement.StockReservationService
+	PurchaseService            *purchase.PurchaseService
+	PurchaseReturnService      *purchase_return.PurchaseReturnService
+	BrandService               *brand.BrandService
+	StockOpnameService         *stock_opname.StockOpnameService
+	TagService                 *product.TagService
+	UnitService                *unit.UnitService
+	QualityControlService      *quality_control.QualityControlService
+	PurchaseRequisitionService *purchase_requisition.PurchaseRequisitionService
+	RFQService                 *rfq.RFQService
+	GoodsReceiptService        *goods_receipt.GoodsReceiptService
+	ThreeWayMatchService       *goods_receipt.ThreeWayMatchService
+	LandedCostService          *landed_cost.LandedCostService
+	ConsignmentService         *consignment.ConsignmentService
 }
 
 func NewInventoryService(ctx *context.ERPContext) *InventoryService {
@@ -52,22 +67,33 @@ func NewInventoryService(ctx *context.ERPContext) *InventoryService {
 	unitService := unit.NewUnitService(ctx.DB, ctx)
 	productSrv := product.NewProductService(ctx.DB, ctx, fileService, tagService)
 	purchaseSrv := purchase.NewPurchaseService(ctx.DB, ctx, financeService, stockmovementSrv)
+	purchaseReturnSrv := purchase_return.NewPurchaseReturnService(ctx.DB, ctx, financeService, stockmovementSrv, purchaseSrv)
+	goodsReceiptSrv := goods_receipt.NewGoodsReceiptService(ctx.DB, ctx, financeService, stockmovementSrv)
 
 	var service = InventoryService{
-		ctx:                     ctx,
-		MasterProductService:    product.NewMasterProductService(ctx.DB, ctx),
-		ProductService:          productSrv,
-		ProductCategoryService:  product.NewProductCategoryService(ctx.DB, ctx),
-		ProductAttributeService: product.NewProductAttributeService(ctx.DB, ctx),
-		PriceCategoryService:    product.NewPriceCategoryService(ctx.DB, ctx),
-		WarehouseService:        warehouse.NewWarehouseService(ctx.DB, ctx),
-		StockMovementService:    stockmovementSrv,
-		PurchaseService:         purchaseSrv,
-		PurchaseReturnService:   purchase_return.NewPurchaseReturnService(ctx.DB, ctx, financeService, stockmovementSrv, purchaseSrv),
-		BrandService:            brand.NewBrandService(ctx.DB, ctx),
-		TagService:              tagService,
-		StockOpnameService:      stock_opname.NewStockOpnameService(ctx.DB, ctx, productSrv, stockmovementSrv),
-		UnitService:             unitService,
+		ctx:                        ctx,
+		MasterProductService:       product.NewMasterProductService(ctx.DB, ctx),
+		ProductService:             productSrv,
+		ProductCategoryService:     product.NewProductCategoryService(ctx.DB, ctx),
+		ProductAttributeService:    product.NewProductAttributeService(ctx.DB, ctx),
+		PriceCategoryService:       product.NewPriceCategoryService(ctx.DB, ctx),
+		PriceListService:           product.NewPriceListService(ctx.DB, ctx),
+		WarehouseService:           warehouse.NewWarehouseService(ctx.DB, ctx),
+		StockMovementService:       stockmovementSrv,
+		StockReservationService:    stockmovement.NewStockReservationService(ctx.DB, ctx),
+		PurchaseService:            purchaseSrv,
+		PurchaseReturnService:      purchaseReturnSrv,
+		BrandService:               brand.NewBrandService(ctx.DB, ctx),
+		TagService:                 tagService,
+		StockOpnameService:         stock_opname.NewStockOpnameService(ctx.DB, ctx, productSrv, stockmovementSrv),
+		UnitService:                unitService,
+		QualityControlService:      quality_control.NewQualityControlService(ctx.DB, ctx, stockmovementSrv, purchaseReturnSrv),
+		PurchaseRequisitionService: purchase_requisition.NewPurchaseRequisitionService(ctx.DB, ctx, purchaseSrv),
+		RFQService:                 rfq.NewRFQService(ctx.DB, ctx),
+		GoodsReceiptService:        goodsReceiptSrv,
+		ThreeWayMatchService:       goods_receipt.NewThreeWayMatchService(ctx.DB, ctx, purchaseSrv, goodsReceiptSrv),
+		LandedCostService:          landed_cost.NewLandedCostService(ctx.DB, ctx),
+		ConsignmentService:         consignment.NewConsignmentService(ctx.DB, ctx, financeService, stockmovementSrv, purchaseSrv),
 	}
 	err := service.Migrate()
 	if err != nil {
@@ -111,6 +137,30 @@ func (s *InventoryService) Migrate() error {
 		log.Println("ERROR MIGRATING PURCHASE RETURN", err)
 		return err
 	}
+	if err := quality_control.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR MIGRATING QUALITY CONTROL", err)
+		return err
+	}
+	if err := purchase_requisition.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR MIGRATING PURCHASE REQUISITION", err)
+		return err
+	}
+	if err := rfq.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR MIGRATING RFQ", err)
+		return err
+	}
+	if err := goods_receipt.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR MIGRATING GOODS RECEIPT", err)
+		return err
+	}
+	if err := landed_cost.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR MIGRATING LANDED COST", err)
+		return err
+	}
+	if err := consignment.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR MIGRATING CONSIGNMENT", err)
+		return err
+	}
 
 	return nil
 }
@@ -0,0 +1,524 @@
+package landed_cost
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type LandedCostService struct {
+	db  *gorm.DB
+	ctx *context.ERPContext
+}
+
+// NewLandedCostService creates a new instance of LandedCostService with the given database connection and context.
+func NewLandedCostService(db *gorm.DB, ctx *context.ERPContext) *LandedCostService {
+	return &LandedCostService{
+		db:  db,
+		ctx: ctx,
+	}
+}
+
+// Migrate migrates the database schema needed for the LandedCostService.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.LandedCostVoucherModel{},
+		&models.LandedCostChargeModel{},
+		&models.LandedCostAllocationModel{},
+	)
+}
+
+// CreateVoucher creates a draft landed cost voucher with its charges.
+func (s *LandedCostService) CreateVoucher(data *models.LandedCostVoucherModel) error {
+	if data.VoucherNumber == "" {
+		data.VoucherNumber = fmt.Sprintf("LCV-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.Date.IsZero() {
+		data.Date = time.Now()
+	}
+	if data.AllocationMethod == "" {
+		data.AllocationMethod = models.AllocateByValue
+	}
+	data.Status = "DRAFT"
+	data.Total = 0
+	for _, v := range data.Charges {
+		data.Total += v.Amount
+	}
+	for _, v := range data.GoodsReceipts {
+		if err := s.checkReceipt(v.ID, data.CompanyID); err != nil {
+			return err
+		}
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdateVoucher updates the header of a draft landed cost voucher.
+func (s *LandedCostService) UpdateVoucher(id string, data *models.LandedCostVoucherModel) error {
+	return s.db.Omit(clause.Associations, "status", "total").Where("id = ? AND status = ?", id, "DRAFT").Updates(data).Error
+}
+
+// DeleteVoucher deletes a draft landed cost voucher.
+func (s *LandedCostService) DeleteVoucher(id string) error {
+	voucher, err := s.GetVoucherByID(id)
+	if err != nil {
+		return err
+	}
+	if voucher.Status != "DRAFT" {
+		return errors.New("only draft voucher can be deleted")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(voucher).Association("GoodsReceipts").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Where("voucher_id = ?", id).Delete(&models.LandedCostChargeModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("voucher_id = ?", id).Delete(&models.LandedCostAllocationModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.LandedCostVoucherModel{}).Error
+	})
+}
+
+// GetVouchers retrieves a paginated list of landed cost vouchers.
+func (s *LandedCostService) GetVouchers(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Contact").Preload("CreditAccount")
+	if search != "" {
+		stmt = stmt.Where("voucher_number ILIKE ? OR description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	if request.URL.Query().Get("order") != "" {
+		stmt = stmt.Order(request.URL.Query().Get("order"))
+	} else {
+		stmt = stmt.Order("date DESC")
+	}
+	stmt = stmt.Model(&models.LandedCostVoucherModel{})
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.LandedCostVoucherModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetVoucherByID retrieves a landed cost voucher with its receipts, charges and allocations.
+func (s *LandedCostService) GetVoucherByID(id string) (*models.LandedCostVoucherModel, error) {
+	var voucher models.LandedCostVoucherModel
+	err := s.db.
+		Preload("Contact").
+		Preload("CreditAccount").
+		Preload("GoodsReceipts").
+		Preload("Charges").
+		Preload("Allocations", func(db *gorm.DB) *gorm.DB {
+			return db.Preload("Product").Order("created_at ASC")
+		}).
+		Where("id = ?", id).First(&voucher).Error
+	if err != nil {
+		return nil, err
+	}
+	return &voucher, nil
+}
+
+// AddCharge adds a cost component to a draft landed cost voucher.
+func (s *LandedCostService) AddCharge(voucherID string, charge *models.LandedCostChargeModel) error {
+	if err := s.checkDraft(voucherID); err != nil {
+		return err
+	}
+	charge.VoucherID = voucherID
+	if err := s.db.Create(charge).Error; err != nil {
+		return err
+	}
+	return s.updateTotal(voucherID)
+}
+
+// DeleteCharge removes a cost component from a draft landed cost voucher.
+func (s *LandedCostService) DeleteCharge(voucherID, chargeID string) error {
+	if err := s.checkDraft(voucherID); err != nil {
+		return err
+	}
+	if err := s.db.Where("voucher_id = ? AND id = ?", voucherID, chargeID).Delete(&models.LandedCostChargeModel{}).Error; err != nil {
+		return err
+	}
+	return s.updateTotal(voucherID)
+}
+
+// AddReceipt links a posted goods receipt to a draft landed cost voucher.
+func (s *LandedCostService) AddReceipt(voucherID, receiptID string) error {
+	voucher, err := s.GetVoucherByID(voucherID)
+	if err != nil {
+		return err
+	}
+	if voucher.Status != "DRAFT" {
+		return errors.New("voucher is not draft")
+	}
+	if err := s.checkReceipt(receiptID, voucher.CompanyID); err != nil {
+		return err
+	}
+	return s.db.Model(voucher).Association("GoodsReceipts").Append(&models.GoodsReceiptModel{BaseModel: shared.BaseModel{ID: receiptID}})
+}
+
+// RemoveReceipt unlinks a goods receipt from a draft landed cost voucher.
+func (s *LandedCostService) RemoveReceipt(voucherID, receiptID string) error {
+	voucher, err := s.GetVoucherByID(voucherID)
+	if err != nil {
+		return err
+	}
+	if voucher.Status != "DRAFT" {
+		return errors.New("voucher is not draft")
+	}
+	return s.db.Model(voucher).Association("GoodsReceipts").Delete(&models.GoodsReceiptModel{BaseModel: shared.BaseModel{ID: receiptID}})
+}
+
+// AllocateCosts calculates the allocation of the voucher total across the lines of its goods receipts.
+//
+// The basis of each line depends on the allocation method: received quantity (in base
+// unit), received value, total weight or total volume (from the product or variant
+// dimensions). The last line receives the rounding remainder so the allocations add up
+// to the voucher total. For every line the quantity sold since the receipt is estimated
+// (first in, first out) to split the amount between inventory and COGS.
+//
+// The allocations of a draft voucher are replaced and returned as a preview.
+func (s *LandedCostService) AllocateCosts(voucherID string) ([]models.LandedCostAllocationModel, error) {
+	voucher, err := s.GetVoucherByID(voucherID)
+	if err != nil {
+		return nil, err
+	}
+	if voucher.Status != "DRAFT" {
+		return nil, errors.New("voucher is not draft")
+	}
+	allocations, err := s.calculateAllocations(s.db, voucher)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("voucher_id = ?", voucher.ID).Unscoped().Delete(&models.LandedCostAllocationModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&allocations).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+// PostVoucher posts a draft landed cost voucher.
+//
+// The allocations are recalculated and the landed cost of every goods receipt line is
+// increased, which raises its landed unit cost. The part allocated to quantities still
+// on hand is debited to the inventory account and added to the average cost of the
+// product, the part allocated to quantities sold
+// since the receipt is debited to the COGS account. The voucher total is credited to
+// the credit account of the voucher.
+func (s *LandedCostService) PostVoucher(voucherID string, userID string) error {
+	voucher, err := s.GetVoucherByID(voucherID)
+	if err != nil {
+		return err
+	}
+	if voucher.Status != "DRAFT" {
+		return errors.New("voucher is not draft")
+	}
+	if voucher.CreditAccountID == nil {
+		return errors.New("credit account is required")
+	}
+	if voucher.Total <= 0 {
+		return errors.New("voucher total must be greater than zero")
+	}
+	if voucher.CompanyID == nil {
+		return errors.New("company ID is required")
+	}
+	var inventoryAccount models.AccountModel
+	if err := s.db.Where("is_inventory_account = ? and company_id = ?", true, *voucher.CompanyID).First(&inventoryAccount).Error; err != nil {
+		return errors.New("inventory account not found")
+	}
+	var cogsAccount models.AccountModel
+	if err := s.db.Where("is_cogs_account = ? and company_id = ?", true, *voucher.CompanyID).First(&cogsAccount).Error; err != nil {
+		return errors.New("cogs account not found")
+	}
+
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		allocations, err := s.calculateAllocations(tx, voucher)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("voucher_id = ?", voucher.ID).Unscoped().Delete(&models.LandedCostAllocationModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&allocations).Error; err != nil {
+			return err
+		}
+
+		inventoryAmount, cogsAmount := 0.0, 0.0
+		for _, v := range allocations {
+			inventoryAmount += v.InventoryAmount
+			cogsAmount += v.CogsAmount
+			if err := s.applyLandedCost(tx, v.GoodsReceiptItemID, v.Amount, v.InventoryAmount); err != nil {
+				return err
+			}
+		}
+
+		if inventoryAmount > 0 {
+			if err := s.createTransaction(tx, voucher, &inventoryAccount.ID, "Landed Cost ", inventoryAmount, 0, userID); err != nil {
+				return err
+			}
+		}
+		if cogsAmount > 0 {
+			if err := s.createTransaction(tx, voucher, &cogsAccount.ID, "HPP Landed Cost ", cogsAmount, 0, userID); err != nil {
+				return err
+			}
+		}
+		if err := s.createTransaction(tx, voucher, voucher.CreditAccountID, "Landed Cost ", 0, voucher.Total, userID); err != nil {
+			return err
+		}
+
+		return tx.Model(&models.LandedCostVoucherModel{}).Where("id = ?", voucher.ID).Updates(map[string]any{
+			"status":       "POSTED",
+			"posted_at":    now,
+			"posted_by_id": userID,
+		}).Error
+	})
+}
+
+// CancelVoucher reverses a posted landed cost voucher by removing its journal entries
+// and the landed cost added to the goods receipt lines.
+func (s *LandedCostService) CancelVoucher(voucherID string) error {
+	voucher, err := s.GetVoucherByID(voucherID)
+	if err != nil {
+		return err
+	}
+	if voucher.Status != "POSTED" {
+		return errors.New("voucher is not posted")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, v := range voucher.Allocations {
+			if err := s.applyLandedCost(tx, v.GoodsReceiptItemID, -v.Amount, -v.InventoryAmount); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("transaction_ref_id = ? AND transaction_ref_type = ?", voucher.ID, "landed_cost_voucher").Delete(&models.TransactionModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.LandedCostVoucherModel{}).Where("id = ?", voucher.ID).Update("status", "CANCELLED").Error
+	})
+}
+
+func (s *LandedCostService) calculateAllocations(tx *gorm.DB, voucher *models.LandedCostVoucherModel) ([]models.LandedCostAllocationModel, error) {
+	if len(voucher.GoodsReceipts) == 0 {
+		return nil, errors.New("voucher has no goods receipt")
+	}
+	receiptIDs := []string{}
+	receiptDates := map[string]time.Time{}
+	for _, v := range voucher.GoodsReceipts {
+		receiptIDs = append(receiptIDs, v.ID)
+		receiptDates[v.ID] = v.Date
+	}
+	var items []models.GoodsReceiptItemModel
+	err := tx.Preload("Product").Preload("Variant").
+		Where("goods_receipt_id IN (?)", receiptIDs).
+		Order("created_at ASC").Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+
+	allocations := []models.LandedCostAllocationModel{}
+	totalBasis := 0.0
+	for _, v := range items {
+		basis := allocationBasis(voucher.AllocationMethod, v)
+		totalBasis += basis
+		allocations = append(allocations, models.LandedCostAllocationModel{
+			VoucherID:          voucher.ID,
+			GoodsReceiptItemID: v.ID,
+			ProductID:          v.ProductID,
+			VariantID:          v.VariantID,
+			WarehouseID:        v.WarehouseID,
+			Quantity:           v.Quantity,
+			Basis:              basis,
+		})
+	}
+	if totalBasis == 0 {
+		return nil, fmt.Errorf("allocation basis %s is zero for all receipt lines", voucher.AllocationMethod)
+	}
+
+	allocated := 0.0
+	for i := range allocations {
+		if i == len(allocations)-1 {
+			allocations[i].Amount = utils.AmountRound(voucher.Total-allocated, 2)
+		} else {
+			allocations[i].Amount = utils.AmountRound(voucher.Total*allocations[i].Basis/totalBasis, 2)
+		}
+		allocated += allocations[i].Amount
+
+		sold, err := s.soldSinceReceipt(tx, items[i], receiptDates[items[i].GoodsReceiptID])
+		if err != nil {
+			return nil, err
+		}
+		allocations[i].SoldQuantity = sold
+		if items[i].Quantity > 0 {
+			allocations[i].CogsAmount = utils.AmountRound(allocations[i].Amount*sold/items[i].Quantity, 2)
+		}
+		allocations[i].InventoryAmount = allocations[i].Amount - allocations[i].CogsAmount
+	}
+	return allocations, nil
+}
+
+// allocationBasis returns the value a receipt line contributes to the allocation basis.
+func allocationBasis(method models.LandedCostAllocationMethod, item models.GoodsReceiptItemModel) float64 {
+	unitValue := item.UnitValue
+	if unitValue == 0 {
+		unitValue = 1
+	}
+	baseQty := item.Quantity * unitValue
+	switch method {
+	case models.AllocateByQuantity:
+		return baseQty
+	case models.AllocateByWeight:
+		if item.Variant != nil && item.Variant.Weight > 0 {
+			return item.Variant.Weight * baseQty
+		}
+		if item.Product != nil {
+			return item.Product.Weight * baseQty
+		}
+	case models.AllocateByVolume:
+		if item.Variant != nil && item.Variant.Height*item.Variant.Length*item.Variant.Width > 0 {
+			return item.Variant.Height * item.Variant.Length * item.Variant.Width * baseQty
+		}
+		if item.Product != nil {
+			return item.Product.Height * item.Product.Length * item.Product.Width * baseQty
+		}
+	default:
+		return item.Quantity * item.UnitCost
+	}
+	return 0
+}
+
+// soldSinceReceipt estimates how much of a receipt line has been sold since it was received.
+//
+// Stock is assumed to be consumed first in, first out: sales after the receipt first
+// use up the stock that was on hand before the receipt, the rest is taken from the
+// receipt. The result is expressed in the receipt line's unit.
+func (s *LandedCostService) soldSinceReceipt(tx *gorm.DB, item models.GoodsReceiptItemModel, receiptDate time.Time) (float64, error) {
+	if item.ProductID == nil || item.WarehouseID == nil {
+		return 0, nil
+	}
+	unitValue := item.UnitValue
+	if unitValue == 0 {
+		unitValue = 1
+	}
+	base := func() *gorm.DB {
+		stmt := tx.Model(&models.StockMovementModel{}).
+			Where("product_id = ? AND warehouse_id = ? AND owner_id IS NULL", *item.ProductID, *item.WarehouseID)
+		if item.VariantID != nil {
+			stmt = stmt.Where("variant_id = ?", *item.VariantID)
+		}
+		return stmt
+	}
+	var before float64
+	if err := base().Where("date < ?", receiptDate).
+		Select("COALESCE(SUM(quantity * value), 0)").Scan(&before).Error; err != nil {
+		return 0, err
+	}
+	var sold float64
+	if err := base().Where("date >= ? AND type = ? AND quantity < 0", receiptDate, models.MovementTypeSale).
+		Select("COALESCE(SUM(-quantity * value), 0)").Scan(&sold).Error; err != nil {
+		return 0, err
+	}
+	fromReceipt := sold - math.Max(before, 0)
+	fromReceipt = math.Max(0, math.Min(fromReceipt, item.Quantity*unitValue))
+	return fromReceipt / unitValue, nil
+}
+
+// applyLandedCost adds amount to the landed cost of a receipt line. The part capitalised to the
+// stock still on hand (inventoryAmount) is added to the average cost of the product.
+func (s *LandedCostService) applyLandedCost(tx *gorm.DB, itemID string, amount, inventoryAmount float64) error {
+	var item models.GoodsReceiptItemModel
+	if err := tx.Where("id = ?", itemID).First(&item).Error; err != nil {
+		return err
+	}
+	item.LandedCost = utils.AmountRound(item.LandedCost+amount, 2)
+	item.LandedUnitCost = item.UnitCost
+	if item.Quantity > 0 {
+		item.LandedUnitCost = item.UnitCost + item.LandedCost/item.Quantity
+	}
+	if err := tx.Model(&models.GoodsReceiptItemModel{}).Where("id = ?", item.ID).Updates(map[string]any{
+		"landed_cost":      item.LandedCost,
+		"landed_unit_cost": item.LandedUnitCost,
+	}).Error; err != nil {
+		return err
+	}
+	if item.ProductID == nil || inventoryAmount == 0 {
+		return nil
+	}
+	return stockmovement.UpdateAverageCost(tx, *item.ProductID, 0, inventoryAmount)
+}
+
+func (s *LandedCostService) createTransaction(tx *gorm.DB, voucher *models.LandedCostVoucherModel, accountID *string, label string, debit, credit float64, userID string) error {
+	return tx.Create(&models.TransactionModel{
+		BaseModel:          shared.BaseModel{ID: utils.Uuid()},
+		Code:               utils.RandString(10, false),
+		Date:               voucher.Date,
+		AccountID:          accountID,
+		Description:        label + voucher.VoucherNumber,
+		Notes:              voucher.Description,
+		TransactionRefID:   &voucher.ID,
+		TransactionRefType: "landed_cost_voucher",
+		CompanyID:          voucher.CompanyID,
+		Debit:              debit,
+		Credit:             credit,
+		Amount:             debit + credit,
+		UserID:             &userID,
+		IsPurchaseCost:     true,
+	}).Error
+}
+
+func (s *LandedCostService) checkDraft(voucherID string) error {
+	var voucher models.LandedCostVoucherModel
+	if err := s.db.Select("id", "status").Where("id = ?", voucherID).First(&voucher).Error; err != nil {
+		return err
+	}
+	if voucher.Status != "DRAFT" {
+		return errors.New("voucher is not draft")
+	}
+	return nil
+}
+
+func (s *LandedCostService) checkReceipt(receiptID string, companyID *string) error {
+	var receipt models.GoodsReceiptModel
+	if err := s.db.Select("id", "status", "company_id").Where("id = ?", receiptID).First(&receipt).Error; err != nil {
+		return err
+	}
+	if receipt.Status != "POSTED" {
+		return errors.New("goods receipt is not posted")
+	}
+	if companyID != nil && receipt.CompanyID != nil && *companyID != *receipt.CompanyID {
+		return errors.New("goods receipt belongs to another company")
+	}
+	return nil
+}
+
+func (s *LandedCostService) updateTotal(voucherID string) error {
+	var total float64
+	if err := s.db.Model(&models.LandedCostChargeModel{}).Where("voucher_id = ?", voucherID).
+		Select("COALESCE(SUM(amount), 0)").Scan(&total).Error; err != nil {
+		return err
+	}
+	return s.db.Model(&models.LandedCostVoucherModel{}).Where("id = ?", voucherID).Update("total", total).Error
+}
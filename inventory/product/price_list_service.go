@@ -0,0 +1,510 @@
+package product
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type PriceListService struct {
+	db  *gorm.DB
+	ctx *context.ERPContext
+}
+
+// NewPriceListService creates a new instance of PriceListService with the given database connection and context.
+func NewPriceListService(db *gorm.DB, ctx *context.ERPContext) *PriceListService {
+	return &PriceListService{db: db, ctx: ctx}
+}
+
+// PriceRequest is the sale line a price is resolved for. When BasePrice is zero the price of the
+// variant, or of the product, is used as the base price.
+type PriceRequest struct {
+	CompanyID  *string   `json:"company_id,omitempty"`
+	ProductID  string    `json:"product_id"`
+	VariantID  *string   `json:"variant_id,omitempty"`
+	ContactID  *string   `json:"contact_id,omitempty"`
+	MerchantID *string   `json:"merchant_id,omitempty"`
+	Channel    string    `json:"channel,omitempty"`
+	Quantity   float64   `json:"quantity"`
+	Date       time.Time `json:"date"`
+	BasePrice  float64   `json:"base_price"`
+}
+
+// PriceRule is one price list entry considered for a PriceRequest. Reason tells why an entry was
+// not applied.
+type PriceRule struct {
+	PriceListID   string  `json:"price_list_id"`
+	PriceListName string  `json:"price_list_name"`
+	ItemID        string  `json:"item_id"`
+	Priority      int     `json:"priority"`
+	AssignedTo    string  `json:"assigned_to"` // CONTACT, CUSTOMER_GROUP, MERCHANT, CHANNEL or ALL
+	Level         string  `json:"level"`       // VARIANT, PRODUCT or CATEGORY
+	Method        string  `json:"method"`
+	MinQuantity   float64 `json:"min_quantity"`
+	Price         float64 `json:"price"`
+	Reason        string  `json:"reason,omitempty"`
+}
+
+// PriceResolution is the outcome of ResolvePrice. Rule is the winning entry, or nil when no
+// price list applies and the base price is used.
+type PriceResolution struct {
+	ProductID   string      `json:"product_id"`
+	VariantID   *string     `json:"variant_id,omitempty"`
+	Quantity    float64     `json:"quantity"`
+	Channel     string      `json:"channel,omitempty"`
+	Date        time.Time   `json:"date"`
+	BasePrice   float64     `json:"base_price"`
+	Price       float64     `json:"price"`
+	Rule        *PriceRule  `json:"rule,omitempty"`
+	Candidates  []PriceRule `json:"candidates"` // applicable entries that lost to the winning rule
+	Skipped     []PriceRule `json:"skipped"`
+	Explanation []string    `json:"explanation"`
+}
+
+var assignmentRank = map[string]int{
+	models.PriceListAssignContact:       4,
+	models.PriceListAssignCustomerGroup: 3,
+	models.PriceListAssignMerchant:      2,
+	models.PriceListAssignChannel:       1,
+	"ALL":                               0,
+}
+
+var levelRank = map[string]int{
+	"VARIANT":  2,
+	"PRODUCT":  1,
+	"CATEGORY": 0,
+}
+
+// GetPriceLists retrieves a paginated list of price lists, filtered by the company ID header and
+// the search query on name, code and description.
+func (s *PriceListService) GetPriceLists(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Assignments")
+	if search != "" {
+		stmt = stmt.Where("price_lists.name ILIKE ? OR price_lists.code ILIKE ? OR price_lists.description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	stmt = stmt.Model(&models.PriceListModel{}).Order("priority DESC, name ASC")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.PriceListModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetPriceListByID retrieves a price list with its assignments and entries.
+func (s *PriceListService) GetPriceListByID(id string) (*models.PriceListModel, error) {
+	var priceList models.PriceListModel
+	err := s.db.Preload("Assignments").
+		Preload("Items", func(db *gorm.DB) *gorm.DB {
+			return db.Preload("Product", func(db *gorm.DB) *gorm.DB {
+				return db.Select("id", "name", "display_name", "price", "standard_cost")
+			}).Preload("Variant", func(db *gorm.DB) *gorm.DB {
+				return db.Select("id", "display_name", "price")
+			}).Preload("Category", func(db *gorm.DB) *gorm.DB {
+				return db.Select("id", "name")
+			}).Order("created_at ASC")
+		}).
+		Where("id = ?", id).First(&priceList).Error
+	if err != nil {
+		return nil, err
+	}
+	return &priceList, nil
+}
+
+// CreatePriceList creates a price list together with its assignments and entries.
+func (s *PriceListService) CreatePriceList(data *models.PriceListModel) error {
+	for i := range data.Items {
+		if err := validatePriceListItem(&data.Items[i]); err != nil {
+			return err
+		}
+	}
+	for i := range data.Assignments {
+		if err := validatePriceListAssignment(&data.Assignments[i]); err != nil {
+			return err
+		}
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdatePriceList updates the header of a price list. Assignments and entries are changed with
+// SetAssignments, AddItem, UpdateItem and DeleteItem.
+func (s *PriceListService) UpdatePriceList(id string, data *models.PriceListModel) error {
+	return s.db.Model(&models.PriceListModel{}).Where("id = ?", id).
+		Select("name", "code", "description", "priority", "start_date", "end_date", "is_active").
+		Updates(data).Error
+}
+
+// DeletePriceList deletes a price list with its assignments and entries.
+func (s *PriceListService) DeletePriceList(id string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("price_list_id = ?", id).Delete(&models.PriceListItemModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("price_list_id = ?", id).Delete(&models.PriceListAssignmentModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.PriceListModel{}).Error
+	})
+}
+
+// SetAssignments replaces the assignments of a price list. A price list without assignments
+// applies to every sale of its company.
+func (s *PriceListService) SetAssignments(priceListID string, assignments []models.PriceListAssignmentModel) error {
+	for i := range assignments {
+		if err := validatePriceListAssignment(&assignments[i]); err != nil {
+			return err
+		}
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("price_list_id = ?", priceListID).Delete(&models.PriceListAssignmentModel{}).Error; err != nil {
+			return err
+		}
+		for i := range assignments {
+			assignments[i].ID = ""
+			assignments[i].PriceListID = &priceListID
+			if err := tx.Create(&assignments[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddItem adds an entry to a price list.
+func (s *PriceListService) AddItem(priceListID string, item *models.PriceListItemModel) error {
+	if err := validatePriceListItem(item); err != nil {
+		return err
+	}
+	item.PriceListID = &priceListID
+	return s.db.Create(item).Error
+}
+
+// UpdateItem updates an entry of a price list.
+func (s *PriceListService) UpdateItem(id string, item *models.PriceListItemModel) error {
+	if err := validatePriceListItem(item); err != nil {
+		return err
+	}
+	var existing models.PriceListItemModel
+	if err := s.db.First(&existing, "id = ?", id).Error; err != nil {
+		return err
+	}
+	existing.ProductID = item.ProductID
+	existing.VariantID = item.VariantID
+	existing.CategoryID = item.CategoryID
+	existing.Method = item.Method
+	existing.Value = item.Value
+	existing.MinQuantity = item.MinQuantity
+	existing.Tiers = item.Tiers
+	existing.TierData = json.RawMessage("[]")
+	existing.StartDate = item.StartDate
+	existing.EndDate = item.EndDate
+	existing.Notes = item.Notes
+	return s.db.Omit(clause.Associations).Save(&existing).Error
+}
+
+// DeleteItem deletes an entry of a price list.
+func (s *PriceListService) DeleteItem(id string) error {
+	return s.db.Where("id = ?", id).Delete(&models.PriceListItemModel{}).Error
+}
+
+func validatePriceListAssignment(assignment *models.PriceListAssignmentModel) error {
+	switch assignment.Type {
+	case models.PriceListAssignContact, models.PriceListAssignCustomerGroup, models.PriceListAssignMerchant:
+		if assignment.ReferenceID == nil {
+			return fmt.Errorf("%s assignment needs a reference", assignment.Type)
+		}
+	case models.PriceListAssignChannel:
+		if assignment.Channel == "" {
+			return errors.New("channel assignment needs a channel")
+		}
+	default:
+		return fmt.Errorf("unknown assignment type %s", assignment.Type)
+	}
+	return nil
+}
+
+func validatePriceListItem(item *models.PriceListItemModel) error {
+	if item.ProductID == nil && item.VariantID == nil && item.CategoryID == nil {
+		return errors.New("price list entry needs a product, variant or category")
+	}
+	if item.Method == "" {
+		item.Method = models.PriceListItemFixed
+	}
+	switch item.Method {
+	case models.PriceListItemFixed, models.PriceListItemCostPlus, models.PriceListItemDiscount:
+		if item.Value < 0 {
+			return errors.New("price list entry value cannot be negative")
+		}
+		if item.Method == models.PriceListItemDiscount && item.Value > 100 {
+			return errors.New("discount cannot exceed 100 percent")
+		}
+	case models.PriceListItemTiered:
+		if len(item.Tiers) == 0 {
+			return errors.New("tiered price list entry needs at least one tier")
+		}
+		sort.Slice(item.Tiers, func(i, j int) bool { return item.Tiers[i].MinQuantity < item.Tiers[j].MinQuantity })
+		for _, v := range item.Tiers {
+			if v.Price < 0 {
+				return errors.New("tier price cannot be negative")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown price method %s", item.Method)
+	}
+	if item.StartDate != nil && item.EndDate != nil && item.EndDate.Before(*item.StartDate) {
+		return errors.New("end date is before start date")
+	}
+	return nil
+}
+
+// ResolvePrice is the single place a selling price is decided; the cart, POS, sales documents
+// and merchant offers all call it.
+//
+// Every price list entry for the variant, the product or its category is considered. An entry
+// is skipped, with the reason, when its price list or the entry itself is outside its date
+// range, the price list is assigned elsewhere, the quantity is below its minimum or its price
+// cannot be computed. Of the applicable entries the winner is the one whose price list is
+// assigned most specifically (contact, customer group, merchant, channel, everyone), then the
+// highest price list priority, then the most specific entry (variant, product, category), then
+// the highest minimum quantity and finally the lowest price. Without an applicable entry the
+// base price is used.
+func (s *PriceListService) ResolvePrice(req PriceRequest) (*PriceResolution, error) {
+	if req.Date.IsZero() {
+		req.Date = time.Now()
+	}
+	if req.Quantity <= 0 {
+		req.Quantity = 1
+	}
+	var product models.ProductModel
+	if err := s.db.Select("id", "price", "standard_cost", "category_id", "company_id").First(&product, "id = ?", req.ProductID).Error; err != nil {
+		return nil, err
+	}
+	if req.CompanyID == nil {
+		req.CompanyID = product.CompanyID
+	}
+	basePrice := product.Price
+	if req.VariantID != nil {
+		var variant models.VariantModel
+		if err := s.db.Select("id", "price").First(&variant, "id = ?", *req.VariantID).Error; err != nil {
+			return nil, err
+		}
+		if variant.Price > 0 {
+			basePrice = variant.Price
+		}
+	}
+	if req.BasePrice > 0 {
+		basePrice = req.BasePrice
+	}
+
+	result := PriceResolution{
+		ProductID:   req.ProductID,
+		VariantID:   req.VariantID,
+		Quantity:    req.Quantity,
+		Channel:     req.Channel,
+		Date:        req.Date,
+		BasePrice:   basePrice,
+		Price:       basePrice,
+		Candidates:  []PriceRule{},
+		Skipped:     []PriceRule{},
+		Explanation: []string{},
+	}
+
+	stmt := s.db.Select("price_list_items.*").Joins("JOIN price_lists ON price_lists.id = price_list_items.price_list_id AND price_lists.deleted_at IS NULL").
+		Where("price_lists.is_active = ?", true).
+		Preload("PriceList.Assignments")
+	if req.CompanyID != nil {
+		stmt = stmt.Where("price_lists.company_id = ? OR price_lists.company_id IS NULL", *req.CompanyID)
+	}
+	scope := s.db.Where("price_list_items.product_id = ? AND price_list_items.variant_id IS NULL", req.ProductID)
+	if req.VariantID != nil {
+		scope = scope.Or("price_list_items.variant_id = ?", *req.VariantID)
+	}
+	if product.CategoryID != nil {
+		scope = scope.Or("price_list_items.category_id = ? AND price_list_items.product_id IS NULL AND price_list_items.variant_id IS NULL", *product.CategoryID)
+	}
+	var items []models.PriceListItemModel
+	if err := stmt.Where(scope).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		result.Explanation = append(result.Explanation, fmt.Sprintf("no price list entry for this item, base price %.2f", basePrice))
+		return &result, nil
+	}
+
+	groupIDs := map[string]bool{}
+	if req.ContactID != nil {
+		var ids []string
+		if err := s.db.Table("contact_customer_groups").Where("contact_model_id = ?", *req.ContactID).
+			Pluck("customer_group_model_id", &ids).Error; err != nil {
+			return nil, err
+		}
+		for _, v := range ids {
+			groupIDs[v] = true
+		}
+	}
+
+	var applicable []PriceRule
+	for _, item := range items {
+		if item.PriceList == nil {
+			continue
+		}
+		rule := PriceRule{
+			PriceListID:   item.PriceList.ID,
+			PriceListName: item.PriceList.Name,
+			ItemID:        item.ID,
+			Priority:      item.PriceList.Priority,
+			Method:        item.Method,
+			MinQuantity:   item.MinQuantity,
+			Level:         "CATEGORY",
+		}
+		if item.VariantID != nil {
+			rule.Level = "VARIANT"
+		} else if item.ProductID != nil {
+			rule.Level = "PRODUCT"
+		}
+		assignedTo, ok := matchAssignment(item.PriceList.Assignments, req, groupIDs)
+		rule.AssignedTo = assignedTo
+		if reason := dateReason("price list", item.PriceList.StartDate, item.PriceList.EndDate, req.Date); reason != "" {
+			rule.Reason = reason
+		} else if !ok {
+			rule.Reason = "price list is not assigned to this customer, merchant or channel"
+		} else if reason := dateReason("entry", item.StartDate, item.EndDate, req.Date); reason != "" {
+			rule.Reason = reason
+		} else if req.Quantity < item.MinQuantity {
+			rule.Reason = fmt.Sprintf("quantity %.2f is below the minimum of %.2f", req.Quantity, item.MinQuantity)
+		} else {
+			price, reason := priceOfItem(item, basePrice, product.StandardCost, req.Quantity)
+			rule.Price = price
+			rule.Reason = reason
+		}
+		if rule.Reason != "" {
+			result.Skipped = append(result.Skipped, rule)
+			continue
+		}
+		applicable = append(applicable, rule)
+	}
+
+	sort.SliceStable(applicable, func(i, j int) bool {
+		a, b := applicable[i], applicable[j]
+		if assignmentRank[a.AssignedTo] != assignmentRank[b.AssignedTo] {
+			return assignmentRank[a.AssignedTo] > assignmentRank[b.AssignedTo]
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if levelRank[a.Level] != levelRank[b.Level] {
+			return levelRank[a.Level] > levelRank[b.Level]
+		}
+		if a.MinQuantity != b.MinQuantity {
+			return a.MinQuantity > b.MinQuantity
+		}
+		return a.Price < b.Price
+	})
+
+	if len(applicable) == 0 {
+		result.Explanation = append(result.Explanation, fmt.Sprintf("no applicable price list entry, base price %.2f", basePrice))
+	} else {
+		winner := applicable[0]
+		result.Rule = &winner
+		result.Price = winner.Price
+		result.Candidates = applicable[1:]
+		result.Explanation = append(result.Explanation, fmt.Sprintf("%s (%s %s entry, assigned to %s, priority %d): %.2f instead of base price %.2f",
+			winner.PriceListName, winner.Level, winner.Method, winner.AssignedTo, winner.Priority, winner.Price, basePrice))
+		for _, v := range result.Candidates {
+			result.Explanation = append(result.Explanation, fmt.Sprintf("%s (%s %s entry, assigned to %s, priority %d): %.2f lost to %s",
+				v.PriceListName, v.Level, v.Method, v.AssignedTo, v.Priority, v.Price, winner.PriceListName))
+		}
+	}
+	for _, v := range result.Skipped {
+		result.Explanation = append(result.Explanation, fmt.Sprintf("%s (%s %s entry) not applied: %s", v.PriceListName, v.Level, v.Method, v.Reason))
+	}
+	return &result, nil
+}
+
+// matchAssignment returns the most specific assignment of a price list that matches the request.
+// A price list without assignments applies to everyone.
+func matchAssignment(assignments []models.PriceListAssignmentModel, req PriceRequest, groupIDs map[string]bool) (string, bool) {
+	if len(assignments) == 0 {
+		return "ALL", true
+	}
+	best := ""
+	for _, v := range assignments {
+		matched := false
+		switch v.Type {
+		case models.PriceListAssignContact:
+			matched = req.ContactID != nil && v.ReferenceID != nil && *v.ReferenceID == *req.ContactID
+		case models.PriceListAssignCustomerGroup:
+			matched = v.ReferenceID != nil && groupIDs[*v.ReferenceID]
+		case models.PriceListAssignMerchant:
+			matched = req.MerchantID != nil && v.ReferenceID != nil && *v.ReferenceID == *req.MerchantID
+		case models.PriceListAssignChannel:
+			matched = req.Channel != "" && v.Channel == req.Channel
+		}
+		if matched && (best == "" || assignmentRank[v.Type] > assignmentRank[best]) {
+			best = v.Type
+		}
+	}
+	return best, best != ""
+}
+
+// dateReason returns why date lies outside the start and end date, or an empty string.
+func dateReason(label string, start, end *time.Time, date time.Time) string {
+	if start != nil && date.Before(*start) {
+		return fmt.Sprintf("%s starts on %s", label, start.Format("2006-01-02"))
+	}
+	if end != nil && date.After(*end) {
+		return fmt.Sprintf("%s ended on %s", label, end.Format("2006-01-02"))
+	}
+	return ""
+}
+
+// priceOfItem computes the unit price of a price list entry, or the reason it has none.
+func priceOfItem(item models.PriceListItemModel, basePrice, cost, quantity float64) (float64, string) {
+	var price float64
+	switch item.Method {
+	case models.PriceListItemFixed:
+		price = item.Value
+	case models.PriceListItemCostPlus:
+		if cost <= 0 {
+			return 0, "product has no standard cost"
+		}
+		price = cost * (1 + item.Value/100)
+	case models.PriceListItemDiscount:
+		price = basePrice * (1 - item.Value/100)
+	case models.PriceListItemTiered:
+		found := false
+		var tierMin float64
+		for _, v := range item.Tiers {
+			if quantity >= v.MinQuantity && (!found || v.MinQuantity > tierMin) {
+				price = v.Price
+				tierMin = v.MinQuantity
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Sprintf("quantity %.2f is below the first tier", quantity)
+		}
+	default:
+		return 0, fmt.Sprintf("unknown price method %s", item.Method)
+	}
+	if price < 0 {
+		price = 0
+	}
+	return utils.AmountRound(price, 2), ""
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/AMETORY/ametory-erp-modules/context"
 	"github.com/AMETORY/ametory-erp-modules/file"
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
 	"github.com/AMETORY/ametory-erp-modules/utils"
 	"github.com/morkid/paginate"
@@ -48,6 +49,9 @@ func Migrate(db *gorm.DB) error {
 		&models.VariantTag{},
 		&models.VarianMerchant{},
 		&models.ProductFeedbackModel{},
+		&models.PriceListModel{},
+		&models.PriceListAssignmentModel{},
+		&models.PriceListItemModel{},
 	)
 }
 
@@ -179,8 +183,11 @@ func (s *ProductService) GetProductByID(id string, request *http.Request) (*mode
 		}
 	}
 	stock, _ := s.GetStock(product.ID, request, warehouseID)
+	reserved, _ := stockmovement.NewStockReservationService(s.db, s.ctx).GetReservedStocks([]string{product.ID}, warehouseID)
 
 	product.TotalStock = stock
+	product.ReservedStock = reserved[stockmovement.ReservedStockKey(product.ID, nil)]
+	product.AvailableStock = stock - product.ReservedStock
 	for i, v := range product.Variants {
 		if idMerchant != "" {
 			v.MerchantID = &idMerchant
@@ -188,6 +195,8 @@ func (s *ProductService) GetProductByID(id string, request *http.Request) (*mode
 		v.GetPriceAndDiscount(s.db)
 		variantStock, _ := s.GetVariantStock(product.ID, v.ID, request, warehouseID)
 		v.TotalStock = variantStock
+		v.ReservedStock = reserved[stockmovement.ReservedStockKey(product.ID, &v.ID)]
+		v.AvailableStock = variantStock - v.ReservedStock
 		product.Variants[i] = v
 		fmt.Println("VARIANT STOCK", v.ID, variantStock)
 	}
@@ -330,6 +339,11 @@ func (s *ProductService) GetProducts(request http.Request, search string, status
 	if warehouseIDStr != "" {
 		warehouseID = &warehouseIDStr
 	}
+	productIDs := make([]string, 0, len(*items))
+	for _, item := range *items {
+		productIDs = append(productIDs, item.ID)
+	}
+	reserved, _ := stockmovement.NewStockReservationService(s.db, s.ctx).GetReservedStocks(productIDs, warehouseID)
 
 	for _, item := range *items {
 		item.GetPriceAndDiscount(s.db)
@@ -352,10 +366,14 @@ func (s *ProductService) GetProducts(request http.Request, search string, status
 		item.TotalStock = stock
 
 		item.TotalStock = stock
+		item.ReservedStock = reserved[stockmovement.ReservedStockKey(item.ID, nil)]
+		item.AvailableStock = stock - item.ReservedStock
 		for i, variant := range item.Variants {
 			variant.GetPriceAndDiscount(s.db)
 			variantStock, _ := s.GetVariantStock(item.ID, variant.ID, &request, warehouseID)
 			variant.TotalStock = variantStock
+			variant.ReservedStock = reserved[stockmovement.ReservedStockKey(item.ID, &variant.ID)]
+			variant.AvailableStock = variantStock - variant.ReservedStock
 			salesCount, _ := s.GetSalesVariantCount(item.ID, variant.ID, &request, warehouseID)
 			variant.SalesCount = salesCount
 			// variant.Price = s.GetVariantPrice(merchantID, &variant)
@@ -476,6 +494,9 @@ func (s *ProductService) DeleteImageOfProduct(productID string, imageID string)
 
 // GetStock retrieves the total stock of a product in the database.
 //
+// The result is the on-hand stock; it does not subtract reserved stock. Use
+// GetAvailableToPromise for the quantity that can still be promised to customers.
+//
 // Args:
 //
 //	productID: the ID of the product whose stock to retrieve.
@@ -512,6 +533,51 @@ func (s *ProductService) GetStock(productID string, request *http.Request, wareh
 	return totalStock, nil
 }
 
+// GetReservedStock retrieves the open reserved quantity of a product.
+//
+// Args:
+//
+//	productID: the ID of the product whose reservations to sum.
+//	variantID: an optional ID of the variant to filter the reservations by.
+//	warehouseID: an optional ID of the warehouse to filter the reservations by.
+//
+// Returns:
+//
+//	the quantity held by active, unexpired reservations, and an error if any error occurs.
+func (s *ProductService) GetReservedStock(productID string, variantID *string, warehouseID *string) (float64, error) {
+	return stockmovement.NewStockReservationService(s.db, s.ctx).GetReservedStock(productID, variantID, warehouseID)
+}
+
+// GetAvailableToPromise retrieves the stock of a product that is not reserved yet.
+//
+// Args:
+//
+//	productID: the ID of the product.
+//	variantID: an optional ID of the variant; when set the variant stock is used.
+//	request: an optional HTTP request containing additional query parameters.
+//	warehouseID: an optional ID of the warehouse to filter the stock by.
+//
+// Returns:
+//
+//	the on-hand stock (GetStock or GetVariantStock) minus the reserved stock, and an error if any error occurs.
+func (s *ProductService) GetAvailableToPromise(productID string, variantID *string, request *http.Request, warehouseID *string) (float64, error) {
+	var onHand float64
+	var err error
+	if variantID != nil {
+		onHand, err = s.GetVariantStock(productID, *variantID, request, warehouseID)
+	} else {
+		onHand, err = s.GetStock(productID, request, warehouseID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	reserved, err := s.GetReservedStock(productID, variantID, warehouseID)
+	if err != nil {
+		return 0, err
+	}
+	return onHand - reserved, nil
+}
+
 // GetSalesCount retrieves the total sales of a product in the database.
 //
 // Args:
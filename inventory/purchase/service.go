@@ -407,9 +407,52 @@ func (s *PurchaseService) UpdateTotal(purchase *models.PurchaseOrderModel) error
 	b, _ := json.Marshal(taxBreakdown)
 	purchase.TaxBreakdown = string(b)
 
+	if err := s.CheckRequisitionLimit(purchase); err != nil {
+		return err
+	}
+
 	return s.db.Omit(clause.Associations).Save(&purchase).Error
 }
 
+// CheckRequisitionLimit verifies that a purchase order created from a purchase requisition
+// stays within the requisition's approved total.
+//
+// The totals before tax of all purchase orders referencing the same requisition are added
+// up (using the given purchase's current total) and compared with the approved total, which
+// is estimated without tax as well.
+// If the sum exceeds it, or the requisition is waiting for re-approval, an error is
+// returned and the requisition has to be re-approved first. Purchases that are not
+// linked to a requisition are not checked.
+func (s *PurchaseService) CheckRequisitionLimit(purchase *models.PurchaseOrderModel) error {
+	return CheckRequisitionLimit(s.db, purchase)
+}
+
+// CheckRequisitionLimit is PurchaseService.CheckRequisitionLimit on db, e.g. the transaction
+// creating the purchase order.
+func CheckRequisitionLimit(db *gorm.DB, purchase *models.PurchaseOrderModel) error {
+	if purchase.RefID == nil || purchase.RefType == nil || *purchase.RefType != "purchase_requisition" {
+		return nil
+	}
+	var requisition models.PurchaseRequisitionModel
+	if err := db.Where("id = ?", *purchase.RefID).First(&requisition).Error; err != nil {
+		return err
+	}
+	if requisition.Status != models.RequisitionStatusApproved && requisition.Status != models.RequisitionStatusConverted {
+		return errors.New("purchase requisition is not approved")
+	}
+	var otherTotal float64
+	if err := db.Model(&models.PurchaseOrderModel{}).
+		Where("ref_id = ? AND ref_type = ? AND id <> ?", requisition.ID, "purchase_requisition", purchase.ID).
+		Select("COALESCE(SUM(total_before_tax), 0)").
+		Scan(&otherTotal).Error; err != nil {
+		return err
+	}
+	if otherTotal+purchase.TotalBeforeTax > requisition.ApprovedTotal {
+		return fmt.Errorf("purchase total exceeds approved requisition %s, re-approval required", requisition.RequisitionNumber)
+	}
+	return nil
+}
+
 // CalculateTaxes calculates the total tax for a given base amount and a list of tax models.
 //
 // If the isCompound flag is true, the total tax is calculated by adding the tax amount of each tax model to the total amount.
@@ -540,6 +583,11 @@ func (s *PurchaseService) PostPurchase(id string, data *models.PurchaseOrderMode
 	if len(data.Items) == 0 {
 		return errors.New("items is required")
 	}
+	for _, v := range data.Items {
+		if v.RefItemID != nil {
+			return errors.New("bill references purchase order lines, post it through three-way matching")
+		}
+	}
 	now := time.Now()
 
 	if data.PaymentTermsCode != "" {
@@ -573,6 +621,9 @@ func (s *PurchaseService) PostPurchase(id string, data *models.PurchaseOrderMode
 	if data.PaymentAccountID == nil {
 		return errors.New("payment account is required")
 	}
+	if err := s.CheckRequisitionLimit(data); err != nil {
+		return err
+	}
 	assetID := utils.Uuid()
 	err = s.db.Transaction(func(tx *gorm.DB) error {
 		s.financeService.TransactionService.SetDB(tx)
@@ -665,6 +716,13 @@ func (s *PurchaseService) PostPurchase(id string, data *models.PurchaseOrderMode
 					return err
 				}
 
+				unitValue := v.UnitValue
+				if unitValue == 0 {
+					unitValue = 1
+				}
+				if err := stockmovement.UpdateAverageCost(tx, *v.ProductID, v.Quantity*unitValue, v.SubTotal); err != nil {
+					return err
+				}
 			}
 			err = tx.Save(v).Error
 			if err != nil {
@@ -756,6 +814,9 @@ func (s *PurchaseService) CreatePurchasePayment(purchase *models.PurchaseOrderMo
 		if balance < purchasePayment.Amount {
 			return errors.New("payment is more than balance")
 		}
+		if purchase.PaymentHold {
+			return fmt.Errorf("purchase %s is on payment hold: %s", purchase.PurchaseNumber, purchase.PaymentHoldReason)
+		}
 
 		if purchasePayment.AssetAccountID == nil {
 			return errors.New("asset account is required")
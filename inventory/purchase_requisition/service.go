@@ -0,0 +1,704 @@
+package purchase_requisition
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/auth"
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/inventory/purchase"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type PurchaseRequisitionService struct {
+	db              *gorm.DB
+	ctx             *context.ERPContext
+	purchaseService *purchase.PurchaseService
+	rbacService     *auth.RBACService
+}
+
+// NewPurchaseRequisitionService creates a new instance of PurchaseRequisitionService with the given database connection, context and purchase service.
+//
+// The RBAC service is taken from the context when available and is used to check
+// the permission required by each approval rule.
+func NewPurchaseRequisitionService(db *gorm.DB, ctx *context.ERPContext, purchaseService *purchase.PurchaseService) *PurchaseRequisitionService {
+	var rbacService *auth.RBACService
+	if rbacSrv, ok := ctx.RBACService.(*auth.RBACService); ok {
+		rbacService = rbacSrv
+	}
+	return &PurchaseRequisitionService{
+		db:              db,
+		ctx:             ctx,
+		purchaseService: purchaseService,
+		rbacService:     rbacService,
+	}
+}
+
+// Migrate migrates the database schema needed for the PurchaseRequisitionService.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.PurchaseRequisitionModel{},
+		&models.PurchaseRequisitionItemModel{},
+		&models.PurchaseApprovalRuleModel{},
+		&models.PurchaseRequisitionApprovalModel{},
+	)
+}
+
+// SetRBACService sets the RBAC service used to check approver permissions.
+func (s *PurchaseRequisitionService) SetRBACService(rbacService *auth.RBACService) {
+	s.rbacService = rbacService
+}
+
+// CreateApprovalRule creates a new approval rule.
+func (s *PurchaseRequisitionService) CreateApprovalRule(data *models.PurchaseApprovalRuleModel) error {
+	return s.db.Create(data).Error
+}
+
+// UpdateApprovalRule updates the approval rule with the given ID.
+func (s *PurchaseRequisitionService) UpdateApprovalRule(id string, data *models.PurchaseApprovalRuleModel) error {
+	return s.db.Omit(clause.Associations).Where("id = ?", id).Save(data).Error
+}
+
+// DeleteApprovalRule deletes the approval rule with the given ID.
+func (s *PurchaseRequisitionService) DeleteApprovalRule(id string) error {
+	return s.db.Where("id = ?", id).Delete(&models.PurchaseApprovalRuleModel{}).Error
+}
+
+// GetApprovalRules returns all approval rules of a company ordered by level.
+func (s *PurchaseRequisitionService) GetApprovalRules(companyID string) ([]models.PurchaseApprovalRuleModel, error) {
+	var rules []models.PurchaseApprovalRuleModel
+	err := s.db.Preload("Branch").Preload("ProductCategory").
+		Where("company_id = ?", companyID).
+		Order("level asc, min_amount asc").
+		Find(&rules).Error
+	return rules, err
+}
+
+// CreateRequisition creates a new purchase requisition in DRAFT status and calculates its total.
+func (s *PurchaseRequisitionService) CreateRequisition(data *models.PurchaseRequisitionModel) error {
+	if data.RequisitionNumber == "" {
+		data.RequisitionNumber = fmt.Sprintf("PR-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.Date.IsZero() {
+		data.Date = time.Now()
+	}
+	data.Status = models.RequisitionStatusDraft
+	data.ApprovalLevel = 0
+	data.ApprovedTotal = 0
+	data.Total = 0
+	for i := range data.Items {
+		s.calculateItem(&data.Items[i])
+		data.Total += data.Items[i].Total
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdateRequisition updates the header of a draft or rejected requisition.
+func (s *PurchaseRequisitionService) UpdateRequisition(id string, data *models.PurchaseRequisitionModel) error {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return err
+	}
+	if !isEditable(requisition) {
+		return errors.New("requisition can not be edited")
+	}
+	return s.db.Omit(clause.Associations, "status", "approval_level", "approved_total", "total").
+		Where("id = ?", id).Updates(data).Error
+}
+
+// DeleteRequisition deletes a draft requisition with its items and approval history.
+func (s *PurchaseRequisitionService) DeleteRequisition(id string) error {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return err
+	}
+	if requisition.Status != models.RequisitionStatusDraft {
+		return errors.New("only draft requisition can be deleted")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("requisition_id = ?", id).Delete(&models.PurchaseRequisitionItemModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("requisition_id = ?", id).Delete(&models.PurchaseRequisitionApprovalModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.PurchaseRequisitionModel{}).Error
+	})
+}
+
+// GetRequisitions retrieves a paginated list of purchase requisitions.
+//
+// The search query is applied to the requisition number and description. If the
+// request contains a company ID header, the result is filtered by the company ID.
+// The status, branch_id, organization_id and employee_id query parameters can
+// be used to narrow down the result.
+func (s *PurchaseRequisitionService) GetRequisitions(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Employee", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name")
+	}).Preload("Organization").Preload("Branch")
+	if search != "" {
+		stmt = stmt.Where("requisition_number ILIKE ? OR description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	for _, key := range []string{"status", "branch_id", "organization_id", "employee_id"} {
+		if request.URL.Query().Get(key) != "" {
+			stmt = stmt.Where(key+" = ?", request.URL.Query().Get(key))
+		}
+	}
+	stmt = stmt.Model(&models.PurchaseRequisitionModel{}).Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.PurchaseRequisitionModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetRequisitionByID retrieves a purchase requisition by its ID.
+//
+// Items, approval history and the purchase orders created from the requisition
+// are loaded. For a submitted requisition the next pending approval rule is set
+// in PendingRule.
+func (s *PurchaseRequisitionService) GetRequisitionByID(id string) (*models.PurchaseRequisitionModel, error) {
+	var requisition models.PurchaseRequisitionModel
+	err := s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Product").Preload("Variant").Preload("Unit").Preload("Vendor").Preload("Warehouse").Order("created_at asc")
+	}).Preload("Approvals", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "full_name")
+		}).Order("date asc")
+	}).Preload("Employee").Preload("Organization").Preload("Branch").
+		Where("id = ?", id).First(&requisition).Error
+	if err != nil {
+		return nil, err
+	}
+
+	s.db.Where("ref_id = ? AND ref_type = ?", requisition.ID, "purchase_requisition").Find(&requisition.PurchaseOrders)
+
+	if requisition.Status == models.RequisitionStatusSubmitted {
+		rules, err := s.GetRequiredRules(&requisition)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range rules {
+			if v.Level > requisition.ApprovalLevel {
+				requisition.PendingRule = &rules[i]
+				break
+			}
+		}
+	}
+	return &requisition, nil
+}
+
+// AddItem adds a new item to a draft or rejected requisition and recalculates its total.
+func (s *PurchaseRequisitionService) AddItem(requisitionID string, item *models.PurchaseRequisitionItemModel) error {
+	requisition, err := s.GetRequisitionByID(requisitionID)
+	if err != nil {
+		return err
+	}
+	if !isEditable(requisition) {
+		return errors.New("requisition can not be edited")
+	}
+	item.RequisitionID = requisitionID
+	s.calculateItem(item)
+	if err := s.db.Create(item).Error; err != nil {
+		return err
+	}
+	return s.UpdateTotal(requisitionID)
+}
+
+// UpdateItem updates an item of a draft or rejected requisition and recalculates its total.
+func (s *PurchaseRequisitionService) UpdateItem(requisitionID, itemID string, item *models.PurchaseRequisitionItemModel) error {
+	requisition, err := s.GetRequisitionByID(requisitionID)
+	if err != nil {
+		return err
+	}
+	if !isEditable(requisition) {
+		return errors.New("requisition can not be edited")
+	}
+	item.ID = itemID
+	item.RequisitionID = requisitionID
+	s.calculateItem(item)
+	if err := s.db.Omit(clause.Associations).Where("id = ? AND requisition_id = ?", itemID, requisitionID).Save(item).Error; err != nil {
+		return err
+	}
+	return s.UpdateTotal(requisitionID)
+}
+
+// DeleteItem deletes an item of a draft or rejected requisition and recalculates its total.
+func (s *PurchaseRequisitionService) DeleteItem(requisitionID, itemID string) error {
+	requisition, err := s.GetRequisitionByID(requisitionID)
+	if err != nil {
+		return err
+	}
+	if !isEditable(requisition) {
+		return errors.New("requisition can not be edited")
+	}
+	if err := s.db.Where("id = ? AND requisition_id = ?", itemID, requisitionID).Delete(&models.PurchaseRequisitionItemModel{}).Error; err != nil {
+		return err
+	}
+	return s.UpdateTotal(requisitionID)
+}
+
+// UpdateTotal recalculates the total of a requisition from its items.
+func (s *PurchaseRequisitionService) UpdateTotal(requisitionID string) error {
+	var total float64
+	if err := s.db.Model(&models.PurchaseRequisitionItemModel{}).
+		Where("requisition_id = ?", requisitionID).
+		Select("COALESCE(SUM(total), 0)").
+		Scan(&total).Error; err != nil {
+		return err
+	}
+	return s.db.Model(&models.PurchaseRequisitionModel{}).Where("id = ?", requisitionID).Update("total", total).Error
+}
+
+func (s *PurchaseRequisitionService) calculateItem(item *models.PurchaseRequisitionItemModel) {
+	if item.UnitValue == 0 {
+		item.UnitValue = 1
+	}
+	if item.ProductCategoryID == nil && item.ProductID != nil {
+		var product models.ProductModel
+		if err := s.db.Select("id", "category_id").Where("id = ?", *item.ProductID).First(&product).Error; err == nil {
+			item.ProductCategoryID = product.CategoryID
+		}
+	}
+	item.Total = item.Quantity * item.UnitValue * item.EstimatedPrice
+}
+
+func isEditable(requisition *models.PurchaseRequisitionModel) bool {
+	return requisition.Status == models.RequisitionStatusDraft || requisition.Status == models.RequisitionStatusRejected
+}
+
+// GetRequiredRules returns the approval rules that apply to a requisition, ordered by level.
+//
+// A rule applies when it is active, belongs to the requisition's company, its
+// amount range contains the requisition total, its branch is empty or equal to
+// the requisition branch, and its product category is empty or used by at least
+// one item. When several rules share a level only the most specific one is
+// kept (a branch and a product category each count once; on a tie the first
+// rule found is kept), so each level needs exactly one approval.
+func (s *PurchaseRequisitionService) GetRequiredRules(requisition *models.PurchaseRequisitionModel) ([]models.PurchaseApprovalRuleModel, error) {
+	var rules []models.PurchaseApprovalRuleModel
+	stmt := s.db.Where("is_active = ?", true).
+		Where("min_amount <= ?", requisition.Total).
+		Where("max_amount IS NULL OR max_amount >= ?", requisition.Total)
+	if requisition.CompanyID != nil {
+		stmt = stmt.Where("company_id = ?", *requisition.CompanyID)
+	}
+	if requisition.BranchID != nil {
+		stmt = stmt.Where("branch_id IS NULL OR branch_id = ?", *requisition.BranchID)
+	} else {
+		stmt = stmt.Where("branch_id IS NULL")
+	}
+	if err := stmt.Order("level asc, min_amount asc, id asc").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	categories := map[string]bool{}
+	for _, v := range requisition.Items {
+		if v.ProductCategoryID != nil {
+			categories[*v.ProductCategoryID] = true
+		}
+	}
+
+	byLevel := map[int]models.PurchaseApprovalRuleModel{}
+	for _, v := range rules {
+		if v.ProductCategoryID != nil && !categories[*v.ProductCategoryID] {
+			continue
+		}
+		current, ok := byLevel[v.Level]
+		if !ok || ruleSpecificity(v) > ruleSpecificity(current) {
+			byLevel[v.Level] = v
+		}
+	}
+	result := make([]models.PurchaseApprovalRuleModel, 0, len(byLevel))
+	for _, v := range byLevel {
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Level < result[j].Level
+	})
+	return result, nil
+}
+
+func ruleSpecificity(rule models.PurchaseApprovalRuleModel) int {
+	score := 0
+	if rule.BranchID != nil {
+		score++
+	}
+	if rule.ProductCategoryID != nil {
+		score++
+	}
+	return score
+}
+
+// SubmitRequisition submits a draft or rejected requisition for approval.
+//
+// If no approval rule applies to the requisition it is approved immediately.
+func (s *PurchaseRequisitionService) SubmitRequisition(id string, userID string, notes string) error {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return err
+	}
+	if !isEditable(requisition) {
+		return errors.New("requisition already submitted")
+	}
+	if len(requisition.Items) == 0 {
+		return errors.New("requisition items is empty")
+	}
+	return s.startApproval(requisition, userID, "SUBMITTED", notes)
+}
+
+// RequestReapproval restarts the approval chain of an approved requisition with a new total.
+//
+// It is used when a purchase order needs to exceed the approved amount. The
+// requisition goes back to SUBMITTED with the new total; once the chain is
+// approved again the approved total is raised to the new amount.
+func (s *PurchaseRequisitionService) RequestReapproval(id string, userID string, newTotal float64, notes string) error {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return err
+	}
+	if requisition.Status != models.RequisitionStatusApproved && requisition.Status != models.RequisitionStatusConverted {
+		return errors.New("only approved requisition can be re-approved")
+	}
+	if newTotal <= requisition.ApprovedTotal {
+		return errors.New("new total must be greater than approved total")
+	}
+	requisition.Total = newTotal
+	return s.startApproval(requisition, userID, "REAPPROVAL", notes)
+}
+
+func (s *PurchaseRequisitionService) startApproval(requisition *models.PurchaseRequisitionModel, userID string, action string, notes string) error {
+	rules, err := s.GetRequiredRules(requisition)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.PurchaseRequisitionApprovalModel{
+			RequisitionID: requisition.ID,
+			Action:        action,
+			Amount:        requisition.Total,
+			Date:          now,
+			Notes:         notes,
+			UserID:        &userID,
+		}).Error; err != nil {
+			return err
+		}
+		data := map[string]any{
+			"status":         models.RequisitionStatusSubmitted,
+			"approval_level": 0,
+			"total":          requisition.Total,
+		}
+		if len(rules) == 0 {
+			data["status"] = models.RequisitionStatusApproved
+			data["approved_total"] = requisition.Total
+			data["approved_at"] = now
+		}
+		return tx.Model(&models.PurchaseRequisitionModel{}).Where("id = ?", requisition.ID).Updates(data).Error
+	})
+}
+
+// ApproveRequisition records an approval of the pending level of a submitted requisition.
+//
+// The user must be the rule's approver (when set) and must hold the rule's RBAC
+// permission (when set). After the last level the requisition becomes APPROVED
+// and its total becomes the approved total. A converted requisition that went
+// through re-approval returns to CONVERTED.
+func (s *PurchaseRequisitionService) ApproveRequisition(id string, userID string, notes string) error {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return err
+	}
+	if requisition.Status != models.RequisitionStatusSubmitted {
+		return errors.New("requisition is not waiting for approval")
+	}
+	rules, err := s.GetRequiredRules(requisition)
+	if err != nil {
+		return err
+	}
+	rule := requisition.PendingRule
+	if rule == nil {
+		return errors.New("no pending approval rule")
+	}
+	if err := s.checkApprover(rule, userID, requisition.CompanyID); err != nil {
+		return err
+	}
+
+	isLast := rule.Level == rules[len(rules)-1].Level
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.PurchaseRequisitionApprovalModel{
+			RequisitionID: requisition.ID,
+			RuleID:        &rule.ID,
+			Level:         rule.Level,
+			Action:        "APPROVED",
+			Amount:        requisition.Total,
+			Date:          now,
+			Notes:         notes,
+			UserID:        &userID,
+		}).Error; err != nil {
+			return err
+		}
+		data := map[string]any{"approval_level": rule.Level}
+		if isLast {
+			data["status"] = models.RequisitionStatusApproved
+			if len(requisition.PurchaseOrders) > 0 && s.allItemsConverted(requisition) {
+				data["status"] = models.RequisitionStatusConverted
+			}
+			data["approved_total"] = requisition.Total
+			data["approved_at"] = now
+		}
+		return tx.Model(&models.PurchaseRequisitionModel{}).Where("id = ?", requisition.ID).Updates(data).Error
+	})
+}
+
+// RejectRequisition rejects a submitted requisition at its pending level.
+//
+// A rejected requisition can be edited and submitted again.
+func (s *PurchaseRequisitionService) RejectRequisition(id string, userID string, notes string) error {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return err
+	}
+	if requisition.Status != models.RequisitionStatusSubmitted {
+		return errors.New("requisition is not waiting for approval")
+	}
+	rule := requisition.PendingRule
+	if rule == nil {
+		return errors.New("no pending approval rule")
+	}
+	if err := s.checkApprover(rule, userID, requisition.CompanyID); err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.PurchaseRequisitionApprovalModel{
+			RequisitionID: requisition.ID,
+			RuleID:        &rule.ID,
+			Level:         rule.Level,
+			Action:        "REJECTED",
+			Amount:        requisition.Total,
+			Date:          time.Now(),
+			Notes:         notes,
+			UserID:        &userID,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.PurchaseRequisitionModel{}).Where("id = ?", requisition.ID).Updates(map[string]any{
+			"status":         models.RequisitionStatusRejected,
+			"approval_level": 0,
+		}).Error
+	})
+}
+
+// CancelRequisition cancels a requisition that has not been converted into purchase orders.
+func (s *PurchaseRequisitionService) CancelRequisition(id string, userID string, notes string) error {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return err
+	}
+	if len(requisition.PurchaseOrders) > 0 {
+		return errors.New("requisition already has purchase orders")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.PurchaseRequisitionApprovalModel{
+			RequisitionID: requisition.ID,
+			Action:        "CANCELLED",
+			Amount:        requisition.Total,
+			Date:          time.Now(),
+			Notes:         notes,
+			UserID:        &userID,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.PurchaseRequisitionModel{}).Where("id = ?", requisition.ID).Update("status", models.RequisitionStatusCancelled).Error
+	})
+}
+
+func (s *PurchaseRequisitionService) checkApprover(rule *models.PurchaseApprovalRuleModel, userID string, companyID *string) error {
+	if rule.ApproverUserID != nil && *rule.ApproverUserID != userID {
+		return errors.New("user is not the approver of this level")
+	}
+	if rule.PermissionName == "" {
+		return nil
+	}
+	if s.rbacService == nil {
+		return errors.New("rbac service is not available")
+	}
+	var ok bool
+	var err error
+	if companyID != nil {
+		ok, err = s.rbacService.CheckPermissionWithCompanyID(userID, *companyID, []string{rule.PermissionName})
+	} else {
+		ok, err = s.rbacService.CheckPermission(userID, []string{rule.PermissionName})
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("user does not have permission %s", rule.PermissionName)
+	}
+	return nil
+}
+
+func (s *PurchaseRequisitionService) allItemsConverted(requisition *models.PurchaseRequisitionModel) bool {
+	for _, v := range requisition.Items {
+		if v.PurchaseID == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ConvertToPurchaseOrders converts the approved items of a requisition into purchase orders, one per vendor.
+//
+// Only items that have a vendor and are not yet converted are used; itemIDs can
+// be given to convert a subset of them. Each purchase order references the
+// requisition through RefID/RefType ("purchase_requisition") and each converted
+// item keeps the ID of its purchase order. The purchase order lines use the
+// estimated price of the requisition, which can be revised afterwards as long as
+// the purchase order total stays within the approved total (see
+// PurchaseService.CheckRequisitionLimit). When every item is converted the
+// requisition becomes CONVERTED.
+func (s *PurchaseRequisitionService) ConvertToPurchaseOrders(id string, userID string, paymentAccountID *string, itemIDs []string) ([]models.PurchaseOrderModel, error) {
+	requisition, err := s.GetRequisitionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if requisition.Status != models.RequisitionStatusApproved {
+		return nil, errors.New("requisition is not approved")
+	}
+
+	groups := map[string][]models.PurchaseRequisitionItemModel{}
+	vendorIDs := []string{}
+	for _, v := range requisition.Items {
+		if v.PurchaseID != nil {
+			continue
+		}
+		if len(itemIDs) > 0 && !utils.ContainsString(itemIDs, v.ID) {
+			continue
+		}
+		if v.VendorID == nil {
+			return nil, fmt.Errorf("vendor is required for item %s", v.Description)
+		}
+		if _, ok := groups[*v.VendorID]; !ok {
+			vendorIDs = append(vendorIDs, *v.VendorID)
+		}
+		groups[*v.VendorID] = append(groups[*v.VendorID], v)
+	}
+	if len(groups) == 0 {
+		return nil, errors.New("no item to convert")
+	}
+
+	refType := "purchase_requisition"
+	now := time.Now()
+	var purchases []models.PurchaseOrderModel
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for i, vendorID := range vendorIDs {
+			var vendor models.ContactModel
+			if err := tx.Where("id = ?", vendorID).First(&vendor).Error; err != nil {
+				return err
+			}
+			contactData, _ := json.Marshal(map[string]any{
+				"name":    vendor.Name,
+				"email":   vendor.Email,
+				"phone":   vendor.Phone,
+				"address": vendor.Address,
+			})
+			purchaseOrder := models.PurchaseOrderModel{
+				PurchaseNumber:   fmt.Sprintf("%s-%d", requisition.RequisitionNumber, i+1),
+				Description:      requisition.Description,
+				Notes:            requisition.Notes,
+				Status:           "DRAFT",
+				PurchaseDate:     now,
+				PaymentAccountID: paymentAccountID,
+				CompanyID:        requisition.CompanyID,
+				UserID:           &userID,
+				ContactID:        &vendor.ID,
+				ContactData:      string(contactData),
+				TaxBreakdown:     "{}",
+				Type:             models.PURCHASE,
+				DocumentType:     models.PURCHASE_ORDER,
+				RefID:            &requisition.ID,
+				RefType:          &refType,
+			}
+			for _, v := range groups[vendorID] {
+				subtotal := v.Quantity * v.UnitValue * v.EstimatedPrice
+				purchaseOrder.Items = append(purchaseOrder.Items, models.PurchaseOrderItemModel{
+					Description:        v.Description,
+					Notes:              v.Notes,
+					ProductID:          v.ProductID,
+					VariantID:          v.VariantID,
+					Quantity:           v.Quantity,
+					UnitID:             v.UnitID,
+					UnitValue:          v.UnitValue,
+					UnitPrice:          v.EstimatedPrice,
+					SubtotalBeforeDisc: subtotal,
+					SubTotal:           subtotal,
+					Total:              subtotal,
+					WarehouseID:        v.WarehouseID,
+				})
+				purchaseOrder.TotalBeforeDisc += subtotal
+				purchaseOrder.TotalBeforeTax += subtotal
+				purchaseOrder.Subtotal += subtotal
+				purchaseOrder.Total += subtotal
+			}
+			if err := tx.Create(&purchaseOrder).Error; err != nil {
+				return err
+			}
+			for _, v := range groups[vendorID] {
+				if err := tx.Model(&models.PurchaseRequisitionItemModel{}).Where("id = ?", v.ID).Update("purchase_id", purchaseOrder.ID).Error; err != nil {
+					return err
+				}
+			}
+			purchases = append(purchases, purchaseOrder)
+		}
+
+		var remaining int64
+		if err := tx.Model(&models.PurchaseRequisitionItemModel{}).
+			Where("requisition_id = ? AND purchase_id IS NULL", requisition.ID).
+			Count(&remaining).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.PurchaseRequisitionApprovalModel{
+			RequisitionID: requisition.ID,
+			Action:        "CONVERTED",
+			Amount:        requisition.ApprovedTotal,
+			Date:          now,
+			Notes:         fmt.Sprintf("%d purchase order(s) created", len(purchases)),
+			UserID:        &userID,
+		}).Error; err != nil {
+			return err
+		}
+		if remaining == 0 {
+			return tx.Model(&models.PurchaseRequisitionModel{}).Where("id = ?", requisition.ID).Update("status", models.RequisitionStatusConverted).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purchases, nil
+}
+
+// GetApprovalHistory returns the approval history of a requisition ordered by date.
+func (s *PurchaseRequisitionService) GetApprovalHistory(id string) ([]models.PurchaseRequisitionApprovalModel, error) {
+	var history []models.PurchaseRequisitionApprovalModel
+	err := s.db.Preload("Rule").Preload("User", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name")
+	}).Where("requisition_id = ?", id).Order("date asc").Find(&history).Error
+	return history, err
+}
@@ -37,6 +37,11 @@ func NewPurchaseReturnService(db *gorm.DB, ctx *context.ERPContext, financeServi
 	}
 }
 
+// SetDB sets the database connection of the service, e.g. to a transaction of the caller.
+func (s *PurchaseReturnService) SetDB(db *gorm.DB) {
+	s.db = db
+}
+
 // Migrate migrates the database schema needed for the PurchaseReturnService.
 func Migrate(db *gorm.DB) error {
 	return db.AutoMigrate(&models.ReturnModel{}, &models.ReturnItemModel{})
@@ -444,7 +449,9 @@ func (s *PurchaseReturnService) ReleaseReturn(returnID string, userID string, da
 		returnPurchase.ReleasedAt = &now
 		returnPurchase.ReleasedByID = &userID
 		// CLEAR TRANSACTION
-		s.purchaseService.UpdateTotal(purchase)
+		if err := s.purchaseService.UpdateTotal(purchase); err != nil {
+			return err
+		}
 
 		if accountID != nil {
 			// if accountID is ASSET, CREATE purcahase payment return
@@ -0,0 +1,799 @@
+package quality_control
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/inventory/purchase_return"
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type QualityControlService struct {
+	db                    *gorm.DB
+	ctx                   *context.ERPContext
+	stockMovementService  *stockmovement.StockMovementService
+	purchaseReturnService *purchase_return.PurchaseReturnService
+}
+
+// NewQualityControlService creates a new instance of QualityControlService with the given database connection, context, stock movement service and purchase return service.
+func NewQualityControlService(db *gorm.DB, ctx *context.ERPContext, stockMovementService *stockmovement.StockMovementService, purchaseReturnService *purchase_return.PurchaseReturnService) *QualityControlService {
+	return &QualityControlService{
+		db:                    db,
+		ctx:                   ctx,
+		stockMovementService:  stockMovementService,
+		purchaseReturnService: purchaseReturnService,
+	}
+}
+
+// Migrate migrates the database schema needed for the QualityControlService.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.InspectionPlanModel{},
+		&models.InspectionParameterModel{},
+		&models.InspectionModel{},
+		&models.InspectionResultModel{},
+		&models.NonConformanceReportModel{},
+		&models.CorrectiveActionModel{},
+	)
+}
+
+// CreateInspectionPlan creates a new inspection plan along with its checklist parameters.
+func (s *QualityControlService) CreateInspectionPlan(data *models.InspectionPlanModel) error {
+	return s.db.Create(data).Error
+}
+
+// UpdateInspectionPlan updates the inspection plan with the given ID, omitting its parameters.
+func (s *QualityControlService) UpdateInspectionPlan(id string, data *models.InspectionPlanModel) error {
+	return s.db.Omit(clause.Associations).Where("id = ?", id).Updates(data).Error
+}
+
+// DeleteInspectionPlan deletes the inspection plan with the given ID and its parameters.
+func (s *QualityControlService) DeleteInspectionPlan(id string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("inspection_plan_id = ?", id).Delete(&models.InspectionParameterModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.InspectionPlanModel{}).Error
+	})
+}
+
+// GetInspectionPlanByID retrieves an inspection plan by its ID, with its parameters ordered by sequence.
+func (s *QualityControlService) GetInspectionPlanByID(id string) (*models.InspectionPlanModel, error) {
+	var plan models.InspectionPlanModel
+	err := s.db.Preload("Parameters", func(db *gorm.DB) *gorm.DB {
+		return db.Order("sequence asc")
+	}).Preload("Product").Where("id = ?", id).First(&plan).Error
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// GetInspectionPlans retrieves a paginated list of inspection plans.
+//
+// It takes an http.Request and a search query string as input. The search query
+// is applied to the plan name and code. If the request contains a company ID
+// header, the result is filtered by the company ID. The inspection_type and
+// product_id query parameters can be used to narrow down the result.
+func (s *QualityControlService) GetInspectionPlans(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Parameters").Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "display_name")
+	})
+	if search != "" {
+		stmt = stmt.Where("name ILIKE ? OR code ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("inspection_type") != "" {
+		stmt = stmt.Where("inspection_type = ?", request.URL.Query().Get("inspection_type"))
+	}
+	if request.URL.Query().Get("product_id") != "" {
+		stmt = stmt.Where("product_id = ?", request.URL.Query().Get("product_id"))
+	}
+	stmt = stmt.Model(&models.InspectionPlanModel{})
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.InspectionPlanModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// AddParameter adds a new checklist parameter to the inspection plan with the given ID.
+func (s *QualityControlService) AddParameter(planID string, parameter *models.InspectionParameterModel) error {
+	parameter.InspectionPlanID = planID
+	return s.db.Create(parameter).Error
+}
+
+// UpdateParameter updates the checklist parameter with the given ID.
+func (s *QualityControlService) UpdateParameter(parameterID string, parameter *models.InspectionParameterModel) error {
+	return s.db.Where("id = ?", parameterID).Updates(parameter).Error
+}
+
+// DeleteParameter deletes the checklist parameter with the given ID from the inspection plan.
+func (s *QualityControlService) DeleteParameter(planID, parameterID string) error {
+	return s.db.Where("id = ? AND inspection_plan_id = ?", parameterID, planID).Delete(&models.InspectionParameterModel{}).Error
+}
+
+// FindPlan looks up the active inspection plan for the given product and inspection type.
+//
+// A plan bound to the product takes precedence over a generic plan (one without
+// a product) of the same type. It returns gorm.ErrRecordNotFound if neither exists.
+func (s *QualityControlService) FindPlan(companyID *string, productID *string, inspectionType models.InspectionType) (*models.InspectionPlanModel, error) {
+	var plan models.InspectionPlanModel
+	stmt := s.db.Preload("Parameters").Where("inspection_type = ? AND is_active = ?", inspectionType, true)
+	if companyID != nil {
+		stmt = stmt.Where("company_id = ?", *companyID)
+	}
+	if productID != nil {
+		stmt = stmt.Where("product_id = ? OR product_id IS NULL", *productID).Order("product_id IS NULL asc")
+	} else {
+		stmt = stmt.Where("product_id IS NULL")
+	}
+	if err := stmt.First(&plan).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// CreateInspection creates a new inspection record.
+//
+// If the inspection references a plan and carries no results, an empty result
+// row is created for each of the plan parameters so the inspector only has to
+// fill in the measured values.
+func (s *QualityControlService) CreateInspection(data *models.InspectionModel) error {
+	if data.InspectionNumber == "" {
+		data.InspectionNumber = fmt.Sprintf("QC-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.Date.IsZero() {
+		data.Date = time.Now()
+	}
+	data.Status = models.InspectionStatusPending
+	if data.InspectionPlanID != nil && len(data.Results) == 0 {
+		plan, err := s.GetInspectionPlanByID(*data.InspectionPlanID)
+		if err != nil {
+			return err
+		}
+		data.InspectionType = plan.InspectionType
+		for _, v := range plan.Parameters {
+			paramID := v.ID
+			data.Results = append(data.Results, models.InspectionResultModel{
+				ParameterID: &paramID,
+				Name:        v.Name,
+			})
+		}
+	}
+	return s.db.Create(data).Error
+}
+
+// CreateInspectionsFromPurchase creates one incoming inspection for each product line of a purchase.
+//
+// For every purchase item with a product, the active INCOMING plan for the product
+// is looked up and an inspection is created referencing the purchase and the
+// purchase item. Lines without a matching plan are skipped. The quarantine
+// warehouse is stored on each inspection and used when the inspection fails.
+func (s *QualityControlService) CreateInspectionsFromPurchase(purchaseID string, quarantineWarehouseID *string) ([]models.InspectionModel, error) {
+	var purchase models.PurchaseOrderModel
+	if err := s.db.Preload("Items").Where("id = ?", purchaseID).First(&purchase).Error; err != nil {
+		return nil, err
+	}
+	secRefType := "purchase_item"
+	var inspections []models.InspectionModel
+	for _, v := range purchase.Items {
+		if v.ProductID == nil || v.Quantity <= 0 {
+			continue
+		}
+		plan, err := s.FindPlan(purchase.CompanyID, v.ProductID, models.InspectionTypeIncoming)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		itemID := v.ID
+		inspection := models.InspectionModel{
+			InspectionPlanID:      &plan.ID,
+			InspectionType:        models.InspectionTypeIncoming,
+			RefID:                 purchase.ID,
+			RefType:               "purchase",
+			SecondaryRefID:        &itemID,
+			SecondaryRefType:      &secRefType,
+			ProductID:             v.ProductID,
+			VariantID:             v.VariantID,
+			WarehouseID:           v.WarehouseID,
+			QuarantineWarehouseID: quarantineWarehouseID,
+			Quantity:              v.Quantity * v.UnitValue,
+			CompanyID:             purchase.CompanyID,
+		}
+		if inspection.Quantity == 0 {
+			inspection.Quantity = v.Quantity
+		}
+		if err := s.CreateInspection(&inspection); err != nil {
+			return nil, err
+		}
+		inspections = append(inspections, inspection)
+	}
+	return inspections, nil
+}
+
+// GetInspections retrieves a paginated list of inspections.
+//
+// It takes an http.Request and a search query string as input. The search query
+// is applied to the inspection number and notes. The inspection_type, status,
+// ref_id and ref_type query parameters can be used to filter the result.
+func (s *QualityControlService) GetInspections(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("InspectionPlan", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "code")
+	}).Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "display_name")
+	}).Preload("Warehouse", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	})
+	if search != "" {
+		stmt = stmt.Where("inspection_number ILIKE ? OR notes ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	for _, key := range []string{"inspection_type", "status", "ref_id", "ref_type"} {
+		if request.URL.Query().Get(key) != "" {
+			stmt = stmt.Where(key+" = ?", request.URL.Query().Get(key))
+		}
+	}
+	stmt = stmt.Model(&models.InspectionModel{}).Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.InspectionModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetInspectionByID retrieves an inspection by its ID along with its plan, results and warehouses.
+func (s *QualityControlService) GetInspectionByID(id string) (*models.InspectionModel, error) {
+	var inspection models.InspectionModel
+	err := s.db.Preload("InspectionPlan").
+		Preload("Results.Parameter").
+		Preload("Product").
+		Preload("Variant").
+		Preload("Warehouse").
+		Preload("QuarantineWarehouse").
+		Preload("InspectedBy", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "full_name")
+		}).
+		Where("id = ?", id).First(&inspection).Error
+	if err != nil {
+		return nil, err
+	}
+	return &inspection, nil
+}
+
+// DeleteInspection deletes a pending inspection and its results.
+func (s *QualityControlService) DeleteInspection(id string) error {
+	inspection, err := s.GetInspectionByID(id)
+	if err != nil {
+		return err
+	}
+	if inspection.Status != models.InspectionStatusPending {
+		return errors.New("only pending inspection can be deleted")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("inspection_id = ?", id).Delete(&models.InspectionResultModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.InspectionModel{}).Error
+	})
+}
+
+// EvaluateResult checks a single result against its checklist parameter.
+//
+// NUMERIC parameters pass when the value is within the min/max range (either
+// bound may be omitted), BOOLEAN parameters pass when the value is true, and
+// TEXT parameters pass when the value equals the expected value
+// (case-insensitive) or when no expected value is set.
+func EvaluateResult(parameter models.InspectionParameterModel, result models.InspectionResultModel) bool {
+	switch parameter.ParameterType {
+	case "BOOLEAN":
+		return result.BoolValue != nil && *result.BoolValue
+	case "TEXT":
+		if parameter.ExpectedValue == "" {
+			return result.TextValue != "" || !parameter.IsMandatory
+		}
+		return strings.EqualFold(strings.TrimSpace(result.TextValue), strings.TrimSpace(parameter.ExpectedValue))
+	default:
+		value := result.NumericValue
+		if value == nil && result.TextValue != "" {
+			parsed, err := strconv.ParseFloat(result.TextValue, 64)
+			if err == nil {
+				value = &parsed
+			}
+		}
+		if value == nil {
+			return !parameter.IsMandatory
+		}
+		if parameter.MinValue != nil && *value < *parameter.MinValue {
+			return false
+		}
+		if parameter.MaxValue != nil && *value > *parameter.MaxValue {
+			return false
+		}
+		return true
+	}
+}
+
+// RecordResults saves the measured values for an inspection.
+//
+// Each result is matched to an existing result row by ParameterID (or ID) and
+// evaluated against its parameter with EvaluateResult. Results without a
+// parameter are stored with the Passed flag given by the caller.
+func (s *QualityControlService) RecordResults(inspectionID string, results []models.InspectionResultModel) error {
+	inspection, err := s.GetInspectionByID(inspectionID)
+	if err != nil {
+		return err
+	}
+	if inspection.Status != models.InspectionStatusPending {
+		return errors.New("inspection already completed")
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, v := range results {
+			var existing *models.InspectionResultModel
+			for i, r := range inspection.Results {
+				if (v.ID != "" && r.ID == v.ID) || (v.ParameterID != nil && r.ParameterID != nil && *r.ParameterID == *v.ParameterID) {
+					existing = &inspection.Results[i]
+					break
+				}
+			}
+			if existing == nil {
+				v.InspectionID = inspectionID
+				if v.ParameterID != nil {
+					var parameter models.InspectionParameterModel
+					if err := tx.Where("id = ?", *v.ParameterID).First(&parameter).Error; err != nil {
+						return err
+					}
+					v.Name = parameter.Name
+					v.Passed = EvaluateResult(parameter, v)
+				}
+				if err := tx.Create(&v).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			existing.NumericValue = v.NumericValue
+			existing.TextValue = v.TextValue
+			existing.BoolValue = v.BoolValue
+			existing.Notes = v.Notes
+			if existing.Parameter != nil {
+				existing.Passed = EvaluateResult(*existing.Parameter, *existing)
+			} else {
+				existing.Passed = v.Passed
+			}
+			if err := tx.Omit(clause.Associations).Save(existing).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CompleteInspection finalizes an inspection.
+//
+// The rejected quantity defaults to the whole inspected quantity when any
+// mandatory checklist result fails, and to zero otherwise; pass a non-nil
+// rejectedQty to override it (e.g. when only part of a lot is defective).
+// Rejected stock is moved to the quarantine warehouse when one is set, and the
+// status becomes QUARANTINED; otherwise the status is FAILED. An inspection
+// with nothing rejected is PASSED.
+//
+// When stock of a purchase receipt is rejected, the draft purchase return of the rejected
+// quantity is raised within the same transaction (see RejectReceipt).
+func (s *QualityControlService) CompleteInspection(inspectionID string, userID string, date time.Time, rejectedQty *float64, notes string) (*models.InspectionModel, error) {
+	inspection, err := s.GetInspectionByID(inspectionID)
+	if err != nil {
+		return nil, err
+	}
+	if inspection.Status != models.InspectionStatusPending {
+		return nil, errors.New("inspection already completed")
+	}
+
+	passed := true
+	for _, v := range inspection.Results {
+		if v.Passed {
+			continue
+		}
+		if v.Parameter == nil || v.Parameter.IsMandatory {
+			passed = false
+			break
+		}
+	}
+
+	rejected := 0.0
+	if !passed {
+		rejected = inspection.Quantity
+	}
+	if rejectedQty != nil {
+		rejected = *rejectedQty
+	}
+	if rejected < 0 || rejected > inspection.Quantity {
+		return nil, errors.New("rejected quantity is out of range")
+	}
+
+	now := time.Now()
+	inspection.RejectedQuantity = rejected
+	inspection.AcceptedQuantity = inspection.Quantity - rejected
+	inspection.InspectedAt = &now
+	inspection.InspectedByID = &userID
+	if notes != "" {
+		inspection.Notes = notes
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		switch {
+		case rejected == 0:
+			inspection.Status = models.InspectionStatusPassed
+		case inspection.QuarantineWarehouseID != nil && inspection.WarehouseID != nil && inspection.ProductID != nil:
+			if err := s.moveStock(tx, inspection, date, *inspection.WarehouseID, *inspection.QuarantineWarehouseID, rejected,
+				fmt.Sprintf("Quarantine %s", inspection.InspectionNumber)); err != nil {
+				return err
+			}
+			inspection.QuarantinedQuantity = rejected
+			inspection.Status = models.InspectionStatusQuarantined
+		default:
+			inspection.Status = models.InspectionStatusFailed
+		}
+		if rejected > 0 && s.purchaseReturnService != nil && inspection.RefType == "purchase" && inspection.SecondaryRefID != nil {
+			returnPurchase, err := s.rejectReceipt(tx, inspection, userID, date, "")
+			if err != nil {
+				return err
+			}
+			inspection.PurchaseReturnID = &returnPurchase.ID
+		}
+		return tx.Omit(clause.Associations).Save(inspection).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inspection, nil
+}
+
+// ReleaseQuarantine moves quarantined stock of an inspection back to its original warehouse.
+//
+// It is used when a quarantined lot is accepted after all (e.g. use-as-is
+// disposition). The released quantity is added back to the accepted quantity.
+func (s *QualityControlService) ReleaseQuarantine(inspectionID string, quantity float64, date time.Time) error {
+	inspection, err := s.GetInspectionByID(inspectionID)
+	if err != nil {
+		return err
+	}
+	if inspection.Status != models.InspectionStatusQuarantined {
+		return errors.New("inspection is not quarantined")
+	}
+	if quantity <= 0 || quantity > inspection.QuarantinedQuantity {
+		return errors.New("quantity exceeds quarantined quantity")
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.moveStock(tx, inspection, date, *inspection.QuarantineWarehouseID, *inspection.WarehouseID, quantity,
+			fmt.Sprintf("Release quarantine %s", inspection.InspectionNumber)); err != nil {
+			return err
+		}
+		inspection.QuarantinedQuantity -= quantity
+		inspection.RejectedQuantity -= quantity
+		inspection.AcceptedQuantity += quantity
+		if inspection.QuarantinedQuantity == 0 && inspection.RejectedQuantity == 0 {
+			inspection.Status = models.InspectionStatusPassed
+		}
+		return tx.Omit(clause.Associations).Save(inspection).Error
+	})
+}
+
+// moveStock records a pair of transfer movements for the inspected product
+// between two warehouses, referencing the inspection.
+func (s *QualityControlService) moveStock(tx *gorm.DB, inspection *models.InspectionModel, date time.Time, fromWarehouseID, toWarehouseID string, quantity float64, description string) error {
+	refType := "inspection"
+	s.stockMovementService.SetDB(tx)
+	defer s.stockMovementService.SetDB(s.db)
+
+	out, err := s.stockMovementService.AddMovement(date, *inspection.ProductID, fromWarehouseID, inspection.VariantID, nil, nil, inspection.CompanyID, -quantity, models.MovementTypeTransfer, inspection.ID, description)
+	if err != nil {
+		return err
+	}
+	in, err := s.stockMovementService.AddMovement(date, *inspection.ProductID, toWarehouseID, inspection.VariantID, nil, nil, inspection.CompanyID, quantity, models.MovementTypeTransfer, inspection.ID, description)
+	if err != nil {
+		return err
+	}
+	for _, m := range []*models.StockMovementModel{out, in} {
+		m.ReferenceType = &refType
+		m.SecondaryRefID = &inspection.RefID
+		m.SecondaryRefType = &inspection.RefType
+		if err := tx.Save(m).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RejectReceipt raises a draft purchase return for the rejected quantity of an incoming inspection.
+//
+// The inspection must reference a purchase item (see CreateInspectionsFromPurchase)
+// and have a rejected quantity. The return line copies the price, discount and tax
+// of the purchase item; when the stock has been quarantined the return is taken
+// from the quarantine warehouse. The return is left in DRAFT so it can be
+// reviewed and posted with PurchaseReturnService.ReleaseReturn.
+//
+// CompleteInspection raises the return itself; RejectReceipt is for inspections
+// completed before, or without, a purchase return service.
+func (s *QualityControlService) RejectReceipt(inspectionID string, userID string, date time.Time, reason string) (*models.ReturnModel, error) {
+	inspection, err := s.GetInspectionByID(inspectionID)
+	if err != nil {
+		return nil, err
+	}
+	if inspection.RefType != "purchase" || inspection.SecondaryRefID == nil {
+		return nil, errors.New("inspection is not linked to a purchase receipt")
+	}
+	if inspection.RejectedQuantity <= 0 {
+		return nil, errors.New("inspection has no rejected quantity")
+	}
+	if inspection.PurchaseReturnID != nil {
+		return nil, errors.New("purchase return already raised")
+	}
+	if s.purchaseReturnService == nil {
+		return nil, errors.New("purchase return service is not set")
+	}
+
+	var returnPurchase *models.ReturnModel
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		returnPurchase, err = s.rejectReceipt(tx, inspection, userID, date, reason)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.InspectionModel{}).Where("id = ?", inspection.ID).Update("purchase_return_id", returnPurchase.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return returnPurchase, nil
+}
+
+// rejectReceipt creates the draft purchase return of the rejected quantity of an inspection in tx.
+func (s *QualityControlService) rejectReceipt(tx *gorm.DB, inspection *models.InspectionModel, userID string, date time.Time, reason string) (*models.ReturnModel, error) {
+	var purchaseItem models.PurchaseOrderItemModel
+	if err := tx.Preload("Tax").Where("id = ?", *inspection.SecondaryRefID).First(&purchaseItem).Error; err != nil {
+		return nil, err
+	}
+	var purchase models.PurchaseOrderModel
+	if err := tx.Where("id = ?", inspection.RefID).First(&purchase).Error; err != nil {
+		return nil, err
+	}
+
+	value := purchaseItem.UnitValue
+	if value == 0 {
+		value = 1
+	}
+	warehouseID := purchaseItem.WarehouseID
+	if inspection.QuarantinedQuantity > 0 {
+		warehouseID = inspection.QuarantineWarehouseID
+	}
+	if reason == "" {
+		reason = fmt.Sprintf("Rejected on inspection %s", inspection.InspectionNumber)
+	}
+
+	returnItem := models.ReturnItemModel{
+		Description:      purchaseItem.Description,
+		Notes:            inspection.Notes,
+		ProductID:        purchaseItem.ProductID,
+		VariantID:        purchaseItem.VariantID,
+		Quantity:         inspection.RejectedQuantity / value,
+		OriginalQuantity: purchaseItem.Quantity,
+		UnitPrice:        purchaseItem.UnitPrice,
+		UnitID:           purchaseItem.UnitID,
+		Value:            value,
+		DiscountPercent:  purchaseItem.DiscountPercent,
+		TaxID:            purchaseItem.TaxID,
+		Tax:              purchaseItem.Tax,
+		WarehouseID:      warehouseID,
+	}
+	if purchaseItem.DiscountPercent == 0 && purchaseItem.Quantity > 0 {
+		returnItem.DiscountAmount = purchaseItem.DiscountAmount * returnItem.Quantity / purchaseItem.Quantity
+	}
+
+	returnPurchase := models.ReturnModel{
+		ReturnNumber: fmt.Sprintf("RTN-%s", inspection.InspectionNumber),
+		Description:  fmt.Sprintf("Retur %s (%s)", purchase.PurchaseNumber, inspection.InspectionNumber),
+		Date:         date,
+		ReturnType:   "PURCHASE_RETURN",
+		RefID:        purchase.ID,
+		CompanyID:    purchase.CompanyID,
+		UserID:       &userID,
+		Reason:       reason,
+		Notes:        inspection.Notes,
+	}
+
+	if err := tx.Omit(clause.Associations).Create(&returnPurchase).Error; err != nil {
+		return nil, err
+	}
+	returnItem.ReturnID = returnPurchase.ID
+	if err := tx.Omit("Tax").Create(&returnItem).Error; err != nil {
+		return nil, err
+	}
+
+	// Recalculate subtotal, tax and total of the return line
+	s.purchaseReturnService.SetDB(tx)
+	defer s.purchaseReturnService.SetDB(s.db)
+	if err := s.purchaseReturnService.UpdateItem(&returnItem); err != nil {
+		return nil, err
+	}
+	returnPurchase.Items = []models.ReturnItemModel{returnItem}
+	return &returnPurchase, nil
+}
+
+// CreateNCR creates a new non-conformance report.
+//
+// When the report references an inspection, the description defaults to the
+// failed checklist results of that inspection.
+func (s *QualityControlService) CreateNCR(data *models.NonConformanceReportModel) error {
+	if data.NCRNumber == "" {
+		data.NCRNumber = fmt.Sprintf("NCR-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.Date.IsZero() {
+		data.Date = time.Now()
+	}
+	data.Status = "OPEN"
+	if data.InspectionID != nil && data.Description == "" {
+		inspection, err := s.GetInspectionByID(*data.InspectionID)
+		if err != nil {
+			return err
+		}
+		if data.CompanyID == nil {
+			data.CompanyID = inspection.CompanyID
+		}
+		var failed []string
+		for _, v := range inspection.Results {
+			if !v.Passed {
+				failed = append(failed, v.Name)
+			}
+		}
+		data.Description = fmt.Sprintf("Inspection %s failed: %s", inspection.InspectionNumber, strings.Join(failed, ", "))
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdateNCR updates the non-conformance report with the given ID, omitting its corrective actions.
+func (s *QualityControlService) UpdateNCR(id string, data *models.NonConformanceReportModel) error {
+	return s.db.Omit(clause.Associations).Where("id = ?", id).Updates(data).Error
+}
+
+// GetNCRByID retrieves a non-conformance report by its ID along with its inspection and corrective actions.
+func (s *QualityControlService) GetNCRByID(id string) (*models.NonConformanceReportModel, error) {
+	var ncr models.NonConformanceReportModel
+	err := s.db.Preload("Inspection").
+		Preload("CorrectiveActions.AssignedTo", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "full_name")
+		}).
+		Preload("ReportedBy", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "full_name")
+		}).
+		Preload("ClosedBy", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "full_name")
+		}).
+		Where("id = ?", id).First(&ncr).Error
+	if err != nil {
+		return nil, err
+	}
+	return &ncr, nil
+}
+
+// GetNCRs retrieves a paginated list of non-conformance reports.
+//
+// The search query is applied to the NCR number and title. The status and
+// severity query parameters can be used to filter the result.
+func (s *QualityControlService) GetNCRs(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("CorrectiveActions")
+	if search != "" {
+		stmt = stmt.Where("ncr_number ILIKE ? OR title ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	if request.URL.Query().Get("severity") != "" {
+		stmt = stmt.Where("severity = ?", request.URL.Query().Get("severity"))
+	}
+	stmt = stmt.Model(&models.NonConformanceReportModel{}).Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.NonConformanceReportModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// AddCorrectiveAction adds a corrective or preventive action to the NCR with the given ID.
+//
+// Adding an action to an OPEN report moves it to IN_PROGRESS.
+func (s *QualityControlService) AddCorrectiveAction(ncrID string, action *models.CorrectiveActionModel) error {
+	ncr, err := s.GetNCRByID(ncrID)
+	if err != nil {
+		return err
+	}
+	if ncr.Status == "CLOSED" {
+		return errors.New("ncr already closed")
+	}
+	action.NCRID = ncrID
+	action.Status = "OPEN"
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(action).Error; err != nil {
+			return err
+		}
+		if ncr.Status == "OPEN" {
+			return tx.Model(&models.NonConformanceReportModel{}).Where("id = ?", ncrID).Update("status", "IN_PROGRESS").Error
+		}
+		return nil
+	})
+}
+
+// UpdateCorrectiveActionStatus updates the status of a corrective action.
+//
+// Valid statuses are OPEN, DONE and VERIFIED. The completion time is set when
+// the action moves to DONE.
+func (s *QualityControlService) UpdateCorrectiveActionStatus(actionID string, status string, notes string) error {
+	if !utils.ContainsString([]string{"OPEN", "DONE", "VERIFIED"}, status) {
+		return errors.New("invalid corrective action status")
+	}
+	data := map[string]any{"status": status}
+	if notes != "" {
+		data["notes"] = notes
+	}
+	if status == "DONE" {
+		data["completed_at"] = time.Now()
+	}
+	return s.db.Model(&models.CorrectiveActionModel{}).Where("id = ?", actionID).Updates(data).Error
+}
+
+// CloseNCR closes the non-conformance report with the given ID.
+//
+// All corrective actions of the report must be DONE or VERIFIED.
+func (s *QualityControlService) CloseNCR(ncrID string, userID string, rootCause string) error {
+	ncr, err := s.GetNCRByID(ncrID)
+	if err != nil {
+		return err
+	}
+	if ncr.Status == "CLOSED" {
+		return errors.New("ncr already closed")
+	}
+	for _, v := range ncr.CorrectiveActions {
+		if v.Status == "OPEN" {
+			return errors.New("ncr has open corrective actions")
+		}
+	}
+	now := time.Now()
+	data := map[string]any{
+		"status":       "CLOSED",
+		"closed_at":    now,
+		"closed_by_id": userID,
+	}
+	if rootCause != "" {
+		data["root_cause"] = rootCause
+	}
+	return s.db.Model(&models.NonConformanceReportModel{}).Where("id = ?", ncrID).Updates(data).Error
+}
@@ -0,0 +1,740 @@
+package rfq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/inventory/purchase"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultOnTimeRate is used for vendors without any received purchase order history.
+const defaultOnTimeRate = 0.5
+
+type RFQService struct {
+	db  *gorm.DB
+	ctx *context.ERPContext
+}
+
+// NewRFQService creates a new instance of RFQService with the given database connection and context.
+func NewRFQService(db *gorm.DB, ctx *context.ERPContext) *RFQService {
+	return &RFQService{
+		db:  db,
+		ctx: ctx,
+	}
+}
+
+// Migrate migrates the database schema needed for the RFQService.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.RequestForQuotationModel{},
+		&models.RFQItemModel{},
+		&models.RFQVendorModel{},
+		&models.VendorQuoteLineModel{},
+	)
+}
+
+// CreateRFQ creates a new request for quotation with its items and invited vendors.
+func (s *RFQService) CreateRFQ(data *models.RequestForQuotationModel) error {
+	if data.RFQNumber == "" {
+		data.RFQNumber = fmt.Sprintf("RFQ-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.Date.IsZero() {
+		data.Date = time.Now()
+	}
+	data.Status = "DRAFT"
+	return s.db.Create(data).Error
+}
+
+// CreateRFQFromRequisition creates a draft RFQ that copies the items of an approved purchase requisition.
+//
+// The suggested vendors of the requisition items are invited automatically.
+func (s *RFQService) CreateRFQFromRequisition(requisitionID string, userID string, deadline *time.Time) (*models.RequestForQuotationModel, error) {
+	var requisition models.PurchaseRequisitionModel
+	if err := s.db.Preload("Items").Where("id = ?", requisitionID).First(&requisition).Error; err != nil {
+		return nil, err
+	}
+	if requisition.Status != models.RequisitionStatusApproved {
+		return nil, errors.New("requisition is not approved")
+	}
+	data := models.RequestForQuotationModel{
+		Title:         requisition.Description,
+		Description:   requisition.Notes,
+		Deadline:      deadline,
+		RequisitionID: &requisition.ID,
+		UserID:        &userID,
+		CompanyID:     requisition.CompanyID,
+	}
+	invited := map[string]bool{}
+	for _, v := range requisition.Items {
+		if v.PurchaseID != nil {
+			continue
+		}
+		requisitionItemID := v.ID
+		data.Items = append(data.Items, models.RFQItemModel{
+			RequisitionItemID: &requisitionItemID,
+			Description:       v.Description,
+			Notes:             v.Notes,
+			ProductID:         v.ProductID,
+			VariantID:         v.VariantID,
+			Quantity:          v.Quantity,
+			UnitID:            v.UnitID,
+			UnitValue:         v.UnitValue,
+			WarehouseID:       v.WarehouseID,
+		})
+		if v.VendorID != nil && !invited[*v.VendorID] {
+			invited[*v.VendorID] = true
+			data.Vendors = append(data.Vendors, models.RFQVendorModel{ContactID: *v.VendorID})
+		}
+	}
+	if len(data.Items) == 0 {
+		return nil, errors.New("requisition has no open item")
+	}
+	if err := s.CreateRFQ(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// UpdateRFQ updates the header of the RFQ with the given ID.
+func (s *RFQService) UpdateRFQ(id string, data *models.RequestForQuotationModel) error {
+	return s.db.Omit(clause.Associations, "status").Where("id = ?", id).Updates(data).Error
+}
+
+// DeleteRFQ deletes a draft RFQ along with its items, vendors and quotes.
+func (s *RFQService) DeleteRFQ(id string) error {
+	rfq, err := s.GetRFQByID(id)
+	if err != nil {
+		return err
+	}
+	if rfq.Status != "DRAFT" {
+		return errors.New("only draft rfq can be deleted")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, v := range rfq.Vendors {
+			if err := tx.Where("rfq_vendor_id = ?", v.ID).Delete(&models.VendorQuoteLineModel{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("rfq_id = ?", id).Delete(&models.RFQVendorModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("rfq_id = ?", id).Delete(&models.RFQItemModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&models.RequestForQuotationModel{}).Error
+	})
+}
+
+// GetRFQs retrieves a paginated list of RFQs.
+//
+// The search query is applied to the RFQ number and title. If the request
+// contains a company ID header, the result is filtered by the company ID. The
+// status query parameter can be used to filter by status.
+func (s *RFQService) GetRFQs(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Vendors.Contact", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	})
+	if search != "" {
+		stmt = stmt.Where("rfq_number ILIKE ? OR title ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Model(&models.RequestForQuotationModel{}).Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.RequestForQuotationModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetRFQByID retrieves an RFQ by its ID with its items, vendors and their quotes.
+func (s *RFQService) GetRFQByID(id string) (*models.RequestForQuotationModel, error) {
+	var rfq models.RequestForQuotationModel
+	err := s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Product").Preload("Variant").Preload("Unit").Order("created_at asc")
+	}).Preload("Vendors", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Contact").Preload("Quotes")
+	}).Preload("AwardedVendor").
+		Where("id = ?", id).First(&rfq).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rfq, nil
+}
+
+// AddItem adds a new item to a draft RFQ.
+func (s *RFQService) AddItem(rfqID string, item *models.RFQItemModel) error {
+	rfq, err := s.GetRFQByID(rfqID)
+	if err != nil {
+		return err
+	}
+	if rfq.Status != "DRAFT" {
+		return errors.New("rfq can not be edited")
+	}
+	item.RFQID = rfqID
+	return s.db.Create(item).Error
+}
+
+// DeleteItem deletes an item from a draft RFQ.
+func (s *RFQService) DeleteItem(rfqID, itemID string) error {
+	rfq, err := s.GetRFQByID(rfqID)
+	if err != nil {
+		return err
+	}
+	if rfq.Status != "DRAFT" {
+		return errors.New("rfq can not be edited")
+	}
+	return s.db.Where("id = ? AND rfq_id = ?", itemID, rfqID).Delete(&models.RFQItemModel{}).Error
+}
+
+// InviteVendor invites a vendor contact to an RFQ and returns the invitation with its public token.
+//
+// Inviting the same vendor twice returns the existing invitation.
+func (s *RFQService) InviteVendor(rfqID string, contactID string) (*models.RFQVendorModel, error) {
+	rfq, err := s.GetRFQByID(rfqID)
+	if err != nil {
+		return nil, err
+	}
+	if rfq.Status != "DRAFT" && rfq.Status != "SENT" {
+		return nil, errors.New("rfq is closed")
+	}
+	for _, v := range rfq.Vendors {
+		if v.ContactID == contactID {
+			return &v, nil
+		}
+	}
+	vendor := models.RFQVendorModel{
+		RFQID:     rfqID,
+		ContactID: contactID,
+	}
+	if err := s.db.Create(&vendor).Error; err != nil {
+		return nil, err
+	}
+	return &vendor, nil
+}
+
+// RemoveVendor removes a vendor invitation and its quotes from an RFQ.
+func (s *RFQService) RemoveVendor(rfqID, rfqVendorID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rfq_vendor_id = ?", rfqVendorID).Delete(&models.VendorQuoteLineModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ? AND rfq_id = ?", rfqVendorID, rfqID).Delete(&models.RFQVendorModel{}).Error
+	})
+}
+
+// SendRFQ marks a draft RFQ as SENT so that invited vendors can submit their bids.
+//
+// Delivering the invitation (e.g. e-mailing the public token link) is left to the caller.
+func (s *RFQService) SendRFQ(id string) error {
+	rfq, err := s.GetRFQByID(id)
+	if err != nil {
+		return err
+	}
+	if rfq.Status != "DRAFT" {
+		return errors.New("rfq already sent")
+	}
+	if len(rfq.Items) == 0 {
+		return errors.New("rfq items is empty")
+	}
+	if len(rfq.Vendors) == 0 {
+		return errors.New("rfq has no vendor")
+	}
+	return s.db.Model(&models.RequestForQuotationModel{}).Where("id = ?", id).Update("status", "SENT").Error
+}
+
+// CloseRFQ stops accepting bids on an RFQ.
+func (s *RFQService) CloseRFQ(id string) error {
+	return s.db.Model(&models.RequestForQuotationModel{}).Where("id = ? AND status = ?", id, "SENT").Update("status", "CLOSED").Error
+}
+
+// CancelRFQ cancels an RFQ that has not been awarded.
+func (s *RFQService) CancelRFQ(id string) error {
+	rfq, err := s.GetRFQByID(id)
+	if err != nil {
+		return err
+	}
+	if rfq.Status == "AWARDED" {
+		return errors.New("rfq already awarded")
+	}
+	return s.db.Model(&models.RequestForQuotationModel{}).Where("id = ?", id).Update("status", "CANCELLED").Error
+}
+
+// SubmitQuote records the quote lines of an invited vendor.
+//
+// Existing quote lines of the vendor are replaced. Each line must reference an
+// item of the RFQ. The RFQ must be SENT and its deadline, if any, not passed.
+func (s *RFQService) SubmitQuote(rfqVendorID string, lines []models.VendorQuoteLineModel, notes string) error {
+	var vendor models.RFQVendorModel
+	if err := s.db.Preload("RFQ.Items").Where("id = ?", rfqVendorID).First(&vendor).Error; err != nil {
+		return err
+	}
+	return s.submitQuote(&vendor, lines, notes)
+}
+
+func (s *RFQService) submitQuote(vendor *models.RFQVendorModel, lines []models.VendorQuoteLineModel, notes string) error {
+	rfq := vendor.RFQ
+	if rfq == nil || rfq.Status != "SENT" {
+		return errors.New("rfq is not open for bidding")
+	}
+	if rfq.Deadline != nil && time.Now().After(*rfq.Deadline) {
+		return errors.New("rfq deadline has passed")
+	}
+	if vendor.Status == "DECLINED" || vendor.Status == "LOST" {
+		return errors.New("vendor can no longer quote")
+	}
+	if len(lines) == 0 {
+		return errors.New("quote lines is empty")
+	}
+	items := map[string]models.RFQItemModel{}
+	for _, v := range rfq.Items {
+		items[v.ID] = v
+	}
+
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rfq_vendor_id = ?", vendor.ID).Delete(&models.VendorQuoteLineModel{}).Error; err != nil {
+			return err
+		}
+		for _, v := range lines {
+			item, ok := items[v.RFQItemID]
+			if !ok {
+				return fmt.Errorf("rfq item %s not found", v.RFQItemID)
+			}
+			if v.UnitPrice < 0 || v.LeadTimeDays < 0 {
+				return errors.New("invalid quote line")
+			}
+			if v.Quantity == 0 {
+				v.Quantity = item.Quantity
+			}
+			v.ID = ""
+			v.RFQVendorID = vendor.ID
+			v.RFQItem = nil
+			if err := tx.Create(&v).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.RFQVendorModel{}).Where("id = ?", vendor.ID).Updates(map[string]any{
+			"status":       "SUBMITTED",
+			"submitted_at": now,
+			"notes":        notes,
+		}).Error
+	})
+}
+
+// GetVendorInvitationByToken retrieves a vendor invitation by its public token.
+//
+// It is meant for the vendor-facing bid page: the RFQ with its items and the
+// vendor's own quote lines are loaded, other vendors' bids are not.
+func (s *RFQService) GetVendorInvitationByToken(token string) (*models.RFQVendorModel, error) {
+	var vendor models.RFQVendorModel
+	err := s.db.Preload("RFQ").Preload("RFQ.Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Product", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "name", "display_name", "sku")
+		}).Preload("Unit").Order("created_at asc")
+	}).Preload("Contact", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Preload("Quotes").
+		First(&vendor, "token = ?", token).Error
+	if err != nil {
+		return nil, err
+	}
+	return &vendor, nil
+}
+
+// SubmitQuoteByToken records the quote lines of a vendor identified by its public token.
+func (s *RFQService) SubmitQuoteByToken(token string, lines []models.VendorQuoteLineModel, notes string) error {
+	var vendor models.RFQVendorModel
+	if err := s.db.Preload("RFQ.Items").First(&vendor, "token = ?", token).Error; err != nil {
+		return err
+	}
+	return s.submitQuote(&vendor, lines, notes)
+}
+
+// DeclineByToken marks the invitation identified by its public token as declined.
+func (s *RFQService) DeclineByToken(token string, notes string) error {
+	return s.db.Model(&models.RFQVendorModel{}).Where("token = ? AND status = ?", token, "INVITED").Updates(map[string]any{
+		"status": "DECLINED",
+		"notes":  notes,
+	}).Error
+}
+
+// GetVendorOnTimeRate calculates the share of a vendor's purchase orders that were received on time.
+//
+// Only purchase orders with an expected delivery date and at least one stock
+// receipt (stock movement referencing the purchase) are counted. The first
+// receipt date is compared with the expected delivery date. It returns
+// defaultOnTimeRate when the vendor has no such history.
+func (s *RFQService) GetVendorOnTimeRate(companyID *string, contactID string) (float64, error) {
+	var rows []struct {
+		ExpectedDeliveryDate time.Time
+		ReceivedAt           time.Time
+	}
+	stmt := s.db.Model(&models.PurchaseOrderModel{}).
+		Select("purchase_orders.expected_delivery_date, MIN(stock_movements.date) AS received_at").
+		Joins("JOIN stock_movements ON stock_movements.reference_id = purchase_orders.id AND stock_movements.quantity > 0 AND stock_movements.deleted_at IS NULL").
+		Where("purchase_orders.contact_id = ? AND purchase_orders.expected_delivery_date IS NOT NULL", contactID)
+	if companyID != nil {
+		stmt = stmt.Where("purchase_orders.company_id = ?", *companyID)
+	}
+	err := stmt.Group("purchase_orders.id, purchase_orders.expected_delivery_date").
+		Scan(&rows).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return defaultOnTimeRate, nil
+	}
+	onTime := 0
+	for _, v := range rows {
+		if !v.ReceivedAt.After(endOfDay(v.ExpectedDeliveryDate)) {
+			onTime++
+		}
+	}
+	return float64(onTime) / float64(len(rows)), nil
+}
+
+func endOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 0, t.Location())
+}
+
+// CompareQuotes builds the comparison matrix of an RFQ.
+//
+// For every RFQ line the quotes of all vendors are listed and the lowest valid
+// price is flagged; quotes past their validity date are marked expired and
+// ignored in the scoring. Each vendor is then scored between 0 and 1:
+//
+//   - price: average of (lowest unit price / vendor unit price) over the lines,
+//     where unquoted lines count as 0
+//   - lead time: shortest average lead time / vendor average lead time
+//   - delivery: on-time rate of past purchase orders (GetVendorOnTimeRate)
+//
+// The final score is the weighted sum using the RFQ's weights. Vendors are
+// returned ordered by score, and BestID holds the highest scoring vendor.
+func (s *RFQService) CompareQuotes(rfqID string) (*models.RFQComparison, error) {
+	rfq, err := s.GetRFQByID(rfqID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result := models.RFQComparison{RFQID: rfq.ID}
+
+	type validQuote struct {
+		unitPrice float64
+		leadTime  int
+	}
+	valid := map[string]map[string]validQuote{} // contactID -> itemID -> quote
+	lowest := map[string]float64{}
+
+	for _, item := range rfq.Items {
+		line := models.RFQComparisonLine{
+			RFQItemID:   item.ID,
+			Description: item.Description,
+			Quantity:    item.Quantity,
+		}
+		for _, vendor := range rfq.Vendors {
+			for _, q := range vendor.Quotes {
+				if q.RFQItemID != item.ID {
+					continue
+				}
+				expired := q.ValidUntil != nil && now.After(*q.ValidUntil)
+				line.Quotes = append(line.Quotes, models.RFQComparisonLineCell{
+					ContactID:    vendor.ContactID,
+					UnitPrice:    q.UnitPrice,
+					Total:        q.UnitPrice * item.Quantity * item.UnitValue,
+					LeadTimeDays: q.LeadTimeDays,
+					ValidUntil:   q.ValidUntil,
+					IsExpired:    expired,
+				})
+				if expired {
+					continue
+				}
+				if valid[vendor.ContactID] == nil {
+					valid[vendor.ContactID] = map[string]validQuote{}
+				}
+				valid[vendor.ContactID][item.ID] = validQuote{unitPrice: q.UnitPrice, leadTime: q.LeadTimeDays}
+				if current, ok := lowest[item.ID]; !ok || q.UnitPrice < current {
+					lowest[item.ID] = q.UnitPrice
+				}
+			}
+		}
+		for i, c := range line.Quotes {
+			if !c.IsExpired && c.UnitPrice == lowest[item.ID] {
+				line.Quotes[i].IsLowest = true
+			}
+		}
+		result.Lines = append(result.Lines, line)
+	}
+
+	minLead := -1.0
+	for _, vendor := range rfq.Vendors {
+		quotes := valid[vendor.ContactID]
+		if len(quotes) == 0 {
+			continue
+		}
+		score := models.RFQVendorScore{ContactID: vendor.ContactID, QuotedLines: len(quotes)}
+		if vendor.Contact != nil {
+			score.ContactName = vendor.Contact.Name
+		}
+		priceSum := 0.0
+		leadSum := 0
+		for _, item := range rfq.Items {
+			q, ok := quotes[item.ID]
+			if !ok {
+				continue
+			}
+			score.Total += q.unitPrice * item.Quantity * item.UnitValue
+			leadSum += q.leadTime
+			if q.unitPrice > 0 {
+				priceSum += lowest[item.ID] / q.unitPrice
+			} else {
+				priceSum += 1
+			}
+		}
+		if len(rfq.Items) > 0 {
+			score.PriceScore = priceSum / float64(len(rfq.Items))
+		}
+		score.AvgLeadTimeDays = float64(leadSum) / float64(len(quotes))
+		if minLead < 0 || score.AvgLeadTimeDays < minLead {
+			minLead = score.AvgLeadTimeDays
+		}
+		onTime, err := s.GetVendorOnTimeRate(rfq.CompanyID, vendor.ContactID)
+		if err != nil {
+			return nil, err
+		}
+		score.OnTimeRate = onTime
+		score.DeliveryScore = onTime
+		result.Vendors = append(result.Vendors, score)
+	}
+
+	totalWeight := rfq.PriceWeight + rfq.LeadTimeWeight + rfq.DeliveryWeight
+	if totalWeight == 0 {
+		totalWeight = 1
+	}
+	for i, v := range result.Vendors {
+		if v.AvgLeadTimeDays > 0 {
+			v.LeadTimeScore = minLead / v.AvgLeadTimeDays
+		} else {
+			v.LeadTimeScore = 1
+		}
+		v.Score = utils.AmountRound((v.PriceScore*rfq.PriceWeight+v.LeadTimeScore*rfq.LeadTimeWeight+v.DeliveryScore*rfq.DeliveryWeight)/totalWeight, 4)
+		result.Vendors[i] = v
+	}
+	sort.SliceStable(result.Vendors, func(i, j int) bool {
+		return result.Vendors[i].Score > result.Vendors[j].Score
+	})
+	if len(result.Vendors) > 0 {
+		result.BestID = &result.Vendors[0].ContactID
+	}
+	return &result, nil
+}
+
+// AwardRFQ converts the quote of the winning vendor into a purchase order.
+//
+// All valid quote lines of the vendor become purchase order lines at the quoted
+// price. The expected delivery date is the award date plus the longest quoted lead
+// time, and is later used to rate the vendor's on-time delivery. If the RFQ was
+// raised from a purchase requisition, the purchase order references the
+// requisition (so its approved total is enforced) and the RFQ as secondary
+// reference, and the requisition items that were quoted are marked converted to
+// it; otherwise it references the RFQ. The vendor is marked AWARDED, the other
+// vendors LOST and the RFQ AWARDED.
+func (s *RFQService) AwardRFQ(rfqID string, contactID string, userID string, paymentAccountID *string) (*models.PurchaseOrderModel, error) {
+	rfq, err := s.GetRFQByID(rfqID)
+	if err != nil {
+		return nil, err
+	}
+	if rfq.Status != "SENT" && rfq.Status != "CLOSED" {
+		return nil, errors.New("rfq can not be awarded")
+	}
+	var winner *models.RFQVendorModel
+	for i, v := range rfq.Vendors {
+		if v.ContactID == contactID {
+			winner = &rfq.Vendors[i]
+			break
+		}
+	}
+	if winner == nil || winner.Status != "SUBMITTED" {
+		return nil, errors.New("vendor has no submitted quote")
+	}
+
+	now := time.Now()
+	refType := "rfq"
+	purchaseOrder := models.PurchaseOrderModel{
+		PurchaseNumber:   rfq.RFQNumber,
+		Description:      rfq.Title,
+		Notes:            rfq.Description,
+		Status:           "DRAFT",
+		PurchaseDate:     now,
+		PaymentAccountID: paymentAccountID,
+		CompanyID:        rfq.CompanyID,
+		UserID:           &userID,
+		ContactID:        &contactID,
+		TaxBreakdown:     "{}",
+		Type:             models.PURCHASE,
+		DocumentType:     models.PURCHASE_ORDER,
+		RefID:            &rfq.ID,
+		RefType:          &refType,
+	}
+	if rfq.RequisitionID != nil {
+		reqRefType := "purchase_requisition"
+		purchaseOrder.RefID = rfq.RequisitionID
+		purchaseOrder.RefType = &reqRefType
+		purchaseOrder.SecondaryRefID = &rfq.ID
+		purchaseOrder.SecondaryRefType = &refType
+	}
+	if winner.Contact != nil {
+		contactData, _ := json.Marshal(map[string]any{
+			"name":    winner.Contact.Name,
+			"email":   winner.Contact.Email,
+			"phone":   winner.Contact.Phone,
+			"address": winner.Contact.Address,
+		})
+		purchaseOrder.ContactData = string(contactData)
+	} else {
+		purchaseOrder.ContactData = "{}"
+	}
+
+	items := map[string]models.RFQItemModel{}
+	for _, v := range rfq.Items {
+		items[v.ID] = v
+	}
+	maxLead := 0
+	requisitionItemIDs := []string{}
+	for _, q := range winner.Quotes {
+		if q.ValidUntil != nil && now.After(*q.ValidUntil) {
+			continue
+		}
+		item, ok := items[q.RFQItemID]
+		if !ok {
+			continue
+		}
+		if q.LeadTimeDays > maxLead {
+			maxLead = q.LeadTimeDays
+		}
+		if item.RequisitionItemID != nil {
+			requisitionItemIDs = append(requisitionItemIDs, *item.RequisitionItemID)
+		}
+		value := item.UnitValue
+		if value == 0 {
+			value = 1
+		}
+		// the quotes are compared on the requested quantity; a vendor quoting less is ordered less
+		quantity := item.Quantity
+		if q.Quantity > 0 && q.Quantity < quantity {
+			quantity = q.Quantity
+		}
+		subtotal := quantity * value * q.UnitPrice
+		purchaseOrder.Items = append(purchaseOrder.Items, models.PurchaseOrderItemModel{
+			Description:        item.Description,
+			Notes:              q.Notes,
+			ProductID:          item.ProductID,
+			VariantID:          item.VariantID,
+			Quantity:           quantity,
+			UnitID:             item.UnitID,
+			UnitValue:          value,
+			UnitPrice:          q.UnitPrice,
+			SubtotalBeforeDisc: subtotal,
+			SubTotal:           subtotal,
+			Total:              subtotal,
+			WarehouseID:        item.WarehouseID,
+		})
+		purchaseOrder.TotalBeforeDisc += subtotal
+		purchaseOrder.TotalBeforeTax += subtotal
+		purchaseOrder.Subtotal += subtotal
+		purchaseOrder.Total += subtotal
+	}
+	if len(purchaseOrder.Items) == 0 {
+		return nil, errors.New("vendor has no valid quote line")
+	}
+	expected := now.AddDate(0, 0, maxLead)
+	purchaseOrder.ExpectedDeliveryDate = &expected
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := purchase.CheckRequisitionLimit(tx, &purchaseOrder); err != nil {
+			return err
+		}
+		if err := tx.Create(&purchaseOrder).Error; err != nil {
+			return err
+		}
+		if rfq.RequisitionID != nil {
+			if err := s.convertRequisitionItems(tx, *rfq.RequisitionID, requisitionItemIDs, purchaseOrder.ID, userID, now); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&models.RFQVendorModel{}).Where("rfq_id = ? AND id <> ?", rfq.ID, winner.ID).Update("status", "LOST").Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.RFQVendorModel{}).Where("id = ?", winner.ID).Update("status", "AWARDED").Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.RequestForQuotationModel{}).Where("id = ?", rfq.ID).Updates(map[string]any{
+			"status":            "AWARDED",
+			"awarded_vendor_id": contactID,
+			"purchase_id":       purchaseOrder.ID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &purchaseOrder, nil
+}
+
+// convertRequisitionItems marks the requisition items quoted in an awarded RFQ as converted to
+// the purchase order, the same way PurchaseRequisitionService.ConvertToPurchaseOrders does. The
+// requisition becomes CONVERTED once all its items are converted.
+func (s *RFQService) convertRequisitionItems(tx *gorm.DB, requisitionID string, itemIDs []string, purchaseID string, userID string, date time.Time) error {
+	var requisition models.PurchaseRequisitionModel
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", requisitionID).First(&requisition).Error; err != nil {
+		return err
+	}
+	if len(itemIDs) > 0 {
+		result := tx.Model(&models.PurchaseRequisitionItemModel{}).
+			Where("requisition_id = ? AND id IN ? AND purchase_id IS NULL", requisition.ID, itemIDs).
+			Update("purchase_id", purchaseID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(itemIDs)) {
+			return errors.New("requisition items are already converted to a purchase order")
+		}
+	}
+
+	var remaining int64
+	if err := tx.Model(&models.PurchaseRequisitionItemModel{}).
+		Where("requisition_id = ? AND purchase_id IS NULL", requisition.ID).
+		Count(&remaining).Error; err != nil {
+		return err
+	}
+	if err := tx.Create(&models.PurchaseRequisitionApprovalModel{
+		RequisitionID: requisition.ID,
+		Action:        "CONVERTED",
+		Amount:        requisition.ApprovedTotal,
+		Date:          date,
+		Notes:         "purchase order created from awarded RFQ",
+		UserID:        &userID,
+	}).Error; err != nil {
+		return err
+	}
+	if remaining == 0 {
+		return tx.Model(&models.PurchaseRequisitionModel{}).Where("id = ?", requisition.ID).Update("status", models.RequisitionStatusConverted).Error
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package stockmovement
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultReservationTTL is the lifetime of a reservation without an explicit expiry,
+// per reference type. Reference types not listed here do not expire by default.
+var DefaultReservationTTL = map[string]time.Duration{
+	"cart":  30 * time.Minute,
+	"offer": 24 * time.Hour,
+}
+
+// reservationEpsilon absorbs floating point noise when comparing quantities.
+const reservationEpsilon = 0.000001
+
+type StockReservationService struct {
+	db  *gorm.DB
+	ctx *context.ERPContext
+}
+
+// NewStockReservationService creates a new instance of StockReservationService
+// with the provided database connection and ERP context.
+func NewStockReservationService(db *gorm.DB, ctx *context.ERPContext) *StockReservationService {
+	return &StockReservationService{db: db, ctx: ctx}
+}
+
+func (s *StockReservationService) SetDB(db *gorm.DB) {
+	s.db = db
+}
+
+// ActiveReservationScope limits a query on stock_reservations to reservations that still hold stock,
+// i.e. ACTIVE reservations that have not passed their expiry yet.
+func ActiveReservationScope(now time.Time) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("stock_reservations.status = ?", models.ReservationStatusActive).
+			Where("stock_reservations.expires_at IS NULL OR stock_reservations.expires_at > ?", now)
+	}
+}
+
+// GetReservedStock returns the open reserved quantity of a product, in base units.
+//
+// variantID and warehouseID are optional filters; reservations without a warehouse count
+// for every warehouse. Expired reservations are ignored even when ExpireReservations has not
+// run yet.
+func (s *StockReservationService) GetReservedStock(productID string, variantID, warehouseID *string) (float64, error) {
+	return reservedStock(s.db, productID, variantID, warehouseID)
+}
+
+// GetReservedStocks returns the open reserved quantities of several products with one query,
+// keyed by ReservedStockKey: per product and per variant of a product.
+func (s *StockReservationService) GetReservedStocks(productIDs []string, warehouseID *string) (map[string]float64, error) {
+	result := map[string]float64{}
+	if len(productIDs) == 0 {
+		return result, nil
+	}
+	var rows []struct {
+		ProductID string
+		VariantID *string
+		Reserved  float64
+	}
+	db := s.db.Model(&models.StockReservationModel{}).
+		Scopes(ActiveReservationScope(time.Now()), warehouseScope(warehouseID)).
+		Where("product_id IN ?", productIDs)
+	if err := db.Select("product_id, variant_id, COALESCE(SUM(quantity - fulfilled_quantity), 0) AS reserved").
+		Group("product_id, variant_id").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range rows {
+		result[ReservedStockKey(v.ProductID, nil)] += v.Reserved
+		if v.VariantID != nil {
+			result[ReservedStockKey(v.ProductID, v.VariantID)] += v.Reserved
+		}
+	}
+	return result, nil
+}
+
+// ReservedStockKey is the key of the reserved quantity of a product, or of its variant when
+// variantID is set, in the result of GetReservedStocks.
+func ReservedStockKey(productID string, variantID *string) string {
+	if variantID == nil {
+		return productID
+	}
+	return productID + "/" + *variantID
+}
+
+// GetAvailableToPromise returns the on-hand stock of a product minus its open reservations.
+func (s *StockReservationService) GetAvailableToPromise(productID string, variantID, warehouseID *string) (float64, error) {
+	return availableToPromise(s.db, productID, variantID, warehouseID)
+}
+
+// Reserve creates an active reservation.
+//
+// The reservation must have a product, a positive quantity and a reference. When ExpiresAt
+// is empty, DefaultReservationTTL of the reference type is applied. Products with stock
+// tracking enabled are only reserved when enough stock is available to promise in the
+// warehouse of the reservation; the product row is locked while the stock is checked, so
+// concurrent reservations of the same product cannot promise the same stock twice.
+func (s *StockReservationService) Reserve(data *models.StockReservationModel) error {
+	if data.ProductID == "" {
+		return errors.New("product ID is required")
+	}
+	if data.Quantity <= 0 {
+		return errors.New("reservation quantity must be greater than zero")
+	}
+	if data.ReferenceID == "" || data.ReferenceType == "" {
+		return errors.New("reservation reference is required")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var product models.ProductModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "display_name", "enable_stock").First(&product, "id = ?", data.ProductID).Error; err != nil {
+			return err
+		}
+		if product.EnableStock {
+			available, err := availableToPromise(tx, data.ProductID, data.VariantID, data.WarehouseID)
+			if err != nil {
+				return err
+			}
+			if available+reservationEpsilon < data.Quantity {
+				return fmt.Errorf("insufficient stock for %s: available %.2f, requested %.2f", product.DisplayName, available, data.Quantity)
+			}
+		}
+
+		now := time.Now()
+		if data.Date.IsZero() {
+			data.Date = now
+		}
+		if data.ExpiresAt == nil {
+			if ttl, ok := DefaultReservationTTL[data.ReferenceType]; ok {
+				expiresAt := now.Add(ttl)
+				data.ExpiresAt = &expiresAt
+			}
+		}
+		data.Status = models.ReservationStatusActive
+		data.FulfilledQuantity = 0
+		return tx.Create(data).Error
+	})
+}
+
+// Hold removes the expiry of the active reservations of a document, e.g. when a cart becomes an
+// order, so they keep the stock until the document is fulfilled or released. Reservations that
+// already passed their expiry are not revived.
+func (s *StockReservationService) Hold(refType, refID string) error {
+	return s.db.Model(&models.StockReservationModel{}).
+		Scopes(ActiveReservationScope(time.Now())).
+		Where("reference_type = ? AND reference_id = ?", refType, refID).
+		Update("expires_at", nil).Error
+}
+
+// Release releases all active reservations of a document, e.g. when it is cancelled.
+func (s *StockReservationService) Release(refType, refID, reason string) error {
+	return s.close(refType, refID, models.ReservationStatusReleased, reason)
+}
+
+// FulfilAll marks all active reservations of a document as fulfilled.
+func (s *StockReservationService) FulfilAll(refType, refID, reason string) error {
+	return s.close(refType, refID, models.ReservationStatusFulfilled, reason)
+}
+
+// Fulfil consumes quantity (in base units) from the active reservations of a document.
+//
+// When secondaryRefID is set only the reservations of that document line are consumed.
+// Reservations are consumed oldest first; a reservation that is consumed completely is
+// marked FULFILLED. Quantity that exceeds the reserved quantity is ignored.
+func (s *StockReservationService) Fulfil(refType, refID string, secondaryRefID *string, quantity float64) error {
+	if quantity <= 0 {
+		return nil
+	}
+	var reservations []models.StockReservationModel
+	db := s.db.Where("reference_type = ? AND reference_id = ? AND status = ?", refType, refID, models.ReservationStatusActive)
+	if secondaryRefID != nil {
+		db = db.Where("secondary_ref_id = ?", *secondaryRefID)
+	}
+	if err := db.Order("date asc, created_at asc").Find(&reservations).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	remaining := quantity
+	for _, v := range reservations {
+		if remaining <= reservationEpsilon {
+			break
+		}
+		open := v.Quantity - v.FulfilledQuantity
+		consumed := open
+		if remaining < open {
+			consumed = remaining
+		}
+		remaining -= consumed
+		updates := map[string]any{"fulfilled_quantity": v.FulfilledQuantity + consumed}
+		if open-consumed <= reservationEpsilon {
+			updates["status"] = models.ReservationStatusFulfilled
+			updates["closed_at"] = now
+			updates["closed_reason"] = "fulfilled"
+		}
+		if err := s.db.Model(&models.StockReservationModel{}).Where("id = ?", v.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireReservations marks every active reservation that passed its expiry as EXPIRED.
+//
+// It is meant to be called periodically and returns the number of expired reservations.
+// Expired reservations stop counting as reserved stock even before this runs.
+func (s *StockReservationService) ExpireReservations(now time.Time) (int64, error) {
+	result := s.db.Model(&models.StockReservationModel{}).
+		Where("status = ? AND expires_at IS NOT NULL AND expires_at <= ?", models.ReservationStatusActive, now).
+		Updates(map[string]any{
+			"status":        models.ReservationStatusExpired,
+			"closed_at":     now,
+			"closed_reason": "expired",
+		})
+	return result.RowsAffected, result.Error
+}
+
+// GetReservationsByReference returns the reservations of a document.
+func (s *StockReservationService) GetReservationsByReference(refType, refID string) ([]models.StockReservationModel, error) {
+	var reservations []models.StockReservationModel
+	err := s.db.Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "display_name")
+	}).Where("reference_type = ? AND reference_id = ?", refType, refID).
+		Order("date asc").Find(&reservations).Error
+	return reservations, err
+}
+
+// GetReservations retrieves a paginated list of stock reservations.
+//
+// The list can be filtered with the product_id, warehouse_id, status and reference_type
+// query parameters and is scoped to the company in the ID-Company header.
+func (s *StockReservationService) GetReservations(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "display_name")
+	}).Preload("Warehouse", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Joins("LEFT JOIN products ON stock_reservations.product_id = products.id")
+	if search != "" {
+		stmt = stmt.Where("stock_reservations.description ILIKE ? OR products.name ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("stock_reservations.company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("product_id") != "" {
+		stmt = stmt.Where("stock_reservations.product_id = ?", request.URL.Query().Get("product_id"))
+	}
+	if request.URL.Query().Get("warehouse_id") != "" {
+		stmt = stmt.Where("stock_reservations.warehouse_id = ?", request.URL.Query().Get("warehouse_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("stock_reservations.status = ?", request.URL.Query().Get("status"))
+	}
+	if request.URL.Query().Get("reference_type") != "" {
+		stmt = stmt.Where("stock_reservations.reference_type = ?", request.URL.Query().Get("reference_type"))
+	}
+	stmt = stmt.Model(&models.StockReservationModel{}).Order("stock_reservations.date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.StockReservationModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+func (s *StockReservationService) close(refType, refID string, status models.ReservationStatus, reason string) error {
+	return s.db.Model(&models.StockReservationModel{}).
+		Where("reference_type = ? AND reference_id = ? AND status = ?", refType, refID, models.ReservationStatusActive).
+		Updates(map[string]any{
+			"status":        status,
+			"closed_at":     time.Now(),
+			"closed_reason": reason,
+		}).Error
+}
+
+func reservedStock(db *gorm.DB, productID string, variantID, warehouseID *string) (float64, error) {
+	var reserved float64
+	db = db.Model(&models.StockReservationModel{}).
+		Scopes(ActiveReservationScope(time.Now())).
+		Where("product_id = ?", productID)
+	if variantID != nil {
+		db = db.Where("variant_id = ?", *variantID)
+	}
+	if err := db.Scopes(warehouseScope(warehouseID)).Select("COALESCE(SUM(quantity - fulfilled_quantity), 0)").Scan(&reserved).Error; err != nil {
+		return 0, err
+	}
+	return reserved, nil
+}
+
+// warehouseScope limits reservations to a warehouse. Reservations without a warehouse can be
+// served from any warehouse, so they count against every warehouse.
+func warehouseScope(warehouseID *string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if warehouseID == nil {
+			return db
+		}
+		return db.Where("warehouse_id = ? OR warehouse_id IS NULL", *warehouseID)
+	}
+}
+
+func availableToPromise(db *gorm.DB, productID string, variantID, warehouseID *string) (float64, error) {
+	var onHand float64
+	stmt := db.Model(&models.StockMovementModel{}).Where("product_id = ?", productID)
+	if variantID != nil {
+		stmt = stmt.Where("variant_id = ?", *variantID)
+	}
+	if warehouseID != nil {
+		stmt = stmt.Where("warehouse_id = ?", *warehouseID)
+	}
+	if err := stmt.Select("COALESCE(SUM(quantity * value), 0)").Scan(&onHand).Error; err != nil {
+		return 0, err
+	}
+	reserved, err := reservedStock(db, productID, variantID, warehouseID)
+	if err != nil {
+		return 0, err
+	}
+	return onHand - reserved, nil
+}
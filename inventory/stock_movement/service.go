@@ -9,6 +9,7 @@ import (
 	"github.com/AMETORY/ametory-erp-modules/utils"
 	"github.com/morkid/paginate"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type StockMovementService struct {
@@ -26,11 +27,11 @@ func NewStockMovementService(db *gorm.DB, ctx *context.ERPContext) *StockMovemen
 // Migrate migrates the database schema needed for the StockMovementService.
 //
 // It uses GORM's AutoMigrate function to create the tables for StockMovementModel
-// if they do not already exist.
+// and StockReservationModel if they do not already exist.
 //
 // If the migration fails, the error is returned to the caller.
 func Migrate(db *gorm.DB) error {
-	return db.AutoMigrate(&models.StockMovementModel{})
+	return db.AutoMigrate(&models.StockMovementModel{}, &models.StockReservationModel{})
 }
 func (s *StockMovementService) SetDB(db *gorm.DB) {
 	s.db = db
@@ -111,6 +112,14 @@ func (s *StockMovementService) GetStockMovements(request http.Request, search st
 	if request.URL.Query().Get("merchant_id") != "" {
 		stmt = stmt.Where("stock_movements.merchant_id = ?", request.URL.Query().Get("merchant_id"))
 	}
+	// owner_id=none lists only company-owned stock, leaving out consignment stock
+	if ownerID := request.URL.Query().Get("owner_id"); ownerID != "" {
+		if ownerID == "none" {
+			stmt = stmt.Where("stock_movements.owner_id IS NULL")
+		} else {
+			stmt = stmt.Where("stock_movements.owner_id = ?", ownerID)
+		}
+	}
 	if s.isMerchantMode {
 		stmt = stmt.Where("stock_movements.merchant_id = ?", request.Header.Get("ID-Merchant"))
 	}
@@ -505,3 +514,47 @@ func (s *StockMovementService) GetStockMovementByID(id string) (*models.StockMov
 	}).Where("id = ?", id).First(&invoice).Error
 	return &invoice, err
 }
+
+// UnitCost returns the moving average cost of a product per base unit, or fallback when the
+// product has no average cost yet.
+func UnitCost(db *gorm.DB, productID string, fallback float64) (float64, error) {
+	var product models.ProductModel
+	if err := db.Select("id", "average_cost").Where("id = ?", productID).First(&product).Error; err != nil {
+		return 0, err
+	}
+	if product.AverageCost > 0 {
+		return product.AverageCost, nil
+	}
+	return fallback, nil
+}
+
+// UpdateAverageCost updates the moving average cost of a product after quantity (in base units)
+// valued at value entered its own stock. It must be called once the stock movement is saved.
+//
+// A cost adjustment of the stock on hand, e.g. a landed cost, has no quantity; a negative
+// quantity and value undo a receipt whose movement was removed.
+func UpdateAverageCost(tx *gorm.DB, productID string, quantity, value float64) error {
+	var product models.ProductModel
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "average_cost").Where("id = ?", productID).First(&product).Error; err != nil {
+		return err
+	}
+	var onHand float64
+	if err := tx.Model(&models.StockMovementModel{}).
+		Where("product_id = ? AND owner_id IS NULL", productID).
+		Select("COALESCE(SUM(quantity * value), 0)").
+		Scan(&onHand).Error; err != nil {
+		return err
+	}
+	if onHand <= 0 {
+		return nil
+	}
+	before := onHand - quantity
+	if before < 0 {
+		before = 0
+	}
+	averageCost := (product.AverageCost*before + value) / onHand
+	if averageCost < 0 {
+		averageCost = 0
+	}
+	return tx.Model(&models.ProductModel{}).Where("id = ?", productID).Update("average_cost", averageCost).Error
+}
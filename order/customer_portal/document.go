@@ -0,0 +1,111 @@
+package customer_portal
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+// PortalDocument is an invoice or delivery as the customer sees it in the portal. It leaves out
+// the internal fields of the sales document such as its accounts, cost prices, warehouses,
+// salesperson and internal notes.
+type PortalDocument struct {
+	ID            string                  `json:"id"`
+	SalesNumber   string                  `json:"sales_number"`
+	DocumentType  models.SalesDocType     `json:"document_type"`
+	Status        string                  `json:"status"`
+	SalesDate     time.Time               `json:"sales_date"`
+	DueDate       *time.Time              `json:"due_date,omitempty"`
+	Description   string                  `json:"description,omitempty"`
+	TermCondition string                  `json:"term_condition,omitempty"`
+	PaymentTerms  string                  `json:"payment_terms,omitempty"`
+	Subtotal      float64                 `json:"subtotal"`
+	TotalDiscount float64                 `json:"total_discount"`
+	TotalTax      float64                 `json:"total_tax"`
+	Total         float64                 `json:"total"`
+	Paid          float64                 `json:"paid"`
+	Balance       float64                 `json:"balance"`
+	TaxBreakdown  map[string]any          `json:"tax_breakdown,omitempty"`
+	Delivery      map[string]any          `json:"delivery,omitempty"`
+	Items         []PortalDocumentItem    `json:"items,omitempty"`
+	Payments      []PortalDocumentPayment `json:"payments,omitempty"`
+}
+
+// PortalDocumentItem is a line of a PortalDocument.
+type PortalDocumentItem struct {
+	Description     string  `json:"description"`
+	Quantity        float64 `json:"quantity"`
+	Unit            string  `json:"unit,omitempty"`
+	UnitPrice       float64 `json:"unit_price"`
+	DiscountPercent float64 `json:"discount_percent,omitempty"`
+	DiscountAmount  float64 `json:"discount_amount,omitempty"`
+	SubTotal        float64 `json:"sub_total"`
+	TotalTax        float64 `json:"total_tax,omitempty"`
+	Total           float64 `json:"total"`
+}
+
+// PortalDocumentPayment is a payment received for a PortalDocument.
+type PortalDocumentPayment struct {
+	Date   time.Time `json:"date"`
+	Amount float64   `json:"amount"`
+}
+
+// newPortalDocument copies the customer facing fields of a sales document. charges are the
+// installment charges added to the balance of an invoice.
+func newPortalDocument(doc *models.SalesModel, items []models.SalesItemModel, charges float64) *PortalDocument {
+	result := &PortalDocument{
+		ID:            doc.ID,
+		SalesNumber:   doc.SalesNumber,
+		DocumentType:  doc.DocumentType,
+		Status:        doc.Status,
+		SalesDate:     doc.SalesDate,
+		DueDate:       doc.DueDate,
+		Description:   doc.Description,
+		TermCondition: doc.TermCondition,
+		PaymentTerms:  doc.PaymentTerms,
+		Subtotal:      doc.Subtotal,
+		TotalDiscount: doc.TotalDiscount,
+		TotalTax:      doc.TotalTax,
+		Total:         doc.Total,
+		Paid:          doc.Paid,
+		TaxBreakdown:  doc.TaxBreakdownParsed,
+		Items:         []PortalDocumentItem{},
+	}
+	if doc.DocumentType == models.INVOICE {
+		result.Balance = doc.Total + charges - doc.Paid
+	}
+	if doc.DocumentType == models.DELIVERY {
+		result.Delivery = doc.DeliveryDataParsed
+	}
+	for _, v := range items {
+		item := PortalDocumentItem{
+			Description:     v.Description,
+			Quantity:        v.Quantity,
+			UnitPrice:       v.UnitPrice,
+			DiscountPercent: v.DiscountPercent,
+			DiscountAmount:  v.DiscountAmount,
+			SubTotal:        v.SubTotal,
+			TotalTax:        v.TotalTax,
+			Total:           v.Total,
+		}
+		if v.Unit != nil {
+			item.Unit = v.Unit.Name
+		}
+		result.Items = append(result.Items, item)
+	}
+	for _, v := range doc.SalesPayments {
+		result.Payments = append(result.Payments, PortalDocumentPayment{Date: v.PaymentDate, Amount: v.Amount})
+	}
+	return result
+}
+
+// newPortalDocuments copies the customer facing fields of a list of sales documents, without
+// their lines.
+func newPortalDocuments(docs []models.SalesModel) []PortalDocument {
+	result := make([]PortalDocument, len(docs))
+	for i := range docs {
+		result[i] = *newPortalDocument(&docs[i], nil, 0)
+		result[i].Items = nil
+	}
+	return result
+}
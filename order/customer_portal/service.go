@@ -0,0 +1,404 @@
+package customer_portal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/finance"
+	"github.com/AMETORY/ametory-erp-modules/order/payment"
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/order/sales"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// amountEpsilon absorbs rounding differences between the total and the paid amount of an invoice.
+const amountEpsilon = 0.005
+
+// ErrAccessDenied is returned when a portal token or user link is unknown, expired or revoked, or
+// when a document does not belong to the contact of the access.
+var ErrAccessDenied = errors.New("customer portal access denied")
+
+// CustomerPortalService is the self-service portal of a customer: its invoices, deliveries and
+// returns, their PDFs, its statement of account and aging, and payment of open invoices.
+//
+// Every portal call takes the access returned by AuthenticateToken or AuthenticateUser and only
+// sees the documents of the contact and company of that access.
+type CustomerPortalService struct {
+	ctx            *context.ERPContext
+	db             *gorm.DB
+	financeService *finance.FinanceService
+	salesService   *sales.SalesService
+	paymentService *payment.PaymentService
+}
+
+// NewCustomerPortalService creates a new instance of CustomerPortalService.
+func NewCustomerPortalService(db *gorm.DB, ctx *context.ERPContext, financeService *finance.FinanceService, salesService *sales.SalesService, paymentService *payment.PaymentService) *CustomerPortalService {
+	return &CustomerPortalService{
+		ctx:            ctx,
+		db:             db,
+		financeService: financeService,
+		salesService:   salesService,
+		paymentService: paymentService,
+	}
+}
+
+// Migrate migrates the customer portal models. Plain tokens of accesses created before tokens
+// were hashed are replaced by their hash.
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&models.CustomerPortalAccessModel{}); err != nil {
+		return err
+	}
+	if !db.Migrator().HasColumn(&models.CustomerPortalAccessModel{}, "token") {
+		return nil
+	}
+	var accesses []struct {
+		ID    string
+		Token string
+	}
+	if err := db.Table("customer_portal_accesses").Select("id", "token").
+		Where("token IS NOT NULL AND token <> ''").Find(&accesses).Error; err != nil {
+		return err
+	}
+	for _, v := range accesses {
+		if err := db.Table("customer_portal_accesses").Where("id = ?", v.ID).
+			Update("token_hash", hashToken(v.Token)).Error; err != nil {
+			return err
+		}
+	}
+	return db.Migrator().DropColumn(&models.CustomerPortalAccessModel{}, "token")
+}
+
+// CreateAccess grants a contact access to the portal. The access gets a new random token, returned
+// in Token only by this call as just its hash is stored; when UserID is set the user can also reach the portal with its own login (see AuthenticateUser).
+func (s *CustomerPortalService) CreateAccess(access *models.CustomerPortalAccessModel) error {
+	var contact models.ContactModel
+	if err := s.db.Select("id", "company_id").First(&contact, "id = ?", access.ContactID).Error; err != nil {
+		return err
+	}
+	if access.CompanyID == nil {
+		access.CompanyID = contact.CompanyID
+	}
+	if access.CompanyID == nil {
+		return errors.New("contact has no company")
+	}
+	if contact.CompanyID != nil && *contact.CompanyID != *access.CompanyID {
+		return errors.New("contact does not belong to the company")
+	}
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	access.Token = token
+	access.TokenHash = hashToken(token)
+	access.RevokedAt = nil
+	return s.db.Create(access).Error
+}
+
+// RegenerateToken replaces the token of an access; the old token stops working. The new token is
+// returned in Token and cannot be read again later.
+func (s *CustomerPortalService) RegenerateToken(id string) (*models.CustomerPortalAccessModel, error) {
+	var access models.CustomerPortalAccessModel
+	if err := s.db.First(&access, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	access.TokenHash = hashToken(token)
+	if err := s.db.Model(&access).Update("token_hash", access.TokenHash).Error; err != nil {
+		return nil, err
+	}
+	access.Token = token
+	return &access, nil
+}
+
+// RevokeAccess revokes an access.
+func (s *CustomerPortalService) RevokeAccess(id string) error {
+	return s.db.Model(&models.CustomerPortalAccessModel{}).Where("id = ?", id).Update("revoked_at", time.Now()).Error
+}
+
+// GetAccesses returns the portal accesses of a contact.
+func (s *CustomerPortalService) GetAccesses(contactID string) ([]models.CustomerPortalAccessModel, error) {
+	var accesses []models.CustomerPortalAccessModel
+	err := s.db.Preload("User", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name", "email")
+	}).Where("contact_id = ?", contactID).Order("created_at DESC").Find(&accesses).Error
+	return accesses, err
+}
+
+// AuthenticateToken returns the active access with the given token.
+func (s *CustomerPortalService) AuthenticateToken(token string) (*models.CustomerPortalAccessModel, error) {
+	if strings.TrimSpace(token) == "" {
+		return nil, ErrAccessDenied
+	}
+	var access models.CustomerPortalAccessModel
+	if err := s.activeAccesses().Where("token_hash = ?", hashToken(token)).First(&access).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAccessDenied
+		}
+		return nil, err
+	}
+	return s.touch(&access)
+}
+
+// AuthenticateUser returns the active access linked to a user in a company.
+func (s *CustomerPortalService) AuthenticateUser(userID, companyID string) (*models.CustomerPortalAccessModel, error) {
+	var access models.CustomerPortalAccessModel
+	if err := s.activeAccesses().Where("user_id = ? AND company_id = ?", userID, companyID).
+		Order("created_at DESC").First(&access).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAccessDenied
+		}
+		return nil, err
+	}
+	return s.touch(&access)
+}
+
+func (s *CustomerPortalService) activeAccesses() *gorm.DB {
+	return s.db.Preload("Contact").
+		Where("revoked_at IS NULL").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now())
+}
+
+func (s *CustomerPortalService) touch(access *models.CustomerPortalAccessModel) (*models.CustomerPortalAccessModel, error) {
+	if access.CompanyID == nil {
+		return nil, ErrAccessDenied
+	}
+	now := time.Now()
+	access.LastUsedAt = &now
+	if err := s.db.Model(&models.CustomerPortalAccessModel{}).Where("id = ?", access.ID).Update("last_used_at", now).Error; err != nil {
+		return nil, err
+	}
+	return access, nil
+}
+
+// GetInvoices returns the posted invoices of the customer. The status query parameter filters
+// on the status of the invoice, e.g. "paid".
+func (s *CustomerPortalService) GetInvoices(access *models.CustomerPortalAccessModel, request http.Request, search string) (paginate.Page, error) {
+	return s.getDocuments(access, models.INVOICE, request, search)
+}
+
+// GetDeliveries returns the deliveries of the customer.
+func (s *CustomerPortalService) GetDeliveries(access *models.CustomerPortalAccessModel, request http.Request, search string) (paginate.Page, error) {
+	return s.getDocuments(access, models.DELIVERY, request, search)
+}
+
+func (s *CustomerPortalService) getDocuments(access *models.CustomerPortalAccessModel, docType models.SalesDocType, request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.customerDocuments(access).Where("sales.document_type = ?", docType)
+	if search != "" {
+		stmt = stmt.Where("sales.sales_number ILIKE ? OR sales.description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("sales.status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Model(&models.SalesModel{}).Order("sales.sales_date DESC")
+	utils.FixRequest(&request)
+	items := []models.SalesModel{}
+	page := pg.With(stmt).Request(request).Response(&items)
+	page.Items = newPortalDocuments(items)
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// customerDocuments scopes a query to the issued sales documents of the contact of an access.
+func (s *CustomerPortalService) customerDocuments(access *models.CustomerPortalAccessModel) *gorm.DB {
+	return s.db.Where("sales.company_id = ? AND sales.contact_id = ?", *access.CompanyID, access.ContactID).
+		Where("UPPER(sales.status) NOT IN ?", []string{"DRAFT", "CANCELED"})
+}
+
+// GetReturns returns the released sales returns of the customer.
+func (s *CustomerPortalService) GetReturns(access *models.CustomerPortalAccessModel, request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Items").
+		Where("returns.company_id = ? AND returns.return_type = ?", *access.CompanyID, "SALES_RETURN").
+		Where("returns.status <> ?", "DRAFT").
+		Where("returns.ref_id IN (?)", s.customerDocuments(access).Model(&models.SalesModel{}).Select("sales.id"))
+	if search != "" {
+		stmt = stmt.Where("returns.return_number ILIKE ? OR returns.description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	stmt = stmt.Model(&models.ReturnModel{}).Order("returns.date DESC")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.ReturnModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetDocument returns an issued invoice or delivery of the customer with its lines and payments.
+func (s *CustomerPortalService) GetDocument(access *models.CustomerPortalAccessModel, id string) (*PortalDocument, error) {
+	doc, err := s.document(access, id)
+	if err != nil {
+		return nil, err
+	}
+	items, err := s.salesService.GetItems(doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	charges := 0.0
+	if doc.DocumentType == models.INVOICE {
+		charges = s.salesService.InstallmentCharges(doc.ID)
+	}
+	return newPortalDocument(doc, items, charges), nil
+}
+
+// document returns the sales document of an issued invoice or delivery of the customer.
+func (s *CustomerPortalService) document(access *models.CustomerPortalAccessModel, id string) (*models.SalesModel, error) {
+	var count int64
+	if err := s.customerDocuments(access).Model(&models.SalesModel{}).Where("sales.id = ?", id).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrAccessDenied
+	}
+	return s.salesService.GetSalesByID(id)
+}
+
+// GetDocumentPdf renders the PDF of an invoice or delivery of the customer with
+// SalesService.GetPdf. Deliveries show the shipping address.
+func (s *CustomerPortalService) GetDocumentPdf(access *models.CustomerPortalAccessModel, id, templatePath, timeFormatStr, footer string) ([]byte, error) {
+	doc, err := s.document(access, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.salesService.GetPdf(doc, templatePath, timeFormatStr, footer, true, doc.DocumentType == models.DELIVERY)
+}
+
+// GetStatement returns the statement of account of the customer between two dates: its
+// receivable ledger with the balance before, during and after the period.
+func (s *CustomerPortalService) GetStatement(access *models.CustomerPortalAccessModel, startDate, endDate time.Time) (*models.AccountReceivableLedgerReport, error) {
+	if s.financeService == nil || s.financeService.ReportService == nil {
+		return nil, errors.New("finance service is not initialized")
+	}
+	return s.financeService.ReportService.GetAccountReceivableLedger(*access.CompanyID, access.ContactID, startDate, endDate)
+}
+
+// GetAging returns the aging of the open invoices and installments of the customer.
+func (s *CustomerPortalService) GetAging(access *models.CustomerPortalAccessModel, asOf time.Time) (*models.ReceivableAgingReport, error) {
+	return s.salesService.GetReceivableAging(*access.CompanyID, access.ContactID, asOf)
+}
+
+// PayInvoice creates a payment link for the outstanding amount of an open invoice of the customer.
+// It uses PaymentService.RequestPayment rather than PaymentService.CreatePaymentLink, because
+// CreatePaymentLink does not record a payment linked to the invoice, so a paid link could not be
+// settled on it. A pending, unexpired payment of the same amount is returned instead of creating
+// a new one; otherwise the other pending payments of the invoice are expired once the new one is
+// created, so the customer is left with a single open link. When the payment is paid the invoice
+// receives a sales payment on assetAccountID, the clearing account of the provider, which is
+// required.
+func (s *CustomerPortalService) PayInvoice(access *models.CustomerPortalAccessModel, invoiceID, providerName string, assetAccountID *string, req payment_provider.PaymentRequest) (*models.PaymentModel, error) {
+	if s.paymentService == nil {
+		return nil, errors.New("payment service is not initialized")
+	}
+	if assetAccountID == nil || *assetAccountID == "" {
+		return nil, errors.New("asset account is required")
+	}
+	invoice, err := s.document(access, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.DocumentType != models.INVOICE {
+		return nil, errors.New("only invoices can be paid")
+	}
+	outstanding := utils.AmountRound(invoice.Total+s.salesService.InstallmentCharges(invoice.ID)-invoice.Paid, 2)
+	if outstanding <= amountEpsilon {
+		return nil, errors.New("invoice is already paid")
+	}
+
+	var pending models.PaymentModel
+	err = s.db.Where("ref_type = ? AND ref_id = ? AND status = ?", "sales", invoice.ID, models.PaymentStatusPending).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("created_at DESC").First(&pending).Error
+	if err == nil && math.Abs(pending.Total-outstanding) <= amountEpsilon {
+		return &pending, nil
+	}
+
+	contact := access.Contact
+	if contact == nil {
+		contact = &models.ContactModel{}
+		if err := s.db.First(contact, "id = ?", access.ContactID).Error; err != nil {
+			return nil, err
+		}
+	}
+	data := models.PaymentModel{
+		Name:           contact.Name,
+		Email:          contact.Email,
+		Total:          outstanding,
+		RefID:          invoice.ID,
+		RefType:        "sales",
+		CompanyID:      access.CompanyID,
+		AssetAccountID: assetAccountID,
+	}
+	if contact.Phone != nil {
+		data.Phone = *contact.Phone
+	}
+	if req.Method == "" {
+		req.Method = payment_provider.PaymentMethodLink
+	}
+	req.Amount = outstanding
+	if req.Description == "" {
+		req.Description = fmt.Sprintf("Pembayaran %s", invoice.SalesNumber)
+	}
+	if req.CustomerID == "" {
+		req.CustomerID = access.ContactID
+	}
+	if _, err := s.paymentService.RequestPayment(providerName, &data, req); err != nil {
+		return nil, err
+	}
+	s.expirePendingPayments(invoice.ID, data.ID)
+	return &data, nil
+}
+
+// expirePendingPayments expires the pending payments of an invoice other than exceptID. A payment
+// that is paid after all can still move from EXPIRED to PAID and settle the invoice.
+func (s *CustomerPortalService) expirePendingPayments(invoiceID, exceptID string) {
+	var ids []string
+	if err := s.db.Model(&models.PaymentModel{}).
+		Where("ref_type = ? AND ref_id = ? AND status = ? AND id <> ?", "sales", invoiceID, models.PaymentStatusPending, exceptID).
+		Pluck("id", &ids).Error; err != nil {
+		log.Println("ERROR EXPIRE PAYMENT", err)
+		return
+	}
+	for _, id := range ids {
+		_, err := s.paymentService.UpdatePaymentStatus(id, payment.StatusUpdate{
+			Status: models.PaymentStatusExpired,
+			Reason: "replaced by a new payment link",
+		})
+		if err != nil && !errors.Is(err, payment.ErrInvalidTransition) {
+			log.Println("ERROR EXPIRE PAYMENT", err)
+		}
+	}
+}
+
+// generateToken returns a random hex token of 48 characters.
+func generateToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 hash of a token, as stored in TokenHash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,908 @@
+package loyalty
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// pointsEpsilon absorbs floating point noise when comparing points.
+const pointsEpsilon = 0.000001
+
+// ErrNotMember is returned when a contact is not a member of the loyalty program.
+var ErrNotMember = errors.New("contact is not a loyalty member")
+
+// LoyaltyService manages loyalty programs, members and their points ledger.
+//
+// Points are earned per rule when a POS sale or a sales invoice is completed, multiplied by
+// the tier of the member. Every earning is a lot in the ledger that expires after the point
+// expiry of the program; redemptions, expiries and negative adjustments consume the lots that
+// expire first. A negative balance (e.g. after a return of a sale whose points were already
+// spent) is settled by the next earnings.
+type LoyaltyService struct {
+	db  *gorm.DB
+	ctx *context.ERPContext
+}
+
+// NewLoyaltyService creates a new instance of LoyaltyService with the given database connection and context.
+func NewLoyaltyService(db *gorm.DB, ctx *context.ERPContext) *LoyaltyService {
+	return &LoyaltyService{db: db, ctx: ctx}
+}
+
+// SetDB sets the database connection of the service, e.g. the transaction of a sale, so points
+// are redeemed within it.
+func (s *LoyaltyService) SetDB(db *gorm.DB) {
+	s.db = db
+}
+
+// Migrate migrates the loyalty models.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.LoyaltyProgramModel{},
+		&models.LoyaltyRuleModel{},
+		&models.LoyaltyTierModel{},
+		&models.LoyaltyMemberModel{},
+		&models.LoyaltyLedgerModel{},
+	)
+}
+
+// EarnLine is a line of a sale that earns points.
+type EarnLine struct {
+	ProductID  *string
+	CategoryID *string
+	Quantity   float64
+	Total      float64
+}
+
+// RedemptionQuote tells how many points a member can redeem on an order.
+type RedemptionQuote struct {
+	MemberID   string  `json:"member_id"`
+	Balance    float64 `json:"balance"`
+	PointValue float64 `json:"point_value"`
+	MinPoints  float64 `json:"min_points"`
+	MaxPoints  float64 `json:"max_points"`
+	MaxAmount  float64 `json:"max_amount"`
+}
+
+// CreateProgram creates a new loyalty program.
+func (s *LoyaltyService) CreateProgram(data *models.LoyaltyProgramModel) error {
+	return s.db.Create(data).Error
+}
+
+// UpdateProgram updates a loyalty program.
+func (s *LoyaltyService) UpdateProgram(id string, data *models.LoyaltyProgramModel) error {
+	return s.db.Where("id = ?", id).Updates(data).Error
+}
+
+// DeleteProgram deletes a loyalty program.
+func (s *LoyaltyService) DeleteProgram(id string) error {
+	return s.db.Where("id = ?", id).Delete(&models.LoyaltyProgramModel{}).Error
+}
+
+// GetProgramByID retrieves a loyalty program with its rules and tiers.
+func (s *LoyaltyService) GetProgramByID(id string) (*models.LoyaltyProgramModel, error) {
+	var program models.LoyaltyProgramModel
+	err := s.db.Preload("Rules").Preload("Tiers", func(db *gorm.DB) *gorm.DB {
+		return db.Order("min_spend asc")
+	}).Where("id = ?", id).First(&program).Error
+	return &program, err
+}
+
+// GetActiveProgram retrieves the active loyalty program of a company.
+func (s *LoyaltyService) GetActiveProgram(companyID *string) (*models.LoyaltyProgramModel, error) {
+	var program models.LoyaltyProgramModel
+	stmt := s.db.Preload("Rules", "is_active = ?", true).Preload("Tiers", func(db *gorm.DB) *gorm.DB {
+		return db.Order("min_spend asc")
+	}).Where("is_active = ?", true)
+	if companyID != nil {
+		stmt = stmt.Where("company_id = ?", *companyID)
+	}
+	err := stmt.Order("created_at asc").First(&program).Error
+	return &program, err
+}
+
+// GetPrograms retrieves a paginated list of loyalty programs.
+func (s *LoyaltyService) GetPrograms(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db
+	if search != "" {
+		stmt = stmt.Where("name ILIKE ? OR description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	stmt = stmt.Model(&models.LoyaltyProgramModel{})
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.LoyaltyProgramModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// AddRule adds an earning rule to a loyalty program.
+func (s *LoyaltyService) AddRule(programID string, data *models.LoyaltyRuleModel) error {
+	if !data.PerQuantity && data.SpendAmount <= 0 {
+		return errors.New("spend amount must be greater than zero")
+	}
+	if data.RuleType == models.LoyaltyRuleProduct && data.ProductID == nil {
+		return errors.New("product ID is required")
+	}
+	if data.RuleType == models.LoyaltyRuleCategory && data.CategoryID == nil {
+		return errors.New("category ID is required")
+	}
+	data.ProgramID = programID
+	return s.db.Create(data).Error
+}
+
+// DeleteRule deletes an earning rule.
+func (s *LoyaltyService) DeleteRule(ruleID string) error {
+	return s.db.Where("id = ?", ruleID).Delete(&models.LoyaltyRuleModel{}).Error
+}
+
+// AddTier adds a tier to a loyalty program.
+func (s *LoyaltyService) AddTier(programID string, data *models.LoyaltyTierModel) error {
+	if data.Multiplier <= 0 {
+		data.Multiplier = 1
+	}
+	data.ProgramID = programID
+	return s.db.Create(data).Error
+}
+
+// DeleteTier deletes a tier. Members of the tier are moved on the next tier evaluation.
+func (s *LoyaltyService) DeleteTier(tierID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.LoyaltyMemberModel{}).Where("tier_id = ?", tierID).Update("tier_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", tierID).Delete(&models.LoyaltyTierModel{}).Error
+	})
+}
+
+// Enroll makes a contact a member of a loyalty program. Enrolling an existing member returns
+// the existing membership.
+func (s *LoyaltyService) Enroll(programID, contactID string) (*models.LoyaltyMemberModel, error) {
+	var program models.LoyaltyProgramModel
+	if err := s.db.Preload("Tiers", func(db *gorm.DB) *gorm.DB {
+		return db.Order("min_spend asc")
+	}).Where("id = ?", programID).First(&program).Error; err != nil {
+		return nil, err
+	}
+	var member *models.LoyaltyMemberModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		member, err = s.getMember(tx, &program, contactID, true)
+		return err
+	})
+	return member, err
+}
+
+// GetMember retrieves the membership of a contact in a loyalty program.
+func (s *LoyaltyService) GetMember(programID, contactID string) (*models.LoyaltyMemberModel, error) {
+	var member models.LoyaltyMemberModel
+	err := s.db.Preload("Tier").Where("program_id = ? AND contact_id = ?", programID, contactID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotMember
+	}
+	return &member, err
+}
+
+// GetMembers retrieves a paginated list of members of a loyalty program.
+func (s *LoyaltyService) GetMembers(request http.Request, search string, programID string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Tier").Preload("Contact", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "email", "phone")
+	}).Joins("LEFT JOIN contacts ON contacts.id = loyalty_members.contact_id").
+		Where("loyalty_members.program_id = ?", programID)
+	if search != "" {
+		stmt = stmt.Where("loyalty_members.member_number ILIKE ? OR contacts.name ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.URL.Query().Get("tier_id") != "" {
+		stmt = stmt.Where("loyalty_members.tier_id = ?", request.URL.Query().Get("tier_id"))
+	}
+	stmt = stmt.Model(&models.LoyaltyMemberModel{})
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.LoyaltyMemberModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetLedger retrieves a paginated points ledger of a member, newest first.
+func (s *LoyaltyService) GetLedger(request http.Request, memberID string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Where("member_id = ?", memberID)
+	if request.URL.Query().Get("type") != "" {
+		stmt = stmt.Where("type = ?", request.URL.Query().Get("type"))
+	}
+	stmt = stmt.Model(&models.LoyaltyLedgerModel{}).Order("date desc, created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.LoyaltyLedgerModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// EarnFromPOS awards the points of a completed POS sale to its contact.
+//
+// It does nothing when the sale has no contact, the company has no active program or the
+// contact is not a member of a program without auto enrolment. Earning is idempotent: a sale
+// earns points only once.
+func (s *LoyaltyService) EarnFromPOS(posID string) (*models.LoyaltyLedgerModel, error) {
+	var pos models.POSModel
+	if err := s.db.Preload("Items.Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "category_id")
+	}).Where("id = ?", posID).First(&pos).Error; err != nil {
+		return nil, err
+	}
+	if pos.ContactID == nil {
+		return nil, nil
+	}
+	if strings.ToLower(pos.Status) != "completed" {
+		return nil, errors.New("POS sale is not completed")
+	}
+	lines := []EarnLine{}
+	for _, v := range pos.Items {
+		line := EarnLine{ProductID: v.ProductID, Quantity: v.Quantity, Total: v.Total}
+		if v.Product != nil {
+			line.CategoryID = v.Product.CategoryID
+		}
+		lines = append(lines, line)
+	}
+	return s.EarnPoints(pos.CompanyID, *pos.ContactID, "pos", pos.ID, pos.SalesDate, pos.Total, lines, fmt.Sprintf("Penjualan %s", pos.SalesNumber))
+}
+
+// EarnFromSales awards the points of a posted sales invoice to its contact. See EarnFromPOS.
+func (s *LoyaltyService) EarnFromSales(salesID string) (*models.LoyaltyLedgerModel, error) {
+	var sales models.SalesModel
+	if err := s.db.Preload("Items.Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "category_id")
+	}).Where("id = ?", salesID).First(&sales).Error; err != nil {
+		return nil, err
+	}
+	if sales.ContactID == nil {
+		return nil, nil
+	}
+	if sales.DocumentType != models.INVOICE {
+		return nil, errors.New("document is not an invoice")
+	}
+	lines := []EarnLine{}
+	for _, v := range sales.Items {
+		if v.IsCost {
+			continue
+		}
+		line := EarnLine{ProductID: v.ProductID, Quantity: v.Quantity, Total: v.Total}
+		if v.Product != nil {
+			line.CategoryID = v.Product.CategoryID
+		}
+		lines = append(lines, line)
+	}
+	return s.EarnPoints(sales.CompanyID, *sales.ContactID, "sales", sales.ID, sales.SalesDate, sales.Total, lines, fmt.Sprintf("Penjualan %s", sales.SalesNumber))
+}
+
+// EarnPoints awards points for a sale from source (pos or sales) to a contact.
+//
+// Each active rule of the program adds points: SPEND rules on the sale total, PRODUCT and
+// CATEGORY rules on the matching lines. The sum is multiplied by the tier multiplier of the
+// member and rounded down. The sale total counts towards the rolling spend of the member, after
+// which the tier is evaluated again. It returns nil when nothing is earned.
+func (s *LoyaltyService) EarnPoints(companyID *string, contactID, source, refID string, date time.Time, total float64, lines []EarnLine, description string) (*models.LoyaltyLedgerModel, error) {
+	program, err := s.GetActiveProgram(companyID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	var ledger *models.LoyaltyLedgerModel
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		member, err := s.getMember(tx, program, contactID, program.AutoEnroll)
+		if errors.Is(err, ErrNotMember) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the member is locked, so a sale is not earned twice concurrently
+		var count int64
+		if err := tx.Model(&models.LoyaltyLedgerModel{}).
+			Where("reference_type = ? AND reference_id = ? AND type = ?", source, refID, models.LoyaltyLedgerEarn).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		multiplier := 1.0
+		if member.TierID != nil {
+			for _, t := range program.Tiers {
+				if t.ID == *member.TierID && t.Multiplier > 0 {
+					multiplier = t.Multiplier
+				}
+			}
+		}
+		points := math.Floor(calculatePoints(program.Rules, source, date, total, lines) * multiplier)
+
+		ledger = &models.LoyaltyLedgerModel{
+			MemberID:      member.ID,
+			ProgramID:     program.ID,
+			ContactID:     contactID,
+			Date:          date,
+			Type:          models.LoyaltyLedgerEarn,
+			Points:        points,
+			Amount:        total,
+			Multiplier:    multiplier,
+			ReferenceID:   &refID,
+			ReferenceType: source,
+			Description:   description,
+		}
+		if program.PointExpiryDays > 0 {
+			expiresAt := date.AddDate(0, 0, program.PointExpiryDays)
+			ledger.ExpiresAt = &expiresAt
+		}
+		if err := s.addPoints(tx, member, ledger); err != nil {
+			return err
+		}
+		return s.evaluateTier(tx, program, member, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// QuoteRedemption tells how many points of a contact can be redeemed on an order total.
+func (s *LoyaltyService) QuoteRedemption(companyID *string, contactID string, orderTotal float64) (*RedemptionQuote, error) {
+	program, err := s.GetActiveProgram(companyID)
+	if err != nil {
+		return nil, err
+	}
+	member, err := s.GetMember(program.ID, contactID)
+	if err != nil {
+		return nil, err
+	}
+	quote := RedemptionQuote{
+		MemberID:   member.ID,
+		Balance:    member.PointsBalance,
+		PointValue: program.PointValue,
+		MinPoints:  program.MinRedeemPoints,
+	}
+	if program.PointValue <= 0 || member.PointsBalance < program.MinRedeemPoints || member.PointsBalance <= 0 {
+		return &quote, nil
+	}
+	maxAmount := orderTotal * program.MaxRedeemPercent / 100
+	quote.MaxPoints = math.Min(member.PointsBalance, math.Floor(maxAmount/program.PointValue))
+	quote.MaxAmount = quote.MaxPoints * program.PointValue
+	return &quote, nil
+}
+
+// Redeem redeems points of a contact on an order, as a payment method or as a discount.
+//
+// The points must be at least the minimum of the program, not more than the balance, and worth
+// no more than the redeemable share of orderTotal. The returned ledger entry holds the value of
+// the redeemed points in Amount; the caller records it as a payment or a discount on the order
+// referred to by refType and refID.
+func (s *LoyaltyService) Redeem(companyID *string, contactID string, points, orderTotal float64, mode models.LoyaltyRedeemMode, refID, refType string, userID *string) (*models.LoyaltyLedgerModel, error) {
+	if points <= 0 {
+		return nil, errors.New("points must be greater than zero")
+	}
+	if mode == "" {
+		mode = models.LoyaltyRedeemPayment
+	}
+	program, err := s.GetActiveProgram(companyID)
+	if err != nil {
+		return nil, err
+	}
+	if program.PointValue <= 0 {
+		return nil, errors.New("points of this program cannot be redeemed")
+	}
+	if points+pointsEpsilon < program.MinRedeemPoints {
+		return nil, fmt.Errorf("minimum redemption is %.0f points", program.MinRedeemPoints)
+	}
+	amount := points * program.PointValue
+	if amount > orderTotal*program.MaxRedeemPercent/100+pointsEpsilon {
+		return nil, fmt.Errorf("points can pay at most %.0f%% of the order", program.MaxRedeemPercent)
+	}
+
+	var ledger *models.LoyaltyLedgerModel
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		member, err := s.getMember(tx, program, contactID, false)
+		if err != nil {
+			return err
+		}
+		if member.PointsBalance+pointsEpsilon < points {
+			return fmt.Errorf("insufficient points: balance %.0f, requested %.0f", member.PointsBalance, points)
+		}
+		ledger = &models.LoyaltyLedgerModel{
+			MemberID:      member.ID,
+			ProgramID:     program.ID,
+			ContactID:     contactID,
+			Date:          time.Now(),
+			Type:          models.LoyaltyLedgerRedeem,
+			Points:        -points,
+			Amount:        amount,
+			Multiplier:    1,
+			RedeemMode:    mode,
+			ReferenceID:   &refID,
+			ReferenceType: refType,
+			Description:   fmt.Sprintf("Penukaran %.0f poin", points),
+			UserID:        userID,
+		}
+		return s.deductPoints(tx, member, ledger)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// Adjust adds (positive) or removes (negative) points of a member manually.
+func (s *LoyaltyService) Adjust(memberID string, points float64, description string, userID *string) (*models.LoyaltyLedgerModel, error) {
+	if points == 0 {
+		return nil, errors.New("points cannot be zero")
+	}
+	var ledger *models.LoyaltyLedgerModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var member models.LoyaltyMemberModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", memberID).First(&member).Error; err != nil {
+			return err
+		}
+		var program models.LoyaltyProgramModel
+		if err := tx.Select("id", "point_expiry_days").Where("id = ?", member.ProgramID).First(&program).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		ledger = &models.LoyaltyLedgerModel{
+			MemberID:      member.ID,
+			ProgramID:     member.ProgramID,
+			ContactID:     member.ContactID,
+			Date:          now,
+			Type:          models.LoyaltyLedgerAdjust,
+			Points:        points,
+			Multiplier:    1,
+			ReferenceType: "manual",
+			Description:   description,
+			UserID:        userID,
+		}
+		if points < 0 {
+			return s.deductPoints(tx, &member, ledger)
+		}
+		if program.PointExpiryDays > 0 {
+			expiresAt := now.AddDate(0, 0, program.PointExpiryDays)
+			ledger.ExpiresAt = &expiresAt
+		}
+		return s.addPoints(tx, &member, ledger)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// ReverseForReturn takes back the points a sale earned for the returned part of it.
+//
+// The reversed points are the earned points in proportion to the return total against the
+// sale total; the return total is also taken off the rolling spend. It is idempotent per return
+// and does nothing when the sale earned no points.
+func (s *LoyaltyService) ReverseForReturn(returnID string) (*models.LoyaltyLedgerModel, error) {
+	var returnData models.ReturnModel
+	if err := s.db.Preload("Items").Where("id = ?", returnID).First(&returnData).Error; err != nil {
+		return nil, err
+	}
+	var returnTotal float64
+	for _, v := range returnData.Items {
+		returnTotal += v.Total
+	}
+	return s.reverseEarning("sales", returnData.RefID, "sales_return", returnData.ID, returnTotal, fmt.Sprintf("Retur %s", returnData.ReturnNumber), returnData.UserID)
+}
+
+// ReverseReference reverses the points of a sale (refType, refID) for a refund identified by
+// refundID: the earned points are taken back in proportion to amount against the sale total.
+//
+// When amount is 0 the sale is reversed in full and the points redeemed on it are given back
+// as well. It is idempotent per refund.
+func (s *LoyaltyService) ReverseReference(refType, refID, refundID string, amount float64, reason string, userID *string) error {
+	full := amount <= 0
+	var earn models.LoyaltyLedgerModel
+	err := s.db.Where("reference_type = ? AND reference_id = ? AND type = ?", refType, refID, models.LoyaltyLedgerEarn).First(&earn).Error
+	if err == nil {
+		if full {
+			amount = earn.Amount
+		}
+		if _, err := s.reverseEarning(refType, refID, refType+"_refund", refundID, amount, reason, userID); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if !full {
+		return nil
+	}
+
+	var redemptions []models.LoyaltyLedgerModel
+	if err := s.db.Where("reference_type = ? AND reference_id = ? AND type = ?", refType, refID, models.LoyaltyLedgerRedeem).Find(&redemptions).Error; err != nil {
+		return err
+	}
+	for _, redemption := range redemptions {
+		var count int64
+		s.db.Model(&models.LoyaltyLedgerModel{}).Where("reversal_of_id = ?", redemption.ID).Count(&count)
+		if count > 0 {
+			continue
+		}
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var member models.LoyaltyMemberModel
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", redemption.MemberID).First(&member).Error; err != nil {
+				return err
+			}
+			var program models.LoyaltyProgramModel
+			if err := tx.Select("id", "point_expiry_days").Where("id = ?", member.ProgramID).First(&program).Error; err != nil {
+				return err
+			}
+			now := time.Now()
+			redemptionID := redemption.ID
+			ledger := models.LoyaltyLedgerModel{
+				MemberID:      member.ID,
+				ProgramID:     member.ProgramID,
+				ContactID:     member.ContactID,
+				Date:          now,
+				Type:          models.LoyaltyLedgerReversal,
+				Points:        -redemption.Points,
+				Amount:        -redemption.Amount,
+				Multiplier:    1,
+				RedeemMode:    redemption.RedeemMode,
+				ReferenceID:   &refundID,
+				ReferenceType: refType + "_refund",
+				ReversalOfID:  &redemptionID,
+				Description:   reason,
+				UserID:        userID,
+			}
+			if program.PointExpiryDays > 0 {
+				expiresAt := now.AddDate(0, 0, program.PointExpiryDays)
+				ledger.ExpiresAt = &expiresAt
+			}
+			return s.addPoints(tx, &member, &ledger)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpirePoints expires the unused points of every lot that passed its expiry.
+//
+// It is meant to be called periodically and returns the number of expired lots.
+func (s *LoyaltyService) ExpirePoints(now time.Time) (int64, error) {
+	var lots []models.LoyaltyLedgerModel
+	if err := s.db.Where("remaining_points > 0 AND expires_at IS NOT NULL AND expires_at <= ?", now).
+		Order("expires_at asc").Find(&lots).Error; err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, lot := range lots {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var member models.LoyaltyMemberModel
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", lot.MemberID).First(&member).Error; err != nil {
+				return err
+			}
+			// the lot may have been consumed since it was loaded
+			var current models.LoyaltyLedgerModel
+			if err := tx.Select("id", "remaining_points").Where("id = ?", lot.ID).First(&current).Error; err != nil {
+				return err
+			}
+			if current.RemainingPoints <= pointsEpsilon {
+				return nil
+			}
+			lotID := lot.ID
+			if err := tx.Create(&models.LoyaltyLedgerModel{
+				MemberID:      member.ID,
+				ProgramID:     member.ProgramID,
+				ContactID:     member.ContactID,
+				Date:          now,
+				Type:          models.LoyaltyLedgerExpire,
+				Points:        -current.RemainingPoints,
+				Multiplier:    1,
+				ReferenceType: "expiry",
+				ReversalOfID:  &lotID,
+				Description:   fmt.Sprintf("Poin kedaluwarsa (%s)", lot.Description),
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.LoyaltyLedgerModel{}).Where("id = ?", lot.ID).Update("remaining_points", 0).Error; err != nil {
+				return err
+			}
+			count++
+			return tx.Model(&models.LoyaltyMemberModel{}).Where("id = ?", member.ID).
+				Update("points_balance", member.PointsBalance-current.RemainingPoints).Error
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// EvaluateTiers moves every member of a program to the tier of its rolling spend, up or down.
+//
+// It is meant to be called periodically so that members whose spend rolls out of the period
+// are moved down. It returns the number of members whose tier changed.
+func (s *LoyaltyService) EvaluateTiers(programID string, now time.Time) (int, error) {
+	program, err := s.GetProgramByID(programID)
+	if err != nil {
+		return 0, err
+	}
+	var members []models.LoyaltyMemberModel
+	if err := s.db.Where("program_id = ?", programID).Find(&members).Error; err != nil {
+		return 0, err
+	}
+	changed := 0
+	for i := range members {
+		before := members[i].TierID
+		if err := s.evaluateTier(s.db, program, &members[i], now); err != nil {
+			return changed, err
+		}
+		if (before == nil) != (members[i].TierID == nil) || (before != nil && *before != *members[i].TierID) {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// reverseEarning takes back the points a sale (refType, refID) earned for amount of it and
+// books the reversal under the reference of the return or refund.
+func (s *LoyaltyService) reverseEarning(refType, refID, reversalType, reversalID string, amount float64, description string, userID *string) (*models.LoyaltyLedgerModel, error) {
+	var count int64
+	s.db.Model(&models.LoyaltyLedgerModel{}).
+		Where("reference_type = ? AND reference_id = ? AND type = ?", reversalType, reversalID, models.LoyaltyLedgerReversal).
+		Count(&count)
+	if count > 0 {
+		return nil, nil
+	}
+	var earn models.LoyaltyLedgerModel
+	err := s.db.Where("reference_type = ? AND reference_id = ? AND type = ?", refType, refID, models.LoyaltyLedgerEarn).First(&earn).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ledger *models.LoyaltyLedgerModel
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var member models.LoyaltyMemberModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", earn.MemberID).First(&member).Error; err != nil {
+			return err
+		}
+		var reversed struct {
+			Points float64
+			Amount float64
+		}
+		if err := tx.Model(&models.LoyaltyLedgerModel{}).
+			Select("COALESCE(SUM(points), 0) as points, COALESCE(SUM(amount), 0) as amount").
+			Where("reversal_of_id = ? AND type = ?", earn.ID, models.LoyaltyLedgerReversal).
+			Scan(&reversed).Error; err != nil {
+			return err
+		}
+		openAmount := earn.Amount + reversed.Amount
+		openPoints := earn.Points + reversed.Points
+		amount = math.Min(amount, openAmount)
+		if amount <= pointsEpsilon {
+			return nil
+		}
+		points := openPoints
+		if earn.Amount > 0 && amount < openAmount-pointsEpsilon {
+			points = math.Min(openPoints, math.Round(earn.Points*amount/earn.Amount))
+		}
+		earnID := earn.ID
+		ledger = &models.LoyaltyLedgerModel{
+			MemberID:      member.ID,
+			ProgramID:     member.ProgramID,
+			ContactID:     member.ContactID,
+			Date:          time.Now(),
+			Type:          models.LoyaltyLedgerReversal,
+			Points:        -points,
+			Amount:        -amount,
+			Multiplier:    earn.Multiplier,
+			ReferenceID:   &reversalID,
+			ReferenceType: reversalType,
+			ReversalOfID:  &earnID,
+			Description:   description,
+			UserID:        userID,
+		}
+		// the reversal takes back the points of the earned lot first
+		if err := s.deductPoints(tx, &member, ledger, earn.ID); err != nil {
+			return err
+		}
+		var program models.LoyaltyProgramModel
+		if err := tx.Preload("Tiers", func(db *gorm.DB) *gorm.DB {
+			return db.Order("min_spend asc")
+		}).Where("id = ?", member.ProgramID).First(&program).Error; err != nil {
+			return err
+		}
+		return s.evaluateTier(tx, &program, &member, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// getMember returns the locked membership of a contact, enrolling the contact when enroll is set.
+func (s *LoyaltyService) getMember(tx *gorm.DB, program *models.LoyaltyProgramModel, contactID string, enroll bool) (*models.LoyaltyMemberModel, error) {
+	var member models.LoyaltyMemberModel
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("program_id = ? AND contact_id = ?", program.ID, contactID).First(&member).Error
+	if err == nil {
+		return &member, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !enroll {
+		return nil, ErrNotMember
+	}
+	member = models.LoyaltyMemberModel{
+		ProgramID:    program.ID,
+		ContactID:    contactID,
+		MemberNumber: fmt.Sprintf("MBR-%s", utils.RandomStringNumber(10, false)),
+		JoinedAt:     time.Now(),
+	}
+	for _, t := range program.Tiers {
+		if t.MinSpend <= 0 {
+			tierID := t.ID
+			member.TierID = &tierID
+		}
+	}
+	if err := tx.Create(&member).Error; err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// addPoints books a ledger entry that adds points. When the balance of the member is negative
+// the new lot first settles it.
+func (s *LoyaltyService) addPoints(tx *gorm.DB, member *models.LoyaltyMemberModel, ledger *models.LoyaltyLedgerModel) error {
+	ledger.RemainingPoints = ledger.Points
+	if member.PointsBalance < 0 {
+		ledger.RemainingPoints = math.Max(0, ledger.Points+member.PointsBalance)
+	}
+	if err := tx.Create(ledger).Error; err != nil {
+		return err
+	}
+	member.PointsBalance += ledger.Points
+	updates := map[string]any{"points_balance": member.PointsBalance}
+	if ledger.Type == models.LoyaltyLedgerEarn || ledger.Type == models.LoyaltyLedgerAdjust {
+		member.LifetimePoints += ledger.Points
+		updates["lifetime_points"] = member.LifetimePoints
+	}
+	return tx.Model(&models.LoyaltyMemberModel{}).Where("id = ?", member.ID).Updates(updates).Error
+}
+
+// deductPoints books a ledger entry that removes points and consumes the lots, preferred lots
+// first and then the ones that expire first. Points that no lot covers leave a negative balance.
+func (s *LoyaltyService) deductPoints(tx *gorm.DB, member *models.LoyaltyMemberModel, ledger *models.LoyaltyLedgerModel, preferredLots ...string) error {
+	remaining := -ledger.Points
+	for _, lotID := range preferredLots {
+		consumed, err := s.consumeLots(tx, tx.Where("id = ?", lotID), remaining)
+		if err != nil {
+			return err
+		}
+		remaining -= consumed
+	}
+	if remaining > pointsEpsilon {
+		if _, err := s.consumeLots(tx, tx.Where("member_id = ?", member.ID), remaining); err != nil {
+			return err
+		}
+	}
+	if err := tx.Create(ledger).Error; err != nil {
+		return err
+	}
+	member.PointsBalance += ledger.Points
+	return tx.Model(&models.LoyaltyMemberModel{}).Where("id = ?", member.ID).Update("points_balance", member.PointsBalance).Error
+}
+
+// consumeLots consumes up to points from the open lots matched by stmt, the ones that expire
+// first first, and returns the consumed points.
+func (s *LoyaltyService) consumeLots(tx *gorm.DB, stmt *gorm.DB, points float64) (float64, error) {
+	var lots []models.LoyaltyLedgerModel
+	if err := stmt.Where("remaining_points > 0").
+		Order("expires_at IS NULL, expires_at asc, date asc").Find(&lots).Error; err != nil {
+		return 0, err
+	}
+	consumed := 0.0
+	for _, lot := range lots {
+		if points-consumed <= pointsEpsilon {
+			break
+		}
+		take := math.Min(lot.RemainingPoints, points-consumed)
+		if err := tx.Model(&models.LoyaltyLedgerModel{}).Where("id = ?", lot.ID).
+			Update("remaining_points", lot.RemainingPoints-take).Error; err != nil {
+			return consumed, err
+		}
+		consumed += take
+	}
+	return consumed, nil
+}
+
+// evaluateTier recalculates the rolling spend of a member and moves it to the matching tier.
+func (s *LoyaltyService) evaluateTier(tx *gorm.DB, program *models.LoyaltyProgramModel, member *models.LoyaltyMemberModel, now time.Time) error {
+	stmt := tx.Model(&models.LoyaltyLedgerModel{}).
+		Where("member_id = ? AND type IN (?)", member.ID, []models.LoyaltyLedgerType{models.LoyaltyLedgerEarn, models.LoyaltyLedgerReversal}).
+		Where("reference_type NOT IN (?)", []string{"manual", "expiry"}).
+		Where("redeem_mode = '' OR redeem_mode IS NULL")
+	if program.TierPeriodDays > 0 {
+		stmt = stmt.Where("date > ?", now.AddDate(0, 0, -program.TierPeriodDays))
+	}
+	var spend float64
+	if err := stmt.Select("COALESCE(SUM(amount), 0)").Scan(&spend).Error; err != nil {
+		return err
+	}
+	var tierID *string
+	for _, t := range program.Tiers {
+		if spend+pointsEpsilon >= t.MinSpend {
+			id := t.ID
+			tierID = &id
+		}
+	}
+	member.RollingSpend = spend
+	member.TierID = tierID
+	member.TierEvaluatedAt = &now
+	return tx.Model(&models.LoyaltyMemberModel{}).Where("id = ?", member.ID).Updates(map[string]any{
+		"rolling_spend":     spend,
+		"tier_id":           tierID,
+		"tier_evaluated_at": now,
+	}).Error
+}
+
+// calculatePoints adds up the points of every rule that applies to a sale.
+func calculatePoints(rules []models.LoyaltyRuleModel, source string, date time.Time, total float64, lines []EarnLine) float64 {
+	var points float64
+	for _, rule := range rules {
+		if !rule.IsActive || (rule.Source != "" && rule.Source != source) {
+			continue
+		}
+		if (rule.StartDate != nil && date.Before(*rule.StartDate)) || (rule.EndDate != nil && date.After(*rule.EndDate)) {
+			continue
+		}
+		switch rule.RuleType {
+		case models.LoyaltyRuleSpend:
+			if rule.SpendAmount > 0 {
+				points += math.Floor(total/rule.SpendAmount) * rule.Points
+			}
+		case models.LoyaltyRuleProduct, models.LoyaltyRuleCategory:
+			var quantity, spend float64
+			for _, line := range lines {
+				if rule.RuleType == models.LoyaltyRuleProduct && (line.ProductID == nil || rule.ProductID == nil || *line.ProductID != *rule.ProductID) {
+					continue
+				}
+				if rule.RuleType == models.LoyaltyRuleCategory && (line.CategoryID == nil || rule.CategoryID == nil || *line.CategoryID != *rule.CategoryID) {
+					continue
+				}
+				quantity += line.Quantity
+				spend += line.Total
+			}
+			if rule.PerQuantity {
+				points += math.Floor(quantity) * rule.Points
+			} else if rule.SpendAmount > 0 {
+				points += math.Floor(spend/rule.SpendAmount) * rule.Points
+			}
+		}
+	}
+	return points
+}
@@ -0,0 +1,335 @@
+package marketplace
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// RecordOrder computes the platform commission of a completed merchant order and books it to
+// the balance ledger of the merchant.
+//
+// Every line gets the most specific active rule: a product rule, then a category rule, then a
+// merchant type rule, then a rule without scope; the highest priority wins within a scope and a
+// rule limited to a merchant type only applies to merchants of that type. The commission of a
+// line is computed on its amount after discounts, with a discount on the order subtotal spread
+// over the lines by their share. The fixed fee of every rule used is charged once per order and
+// the tier of a rule is chosen by the sales of the merchant earlier in the month.
+//
+// Orders paid online are collected by the platform, so their total is credited to the merchant
+// (SALE) and becomes available after the hold period of the merchant; the commission is debited
+// in any case. Orders already paid out through a withdrawal are not credited again. Recording an
+// order twice returns the first commission.
+func (s *MarketplaceService) RecordOrder(posID string) (*models.MerchantCommissionModel, error) {
+	var existing models.MerchantCommissionModel
+	err := s.db.Preload("Lines").Where("pos_id = ?", posID).First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var pos models.POSModel
+	if err := s.db.Preload("Merchant").Preload("Items.Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "category_id")
+	}).Where("id = ?", posID).First(&pos).Error; err != nil {
+		return nil, err
+	}
+	if pos.MerchantID == nil || pos.Merchant == nil {
+		return nil, errors.New("sale is not a merchant order")
+	}
+	if !strings.EqualFold(pos.Status, "completed") {
+		return nil, errors.New("order is not completed")
+	}
+	date := pos.SalesDate
+	if pos.CompletedAt != nil {
+		date = *pos.CompletedAt
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	commission := models.MerchantCommissionModel{
+		BaseModel:   shared.BaseModel{ID: utils.Uuid()},
+		POSID:       &pos.ID,
+		MerchantID:  pos.MerchantID,
+		CompanyID:   pos.CompanyID,
+		Date:        date,
+		OrderAmount: pos.Total,
+		Collected:   pos.PaymentID != nil,
+	}
+	monthStart := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
+	if err := s.db.Model(&models.MerchantCommissionModel{}).Select("COALESCE(SUM(order_amount), 0)").
+		Where("merchant_id = ? AND date >= ? AND date < ?", *pos.MerchantID, monthStart, date).
+		Scan(&commission.Volume).Error; err != nil {
+		return nil, err
+	}
+
+	rules, err := s.activeRules(pos.CompanyID, date)
+	if err != nil {
+		return nil, err
+	}
+	// a discount the order carries on its subtotal, e.g. an order-level promotion, is spread over
+	// the lines by their share so the commission is computed on what the customer paid
+	basis := make([]float64, len(pos.Items))
+	linesTotal := 0.0
+	for i, item := range pos.Items {
+		basis[i] = lineValue(item)
+		linesTotal += basis[i]
+	}
+	if pos.Subtotal > 0 && linesTotal-pos.Subtotal > amountEpsilon {
+		orderDiscount := linesTotal - pos.Subtotal
+		for i := range basis {
+			basis[i] = math.Round((basis[i]-orderDiscount*basis[i]/linesTotal)*100) / 100
+		}
+	}
+	used := map[string]*models.CommissionRuleModel{}
+	usedOrder := []string{}
+	for i, item := range pos.Items {
+		var categoryID *string
+		if item.Product != nil {
+			categoryID = item.Product.CategoryID
+		}
+		rule := matchRule(rules, item.ProductID, categoryID, pos.Merchant.MerchantTypeID)
+		if rule == nil {
+			continue
+		}
+		percent, _ := ruleRate(rule, commission.Volume)
+		itemID := item.ID
+		amount := math.Round(basis[i]*percent) / 100
+		commission.Lines = append(commission.Lines, models.MerchantCommissionLineModel{
+			BaseModel:    shared.BaseModel{ID: utils.Uuid()},
+			CommissionID: &commission.ID,
+			POSItemID:    &itemID,
+			ProductID:    item.ProductID,
+			Description:  item.Description,
+			RuleID:       &rule.ID,
+			RuleName:     rule.Name,
+			Basis:        basis[i],
+			Percent:      percent,
+			Amount:       amount,
+		})
+		commission.CommissionAmount += amount
+		if _, ok := used[rule.ID]; !ok {
+			used[rule.ID] = rule
+			usedOrder = append(usedOrder, rule.ID)
+		}
+	}
+	for _, id := range usedOrder {
+		rule := used[id]
+		_, fixedFee := ruleRate(rule, commission.Volume)
+		if fixedFee <= 0 {
+			continue
+		}
+		commission.Lines = append(commission.Lines, models.MerchantCommissionLineModel{
+			BaseModel:    shared.BaseModel{ID: utils.Uuid()},
+			CommissionID: &commission.ID,
+			Description:  fmt.Sprintf("Biaya tetap %s", rule.Name),
+			RuleID:       &rule.ID,
+			RuleName:     rule.Name,
+			Amount:       fixedFee,
+		})
+		commission.CommissionAmount += fixedFee
+	}
+	commission.CommissionAmount = math.Round(commission.CommissionAmount*100) / 100
+
+	var withdrawn int64
+	s.db.Model(&models.WithdrawalItemModel{}).Where("pos_id = ?", pos.ID).Count(&withdrawn)
+	availableAt := date.AddDate(0, 0, pos.Merchant.PayoutHoldDays)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&commission).Error; err != nil {
+			return err
+		}
+		if commission.Collected && withdrawn == 0 {
+			if err := s.addEntry(tx, pos.MerchantID, pos.CompanyID, date, models.MerchantLedgerSale, pos.Total, availableAt, &pos.ID, "pos_sales",
+				fmt.Sprintf("Penjualan %s", pos.SalesNumber), nil); err != nil {
+				return err
+			}
+		}
+		if commission.CommissionAmount > 0 {
+			return s.addEntry(tx, pos.MerchantID, pos.CompanyID, date, models.MerchantLedgerCommission, -commission.CommissionAmount, availableAt, &pos.ID, "pos_sales",
+				fmt.Sprintf("Komisi penjualan %s", pos.SalesNumber), nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &commission, nil
+}
+
+// RecordRefund books a completed refund of a merchant order: the commission is given back in
+// proportion to the refunded amount, and a refund paid back through the payment provider is
+// taken from the balance of the merchant. Refunds of orders without a commission are ignored and
+// a refund is booked once.
+func (s *MarketplaceService) RecordRefund(refund *models.POSRefundModel) error {
+	if refund == nil || refund.POSID == nil || refund.Status != models.POSRefundCompleted {
+		return nil
+	}
+	var count int64
+	s.db.Model(&models.MerchantLedgerEntryModel{}).Where("ref_id = ? AND ref_type = ?", refund.ID, "pos_refund").Count(&count)
+	if count > 0 {
+		return nil
+	}
+	var commission models.MerchantCommissionModel
+	err := s.db.Where("pos_id = ?", *refund.POSID).First(&commission).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if refund.Method == models.POSRefundMethodProvider && commission.Collected {
+			if err := s.addEntry(tx, commission.MerchantID, commission.CompanyID, refund.Date, models.MerchantLedgerRefund, -refund.Amount, refund.Date, &refund.ID, "pos_refund",
+				fmt.Sprintf("Refund %s", refund.Code), refund.ApprovedByID); err != nil {
+				return err
+			}
+		}
+		reversal := 0.0
+		if commission.OrderAmount > 0 {
+			reversal = math.Round(commission.CommissionAmount*refund.Amount/commission.OrderAmount*100) / 100
+		}
+		reversal = math.Min(reversal, commission.CommissionAmount-commission.ReversedAmount)
+		if reversal <= amountEpsilon {
+			return nil
+		}
+		if err := tx.Model(&models.MerchantCommissionModel{}).Where("id = ?", commission.ID).
+			Update("reversed_amount", gorm.Expr("reversed_amount + ?", reversal)).Error; err != nil {
+			return err
+		}
+		return s.addEntry(tx, commission.MerchantID, commission.CompanyID, refund.Date, models.MerchantLedgerCommissionReversal, reversal, refund.Date, &refund.ID, "pos_refund",
+			fmt.Sprintf("Pengembalian komisi refund %s", refund.Code), refund.ApprovedByID)
+	})
+}
+
+// GetCommissionByPOSID retrieves the commission of a merchant order with its lines.
+func (s *MarketplaceService) GetCommissionByPOSID(posID string) (*models.MerchantCommissionModel, error) {
+	var commission models.MerchantCommissionModel
+	err := s.db.Preload("Lines").Where("pos_id = ?", posID).First(&commission).Error
+	if err != nil {
+		return nil, err
+	}
+	return &commission, nil
+}
+
+// GetCommissions retrieves a paginated list of order commissions.
+//
+// The list can be filtered with the merchant_id, start_date and end_date query parameters and
+// is scoped to the company in the ID-Company header.
+func (s *MarketplaceService) GetCommissions(request http.Request) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("POS", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "sales_number", "code", "total", "contact_data")
+	}).Preload("Merchant", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Model(&models.MerchantCommissionModel{})
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("merchant_id") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.URL.Query().Get("merchant_id"))
+	}
+	if request.URL.Query().Get("start_date") != "" {
+		stmt = stmt.Where("date >= ?", request.URL.Query().Get("start_date"))
+	}
+	if request.URL.Query().Get("end_date") != "" {
+		stmt = stmt.Where("date <= ?", request.URL.Query().Get("end_date"))
+	}
+	stmt = stmt.Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.MerchantCommissionModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// activeRules returns the active rules of a company (and the rules without company) valid on a
+// date, highest priority first.
+func (s *MarketplaceService) activeRules(companyID *string, date time.Time) ([]models.CommissionRuleModel, error) {
+	var rules []models.CommissionRuleModel
+	stmt := s.db.Where("is_active = ?", true).
+		Where("start_date IS NULL OR start_date <= ?", date).
+		Where("end_date IS NULL OR end_date >= ?", date)
+	if companyID != nil {
+		stmt = stmt.Where("company_id = ? OR company_id IS NULL", *companyID)
+	} else {
+		stmt = stmt.Where("company_id IS NULL")
+	}
+	if err := stmt.Order("priority desc, created_at desc").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// lineValue returns the amount of a sale line after its own discounts; lines of a cart order only
+// carry their subtotal.
+func lineValue(item models.POSSalesItemModel) float64 {
+	if item.Total > 0 {
+		return item.Total
+	}
+	return item.Subtotal
+}
+
+// matchRule picks the most specific rule of a line; rules are ordered by priority. Every
+// reference a rule sets must match the line, so a product or category rule limited to a
+// merchant type is skipped for merchants of another type.
+func matchRule(rules []models.CommissionRuleModel, productID, categoryID, merchantTypeID *string) *models.CommissionRuleModel {
+	matches := func(ref, value *string) bool {
+		return ref != nil && *ref != "" && value != nil && *ref == *value
+	}
+	empty := func(ref *string) bool {
+		return ref == nil || *ref == ""
+	}
+	fits := func(ref, value *string) bool {
+		return empty(ref) || matches(ref, value)
+	}
+	scopes := []func(rule *models.CommissionRuleModel) bool{
+		func(rule *models.CommissionRuleModel) bool {
+			return matches(rule.ProductID, productID) && fits(rule.CategoryID, categoryID) && fits(rule.MerchantTypeID, merchantTypeID)
+		},
+		func(rule *models.CommissionRuleModel) bool {
+			return empty(rule.ProductID) && matches(rule.CategoryID, categoryID) && fits(rule.MerchantTypeID, merchantTypeID)
+		},
+		func(rule *models.CommissionRuleModel) bool {
+			return empty(rule.ProductID) && empty(rule.CategoryID) && matches(rule.MerchantTypeID, merchantTypeID)
+		},
+		func(rule *models.CommissionRuleModel) bool {
+			return empty(rule.ProductID) && empty(rule.CategoryID) && empty(rule.MerchantTypeID)
+		},
+	}
+	for _, scope := range scopes {
+		for i := range rules {
+			if scope(&rules[i]) {
+				return &rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// ruleRate returns the percent and fixed fee of a rule for the sales volume of a merchant: the
+// tier with the highest reached minimum volume, or the base rate of the rule.
+func ruleRate(rule *models.CommissionRuleModel, volume float64) (float64, float64) {
+	tiers := append([]models.CommissionTier{}, rule.Tiers...)
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MinVolume > tiers[j].MinVolume
+	})
+	for _, v := range tiers {
+		if volume >= v.MinVolume {
+			return v.Percent, v.FixedFee
+		}
+	}
+	return rule.Percent, rule.FixedFee
+}
@@ -0,0 +1,244 @@
+package marketplace
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// MerchantBalance summarizes the balance ledger of a merchant.
+type MerchantBalance struct {
+	MerchantID string  `json:"merchant_id"`
+	Earned     float64 `json:"earned"`     // sales less commission and refunds
+	Held       float64 `json:"held"`       // part of earned still in the hold period
+	Available  float64 `json:"available"`  // ready to be paid out
+	Withdrawn  float64 `json:"withdrawn"`  // completed payouts
+	Processing float64 `json:"processing"` // payouts not completed yet
+}
+
+// StatementEntry is a ledger entry of a statement with the running balance after it.
+type StatementEntry struct {
+	models.MerchantLedgerEntryModel
+	Balance float64 `json:"balance"`
+}
+
+// MerchantStatement is the statement of a merchant over a period.
+type MerchantStatement struct {
+	MerchantID     string             `json:"merchant_id"`
+	MerchantName   string             `json:"merchant_name"`
+	StartDate      time.Time          `json:"start_date"`
+	EndDate        time.Time          `json:"end_date"`
+	OpeningBalance float64            `json:"opening_balance"`
+	Entries        []StatementEntry   `json:"entries"`
+	Totals         map[string]float64 `json:"totals"` // per entry type
+	ClosingBalance float64            `json:"closing_balance"`
+	Balance        MerchantBalance    `json:"balance"` // the balance at the end date
+}
+
+// addEntry writes an entry to the balance ledger of a merchant; amount is positive for money owed
+// to the merchant and negative otherwise.
+func (s *MarketplaceService) addEntry(tx *gorm.DB, merchantID, companyID *string, date time.Time, entryType string, amount float64, availableAt time.Time, refID *string, refType, description string, userID *string) error {
+	return tx.Create(&models.MerchantLedgerEntryModel{
+		MerchantID:  merchantID,
+		CompanyID:   companyID,
+		Date:        date,
+		Type:        entryType,
+		Amount:      amount,
+		AvailableAt: availableAt,
+		RefID:       refID,
+		RefType:     refType,
+		Description: description,
+		UserID:      userID,
+	}).Error
+}
+
+// CreateAdjustment books a manual correction to the balance of a merchant, available right away.
+func (s *MarketplaceService) CreateAdjustment(merchantID string, amount float64, description string, userID string) (*models.MerchantLedgerEntryModel, error) {
+	if amount == 0 {
+		return nil, fmt.Errorf("amount is required")
+	}
+	var merchant models.MerchantModel
+	if err := s.db.Select("id", "company_id").Where("id = ?", merchantID).First(&merchant).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	entry := models.MerchantLedgerEntryModel{
+		MerchantID:  &merchant.ID,
+		CompanyID:   merchant.CompanyID,
+		Date:        now,
+		Type:        models.MerchantLedgerAdjustment,
+		Amount:      amount,
+		AvailableAt: now,
+		Description: description,
+		UserID:      &userID,
+	}
+	if err := s.db.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// GetMerchantBalance summarizes the balance of a merchant at the given time.
+func (s *MarketplaceService) GetMerchantBalance(merchantID string, now time.Time) (*MerchantBalance, error) {
+	balance := MerchantBalance{MerchantID: merchantID}
+	payoutTypes := []string{models.MerchantLedgerPayout, models.MerchantLedgerPayoutReversal}
+	if err := s.db.Model(&models.MerchantLedgerEntryModel{}).Select("COALESCE(SUM(amount), 0)").
+		Where("merchant_id = ? AND type NOT IN ? AND date <= ?", merchantID, payoutTypes, now).
+		Scan(&balance.Earned).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.MerchantLedgerEntryModel{}).Select("COALESCE(SUM(amount), 0)").
+		Where("merchant_id = ? AND type NOT IN ? AND date <= ? AND available_at > ?", merchantID, payoutTypes, now, now).
+		Scan(&balance.Held).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.MerchantLedgerEntryModel{}).Select("COALESCE(SUM(amount), 0)").
+		Where("merchant_id = ? AND available_at <= ?", merchantID, now).
+		Scan(&balance.Available).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.MerchantPayoutModel{}).Select("COALESCE(SUM(amount), 0)").
+		Where("merchant_id = ? AND status = ?", merchantID, models.MerchantPayoutCompleted).
+		Scan(&balance.Withdrawn).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.MerchantPayoutModel{}).Select("COALESCE(SUM(amount), 0)").
+		Where("merchant_id = ? AND status IN ?", merchantID, []string{models.MerchantPayoutPending, models.MerchantPayoutProcessing}).
+		Scan(&balance.Processing).Error; err != nil {
+		return nil, err
+	}
+	return &balance, nil
+}
+
+// GetLedger retrieves a paginated list of balance ledger entries.
+//
+// The list can be filtered with the merchant_id, type, start_date and end_date query parameters
+// and is scoped to the merchant in the ID-Merchant header or the company in the ID-Company header.
+func (s *MarketplaceService) GetLedger(request http.Request) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Merchant", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Model(&models.MerchantLedgerEntryModel{})
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.Header.Get("ID-Merchant") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.Header.Get("ID-Merchant"))
+	}
+	if request.URL.Query().Get("merchant_id") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.URL.Query().Get("merchant_id"))
+	}
+	if request.URL.Query().Get("type") != "" {
+		stmt = stmt.Where("type = ?", request.URL.Query().Get("type"))
+	}
+	if request.URL.Query().Get("start_date") != "" {
+		stmt = stmt.Where("date >= ?", request.URL.Query().Get("start_date"))
+	}
+	if request.URL.Query().Get("end_date") != "" {
+		stmt = stmt.Where("date <= ?", request.URL.Query().Get("end_date"))
+	}
+	stmt = stmt.Order("date desc, created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.MerchantLedgerEntryModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetStatement builds the statement of a merchant between two dates: the opening balance, every
+// entry with the running balance, the totals per entry type and the closing balance.
+func (s *MarketplaceService) GetStatement(merchantID string, startDate, endDate time.Time) (*MerchantStatement, error) {
+	var merchant models.MerchantModel
+	if err := s.db.Select("id", "name").Where("id = ?", merchantID).First(&merchant).Error; err != nil {
+		return nil, err
+	}
+	statement := MerchantStatement{
+		MerchantID:   merchant.ID,
+		MerchantName: merchant.Name,
+		StartDate:    startDate,
+		EndDate:      endDate,
+		Entries:      []StatementEntry{},
+		Totals:       map[string]float64{},
+	}
+	if err := s.db.Model(&models.MerchantLedgerEntryModel{}).Select("COALESCE(SUM(amount), 0)").
+		Where("merchant_id = ? AND date < ?", merchantID, startDate).
+		Scan(&statement.OpeningBalance).Error; err != nil {
+		return nil, err
+	}
+	var entries []models.MerchantLedgerEntryModel
+	if err := s.db.Where("merchant_id = ? AND date >= ? AND date <= ?", merchantID, startDate, endDate).
+		Order("date asc, created_at asc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	running := statement.OpeningBalance
+	for _, v := range entries {
+		running += v.Amount
+		statement.Entries = append(statement.Entries, StatementEntry{MerchantLedgerEntryModel: v, Balance: running})
+		statement.Totals[v.Type] += v.Amount
+	}
+	statement.ClosingBalance = running
+	balance, err := s.GetMerchantBalance(merchantID, endDate)
+	if err != nil {
+		return nil, err
+	}
+	statement.Balance = *balance
+	return &statement, nil
+}
+
+// DownloadStatement renders the statement of a merchant between two dates as CSV.
+func (s *MarketplaceService) DownloadStatement(merchantID string, startDate, endDate time.Time) ([]byte, error) {
+	statement, err := s.GetStatement(merchantID, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	amount := func(v float64) string {
+		return fmt.Sprintf("%.2f", v)
+	}
+	rows := [][]string{
+		{"Merchant", statement.MerchantName},
+		{"Period", statement.StartDate.Format("2006-01-02"), statement.EndDate.Format("2006-01-02")},
+		{},
+		{"Date", "Type", "Description", "Available At", "Amount", "Balance"},
+		{statement.StartDate.Format("2006-01-02"), "", "Opening balance", "", "", amount(statement.OpeningBalance)},
+	}
+	for _, v := range statement.Entries {
+		rows = append(rows, []string{
+			v.Date.Format("2006-01-02 15:04"),
+			v.Type,
+			v.Description,
+			v.AvailableAt.Format("2006-01-02"),
+			amount(v.Amount),
+			amount(v.Balance),
+		})
+	}
+	rows = append(rows, []string{statement.EndDate.Format("2006-01-02"), "", "Closing balance", "", "", amount(statement.ClosingBalance)}, []string{})
+	for _, t := range []string{
+		models.MerchantLedgerSale,
+		models.MerchantLedgerCommission,
+		models.MerchantLedgerRefund,
+		models.MerchantLedgerCommissionReversal,
+		models.MerchantLedgerPayout,
+		models.MerchantLedgerPayoutReversal,
+		models.MerchantLedgerAdjustment,
+	} {
+		if v, ok := statement.Totals[t]; ok {
+			rows = append(rows, []string{"Total " + t, amount(v)})
+		}
+	}
+	rows = append(rows,
+		[]string{"Held", amount(statement.Balance.Held)},
+		[]string{"Available", amount(statement.Balance.Available)},
+	)
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,424 @@
+package marketplace
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PayoutBatchRequest selects the merchants of a payout batch.
+type PayoutBatchRequest struct {
+	CompanyID        string    `json:"company_id"`
+	Provider         string    `json:"provider"`
+	Date             time.Time `json:"date"`
+	MinAmount        float64   `json:"min_amount"`             // smaller balances wait for the next batch
+	MerchantIDs      []string  `json:"merchant_ids,omitempty"` // empty for every merchant of the company
+	CashAccountID    *string   `json:"cash_account_id,omitempty"`
+	PayableAccountID *string   `json:"payable_account_id,omitempty"`
+	Notes            string    `json:"notes"`
+}
+
+// GeneratePayoutBatch creates a draft batch paying out the available balance of the merchants.
+//
+// The balance of every payout is reserved with a PAYOUT ledger entry right away, so it cannot be
+// paid out twice; merchants without bank details or with less than the minimum amount are
+// skipped. The batch is sent to the provider by ProcessPayoutBatch.
+func (s *MarketplaceService) GeneratePayoutBatch(req PayoutBatchRequest, userID string) (*models.MerchantPayoutBatchModel, error) {
+	if _, ok := s.disbursementProviders[req.Provider]; !ok {
+		return nil, fmt.Errorf("disbursement provider %s not found", req.Provider)
+	}
+	if req.Date.IsZero() {
+		req.Date = time.Now()
+	}
+	batch := models.MerchantPayoutBatchModel{
+		BaseModel:        shared.BaseModel{ID: utils.Uuid()},
+		Code:             fmt.Sprintf("PAYOUT-%s", utils.RandomStringNumber(8, false)),
+		CompanyID:        &req.CompanyID,
+		Date:             req.Date,
+		Provider:         req.Provider,
+		Status:           models.MerchantPayoutBatchDraft,
+		CashAccountID:    req.CashAccountID,
+		PayableAccountID: req.PayableAccountID,
+		Notes:            req.Notes,
+		UserID:           &userID,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var merchants []models.MerchantModel
+		stmt := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("company_id = ?", req.CompanyID)
+		if len(req.MerchantIDs) > 0 {
+			stmt = stmt.Where("id IN ?", req.MerchantIDs)
+		}
+		if err := stmt.Order("name asc").Find(&merchants).Error; err != nil {
+			return err
+		}
+		for _, merchant := range merchants {
+			if merchant.PayoutBankCode == "" || merchant.PayoutAccountNumber == "" {
+				continue
+			}
+			var available float64
+			if err := tx.Model(&models.MerchantLedgerEntryModel{}).Select("COALESCE(SUM(amount), 0)").
+				Where("merchant_id = ? AND available_at <= ?", merchant.ID, req.Date).
+				Scan(&available).Error; err != nil {
+				return err
+			}
+			amount := math.Floor(available*100+amountEpsilon) / 100
+			if amount <= 0 || amount < req.MinAmount {
+				continue
+			}
+			holder := merchant.PayoutAccountName
+			if holder == "" {
+				holder = merchant.Name
+			}
+			batch.Payouts = append(batch.Payouts, models.MerchantPayoutModel{
+				BaseModel:         shared.BaseModel{ID: utils.Uuid()},
+				BatchID:           &batch.ID,
+				MerchantID:        &merchant.ID,
+				CompanyID:         &req.CompanyID,
+				Amount:            amount,
+				BankCode:          merchant.PayoutBankCode,
+				AccountNumber:     merchant.PayoutAccountNumber,
+				AccountHolderName: holder,
+				Status:            models.MerchantPayoutPending,
+			})
+			batch.TotalAmount += amount
+		}
+		if len(batch.Payouts) == 0 {
+			return errors.New("no merchant balance to pay out")
+		}
+		batch.PayoutCount = len(batch.Payouts)
+		if err := tx.Create(&batch).Error; err != nil {
+			return err
+		}
+		for _, payout := range batch.Payouts {
+			if err := s.addEntry(tx, payout.MerchantID, payout.CompanyID, req.Date, models.MerchantLedgerPayout, -payout.Amount, req.Date, &payout.ID, "merchant_payout",
+				fmt.Sprintf("Pencairan %s", batch.Code), &userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// ProcessPayoutBatch sends the pending payouts of a batch to the disbursement provider.
+//
+// A payout the provider could not be reached for stays pending with the error as failure reason;
+// processing the batch again retries it with the same reference, so the provider does not pay it
+// twice.
+func (s *MarketplaceService) ProcessPayoutBatch(id string) (*models.MerchantPayoutBatchModel, error) {
+	batch, err := s.GetPayoutBatchByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if batch.Status != models.MerchantPayoutBatchDraft && batch.Status != models.MerchantPayoutBatchProcessing {
+		return nil, fmt.Errorf("payout batch %s is %s", batch.Code, batch.Status)
+	}
+	provider, ok := s.disbursementProviders[batch.Provider]
+	if !ok {
+		return nil, fmt.Errorf("disbursement provider %s not found", batch.Provider)
+	}
+	if batch.Status == models.MerchantPayoutBatchDraft {
+		if err := s.db.Model(&models.MerchantPayoutBatchModel{}).Where("id = ?", batch.ID).
+			Update("status", models.MerchantPayoutBatchProcessing).Error; err != nil {
+			return nil, err
+		}
+	}
+	for _, payout := range batch.Payouts {
+		if payout.Status != models.MerchantPayoutPending || payout.ProviderRef != "" {
+			continue
+		}
+		resp, err := provider.Disburse(payment_provider.DisbursementRequest{
+			ReferenceID:       payout.ID,
+			BankCode:          payout.BankCode,
+			AccountNumber:     payout.AccountNumber,
+			AccountHolderName: payout.AccountHolderName,
+			Amount:            payout.Amount,
+			Description:       fmt.Sprintf("Pencairan %s", batch.Code),
+		})
+		if err != nil {
+			log.Println("ERROR DISBURSE", payout.ID, err)
+			s.db.Model(&models.MerchantPayoutModel{}).Where("id = ?", payout.ID).Update("failure_reason", err.Error())
+			continue
+		}
+		if _, err := s.applyDisbursement(payout.ID, resp); err != nil {
+			log.Println("ERROR DISBURSE", payout.ID, err)
+		}
+	}
+	return s.GetPayoutBatchByID(id)
+}
+
+// HandleDisbursementWebhook verifies the disbursement callback of a provider and applies it to
+// its payout. Callbacks of payouts already completed or failed are ignored.
+func (s *MarketplaceService) HandleDisbursementWebhook(providerName string, req payment_provider.WebhookRequest) (*models.MerchantPayoutModel, error) {
+	provider, ok := s.disbursementProviders[providerName]
+	if !ok {
+		return nil, fmt.Errorf("disbursement provider %s not found", providerName)
+	}
+	resp, err := provider.ParseDisbursementWebhook(req)
+	if err != nil {
+		return nil, err
+	}
+	var payout models.MerchantPayoutModel
+	stmt := s.db.Where("id = ?", resp.ReferenceID)
+	if resp.ProviderRef != "" {
+		stmt = stmt.Or("provider_ref = ?", resp.ProviderRef)
+	}
+	if err := stmt.First(&payout).Error; err != nil {
+		return nil, err
+	}
+	return s.applyDisbursement(payout.ID, resp)
+}
+
+// RefreshPayout asks the provider for the status of a payout still in process.
+func (s *MarketplaceService) RefreshPayout(id string) (*models.MerchantPayoutModel, error) {
+	var payout models.MerchantPayoutModel
+	if err := s.db.Where("id = ?", id).First(&payout).Error; err != nil {
+		return nil, err
+	}
+	if payout.ProviderRef == "" {
+		return nil, errors.New("payout has not been sent to the provider")
+	}
+	var batch models.MerchantPayoutBatchModel
+	if err := s.db.Select("id", "provider").Where("id = ?", payout.BatchID).First(&batch).Error; err != nil {
+		return nil, err
+	}
+	provider, ok := s.disbursementProviders[batch.Provider]
+	if !ok {
+		return nil, fmt.Errorf("disbursement provider %s not found", batch.Provider)
+	}
+	resp, err := provider.GetDisbursement(payout.ProviderRef)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyDisbursement(payout.ID, resp)
+}
+
+// CancelPayoutBatch cancels a draft batch and gives the reserved balance back to the merchants.
+func (s *MarketplaceService) CancelPayoutBatch(id string, userID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var batch models.MerchantPayoutBatchModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Payouts").Where("id = ?", id).First(&batch).Error; err != nil {
+			return err
+		}
+		if batch.Status != models.MerchantPayoutBatchDraft {
+			return fmt.Errorf("payout batch %s is %s, only draft batches can be canceled", batch.Code, batch.Status)
+		}
+		now := time.Now()
+		for _, payout := range batch.Payouts {
+			if payout.Status != models.MerchantPayoutPending {
+				continue
+			}
+			if err := tx.Model(&models.MerchantPayoutModel{}).Where("id = ?", payout.ID).
+				Update("status", models.MerchantPayoutCanceled).Error; err != nil {
+				return err
+			}
+			if err := s.addEntry(tx, payout.MerchantID, payout.CompanyID, now, models.MerchantLedgerPayoutReversal, payout.Amount, now, &payout.ID, "merchant_payout",
+				fmt.Sprintf("Pembatalan pencairan %s", batch.Code), &userID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&batch).Update("status", models.MerchantPayoutBatchCanceled).Error
+	})
+}
+
+// GetPayoutBatchByID retrieves a payout batch with its payouts.
+func (s *MarketplaceService) GetPayoutBatchByID(id string) (*models.MerchantPayoutBatchModel, error) {
+	var batch models.MerchantPayoutBatchModel
+	err := s.db.Preload("Payouts.Merchant", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Preload("CashAccount").Preload("PayableAccount").Where("id = ?", id).First(&batch).Error
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// GetPayoutBatches retrieves a paginated list of payout batches.
+//
+// The list can be filtered with the status query parameter and is scoped to the company in the
+// ID-Company header.
+func (s *MarketplaceService) GetPayoutBatches(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Model(&models.MerchantPayoutBatchModel{})
+	if search != "" {
+		stmt = stmt.Where("code ILIKE ? OR notes ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.MerchantPayoutBatchModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetPayouts retrieves a paginated list of payouts, filtered with the batch_id, merchant_id and
+// status query parameters or the merchant in the ID-Merchant header.
+func (s *MarketplaceService) GetPayouts(request http.Request) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Merchant", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Model(&models.MerchantPayoutModel{})
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.Header.Get("ID-Merchant") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.Header.Get("ID-Merchant"))
+	}
+	for _, key := range []string{"batch_id", "merchant_id", "status"} {
+		if request.URL.Query().Get(key) != "" {
+			stmt = stmt.Where(key+" = ?", request.URL.Query().Get(key))
+		}
+	}
+	stmt = stmt.Order("created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.MerchantPayoutModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// applyDisbursement applies the status reported by the provider to a payout: a completed payout
+// is journaled, a failed one gives the reserved balance back to the merchant.
+func (s *MarketplaceService) applyDisbursement(payoutID string, resp *payment_provider.DisbursementResponse) (*models.MerchantPayoutModel, error) {
+	var payout models.MerchantPayoutModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", payoutID).First(&payout).Error; err != nil {
+			return err
+		}
+		if payout.Status == models.MerchantPayoutCompleted || payout.Status == models.MerchantPayoutFailed || payout.Status == models.MerchantPayoutCanceled {
+			return nil
+		}
+		var batch models.MerchantPayoutBatchModel
+		if err := tx.Where("id = ?", payout.BatchID).First(&batch).Error; err != nil {
+			return err
+		}
+		if resp.ProviderRef != "" {
+			payout.ProviderRef = resp.ProviderRef
+		}
+		now := time.Now()
+		switch resp.Status {
+		case payment_provider.DisbursementCompleted:
+			payout.Status = models.MerchantPayoutCompleted
+			payout.DisbursedAt = &now
+			payout.FailureReason = ""
+			if err := s.postPayoutJournal(tx, &batch, &payout); err != nil {
+				return err
+			}
+		case payment_provider.DisbursementFailed:
+			payout.Status = models.MerchantPayoutFailed
+			payout.FailureReason = resp.FailureReason
+			if err := s.addEntry(tx, payout.MerchantID, payout.CompanyID, now, models.MerchantLedgerPayoutReversal, payout.Amount, now, &payout.ID, "merchant_payout",
+				fmt.Sprintf("Pencairan %s gagal: %s", batch.Code, resp.FailureReason), nil); err != nil {
+				return err
+			}
+		default:
+			payout.Status = models.MerchantPayoutProcessing
+			payout.FailureReason = ""
+		}
+		if err := tx.Model(&payout).Updates(map[string]any{
+			"status":         payout.Status,
+			"provider_ref":   payout.ProviderRef,
+			"failure_reason": payout.FailureReason,
+			"disbursed_at":   payout.DisbursedAt,
+		}).Error; err != nil {
+			return err
+		}
+		return s.updateBatchProgress(tx, &batch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &payout, nil
+}
+
+// updateBatchProgress recounts the payouts of a batch and completes it once none is left in
+// process.
+func (s *MarketplaceService) updateBatchProgress(tx *gorm.DB, batch *models.MerchantPayoutBatchModel) error {
+	var rows []struct {
+		Status string
+		Total  int
+	}
+	if err := tx.Model(&models.MerchantPayoutModel{}).Select("status, COUNT(*) AS total").
+		Where("batch_id = ?", batch.ID).Group("status").Scan(&rows).Error; err != nil {
+		return err
+	}
+	counts := map[string]int{}
+	for _, v := range rows {
+		counts[v.Status] = v.Total
+	}
+	status := batch.Status
+	if counts[models.MerchantPayoutPending] == 0 && counts[models.MerchantPayoutProcessing] == 0 {
+		status = models.MerchantPayoutBatchCompleted
+	}
+	return tx.Model(&models.MerchantPayoutBatchModel{}).Where("id = ?", batch.ID).Updates(map[string]any{
+		"completed_count": counts[models.MerchantPayoutCompleted],
+		"failed_count":    counts[models.MerchantPayoutFailed],
+		"status":          status,
+	}).Error
+}
+
+// postPayoutJournal journals a completed payout from the merchant payable account to the cash
+// account of the batch; batches without both accounts are not journaled.
+func (s *MarketplaceService) postPayoutJournal(tx *gorm.DB, batch *models.MerchantPayoutBatchModel, payout *models.MerchantPayoutModel) error {
+	if batch.CashAccountID == nil || batch.PayableAccountID == nil {
+		return nil
+	}
+	date := time.Now()
+	if payout.DisbursedAt != nil {
+		date = *payout.DisbursedAt
+	}
+	description := fmt.Sprintf("Pencairan saldo merchant %s", batch.Code)
+	debitID := utils.Uuid()
+	creditID := utils.Uuid()
+	err := tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: debitID},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   batch.PayableAccountID,
+		Description:                 description,
+		TransactionRefID:            &creditID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &payout.ID,
+		TransactionSecondaryRefType: "merchant_payout",
+		CompanyID:                   batch.CompanyID,
+		Debit:                       payout.Amount,
+		Amount:                      payout.Amount,
+		UserID:                      batch.UserID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: creditID},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   batch.CashAccountID,
+		Description:                 description,
+		TransactionRefID:            &debitID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &payout.ID,
+		TransactionSecondaryRefType: "merchant_payout",
+		CompanyID:                   batch.CompanyID,
+		Credit:                      payout.Amount,
+		Amount:                      payout.Amount,
+		UserID:                      batch.UserID,
+	}).Error
+}
@@ -0,0 +1,132 @@
+package marketplace
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// amountEpsilon absorbs rounding differences between ledger amounts.
+const amountEpsilon = 0.005
+
+// MarketplaceService computes the platform commission of merchant orders, keeps the balance
+// ledger of the merchants and pays their balance out in batches.
+type MarketplaceService struct {
+	ctx                   *context.ERPContext
+	db                    *gorm.DB
+	disbursementProviders map[string]payment_provider.DisbursementProvider
+}
+
+// NewMarketplaceService creates a new instance of MarketplaceService.
+func NewMarketplaceService(db *gorm.DB, ctx *context.ERPContext) *MarketplaceService {
+	return &MarketplaceService{
+		ctx:                   ctx,
+		db:                    db,
+		disbursementProviders: make(map[string]payment_provider.DisbursementProvider, 0),
+	}
+}
+
+// AddDisbursementProvider registers a provider paying the merchant payouts out.
+func (s *MarketplaceService) AddDisbursementProvider(providerName string, provider payment_provider.DisbursementProvider) {
+	s.disbursementProviders[providerName] = provider
+}
+
+// Migrate migrates the commission, merchant ledger and payout models.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.CommissionRuleModel{},
+		&models.MerchantCommissionModel{},
+		&models.MerchantCommissionLineModel{},
+		&models.MerchantLedgerEntryModel{},
+		&models.MerchantPayoutBatchModel{},
+		&models.MerchantPayoutModel{},
+	)
+}
+
+// CreateRule creates a commission rule.
+func (s *MarketplaceService) CreateRule(data *models.CommissionRuleModel) error {
+	if err := checkRule(data); err != nil {
+		return err
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdateRule updates a commission rule. The commission of orders already completed is not
+// recalculated.
+func (s *MarketplaceService) UpdateRule(id string, data *models.CommissionRuleModel) error {
+	if err := checkRule(data); err != nil {
+		return err
+	}
+	data.ID = id
+	return s.db.Omit("created_at").Save(data).Error
+}
+
+// DeleteRule deletes a commission rule.
+func (s *MarketplaceService) DeleteRule(id string) error {
+	return s.db.Where("id = ?", id).Delete(&models.CommissionRuleModel{}).Error
+}
+
+// GetRuleByID retrieves a commission rule.
+func (s *MarketplaceService) GetRuleByID(id string) (*models.CommissionRuleModel, error) {
+	var rule models.CommissionRuleModel
+	err := s.db.Preload("MerchantType").Preload("Category").Preload("Product").Where("id = ?", id).First(&rule).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// GetRules retrieves a paginated list of commission rules.
+//
+// The list is scoped to the company in the ID-Company header; rules without a company apply to
+// every company and are listed as well.
+func (s *MarketplaceService) GetRules(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("MerchantType").Preload("Category").Preload("Product", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "sku")
+	}).Model(&models.CommissionRuleModel{})
+	if search != "" {
+		stmt = stmt.Where("name ILIKE ? OR description ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ? OR company_id IS NULL", request.Header.Get("ID-Company"))
+	}
+	stmt = stmt.Order("priority desc, created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.CommissionRuleModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+func checkRule(data *models.CommissionRuleModel) error {
+	if data.Name == "" {
+		return errors.New("name is required")
+	}
+	scopes := 0
+	for _, v := range []*string{data.MerchantTypeID, data.CategoryID, data.ProductID} {
+		if v != nil && *v != "" {
+			scopes++
+		}
+	}
+	if scopes > 1 {
+		return errors.New("a commission rule applies to one merchant type, category or product")
+	}
+	if data.Percent < 0 || data.Percent > 100 || data.FixedFee < 0 {
+		return errors.New("invalid commission percent or fixed fee")
+	}
+	for _, v := range data.Tiers {
+		if v.MinVolume < 0 || v.Percent < 0 || v.Percent > 100 || v.FixedFee < 0 {
+			return errors.New("invalid commission tier")
+		}
+	}
+	if data.StartDate != nil && data.EndDate != nil && data.EndDate.Before(*data.StartDate) {
+		return errors.New("end date is before start date")
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package merchant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/thirdparty/websocket"
+	"gorm.io/gorm"
+)
+
+// defaultPrepMinutes is the preparation target of items whose product and station have none.
+const defaultPrepMinutes = 15
+
+// Kitchen display events pushed over the websocket.
+const (
+	KitchenEventNewTickets    = "new_tickets"
+	KitchenEventCourseFired   = "course_fired"
+	KitchenEventStatusChanged = "status_changed"
+	KitchenEventSLAAlert      = "sla_alert"
+	KitchenEventTableChanged  = "table_changed"
+)
+
+// KitchenDisplayEvent is a message of the kitchen display feed.
+type KitchenDisplayEvent struct {
+	Event      string                        `json:"event"`
+	MerchantID string                        `json:"merchant_id"`
+	StationID  string                        `json:"station_id"`
+	Tickets    []models.MerchantStationOrder `json:"tickets"`
+	Timestamp  time.Time                     `json:"timestamp"`
+}
+
+// KitchenDisplayChannel returns the websocket channel of the kitchen display of a station, or
+// of all stations of the merchant when stationID is empty.
+func KitchenDisplayChannel(merchantID string, stationID string) string {
+	if stationID == "" {
+		return fmt.Sprintf("kds:%s", merchantID)
+	}
+	return fmt.Sprintf("kds:%s:%s", merchantID, stationID)
+}
+
+// SetWebsocketService sets the websocket service used to push the kitchen display feed.
+// Without it, kitchen displays have to poll GetKitchenDisplay.
+func (s *MerchantService) SetWebsocketService(websocketService *websocket.WebsocketService) {
+	s.websocketService = websocketService
+}
+
+// GetKitchenDisplay retrieves the tickets a kitchen display shows: fired items that are not
+// served yet, the ones due first on top. When stationID is empty the tickets of all stations of
+// the merchant are returned.
+func (s *MerchantService) GetKitchenDisplay(merchantID string, stationID string) ([]models.MerchantStationOrder, error) {
+	var tickets []models.MerchantStationOrder
+	stmt := s.db.Preload("MerchantStation").Preload("MerchantDesk").Preload("Order", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "code", "merchant_desk_id", "fired_course")
+	}).
+		Joins("JOIN merchant_stations ON merchant_stations.id = merchant_station_orders.merchant_station_id").
+		Where("merchant_stations.merchant_id = ?", merchantID).
+		Where("merchant_station_orders.status IN (?)", []string{models.StationOrderPending, models.StationOrderPreparing, models.StationOrderReady})
+	if stationID != "" {
+		stmt = stmt.Where("merchant_station_orders.merchant_station_id = ?", stationID)
+	}
+	err := stmt.Order("merchant_station_orders.due_at asc, merchant_station_orders.created_at asc").Find(&tickets).Error
+	return tickets, err
+}
+
+// FireCourse sends the held items of an order up to the given course to the kitchen.
+//
+// Items of the first course are fired when the order is distributed; the next course is fired
+// automatically when every item of the fired courses is served. FireCourse fires a course
+// earlier on request of the waiter.
+func (s *MerchantService) FireCourse(merchantID string, orderID string, course int) ([]models.MerchantStationOrder, error) {
+	var order models.MerchantOrder
+	if err := s.db.Select("id", "fired_course").Where("merchant_id = ? AND id = ?", merchantID, orderID).First(&order).Error; err != nil {
+		return nil, err
+	}
+	var held []models.MerchantStationOrder
+	if err := s.db.Where("order_id = ? AND status = ? AND course <= ?", orderID, models.StationOrderHold, course).Find(&held).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for i := range held {
+			s.fireTicket(merchantID, &held[i], now)
+			if err := tx.Model(&held[i]).Updates(map[string]any{
+				"status":   held[i].Status,
+				"fired_at": held[i].FiredAt,
+				"due_at":   held[i].DueAt,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		if course > order.FiredCourse {
+			return tx.Model(&models.MerchantOrder{}).Where("id = ?", orderID).Update("fired_course", course).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishKitchenEvent(merchantID, KitchenEventCourseFired, held)
+	return held, nil
+}
+
+// FireNextCourse fires the lowest course of an order that is still held. It returns no tickets
+// when nothing is held.
+func (s *MerchantService) FireNextCourse(merchantID string, orderID string) ([]models.MerchantStationOrder, error) {
+	var next models.MerchantStationOrder
+	err := s.db.Select("course").Where("order_id = ? AND status = ?", orderID, models.StationOrderHold).Order("course asc").First(&next).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return []models.MerchantStationOrder{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.FireCourse(merchantID, orderID, next.Course)
+}
+
+// CheckStationSLA flags the tickets of a merchant that passed their preparation target and
+// pushes an SLA alert for them. Each ticket is alerted once; the method is meant to be called
+// periodically.
+func (s *MerchantService) CheckStationSLA(merchantID string, now time.Time) ([]models.MerchantStationOrder, error) {
+	var late []models.MerchantStationOrder
+	err := s.db.Preload("MerchantDesk").
+		Joins("JOIN merchant_stations ON merchant_stations.id = merchant_station_orders.merchant_station_id").
+		Where("merchant_stations.merchant_id = ?", merchantID).
+		Where("merchant_station_orders.status IN (?)", []string{models.StationOrderPending, models.StationOrderPreparing}).
+		Where("merchant_station_orders.due_at <= ? AND merchant_station_orders.sla_alerted_at IS NULL", now).
+		Find(&late).Error
+	if err != nil || len(late) == 0 {
+		return late, err
+	}
+	ids := make([]string, len(late))
+	for i := range late {
+		ids[i] = late[i].ID
+		late[i].SLAAlertedAt = &now
+	}
+	if err := s.db.Model(&models.MerchantStationOrder{}).Where("id IN (?)", ids).Update("sla_alerted_at", now).Error; err != nil {
+		return nil, err
+	}
+	s.publishKitchenEvent(merchantID, KitchenEventSLAAlert, late)
+	return late, nil
+}
+
+// fireTicket marks a ticket as sent to the kitchen and sets its preparation target.
+func (s *MerchantService) fireTicket(merchantID string, ticket *models.MerchantStationOrder, now time.Time) {
+	var item models.MerchantOrderItem
+	json.Unmarshal(ticket.Item, &item)
+	due := now.Add(time.Duration(s.prepMinutes(merchantID, item.ProductID, ticket.MerchantStationID)) * time.Minute)
+	ticket.Status = models.StationOrderPending
+	ticket.FiredAt = &now
+	ticket.DueAt = &due
+}
+
+// prepMinutes returns the preparation target of a product: the one of the product in the
+// merchant, else the SLA of its station.
+func (s *MerchantService) prepMinutes(merchantID string, productID string, stationID *string) int {
+	var productMerchant models.ProductMerchant
+	if err := s.db.Select("prep_minutes").Where("product_model_id = ? AND merchant_model_id = ?", productID, merchantID).First(&productMerchant).Error; err == nil && productMerchant.PrepMinutes > 0 {
+		return productMerchant.PrepMinutes
+	}
+	if stationID != nil {
+		var station models.MerchantStation
+		if err := s.db.Select("sla_minutes").Where("id = ?", *stationID).First(&station).Error; err == nil && station.SLAMinutes > 0 {
+			return station.SLAMinutes
+		}
+	}
+	return defaultPrepMinutes
+}
+
+// autoFireNextCourse fires the next held course of an order once every fired item is served.
+func (s *MerchantService) autoFireNextCourse(merchantID string, orderID string) {
+	var open int64
+	s.db.Model(&models.MerchantStationOrder{}).
+		Where("order_id = ? AND status NOT IN (?)", orderID, []string{models.StationOrderHold, models.StationOrderServed, models.StationOrderCancelled}).
+		Count(&open)
+	if open > 0 {
+		return
+	}
+	if _, err := s.FireNextCourse(merchantID, orderID); err != nil {
+		log.Println("ERROR FIRE COURSE", err)
+	}
+}
+
+// publishOrderTickets pushes the unserved tickets of an order to the kitchen displays.
+func (s *MerchantService) publishOrderTickets(merchantID string, orderID string, event string) {
+	if s.websocketService == nil {
+		return
+	}
+	var tickets []models.MerchantStationOrder
+	s.db.Preload("MerchantDesk").Where("order_id = ? AND status NOT IN (?)", orderID, []string{models.StationOrderServed, models.StationOrderCancelled}).Find(&tickets)
+	s.publishKitchenEvent(merchantID, event, tickets)
+}
+
+// SubscribeKitchenDisplay subscribes a websocket request to the kitchen display of a station, or
+// of all stations of the merchant when stationID is empty. The user must own the merchant or be
+// one of its users, and the station must belong to the merchant.
+func (s *MerchantService) SubscribeKitchenDisplay(w http.ResponseWriter, r *http.Request, merchantID, stationID, userID string) error {
+	if s.websocketService == nil {
+		return errors.New("websocket service is not set")
+	}
+	var count int64
+	if err := s.db.Model(&models.MerchantModel{}).
+		Where("id = ? AND (user_id = ? OR id IN (?))", merchantID, userID,
+			s.db.Model(&models.MerchantUser{}).Select("merchant_model_id").Where("user_model_id = ?", userID)).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("user has no access to the merchant")
+	}
+	if stationID != "" {
+		if err := s.db.Model(&models.MerchantStation{}).Where("id = ? AND merchant_id = ?", stationID, merchantID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.New("station does not belong to the merchant")
+		}
+	}
+	return s.websocketService.Subscribe(w, r, KitchenDisplayChannel(merchantID, stationID))
+}
+
+// publishKitchenEvent pushes tickets to the kitchen display of their stations.
+func (s *MerchantService) publishKitchenEvent(merchantID string, event string, tickets []models.MerchantStationOrder) {
+	if s.websocketService == nil || len(tickets) == 0 {
+		return
+	}
+	byStation := map[string][]models.MerchantStationOrder{}
+	for _, ticket := range tickets {
+		stationID := ""
+		if ticket.MerchantStationID != nil {
+			stationID = *ticket.MerchantStationID
+		}
+		byStation[stationID] = append(byStation[stationID], ticket)
+	}
+	for stationID, stationTickets := range byStation {
+		msg, err := json.Marshal(KitchenDisplayEvent{
+			Event:      event,
+			MerchantID: merchantID,
+			StationID:  stationID,
+			Tickets:    stationTickets,
+			Timestamp:  time.Now(),
+		})
+		if err != nil {
+			log.Println("ERROR KITCHEN DISPLAY", err)
+			continue
+		}
+		if err := s.websocketService.BroadcastChannel(KitchenDisplayChannel(merchantID, stationID), msg); err != nil {
+			log.Println("ERROR KITCHEN DISPLAY", err)
+		}
+	}
+}
+
+// isStationStatus reports whether status is one of the given statuses, ignoring case.
+func isStationStatus(status string, statuses ...string) bool {
+	for _, v := range statuses {
+		if strings.EqualFold(status, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,366 @@
+package merchant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// CreateModifierGroup creates a modifier group with its options for a merchant.
+func (s *MerchantService) CreateModifierGroup(merchantID string, group *models.MerchantModifierGroup) error {
+	group.MerchantID = &merchantID
+	if group.MaxSelect > 0 && group.MinSelect > group.MaxSelect {
+		return errors.New("min select is greater than max select")
+	}
+	return s.db.Create(group).Error
+}
+
+// UpdateModifierGroup updates a modifier group of a merchant. Options are managed with
+// AddModifierOption, UpdateModifierOption and DeleteModifierOption.
+func (s *MerchantService) UpdateModifierGroup(merchantID string, groupID string, group *models.MerchantModifierGroup) error {
+	if group.MaxSelect > 0 && group.MinSelect > group.MaxSelect {
+		return errors.New("min select is greater than max select")
+	}
+	return s.db.Model(&models.MerchantModifierGroup{}).Where("merchant_id = ? AND id = ?", merchantID, groupID).
+		Select("name", "description", "min_select", "max_select", "is_required").
+		Updates(group).Error
+}
+
+// DeleteModifierGroup deletes a modifier group of a merchant and unassigns it from its products.
+func (s *MerchantService) DeleteModifierGroup(merchantID string, groupID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("merchant_id = ? AND group_id = ?", merchantID, groupID).Delete(&models.MerchantProductModifierGroup{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("merchant_id = ? AND id = ?", merchantID, groupID).Delete(&models.MerchantModifierGroup{}).Error
+	})
+}
+
+// GetModifierGroupDetail retrieves a modifier group with its options and assigned products.
+func (s *MerchantService) GetModifierGroupDetail(merchantID string, groupID string) (*models.MerchantModifierGroup, error) {
+	var group models.MerchantModifierGroup
+	err := s.db.Preload("Options", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position asc")
+	}).Where("merchant_id = ? AND id = ?", merchantID, groupID).First(&group).Error
+	if err != nil {
+		return nil, err
+	}
+	s.db.Model(&models.MerchantProductModifierGroup{}).Where("merchant_id = ? AND group_id = ?", merchantID, groupID).Pluck("product_id", &group.ProductIDs)
+	return &group, nil
+}
+
+// GetModifierGroups retrieves a paginated list of the modifier groups of a merchant.
+func (s *MerchantService) GetModifierGroups(request http.Request, merchantID string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Options", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position asc")
+	}).Where("merchant_id = ?", merchantID)
+	if search := request.URL.Query().Get("search"); search != "" {
+		stmt = stmt.Where("name ILIKE ?", "%"+search+"%")
+	}
+	stmt = stmt.Model(&models.MerchantModifierGroup{}).Order("name asc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.MerchantModifierGroup{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// AddModifierOption adds an option to a modifier group of a merchant.
+func (s *MerchantService) AddModifierOption(merchantID string, groupID string, option *models.MerchantModifierOption) error {
+	var group models.MerchantModifierGroup
+	if err := s.db.Select("id").Where("merchant_id = ? AND id = ?", merchantID, groupID).First(&group).Error; err != nil {
+		return err
+	}
+	option.GroupID = group.ID
+	return s.db.Create(option).Error
+}
+
+// UpdateModifierOption updates an option of a modifier group of a merchant.
+func (s *MerchantService) UpdateModifierOption(merchantID string, groupID string, optionID string, option *models.MerchantModifierOption) error {
+	var group models.MerchantModifierGroup
+	if err := s.db.Select("id").Where("merchant_id = ? AND id = ?", merchantID, groupID).First(&group).Error; err != nil {
+		return err
+	}
+	return s.db.Model(&models.MerchantModifierOption{}).Where("group_id = ? AND id = ?", group.ID, optionID).
+		Select("name", "price_delta", "is_default", "is_available", "position").
+		Updates(option).Error
+}
+
+// DeleteModifierOption deletes an option of a modifier group of a merchant.
+func (s *MerchantService) DeleteModifierOption(merchantID string, groupID string, optionID string) error {
+	var group models.MerchantModifierGroup
+	if err := s.db.Select("id").Where("merchant_id = ? AND id = ?", merchantID, groupID).First(&group).Error; err != nil {
+		return err
+	}
+	return s.db.Where("group_id = ? AND id = ?", group.ID, optionID).Delete(&models.MerchantModifierOption{}).Error
+}
+
+// AssignModifierGroup assigns a modifier group to products of a merchant.
+func (s *MerchantService) AssignModifierGroup(merchantID string, groupID string, productIDs []string) error {
+	var group models.MerchantModifierGroup
+	if err := s.db.Select("id").Where("merchant_id = ? AND id = ?", merchantID, groupID).First(&group).Error; err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for i, productID := range productIDs {
+			link := models.MerchantProductModifierGroup{
+				MerchantID: merchantID,
+				ProductID:  productID,
+				GroupID:    groupID,
+				Position:   i,
+			}
+			if err := tx.Where(link).FirstOrCreate(&link).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UnassignModifierGroup removes a modifier group from products of a merchant.
+func (s *MerchantService) UnassignModifierGroup(merchantID string, groupID string, productIDs []string) error {
+	return s.db.Where("merchant_id = ? AND group_id = ? AND product_id IN (?)", merchantID, groupID, productIDs).
+		Delete(&models.MerchantProductModifierGroup{}).Error
+}
+
+// GetProductModifierGroups retrieves the modifier groups of a product in a merchant with their
+// available options.
+func (s *MerchantService) GetProductModifierGroups(merchantID string, productID string) ([]models.MerchantModifierGroup, error) {
+	var groups []models.MerchantModifierGroup
+	err := s.db.Preload("Options", func(db *gorm.DB) *gorm.DB {
+		return db.Where("is_available = ?", true).Order("position asc")
+	}).
+		Joins("JOIN merchant_product_modifier_groups ON merchant_product_modifier_groups.group_id = merchant_modifier_groups.id").
+		Where("merchant_product_modifier_groups.merchant_id = ? AND merchant_product_modifier_groups.product_id = ?", merchantID, productID).
+		Order("merchant_product_modifier_groups.position asc").
+		Find(&groups).Error
+	return groups, err
+}
+
+// ApplyModifiers validates the modifiers selected on an order item against the modifier groups
+// of its product and prices them.
+//
+// Names and price deltas are taken from the modifier options, not from the request. Required
+// groups without a selection get their default options. The item subtotal is recalculated with
+// the modifier total added to the unit price. Items of products without modifier groups are
+// left untouched.
+func (s *MerchantService) ApplyModifiers(merchantID string, item *models.MerchantOrderItem) error {
+	groups, err := s.GetProductModifierGroups(merchantID, item.ProductID)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		if len(item.Modifiers) > 0 {
+			return errors.New("product has no modifiers")
+		}
+		return nil
+	}
+
+	options := map[string]models.MerchantModifierOption{}
+	for _, group := range groups {
+		for _, option := range group.Options {
+			options[option.ID] = option
+		}
+	}
+	selected := map[string][]models.MerchantOrderItemModifier{}
+	for _, modifier := range item.Modifiers {
+		option, ok := options[modifier.OptionID]
+		if !ok {
+			return fmt.Errorf("modifier option %s is not available", modifier.OptionID)
+		}
+		if modifier.Quantity <= 0 {
+			modifier.Quantity = 1
+		}
+		modifier.GroupID = option.GroupID
+		modifier.OptionName = option.Name
+		modifier.PriceDelta = option.PriceDelta
+		selected[option.GroupID] = append(selected[option.GroupID], modifier)
+	}
+
+	modifiers := []models.MerchantOrderItemModifier{}
+	modifierTotal := 0.0
+	for _, group := range groups {
+		chosen := selected[group.ID]
+		if len(chosen) == 0 && (group.IsRequired || group.MinSelect > 0) {
+			for _, option := range group.Options {
+				if option.IsDefault {
+					chosen = append(chosen, models.MerchantOrderItemModifier{
+						OptionID:   option.ID,
+						OptionName: option.Name,
+						PriceDelta: option.PriceDelta,
+						Quantity:   1,
+					})
+				}
+			}
+		}
+		minSelect := group.MinSelect
+		if group.IsRequired && minSelect < 1 {
+			minSelect = 1
+		}
+		if len(chosen) < minSelect {
+			return fmt.Errorf("choose at least %d option(s) of %s", minSelect, group.Name)
+		}
+		if group.MaxSelect > 0 && len(chosen) > group.MaxSelect {
+			return fmt.Errorf("choose at most %d option(s) of %s", group.MaxSelect, group.Name)
+		}
+		for _, modifier := range chosen {
+			modifier.GroupID = group.ID
+			modifier.GroupName = group.Name
+			modifierTotal += modifier.PriceDelta * modifier.Quantity
+			modifiers = append(modifiers, modifier)
+		}
+	}
+	item.Modifiers = modifiers
+	item.ModifierTotal = modifierTotal
+	s.countSubtotal(item)
+	return nil
+}
+
+// TransferTable moves an active order to another table.
+//
+// The target table must not have an active order; use MergeTables to combine orders. The
+// kitchen tickets of the order follow it and the guest of the table moves along. The source
+// table becomes available when it has no other active order.
+func (s *MerchantService) TransferTable(merchantID string, orderID string, targetDeskID string) error {
+	var order models.MerchantOrder
+	if err := s.db.Where("merchant_id = ? AND id = ? AND order_status = ?", merchantID, orderID, "ACTIVE").First(&order).Error; err != nil {
+		return err
+	}
+	if order.MerchantDeskID != nil && *order.MerchantDeskID == targetDeskID {
+		return errors.New("order is already on the target table")
+	}
+	var target models.MerchantDesk
+	if err := s.db.Where("merchant_id = ? AND id = ?", merchantID, targetDeskID).First(&target).Error; err != nil {
+		return err
+	}
+	var count int64
+	s.db.Model(&models.MerchantOrder{}).Where("merchant_id = ? AND merchant_desk_id = ? AND order_status = ?", merchantID, targetDeskID, "ACTIVE").Count(&count)
+	if count > 0 {
+		return errors.New("target table has an active order, merge the orders instead")
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.MerchantOrder{}).Where("id = ?", order.ID).Update("merchant_desk_id", targetDeskID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.MerchantStationOrder{}).Where("order_id = ?", order.ID).Update("merchant_desk_id", targetDeskID).Error; err != nil {
+			return err
+		}
+		targetData := map[string]any{"status": "OCCUPIED"}
+		if order.MerchantDeskID != nil {
+			var source models.MerchantDesk
+			if err := tx.Where("id = ?", *order.MerchantDeskID).First(&source).Error; err == nil {
+				targetData["contact_name"] = source.ContactName
+				targetData["contact_phone"] = source.ContactPhone
+				targetData["contact_id"] = source.ContactID
+				if err := s.releaseDesk(tx, merchantID, source.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&models.MerchantDesk{}).Where("id = ?", targetDeskID).Updates(targetData).Error
+	})
+	if err != nil {
+		return err
+	}
+	s.publishOrderTickets(merchantID, order.ID, KitchenEventTableChanged)
+	return nil
+}
+
+// MergeTables merges the active orders of other tables into a target order.
+//
+// The items and kitchen tickets of the source orders move to the target order. Source orders
+// must not have payments; they are marked MERGED with the target as parent and their tables
+// become available.
+func (s *MerchantService) MergeTables(merchantID string, targetOrderID string, sourceOrderIDs []string) (*models.MerchantOrder, error) {
+	if len(sourceOrderIDs) == 0 {
+		return nil, errors.New("source orders are required")
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var target models.MerchantOrder
+		if err := tx.Where("merchant_id = ? AND id = ? AND order_status = ?", merchantID, targetOrderID, "ACTIVE").First(&target).Error; err != nil {
+			return err
+		}
+		items := parseItems(target.Items)
+		firedCourse := target.FiredCourse
+		for _, sourceID := range sourceOrderIDs {
+			if sourceID == target.ID {
+				return errors.New("cannot merge an order into itself")
+			}
+			var source models.MerchantOrder
+			if err := tx.Where("merchant_id = ? AND id = ? AND order_status = ?", merchantID, sourceID, "ACTIVE").First(&source).Error; err != nil {
+				return err
+			}
+			var payments int64
+			tx.Model(&models.MerchantPayment{}).Where("order_id = ?", source.ID).Count(&payments)
+			if payments > 0 {
+				return fmt.Errorf("order %s already has payments", source.Code)
+			}
+			items = append(items, parseItems(source.Items)...)
+			if source.FiredCourse > firedCourse {
+				firedCourse = source.FiredCourse
+			}
+			if err := tx.Model(&models.MerchantStationOrder{}).Where("order_id = ?", source.ID).Updates(map[string]any{
+				"order_id":         target.ID,
+				"merchant_desk_id": target.MerchantDeskID,
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.MerchantOrder{}).Where("id = ?", source.ID).Updates(map[string]any{
+				"order_status": "MERGED",
+				"parent_id":    target.ID,
+				"items":        json.RawMessage("[]"),
+				"total":        0,
+				"sub_total":    0,
+			}).Error; err != nil {
+				return err
+			}
+			if source.MerchantDeskID != nil && (target.MerchantDeskID == nil || *source.MerchantDeskID != *target.MerchantDeskID) {
+				if err := s.releaseDesk(tx, merchantID, *source.MerchantDeskID); err != nil {
+					return err
+				}
+			}
+		}
+		var total, subTotal float64
+		for _, v := range items {
+			total += v.Subtotal
+			subTotal += v.SubtotalBeforeDisc
+		}
+		b, err := json.Marshal(items)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.MerchantOrder{}).Where("id = ?", target.ID).Updates(map[string]any{
+			"items":        b,
+			"total":        total,
+			"sub_total":    subTotal,
+			"fired_course": firedCourse,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishOrderTickets(merchantID, targetOrderID, KitchenEventTableChanged)
+	return s.GetOrderDetail(merchantID, targetOrderID)
+}
+
+// releaseDesk makes a table available again when it has no active order left.
+func (s *MerchantService) releaseDesk(tx *gorm.DB, merchantID string, deskID string) error {
+	var count int64
+	tx.Model(&models.MerchantOrder{}).Where("merchant_id = ? AND merchant_desk_id = ? AND order_status = ?", merchantID, deskID, "ACTIVE").Count(&count)
+	if count > 0 {
+		return nil
+	}
+	return tx.Model(&models.MerchantDesk{}).Where("id = ?", deskID).Updates(map[string]any{
+		"status":        "AVAILABLE",
+		"contact_name":  "",
+		"contact_phone": "",
+		"contact_id":    nil,
+	}).Error
+}
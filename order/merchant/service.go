@@ -11,7 +11,10 @@ import (
 	"github.com/AMETORY/ametory-erp-modules/context"
 	"github.com/AMETORY/ametory-erp-modules/finance"
 	"github.com/AMETORY/ametory-erp-modules/inventory"
+	"github.com/AMETORY/ametory-erp-modules/inventory/product"
+	"github.com/AMETORY/ametory-erp-modules/order/pos"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/thirdparty/websocket"
 	"github.com/AMETORY/ametory-erp-modules/utils"
 	"github.com/google/uuid"
 	"github.com/morkid/paginate"
@@ -24,6 +27,7 @@ type MerchantService struct {
 	db               *gorm.DB
 	financeService   *finance.FinanceService
 	inventoryService *inventory.InventoryService
+	websocketService *websocket.WebsocketService
 }
 
 // NewMerchantService returns a new instance of MerchantService.
@@ -54,6 +58,9 @@ func Migrate(db *gorm.DB) error {
 		&models.MerchantStationOrder{},
 		&models.MerchantPayment{},
 		&models.XenditModel{},
+		&models.MerchantModifierGroup{},
+		&models.MerchantModifierOption{},
+		&models.MerchantProductModifierGroup{},
 	)
 }
 
@@ -667,13 +674,16 @@ func (s *MerchantService) EditVariantPrice(merchantID, variantID string, price f
 // GetProductAvailableByMerchant retrieves the availability of products in an order request for a specific merchant.
 //
 // The function takes a merchant and an order request as input. It iterates over the order request items and
-// checks the availability of each item against the merchant stock. If the item is out of stock, the item status
+// checks the availability of each item against the unreserved merchant stock. If the item is out of stock, the item status
 // is marked as "OUT_OF_STOCK". Otherwise, the item status is marked as "AVAILABLE". The function also calculates
 // the total discount amount for the merchant.
 //
 // The function returns a MerchantAvailableProduct object that contains the merchant ID, name, items, sub total,
 // sub total before discount, order request ID, and total discount amount.
 //
+// Every item is priced with the price lists of the customer of the order request, the merchant and
+// the offering channel; a winning price list entry replaces the requested price and its discount.
+//
 // If any error occurs during the operation, the function returns an error.
 func (s *MerchantService) GetProductAvailableByMerchant(merchant models.MerchantModel, orderRequest *models.OrderRequestModel) (*models.MerchantAvailableProduct, error) {
 	var subTotal, totalDiscAmount, subTotalBeforeDiscount float64
@@ -693,10 +703,10 @@ func (s *MerchantService) GetProductAvailableByMerchant(merchant models.Merchant
 		if item.VariantID != nil {
 			var variant models.VariantModel
 			s.db.Select("price", "id", "display_name").Find(&variant, "id = ?", *item.VariantID)
-			availableStock, _ = s.inventoryService.ProductService.GetVariantStock(*item.ProductID, *item.VariantID, nil, merchant.DefaultWarehouseID)
+			availableStock, _ = s.inventoryService.ProductService.GetAvailableToPromise(*item.ProductID, item.VariantID, nil, merchant.DefaultWarehouseID)
 			variantDisplayName = &variant.DisplayName
 		} else {
-			availableStock, _ = s.inventoryService.ProductService.GetStock(*item.ProductID, nil, merchant.DefaultWarehouseID)
+			availableStock, _ = s.inventoryService.ProductService.GetAvailableToPromise(*item.ProductID, nil, nil, merchant.DefaultWarehouseID)
 		}
 
 		// _, discAmount, discValue, discType, err := s.inventoryService.ProductService.CalculateDiscountedPrice(*item.ProductID, price)
@@ -704,6 +714,22 @@ func (s *MerchantService) GetProductAvailableByMerchant(merchant models.Merchant
 		// 	return nil, err
 		// }
 
+		var priceListItemID *string
+		resolution, err := s.ResolveOfferPrice(merchant, orderRequest.ContactID, *item.ProductID, item.VariantID, item.Quantity, item.OriginalPrice)
+		if err != nil {
+			return nil, err
+		}
+		if resolution.Rule != nil {
+			// Daftar harga menggantikan diskon produk
+			priceListItemID = &resolution.Rule.ItemID
+			item.UnitPrice = resolution.Price
+			item.Total = item.Quantity * resolution.Price
+			item.TotalBeforeDiscount = item.Quantity * resolution.BasePrice
+			item.DiscountAmount = 0
+			item.DiscountPercent = 0
+			item.DiscountType = ""
+		}
+
 		fmt.Println("AVAILABLE STOCK", merchant.Name, *item.ProductID, *item.VariantID, *merchant.DefaultWarehouseID, availableStock)
 		if availableStock < item.Quantity {
 			item.Status = "OUT_OF_STOCK"
@@ -722,6 +748,7 @@ func (s *MerchantService) GetProductAvailableByMerchant(merchant models.Merchant
 			Quantity:                item.Quantity,
 			UnitPrice:               item.UnitPrice,
 			UnitPriceBeforeDiscount: item.OriginalPrice,
+			PriceListItemID:         priceListItemID,
 			Status:                  item.Status,
 			SubTotalBeforeDiscount:  item.TotalBeforeDiscount,
 			SubTotal:                item.Total,
@@ -738,6 +765,25 @@ func (s *MerchantService) GetProductAvailableByMerchant(merchant models.Merchant
 	return &merchantAvailable, nil
 }
 
+// ResolveOfferPrice returns the price a merchant offers for a product, or its variant, requested by
+// a customer. The price lists of the customer, its customer groups, the merchant and the offering
+// channel are applied to the base price; the resolution explains which entry won.
+func (s *MerchantService) ResolveOfferPrice(merchant models.MerchantModel, contactID *string, productID string, variantID *string, quantity, basePrice float64) (*product.PriceResolution, error) {
+	if s.inventoryService == nil {
+		return nil, errors.New("inventory service is not initialized")
+	}
+	return s.inventoryService.PriceListService.ResolvePrice(product.PriceRequest{
+		CompanyID:  merchant.CompanyID,
+		ProductID:  productID,
+		VariantID:  variantID,
+		ContactID:  contactID,
+		MerchantID: &merchant.ID,
+		Channel:    models.PriceChannelOffering,
+		Quantity:   quantity,
+		BasePrice:  basePrice,
+	})
+}
+
 // GetPhoneNumberFromMerchantID retrieves a list of phone numbers associated with a specific merchant.
 //
 // It takes a merchant ID as a string and returns a slice of phone numbers and an error if the operation fails.
@@ -1685,8 +1731,32 @@ func (s *MerchantService) DeleteProductFromMerchantStation(merchantID string, st
 // CreateOrder creates a new order for a specific merchant.
 //
 // The function takes the ID of the merchant and the order model as input.
+// When the merchant requires an open cashier shift and there is none, pos.ErrNoOpenShift is returned.
+// The modifiers of the items are validated and priced with ApplyModifiers.
 // It returns an error if the creation fails.
 func (s *MerchantService) CreateOrder(merchantID string, order *models.MerchantOrder) error {
+	var merchant models.MerchantModel
+	if err := s.db.Select("id", "require_open_shift").First(&merchant, "id = ?", merchantID).Error; err != nil {
+		return err
+	}
+	if _, err := pos.ShiftForSale(s.db, &merchant, s.ctx.Request); err != nil {
+		return err
+	}
+	newItems := parseItems(order.Items)
+	withModifiers := false
+	for i := range newItems {
+		if newItems[i].ID == "" {
+			newItems[i].ID = utils.Uuid()
+		}
+		if err := s.ApplyModifiers(merchantID, &newItems[i]); err != nil {
+			return err
+		}
+		if len(newItems[i].Modifiers) > 0 {
+			withModifiers = true
+		}
+	}
+	order.Items, _ = json.Marshal(newItems)
+
 	var existingOrder models.MerchantOrder
 	err := s.db.Where("merchant_id = ? AND merchant_desk_id = ? AND order_status = ?", merchantID, order.MerchantDeskID, "ACTIVE").First(&existingOrder).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -1694,11 +1764,17 @@ func (s *MerchantService) CreateOrder(merchantID string, order *models.MerchantO
 		order.MerchantID = &merchantID
 		order.OrderStatus = "ACTIVE"
 		order.Code = strings.ToUpper(utils.GenerateRandomString(6))
+		if withModifiers {
+			order.Total, order.SubTotal = 0, 0
+			for _, v := range newItems {
+				order.Total += v.Subtotal
+				order.SubTotal += v.SubtotalBeforeDisc
+			}
+		}
 		return s.db.Create(order).Error
 
 	}
 	existingItems := parseItems(existingOrder.Items)
-	newItems := parseItems(order.Items)
 	existingItems = append(existingItems, newItems...)
 	b, _ := json.Marshal(existingItems)
 	existingOrder.Items = b
@@ -1728,6 +1804,9 @@ func parseItems(orderItems json.RawMessage) []models.MerchantOrderItem {
 // DistributeOrder distributes the order to the stations.
 //
 // The function takes the ID of the merchant, the order model as input.
+// Items of a course that is not fired yet are held (status HOLD) until the previous course is
+// served or FireCourse is called; the first course of an order is fired right away. Fired items
+// get a preparation target from the product or the station and are pushed to the kitchen display.
 // It returns a slice of MerchantStationOrder and an error if the operation fails.
 func (s *MerchantService) DistributeOrder(merchantID string, order *models.MerchantOrder) ([]models.MerchantStationOrder, error) {
 	items := []models.MerchantOrderItem{}
@@ -1736,6 +1815,24 @@ func (s *MerchantService) DistributeOrder(merchantID string, order *models.Merch
 	if err != nil {
 		return nil, err
 	}
+	var current models.MerchantOrder
+	if err := s.db.Select("id", "fired_course").Where("id = ?", order.ID).First(&current).Error; err != nil {
+		return nil, err
+	}
+	firedCourse := current.FiredCourse
+	if firedCourse == 0 {
+		for _, v := range items {
+			if v.Course > 0 && (firedCourse == 0 || v.Course < firedCourse) {
+				firedCourse = v.Course
+			}
+		}
+		if firedCourse > 0 {
+			if err := s.db.Model(&models.MerchantOrder{}).Where("id = ?", order.ID).Update("fired_course", firedCourse).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+	now := time.Now()
 	orderStations := []models.MerchantStationOrder{}
 	for _, v := range items {
 		var productMerchant models.ProductMerchant
@@ -1751,9 +1848,13 @@ func (s *MerchantService) DistributeOrder(merchantID string, order *models.Merch
 			var orderStation models.MerchantStationOrder = models.MerchantStationOrder{
 				MerchantStationID: productMerchant.MerchantStationID,
 				OrderID:           order.ID,
-				Status:            "PENDING",
+				Status:            models.StationOrderHold,
 				Item:              itemStation,
 				MerchantDeskID:    order.MerchantDeskID,
+				Course:            v.Course,
+			}
+			if v.Course <= firedCourse {
+				s.fireTicket(merchantID, &orderStation, now)
 			}
 			orderStation.ID = utils.Uuid()
 			if err := s.db.Create(&orderStation).Error; err != nil {
@@ -1765,6 +1866,13 @@ func (s *MerchantService) DistributeOrder(merchantID string, order *models.Merch
 
 	}
 
+	fired := []models.MerchantStationOrder{}
+	for _, v := range orderStations {
+		if v.Status != models.StationOrderHold {
+			fired = append(fired, v)
+		}
+	}
+	s.publishKitchenEvent(merchantID, KitchenEventNewTickets, fired)
 	return orderStations, nil
 }
 
@@ -1830,15 +1938,47 @@ func (s *MerchantService) GetOrders(request http.Request, merchantID string) (pa
 	return page, nil
 }
 
+// UpdateStationOrderStatus updates the status of an item in a station.
+//
+// The prep timer of the item is updated with the status (PREPARING, READY, SERVED) and the
+// change is pushed to the kitchen display. Held items of a course that is not fired yet can
+// only be cancelled. When every fired item of the order is served, the next course is fired.
 func (s *MerchantService) UpdateStationOrderStatus(stationID, stationOrderID string, status string) error {
 	var orderStation models.MerchantStationOrder
-	if err := s.db.Model(&models.MerchantStationOrder{}).Where("merchant_station_id = ? AND id = ?", stationID, stationOrderID).First(&orderStation).Error; err != nil {
+	if err := s.db.Preload("MerchantStation").Model(&models.MerchantStationOrder{}).Where("merchant_station_id = ? AND id = ?", stationID, stationOrderID).First(&orderStation).Error; err != nil {
 		return err
 	}
+	if orderStation.Status == models.StationOrderHold && !isStationStatus(status, models.StationOrderHold, models.StationOrderCancelled) {
+		return errors.New("course of the item has not been fired")
+	}
+	now := time.Now()
+	switch {
+	case isStationStatus(status, models.StationOrderPreparing):
+		if orderStation.StartedAt == nil {
+			orderStation.StartedAt = &now
+		}
+	case isStationStatus(status, models.StationOrderReady):
+		if orderStation.ReadyAt == nil {
+			orderStation.ReadyAt = &now
+		}
+	case isStationStatus(status, models.StationOrderServed):
+		if orderStation.ReadyAt == nil {
+			orderStation.ReadyAt = &now
+		}
+		orderStation.ServedAt = &now
+	}
 	orderStation.Status = status
+	station := orderStation.MerchantStation
+	orderStation.MerchantStation = nil
 	if err := s.db.Save(&orderStation).Error; err != nil {
 		return err
 	}
+	if station != nil && station.MerchantID != nil {
+		s.publishKitchenEvent(*station.MerchantID, KitchenEventStatusChanged, []models.MerchantStationOrder{orderStation})
+		if isStationStatus(status, models.StationOrderServed, models.StationOrderCancelled) {
+			s.autoFireNextCourse(*station.MerchantID, orderStation.OrderID)
+		}
+	}
 	return nil
 }
 
@@ -1861,6 +2001,99 @@ func (s *MerchantService) UpdateStationOrderStatus(stationID, stationOrderID str
 // 	return tx.Commit().Error
 // }
 
+// CreateOrderPayment records a payment for a merchant order.
+//
+// The payment is linked to the open cashier shift of the merchant so that it is counted
+// when the shift is closed. When the merchant requires an open shift and there is none,
+// pos.ErrNoOpenShift is returned.
+func (s *MerchantService) CreateOrderPayment(orderID string, payment *models.MerchantPayment) error {
+	var order models.MerchantOrder
+	if err := s.db.Select("id", "merchant_id").First(&order, "id = ?", orderID).Error; err != nil {
+		return err
+	}
+	if order.MerchantID == nil {
+		return errors.New("order has no merchant")
+	}
+	var merchant models.MerchantModel
+	if err := s.db.Select("id", "require_open_shift").First(&merchant, "id = ?", *order.MerchantID).Error; err != nil {
+		return err
+	}
+	shift, err := pos.ShiftForSale(s.db, &merchant, s.ctx.Request)
+	if err != nil {
+		return err
+	}
+	payment.OrderID = order.ID
+	payment.MerchantID = order.MerchantID
+	if payment.Date.IsZero() {
+		payment.Date = time.Now()
+	}
+	if shift != nil {
+		payment.ShiftID = &shift.ID
+	}
+	return s.db.Create(payment).Error
+}
+
+// CreateOrderPayments settles the rest of a merchant order with several tenders, e.g. part cash
+// and part QRIS.
+//
+// The tenders must cover what is left of the order after its earlier payments. Only cash gives
+// change, which is computed here and stored on the cash payment; like CreateOrderPayment, every
+// payment is linked to the open cashier shift of the merchant.
+func (s *MerchantService) CreateOrderPayments(orderID string, payments []models.MerchantPayment) error {
+	if len(payments) == 0 {
+		return errors.New("no payment")
+	}
+	var order models.MerchantOrder
+	if err := s.db.Select("id", "merchant_id", "total").First(&order, "id = ?", orderID).Error; err != nil {
+		return err
+	}
+	if order.MerchantID == nil {
+		return errors.New("order has no merchant")
+	}
+	var merchant models.MerchantModel
+	if err := s.db.Select("id", "require_open_shift").First(&merchant, "id = ?", *order.MerchantID).Error; err != nil {
+		return err
+	}
+	shift, err := pos.ShiftForSale(s.db, &merchant, s.ctx.Request)
+	if err != nil {
+		return err
+	}
+	var paid float64
+	if err := s.db.Model(&models.MerchantPayment{}).Select("COALESCE(SUM(amount - change), 0)").
+		Where("order_id = ?", order.ID).Scan(&paid).Error; err != nil {
+		return err
+	}
+	methods := make([]string, len(payments))
+	amounts := make([]float64, len(payments))
+	for i, v := range payments {
+		methods[i] = strings.ToUpper(v.PaymentMethod)
+		amounts[i] = v.Amount
+	}
+	changes, err := pos.TenderChange(order.Total-paid, methods, amounts)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for i := range payments {
+			payments[i].OrderID = order.ID
+			payments[i].MerchantID = order.MerchantID
+			payments[i].PaymentMethod = methods[i]
+			payments[i].Change = changes[i]
+			if payments[i].Date.IsZero() {
+				payments[i].Date = now
+			}
+			if shift != nil {
+				payments[i].ShiftID = &shift.ID
+			}
+			if err := tx.Create(&payments[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // GetPrintReceipt generates a PDF receipt for a given order.
 //
 // The function takes an order model, a template path (optional), and a time format string (optional).
@@ -2007,6 +2240,11 @@ func (s *MerchantService) SplitBill(order *models.MerchantOrder, contact *models
 							Status:            oldOrder.Status,
 							MerchantDeskID:    oldOrder.MerchantDeskID,
 							MerchantStationID: oldOrder.MerchantStationID,
+							Course:            oldOrder.Course,
+							FiredAt:           oldOrder.FiredAt,
+							StartedAt:         oldOrder.StartedAt,
+							ReadyAt:           oldOrder.ReadyAt,
+							DueAt:             oldOrder.DueAt,
 						}
 
 						newStatonOrder.ID = utils.Uuid()
@@ -2081,8 +2319,10 @@ func (s *MerchantService) SplitBill(order *models.MerchantOrder, contact *models
 // discount as the product of the item's quantity and unit price, and sets the
 // subtotal as the difference between the subtotal before discount and the
 // discount amount.
+//
+// The unit price includes the modifier total of the item.
 func (s *MerchantService) countSubtotal(item *models.MerchantOrderItem) {
-	var beforeDisc = item.Quantity * item.UnitPrice
+	var beforeDisc = item.Quantity * (item.UnitPrice + item.ModifierTotal)
 	item.SubtotalBeforeDisc = beforeDisc
 	if item.DiscountPercent > 0 {
 		item.Subtotal = beforeDisc - (beforeDisc * item.DiscountPercent / 100)
@@ -8,28 +8,43 @@ import (
 	"github.com/AMETORY/ametory-erp-modules/finance"
 	"github.com/AMETORY/ametory-erp-modules/inventory"
 	"github.com/AMETORY/ametory-erp-modules/order/banner"
+	"github.com/AMETORY/ametory-erp-modules/order/customer_portal"
+	"github.com/AMETORY/ametory-erp-modules/order/loyalty"
+	"github.com/AMETORY/ametory-erp-modules/order/marketplace"
 	"github.com/AMETORY/ametory-erp-modules/order/merchant"
 	"github.com/AMETORY/ametory-erp-modules/order/payment"
 	"github.com/AMETORY/ametory-erp-modules/order/payment_term"
 	"github.com/AMETORY/ametory-erp-modules/order/pos"
+	"github.com/AMETORY/ametory-erp-modules/order/pos_sync"
 	"github.com/AMETORY/ametory-erp-modules/order/promotion"
 	"github.com/AMETORY/ametory-erp-modules/order/sales"
+	"github.com/AMETORY/ametory-erp-modules/order/sales_commission"
 	"github.com/AMETORY/ametory-erp-modules/order/sales_return"
+	"github.com/AMETORY/ametory-erp-modules/order/stored_value"
+	"github.com/AMETORY/ametory-erp-modules/order/subscription"
 	"github.com/AMETORY/ametory-erp-modules/order/withdrawal"
 	"gorm.io/gorm"
 )
 
 type OrderService struct {
-	ctx                *context.ERPContext
-	SalesService       *sales.SalesService
-	PosService         *pos.POSService
-	MerchantService    *merchant.MerchantService
-	PaymentService     *payment.PaymentService
-	WithdrawalService  *withdrawal.WithdrawalService
-	BannerService      *banner.BannerService
-	PromotionService   *promotion.PromotionService
-	PaymentTermService *payment_term.PaymentTermService
-	SalesReturnService *sales_return.SalesReturnService
+	ctx                   *context.ERPContext
+	SalesService          *sales.SalesService
+	PosService            *pos.POSService
+	POSShiftService       *pos.POSShiftService
+	POSSyncService        *pos_sync.POSSyncService
+	MerchantService       *merchant.MerchantService
+	PaymentService        *payment.PaymentService
+	WithdrawalService     *withdrawal.WithdrawalService
+	BannerService         *banner.BannerService
+	PromotionService      *promotion.PromotionService
+	PaymentTermService    *payment_term.PaymentTermService
+	SalesReturnService    *sales_return.SalesReturnService
+	LoyaltyService        *loyalty.LoyaltyService
+	StoredValueService    *stored_value.StoredValueService
+	SubscriptionService   *subscription.SubscriptionService
+	MarketplaceService    *marketplace.MarketplaceService
+	CustomerPortalService *customer_portal.CustomerPortalService
+	CommissionService     *sales_commission.SalesCommissionService
 }
 
 // NewOrderService initializes a new OrderService instance.
@@ -47,18 +62,42 @@ func NewOrderService(ctx *context.ERPContext) *OrderService {
 	}
 	inventoryService := inventory.NewInventoryService(ctx)
 	salesService := sales.NewSalesService(ctx.DB, ctx, financeService, inventoryService)
+	paymentService := payment.NewPaymentService(ctx.DB, ctx)
 	var service = OrderService{
-		ctx:                ctx,
-		SalesService:       salesService,
-		PosService:         pos.NewPOSService(ctx.DB, ctx, financeService),
-		MerchantService:    merchant.NewMerchantService(ctx.DB, ctx, financeService, inventoryService),
-		PaymentService:     payment.NewPaymentService(ctx.DB, ctx),
-		WithdrawalService:  withdrawal.NewWithdrawalService(ctx.DB, ctx),
-		BannerService:      banner.NewBannerService(ctx.DB, ctx),
-		PromotionService:   promotion.NewPromotionService(ctx.DB, ctx),
-		PaymentTermService: payment_term.NewPaymentTermService(ctx.DB, ctx),
-		SalesReturnService: sales_return.NewSalesReturnService(ctx.DB, ctx, financeService, inventoryService.StockMovementService, salesService),
+		ctx:                   ctx,
+		SalesService:          salesService,
+		PosService:            pos.NewPOSService(ctx.DB, ctx, financeService),
+		POSShiftService:       pos.NewPOSShiftService(ctx.DB, ctx, financeService),
+		POSSyncService:        pos_sync.NewPOSSyncService(ctx.DB, ctx, inventoryService),
+		MerchantService:       merchant.NewMerchantService(ctx.DB, ctx, financeService, inventoryService),
+		PaymentService:        paymentService,
+		WithdrawalService:     withdrawal.NewWithdrawalService(ctx.DB, ctx),
+		BannerService:         banner.NewBannerService(ctx.DB, ctx),
+		PromotionService:      promotion.NewPromotionService(ctx.DB, ctx),
+		PaymentTermService:    payment_term.NewPaymentTermService(ctx.DB, ctx),
+		SalesReturnService:    sales_return.NewSalesReturnService(ctx.DB, ctx, financeService, inventoryService.StockMovementService, salesService),
+		LoyaltyService:        loyalty.NewLoyaltyService(ctx.DB, ctx),
+		StoredValueService:    stored_value.NewStoredValueService(ctx.DB, ctx),
+		SubscriptionService:   subscription.NewSubscriptionService(ctx.DB, ctx, salesService, paymentService),
+		MarketplaceService:    marketplace.NewMarketplaceService(ctx.DB, ctx),
+		CustomerPortalService: customer_portal.NewCustomerPortalService(ctx.DB, ctx, financeService, salesService, paymentService),
+		CommissionService:     sales_commission.NewSalesCommissionService(ctx.DB, ctx),
 	}
+	service.SalesService.SetLoyaltyService(service.LoyaltyService)
+	service.PosService.SetLoyaltyService(service.LoyaltyService)
+	service.POSSyncService.SetLoyaltyService(service.LoyaltyService)
+	service.POSSyncService.SetPOSService(service.PosService)
+	service.SalesReturnService.SetLoyaltyService(service.LoyaltyService)
+	service.SalesReturnService.SetStoredValueService(service.StoredValueService)
+	service.SalesService.SetCommissionService(service.CommissionService)
+	service.SalesReturnService.SetCommissionService(service.CommissionService)
+	service.PaymentService.SetSalesService(service.SalesService)
+	service.PaymentService.SetPOSService(service.PosService)
+	service.PosService.SetPromotionService(service.PromotionService)
+	service.SalesService.SetPromotionService(service.PromotionService)
+	service.PosService.SetStoredValueService(service.StoredValueService)
+	service.PosService.SetPaymentRefunder(service.PaymentService)
+	service.PosService.SetMarketplaceService(service.MarketplaceService)
 	err := service.Migrate()
 	if err != nil {
 		fmt.Println("INIT ORDER SERVICE ERROR", err)
@@ -88,6 +127,10 @@ func (s *OrderService) Migrate() error {
 		log.Println("ERROR POS", err)
 		return err
 	}
+	if err := pos_sync.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR POS SYNC", err)
+		return err
+	}
 	if err := merchant.Migrate(s.ctx.DB); err != nil {
 		log.Println("ERROR MERCHANT", err)
 		return err
@@ -112,6 +155,30 @@ func (s *OrderService) Migrate() error {
 		log.Println("ERROR PAYMENT TERM", err)
 		return err
 	}
+	if err := loyalty.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR LOYALTY", err)
+		return err
+	}
+	if err := stored_value.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR STORED VALUE", err)
+		return err
+	}
+	if err := subscription.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR SUBSCRIPTION", err)
+		return err
+	}
+	if err := marketplace.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR MARKETPLACE", err)
+		return err
+	}
+	if err := customer_portal.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR CUSTOMER PORTAL", err)
+		return err
+	}
+	if err := sales_commission.Migrate(s.ctx.DB); err != nil {
+		log.Println("ERROR SALES COMMISSION", err)
+		return err
+	}
 
 	return nil
 }
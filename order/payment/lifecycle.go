@@ -0,0 +1,354 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// amountEpsilon absorbs rounding differences between paid and refunded amounts.
+const amountEpsilon = 0.005
+
+// ErrInvalidTransition is returned when a payment cannot move to the requested status.
+var ErrInvalidTransition = errors.New("invalid payment status transition")
+
+// ErrUnderpaid is returned when a payment is reported PAID for less than its total. The payment
+// stays in its status until the rest is paid or it is marked paid manually for its total.
+var ErrUnderpaid = errors.New("paid amount is below the payment total")
+
+// StatusUpdate is a status of a payment reported by a provider (webhook or lookup) or recorded
+// manually.
+//
+// Amount is the paid amount for PAID and the refunded amount for REFUNDED; zero means the total
+// of the payment (PAID) or the rest of the paid amount (REFUNDED). A PAID update below the total
+// is refused with ErrUnderpaid. A partial refund keeps the
+// payment PAID and adds to its refunded amount.
+type StatusUpdate struct {
+	Status string
+	Amount float64
+	At     *time.Time
+	Reason string
+}
+
+// RequestPayment creates a VA, e-wallet, QRIS or payment link payment at a provider and records
+// it as a pending payment.
+//
+// The provider must implement payment_provider.TypedPaymentProvider; an empty provider name uses
+// the active provider. The code of the payment is sent to the provider as the reference of the
+// payment, generated when data has none. data.RefID / RefType (or the PaymentID of a POS sale or
+// donation) link the payment to the document it settles.
+func (s *PaymentService) RequestPayment(providerName string, data *models.PaymentModel, req payment_provider.PaymentRequest) (*payment_provider.PaymentResponse, error) {
+	if providerName == "" {
+		providerName = s.activeProvider
+	}
+	provider, ok := s.PaymentProvider[providerName].(payment_provider.TypedPaymentProvider)
+	if !ok {
+		return nil, fmt.Errorf("payment provider %s does not support typed payments", providerName)
+	}
+	if data.Code == "" {
+		data.Code = fmt.Sprintf("PAY-%s", utils.RandomStringNumber(10, false))
+	}
+	if req.Amount == 0 {
+		req.Amount = data.Total
+	}
+	if req.Amount <= 0 {
+		return nil, errors.New("amount must be greater than 0")
+	}
+	if req.Method == "" {
+		req.Method = payment_provider.PaymentMethodLink
+	}
+	req.ReferenceID = data.Code
+	if req.CustomerName == "" {
+		req.CustomerName = data.Name
+	}
+	if req.Email == "" {
+		req.Email = data.Email
+	}
+	if req.Phone == "" {
+		req.Phone = data.Phone
+	}
+
+	resp, err := provider.CreatePayment(req)
+	if err != nil {
+		return nil, err
+	}
+	paymentData, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	data.Total = req.Amount
+	data.Name = req.CustomerName
+	data.Email = req.Email
+	data.Phone = req.Phone
+	data.PaymentProvider = providerName
+	data.PaymentMethod = string(req.Method)
+	data.PaymentLink = resp.PaymentURL
+	data.ProviderRef = resp.ProviderRef
+	data.ExpiresAt = resp.ExpiresAt
+	data.PaymentData = string(paymentData)
+	data.Status = models.PaymentStatusPending
+	if data.RefType == "" {
+		data.RefType = "ORDER"
+	}
+	if data.ID == "" {
+		err = s.db.Create(data).Error
+	} else {
+		err = s.db.Omit(clause.Associations).Save(data).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetPaymentByID retrieves a payment by its ID.
+func (s *PaymentService) GetPaymentByID(id string) (*models.PaymentModel, error) {
+	data := models.PaymentModel{}
+	err := s.db.Where("id = ?", id).First(&data).Error
+	return &data, err
+}
+
+// RefreshPayment looks the payment up at its provider and applies the reported status. It is the
+// fallback for payments whose webhook did not arrive.
+func (s *PaymentService) RefreshPayment(id string) (*models.PaymentModel, error) {
+	payment, err := s.GetPaymentByID(id)
+	if err != nil {
+		return nil, err
+	}
+	provider, ok := s.PaymentProvider[payment.PaymentProvider].(payment_provider.TypedPaymentProvider)
+	if !ok {
+		return nil, fmt.Errorf("payment provider %s does not support typed payments", payment.PaymentProvider)
+	}
+	resp, err := provider.GetPayment(payment_provider.PaymentMethod(payment.PaymentMethod), payment.ProviderRef, payment.Code)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == payment.Status || resp.Status == models.PaymentStatusPending {
+		return payment, nil
+	}
+	amount := resp.PaidAmount
+	if resp.Status != models.PaymentStatusPaid {
+		amount = 0
+	}
+	return s.UpdatePaymentStatus(id, StatusUpdate{Status: resp.Status, Amount: amount, At: resp.PaidAt})
+}
+
+// UpdatePaymentStatus moves a payment to a new status and settles or releases the linked POS sale,
+// sales invoice or donation.
+//
+// Returns ErrInvalidTransition when the payment cannot move to the status, see
+// models.PaymentModel.CanTransitionTo.
+func (s *PaymentService) UpdatePaymentStatus(id string, update StatusUpdate) (*models.PaymentModel, error) {
+	var payment models.PaymentModel
+	var changed bool
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&payment).Error; err != nil {
+			return err
+		}
+		var err error
+		changed, err = s.transition(tx, &payment, update)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		s.afterTransition(&payment)
+	}
+	return &payment, nil
+}
+
+// SettlePayment settles the documents linked to a paid payment:
+//
+//   - POS sales whose PaymentID is the payment receive the paid amount, oldest first, and are
+//     marked paid once covered (POSService.SettlePayment);
+//   - donations whose PaymentID is the payment are marked PAID and added to their campaign;
+//   - a sales invoice referenced by RefType "sales" / RefID receives a sales payment of the paid
+//     amount, up to its balance, on the asset account of the payment.
+//
+// A settled payment is not settled again.
+func (s *PaymentService) SettlePayment(id string) error {
+	payment, err := s.GetPaymentByID(id)
+	if err != nil {
+		return err
+	}
+	if payment.Status != models.PaymentStatusPaid {
+		return errors.New("payment is not paid")
+	}
+	if payment.SettledAt != nil {
+		return nil
+	}
+	paidAt := time.Now()
+	if payment.PaidAt != nil {
+		paidAt = *payment.PaidAt
+	}
+
+	var sales []models.POSModel
+	if err := s.db.Select("id", "total").Where("payment_id = ?", payment.ID).Order("created_at asc").Find(&sales).Error; err != nil {
+		return err
+	}
+	if len(sales) > 0 && s.posService == nil {
+		return errors.New("pos service is not set")
+	}
+	remaining := payment.PaidAmount
+	for _, v := range sales {
+		amount := math.Min(remaining, v.Total)
+		remaining -= amount
+		if err := s.posService.SettlePayment(v.ID, amount, paidAt); err != nil {
+			return err
+		}
+	}
+
+	if err := s.settleDonations(payment); err != nil {
+		return err
+	}
+
+	if strings.EqualFold(payment.RefType, "sales") && payment.RefID != "" {
+		if err := s.settleSales(payment, paidAt); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	payment.SettledAt = &now
+	return s.db.Model(&models.PaymentModel{}).Where("id = ?", payment.ID).Update("settled_at", now).Error
+}
+
+// transition applies a status update to a locked payment. It returns false when the update
+// does not change the payment.
+func (s *PaymentService) transition(tx *gorm.DB, payment *models.PaymentModel, update StatusUpdate) (bool, error) {
+	at := time.Now()
+	if update.At != nil {
+		at = *update.At
+	}
+	data := map[string]any{}
+	switch {
+	case update.Status == models.PaymentStatusRefunded && payment.Status == models.PaymentStatusPaid:
+		amount := update.Amount
+		if amount <= 0 {
+			amount = payment.PaidAmount - payment.RefundedAmount
+		}
+		payment.RefundedAmount = math.Min(payment.RefundedAmount+amount, payment.PaidAmount)
+		payment.RefundedAt = &at
+		data["refunded_amount"] = payment.RefundedAmount
+		data["refunded_at"] = at
+		if payment.RefundedAmount+amountEpsilon >= payment.PaidAmount {
+			payment.Status = models.PaymentStatusRefunded
+		}
+	case update.Status == payment.Status:
+		return false, nil
+	case !payment.CanTransitionTo(update.Status):
+		return false, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, payment.Status, update.Status)
+	case update.Status == models.PaymentStatusPaid && update.Amount > 0 && update.Amount+amountEpsilon < payment.Total:
+		return false, fmt.Errorf("%w: %.2f of %.2f", ErrUnderpaid, update.Amount, payment.Total)
+	case update.Status == models.PaymentStatusPaid:
+		payment.Status = update.Status
+		payment.PaidAt = &at
+		payment.PaidAmount = update.Amount
+		if payment.PaidAmount <= 0 {
+			payment.PaidAmount = payment.Total
+		}
+		payment.FailureReason = ""
+		data["paid_at"] = at
+		data["paid_amount"] = payment.PaidAmount
+		data["failure_reason"] = ""
+	default:
+		payment.Status = update.Status
+		payment.FailureReason = update.Reason
+		data["failure_reason"] = update.Reason
+	}
+	data["status"] = payment.Status
+	if err := tx.Model(&models.PaymentModel{}).Where("id = ?", payment.ID).Updates(data).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// afterTransition settles the documents of a paid payment and releases the POS sales and
+// donations of an expired or failed one. Failures are logged; a paid payment can be settled
+// again with SettlePayment.
+func (s *PaymentService) afterTransition(payment *models.PaymentModel) {
+	switch payment.Status {
+	case models.PaymentStatusPaid:
+		if err := s.SettlePayment(payment.ID); err != nil {
+			log.Println("ERROR PAYMENT SETTLEMENT", err)
+		}
+	case models.PaymentStatusExpired, models.PaymentStatusFailed:
+		if err := s.db.Model(&models.CrowdFundingDonationModel{}).
+			Where("payment_id = ? AND status <> ?", payment.ID, models.PaymentStatusPaid).
+			Update("status", payment.Status).Error; err != nil {
+			log.Println("ERROR PAYMENT STATUS", err)
+		}
+		if s.posService == nil {
+			return
+		}
+		var posIDs []string
+		s.db.Model(&models.POSModel{}).Where("payment_id = ?", payment.ID).Pluck("id", &posIDs)
+		for _, posID := range posIDs {
+			if err := s.posService.UpdatePaymentStatus(posID, payment.Status); err != nil {
+				log.Println("ERROR PAYMENT STATUS", err)
+			}
+		}
+	}
+}
+
+func (s *PaymentService) settleDonations(payment *models.PaymentModel) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var donations []models.CrowdFundingDonationModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("payment_id = ? AND (status IS NULL OR status <> ?)", payment.ID, models.PaymentStatusPaid).
+			Find(&donations).Error; err != nil {
+			return err
+		}
+		for _, v := range donations {
+			if err := tx.Model(&models.CrowdFundingDonationModel{}).Where("id = ?", v.ID).Updates(map[string]any{
+				"status":         models.PaymentStatusPaid,
+				"payment_method": payment.PaymentMethod,
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.CrowdFundingCampaignModel{}).Where("id = ?", v.CampaignID).
+				Update("current_amount", gorm.Expr("current_amount + ?", v.Amount)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PaymentService) settleSales(payment *models.PaymentModel, paidAt time.Time) error {
+	if s.salesService == nil {
+		return errors.New("sales service is not set")
+	}
+	if payment.AssetAccountID == nil {
+		return errors.New("asset account of the payment is required to settle sales")
+	}
+	sales, err := s.salesService.GetSalesByID(payment.RefID)
+	if err != nil {
+		return err
+	}
+	amount := math.Min(payment.PaidAmount, sales.Total+s.salesService.InstallmentCharges(sales.ID)-sales.Paid)
+	if amount <= amountEpsilon {
+		return nil
+	}
+	return s.salesService.CreateSalesPayment(sales, &models.SalesPaymentModel{
+		PaymentDate:        paidAt,
+		SalesID:            &sales.ID,
+		Amount:             amount,
+		Notes:              fmt.Sprintf("Pembayaran %s %s", payment.PaymentProvider, payment.Code),
+		CompanyID:          sales.CompanyID,
+		AssetAccountID:     payment.AssetAccountID,
+		PaymentMethod:      payment.PaymentMethod,
+		PaymentMethodNotes: payment.ProviderRef,
+	})
+}
@@ -0,0 +1,167 @@
+package payment_provider
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrInvalidCallbackToken is returned by a WebhookParser when a callback does not carry the
+// callback token configured for the provider.
+var ErrInvalidCallbackToken = errors.New("invalid callback token")
+
+// PaymentMethod is the way a customer pays a payment request.
+type PaymentMethod string
+
+const (
+	PaymentMethodVA      PaymentMethod = "VA"
+	PaymentMethodEWallet PaymentMethod = "EWALLET"
+	PaymentMethodQRIS    PaymentMethod = "QRIS"
+	PaymentMethodLink    PaymentMethod = "PAYMENT_LINK"
+)
+
+// PaymentRequest is a provider-agnostic request to collect a payment.
+//
+// ReferenceID is our reference of the payment (PaymentModel.Code); providers send it back in
+// their callbacks. BankCode is used by VA payments and EWalletCode by e-wallet payments.
+type PaymentRequest struct {
+	ReferenceID        string         `json:"reference_id"`
+	Method             PaymentMethod  `json:"method"`
+	Amount             float64        `json:"amount"`
+	Currency           string         `json:"currency"`
+	Description        string         `json:"description"`
+	CustomerID         string         `json:"customer_id"`
+	CustomerName       string         `json:"customer_name"`
+	Email              string         `json:"email"`
+	Phone              string         `json:"phone"`
+	BankCode           string         `json:"bank_code,omitempty"`
+	EWalletCode        string         `json:"ewallet_code,omitempty"`
+	SuccessRedirectURL string         `json:"success_redirect_url,omitempty"`
+	FailureRedirectURL string         `json:"failure_redirect_url,omitempty"`
+	ExpiresAt          *time.Time     `json:"expires_at,omitempty"`
+	Metadata           map[string]any `json:"metadata,omitempty"`
+}
+
+// PaymentResponse is a provider-agnostic payment created or looked up at a provider.
+//
+// Status is one of the models.PaymentStatus* values. PaymentURL is the checkout page of a
+// payment link or the redirect of an e-wallet payment, VANumber the virtual account to transfer
+// to and QRString the QRIS payload. Raw keeps the response of the provider.
+type PaymentResponse struct {
+	ProviderRef string        `json:"provider_ref"`
+	ReferenceID string        `json:"reference_id"`
+	Method      PaymentMethod `json:"method"`
+	Status      string        `json:"status"`
+	Amount      float64       `json:"amount"`
+	PaidAmount  float64       `json:"paid_amount"`
+	PaymentURL  string        `json:"payment_url,omitempty"`
+	VANumber    string        `json:"va_number,omitempty"`
+	BankCode    string        `json:"bank_code,omitempty"`
+	QRString    string        `json:"qr_string,omitempty"`
+	ExpiresAt   *time.Time    `json:"expires_at,omitempty"`
+	PaidAt      *time.Time    `json:"paid_at,omitempty"`
+	Raw         any           `json:"raw,omitempty"`
+}
+
+// TypedPaymentProvider is a payment gateway provider working with PaymentRequest and
+// PaymentResponse instead of provider specific objects.
+type TypedPaymentProvider interface {
+	CreatePayment(req PaymentRequest) (*PaymentResponse, error)
+	// GetPayment looks up a payment by the reference of the provider, or by our reference for
+	// providers that only know ours.
+	GetPayment(method PaymentMethod, providerRef, referenceID string) (*PaymentResponse, error)
+}
+
+// WebhookRequest is an inbound callback of a payment provider.
+type WebhookRequest struct {
+	Header http.Header
+	Query  url.Values
+	Body   []byte
+}
+
+// WebhookEvent is a verified callback of a payment provider.
+//
+// EventID identifies the notification at the provider and is used to ignore retried callbacks.
+// Status is one of the models.PaymentStatus* values.
+type WebhookEvent struct {
+	EventID     string        `json:"event_id"`
+	ProviderRef string        `json:"provider_ref"`
+	ReferenceID string        `json:"reference_id"`
+	Method      PaymentMethod `json:"method"`
+	Status      string        `json:"status"`
+	Amount      float64       `json:"amount"`
+	Fee         float64       `json:"fee"`
+	PaidAt      *time.Time    `json:"paid_at,omitempty"`
+	Reason      string        `json:"reason,omitempty"`
+}
+
+// WebhookParser verifies and parses the callbacks of a payment provider.
+type WebhookParser interface {
+	ParseWebhook(req WebhookRequest) (*WebhookEvent, error)
+}
+
+// RefundRequest is a request to refund a paid payment, fully or partially, at its provider.
+type RefundRequest struct {
+	ReferenceID string        `json:"reference_id"` // our reference of the refund
+	ProviderRef string        `json:"provider_ref"` // provider reference of the refunded payment
+	Method      PaymentMethod `json:"method"`
+	Amount      float64       `json:"amount"`
+	Reason      string        `json:"reason"`
+}
+
+// RefundResponse is a refund created at a provider. Status is one of the Refund* values.
+type RefundResponse struct {
+	ProviderRef string  `json:"provider_ref"`
+	ReferenceID string  `json:"reference_id"`
+	Status      string  `json:"status"`
+	Amount      float64 `json:"amount"`
+	Raw         any     `json:"raw,omitempty"`
+}
+
+const (
+	RefundPending   = "PENDING"
+	RefundSucceeded = "SUCCEEDED"
+	RefundFailed    = "FAILED"
+)
+
+// RefundProvider is a payment provider able to refund its payments.
+type RefundProvider interface {
+	RefundPayment(req RefundRequest) (*RefundResponse, error)
+}
+
+// DisbursementRequest is a request to pay out money to a bank account.
+type DisbursementRequest struct {
+	ReferenceID       string   `json:"reference_id"` // our reference, also used as idempotency key
+	BankCode          string   `json:"bank_code"`
+	AccountNumber     string   `json:"account_number"`
+	AccountHolderName string   `json:"account_holder_name"`
+	Amount            float64  `json:"amount"`
+	Description       string   `json:"description"`
+	EmailTo           []string `json:"email_to,omitempty"`
+}
+
+// DisbursementResponse is a disbursement created at or reported by a provider. Status is one of
+// the Disbursement* values.
+type DisbursementResponse struct {
+	ProviderRef   string  `json:"provider_ref"`
+	ReferenceID   string  `json:"reference_id"`
+	Status        string  `json:"status"`
+	Amount        float64 `json:"amount"`
+	FailureReason string  `json:"failure_reason,omitempty"`
+	Raw           any     `json:"raw,omitempty"`
+}
+
+const (
+	DisbursementPending   = "PENDING"
+	DisbursementCompleted = "COMPLETED"
+	DisbursementFailed    = "FAILED"
+)
+
+// DisbursementProvider is a provider able to pay out money to bank accounts.
+type DisbursementProvider interface {
+	Disburse(req DisbursementRequest) (*DisbursementResponse, error)
+	GetDisbursement(providerRef string) (*DisbursementResponse, error)
+	// ParseDisbursementWebhook verifies and parses the callback of a disbursement.
+	ParseDisbursementWebhook(req WebhookRequest) (*DisbursementResponse, error)
+}
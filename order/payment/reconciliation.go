@@ -0,0 +1,188 @@
+package payment
+
+import (
+	"math"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm"
+)
+
+// ClearingReconciliation reconciles the clearing account of a payment provider, the account
+// receiving online payments until the provider pays them out.
+//
+// The clearing account is debited when a payment is received and credited when its settlement
+// is posted, so its closing balance should equal the paid payments that are not settled yet
+// (OutstandingAmount) adjusted by the settlement lines that could not be matched cleanly
+// (ExceptionAmount). Difference is the part of the balance that is not explained, e.g. payments
+// booked to another account.
+type ClearingReconciliation struct {
+	Provider            string                              `json:"provider"`
+	ClearingAccountID   string                              `json:"clearing_account_id"`
+	StartDate           time.Time                           `json:"start_date"`
+	EndDate             time.Time                           `json:"end_date"`
+	OpeningBalance      float64                             `json:"opening_balance"`
+	Debit               float64                             `json:"debit"`
+	Credit              float64                             `json:"credit"`
+	ClosingBalance      float64                             `json:"closing_balance"`
+	SettledGross        float64                             `json:"settled_gross"`
+	SettledFee          float64                             `json:"settled_fee"`
+	SettledNet          float64                             `json:"settled_net"`
+	OutstandingAmount   float64                             `json:"outstanding_amount"`
+	MissingAmount       float64                             `json:"missing_amount"`
+	ExceptionAmount     float64                             `json:"exception_amount"`
+	ExpectedBalance     float64                             `json:"expected_balance"`
+	Difference          float64                             `json:"difference"`
+	Settlements         []models.PaymentSettlementModel     `json:"settlements"`
+	OutstandingPayments []OutstandingPayment                `json:"outstanding_payments"`
+	Exceptions          []models.PaymentSettlementItemModel `json:"exceptions"`
+}
+
+// OutstandingPayment is a paid payment not covered by a posted settlement. Missing is true when
+// the payment is older than the settlement grace period, i.e. its settlement should have
+// arrived.
+type OutstandingPayment struct {
+	PaymentID     string     `json:"payment_id"`
+	Code          string     `json:"code"`
+	ProviderRef   string     `json:"provider_ref"`
+	PaymentMethod string     `json:"payment_method"`
+	RefID         string     `json:"ref_id"`
+	RefType       string     `json:"ref_type"`
+	PaidAt        *time.Time `json:"paid_at"`
+	Amount        float64    `json:"amount"`
+	AgeDays       int        `json:"age_days"`
+	Missing       bool       `json:"missing"`
+}
+
+// GetClearingReconciliation builds the reconciliation of the clearing account of a provider for
+// a period.
+//
+// Payments paid up to the end date that are not covered by a settlement posted up to the end
+// date are outstanding; those paid more than graceDays before the end date are flagged as
+// missing a settlement. The exceptions are the unmatched, duplicate and mismatched lines of the
+// settlements posted in the period.
+func (s *PaymentService) GetClearingReconciliation(companyID, provider, clearingAccountID string, start, end time.Time, graceDays int) (*ClearingReconciliation, error) {
+	report := ClearingReconciliation{
+		Provider:            provider,
+		ClearingAccountID:   clearingAccountID,
+		StartDate:           start,
+		EndDate:             end,
+		Settlements:         []models.PaymentSettlementModel{},
+		OutstandingPayments: []OutstandingPayment{},
+		Exceptions:          []models.PaymentSettlementItemModel{},
+	}
+
+	var opening, period struct {
+		Debit  float64
+		Credit float64
+	}
+	ledger := func() *gorm.DB {
+		stmt := s.db.Model(&models.TransactionModel{}).
+			Select("COALESCE(SUM(debit), 0) AS debit, COALESCE(SUM(credit), 0) AS credit").
+			Where("account_id = ?", clearingAccountID)
+		if companyID != "" {
+			stmt = stmt.Where("company_id = ?", companyID)
+		}
+		return stmt
+	}
+	if err := ledger().Where("date < ?", start).Scan(&opening).Error; err != nil {
+		return nil, err
+	}
+	if err := ledger().Where("date >= ? AND date <= ?", start, end).Scan(&period).Error; err != nil {
+		return nil, err
+	}
+	report.OpeningBalance = opening.Debit - opening.Credit
+	report.Debit = period.Debit
+	report.Credit = period.Credit
+	report.ClosingBalance = report.OpeningBalance + report.Debit - report.Credit
+
+	settlements := s.db.Where("provider = ? AND clearing_account_id = ? AND status = ?", provider, clearingAccountID, models.PaymentSettlementPosted)
+	if companyID != "" {
+		settlements = settlements.Where("company_id = ?", companyID)
+	}
+	if err := settlements.Where("settlement_date >= ? AND settlement_date <= ?", start, end).
+		Order("settlement_date asc").Find(&report.Settlements).Error; err != nil {
+		return nil, err
+	}
+	settlementIDs := []string{}
+	for _, v := range report.Settlements {
+		report.SettledGross += v.GrossAmount
+		report.SettledFee += v.FeeAmount
+		report.SettledNet += v.NetAmount
+		settlementIDs = append(settlementIDs, v.ID)
+	}
+	if len(settlementIDs) > 0 {
+		if err := s.db.Preload("Payment").
+			Where("settlement_id IN ? AND status <> ?", settlementIDs, models.SettlementItemMatched).
+			Order("line asc").Find(&report.Exceptions).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// every exception posted up to the end date is still part of the closing balance
+	var exceptions []models.PaymentSettlementItemModel
+	if err := s.db.Where("settlement_id IN (?)", s.postedSettlements(companyID, provider, clearingAccountID, end)).
+		Where("status <> ?", models.SettlementItemMatched).
+		Find(&exceptions).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range exceptions {
+		report.ExceptionAmount -= v.GrossAmount
+		if v.Status == models.SettlementItemMismatch {
+			report.ExceptionAmount += v.ExpectedAmount
+		}
+	}
+
+	var payments []models.PaymentModel
+	stmt := s.db.Where("payment_provider = ? AND status = ? AND paid_at <= ?", provider, models.PaymentStatusPaid, end).
+		Where("asset_account_id = ? OR asset_account_id IS NULL", clearingAccountID).
+		Where("id NOT IN (?)", s.db.Model(&models.PaymentSettlementItemModel{}).
+			Select("payment_id").
+			Where("payment_id IS NOT NULL AND status IN ?", []string{models.SettlementItemMatched, models.SettlementItemMismatch}).
+			Where("settlement_id IN (?)", s.postedSettlements(companyID, provider, clearingAccountID, end)))
+	if companyID != "" {
+		stmt = stmt.Where("company_id = ? OR company_id IS NULL", companyID)
+	}
+	if err := stmt.Order("paid_at asc").Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range payments {
+		outstanding := OutstandingPayment{
+			PaymentID:     v.ID,
+			Code:          v.Code,
+			ProviderRef:   v.ProviderRef,
+			PaymentMethod: v.PaymentMethod,
+			RefID:         v.RefID,
+			RefType:       v.RefType,
+			PaidAt:        v.PaidAt,
+			Amount:        v.PaidAmount - v.RefundedAmount,
+		}
+		if v.PaidAt != nil {
+			outstanding.AgeDays = int(end.Sub(*v.PaidAt).Hours() / 24)
+		}
+		outstanding.Missing = outstanding.AgeDays > graceDays
+		report.OutstandingAmount += outstanding.Amount
+		if outstanding.Missing {
+			report.MissingAmount += outstanding.Amount
+		}
+		report.OutstandingPayments = append(report.OutstandingPayments, outstanding)
+	}
+
+	report.ExpectedBalance = report.OutstandingAmount + report.ExceptionAmount
+	report.Difference = report.ClosingBalance - report.ExpectedBalance
+	if math.Abs(report.Difference) < amountEpsilon {
+		report.Difference = 0
+	}
+	return &report, nil
+}
+
+// postedSettlements selects the IDs of the settlements of a provider and clearing account posted
+// up to a date.
+func (s *PaymentService) postedSettlements(companyID, provider, clearingAccountID string, end time.Time) *gorm.DB {
+	stmt := s.db.Model(&models.PaymentSettlementModel{}).Select("id").
+		Where("provider = ? AND clearing_account_id = ? AND status = ? AND settlement_date <= ?", provider, clearingAccountID, models.PaymentSettlementPosted, end)
+	if companyID != "" {
+		stmt = stmt.Where("company_id = ?", companyID)
+	}
+	return stmt
+}
@@ -0,0 +1,107 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RefundPayment refunds a paid payment, fully or partially, through its provider. referenceID is
+// our reference of the refund, e.g. the code of a POS refund; amount 0 refunds the rest of the
+// paid amount.
+//
+// A refund the provider completes right away is applied to the payment as REFUNDED and kept as a
+// payment event with the ID "<refund ref>:SUCCEEDED", so the webhook of the same refund is a
+// duplicate. A pending refund is applied when its webhook arrives.
+func (s *PaymentService) RefundPayment(paymentID string, amount float64, referenceID, reason string) (*payment_provider.RefundResponse, error) {
+	payment, err := s.GetPaymentByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.Status != models.PaymentStatusPaid {
+		return nil, fmt.Errorf("payment %s is %s, only paid payments can be refunded", payment.Code, payment.Status)
+	}
+	refundable := payment.PaidAmount - payment.RefundedAmount
+	if amount <= 0 {
+		amount = refundable
+	}
+	if amount > refundable+amountEpsilon {
+		return nil, fmt.Errorf("refund amount exceeds the refundable amount %.2f", refundable)
+	}
+	provider, ok := s.PaymentProvider[payment.PaymentProvider].(payment_provider.RefundProvider)
+	if !ok {
+		return nil, fmt.Errorf("payment provider %s does not support refunds", payment.PaymentProvider)
+	}
+	resp, err := provider.RefundPayment(payment_provider.RefundRequest{
+		ReferenceID: referenceID,
+		ProviderRef: payment.ProviderRef,
+		Method:      payment_provider.PaymentMethod(payment.PaymentMethod),
+		Amount:      amount,
+		Reason:      reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == payment_provider.RefundFailed {
+		return resp, errors.New("refund was rejected by the payment provider")
+	}
+	if resp.Status != payment_provider.RefundSucceeded {
+		return resp, nil
+	}
+
+	refunded := resp.Amount
+	if refunded <= 0 {
+		refunded = amount
+	}
+	var changed bool
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		record := models.PaymentEventModel{
+			Provider:    payment.PaymentProvider,
+			EventID:     fmt.Sprintf("%s:%s", resp.ProviderRef, resp.Status),
+			PaymentID:   &payment.ID,
+			ProviderRef: payment.ProviderRef,
+			ReferenceID: referenceID,
+			Status:      models.PaymentStatusRefunded,
+			Amount:      refunded,
+			Payload:     "{}",
+			ReceivedAt:  now,
+		}
+		created := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "provider"}, {Name: "event_id"}},
+			DoNothing: true,
+		}).Create(&record)
+		if created.Error != nil {
+			return created.Error
+		}
+		if created.RowsAffected == 0 {
+			// the webhook of the refund was faster
+			return nil
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", payment.ID).First(payment).Error; err != nil {
+			return err
+		}
+		previous := payment.Status
+		var err error
+		changed, err = s.transition(tx, payment, StatusUpdate{Status: models.PaymentStatusRefunded, Amount: refunded, At: &now, Reason: reason})
+		if err != nil {
+			return err
+		}
+		return tx.Model(&record).Updates(map[string]any{
+			"previous_status": previous,
+			"result":          WebhookApplied,
+		}).Error
+	})
+	if err != nil {
+		return resp, err
+	}
+	if changed {
+		s.afterTransition(payment)
+	}
+	return resp, nil
+}
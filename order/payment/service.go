@@ -5,6 +5,8 @@ import (
 
 	"github.com/AMETORY/ametory-erp-modules/context"
 	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/order/pos"
+	"github.com/AMETORY/ametory-erp-modules/order/sales"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
 	"gorm.io/gorm"
 )
@@ -16,6 +18,9 @@ type PaymentService struct {
 	db              *gorm.DB
 	PaymentProvider map[string]payment_provider.PaymentProvider
 	activeProvider  string
+	webhookParsers  map[string]payment_provider.WebhookParser
+	salesService    *sales.SalesService
+	posService      *pos.POSService
 }
 
 // NewPaymentService creates a new instance of PaymentService.
@@ -24,24 +29,49 @@ func NewPaymentService(db *gorm.DB, ctx *context.ERPContext) *PaymentService {
 		ctx:             ctx,
 		db:              ctx.DB,
 		PaymentProvider: make(map[string]payment_provider.PaymentProvider, 0),
+		webhookParsers:  make(map[string]payment_provider.WebhookParser, 0),
 	}
 }
 
+// SetSalesService sets the sales service used to settle the sales invoices paid online.
+func (s *PaymentService) SetSalesService(salesService *sales.SalesService) {
+	s.salesService = salesService
+}
+
+// SetPOSService sets the POS service used to settle the POS sales paid online.
+func (s *PaymentService) SetPOSService(posService *pos.POSService) {
+	s.posService = posService
+}
+
 // AddPaymentProvider adds a new payment provider to the service and sets it
-// as the active provider.
+// as the active provider. Providers that parse webhooks are registered as the
+// webhook parser of the provider as well.
 func (s *PaymentService) AddPaymentProvider(providerName string, paymentProvider payment_provider.PaymentProvider) {
 	s.PaymentProvider[providerName] = paymentProvider
+	if parser, ok := paymentProvider.(payment_provider.WebhookParser); ok {
+		s.AddWebhookParser(providerName, parser)
+	}
 	s.SetActivePaymentProvider(providerName)
 }
 
+// AddWebhookParser sets the parser verifying the webhooks of a provider.
+func (s *PaymentService) AddWebhookParser(providerName string, parser payment_provider.WebhookParser) {
+	s.webhookParsers[providerName] = parser
+}
+
 // SetActivePaymentProvider sets the active payment provider.
 func (s *PaymentService) SetActivePaymentProvider(providerName string) {
 	s.activeProvider = providerName
 }
 
-// Migrate applies database migrations for the PaymentModel.
+// Migrate applies database migrations for the payment, payment event and settlement models.
 func Migrate(db *gorm.DB) error {
-	return db.AutoMigrate(&models.PaymentModel{})
+	return db.AutoMigrate(
+		&models.PaymentModel{},
+		&models.PaymentEventModel{},
+		&models.PaymentSettlementModel{},
+		&models.PaymentSettlementItemModel{},
+	)
 }
 
 // CreatePaymentLink creates a payment link using the active payment provider.
@@ -0,0 +1,600 @@
+package payment
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	SettlementFormatCSV  = "csv"
+	SettlementFormatJSON = "json"
+)
+
+// SettlementLine is a settled payment in the settlement report of a provider.
+//
+// ProviderRef is the ID of the payment at the provider and ReferenceID our reference of the
+// payment (PaymentModel.Code); a line is matched by either of them.
+type SettlementLine struct {
+	ProviderRef string     `json:"provider_ref"`
+	ReferenceID string     `json:"reference_id"`
+	Date        *time.Time `json:"date,omitempty"`
+	GrossAmount float64    `json:"gross_amount"`
+	FeeAmount   float64    `json:"fee_amount"`
+	NetAmount   float64    `json:"net_amount"`
+}
+
+// settlementColumns are the column names (CSV) or keys (JSON) of the settlement reports of OY
+// and Xendit, in order of preference.
+var settlementColumns = map[string][]string{
+	"provider_ref": {"provider_ref", "trx_id", "transaction_id", "tx_ref_number", "invoice_id", "id"},
+	"reference_id": {"reference_id", "partner_trx_id", "external_id", "reference", "order_id"},
+	"gross":        {"gross_amount", "amount", "transaction_amount", "gross"},
+	"fee":          {"fee_amount", "fee", "fees", "total_fee", "admin_fee", "mdr"},
+	"net":          {"net_amount", "settlement_amount", "settled_amount", "net"},
+	"date":         {"transaction_date", "date", "paid_at", "created", "settlement_date"},
+}
+
+var settlementDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"02/01/2006 15:04:05",
+	"02/01/2006",
+}
+
+// ParseSettlementReport reads the lines of a settlement report in CSV (with a header row) or
+// JSON (an array of objects, or an object with the array in "data") format.
+//
+// Columns are recognized by the names used in the reports of OY and Xendit, see
+// settlementColumns. A missing net amount is the gross amount minus the fee, a missing fee the
+// gross minus the net amount and a missing gross amount the net amount plus the fee.
+func ParseSettlementReport(format string, report io.Reader) ([]SettlementLine, error) {
+	var rows []map[string]string
+	var err error
+	switch strings.ToLower(format) {
+	case SettlementFormatCSV:
+		rows, err = readSettlementCSV(report)
+	case SettlementFormatJSON:
+		rows, err = readSettlementJSON(report)
+	default:
+		return nil, fmt.Errorf("settlement report format %s is not supported", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []SettlementLine{}
+	for i, row := range rows {
+		line, err := settlementLine(row)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		lines = append(lines, *line)
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("settlement report has no lines")
+	}
+	return lines, nil
+}
+
+// ImportSettlement records a settlement report of a provider as a draft settlement and matches
+// its lines to payments (see MatchSettlement).
+//
+// data must have the provider, the settlement date and the clearing, bank and fee accounts used
+// when the settlement is posted. A report whose ReportRef was already imported for the provider
+// is rejected.
+func (s *PaymentService) ImportSettlement(data *models.PaymentSettlementModel, format string, report io.Reader) error {
+	if data.Provider == "" {
+		return errors.New("provider is required")
+	}
+	if data.ClearingAccountID == nil || data.BankAccountID == nil || data.FeeAccountID == nil {
+		return errors.New("clearing, bank and fee accounts are required")
+	}
+	lines, err := ParseSettlementReport(format, report)
+	if err != nil {
+		return err
+	}
+	if data.ReportRef != "" {
+		var count int64
+		if err := s.db.Model(&models.PaymentSettlementModel{}).
+			Where("provider = ? AND report_ref = ?", data.Provider, data.ReportRef).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("settlement report %s of %s is already imported", data.ReportRef, data.Provider)
+		}
+	}
+	if data.SettlementDate.IsZero() {
+		data.SettlementDate = time.Now()
+	}
+	if data.Code == "" {
+		data.Code = fmt.Sprintf("STL-%s", utils.RandomStringNumber(8, false))
+	}
+	if data.ID == "" {
+		data.ID = utils.Uuid()
+	}
+	data.Status = models.PaymentSettlementDraft
+	data.Items = nil
+	for i, line := range lines {
+		data.Items = append(data.Items, models.PaymentSettlementItemModel{
+			BaseModel:       shared.BaseModel{ID: utils.Uuid()},
+			Line:            i + 1,
+			ProviderRef:     line.ProviderRef,
+			ReferenceID:     line.ReferenceID,
+			TransactionDate: line.Date,
+			GrossAmount:     line.GrossAmount,
+			FeeAmount:       line.FeeAmount,
+			NetAmount:       line.NetAmount,
+		})
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.matchItems(tx, data); err != nil {
+			return err
+		}
+		return tx.Create(data).Error
+	})
+}
+
+// MatchSettlement matches the lines of a draft settlement to payments again, e.g. after missing
+// payments were recorded.
+//
+// A line is matched to a payment of the provider by its provider reference or by the code of the
+// payment, and linked to the order the payment settles. The line is:
+//
+//   - MATCHED when the payment is paid and the gross amount equals the paid amount;
+//   - MISMATCH when the payment is not paid or the amounts differ;
+//   - UNMATCHED when no payment matches;
+//   - DUPLICATE when the payment is already covered by an earlier line of the report or by
+//     another settlement.
+func (s *PaymentService) MatchSettlement(id string) (*models.PaymentSettlementModel, error) {
+	var settlement models.PaymentSettlementModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items", func(db *gorm.DB) *gorm.DB {
+			return db.Order("line asc")
+		}).Where("id = ?", id).First(&settlement).Error; err != nil {
+			return err
+		}
+		if settlement.Status != models.PaymentSettlementDraft {
+			return errors.New("only draft settlements can be matched")
+		}
+		if err := s.matchItems(tx, &settlement); err != nil {
+			return err
+		}
+		for _, item := range settlement.Items {
+			if err := tx.Model(&models.PaymentSettlementItemModel{}).Where("id = ?", item.ID).Updates(map[string]any{
+				"payment_id":      item.PaymentID,
+				"expected_amount": item.ExpectedAmount,
+				"ref_id":          item.RefID,
+				"ref_type":        item.RefType,
+				"status":          item.Status,
+				"duplicate_of_id": item.DuplicateOfID,
+				"notes":           item.Notes,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&settlement).Updates(map[string]any{
+			"matched_count":   settlement.MatchedCount,
+			"mismatch_count":  settlement.MismatchCount,
+			"unmatched_count": settlement.UnmatchedCount,
+			"duplicate_count": settlement.DuplicateCount,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &settlement, nil
+}
+
+// PostSettlement posts a draft settlement to the ledger:
+//
+//   - the net amount is debited to the bank account and credited to the clearing account;
+//   - the fees are debited to the fee (expense) account and credited to the clearing account.
+//
+// Every line is posted, as its money was paid out by the provider; unmatched and duplicate lines
+// remain visible in the clearing account reconciliation until they are resolved. The fee of each
+// matched line is recorded on its payment.
+func (s *PaymentService) PostSettlement(id string, userID *string) (*models.PaymentSettlementModel, error) {
+	var settlement models.PaymentSettlementModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").
+			Where("id = ?", id).First(&settlement).Error; err != nil {
+			return err
+		}
+		if settlement.Status != models.PaymentSettlementDraft {
+			return errors.New("settlement is already posted")
+		}
+		description := fmt.Sprintf("Settlement %s %s", settlement.Provider, settlement.Code)
+		if settlement.ReportRef != "" {
+			description = fmt.Sprintf("%s (%s)", description, settlement.ReportRef)
+		}
+		if settlement.NetAmount > amountEpsilon {
+			if err := postSettlementJournal(tx, &settlement, "Penerimaan "+description, settlement.BankAccountID, settlement.ClearingAccountID, settlement.NetAmount, userID); err != nil {
+				return err
+			}
+		}
+		if settlement.FeeAmount > amountEpsilon {
+			if err := postSettlementJournal(tx, &settlement, "Biaya "+description, settlement.FeeAccountID, settlement.ClearingAccountID, settlement.FeeAmount, userID); err != nil {
+				return err
+			}
+		}
+		for _, item := range settlement.Items {
+			if item.PaymentID == nil || item.Status == models.SettlementItemDuplicate {
+				continue
+			}
+			if err := tx.Model(&models.PaymentModel{}).Where("id = ?", *item.PaymentID).
+				Update("payment_fee", item.FeeAmount).Error; err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		settlement.Status = models.PaymentSettlementPosted
+		settlement.PostedAt = &now
+		return tx.Model(&settlement).Updates(map[string]any{
+			"status":    settlement.Status,
+			"posted_at": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &settlement, nil
+}
+
+// DeleteSettlement deletes a draft settlement with its lines.
+func (s *PaymentService) DeleteSettlement(id string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var settlement models.PaymentSettlementModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&settlement).Error; err != nil {
+			return err
+		}
+		if settlement.Status != models.PaymentSettlementDraft {
+			return errors.New("posted settlements cannot be deleted")
+		}
+		if err := tx.Where("settlement_id = ?", id).Delete(&models.PaymentSettlementItemModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&settlement).Error
+	})
+}
+
+// GetSettlementByID retrieves a settlement with its lines and their payments.
+func (s *PaymentService) GetSettlementByID(id string) (*models.PaymentSettlementModel, error) {
+	var settlement models.PaymentSettlementModel
+	err := s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("line asc")
+	}).Preload("Items.Payment").
+		Preload("ClearingAccount").Preload("BankAccount").Preload("FeeAccount").
+		Where("id = ?", id).First(&settlement).Error
+	return &settlement, err
+}
+
+// GetSettlements retrieves a paginated list of settlements.
+//
+// The list can be filtered with the provider and status query parameters and is scoped to the
+// company in the ID-Company header.
+func (s *PaymentService) GetSettlements(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Model(&models.PaymentSettlementModel{})
+	if search != "" {
+		stmt = stmt.Where("code ILIKE ? OR report_ref ILIKE ? OR notes ILIKE ?", "%"+search+"%", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("provider") != "" {
+		stmt = stmt.Where("provider = ?", request.URL.Query().Get("provider"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Order("settlement_date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.PaymentSettlementModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// matchItems matches the lines of a settlement to payments and updates the totals and counts of
+// the settlement.
+func (s *PaymentService) matchItems(tx *gorm.DB, settlement *models.PaymentSettlementModel) error {
+	settlement.GrossAmount, settlement.FeeAmount, settlement.NetAmount = 0, 0, 0
+	settlement.MatchedCount, settlement.MismatchCount, settlement.UnmatchedCount, settlement.DuplicateCount = 0, 0, 0, 0
+	seen := map[string]*models.PaymentSettlementItemModel{}
+	for i := range settlement.Items {
+		item := &settlement.Items[i]
+		item.PaymentID, item.DuplicateOfID = nil, nil
+		item.ExpectedAmount, item.RefID, item.RefType, item.Notes = 0, "", "", ""
+		settlement.GrossAmount += item.GrossAmount
+		settlement.FeeAmount += item.FeeAmount
+		settlement.NetAmount += item.NetAmount
+
+		payment, err := s.findSettledPayment(tx, settlement, item)
+		if err != nil {
+			return err
+		}
+		if payment == nil {
+			item.Status = models.SettlementItemUnmatched
+			item.Notes = "no payment matches the provider reference or code"
+			settlement.UnmatchedCount++
+			continue
+		}
+		item.PaymentID = &payment.ID
+		item.ExpectedAmount = payment.PaidAmount
+		item.RefID, item.RefType = payment.RefID, payment.RefType
+		var posIDs []string
+		if err := tx.Model(&models.POSModel{}).Where("payment_id = ?", payment.ID).Pluck("id", &posIDs).Error; err != nil {
+			return err
+		}
+		if len(posIDs) > 0 {
+			item.RefID, item.RefType = posIDs[0], "pos"
+		}
+
+		if first, ok := seen[payment.ID]; ok {
+			item.Status = models.SettlementItemDuplicate
+			item.DuplicateOfID = &first.ID
+			item.Notes = fmt.Sprintf("payment %s is already settled by line %d", payment.Code, first.Line)
+			settlement.DuplicateCount++
+			continue
+		}
+		seen[payment.ID] = item
+
+		var other models.PaymentSettlementItemModel
+		err = tx.Joins("JOIN payment_settlements ON payment_settlements.id = payment_settlement_items.settlement_id").
+			Where("payment_settlement_items.payment_id = ? AND payment_settlement_items.settlement_id <> ?", payment.ID, settlement.ID).
+			Where("payment_settlement_items.status IN ?", []string{models.SettlementItemMatched, models.SettlementItemMismatch}).
+			Where("payment_settlements.deleted_at IS NULL").
+			Select("payment_settlement_items.*").
+			First(&other).Error
+		if err == nil {
+			item.Status = models.SettlementItemDuplicate
+			item.DuplicateOfID = &other.ID
+			item.Notes = fmt.Sprintf("payment %s is already settled by another settlement", payment.Code)
+			settlement.DuplicateCount++
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		switch {
+		case payment.Status != models.PaymentStatusPaid && payment.Status != models.PaymentStatusRefunded:
+			item.Status = models.SettlementItemMismatch
+			item.Notes = fmt.Sprintf("payment %s is %s", payment.Code, payment.Status)
+			settlement.MismatchCount++
+		case math.Abs(item.GrossAmount-payment.PaidAmount) > amountEpsilon:
+			item.Status = models.SettlementItemMismatch
+			item.Notes = fmt.Sprintf("settled amount %.2f differs from paid amount %.2f", item.GrossAmount, payment.PaidAmount)
+			settlement.MismatchCount++
+		default:
+			item.Status = models.SettlementItemMatched
+			settlement.MatchedCount++
+		}
+	}
+	return nil
+}
+
+// findSettledPayment finds the payment of a settlement line by its provider reference, then by
+// its code.
+func (s *PaymentService) findSettledPayment(tx *gorm.DB, settlement *models.PaymentSettlementModel, item *models.PaymentSettlementItemModel) (*models.PaymentModel, error) {
+	lookups := []struct {
+		column string
+		value  string
+	}{
+		{"provider_ref", item.ProviderRef},
+		{"code", item.ReferenceID},
+		{"provider_ref", item.ReferenceID},
+	}
+	for _, lookup := range lookups {
+		if lookup.value == "" {
+			continue
+		}
+		stmt := tx.Where("payment_provider = ?", settlement.Provider).Where(lookup.column+" = ?", lookup.value)
+		if settlement.CompanyID != nil {
+			stmt = stmt.Where("company_id = ? OR company_id IS NULL", *settlement.CompanyID)
+		}
+		var payment models.PaymentModel
+		err := stmt.First(&payment).Error
+		if err == nil {
+			return &payment, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func postSettlementJournal(tx *gorm.DB, settlement *models.PaymentSettlementModel, description string, debitAccountID, creditAccountID *string, amount float64, userID *string) error {
+	if debitAccountID == nil || creditAccountID == nil {
+		return errors.New("journal accounts are required")
+	}
+	debitID := utils.Uuid()
+	creditID := utils.Uuid()
+	err := tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: debitID},
+		Code:                        utils.RandString(10, false),
+		Date:                        settlement.SettlementDate,
+		AccountID:                   debitAccountID,
+		Description:                 description,
+		TransactionRefID:            &creditID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &settlement.ID,
+		TransactionSecondaryRefType: "payment_settlement",
+		CompanyID:                   settlement.CompanyID,
+		Debit:                       amount,
+		Amount:                      amount,
+		UserID:                      userID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: creditID},
+		Code:                        utils.RandString(10, false),
+		Date:                        settlement.SettlementDate,
+		AccountID:                   creditAccountID,
+		Description:                 description,
+		TransactionRefID:            &debitID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &settlement.ID,
+		TransactionSecondaryRefType: "payment_settlement",
+		CompanyID:                   settlement.CompanyID,
+		Credit:                      amount,
+		Amount:                      amount,
+		UserID:                      userID,
+	}).Error
+}
+
+func readSettlementCSV(report io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(report)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 1 {
+		return nil, errors.New("settlement report has no header")
+	}
+	header := make([]string, len(records[0]))
+	for i, v := range records[0] {
+		header[i] = settlementColumn(v)
+	}
+	rows := []map[string]string{}
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		empty := true
+		for i, v := range record {
+			if i < len(header) {
+				row[header[i]] = strings.TrimSpace(v)
+				empty = empty && strings.TrimSpace(v) == ""
+			}
+		}
+		if !empty {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func readSettlementJSON(report io.Reader) ([]map[string]string, error) {
+	var body json.RawMessage
+	if err := json.NewDecoder(report).Decode(&body); err != nil {
+		return nil, err
+	}
+	var objects []map[string]any
+	if err := json.Unmarshal(body, &objects); err != nil {
+		var wrapped struct {
+			Data []map[string]any `json:"data"`
+		}
+		if err := json.Unmarshal(body, &wrapped); err != nil {
+			return nil, err
+		}
+		objects = wrapped.Data
+	}
+	rows := []map[string]string{}
+	for _, object := range objects {
+		row := map[string]string{}
+		for k, v := range object {
+			switch value := v.(type) {
+			case nil:
+			case string:
+				row[settlementColumn(k)] = strings.TrimSpace(value)
+			case float64:
+				row[settlementColumn(k)] = strconv.FormatFloat(value, 'f', -1, 64)
+			default:
+				row[settlementColumn(k)] = fmt.Sprint(value)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func settlementColumn(name string) string {
+	name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+func settlementLine(row map[string]string) (*SettlementLine, error) {
+	value := func(field string) string {
+		for _, column := range settlementColumns[field] {
+			if v := row[column]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	line := SettlementLine{
+		ProviderRef: value("provider_ref"),
+		ReferenceID: value("reference_id"),
+	}
+	if line.ProviderRef == "" && line.ReferenceID == "" {
+		return nil, errors.New("no payment reference")
+	}
+	var err error
+	var hasGross, hasFee, hasNet bool
+	if line.GrossAmount, hasGross, err = settlementAmount(value("gross")); err != nil {
+		return nil, err
+	}
+	if line.FeeAmount, hasFee, err = settlementAmount(value("fee")); err != nil {
+		return nil, err
+	}
+	if line.NetAmount, hasNet, err = settlementAmount(value("net")); err != nil {
+		return nil, err
+	}
+	switch {
+	case hasGross && !hasNet:
+		line.NetAmount = line.GrossAmount - line.FeeAmount
+	case hasNet && !hasGross:
+		line.GrossAmount = line.NetAmount + line.FeeAmount
+	case hasGross && hasNet && !hasFee:
+		line.FeeAmount = line.GrossAmount - line.NetAmount
+	case !hasGross && !hasNet:
+		return nil, errors.New("no amount")
+	}
+	if date := value("date"); date != "" {
+		for _, layout := range settlementDateLayouts {
+			if t, err := time.Parse(layout, date); err == nil {
+				line.Date = &t
+				break
+			}
+		}
+		if line.Date == nil {
+			return nil, fmt.Errorf("invalid date %s", date)
+		}
+	}
+	return &line, nil
+}
+
+// settlementAmount parses an amount such as "150000", "150,000.00" or "Rp 150000". Fees are
+// reported as negative amounts by some providers, so the absolute value is returned.
+func settlementAmount(value string) (float64, bool, error) {
+	value = strings.NewReplacer(",", "", " ", "", "Rp", "", "IDR", "").Replace(value)
+	if value == "" {
+		return 0, false, nil
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid amount %s", value)
+	}
+	return math.Abs(amount), true, nil
+}
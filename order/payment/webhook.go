@@ -0,0 +1,175 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	WebhookApplied   = "APPLIED"
+	WebhookIgnored   = "IGNORED"
+	WebhookUnmatched = "UNMATCHED"
+	WebhookHeld      = "HELD"
+)
+
+// WebhookResult is the outcome of a webhook of a payment provider.
+//
+// Duplicate is true when the event was already received; the webhook should still be
+// acknowledged so that the provider stops retrying it.
+type WebhookResult struct {
+	Event     *payment_provider.WebhookEvent `json:"event"`
+	PaymentID *string                        `json:"payment_id,omitempty"`
+	Status    string                         `json:"status,omitempty"`
+	Result    string                         `json:"result"`
+	Duplicate bool                           `json:"duplicate"`
+	Notes     string                         `json:"notes,omitempty"`
+}
+
+// HandleWebhook verifies, records and applies a webhook of a payment provider.
+//
+// The parser registered for the provider verifies the callback token and maps the callback to a
+// provider-agnostic event. Every event is kept as a PaymentEventModel; an event whose ID was
+// already received is not applied again. The event is matched to a payment of the provider by
+// the provider reference or by the code of the payment, and drives the status of the payment
+// (see UpdatePaymentStatus). Events that cannot move the payment, such as EXPIRED for a paid
+// payment, and events without a status are recorded as IGNORED.
+//
+// A payment_provider.ErrInvalidCallbackToken error means the callback must be rejected
+// (HTTP 401); other errors mean the callback could not be processed and may be retried.
+func (s *PaymentService) HandleWebhook(providerName string, req payment_provider.WebhookRequest) (*WebhookResult, error) {
+	parser, ok := s.webhookParsers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("no webhook parser for payment provider %s", providerName)
+	}
+	event, err := parser.ParseWebhook(req)
+	if err != nil {
+		return nil, err
+	}
+	if event.EventID == "" {
+		return nil, errors.New("webhook event has no ID")
+	}
+
+	result := WebhookResult{Event: event}
+	var payment models.PaymentModel
+	var changed bool
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		record := models.PaymentEventModel{
+			Provider:    providerName,
+			EventID:     event.EventID,
+			ProviderRef: event.ProviderRef,
+			ReferenceID: event.ReferenceID,
+			Status:      event.Status,
+			Amount:      event.Amount,
+			Payload:     string(req.Body),
+			ReceivedAt:  time.Now(),
+		}
+		created := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "provider"}, {Name: "event_id"}},
+			DoNothing: true,
+		}).Create(&record)
+		if created.Error != nil {
+			return created.Error
+		}
+		if created.RowsAffected == 0 {
+			result.Duplicate = true
+			var existing models.PaymentEventModel
+			if err := tx.Where("provider = ? AND event_id = ?", providerName, event.EventID).First(&existing).Error; err != nil {
+				return err
+			}
+			result.PaymentID = existing.PaymentID
+			result.Result = existing.Result
+			return nil
+		}
+
+		stmt := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("payment_provider = ?", providerName)
+		switch {
+		case event.ProviderRef != "" && event.ReferenceID != "":
+			stmt = stmt.Where("provider_ref = ? OR code = ?", event.ProviderRef, event.ReferenceID)
+		case event.ProviderRef != "":
+			stmt = stmt.Where("provider_ref = ?", event.ProviderRef)
+		default:
+			stmt = stmt.Where("code = ?", event.ReferenceID)
+		}
+		err := stmt.First(&payment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			result.Result = WebhookUnmatched
+			return tx.Model(&record).Update("result", WebhookUnmatched).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		result.PaymentID = &payment.ID
+		previous := payment.Status
+		amount := event.Amount
+		if event.Status != models.PaymentStatusPaid && event.Status != models.PaymentStatusRefunded {
+			amount = 0
+		}
+		result.Result = WebhookApplied
+		if event.Status == "" {
+			// informational callbacks, such as a failed refund, do not move the payment
+			result.Result = WebhookIgnored
+			result.Notes = event.Reason
+		} else {
+			changed, err = s.transition(tx, &payment, StatusUpdate{Status: event.Status, Amount: amount, At: event.PaidAt, Reason: event.Reason})
+			if errors.Is(err, ErrInvalidTransition) {
+				result.Result = WebhookIgnored
+				result.Notes = err.Error()
+			} else if errors.Is(err, ErrUnderpaid) {
+				// an underpaid payment stays open for review instead of settling its documents
+				result.Result = WebhookHeld
+				result.Notes = err.Error()
+			} else if err != nil {
+				return err
+			} else if !changed {
+				result.Result = WebhookIgnored
+			}
+		}
+		if payment.ProviderRef == "" && event.ProviderRef != "" {
+			if err := tx.Model(&models.PaymentModel{}).Where("id = ?", payment.ID).Update("provider_ref", event.ProviderRef).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&record).Updates(map[string]any{
+			"payment_id":      payment.ID,
+			"previous_status": previous,
+			"result":          result.Result,
+			"notes":           result.Notes,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		s.afterTransition(&payment)
+	} else if result.PaymentID != nil {
+		// a retried event of a paid payment settles it if the first settlement failed
+		current, err := s.GetPaymentByID(*result.PaymentID)
+		if err == nil && current.Status == models.PaymentStatusPaid && current.SettledAt == nil {
+			if err := s.SettlePayment(current.ID); err != nil {
+				log.Println("ERROR PAYMENT SETTLEMENT", err)
+			}
+		}
+	}
+	if result.PaymentID != nil {
+		if current, err := s.GetPaymentByID(*result.PaymentID); err == nil {
+			result.Status = current.Status
+		}
+	}
+	return &result, nil
+}
+
+// GetPaymentEvents retrieves the webhook events received for a payment, oldest first.
+func (s *PaymentService) GetPaymentEvents(paymentID string) ([]models.PaymentEventModel, error) {
+	var events []models.PaymentEventModel
+	err := s.db.Where("payment_id = ?", paymentID).Order("received_at asc").Find(&events).Error
+	return events, err
+}
@@ -0,0 +1,76 @@
+package pos
+
+import (
+	"math"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm/clause"
+)
+
+// SettlePayment records amount paid by the online payment of a POS sale.
+//
+// Once the sale is paid in full a pending sale becomes COMPLETED, the sale journal is posted when
+// the sale has its sale and asset accounts, and the loyalty points are awarded. A sale paid for
+// less than its total keeps its status. Settling a paid sale again does nothing.
+func (s *POSService) SettlePayment(posID string, amount float64, paidAt time.Time) error {
+	var pos models.POSModel
+	if err := s.db.Preload("Merchant").Where("id = ?", posID).First(&pos).Error; err != nil {
+		return err
+	}
+	if pos.UserPaymentStatus == models.PaymentStatusPaid && pos.Paid >= pos.Total {
+		return nil
+	}
+	pos.Paid = math.Min(amount, pos.Total)
+	if pos.Paid+tenderEpsilon < pos.Total {
+		return s.db.Model(&models.POSModel{}).Where("id = ?", pos.ID).Update("paid", pos.Paid).Error
+	}
+	data := map[string]any{
+		"paid":                pos.Paid,
+		"user_payment_status": models.PaymentStatusPaid,
+	}
+	completed := pos.Status == "PENDING"
+	if completed {
+		data["status"] = "COMPLETED"
+	}
+	if err := s.db.Model(&models.POSModel{}).Where("id = ?", pos.ID).Updates(data).Error; err != nil {
+		return err
+	}
+	pos.UserPaymentStatus = models.PaymentStatusPaid
+	if pos.SaleAccountID != nil && pos.AssetAccountID != nil && s.financeService != nil && s.financeService.TransactionService != nil {
+		var merchant models.MerchantModel
+		if pos.Merchant != nil {
+			merchant = *pos.Merchant
+		}
+		if err := s.UpdateTransaction(&pos, merchant); err != nil {
+			return err
+		}
+	}
+	if completed {
+		s.earnLoyalty(pos.ID)
+		s.recordCommission(pos.ID)
+	}
+	return nil
+}
+
+// UpdatePaymentStatus records the status of the online payment of a POS sale that was not paid,
+// such as EXPIRED or FAILED. Pending sales whose payment expired or failed are cancelled and the
+// stock reserved for their cart or offer is released.
+func (s *POSService) UpdatePaymentStatus(posID string, status string) error {
+	var pos models.POSModel
+	if err := s.db.Select("id", "status", "user_payment_status", "cart_id", "offer_id").Where("id = ?", posID).First(&pos).Error; err != nil {
+		return err
+	}
+	pos.UserPaymentStatus = status
+	cancelled := pos.Status == "PENDING" && (status == models.PaymentStatusExpired || status == models.PaymentStatusFailed)
+	if cancelled {
+		pos.Status = "CANCELED"
+	}
+	if err := s.db.Model(&pos).Omit(clause.Associations).Select("status", "user_payment_status").Updates(&pos).Error; err != nil {
+		return err
+	}
+	if cancelled {
+		return s.releaseReservations(&pos)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/inventory/product"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+// ResolveItemPrice returns the price of a product, or of its variant, sold at the counter of a
+// merchant. The merchant price before the product discount is the base price; the price lists of
+// the contact, its customer groups, the merchant and the POS channel are applied to it. Without a
+// winning price list entry the discounted merchant price is used. The resolution explains which
+// entry won and why the others did not.
+func (s *POSService) ResolveItemPrice(merchantID, contactID *string, productID string, variantID *string, quantity float64) (*product.PriceResolution, error) {
+	if s.inventoryService == nil {
+		return nil, errors.New("inventory service is not initialized")
+	}
+	var companyID *string
+	var basePrice, price float64
+	if variantID != nil {
+		variant := models.VariantModel{}
+		variant.MerchantID = merchantID
+		if err := s.db.Where("id = ?", *variantID).First(&variant).Error; err != nil {
+			return nil, err
+		}
+		variant.GetPriceAndDiscount(s.db)
+		basePrice = variant.OriginalPrice + variant.AdjustmentPrice
+		price = variant.Price
+	} else {
+		p := models.ProductModel{}
+		p.MerchantID = merchantID
+		if err := s.db.Where("id = ?", productID).First(&p).Error; err != nil {
+			return nil, err
+		}
+		p.GetPriceAndDiscount(s.db)
+		basePrice = p.OriginalPrice + p.AdjustmentPrice
+		price = p.Price
+	}
+	if merchantID != nil {
+		var merchant models.MerchantModel
+		if err := s.db.Select("id", "company_id").First(&merchant, "id = ?", *merchantID).Error; err == nil {
+			companyID = merchant.CompanyID
+		}
+	}
+	resolution, err := s.inventoryService.PriceListService.ResolvePrice(product.PriceRequest{
+		CompanyID:  companyID,
+		ProductID:  productID,
+		VariantID:  variantID,
+		ContactID:  contactID,
+		MerchantID: merchantID,
+		Channel:    models.PriceChannelPOS,
+		Quantity:   quantity,
+		Date:       time.Now(),
+		BasePrice:  basePrice,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resolution.Rule == nil && price != basePrice {
+		resolution.Price = price
+		resolution.Explanation = append(resolution.Explanation, fmt.Sprintf("product discount applied, price %.2f", price))
+	}
+	return resolution, nil
+}
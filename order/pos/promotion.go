@@ -0,0 +1,76 @@
+package pos
+
+import (
+	"strconv"
+
+	"github.com/AMETORY/ametory-erp-modules/order/promotion"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm"
+)
+
+// resolvePromotions resolves the promotions of the company for the lines of a sale within tx
+// and lowers the unit price, subtotal and total of the discounted lines. The totals of the sale
+// are left to the caller. It returns nil when the promotion service is not set or no promotion
+// applies.
+func (s *POSService) resolvePromotions(tx *gorm.DB, pos *models.POSModel, companyID *string, voucherCodes []string) (*promotion.PromotionResolution, error) {
+	if s.promotionService == nil || companyID == nil {
+		return nil, nil
+	}
+	cart := promotion.PromotionCart{
+		ContactID:    pos.ContactID,
+		VoucherCodes: voucherCodes,
+		Date:         pos.SalesDate,
+		CompanyID:    companyID,
+	}
+	for i, v := range pos.Items {
+		if v.ProductID == nil || v.Quantity <= 0 {
+			continue
+		}
+		cart.Items = append(cart.Items, promotion.PromotionCartItem{
+			LineID:    strconv.Itoa(i),
+			ProductID: *v.ProductID,
+			VariantID: v.VariantID,
+			Quantity:  v.Quantity,
+			UnitPrice: v.Subtotal / v.Quantity,
+		})
+	}
+	if len(cart.Items) == 0 {
+		return nil, nil
+	}
+	s.promotionService.SetDB(tx)
+	defer s.promotionService.SetDB(s.db)
+	resolution, err := s.promotionService.ResolvePromotions(cart)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolution.Applied) == 0 {
+		return nil, nil
+	}
+	for _, line := range resolution.Lines {
+		if line.Discount <= 0 {
+			continue
+		}
+		i, err := strconv.Atoi(line.LineID)
+		if err != nil || i >= len(pos.Items) {
+			continue
+		}
+		item := &pos.Items[i]
+		item.UnitPrice -= line.Discount / item.Quantity
+		item.Subtotal -= line.Discount
+		if item.Total > 0 {
+			item.Total -= line.Discount
+		}
+	}
+	return resolution, nil
+}
+
+// redeemPromotions records the usage of the promotions of a saved sale within tx, so the sale is
+// not kept when a usage limit or voucher was taken in the meantime.
+func (s *POSService) redeemPromotions(tx *gorm.DB, resolution *promotion.PromotionResolution, pos *models.POSModel, userID *string, refType string) error {
+	if resolution == nil {
+		return nil
+	}
+	s.promotionService.SetDB(tx)
+	defer s.promotionService.SetDB(s.db)
+	return s.promotionService.RedeemPromotions(resolution, pos.ContactID, userID, pos.ID, refType)
+}
@@ -0,0 +1,107 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/AMETORY/ametory-erp-modules/order/stored_value"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm"
+)
+
+// redeemTenders redeems the loyalty points and the vouchers or gift cards paid with the tenders of
+// a saved sale within tx, so they are only spent when the sale is kept. The redemption is recorded
+// in the provider reference of its tender.
+func (s *POSService) redeemTenders(tx *gorm.DB, pos *models.POSModel, userID *string) error {
+	for i := range pos.Tenders {
+		tender := &pos.Tenders[i]
+		var ref string
+		var err error
+		switch tender.Method {
+		case models.POSTenderPoints:
+			ref, err = s.redeemPoints(tx, pos, tender, userID)
+		case models.POSTenderVoucher:
+			ref, err = s.redeemVoucher(tx, pos, tender, userID)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		tender.ProviderRef = ref
+		if err := tx.Model(&models.POSTenderModel{}).Where("id = ?", tender.ID).Update("provider_ref", ref).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redeemPoints redeems the points worth the amount of a POINTS tender as a payment of the sale and
+// returns the ID of the redemption ledger entry.
+func (s *POSService) redeemPoints(tx *gorm.DB, pos *models.POSModel, tender *models.POSTenderModel, userID *string) (string, error) {
+	if s.loyaltyService == nil {
+		return "", errors.New("loyalty service is not set")
+	}
+	if pos.ContactID == nil {
+		return "", errors.New("points can only be redeemed by a customer")
+	}
+	s.loyaltyService.SetDB(tx)
+	defer s.loyaltyService.SetDB(s.db)
+	program, err := s.loyaltyService.GetActiveProgram(pos.CompanyID)
+	if err != nil {
+		return "", err
+	}
+	if program.PointValue <= 0 {
+		return "", errors.New("points of this program cannot be redeemed")
+	}
+	points := tender.Amount / program.PointValue
+	if math.Abs(points-math.Round(points)) > 0.000001 {
+		return "", fmt.Errorf("points tender of %.2f is not a whole number of points", tender.Amount)
+	}
+	ledger, err := s.loyaltyService.Redeem(pos.CompanyID, *pos.ContactID, math.Round(points), pos.Total, models.LoyaltyRedeemPayment, pos.ID, "pos", userID)
+	if err != nil {
+		return "", err
+	}
+	return ledger.ID, nil
+}
+
+// redeemVoucher redeems the amount of a VOUCHER tender from the voucher or gift card with its code
+// and returns the ID of the redemption. The balance moves to the account of the tender, or else
+// the asset account of the sale, which the tender is journaled on.
+func (s *POSService) redeemVoucher(tx *gorm.DB, pos *models.POSModel, tender *models.POSTenderModel, userID *string) (string, error) {
+	if s.storedValueService == nil {
+		return "", errors.New("stored value service is not set")
+	}
+	if tender.Code == "" {
+		return "", errors.New("voucher tender requires the code of the voucher")
+	}
+	if pos.CompanyID == nil {
+		return "", errors.New("sale has no company")
+	}
+	accountID := tender.AccountID
+	if accountID == nil {
+		accountID = pos.AssetAccountID
+	}
+	s.storedValueService.SetDB(tx)
+	defer s.storedValueService.SetDB(s.db)
+	entry, err := s.storedValueService.Redeem(stored_value.RedeemRequest{
+		CompanyID:           *pos.CompanyID,
+		Code:                tender.Code,
+		Pin:                 tender.Pin,
+		Amount:              tender.Amount,
+		SettlementAccountID: accountID,
+		Date:                pos.SalesDate,
+		ReferenceID:         &pos.ID,
+		ReferenceType:       "pos",
+		Description:         fmt.Sprintf("Penjualan %s", pos.SalesNumber),
+		UserID:              userID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if -entry.Amount+tenderEpsilon < tender.Amount {
+		return "", fmt.Errorf("voucher balance of %.2f does not cover the tender of %.2f", -entry.Amount, tender.Amount)
+	}
+	return entry.ID, nil
+}
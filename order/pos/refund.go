@@ -0,0 +1,708 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/order/promotion"
+	"github.com/AMETORY/ametory-erp-modules/order/stored_value"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// refundEpsilon absorbs rounding differences between sale and refund amounts.
+const refundEpsilon = 0.005
+
+// PaymentRefunder refunds the online payment of a sale through its payment provider. It is
+// implemented by payment.PaymentService.
+type PaymentRefunder interface {
+	RefundPayment(paymentID string, amount float64, referenceID, reason string) (*payment_provider.RefundResponse, error)
+}
+
+// RefundLine is a sale line to refund. Restock puts the goods back into the warehouse they
+// left; it should be false for damaged goods.
+type RefundLine struct {
+	ItemID   string  `json:"item_id"`
+	Quantity float64 `json:"quantity"`
+	Restock  bool    `json:"restock"`
+}
+
+// RefundRequest describes a refund of a POS sale or merchant order.
+//
+// Full refunds the rest of the sale: every line not refunded yet, restocked, and the fees.
+// Otherwise Lines refunds lines by quantity at their discounted price, and Amount, when set,
+// is the amount refunded (with or without lines).
+//
+// Method is one of models.POSRefundMethod*. AccountID overrides the account a cash refund is
+// paid from (the cash account of the terminal by default) and TerminalID selects the shift of a
+// cash refund.
+type RefundRequest struct {
+	POSID      string       `json:"pos_id"`
+	Full       bool         `json:"full"`
+	Lines      []RefundLine `json:"lines"`
+	Amount     float64      `json:"amount"`
+	Method     string       `json:"method"`
+	AccountID  *string      `json:"account_id"`
+	TerminalID *string      `json:"terminal_id"`
+	Reason     string       `json:"reason"`
+	Date       time.Time    `json:"date"`
+}
+
+// SetPromotionService sets the promotion service. When it is set, sales redeem the promotions of
+// their company and the promotion usage of a fully refunded sale is reversed.
+func (s *POSService) SetPromotionService(promotionService *promotion.PromotionService) {
+	s.promotionService = promotionService
+}
+
+// SetStoredValueService sets the stored value service used to refund sales to store credit.
+func (s *POSService) SetStoredValueService(storedValueService *stored_value.StoredValueService) {
+	s.storedValueService = storedValueService
+}
+
+// SetPaymentRefunder sets the refunder used to refund online payments through their provider.
+func (s *POSService) SetPaymentRefunder(paymentRefunder PaymentRefunder) {
+	s.paymentRefunder = paymentRefunder
+}
+
+// CreateRefund creates a refund of a completed POS sale or merchant order.
+//
+// The refund cannot exceed what is left of the sale after the refunds that are completed or
+// waiting for approval, and a line cannot be refunded beyond its sold quantity. A refund above
+// the RefundApprovalLimit of the merchant waits for a manager (see ApproveRefund); any other
+// refund is processed right away, see ProcessRefund.
+func (s *POSService) CreateRefund(req RefundRequest, userID string) (*models.POSRefundModel, error) {
+	if req.Method != models.POSRefundMethodProvider && req.Method != models.POSRefundMethodCash && req.Method != models.POSRefundMethodStoreCredit {
+		return nil, errors.New("invalid refund method")
+	}
+	if !req.Full && len(req.Lines) == 0 && req.Amount <= 0 {
+		return nil, errors.New("refund lines or amount is required")
+	}
+	if req.Date.IsZero() {
+		req.Date = time.Now()
+	}
+
+	var refund models.POSRefundModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var pos models.POSModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", req.POSID).First(&pos).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("sales_id = ?", pos.ID).Find(&pos.Items).Error; err != nil {
+			return err
+		}
+		if !strings.EqualFold(pos.Status, "completed") {
+			return errors.New("only completed sales can be refunded")
+		}
+
+		var refunded float64
+		if err := tx.Model(&models.POSRefundModel{}).Select("COALESCE(SUM(amount), 0)").
+			Where("pos_id = ? AND status IN ?", pos.ID, openRefundStatuses()).
+			Scan(&refunded).Error; err != nil {
+			return err
+		}
+		remaining := pos.Total - refunded
+		if remaining <= refundEpsilon {
+			return errors.New("sale is already fully refunded")
+		}
+		refundedQty, err := s.refundedQuantities(tx, pos.ID)
+		if err != nil {
+			return err
+		}
+
+		refund = models.POSRefundModel{
+			BaseModel:     shared.BaseModel{ID: utils.Uuid()},
+			Code:          fmt.Sprintf("RFD-%s", utils.RandomStringNumber(8, false)),
+			Date:          req.Date,
+			POSID:         &pos.ID,
+			MerchantID:    pos.MerchantID,
+			CompanyID:     pos.CompanyID,
+			ContactID:     pos.ContactID,
+			Method:        req.Method,
+			Reason:        req.Reason,
+			Status:        models.POSRefundApproved,
+			PaymentID:     pos.PaymentID,
+			RequestedByID: &userID,
+		}
+
+		// the lines are refunded at their share of the sale total, net of the fees
+		factor := 1.0
+		itemsTotal := 0.0
+		for _, v := range pos.Items {
+			itemsTotal += v.Total
+		}
+		if itemsTotal > 0 {
+			if net := pos.Total - pos.ShippingFee - pos.ServiceFee - pos.PaymentFee; net > 0 {
+				factor = net / itemsTotal
+			}
+		}
+		addLine := func(item models.POSSalesItemModel, qty float64, restock bool) {
+			amount := 0.0
+			if item.Quantity > 0 {
+				amount = item.Total / item.Quantity * qty * factor
+			}
+			itemID := item.ID
+			refund.Items = append(refund.Items, models.POSRefundItemModel{
+				BaseModel:   shared.BaseModel{ID: utils.Uuid()},
+				POSItemID:   &itemID,
+				Description: item.Description,
+				ProductID:   item.ProductID,
+				VariantID:   item.VariantID,
+				WarehouseID: item.WarehouseID,
+				Quantity:    qty,
+				Amount:      math.Round(amount*100) / 100,
+				Restock:     restock,
+			})
+			refund.Amount += math.Round(amount*100) / 100
+		}
+
+		switch {
+		case req.Full:
+			for _, v := range pos.Items {
+				if qty := v.Quantity - refundedQty[v.ID]; qty > refundEpsilon {
+					addLine(v, qty, true)
+				}
+			}
+			refund.Amount = remaining
+		case len(req.Lines) > 0:
+			items := map[string]models.POSSalesItemModel{}
+			for _, v := range pos.Items {
+				items[v.ID] = v
+			}
+			for _, line := range req.Lines {
+				item, ok := items[line.ItemID]
+				if !ok {
+					return fmt.Errorf("item %s is not part of the sale", line.ItemID)
+				}
+				if line.Quantity <= 0 {
+					return fmt.Errorf("quantity of %s must be greater than zero", item.Description)
+				}
+				if line.Quantity > item.Quantity-refundedQty[item.ID]+refundEpsilon {
+					return fmt.Errorf("quantity of %s exceeds the refundable quantity %.2f", item.Description, item.Quantity-refundedQty[item.ID])
+				}
+				refundedQty[item.ID] += line.Quantity
+				addLine(item, line.Quantity, line.Restock)
+			}
+		}
+		if req.Amount > 0 {
+			refund.Amount = req.Amount
+		}
+		if refund.Amount <= 0 {
+			return errors.New("refund amount must be greater than zero")
+		}
+		if refund.Amount > remaining+refundEpsilon {
+			return fmt.Errorf("refund amount exceeds the refundable amount %.2f", remaining)
+		}
+		refund.Type = models.POSRefundPartial
+		if refund.Amount >= remaining-refundEpsilon {
+			refund.Type = models.POSRefundFull
+		}
+
+		if err := s.refundSource(tx, &pos, &refund, req); err != nil {
+			return err
+		}
+		if pos.MerchantID != nil {
+			var merchant models.MerchantModel
+			if err := tx.Select("id", "refund_approval_limit").Where("id = ?", *pos.MerchantID).First(&merchant).Error; err != nil {
+				return err
+			}
+			if merchant.RefundApprovalLimit > 0 && refund.Amount > merchant.RefundApprovalLimit+refundEpsilon {
+				refund.Status = models.POSRefundPendingApproval
+			}
+		}
+		return tx.Create(&refund).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status == models.POSRefundPendingApproval {
+		return &refund, nil
+	}
+	if err := s.processRefund(&refund, userID); err != nil {
+		return &refund, err
+	}
+	return &refund, nil
+}
+
+// ApproveRefund approves a refund waiting for approval and processes it. The manager approving
+// the refund cannot be the user who requested it.
+func (s *POSService) ApproveRefund(id string, userID string) (*models.POSRefundModel, error) {
+	refund, err := s.GetRefundByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status != models.POSRefundPendingApproval {
+		return nil, errors.New("refund is not waiting for approval")
+	}
+	if refund.RequestedByID != nil && *refund.RequestedByID == userID {
+		return nil, errors.New("refund cannot be approved by its requester")
+	}
+	now := time.Now()
+	result := s.db.Model(&models.POSRefundModel{}).Where("id = ? AND status = ?", refund.ID, models.POSRefundPendingApproval).
+		Updates(map[string]any{
+			"status":         models.POSRefundApproved,
+			"approved_by_id": userID,
+			"approved_at":    now,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("refund is not waiting for approval")
+	}
+	refund.Status = models.POSRefundApproved
+	refund.ApprovedByID = &userID
+	refund.ApprovedAt = &now
+	if err := s.processRefund(refund, userID); err != nil {
+		return refund, err
+	}
+	return refund, nil
+}
+
+// RejectRefund rejects a refund waiting for approval. A failed refund that was not refunded at
+// the payment provider can be rejected as well, giving its amount back to the sale.
+func (s *POSService) RejectRefund(id string, userID string, reason string) error {
+	result := s.db.Model(&models.POSRefundModel{}).Where("id = ?", id).
+		Where("status = ? OR (status = ? AND provider_ref = ?)", models.POSRefundPendingApproval, models.POSRefundFailed, "").
+		Updates(map[string]any{
+			"status":         models.POSRefundRejected,
+			"approved_by_id": userID,
+			"approved_at":    time.Now(),
+			"notes":          reason,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("refund cannot be rejected")
+	}
+	return nil
+}
+
+// ProcessRefund processes an approved refund again, e.g. after its payment provider refused it or
+// after its entries could not be posted. A refund already refunded at the provider is not sent to
+// the provider again.
+func (s *POSService) ProcessRefund(id string, userID string) (*models.POSRefundModel, error) {
+	refund, err := s.GetRefundByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status != models.POSRefundApproved && refund.Status != models.POSRefundFailed {
+		return nil, fmt.Errorf("refund is %s", refund.Status)
+	}
+	if err := s.processRefund(refund, userID); err != nil {
+		return refund, err
+	}
+	return refund, nil
+}
+
+// GetRefundByID retrieves a refund with its items.
+func (s *POSService) GetRefundByID(id string) (*models.POSRefundModel, error) {
+	var refund models.POSRefundModel
+	err := s.db.Preload("Items").Preload("RequestedBy", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name")
+	}).Preload("ApprovedBy", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name")
+	}).Where("id = ?", id).First(&refund).Error
+	if err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// GetRefunds retrieves a paginated list of refunds.
+//
+// The list can be filtered with the pos_id, status and method query parameters and is scoped
+// to the company and merchant in the ID-Company and ID-Merchant headers.
+func (s *POSService) GetRefunds(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("RequestedBy", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name")
+	}).Model(&models.POSRefundModel{})
+	if search != "" {
+		stmt = stmt.Where("code ILIKE ? OR reason ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.Header.Get("ID-Merchant") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.Header.Get("ID-Merchant"))
+	}
+	if request.URL.Query().Get("pos_id") != "" {
+		stmt = stmt.Where("pos_id = ?", request.URL.Query().Get("pos_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	if request.URL.Query().Get("method") != "" {
+		stmt = stmt.Where("method = ?", request.URL.Query().Get("method"))
+	}
+	stmt = stmt.Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.POSRefundModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// refundSource checks that the refund can be paid with its method and sets the account the money
+// leaves from: the clearing account of the payment for provider refunds, the cash account of the
+// terminal for cash refunds and the deferred revenue account for store credit.
+func (s *POSService) refundSource(tx *gorm.DB, pos *models.POSModel, refund *models.POSRefundModel, req RefundRequest) error {
+	switch refund.Method {
+	case models.POSRefundMethodProvider:
+		if pos.PaymentID == nil {
+			return errors.New("sale has no online payment to refund")
+		}
+		if s.paymentRefunder == nil {
+			return errors.New("payment refunds are not available")
+		}
+		var payment models.PaymentModel
+		if err := tx.Select("id", "asset_account_id").Where("id = ?", *pos.PaymentID).First(&payment).Error; err != nil {
+			return err
+		}
+		refund.AccountID = payment.AssetAccountID
+		if refund.AccountID == nil {
+			refund.AccountID = pos.AssetAccountID
+		}
+	case models.POSRefundMethodCash:
+		if pos.MerchantID != nil {
+			var merchant models.MerchantModel
+			if err := tx.Select("id", "require_open_shift").Where("id = ?", *pos.MerchantID).First(&merchant).Error; err != nil {
+				return err
+			}
+			shift, err := FindOpenShift(tx, merchant.ID, req.TerminalID)
+			if err != nil && (!errors.Is(err, ErrNoOpenShift) || merchant.RequireOpenShift) {
+				return err
+			}
+			if shift != nil {
+				refund.ShiftID = &shift.ID
+				var terminal models.POSTerminalModel
+				if shift.TerminalID != nil && tx.Select("id", "cash_account_id").Where("id = ?", *shift.TerminalID).First(&terminal).Error == nil {
+					refund.AccountID = terminal.CashAccountID
+				}
+			}
+		}
+		if req.AccountID != nil {
+			refund.AccountID = req.AccountID
+		}
+		if refund.AccountID == nil {
+			refund.AccountID = pos.AssetAccountID
+		}
+	case models.POSRefundMethodStoreCredit:
+		if pos.ContactID == nil || pos.CompanyID == nil {
+			return errors.New("sale has no customer to refund to store credit")
+		}
+		if s.storedValueService == nil {
+			return errors.New("store credit is not available")
+		}
+		if pos.SaleAccountID == nil {
+			// the store credit liability is only booked by the refund journal
+			return errors.New("sale has no sale account to refund to store credit")
+		}
+		account, err := s.storedValueService.LiabilityAccount(*pos.CompanyID)
+		if err != nil {
+			return err
+		}
+		refund.AccountID = &account.ID
+	}
+	return nil
+}
+
+// processRefund pays an approved refund back and records it: the money is refunded through the
+// payment provider, the cash drawer or store credit, the restocked goods go back to the
+// warehouse they were sold from, the reversing entries are posted and the promotions and loyalty
+// points of the sale are reversed.
+func (s *POSService) processRefund(refund *models.POSRefundModel, userID string) error {
+	var pos models.POSModel
+	if err := s.db.Where("id = ?", *refund.POSID).First(&pos).Error; err != nil {
+		return err
+	}
+	if refund.Method == models.POSRefundMethodProvider && s.paymentRefunder == nil {
+		return errors.New("payment refunds are not available")
+	}
+	if refund.Method == models.POSRefundMethodStoreCredit && s.storedValueService == nil {
+		return errors.New("store credit is not available")
+	}
+	if refund.Method == models.POSRefundMethodStoreCredit && (pos.SaleAccountID == nil || refund.AccountID == nil) {
+		return errors.New("sale has no sale account to refund to store credit")
+	}
+
+	if refund.Method == models.POSRefundMethodProvider && refund.ProviderRef == "" {
+		resp, err := s.paymentRefunder.RefundPayment(*refund.PaymentID, refund.Amount, refund.Code, refund.Reason)
+		if err != nil {
+			refund.Status = models.POSRefundFailed
+			refund.Notes = err.Error()
+			if resp != nil {
+				refund.ProviderStatus = resp.Status
+			}
+			if err := s.db.Model(&models.POSRefundModel{}).Where("id = ?", refund.ID).Updates(map[string]any{
+				"status":          refund.Status,
+				"notes":           refund.Notes,
+				"provider_status": refund.ProviderStatus,
+			}).Error; err != nil {
+				log.Println("ERROR REFUND", err)
+			}
+			return err
+		}
+		refund.ProviderRef = resp.ProviderRef
+		refund.ProviderStatus = resp.Status
+		// the refund is kept even when its entries fail below, so it is not sent twice
+		if err := s.db.Model(&models.POSRefundModel{}).Where("id = ?", refund.ID).Updates(map[string]any{
+			"provider_ref":    refund.ProviderRef,
+			"provider_status": refund.ProviderStatus,
+		}).Error; err != nil {
+			log.Println("ERROR REFUND", err)
+		}
+	}
+
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for i := range refund.Items {
+			if err := s.restockRefundItem(tx, &pos, refund, &refund.Items[i], userID); err != nil {
+				return err
+			}
+		}
+		if pos.SaleAccountID != nil && refund.AccountID != nil {
+			if err := s.postRefundJournal(tx, &pos, refund, userID); err != nil {
+				return err
+			}
+		}
+		if refund.Method == models.POSRefundMethodStoreCredit && refund.StoredValueTransactionID == nil {
+			// the liability is booked by the refund journal above, this only credits the customer
+			s.storedValueService.SetDB(tx)
+			defer s.storedValueService.SetDB(s.db)
+			entry, err := s.storedValueService.CreditStoreCredit(*pos.CompanyID, *pos.ContactID, refund.Amount, nil, refund.Date, &refund.ID, "pos_refund", fmt.Sprintf("Refund %s", refund.Code), &userID)
+			if err != nil {
+				return err
+			}
+			refund.StoredValueTransactionID = &entry.ID
+		}
+		refund.Status = models.POSRefundCompleted
+		refund.CompletedAt = &now
+		refund.Notes = ""
+		if err := tx.Model(&models.POSRefundModel{}).Where("id = ?", refund.ID).Updates(map[string]any{
+			"status":                      refund.Status,
+			"completed_at":                now,
+			"notes":                       "",
+			"stored_value_transaction_id": refund.StoredValueTransactionID,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.POSModel{}).Where("id = ?", pos.ID).Updates(map[string]any{
+			"refunded_amount": gorm.Expr("refunded_amount + ?", refund.Amount),
+			"refunded_at":     now,
+		}).Error
+	})
+	if err != nil {
+		refund.Status = models.POSRefundFailed
+		refund.Notes = err.Error()
+		if err := s.db.Model(&models.POSRefundModel{}).Where("id = ?", refund.ID).Updates(map[string]any{
+			"status": refund.Status,
+			"notes":  refund.Notes,
+		}).Error; err != nil {
+			log.Println("ERROR REFUND", err)
+		}
+		return err
+	}
+
+	fully := pos.RefundedAmount+refund.Amount >= pos.Total-refundEpsilon
+	if fully && s.promotionService != nil {
+		for _, refType := range []string{"pos", "merchant_order"} {
+			if err := s.promotionService.ReversePromotionUsage(refType, pos.ID); err != nil {
+				log.Println("ERROR PROMOTION", err)
+			}
+		}
+	}
+	if s.loyaltyService != nil && pos.ContactID != nil {
+		amount := refund.Amount
+		if fully {
+			amount = 0
+		}
+		if err := s.loyaltyService.ReverseReference("pos", pos.ID, refund.ID, amount, fmt.Sprintf("Refund %s", refund.Code), &userID); err != nil {
+			log.Println("ERROR LOYALTY", err)
+		}
+	}
+	if s.marketplaceService != nil && pos.MerchantID != nil {
+		if err := s.marketplaceService.RecordRefund(refund); err != nil {
+			log.Println("ERROR COMMISSION", err)
+		}
+	}
+	return nil
+}
+
+// restockRefundItem puts a refunded line back into the warehouse it was sold from, keeping the
+// owner of consigned goods, whose consignment sale and supplier payable are reversed. Goods that never left the stock, e.g. an order not picked yet, are
+// not restocked.
+func (s *POSService) restockRefundItem(tx *gorm.DB, pos *models.POSModel, refund *models.POSRefundModel, item *models.POSRefundItemModel, userID string) error {
+	if !item.Restock || item.ProductID == nil || item.StockMovementID != nil {
+		return nil
+	}
+	var sold models.StockMovementModel
+	stmt := tx.Where("reference_id = ? AND product_id = ? AND quantity < 0", pos.ID, *item.ProductID)
+	if item.VariantID != nil {
+		stmt = stmt.Where("variant_id = ?", *item.VariantID)
+	}
+	err := stmt.Order("date desc").First(&sold).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	refType := "pos_refund"
+	secondaryRefType := "pos_sales"
+	movement := models.StockMovementModel{
+		Date:             refund.Date,
+		Description:      fmt.Sprintf("Refund %s (%s)", refund.Code, item.Description),
+		ProductID:        *item.ProductID,
+		VariantID:        item.VariantID,
+		WarehouseID:      sold.WarehouseID,
+		MerchantID:       sold.MerchantID,
+		CompanyID:        sold.CompanyID,
+		Quantity:         item.Quantity,
+		Value:            sold.Value,
+		Type:             models.MovementTypeReturn,
+		ReferenceID:      refund.ID,
+		ReferenceType:    &refType,
+		SecondaryRefID:   &pos.ID,
+		SecondaryRefType: &secondaryRefType,
+		UnitID:           sold.UnitID,
+		OwnerID:          sold.OwnerID,
+	}
+	if movement.Value == 0 {
+		movement.Value = 1
+	}
+	if err := tx.Omit(clause.Associations).Create(&movement).Error; err != nil {
+		return err
+	}
+	if sold.OwnerID != nil && item.POSItemID != nil && s.inventoryService != nil && s.inventoryService.ConsignmentService != nil {
+		// the goods are back in the consignment stock of the supplier, so they are no longer sold
+		if err := s.inventoryService.ConsignmentService.ReverseSale(tx, pos.ID, *item.POSItemID, *sold.OwnerID, item.Quantity, refund.Date, refund.Code, &userID); err != nil {
+			return err
+		}
+	}
+	item.WarehouseID = &sold.WarehouseID
+	item.StockMovementID = &movement.ID
+	return tx.Model(&models.POSRefundItemModel{}).Where("id = ?", item.ID).Updates(map[string]any{
+		"warehouse_id":      sold.WarehouseID,
+		"stock_movement_id": movement.ID,
+	}).Error
+}
+
+// postRefundJournal reverses the revenue of the refunded amount against the account the refund is
+// paid from. The tax share of the sale in the refund is reversed on the tax account of the
+// company.
+func (s *POSService) postRefundJournal(tx *gorm.DB, pos *models.POSModel, refund *models.POSRefundModel, userID string) error {
+	var count int64
+	if err := tx.Model(&models.TransactionModel{}).
+		Where("transaction_secondary_ref_id = ? AND transaction_secondary_ref_type = ?", refund.ID, "pos_refund").
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	var tax float64
+	if pos.TaxAmount > 0 && pos.Total > 0 {
+		tax = utils.AmountRound(math.Min(refund.Amount*pos.TaxAmount/pos.Total, refund.Amount), 2)
+	}
+	var taxAccount models.AccountModel
+	if tax > 0 {
+		if err := tx.Where("type = ? AND company_id = ? AND is_tax = ?", models.LIABILITY, pos.CompanyID, true).First(&taxAccount).Error; err != nil {
+			return errors.New("tax account not found")
+		}
+	}
+	description := fmt.Sprintf("Refund %s %s", refund.Code, pos.SalesNumber)
+	creditID := utils.Uuid()
+	debits := []models.TransactionModel{{
+		AccountID: pos.SaleAccountID,
+		Debit:     refund.Amount - tax,
+		Amount:    refund.Amount - tax,
+	}}
+	if tax > 0 {
+		debits = append(debits, models.TransactionModel{
+			AccountID: &taxAccount.ID,
+			Debit:     tax,
+			Amount:    tax,
+			IsTax:     true,
+		})
+	}
+	var debitID string
+	for _, debit := range debits {
+		if debit.Amount <= 0 {
+			continue
+		}
+		debit.ID = utils.Uuid()
+		debit.Code = utils.RandString(10, false)
+		debit.Date = refund.Date
+		debit.Description = description
+		debit.Notes = refund.Reason
+		debit.TransactionRefID = &creditID
+		debit.TransactionRefType = "transaction"
+		debit.TransactionSecondaryRefID = &refund.ID
+		debit.TransactionSecondaryRefType = "pos_refund"
+		debit.CompanyID = pos.CompanyID
+		debit.UserID = &userID
+		if err := tx.Create(&debit).Error; err != nil {
+			return err
+		}
+		if debitID == "" {
+			debitID = debit.ID
+		}
+	}
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: creditID},
+		Code:                        utils.RandString(10, false),
+		Date:                        refund.Date,
+		AccountID:                   refund.AccountID,
+		Description:                 description,
+		Notes:                       refund.Reason,
+		TransactionRefID:            &debitID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &refund.ID,
+		TransactionSecondaryRefType: "pos_refund",
+		CompanyID:                   pos.CompanyID,
+		Credit:                      refund.Amount,
+		Amount:                      refund.Amount,
+		UserID:                      &userID,
+	}).Error
+}
+
+// refundedQuantities sums the refunded quantity of every line of a sale over the refunds that are
+// completed or waiting for approval.
+func (s *POSService) refundedQuantities(tx *gorm.DB, posID string) (map[string]float64, error) {
+	var rows []struct {
+		POSItemID string
+		Quantity  float64
+	}
+	err := tx.Model(&models.POSRefundItemModel{}).
+		Select("pos_refund_items.pos_item_id, COALESCE(SUM(pos_refund_items.quantity), 0) AS quantity").
+		Joins("JOIN pos_refunds ON pos_refunds.id = pos_refund_items.refund_id").
+		Where("pos_refunds.pos_id = ? AND pos_refunds.status IN ? AND pos_refunds.deleted_at IS NULL", posID, openRefundStatuses()).
+		Where("pos_refund_items.pos_item_id IS NOT NULL").
+		Group("pos_refund_items.pos_item_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	quantities := map[string]float64{}
+	for _, v := range rows {
+		quantities[v.POSItemID] = v.Quantity
+	}
+	return quantities, nil
+}
+
+// openRefundStatuses are the statuses of the refunds that count against the refundable amount of
+// a sale.
+func openRefundStatuses() []string {
+	return []string{models.POSRefundPendingApproval, models.POSRefundApproved, models.POSRefundCompleted, models.POSRefundFailed}
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"log"
+	"math"
 	"net/http"
 	"strings"
 	"time"
@@ -15,6 +17,10 @@ import (
 	"github.com/AMETORY/ametory-erp-modules/context"
 	"github.com/AMETORY/ametory-erp-modules/finance"
 	"github.com/AMETORY/ametory-erp-modules/inventory"
+	"github.com/AMETORY/ametory-erp-modules/order/loyalty"
+	"github.com/AMETORY/ametory-erp-modules/order/marketplace"
+	"github.com/AMETORY/ametory-erp-modules/order/promotion"
+	"github.com/AMETORY/ametory-erp-modules/order/stored_value"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
 	"github.com/AMETORY/ametory-erp-modules/shared/objects"
 	"github.com/AMETORY/ametory-erp-modules/utils"
@@ -24,11 +30,16 @@ import (
 )
 
 type POSService struct {
-	ctx              *context.ERPContext
-	db               *gorm.DB
-	financeService   *finance.FinanceService
-	contactService   *contact.ContactService
-	inventoryService *inventory.InventoryService
+	ctx                *context.ERPContext
+	db                 *gorm.DB
+	financeService     *finance.FinanceService
+	contactService     *contact.ContactService
+	inventoryService   *inventory.InventoryService
+	loyaltyService     *loyalty.LoyaltyService
+	promotionService   *promotion.PromotionService
+	storedValueService *stored_value.StoredValueService
+	paymentRefunder    PaymentRefunder
+	marketplaceService *marketplace.MarketplaceService
 }
 
 // NewPOSService creates a new instance of POSService with the given database connection, context and finance service.
@@ -53,9 +64,20 @@ func NewPOSService(db *gorm.DB, ctx *context.ERPContext, financeService *finance
 	}
 }
 
+// SetLoyaltyService sets the loyalty service. When it is set, completed POS sales earn loyalty points.
+func (s *POSService) SetLoyaltyService(loyaltyService *loyalty.LoyaltyService) {
+	s.loyaltyService = loyaltyService
+}
+
+// SetMarketplaceService sets the marketplace service. When it is set, completed merchant orders
+// are charged the platform commission and credited to the balance of the merchant.
+func (s *POSService) SetMarketplaceService(marketplaceService *marketplace.MarketplaceService) {
+	s.marketplaceService = marketplaceService
+}
+
 // Migrate migrates the POS models.
 func Migrate(db *gorm.DB) error {
-	return db.AutoMigrate(&models.POSModel{}, &models.POSSalesItemModel{})
+	return db.AutoMigrate(&models.POSModel{}, &models.POSSalesItemModel{}, &models.POSTerminalModel{}, &models.POSShiftModel{}, &models.POSShiftEventModel{}, &models.POSRefundModel{}, &models.POSRefundItemModel{}, &models.POSTenderModel{})
 }
 
 // CreateMerchant creates a new merchant.
@@ -74,7 +96,15 @@ func (s *POSService) CreateMerchant(name, address, phone string) (*models.Mercha
 }
 
 // CreatePosFromCart creates a new POS from the given cart.
-func (s *POSService) CreatePosFromCart(cart models.CartModel, paymentID *string, salesNumber, paymentType, paymentTypeProvider, userPaymentStatus string, taxAmount float64, assetAccountID, saleAccountID *string) (*models.POSModel, *objects.NewUserData, error) {
+//
+// A cart paid at the counter with one or more tenders, e.g. part cash and part QRIS, is completed
+// right away; the tenders must cover the total and only cash gives change (see TenderChange).
+//
+// When the promotion service is set, the promotions of the cart, including its voucher code, are
+// resolved again and redeemed within the transaction that saves the sale. The sale is refused when
+// they no longer give the PromotionDiscount the cart was priced with. Loyalty points and vouchers
+// paid with POINTS and VOUCHER tenders are redeemed within the same transaction.
+func (s *POSService) CreatePosFromCart(cart models.CartModel, paymentID *string, salesNumber, paymentType, paymentTypeProvider, userPaymentStatus string, taxAmount float64, assetAccountID, saleAccountID *string, tenders ...models.POSTenderModel) (*models.POSModel, *objects.NewUserData, error) {
 	var notifUserData *objects.NewUserData
 	customerData := struct {
 		FullName         string `json:"full_name"`
@@ -103,6 +133,7 @@ func (s *POSService) CreatePosFromCart(cart models.CartModel, paymentID *string,
 			Quantity:                v.Quantity,
 			UnitPrice:               v.Price,
 			UnitPriceBeforeDiscount: v.OriginalPrice,
+			PriceListItemID:         v.PriceListItemID,
 			Subtotal:                v.SubTotal,
 			SubtotalBeforeDisc:      v.SubTotalBeforeDiscount,
 			Height:                  v.Height,
@@ -182,10 +213,49 @@ func (s *POSService) CreatePosFromCart(cart models.CartModel, paymentID *string,
 		SaleAccountID:          saleAccountID,
 		TotalDiscount:          totalDiscount,
 	}
+	if len(tenders) > 0 {
+		if err := s.prepareTenders(&pos, tenders); err != nil {
+			return nil, nil, err
+		}
+		pos.Status = "COMPLETED"
+	}
 
-	if err := s.db.Create(&pos).Error; err != nil {
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var voucherCodes []string
+		if cart.VoucherCode != "" {
+			voucherCodes = []string{cart.VoucherCode}
+		}
+		resolution, err := s.resolvePromotions(tx, &pos, merchant.CompanyID, voucherCodes)
+		if err != nil {
+			return err
+		}
+		discount := 0.0
+		if resolution != nil {
+			discount = resolution.Discount + resolution.ShippingDiscount
+			pos.TotalDiscount += resolution.Discount
+		}
+		// the cart totals the customer paid already include the promotions (see CartService.GetCartByID)
+		if math.Abs(discount-cart.PromotionDiscount) > 0.005 {
+			return errors.New("the promotions of the cart have changed, please review the cart")
+		}
+		if err := tx.Create(&pos).Error; err != nil {
+			return err
+		}
+		if err := s.redeemPromotions(tx, resolution, &pos, &cart.UserID, "merchant_order"); err != nil {
+			return err
+		}
+		if err := s.holdReservations(tx, "cart", cart.ID); err != nil {
+			return err
+		}
+		return s.redeemTenders(tx, &pos, &cart.UserID)
+	})
+	if err != nil {
 		return nil, nil, err
 	}
+	if pos.Status == "COMPLETED" {
+		s.earnLoyalty(pos.ID)
+		s.recordCommission(pos.ID)
+	}
 
 	if (strings.ToLower(userPaymentStatus) == "paid" || strings.ToLower(userPaymentStatus) == "complete") && pos.SaleAccountID != nil && pos.AssetAccountID != nil {
 		if s.financeService.TransactionService != nil {
@@ -230,35 +300,39 @@ func (s *POSService) UpdateTransaction(pos *models.POSModel, merchant models.Mer
 	}
 	// Transaction does not exist, proceed with creating a new one
 
-	now := time.Now()
-	if pos.SaleAccountID != nil {
-		if err := s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
-			Date:               now,
-			AccountID:          pos.SaleAccountID,
-			Description:        fmt.Sprintf("Penjualan [%s] %s ", merchant.Name, pos.SalesNumber),
-			Notes:              pos.Description,
-			TransactionRefID:   &pos.ID,
-			TransactionRefType: "pos_sales",
-			CompanyID:          pos.CompanyID,
-		}, pos.Total); err != nil {
-			return err
-		}
-	}
-	if pos.AssetAccountID != nil {
-		if err := s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
-			Date:               now,
-			AccountID:          pos.AssetAccountID,
-			Description:        fmt.Sprintf("Penjualan [%s] %s ", merchant.Name, pos.SalesNumber),
-			Notes:              pos.Description,
-			TransactionRefID:   &pos.ID,
-			TransactionRefType: "pos_sales",
-			CompanyID:          pos.CompanyID,
-		}, pos.Total); err != nil {
+	if len(pos.Tenders) == 0 {
+		if err := s.db.Where("pos_id = ?", pos.ID).Find(&pos.Tenders).Error; err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return s.PostSale(s.db, pos, merchant, time.Now())
+}
+
+// PostSale journals a sale within db: its total on the sale account and the received side on the
+// accounts of its tenders, or on its asset account when it has no tenders. A sale without a sale
+// account, or with a received side without an account, is refused so the journal stays balanced.
+func (s *POSService) PostSale(db *gorm.DB, pos *models.POSModel, merchant models.MerchantModel, date time.Time) error {
+	if s.financeService == nil || s.financeService.TransactionService == nil {
+		return nil
+	}
+	if pos.SaleAccountID == nil {
+		return errors.New("sale account is required")
+	}
+	s.financeService.TransactionService.SetDB(db)
+	defer s.financeService.TransactionService.SetDB(s.db)
+	if err := s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
+		Date:               date,
+		AccountID:          pos.SaleAccountID,
+		Description:        fmt.Sprintf("Penjualan [%s] %s ", merchant.Name, pos.SalesNumber),
+		Notes:              pos.Description,
+		TransactionRefID:   &pos.ID,
+		TransactionRefType: "pos_sales",
+		CompanyID:          pos.CompanyID,
+	}, pos.Total); err != nil {
+		return err
+	}
+	return s.postTenderTransactions(pos, merchant, date)
 }
 
 // CreatePosFromOffer creates a new POS model from the given offer data and payment data.
@@ -363,6 +437,7 @@ func (s *POSService) CreatePosFromOffer(offer models.OfferModel, paymentID, sale
 			Quantity:                v.Quantity,
 			UnitPrice:               v.UnitPrice,
 			UnitPriceBeforeDiscount: v.UnitPriceBeforeDiscount,
+			PriceListItemID:         v.PriceListItemID,
 			SubtotalBeforeDisc:      v.SubTotalBeforeDiscount,
 			Subtotal:                v.SubTotal,
 			WarehouseID:             merchant.DefaultWarehouseID,
@@ -411,7 +486,13 @@ func (s *POSService) CreatePosFromOffer(offer models.OfferModel, paymentID, sale
 		OrderType:              orderType,
 		TotalBeforeDisc:        totalDiscount,
 	}
-	if err := s.db.Create(&pos).Error; err != nil {
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&pos).Error; err != nil {
+			return err
+		}
+		return s.holdReservations(tx, "offer", offer.ID)
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -433,44 +514,103 @@ func (s *POSService) CreatePosFromOffer(offer models.OfferModel, paymentID, sale
 //
 // The function will also create a new stock movement for each item in the transaction. The stock movement will be created with type "out" and quantity equal to the quantity of the item in the transaction.
 //
-// If the transaction has a sale account ID and an asset account ID, the function will create a new transaction in the journal with debit and credit accounts set to the sale account ID and the asset account ID respectively.
+// The sale is journaled with saleAccountID as the credit account and assetAccountID as the debit account of the tenders without their own account. The sale account is required, and so is the asset account unless every tender has an account.
+//
+// The transaction is linked to the open cashier shift of the merchant (see ShiftForSale). When the merchant requires an open shift and there is none, ErrNoOpenShift is returned.
+//
+// The transaction can be paid with several tenders, each with its own method, provider reference, amount and cash/bank account. The tenders must cover the total and only cash gives change; each tender is journaled on its own account and counted per method when the shift is closed.
+//
+// Items without a unit price are priced with ResolveItemPrice, so the price lists of the contact, the merchant and the POS channel apply.
+//
+// When the promotion service is set, the promotions of the merchant company are resolved for the items and redeemed within the transaction, and the total is reduced by their discount.
+//
+// Tenders with the POINTS method pay with loyalty points of the contact and VOUCHER tenders with the voucher or gift card of their Code and Pin: the points or balance worth their amount are redeemed within the transaction, so they are only spent when the sale is saved.
 //
 // The function will return the created POS model if the transaction is successful, or an error if there is a problem during the transaction.
-func (s *POSService) CreatePOSTransaction(merchantID *string, contactID *string, warehouseID string, items []models.POSSalesItemModel, description string) (*models.POSModel, error) {
+func (s *POSService) CreatePOSTransaction(merchantID *string, contactID *string, warehouseID string, items []models.POSSalesItemModel, description string, saleAccountID, assetAccountID *string, tenders ...models.POSTenderModel) (*models.POSModel, error) {
 	invSrv, ok := s.ctx.InventoryService.(*inventory.InventoryService)
 	if !ok {
 		return nil, errors.New("invalid inventory service")
 	}
 
+	if merchantID == nil {
+		return nil, errors.New("no merchant")
+	}
+	for i, item := range items {
+		if item.ProductID == nil || item.UnitPrice > 0 {
+			continue
+		}
+		resolution, err := s.ResolveItemPrice(merchantID, contactID, *item.ProductID, item.VariantID, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		item.UnitPrice = resolution.Price
+		item.UnitPriceBeforeDiscount = resolution.BasePrice
+		item.SubtotalBeforeDisc = item.Quantity * resolution.BasePrice
+		item.Subtotal = item.Quantity * resolution.Price
+		item.Total = item.Subtotal
+		if resolution.Rule != nil {
+			item.PriceListItemID = &resolution.Rule.ItemID
+		}
+		items[i] = item
+	}
+
 	// Hitung total harga transaksi
 	var totalPrice float64
 	for _, item := range items {
 		totalPrice += item.Total
 	}
-	if merchantID == nil {
-		return nil, errors.New("no merchant")
-	}
 
 	merchant := models.MerchantModel{}
 	if err := s.db.Where("id = ?", merchantID).First(&merchant).Error; err != nil {
 		return nil, err
 	}
+	shift, err := ShiftForSale(s.db, &merchant, s.ctx.Request)
+	if err != nil {
+		return nil, err
+	}
 	pos := models.POSModel{
-		MerchantID: merchantID,
-		ContactID:  contactID,
-		Total:      totalPrice,
-		Status:     "PENDING",
-		Items:      items,
+		MerchantID:     merchantID,
+		CompanyID:      merchant.CompanyID,
+		ContactID:      contactID,
+		Total:          totalPrice,
+		Status:         "PENDING",
+		Items:          items,
+		SaleAccountID:  saleAccountID,
+		AssetAccountID: assetAccountID,
+	}
+	if shift != nil {
+		pos.ShiftID = &shift.ID
 	}
 
 	now := time.Now()
 
-	err := s.ctx.DB.Transaction(func(tx *gorm.DB) error {
+	err = s.ctx.DB.Transaction(func(tx *gorm.DB) error {
+		resolution, err := s.resolvePromotions(tx, &pos, merchant.CompanyID, nil)
+		if err != nil {
+			return err
+		}
+		if resolution != nil {
+			pos.TotalDiscount += resolution.Discount
+			pos.Total -= resolution.Discount
+		}
+		if len(tenders) > 0 {
+			if err := s.prepareTenders(&pos, tenders); err != nil {
+				return err
+			}
+		}
+
 		// Simpan transaksi POS ke database
 		if err := tx.Create(&pos).Error; err != nil {
 			tx.Rollback()
 			return err
 		}
+		if err := s.redeemPromotions(tx, resolution, &pos, nil, "pos"); err != nil {
+			return err
+		}
+		if err := s.redeemTenders(tx, &pos, nil); err != nil {
+			return err
+		}
 
 		// Kurangi stok untuk setiap item
 		for _, item := range items {
@@ -487,36 +627,10 @@ func (s *POSService) CreatePOSTransaction(merchantID *string, contactID *string,
 			return err
 		}
 
-		if s.financeService.TransactionService != nil {
-			// Tambahkan transaksi ke jurnal
-			if pos.SaleAccountID != nil {
-				if err := s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
-					Date:               now,
-					AccountID:          pos.SaleAccountID,
-					Description:        fmt.Sprintf("Penjualan [%s] %s ", merchant.Name, pos.SalesNumber),
-					Notes:              pos.Description,
-					TransactionRefID:   &pos.ID,
-					TransactionRefType: "pos_sales",
-					CompanyID:          pos.CompanyID,
-				}, totalPrice); err != nil {
-					tx.Rollback()
-					return err
-				}
-			}
-			if pos.AssetAccountID != nil {
-				if err := s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
-					Date:               now,
-					AccountID:          pos.AssetAccountID,
-					Description:        fmt.Sprintf("Penjualan [%s] %s ", merchant.Name, pos.SalesNumber),
-					Notes:              pos.Description,
-					TransactionRefID:   &pos.ID,
-					TransactionRefType: "pos_sales",
-					CompanyID:          pos.CompanyID,
-				}, totalPrice); err != nil {
-					tx.Rollback()
-					return err
-				}
-			}
+		// Tambahkan transaksi ke jurnal
+		if err := s.PostSale(tx, &pos, merchant, now); err != nil {
+			tx.Rollback()
+			return err
 		}
 
 		if err := tx.Commit().Error; err != nil {
@@ -530,10 +644,50 @@ func (s *POSService) CreatePOSTransaction(merchantID *string, contactID *string,
 	if err != nil {
 		return nil, err
 	}
+	s.earnLoyalty(pos.ID)
+	s.recordConsignment(pos.ID)
+	s.recordCommission(pos.ID)
 
 	return &pos, nil
 }
 
+// earnLoyalty awards the loyalty points of a completed sale. A failure does not undo the sale.
+func (s *POSService) earnLoyalty(posID string) {
+	if s.loyaltyService == nil {
+		return
+	}
+	if _, err := s.loyaltyService.EarnFromPOS(posID); err != nil {
+		log.Println("ERROR LOYALTY", err)
+	}
+}
+
+// recordConsignment books the supplier payable of the consignment stock taken by a sale once its
+// stock left the warehouse. A failure does not undo the sale.
+func (s *POSService) recordConsignment(posID string) {
+	if s.inventoryService == nil || s.inventoryService.ConsignmentService == nil {
+		return
+	}
+	if _, err := s.inventoryService.ConsignmentService.RecordPOSSale(posID, ""); err != nil {
+		log.Println("ERROR CONSIGNMENT", err)
+	}
+}
+
+// recordCommission books the platform commission of a completed merchant order. A failure does
+// not undo the sale.
+func (s *POSService) recordCommission(posID string) {
+	if s.marketplaceService == nil {
+		return
+	}
+	var merchantID *string
+	s.db.Model(&models.POSModel{}).Select("merchant_id").Where("id = ?", posID).Scan(&merchantID)
+	if merchantID == nil {
+		return
+	}
+	if _, err := s.marketplaceService.RecordOrder(posID); err != nil {
+		log.Println("ERROR COMMISSION", err)
+	}
+}
+
 // GetTransactionsByMerchant returns all POS transactions for the given merchant ID.
 //
 // This function preloads the items of the transactions, and returns a slice of POSModel.
@@ -556,7 +710,7 @@ func (s *POSService) GetUserPosSaleByID(userID string, id string) (*models.POSMo
 		}).Preload("Variant", func(db *gorm.DB) *gorm.DB {
 			return db.Select("display_name", "id")
 		})
-	}).Preload("Payment").Where("user_id = ? AND id = ?", userID, id).First(&pos).Error; err != nil {
+	}).Preload("Payment").Preload("Tenders").Where("user_id = ? AND id = ?", userID, id).First(&pos).Error; err != nil {
 		return nil, err
 	}
 	return &pos, nil
@@ -573,7 +727,7 @@ func (s *POSService) GetUserPosSaleDetail(id string) (*models.POSModel, error) {
 		}).Preload("Variant", func(db *gorm.DB) *gorm.DB {
 			return db.Select("display_name", "id")
 		})
-	}).Preload("Payment").Where("id = ?", id).First(&pos).Error; err != nil {
+	}).Preload("Payment").Preload("Tenders").Where("id = ?", id).First(&pos).Error; err != nil {
 		return nil, err
 	}
 	for i, v := range pos.Items {
@@ -683,7 +837,7 @@ func (s *POSService) GetPosSalesDetail(id string) (*models.POSModel, error) {
 		return tx.Preload("Company").Preload("User")
 	}).Preload("Items", func(tx *gorm.DB) *gorm.DB {
 		return tx.Preload("Product.Tags").Preload("Variant.Tags")
-	}).Preload("Payment").Where("id = ?", id).First(&pos).Error; err != nil {
+	}).Preload("Payment").Preload("Tenders").Where("id = ?", id).First(&pos).Error; err != nil {
 		return nil, err
 	}
 
@@ -843,6 +997,10 @@ func (s *POSService) UpdatePickedByID(id string) error {
 				pos.ID,
 				fmt.Sprintf("Sales #%s", pos.SalesNumber))
 		}
+		if err := s.fulfilReservations(&pos); err != nil {
+			return err
+		}
+		s.recordConsignment(pos.ID)
 	}
 
 	pos.StockStatus = "IN_DELIVERY"
@@ -887,6 +1045,10 @@ func (s *POSService) UpdateDeliveredByID(id string) error {
 				pos.ID,
 				fmt.Sprintf("Sales #%s", pos.SalesNumber))
 		}
+		if err := s.fulfilReservations(&pos); err != nil {
+			return err
+		}
+		s.recordConsignment(pos.ID)
 	}
 
 	pos.StockStatus = "DELIVERED"
@@ -897,6 +1059,52 @@ func (s *POSService) UpdateDeliveredByID(id string) error {
 	return nil
 }
 
+// holdReservations keeps the stock reservations of the cart or offer an order is created from
+// until the order is delivered or cancelled, instead of letting them expire.
+func (s *POSService) holdReservations(tx *gorm.DB, refType, refID string) error {
+	if s.inventoryService == nil {
+		return nil
+	}
+	s.inventoryService.StockReservationService.SetDB(tx)
+	defer s.inventoryService.StockReservationService.SetDB(s.db)
+	return s.inventoryService.StockReservationService.Hold(refType, refID)
+}
+
+// releaseReservations releases the stock reservations of the cart or offer a cancelled POS
+// transaction was created from.
+func (s *POSService) releaseReservations(pos *models.POSModel) error {
+	if s.inventoryService == nil {
+		return nil
+	}
+	if pos.CartID != nil {
+		if err := s.inventoryService.StockReservationService.Release("cart", *pos.CartID, "order cancelled"); err != nil {
+			return err
+		}
+	}
+	if pos.OfferID != nil {
+		if err := s.inventoryService.StockReservationService.Release("offer", *pos.OfferID, "order cancelled"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fulfilReservations closes the stock reservations of the cart or offer a POS transaction was created from,
+// once its stock has left the warehouse.
+func (s *POSService) fulfilReservations(pos *models.POSModel) error {
+	if pos.CartID != nil {
+		if err := s.inventoryService.StockReservationService.FulfilAll("cart", *pos.CartID, "fulfilled"); err != nil {
+			return err
+		}
+	}
+	if pos.OfferID != nil {
+		if err := s.inventoryService.StockReservationService.FulfilAll("offer", *pos.OfferID, "fulfilled"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // CountPosSalesByStatus retrieves the total count of POS sales with a specific status.
 //
 // This function takes a status string and returns the total count of POS sales with that status, or an error if the operation fails.
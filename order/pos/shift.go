@@ -0,0 +1,605 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/finance"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrNoOpenShift is returned when a POS sale requires an open cashier shift and there is none.
+var ErrNoOpenShift = errors.New("no open POS shift")
+
+// ErrTerminalRequired is returned when a POS sale does not name its terminal and the merchant has
+// several open shifts.
+var ErrTerminalRequired = errors.New("terminal is required when several POS shifts are open")
+
+// cashMethod is the payment method that goes through the cash drawer.
+const cashMethod = "CASH"
+
+// varianceEpsilon absorbs floating point noise when comparing amounts.
+const varianceEpsilon = 0.005
+
+type POSShiftService struct {
+	db             *gorm.DB
+	ctx            *context.ERPContext
+	financeService *finance.FinanceService
+}
+
+// NewPOSShiftService creates a new instance of POSShiftService with the given database connection, context and finance service.
+func NewPOSShiftService(db *gorm.DB, ctx *context.ERPContext, financeService *finance.FinanceService) *POSShiftService {
+	return &POSShiftService{db: db, ctx: ctx, financeService: financeService}
+}
+
+// FindOpenShift returns the open shift of a merchant.
+//
+// When terminalID is set only the shift of that terminal is considered; otherwise the most
+// recently opened shift of the merchant is returned. It returns ErrNoOpenShift when there is none.
+func FindOpenShift(db *gorm.DB, merchantID string, terminalID *string) (*models.POSShiftModel, error) {
+	var shift models.POSShiftModel
+	stmt := db.Where("merchant_id = ? AND status = ?", merchantID, "OPEN")
+	if terminalID != nil && *terminalID != "" {
+		stmt = stmt.Where("terminal_id = ?", *terminalID)
+	}
+	if err := stmt.Order("opened_at desc").First(&shift).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoOpenShift
+		}
+		return nil, err
+	}
+	return &shift, nil
+}
+
+// ShiftForSale resolves the shift a new POS sale of the merchant belongs to.
+//
+// The terminal is taken from the ID-Terminal header of the request, if any. Without it the sale
+// can only be placed on the shift of the merchant when a single shift is open; with several open
+// shifts ErrTerminalRequired is returned. When the merchant requires an open shift and there is
+// none, ErrNoOpenShift is returned; otherwise a sale without an open shift gets a nil shift.
+func ShiftForSale(db *gorm.DB, merchant *models.MerchantModel, request *http.Request) (*models.POSShiftModel, error) {
+	var terminalID *string
+	if request != nil && request.Header.Get("ID-Terminal") != "" {
+		id := request.Header.Get("ID-Terminal")
+		terminalID = &id
+	}
+	if terminalID == nil {
+		var open int64
+		if err := db.Model(&models.POSShiftModel{}).Where("merchant_id = ? AND status = ?", merchant.ID, "OPEN").Count(&open).Error; err != nil {
+			return nil, err
+		}
+		if open > 1 {
+			return nil, ErrTerminalRequired
+		}
+	}
+	shift, err := FindOpenShift(db, merchant.ID, terminalID)
+	if errors.Is(err, ErrNoOpenShift) && !merchant.RequireOpenShift {
+		return nil, nil
+	}
+	return shift, err
+}
+
+// CreateTerminal creates a new POS terminal for a merchant.
+func (s *POSShiftService) CreateTerminal(data *models.POSTerminalModel) error {
+	if data.MerchantID == nil {
+		return errors.New("merchant ID is required")
+	}
+	if data.CompanyID == nil {
+		var merchant models.MerchantModel
+		if err := s.db.Select("id", "company_id").First(&merchant, "id = ?", *data.MerchantID).Error; err != nil {
+			return err
+		}
+		data.CompanyID = merchant.CompanyID
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdateTerminal updates a POS terminal.
+func (s *POSShiftService) UpdateTerminal(id string, data *models.POSTerminalModel) error {
+	return s.db.Where("id = ?", id).Updates(data).Error
+}
+
+// DeleteTerminal deletes a POS terminal that has no open shift.
+func (s *POSShiftService) DeleteTerminal(id string) error {
+	var count int64
+	if err := s.db.Model(&models.POSShiftModel{}).Where("terminal_id = ? AND status = ?", id, "OPEN").Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("terminal has an open shift")
+	}
+	return s.db.Where("id = ?", id).Delete(&models.POSTerminalModel{}).Error
+}
+
+// GetTerminalByID retrieves a POS terminal by its ID.
+func (s *POSShiftService) GetTerminalByID(id string) (*models.POSTerminalModel, error) {
+	var terminal models.POSTerminalModel
+	err := s.db.Preload("CashAccount").Preload("OverShortAccount").Where("id = ?", id).First(&terminal).Error
+	return &terminal, err
+}
+
+// GetTerminals retrieves a paginated list of POS terminals of the merchant in the ID-Merchant header.
+func (s *POSShiftService) GetTerminals(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Model(&models.POSTerminalModel{})
+	if search != "" {
+		stmt = stmt.Where("name ILIKE ? OR code ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Merchant") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.Header.Get("ID-Merchant"))
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	stmt = stmt.Order("name asc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.POSTerminalModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// OpenShift opens a cashier shift on a terminal with the given opening float.
+//
+// A terminal can only have one open shift at a time.
+func (s *POSShiftService) OpenShift(terminalID, cashierID string, openingFloat float64, notes string) (*models.POSShiftModel, error) {
+	if openingFloat < 0 {
+		return nil, errors.New("opening float cannot be negative")
+	}
+	terminal, err := s.GetTerminalByID(terminalID)
+	if err != nil {
+		return nil, err
+	}
+	if terminal.Status != "ACTIVE" {
+		return nil, errors.New("terminal is not active")
+	}
+	if terminal.MerchantID == nil {
+		return nil, errors.New("terminal has no merchant")
+	}
+	if _, err := FindOpenShift(s.db, *terminal.MerchantID, &terminal.ID); err == nil {
+		return nil, errors.New("terminal already has an open shift")
+	} else if !errors.Is(err, ErrNoOpenShift) {
+		return nil, err
+	}
+	shift := models.POSShiftModel{
+		ShiftNumber:  fmt.Sprintf("SHIFT-%s", utils.RandomStringNumber(8, false)),
+		MerchantID:   terminal.MerchantID,
+		TerminalID:   &terminal.ID,
+		CashierID:    &cashierID,
+		CompanyID:    terminal.CompanyID,
+		Status:       "OPEN",
+		OpenedAt:     time.Now(),
+		OpeningFloat: openingFloat,
+		Notes:        notes,
+	}
+	if err := s.db.Create(&shift).Error; err != nil {
+		return nil, err
+	}
+	return &shift, nil
+}
+
+// AddCashEvent records cash put into (CASH_IN) or taken out of (CASH_OUT) the drawer of an open shift.
+//
+// When accountID is set and the terminal has a cash account, the movement is journaled
+// against accountID, e.g. the main cash account for a bank deposit.
+func (s *POSShiftService) AddCashEvent(shiftID string, eventType models.POSShiftEventType, amount float64, reason string, accountID *string, userID string) (*models.POSShiftEventModel, error) {
+	if eventType != models.POSShiftCashIn && eventType != models.POSShiftCashOut {
+		return nil, errors.New("invalid cash event type")
+	}
+	if amount <= 0 {
+		return nil, errors.New("amount must be greater than zero")
+	}
+	shift, err := s.getShift(shiftID)
+	if err != nil {
+		return nil, err
+	}
+	if shift.Status != "OPEN" {
+		return nil, errors.New("shift is not open")
+	}
+	event := models.POSShiftEventModel{
+		ShiftID:   shift.ID,
+		Date:      time.Now(),
+		Type:      eventType,
+		Amount:    amount,
+		Reason:    reason,
+		AccountID: accountID,
+		UserID:    &userID,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&event).Error; err != nil {
+			return err
+		}
+		column := "cash_in"
+		if eventType == models.POSShiftCashOut {
+			column = "cash_out"
+		}
+		if err := tx.Model(&models.POSShiftModel{}).Where("id = ?", shift.ID).
+			Update(column, gorm.Expr(column+" + ?", amount)).Error; err != nil {
+			return err
+		}
+		if accountID == nil || shift.Terminal == nil || shift.Terminal.CashAccountID == nil {
+			return nil
+		}
+		debit, credit := shift.Terminal.CashAccountID, accountID
+		label := "Kas Masuk "
+		if eventType == models.POSShiftCashOut {
+			debit, credit = accountID, shift.Terminal.CashAccountID
+			label = "Kas Keluar "
+		}
+		if err := s.createTransaction(tx, shift, event.ID, "pos_shift_event", debit, label, reason, amount, 0, userID); err != nil {
+			return err
+		}
+		return s.createTransaction(tx, shift, event.ID, "pos_shift_event", credit, label, reason, 0, amount, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// GetShiftByID retrieves a shift with its cash events.
+//
+// The payment summary and expected cash of an open shift are calculated on the fly.
+func (s *POSShiftService) GetShiftByID(id string) (*models.POSShiftModel, error) {
+	shift, err := s.getShift(id)
+	if err != nil {
+		return nil, err
+	}
+	if shift.Status == "OPEN" {
+		if err := s.calculateShift(s.db, shift); err != nil {
+			return nil, err
+		}
+	}
+	return shift, nil
+}
+
+// GetShifts retrieves a paginated list of shifts.
+//
+// The list can be filtered with the terminal_id, cashier_id and status query parameters
+// and is scoped to the merchant in the ID-Merchant header.
+func (s *POSShiftService) GetShifts(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Terminal", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "code")
+	}).Preload("Cashier", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name")
+	}).Model(&models.POSShiftModel{})
+	if search != "" {
+		stmt = stmt.Where("shift_number ILIKE ?", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Merchant") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.Header.Get("ID-Merchant"))
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("terminal_id") != "" {
+		stmt = stmt.Where("terminal_id = ?", request.URL.Query().Get("terminal_id"))
+	}
+	if request.URL.Query().Get("cashier_id") != "" {
+		stmt = stmt.Where("cashier_id = ?", request.URL.Query().Get("cashier_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Order("opened_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.POSShiftModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// CloseShift closes an open shift.
+//
+// denominations is the physical count of the cash drawer; counted optionally holds the
+// counted totals of other payment methods (e.g. the EDC settlement of a card terminal).
+// The expected amount of every payment method is calculated from the sales of the shift,
+// and the cash variance is posted between the cash account and the cash over/short
+// account of the terminal. The shift row is locked while it is closed, so it cannot be
+// closed twice concurrently.
+func (s *POSShiftService) CloseShift(shiftID, userID string, denominations []models.POSShiftDenomination, counted map[string]float64, notes string) (*models.POSShiftModel, error) {
+	shift, err := s.getShift(shiftID)
+	if err != nil {
+		return nil, err
+	}
+	if shift.Status != "OPEN" {
+		return nil, errors.New("shift is not open")
+	}
+
+	countedCash := 0.0
+	for i, v := range denominations {
+		if v.Value <= 0 || v.Count < 0 {
+			return nil, errors.New("invalid denomination")
+		}
+		v.Total = v.Value * float64(v.Count)
+		countedCash += v.Total
+		denominations[i] = v
+	}
+	sort.Slice(denominations, func(i, j int) bool { return denominations[i].Value > denominations[j].Value })
+	if denominations == nil {
+		denominations = []models.POSShiftDenomination{}
+	}
+
+	now := time.Now()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var locked models.POSShiftModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "status").
+			Where("id = ?", shift.ID).First(&locked).Error; err != nil {
+			return err
+		}
+		if locked.Status != "OPEN" {
+			return errors.New("shift is not open")
+		}
+		if err := s.calculateShift(tx, shift); err != nil {
+			return err
+		}
+		for i, v := range shift.PaymentSummary {
+			if v.PaymentMethod == cashMethod {
+				v.Counted = countedCash
+			} else if c, ok := counted[v.PaymentMethod]; ok {
+				v.Counted = c
+			} else {
+				v.Counted = v.Expected
+			}
+			v.Variance = v.Counted - v.Expected
+			shift.PaymentSummary[i] = v
+		}
+		shift.Denominations = denominations
+		shift.CountedCash = countedCash
+		shift.Variance = countedCash - shift.ExpectedCash
+		shift.Status = "CLOSED"
+		shift.ClosedAt = &now
+		shift.ClosedByID = &userID
+		if notes != "" {
+			shift.Notes = notes
+		}
+
+		if math.Abs(shift.Variance) > varianceEpsilon {
+			if shift.Terminal == nil || shift.Terminal.CashAccountID == nil || shift.Terminal.OverShortAccountID == nil {
+				return errors.New("cash account and cash over/short account of the terminal are required to post the variance")
+			}
+			amount := math.Abs(shift.Variance)
+			debit, credit := shift.Terminal.CashAccountID, shift.Terminal.OverShortAccountID
+			label := "Kelebihan Kas "
+			if shift.Variance < 0 {
+				debit, credit = shift.Terminal.OverShortAccountID, shift.Terminal.CashAccountID
+				label = "Kekurangan Kas "
+			}
+			if err := s.createTransaction(tx, shift, shift.ID, "pos_shift", debit, label, shift.Notes, amount, 0, userID); err != nil {
+				return err
+			}
+			if err := s.createTransaction(tx, shift, shift.ID, "pos_shift", credit, label, shift.Notes, 0, amount, userID); err != nil {
+				return err
+			}
+		}
+
+		return tx.Omit("Merchant", "Terminal", "Cashier", "Company", "ClosedBy", "Events").Save(shift).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shift, nil
+}
+
+// GetShiftReport returns the report data of a shift.
+//
+// An X report ("X") is a snapshot of an open or closed shift and may be printed any time.
+// A Z report ("Z") is the closing report; it is only available for a closed shift and
+// every print is counted.
+func (s *POSShiftService) GetShiftReport(shiftID, reportType, timeFormatStr string) (*utils.ShiftReportData, error) {
+	if timeFormatStr == "" {
+		timeFormatStr = "02/01/2006 15:04"
+	}
+	reportType = strings.ToUpper(reportType)
+	if reportType != "X" && reportType != "Z" {
+		return nil, errors.New("report type must be X or Z")
+	}
+	shift, err := s.GetShiftByID(shiftID)
+	if err != nil {
+		return nil, err
+	}
+	if reportType == "Z" {
+		if shift.Status != "CLOSED" {
+			return nil, errors.New("z report is only available for a closed shift")
+		}
+		if err := s.db.Model(&models.POSShiftModel{}).Where("id = ?", shift.ID).
+			Update("z_report_count", gorm.Expr("z_report_count + 1")).Error; err != nil {
+			return nil, err
+		}
+		shift.ZReportCount++
+	}
+
+	data := utils.ShiftReportData{
+		ReportType:   reportType,
+		ShiftNumber:  shift.ShiftNumber,
+		OpenedAt:     shift.OpenedAt.Format(timeFormatStr),
+		PrintedAt:    time.Now().Format(timeFormatStr),
+		OpeningFloat: utils.FormatRupiah(shift.OpeningFloat),
+		CashIn:       utils.FormatRupiah(shift.CashIn),
+		CashOut:      utils.FormatRupiah(shift.CashOut),
+		ExpectedCash: utils.FormatRupiah(shift.ExpectedCash),
+		CountedCash:  utils.FormatRupiah(shift.CountedCash),
+		Variance:     utils.FormatRupiah(shift.Variance),
+		PrintCount:   shift.ZReportCount,
+	}
+	if shift.ClosedAt != nil {
+		data.ClosedAt = shift.ClosedAt.Format(timeFormatStr)
+	}
+	if shift.Merchant != nil {
+		data.MerchantName = shift.Merchant.Name
+		data.MerchantAddress = fmt.Sprintf("%s, %s", shift.Merchant.Address, shift.Merchant.Phone)
+	}
+	if shift.Terminal != nil {
+		data.TerminalName = shift.Terminal.Name
+	}
+	if shift.Cashier != nil {
+		data.CashierName = shift.Cashier.FullName
+	}
+	totalSales := 0.0
+	for _, v := range shift.PaymentSummary {
+		totalSales += v.Amount
+		data.TotalCount += v.Count
+		line := utils.ShiftReportLine{
+			Description: v.PaymentMethod,
+			Count:       fmt.Sprintf("%d", v.Count),
+			Amount:      utils.FormatRupiah(v.Amount),
+			Expected:    utils.FormatRupiah(v.Expected),
+		}
+		if shift.Status == "CLOSED" {
+			line.Counted = utils.FormatRupiah(v.Counted)
+			line.Variance = utils.FormatRupiah(v.Variance)
+		}
+		data.Payments = append(data.Payments, line)
+		if v.PaymentMethod == cashMethod {
+			data.CashRefund = utils.FormatRupiah(v.Refund)
+		}
+	}
+	data.TotalSales = utils.FormatRupiah(totalSales)
+	for _, v := range shift.Denominations {
+		data.Denominations = append(data.Denominations, utils.ShiftReportLine{
+			Description: utils.FormatRupiah(v.Value),
+			Count:       fmt.Sprintf("%d", v.Count),
+			Amount:      utils.FormatRupiah(v.Total),
+		})
+	}
+	return &data, nil
+}
+
+// GetPrintShiftReport generates an X or Z report PDF on receipt paper.
+//
+// Like MerchantService.GetPrintReceipt, it takes an optional template path and time format.
+// When the template path is empty, templates/shift_report.html is used.
+func (s *POSShiftService) GetPrintShiftReport(shiftID, reportType, templatePath, timeFormatStr string) ([]byte, error) {
+	data, err := s.GetShiftReport(shiftID, reportType, timeFormatStr)
+	if err != nil {
+		return nil, err
+	}
+	return utils.GenerateShiftReport(*data, templatePath)
+}
+
+func (s *POSShiftService) getShift(id string) (*models.POSShiftModel, error) {
+	var shift models.POSShiftModel
+	err := s.db.Preload("Terminal").Preload("Merchant").Preload("Cashier").
+		Preload("Events", func(db *gorm.DB) *gorm.DB {
+			return db.Order("date asc")
+		}).Where("id = ?", id).First(&shift).Error
+	if err != nil {
+		return nil, err
+	}
+	return &shift, nil
+}
+
+// calculateShift sums the sales of a shift per payment method and sets the expected cash.
+//
+// POS sales count when completed, split per tender when paid with several; tenders and merchant
+// order payments count net of change. Completed cash refunds paid from the drawer during the
+// shift reduce the expected cash.
+func (s *POSShiftService) calculateShift(db *gorm.DB, shift *models.POSShiftModel) error {
+	type methodTotal struct {
+		Method string
+		Count  int
+		Amount float64
+	}
+	var posTotals, tenderTotals, orderTotals []methodTotal
+	if err := db.Model(&models.POSModel{}).
+		Select("UPPER(COALESCE(NULLIF(payment_type, ''), ?)) AS method, COUNT(*) AS count, COALESCE(SUM(total), 0) AS amount", cashMethod).
+		Where("shift_id = ? AND LOWER(status) = ?", shift.ID, "completed").
+		Where("NOT EXISTS (SELECT 1 FROM pos_tenders WHERE pos_tenders.pos_id = pos_sales.id AND pos_tenders.deleted_at IS NULL)").
+		Group("method").Scan(&posTotals).Error; err != nil {
+		return err
+	}
+	// sales paid with tenders are counted per tender, net of the change
+	if err := db.Model(&models.POSTenderModel{}).
+		Select("UPPER(pos_tenders.method) AS method, COUNT(*) AS count, COALESCE(SUM(pos_tenders.amount - pos_tenders.change), 0) AS amount").
+		Joins("JOIN pos_sales ON pos_sales.id = pos_tenders.pos_id AND pos_sales.deleted_at IS NULL").
+		Where("pos_sales.shift_id = ? AND LOWER(pos_sales.status) = ?", shift.ID, "completed").
+		Group("method").Scan(&tenderTotals).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.MerchantPayment{}).
+		Select("UPPER(COALESCE(NULLIF(payment_method, ''), ?)) AS method, COUNT(*) AS count, COALESCE(SUM(amount - change), 0) AS amount", cashMethod).
+		Where("shift_id = ?", shift.ID).
+		Group("method").Scan(&orderTotals).Error; err != nil {
+		return err
+	}
+
+	var cashIn, cashOut float64
+	if err := db.Model(&models.POSShiftEventModel{}).Where("shift_id = ? AND type = ?", shift.ID, models.POSShiftCashIn).
+		Select("COALESCE(SUM(amount), 0)").Scan(&cashIn).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.POSShiftEventModel{}).Where("shift_id = ? AND type = ?", shift.ID, models.POSShiftCashOut).
+		Select("COALESCE(SUM(amount), 0)").Scan(&cashOut).Error; err != nil {
+		return err
+	}
+
+	var cashRefund float64
+	if err := db.Model(&models.POSRefundModel{}).Where("shift_id = ? AND method = ? AND status = ?", shift.ID, models.POSRefundMethodCash, models.POSRefundCompleted).
+		Select("COALESCE(SUM(amount), 0)").Scan(&cashRefund).Error; err != nil {
+		return err
+	}
+
+	summary := map[string]*models.POSShiftPaymentSummary{
+		cashMethod: {PaymentMethod: cashMethod, Refund: cashRefund},
+	}
+	for _, v := range append(append(posTotals, tenderTotals...), orderTotals...) {
+		line, ok := summary[v.Method]
+		if !ok {
+			line = &models.POSShiftPaymentSummary{PaymentMethod: v.Method}
+			summary[v.Method] = line
+		}
+		line.Count += v.Count
+		line.Amount += v.Amount
+	}
+	shift.PaymentSummary = []models.POSShiftPaymentSummary{}
+	for _, v := range summary {
+		v.Expected = v.Amount
+		if v.PaymentMethod == cashMethod {
+			v.Expected = shift.OpeningFloat + v.Amount + cashIn - cashOut - v.Refund
+			shift.ExpectedCash = v.Expected
+		}
+		shift.PaymentSummary = append(shift.PaymentSummary, *v)
+	}
+	sort.Slice(shift.PaymentSummary, func(i, j int) bool {
+		if shift.PaymentSummary[i].PaymentMethod == cashMethod {
+			return true
+		}
+		if shift.PaymentSummary[j].PaymentMethod == cashMethod {
+			return false
+		}
+		return shift.PaymentSummary[i].PaymentMethod < shift.PaymentSummary[j].PaymentMethod
+	})
+	shift.CashIn = cashIn
+	shift.CashOut = cashOut
+	return nil
+}
+
+func (s *POSShiftService) createTransaction(tx *gorm.DB, shift *models.POSShiftModel, refID, refType string, accountID *string, label, notes string, debit, credit float64, userID string) error {
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: utils.Uuid()},
+		Code:                        utils.RandString(10, false),
+		Date:                        time.Now(),
+		AccountID:                   accountID,
+		Description:                 label + shift.ShiftNumber,
+		Notes:                       notes,
+		TransactionRefID:            &refID,
+		TransactionRefType:          refType,
+		TransactionSecondaryRefID:   &shift.ID,
+		TransactionSecondaryRefType: "pos_shift",
+		CompanyID:                   shift.CompanyID,
+		Debit:                       debit,
+		Credit:                      credit,
+		Amount:                      debit + credit,
+		UserID:                      &userID,
+	}).Error
+}
@@ -0,0 +1,140 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+)
+
+// tenderEpsilon absorbs rounding differences between the tenders and the total of a sale.
+const tenderEpsilon = 0.005
+
+// TenderChange checks that the tenders of a sale cover its total and returns the change of every
+// tender. Only cash gives change: the other tenders together cannot exceed the total, and the
+// change is given on the last cash tender.
+func TenderChange(total float64, methods []string, amounts []float64) ([]float64, error) {
+	if len(methods) != len(amounts) {
+		return nil, errors.New("every tender needs a method and an amount")
+	}
+	var paid, nonCash float64
+	for i, amount := range amounts {
+		if amount <= 0 {
+			return nil, fmt.Errorf("tender %d has no amount", i+1)
+		}
+		if methods[i] == "" {
+			return nil, fmt.Errorf("tender %d has no method", i+1)
+		}
+		paid += amount
+		if !strings.EqualFold(methods[i], models.POSTenderCash) {
+			nonCash += amount
+		}
+	}
+	if paid < total-tenderEpsilon {
+		return nil, fmt.Errorf("tenders of %.2f do not cover the total of %.2f", paid, total)
+	}
+	if nonCash > total+tenderEpsilon {
+		return nil, errors.New("change can only be given on cash, non-cash tenders exceed the total")
+	}
+	changes := make([]float64, len(amounts))
+	change := paid - total
+	for i := len(amounts) - 1; i >= 0 && change > tenderEpsilon; i-- {
+		if !strings.EqualFold(methods[i], models.POSTenderCash) {
+			continue
+		}
+		given := change
+		if given > amounts[i] {
+			given = amounts[i]
+		}
+		changes[i] = given
+		change -= given
+	}
+	return changes, nil
+}
+
+// prepareTenders validates the tenders of a sale and fills its change, paid amount and payment
+// type; a sale paid with several methods gets the MULTIPLE payment type.
+func (s *POSService) prepareTenders(pos *models.POSModel, tenders []models.POSTenderModel) error {
+	methods := make([]string, len(tenders))
+	amounts := make([]float64, len(tenders))
+	for i := range tenders {
+		tenders[i].Method = strings.ToUpper(tenders[i].Method)
+		methods[i] = tenders[i].Method
+		amounts[i] = tenders[i].Amount
+	}
+	changes, err := TenderChange(pos.Total, methods, amounts)
+	if err != nil {
+		return err
+	}
+	pos.Paid = 0
+	pos.Change = 0
+	for i := range tenders {
+		if tenders[i].ID == "" {
+			tenders[i].ID = utils.Uuid()
+		}
+		tenders[i].Change = changes[i]
+		tenders[i].ShiftID = pos.ShiftID
+		pos.Paid += tenders[i].Amount
+		pos.Change += changes[i]
+	}
+	pos.Tenders = tenders
+	pos.PaymentType = tenders[0].Method
+	pos.PaymentProviderType = tenders[0].Provider
+	for _, v := range tenders[1:] {
+		if v.Method != pos.PaymentType {
+			pos.PaymentType = string(models.MULTIPLE)
+			pos.PaymentProviderType = models.MULTIPLE
+			break
+		}
+	}
+	return nil
+}
+
+// postTenderTransactions journals the received side of a sale: one entry per tender on its
+// cash/bank account, or a single entry on the asset account of a sale without tenders. A tender
+// without an account falls back to the asset account of the sale; when there is none an error is
+// returned, since skipping the entry would leave the journal unbalanced.
+func (s *POSService) postTenderTransactions(pos *models.POSModel, merchant models.MerchantModel, date time.Time) error {
+	description := fmt.Sprintf("Penjualan [%s] %s ", merchant.Name, pos.SalesNumber)
+	if len(pos.Tenders) == 0 {
+		if pos.AssetAccountID == nil {
+			return errors.New("asset account is required for a sale without tenders")
+		}
+		return s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
+			Date:               date,
+			AccountID:          pos.AssetAccountID,
+			Description:        description,
+			Notes:              pos.Description,
+			TransactionRefID:   &pos.ID,
+			TransactionRefType: "pos_sales",
+			CompanyID:          pos.CompanyID,
+		}, pos.Total)
+	}
+	for _, tender := range pos.Tenders {
+		accountID := tender.AccountID
+		if accountID == nil {
+			accountID = pos.AssetAccountID
+		}
+		if accountID == nil {
+			return fmt.Errorf("tender %s has no account and the sale has no asset account", tender.Method)
+		}
+		tenderID := tender.ID
+		if err := s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
+			Date:                        date,
+			AccountID:                   accountID,
+			Description:                 description,
+			Notes:                       strings.TrimSpace(fmt.Sprintf("%s %s", tender.Method, tender.ProviderRef)),
+			TransactionRefID:            &pos.ID,
+			TransactionRefType:          "pos_sales",
+			TransactionSecondaryRefID:   &tenderID,
+			TransactionSecondaryRefType: "pos_tender",
+			CompanyID:                   pos.CompanyID,
+		}, tender.Amount-tender.Change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
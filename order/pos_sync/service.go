@@ -0,0 +1,869 @@
+package pos_sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/inventory"
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/order/loyalty"
+	"github.com/AMETORY/ametory-erp-modules/order/pos"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/google/uuid"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// stockEpsilon absorbs floating point noise when comparing quantities.
+const stockEpsilon = 0.000001
+
+// errDuplicateUpload is returned when the idempotency key of an upload is already taken.
+var errDuplicateUpload = errors.New("duplicate upload")
+
+// POSSyncService lets POS terminals work offline.
+//
+// A terminal downloads a snapshot of the master data of its merchant, queues sales while it is
+// offline and uploads them later. Uploaded sales are replayed in sequence order and are
+// idempotent on their idempotency key. Every response carries a cursor that the terminal sends
+// back to receive only the changes made after it.
+type POSSyncService struct {
+	db               *gorm.DB
+	ctx              *context.ERPContext
+	inventoryService *inventory.InventoryService
+	loyaltyService   *loyalty.LoyaltyService
+	posService       *pos.POSService
+}
+
+// NewPOSSyncService creates a new instance of POSSyncService with the given database connection,
+// context and inventory service.
+func NewPOSSyncService(db *gorm.DB, ctx *context.ERPContext, inventoryService *inventory.InventoryService) *POSSyncService {
+	return &POSSyncService{
+		db:               db,
+		ctx:              ctx,
+		inventoryService: inventoryService,
+	}
+}
+
+// SetLoyaltyService sets the loyalty service. When it is set, replayed sales earn loyalty points.
+func (s *POSSyncService) SetLoyaltyService(loyaltyService *loyalty.LoyaltyService) {
+	s.loyaltyService = loyaltyService
+}
+
+// SetPOSService sets the POS service. Replayed sales are journaled with it like online sales.
+func (s *POSSyncService) SetPOSService(posService *pos.POSService) {
+	s.posService = posService
+}
+
+// Migrate migrates the POS sync models.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&models.POSSyncLogModel{}, &models.POSSyncStateModel{})
+}
+
+// EncodeCursor converts a point in time into a sync cursor.
+func EncodeCursor(t time.Time) string {
+	return strconv.FormatInt(t.UnixMicro(), 10)
+}
+
+// DecodeCursor converts a sync cursor back into a point in time. An empty cursor
+// is the zero time, i.e. everything has changed since.
+func DecodeCursor(cursor string) (time.Time, error) {
+	if cursor == "" {
+		return time.Time{}, nil
+	}
+	micro, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid sync cursor")
+	}
+	return time.UnixMicro(micro), nil
+}
+
+// GetSnapshot returns the master data a terminal needs to sell offline: the merchant, its
+// products with merchant prices, the product prices, the running promotions, the desks, the
+// stations and the stock in the default warehouse of the merchant.
+//
+// The version of the snapshot is the cursor for the next upload or delta.
+func (s *POSSyncService) GetSnapshot(merchantID, terminalID string) (*models.POSSyncSnapshot, error) {
+	now := time.Now()
+	merchant, err := s.getMerchant(merchantID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkTerminal(merchantID, terminalID); err != nil {
+		return nil, err
+	}
+
+	snapshot := models.POSSyncSnapshot{
+		Version:     EncodeCursor(now),
+		GeneratedAt: now,
+		Merchant:    merchant,
+	}
+	if snapshot.Products, err = s.getProducts(merchantID, nil); err != nil {
+		return nil, err
+	}
+	productIDs := syncProductIDs(snapshot.Products)
+	if err := s.db.Where("product_id IN (?)", productIDs).Order("effective_date asc").Find(&snapshot.Prices).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Preload("Rules").Preload("Actions").
+		Where("company_id = ?", merchant.CompanyID).
+		Where("is_active = ? AND start_date <= ? AND end_date >= ?", true, now, now).
+		Find(&snapshot.Promotions).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("merchant_id = ?", merchantID).Order("order_number").Find(&snapshot.Desks).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("merchant_id = ?", merchantID).Find(&snapshot.Stations).Error; err != nil {
+		return nil, err
+	}
+	if snapshot.Stocks, err = s.getStocks(merchant.DefaultWarehouseID, snapshot.Products); err != nil {
+		return nil, err
+	}
+
+	if err := s.saveState(merchantID, terminalID, func(state *models.POSSyncStateModel) {
+		state.LastCursor = snapshot.Version
+		state.LastSnapshotAt = &now
+	}); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// GetDelta returns the master data of a merchant that changed after the given cursor,
+// including the IDs of the records that were deleted and the stock of every product whose
+// stock moved or whose reservations changed.
+func (s *POSSyncService) GetDelta(merchantID, cursor string) (*models.POSSyncDelta, error) {
+	now := time.Now()
+	since, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	merchant, err := s.getMerchant(merchantID)
+	if err != nil {
+		return nil, err
+	}
+	delta := models.POSSyncDelta{
+		Since:   cursor,
+		Version: EncodeCursor(now),
+		Deleted: map[string][]string{},
+	}
+
+	if err := s.db.Model(&models.ProductMerchant{}).Where("merchant_model_id = ?", merchantID).
+		Pluck("product_model_id", &delta.ProductIDs).Error; err != nil {
+		return nil, err
+	}
+	if delta.Products, err = s.getProducts(merchantID, &since); err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("product_id IN (?) AND updated_at > ?", delta.ProductIDs, since).Find(&delta.Prices).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Preload("Rules").Preload("Actions").Where("company_id = ? AND updated_at > ?", merchant.CompanyID, since).Find(&delta.Promotions).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("merchant_id = ? AND updated_at > ?", merchantID, since).Order("order_number").Find(&delta.Desks).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("merchant_id = ? AND updated_at > ?", merchantID, since).Find(&delta.Stations).Error; err != nil {
+		return nil, err
+	}
+
+	deleted := []struct {
+		key   string
+		model any
+		query string
+		args  []any
+	}{
+		{"products", &models.ProductModel{}, "id IN (?)", []any{delta.ProductIDs}},
+		{"prices", &models.PriceModel{}, "product_id IN (?)", []any{delta.ProductIDs}},
+		{"promotions", &models.PromotionModel{}, "company_id = ?", []any{merchant.CompanyID}},
+		{"desks", &models.MerchantDesk{}, "merchant_id = ?", []any{merchantID}},
+		{"stations", &models.MerchantStation{}, "merchant_id = ?", []any{merchantID}},
+	}
+	for _, v := range deleted {
+		var ids []string
+		if err := s.db.Unscoped().Model(v.model).Where(v.query, v.args...).
+			Where("deleted_at IS NOT NULL AND deleted_at > ?", since).
+			Pluck("id", &ids).Error; err != nil {
+			return nil, err
+		}
+		delta.Deleted[v.key] = ids
+	}
+
+	if merchant.DefaultWarehouseID != nil {
+		var changed []string
+		if err := s.db.Model(&models.StockMovementModel{}).
+			Where("warehouse_id = ? AND product_id IN (?) AND created_at > ?", *merchant.DefaultWarehouseID, delta.ProductIDs, since).
+			Distinct("product_id").Pluck("product_id", &changed).Error; err != nil {
+			return nil, err
+		}
+		var reserved []string
+		if err := s.db.Model(&models.StockReservationModel{}).
+			Where("warehouse_id = ? AND product_id IN (?) AND updated_at > ?", *merchant.DefaultWarehouseID, delta.ProductIDs, since).
+			Distinct("product_id").Pluck("product_id", &reserved).Error; err != nil {
+			return nil, err
+		}
+		changed = append(changed, reserved...)
+		if len(changed) > 0 {
+			var products []models.ProductModel
+			if err := s.db.Select("id").Preload("Variants", func(db *gorm.DB) *gorm.DB {
+				return db.Select("id", "product_id")
+			}).Where("id IN (?)", changed).Find(&products).Error; err != nil {
+				return nil, err
+			}
+			stockProducts := make([]models.POSSyncProduct, 0, len(products))
+			for _, v := range products {
+				stockProducts = append(stockProducts, models.POSSyncProduct{ProductModel: v})
+			}
+			if delta.Stocks, err = s.getStocks(merchant.DefaultWarehouseID, stockProducts); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &delta, nil
+}
+
+// UploadTransactions replays sales that a terminal recorded while it was offline.
+//
+// The transactions are processed in sequence order (then by creation time), each in its own
+// database transaction, so one rejected sale does not block the others. A transaction whose
+// idempotency key was already processed for the merchant is not applied again; its original
+// result is returned with status DUPLICATE.
+//
+// Stock conflicts occur when a product with stock tracking has less stock available to
+// promise in the default warehouse of the merchant than the sale needs. With
+// POSSyncConflictAccept the sale is recorded anyway, since the goods already left the store,
+// and the shortage is reported as APPLIED_WITH_CONFLICT; with POSSyncConflictReject the sale
+// is REJECTED.
+//
+// The response contains one result per transaction and the delta since cursor, which already
+// includes the stock changes of the replayed sales.
+func (s *POSSyncService) UploadTransactions(merchantID, terminalID string, userID *string, cursor string, policy models.POSSyncConflictPolicy, transactions []models.POSSyncTransaction) (*models.POSSyncUploadResponse, error) {
+	if _, err := DecodeCursor(cursor); err != nil {
+		return nil, err
+	}
+	merchant, err := s.getMerchant(merchantID)
+	if err != nil {
+		return nil, err
+	}
+	if merchant.DefaultWarehouseID == nil {
+		return nil, errors.New("merchant has no default warehouse")
+	}
+	if err := s.checkTerminal(merchantID, terminalID); err != nil {
+		return nil, err
+	}
+	if policy == "" {
+		policy = models.POSSyncConflictAccept
+	}
+
+	sort.SliceStable(transactions, func(i, j int) bool {
+		if transactions[i].Sequence != transactions[j].Sequence {
+			return transactions[i].Sequence < transactions[j].Sequence
+		}
+		return transactions[i].CreatedAt.Before(transactions[j].CreatedAt)
+	})
+
+	response := models.POSSyncUploadResponse{}
+	var lastSequence int64
+	for _, v := range transactions {
+		result := s.replay(merchant, terminalID, userID, policy, v)
+		response.Results = append(response.Results, result)
+		if v.Sequence > lastSequence {
+			lastSequence = v.Sequence
+		}
+	}
+
+	if response.Delta, err = s.GetDelta(merchantID, cursor); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := s.saveState(merchantID, terminalID, func(state *models.POSSyncStateModel) {
+		state.LastCursor = response.Delta.Version
+		state.LastUploadAt = &now
+		if lastSequence > state.LastSequence {
+			state.LastSequence = lastSequence
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// GetSyncLogs retrieves a paginated list of uploaded offline transactions.
+//
+// The list can be filtered with the merchant_id, terminal_id and status query parameters.
+func (s *POSSyncService) GetSyncLogs(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Terminal", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "code")
+	}).Preload("POS", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "sales_number", "total", "status")
+	})
+	if search != "" {
+		stmt = stmt.Where("client_id ILIKE ? OR idempotency_key ILIKE ? OR message ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Merchant") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.Header.Get("ID-Merchant"))
+	}
+	if request.URL.Query().Get("merchant_id") != "" {
+		stmt = stmt.Where("merchant_id = ?", request.URL.Query().Get("merchant_id"))
+	}
+	if request.URL.Query().Get("terminal_id") != "" {
+		stmt = stmt.Where("terminal_id = ?", request.URL.Query().Get("terminal_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Model(&models.POSSyncLogModel{}).Order("synced_at desc, sequence desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.POSSyncLogModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetSyncState returns the last sync position of a terminal.
+func (s *POSSyncService) GetSyncState(terminalID string) (*models.POSSyncStateModel, error) {
+	var state models.POSSyncStateModel
+	if err := s.db.Where("terminal_id = ?", terminalID).First(&state).Error; err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// replay applies one offline transaction and records the outcome in the sync log.
+//
+// The sync log row claims the idempotency key: it is inserted in the same transaction as the
+// POS sale, so of two concurrent uploads with the same key only one commits a sale and the other
+// is reported as a duplicate. A key whose earlier upload was rejected can be retried.
+func (s *POSSyncService) replay(merchant *models.MerchantModel, terminalID string, userID *string, policy models.POSSyncConflictPolicy, data models.POSSyncTransaction) models.POSSyncResult {
+	result := models.POSSyncResult{
+		ClientID:       data.ClientID,
+		IdempotencyKey: data.IdempotencyKey,
+		Sequence:       data.Sequence,
+	}
+	if data.IdempotencyKey == "" {
+		result.Status = models.POSSyncRejected
+		result.Message = "idempotency key is required"
+		return result
+	}
+
+	var existing models.POSSyncLogModel
+	err := s.db.Where("merchant_id = ? AND idempotency_key = ?", merchant.ID, data.IdempotencyKey).First(&existing).Error
+	if err == nil && existing.Status != models.POSSyncRejected {
+		return s.duplicateResult(result, &existing)
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		result.Status = models.POSSyncRejected
+		result.Message = err.Error()
+		return result
+	}
+
+	payload, _ := json.Marshal(data)
+	syncLog := models.POSSyncLogModel{
+		MerchantID:      &merchant.ID,
+		TerminalID:      &terminalID,
+		IdempotencyKey:  data.IdempotencyKey,
+		ClientID:        data.ClientID,
+		Sequence:        data.Sequence,
+		ClientCreatedAt: data.CreatedAt,
+		SyncedAt:        time.Now(),
+		UserID:          userID,
+		Payload:         payload,
+		Conflicts:       []models.POSSyncConflict{},
+	}
+	if existing.ID != "" {
+		syncLog.ID = existing.ID
+		syncLog.CreatedAt = existing.CreatedAt
+	}
+
+	var posData *models.POSModel
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.claimSyncLog(tx, &syncLog); err != nil {
+			return err
+		}
+		conflicts, err := s.checkStock(tx, merchant, data.Items)
+		if err != nil {
+			return err
+		}
+		result.Conflicts = conflicts
+		if len(conflicts) > 0 && policy == models.POSSyncConflictReject {
+			return errors.New("insufficient stock")
+		}
+		posData, err = s.createPOS(tx, merchant, terminalID, data)
+		if err != nil {
+			return err
+		}
+
+		result.Status = models.POSSyncApplied
+		if len(result.Conflicts) > 0 {
+			result.Status = models.POSSyncAppliedWithConflict
+			result.Message = "sale recorded with insufficient stock"
+		}
+		result.POSID = &posData.ID
+		result.SalesNumber = posData.SalesNumber
+		syncLog.Status = result.Status
+		syncLog.Message = result.Message
+		syncLog.POSID = result.POSID
+		syncLog.Conflicts = result.Conflicts
+		return tx.Save(&syncLog).Error
+	})
+	if errors.Is(err, errDuplicateUpload) {
+		if err := s.db.Where("merchant_id = ? AND idempotency_key = ?", merchant.ID, data.IdempotencyKey).First(&existing).Error; err != nil {
+			result.Status = models.POSSyncDuplicate
+			result.Message = "already processed"
+			return result
+		}
+		return s.duplicateResult(result, &existing)
+	}
+	if err != nil {
+		result.Status = models.POSSyncRejected
+		result.Message = err.Error()
+		result.POSID = nil
+		result.SalesNumber = ""
+		// the insert of the log was rolled back with the sale
+		syncLog.ID = existing.ID
+		syncLog.Status = result.Status
+		syncLog.Message = result.Message
+		syncLog.POSID = nil
+		syncLog.Conflicts = result.Conflicts
+		if syncLog.Conflicts == nil {
+			syncLog.Conflicts = []models.POSSyncConflict{}
+		}
+		saveErr := s.db.Transaction(func(tx *gorm.DB) error {
+			return s.claimSyncLog(tx, &syncLog)
+		})
+		if errors.Is(saveErr, errDuplicateUpload) {
+			// another upload of the same key was applied meanwhile
+			if err := s.db.Where("merchant_id = ? AND idempotency_key = ?", merchant.ID, data.IdempotencyKey).First(&existing).Error; err == nil {
+				return s.duplicateResult(result, &existing)
+			}
+		} else if saveErr != nil {
+			result.Message = fmt.Sprintf("%s (sync log not saved: %s)", result.Message, saveErr.Error())
+		}
+		return result
+	}
+
+	if s.loyaltyService != nil {
+		if _, err := s.loyaltyService.EarnFromPOS(posData.ID); err != nil {
+			log.Println("ERROR LOYALTY", err)
+		}
+	}
+	if s.inventoryService != nil && s.inventoryService.ConsignmentService != nil {
+		if _, err := s.inventoryService.ConsignmentService.RecordPOSSale(posData.ID, ""); err != nil {
+			log.Println("ERROR CONSIGNMENT", err)
+		}
+	}
+	return result
+}
+
+// claimSyncLog inserts the sync log of an upload, or takes over the log of an earlier rejected
+// upload with the same key. It returns errDuplicateUpload when the key is already taken by an
+// upload that was not rejected.
+func (s *POSSyncService) claimSyncLog(tx *gorm.DB, syncLog *models.POSSyncLogModel) error {
+	if syncLog.ID == "" {
+		if err := tx.Create(syncLog).Error; err != nil {
+			if isUniqueViolation(err) {
+				return errDuplicateUpload
+			}
+			return err
+		}
+		return nil
+	}
+	var rejected models.POSSyncLogModel
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND status = ?", syncLog.ID, models.POSSyncRejected).
+		First(&rejected).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errDuplicateUpload
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Save(syncLog).Error
+}
+
+// duplicateResult fills the result of an upload whose key was already processed.
+func (s *POSSyncService) duplicateResult(result models.POSSyncResult, existing *models.POSSyncLogModel) models.POSSyncResult {
+	result.Status = models.POSSyncDuplicate
+	result.Message = fmt.Sprintf("already processed as %s", existing.Status)
+	result.POSID = existing.POSID
+	result.SalesNumber = ""
+	result.Conflicts = existing.Conflicts
+	if existing.POSID != nil {
+		var pos models.POSModel
+		if err := s.db.Select("id", "sales_number").Where("id = ?", *existing.POSID).First(&pos).Error; err == nil {
+			result.SalesNumber = pos.SalesNumber
+		}
+	}
+	return result
+}
+
+// isUniqueViolation tells whether err is a unique constraint violation of the database.
+func isUniqueViolation(err error) bool {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "sqlstate 23505") || strings.Contains(msg, "duplicate key") || strings.Contains(msg, "unique constraint")
+}
+
+// checkStock compares the quantities of an offline sale with the stock available to promise
+// in the default warehouse of the merchant. Products without stock tracking never conflict.
+func (s *POSSyncService) checkStock(tx *gorm.DB, merchant *models.MerchantModel, items []models.POSSyncItem) ([]models.POSSyncConflict, error) {
+	type stockKey struct {
+		productID string
+		variantID string
+	}
+	requested := map[stockKey]float64{}
+	variants := map[stockKey]*string{}
+	keys := []stockKey{}
+	for _, v := range items {
+		if v.ProductID == "" {
+			return nil, errors.New("product ID is required")
+		}
+		if v.Quantity <= 0 {
+			return nil, errors.New("quantity must be greater than zero")
+		}
+		key := stockKey{productID: v.ProductID}
+		if v.VariantID != nil {
+			key.variantID = *v.VariantID
+		}
+		if _, ok := requested[key]; !ok {
+			keys = append(keys, key)
+		}
+		requested[key] += v.Quantity
+		variants[key] = v.VariantID
+	}
+
+	reservationSrv := stockmovement.NewStockReservationService(tx, s.ctx)
+	conflicts := []models.POSSyncConflict{}
+	for _, key := range keys {
+		var product models.ProductModel
+		if err := tx.Select("id", "enable_stock").First(&product, "id = ?", key.productID).Error; err != nil {
+			return nil, fmt.Errorf("product %s not found", key.productID)
+		}
+		if !product.EnableStock {
+			continue
+		}
+		available, err := reservationSrv.GetAvailableToPromise(key.productID, variants[key], merchant.DefaultWarehouseID)
+		if err != nil {
+			return nil, err
+		}
+		if available+stockEpsilon < requested[key] {
+			conflicts = append(conflicts, models.POSSyncConflict{
+				ProductID: key.productID,
+				VariantID: variants[key],
+				Requested: requested[key],
+				Available: available,
+				Shortage:  requested[key] - available,
+			})
+		}
+	}
+	return conflicts, nil
+}
+
+// createPOS creates the completed POS sale of an offline transaction, its stock movements and its
+// journal. The shift of the sale must be of the merchant and terminal and its sales number must
+// not be taken.
+func (s *POSSyncService) createPOS(tx *gorm.DB, merchant *models.MerchantModel, terminalID string, data models.POSSyncTransaction) (*models.POSModel, error) {
+	salesDate := data.CreatedAt
+	if salesDate.IsZero() {
+		salesDate = time.Now()
+	}
+	salesNumber := data.SalesNumber
+	if salesNumber == "" {
+		salesNumber = fmt.Sprintf("POS-%s", utils.RandomStringNumber(8, false))
+	} else {
+		var count int64
+		if err := tx.Model(&models.POSModel{}).Unscoped().Where("sales_number = ? AND merchant_id = ?", salesNumber, merchant.ID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("sales number %s already used by another sale", salesNumber)
+		}
+	}
+	contactData := "{}"
+	if len(data.ContactData) > 0 {
+		contactData = string(data.ContactData)
+	}
+	paymentType := data.PaymentType
+	if paymentType == "" {
+		paymentType = "CASH"
+	}
+
+	posData := models.POSModel{
+		SalesNumber:         salesNumber,
+		Code:                data.ClientID,
+		Description:         data.Description,
+		Notes:               data.Notes,
+		Status:              "completed",
+		StockStatus:         "completed",
+		UserPaymentStatus:   "PAID",
+		SalesDate:           salesDate,
+		DueDate:             salesDate,
+		MerchantID:          &merchant.ID,
+		CompanyID:           merchant.CompanyID,
+		ContactID:           data.ContactID,
+		ContactData:         contactData,
+		PaymentType:         paymentType,
+		PaymentProviderType: data.PaymentProviderType,
+		Tax:                 data.Tax,
+		TaxType:             data.TaxType,
+		TaxAmount:           data.TaxAmount,
+		ServiceFee:          data.ServiceFee,
+		CompletedAt:         &salesDate,
+		SaleAccountID:       data.SaleAccountID,
+		AssetAccountID:      data.AssetAccountID,
+	}
+	if _, err := uuid.Parse(data.ClientID); err == nil {
+		var count int64
+		tx.Model(&models.POSModel{}).Unscoped().Where("id = ?", data.ClientID).Count(&count)
+		if count > 0 {
+			return nil, errors.New("client ID already used by another sale")
+		}
+		posData.ID = data.ClientID
+	}
+
+	if data.ShiftID != nil {
+		var shift models.POSShiftModel
+		err := tx.Select("id").Where("id = ? AND merchant_id = ? AND terminal_id = ?", *data.ShiftID, merchant.ID, terminalID).First(&shift).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("shift does not belong to the merchant and terminal")
+		}
+		if err != nil {
+			return nil, err
+		}
+		posData.ShiftID = &shift.ID
+	} else {
+		shift, err := pos.FindOpenShift(tx, merchant.ID, &terminalID)
+		if err != nil && !errors.Is(err, pos.ErrNoOpenShift) {
+			return nil, err
+		}
+		if shift != nil {
+			posData.ShiftID = &shift.ID
+		}
+	}
+
+	for _, v := range data.Items {
+		productID := v.ProductID
+		subtotalBeforeDisc := v.UnitPrice * v.Quantity
+		discount := v.DiscountAmount
+		if discount == 0 && v.DiscountPercent > 0 {
+			discount = subtotalBeforeDisc * v.DiscountPercent / 100
+		}
+		subtotal := subtotalBeforeDisc - discount
+		posData.Items = append(posData.Items, models.POSSalesItemModel{
+			Description:             v.Description,
+			Quantity:                v.Quantity,
+			UnitPrice:               v.UnitPrice,
+			UnitPriceBeforeDiscount: v.UnitPrice,
+			DiscountPercent:         v.DiscountPercent,
+			DiscountAmount:          discount,
+			Subtotal:                subtotal,
+			SubtotalBeforeDisc:      subtotalBeforeDisc,
+			Total:                   subtotal,
+			ProductID:               &productID,
+			VariantID:               v.VariantID,
+			WarehouseID:             merchant.DefaultWarehouseID,
+		})
+		posData.SubTotalBeforeDiscount += subtotalBeforeDisc
+		posData.TotalDiscount += discount
+		posData.Subtotal += subtotal
+	}
+	posData.TotalBeforeDisc = posData.SubTotalBeforeDiscount
+	posData.TotalBeforeTax = posData.Subtotal + posData.ServiceFee
+	posData.Total = posData.TotalBeforeTax + posData.TaxAmount
+	posData.Paid = data.Paid
+	if posData.Paid == 0 {
+		posData.Paid = posData.Total
+	}
+
+	if err := tx.Create(&posData).Error; err != nil {
+		return nil, err
+	}
+
+	stockSrv := stockmovement.NewStockMovementService(tx, s.ctx)
+	for _, v := range posData.Items {
+		if _, err := stockSrv.AddMovement(salesDate, *v.ProductID, *merchant.DefaultWarehouseID, v.VariantID, &merchant.ID, nil, merchant.CompanyID, -v.Quantity, models.MovementTypeOut, posData.ID, fmt.Sprintf("Penjualan offline %s", posData.SalesNumber)); err != nil {
+			return nil, err
+		}
+	}
+	if s.posService != nil {
+		if err := s.posService.PostSale(tx, &posData, *merchant, salesDate); err != nil {
+			return nil, err
+		}
+	}
+	return &posData, nil
+}
+
+// getProducts returns the products of a merchant with their merchant prices. When since is set
+// only products that changed after it, or whose variants changed after it, are returned.
+func (s *POSSyncService) getProducts(merchantID string, since *time.Time) ([]models.POSSyncProduct, error) {
+	var productMerchants []models.ProductMerchant
+	if err := s.db.Where("merchant_model_id = ?", merchantID).Find(&productMerchants).Error; err != nil {
+		return nil, err
+	}
+	merchantProducts := map[string]models.ProductMerchant{}
+	ids := []string{}
+	for _, v := range productMerchants {
+		merchantProducts[v.ProductModelID] = v
+		ids = append(ids, v.ProductModelID)
+	}
+	results := []models.POSSyncProduct{}
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	stmt := s.db.Preload("Variants.Attributes.Attribute").Preload("Brand").Preload("Category").Preload("Tags").
+		Where("products.id IN (?)", ids)
+	if since != nil {
+		stmt = stmt.Where("products.updated_at > ? OR products.id IN (?)", *since,
+			s.db.Model(&models.VariantModel{}).Select("product_id").Where("updated_at > ?", *since))
+	}
+	var products []models.ProductModel
+	if err := stmt.Find(&products).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range products {
+		pm := merchantProducts[v.ID]
+		v.Price = pm.Price
+		results = append(results, models.POSSyncProduct{
+			ProductModel:      v,
+			MerchantPrice:     pm.Price,
+			AdjustmentPrice:   pm.AdjustmentPrice,
+			MerchantStationID: pm.MerchantStationID,
+		})
+	}
+	return results, nil
+}
+
+// getStocks returns the on-hand, reserved and available stock of every product and variant
+// in the warehouse. Without a warehouse no stock is returned.
+func (s *POSSyncService) getStocks(warehouseID *string, products []models.POSSyncProduct) ([]models.POSSyncStock, error) {
+	stocks := []models.POSSyncStock{}
+	if warehouseID == nil || len(products) == 0 {
+		return stocks, nil
+	}
+	ids := syncProductIDs(products)
+
+	type stockRow struct {
+		ProductID string
+		VariantID *string
+		Quantity  float64
+	}
+	var onHand []stockRow
+	if err := s.db.Model(&models.StockMovementModel{}).
+		Select("product_id, variant_id, COALESCE(SUM(quantity * value), 0) as quantity").
+		Where("warehouse_id = ? AND product_id IN (?)", *warehouseID, ids).
+		Group("product_id, variant_id").Scan(&onHand).Error; err != nil {
+		return nil, err
+	}
+	var reserved []stockRow
+	if err := s.db.Model(&models.StockReservationModel{}).
+		Scopes(stockmovement.ActiveReservationScope(time.Now())).
+		Select("product_id, variant_id, COALESCE(SUM(quantity - fulfilled_quantity), 0) as quantity").
+		Where("warehouse_id = ? AND product_id IN (?)", *warehouseID, ids).
+		Group("product_id, variant_id").Scan(&reserved).Error; err != nil {
+		return nil, err
+	}
+
+	key := func(productID string, variantID *string) string {
+		if variantID == nil {
+			return productID
+		}
+		return productID + "/" + *variantID
+	}
+	onHandMap := map[string]float64{}
+	reservedMap := map[string]float64{}
+	for _, v := range onHand {
+		onHandMap[key(v.ProductID, v.VariantID)] += v.Quantity
+		onHandMap[v.ProductID+"/*"] += v.Quantity
+	}
+	for _, v := range reserved {
+		reservedMap[key(v.ProductID, v.VariantID)] += v.Quantity
+		reservedMap[v.ProductID+"/*"] += v.Quantity
+	}
+
+	for _, v := range products {
+		if len(v.Variants) == 0 {
+			total := onHandMap[v.ID+"/*"]
+			held := reservedMap[v.ID+"/*"]
+			stocks = append(stocks, models.POSSyncStock{
+				ProductID: v.ID,
+				OnHand:    total,
+				Reserved:  held,
+				Available: total - held,
+			})
+			continue
+		}
+		for _, variant := range v.Variants {
+			variantID := variant.ID
+			total := onHandMap[key(v.ID, &variantID)]
+			held := reservedMap[key(v.ID, &variantID)]
+			stocks = append(stocks, models.POSSyncStock{
+				ProductID: v.ID,
+				VariantID: &variantID,
+				OnHand:    total,
+				Reserved:  held,
+				Available: total - held,
+			})
+		}
+	}
+	return stocks, nil
+}
+
+func (s *POSSyncService) getMerchant(merchantID string) (*models.MerchantModel, error) {
+	var merchant models.MerchantModel
+	if err := s.db.Where("id = ?", merchantID).First(&merchant).Error; err != nil {
+		return nil, err
+	}
+	return &merchant, nil
+}
+
+func (s *POSSyncService) checkTerminal(merchantID, terminalID string) error {
+	var terminal models.POSTerminalModel
+	if err := s.db.Select("id", "merchant_id", "status").Where("id = ?", terminalID).First(&terminal).Error; err != nil {
+		return errors.New("terminal not found")
+	}
+	if terminal.MerchantID == nil || *terminal.MerchantID != merchantID {
+		return errors.New("terminal does not belong to merchant")
+	}
+	if terminal.Status != "ACTIVE" {
+		return errors.New("terminal is not active")
+	}
+	return nil
+}
+
+func (s *POSSyncService) saveState(merchantID, terminalID string, update func(state *models.POSSyncStateModel)) error {
+	var state models.POSSyncStateModel
+	err := s.db.Where("terminal_id = ?", terminalID).First(&state).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	state.MerchantID = &merchantID
+	state.TerminalID = terminalID
+	update(&state)
+	return s.db.Save(&state).Error
+}
+
+func syncProductIDs(products []models.POSSyncProduct) []string {
+	ids := make([]string, 0, len(products))
+	for _, v := range products {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
@@ -0,0 +1,865 @@
+package promotion
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// amountEpsilon absorbs floating point noise when comparing amounts.
+const amountEpsilon = 0.000001
+
+// PromotionCart is the full cart a set of promotions is resolved against.
+type PromotionCart struct {
+	Items         []PromotionCartItem `json:"items"`
+	ContactID     *string             `json:"contact_id,omitempty"`
+	CustomerLevel string              `json:"customer_level,omitempty"`
+	VoucherCodes  []string            `json:"voucher_codes,omitempty"`
+	ShippingFee   float64             `json:"shipping_fee"`
+	Date          time.Time           `json:"date"`
+	CompanyID     *string             `json:"company_id,omitempty"`
+}
+
+// PromotionCartItem is one line of a PromotionCart. LineID is echoed back in the result.
+type PromotionCartItem struct {
+	LineID     string  `json:"line_id"`
+	ProductID  string  `json:"product_id"`
+	VariantID  *string `json:"variant_id,omitempty"`
+	CategoryID *string `json:"category_id,omitempty"`
+	Quantity   float64 `json:"quantity"`
+	UnitPrice  float64 `json:"unit_price"`
+}
+
+// PromotionAdjustment explains one discount a promotion gave on a cart line.
+type PromotionAdjustment struct {
+	PromotionID   string  `json:"promotion_id"`
+	PromotionName string  `json:"promotion_name"`
+	ActionType    string  `json:"action_type"`
+	Amount        float64 `json:"amount"`
+	Description   string  `json:"description"`
+}
+
+// PromotionLineResult is a cart line after the winning promotions are applied.
+type PromotionLineResult struct {
+	LineID      string                `json:"line_id"`
+	ProductID   string                `json:"product_id"`
+	VariantID   *string               `json:"variant_id,omitempty"`
+	Quantity    float64               `json:"quantity"`
+	UnitPrice   float64               `json:"unit_price"`
+	Subtotal    float64               `json:"subtotal"`
+	Discount    float64               `json:"discount"`
+	Total       float64               `json:"total"`
+	Adjustments []PromotionAdjustment `json:"adjustments"`
+}
+
+// AppliedPromotion is a promotion of the winning combination.
+type AppliedPromotion struct {
+	PromotionID      string  `json:"promotion_id"`
+	Name             string  `json:"name"`
+	Priority         int     `json:"priority"`
+	Exclusive        bool    `json:"exclusive"`
+	VoucherCode      string  `json:"voucher_code,omitempty"`
+	VoucherID        *string `json:"voucher_id,omitempty"`
+	Discount         float64 `json:"discount"`
+	ShippingDiscount float64 `json:"shipping_discount"`
+}
+
+// SkippedPromotion is a promotion that was considered but not applied, with the reason.
+type SkippedPromotion struct {
+	PromotionID string `json:"promotion_id"`
+	Name        string `json:"name"`
+	Reason      string `json:"reason"`
+}
+
+// PromotionResolution is the outcome of ResolvePromotions.
+type PromotionResolution struct {
+	Date             time.Time             `json:"date"`
+	Subtotal         float64               `json:"subtotal"`
+	Discount         float64               `json:"discount"`
+	ShippingFee      float64               `json:"shipping_fee"`
+	ShippingDiscount float64               `json:"shipping_discount"`
+	Total            float64               `json:"total"`
+	Applied          []AppliedPromotion    `json:"applied"`
+	Skipped          []SkippedPromotion    `json:"skipped"`
+	Lines            []PromotionLineResult `json:"lines"`
+	Explanation      []string              `json:"explanation"`
+}
+
+// promotionCandidate is an eligible promotion together with the cart lines it applies to.
+type promotionCandidate struct {
+	promotion models.PromotionModel
+	scope     []int
+	voucher   *models.PromotionVoucherModel
+	code      string
+}
+
+// resolveState is the running state of a cart while promotions are applied one by one.
+type resolveState struct {
+	cart             *PromotionCart
+	lines            []PromotionLineResult
+	shippingDiscount float64
+	applied          []AppliedPromotion
+	skipped          []SkippedPromotion
+}
+
+// ResolvePromotions picks the best combination of promotions for a full cart and explains
+// every line adjustment.
+//
+// Candidates are the active promotions of the company of the cart whose rules the cart meets
+// and whose usage limits are not exhausted. Promotions that require a voucher are only
+// candidates when one of cart.VoucherCodes is an available voucher of the promotion or its
+// promotion code.
+//
+// Candidates are applied in a fixed order: higher Priority first, then by name and ID. Each
+// promotion discounts what is left of a line after the promotions before it, so a line never
+// goes below zero. Non-exclusive promotions are stacked together; an exclusive promotion is
+// only applied on its own. The resolver evaluates the full stack and every exclusive promotion
+// alone and keeps the combination with the largest total discount (line and shipping
+// discounts). Ties go to the combination with fewer promotions, then to the one evaluated
+// first. The result is the same for the same cart and promotions.
+//
+// Resolving does not consume usage or vouchers; call RedeemPromotions once the sale is saved.
+// Checkouts resolve and redeem within the transaction that saves the sale (see SetDB).
+func (s *PromotionService) ResolvePromotions(cart PromotionCart) (*PromotionResolution, error) {
+	if cart.Date.IsZero() {
+		cart.Date = time.Now()
+	}
+	for _, v := range cart.Items {
+		if v.Quantity < 0 || v.UnitPrice < 0 {
+			return nil, errors.New("quantity and unit price cannot be negative")
+		}
+	}
+
+	if err := s.fillCategories(&cart); err != nil {
+		return nil, err
+	}
+	candidates, skipped, err := s.findCandidates(&cart)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].promotion, candidates[j].promotion
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+
+	combinations := [][]promotionCandidate{}
+	stack := []promotionCandidate{}
+	for _, v := range candidates {
+		if !v.promotion.Exclusive {
+			stack = append(stack, v)
+		}
+	}
+	if len(stack) > 0 {
+		combinations = append(combinations, stack)
+	}
+	for _, v := range candidates {
+		if v.promotion.Exclusive {
+			combinations = append(combinations, []promotionCandidate{v})
+		}
+	}
+
+	best := s.applyCombination(&cart, nil)
+	bestDiscount := -1.0
+	for _, combination := range combinations {
+		state := s.applyCombination(&cart, combination)
+		discount := state.totalDiscount()
+		if discount > bestDiscount+amountEpsilon ||
+			(math.Abs(discount-bestDiscount) <= amountEpsilon && len(state.applied) < len(best.applied)) {
+			best = state
+			bestDiscount = discount
+		}
+	}
+
+	// promotions that were candidates but are not in the winning combination
+	applied := map[string]bool{}
+	for _, v := range best.applied {
+		applied[v.PromotionID] = true
+	}
+	bestSkipped := map[string]bool{}
+	for _, v := range best.skipped {
+		bestSkipped[v.PromotionID] = true
+	}
+	for _, v := range candidates {
+		if applied[v.promotion.ID] || bestSkipped[v.promotion.ID] {
+			continue
+		}
+		reason := "a better combination of promotions was chosen"
+		if v.promotion.Exclusive {
+			reason = "exclusive promotion gives less discount than the chosen combination"
+		}
+		best.skipped = append(best.skipped, SkippedPromotion{PromotionID: v.promotion.ID, Name: v.promotion.Name, Reason: reason})
+	}
+	best.skipped = append(best.skipped, skipped...)
+	return best.resolution(), nil
+}
+
+// RedeemPromotions records the usage of the applied promotions of a resolution for a saved
+// sale and consumes their vouchers.
+//
+// Usage limits and vouchers are checked again with the promotion rows locked, so two sales
+// cannot use the last remaining usage at the same time. refType is e.g. pos, sales or
+// merchant_order.
+func (s *PromotionService) RedeemPromotions(resolution *PromotionResolution, contactID, userID *string, refID, refType string) error {
+	if resolution == nil || len(resolution.Applied) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, v := range resolution.Applied {
+			var promotion models.PromotionModel
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Select("id", "name", "usage_limit", "usage_limit_per_customer", "usage_count").
+				Where("id = ?", v.PromotionID).First(&promotion).Error; err != nil {
+				return err
+			}
+			reason, err := s.usageLimitReason(tx, &promotion, contactID)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				return fmt.Errorf("%s: %s", promotion.Name, reason)
+			}
+			if v.VoucherID != nil {
+				result := tx.Model(&models.PromotionVoucherModel{}).
+					Where("id = ? AND status = ?", *v.VoucherID, "AVAILABLE").
+					Updates(map[string]any{
+						"status":         "REDEEMED",
+						"redeemed_at":    now,
+						"contact_id":     contactID,
+						"reference_id":   refID,
+						"reference_type": refType,
+					})
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected == 0 {
+					return fmt.Errorf("voucher %s is no longer available", v.VoucherCode)
+				}
+			}
+			if err := tx.Create(&models.PromotionUsageModel{
+				PromotionID:    v.PromotionID,
+				VoucherID:      v.VoucherID,
+				ContactID:      contactID,
+				UserID:         userID,
+				Date:           now,
+				DiscountAmount: v.Discount + v.ShippingDiscount,
+				ReferenceID:    refID,
+				ReferenceType:  refType,
+				Status:         "APPLIED",
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.PromotionModel{}).Where("id = ?", v.PromotionID).
+				Update("usage_count", gorm.Expr("usage_count + 1")).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReversePromotionUsage reverses the promotion usage of a sale, e.g. when it is refunded.
+//
+// The usage counts are given back and the single-use vouchers of the sale become available again.
+func (s *PromotionService) ReversePromotionUsage(refType, refID string) error {
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var usages []models.PromotionUsageModel
+		if err := tx.Where("reference_type = ? AND reference_id = ? AND status = ?", refType, refID, "APPLIED").Find(&usages).Error; err != nil {
+			return err
+		}
+		for _, v := range usages {
+			if err := tx.Model(&models.PromotionUsageModel{}).Where("id = ?", v.ID).
+				Updates(map[string]any{"status": "REVERSED", "reversed_at": now}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.PromotionModel{}).Where("id = ? AND usage_count > 0", v.PromotionID).
+				Update("usage_count", gorm.Expr("usage_count - 1")).Error; err != nil {
+				return err
+			}
+			if v.VoucherID != nil {
+				if err := tx.Model(&models.PromotionVoucherModel{}).Where("id = ? AND status = ?", *v.VoucherID, "REDEEMED").
+					Updates(map[string]any{
+						"status":         "AVAILABLE",
+						"redeemed_at":    nil,
+						"reference_id":   nil,
+						"reference_type": "",
+					}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// fillCategories sets the category of the cart lines that have none from their product.
+func (s *PromotionService) fillCategories(cart *PromotionCart) error {
+	productIDs := []string{}
+	for _, v := range cart.Items {
+		if v.CategoryID == nil {
+			productIDs = append(productIDs, v.ProductID)
+		}
+	}
+	if len(productIDs) == 0 {
+		return nil
+	}
+	var products []models.ProductModel
+	if err := s.db.Select("id", "category_id").Where("id IN ?", productIDs).Find(&products).Error; err != nil {
+		return err
+	}
+	categories := map[string]*string{}
+	for _, v := range products {
+		categories[v.ID] = v.CategoryID
+	}
+	for i := range cart.Items {
+		if cart.Items[i].CategoryID == nil {
+			cart.Items[i].CategoryID = categories[cart.Items[i].ProductID]
+		}
+	}
+	return nil
+}
+
+// findCandidates loads the active promotions and returns the ones the cart is eligible for,
+// together with the reasons the others were skipped.
+func (s *PromotionService) findCandidates(cart *PromotionCart) ([]promotionCandidate, []SkippedPromotion, error) {
+	var promotions []models.PromotionModel
+	stmt := s.db.Preload("Rules").Preload("Actions").
+		Where("is_active = ? AND start_date <= ? AND end_date >= ?", true, cart.Date, cart.Date)
+	if cart.CompanyID != nil {
+		stmt = stmt.Where("company_id = ? OR company_id IS NULL", *cart.CompanyID)
+	}
+	if err := stmt.Find(&promotions).Error; err != nil {
+		return nil, nil, err
+	}
+
+	// vouchers and promotion codes entered by the customer, per promotion
+	vouchers := map[string]*models.PromotionVoucherModel{}
+	codes := map[string]string{}
+	skipped := []SkippedPromotion{}
+	for _, code := range cart.VoucherCodes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" {
+			continue
+		}
+		var voucher models.PromotionVoucherModel
+		err := s.db.Where("code = ?", code).First(&voucher).Error
+		if err == nil {
+			switch {
+			case voucher.Status != "AVAILABLE":
+				skipped = append(skipped, SkippedPromotion{PromotionID: voucher.PromotionID, Name: code, Reason: "voucher is " + strings.ToLower(voucher.Status)})
+			case voucher.ExpiresAt != nil && voucher.ExpiresAt.Before(cart.Date):
+				skipped = append(skipped, SkippedPromotion{PromotionID: voucher.PromotionID, Name: code, Reason: "voucher is expired"})
+			default:
+				if _, ok := vouchers[voucher.PromotionID]; !ok {
+					v := voucher
+					vouchers[voucher.PromotionID] = &v
+					codes[voucher.PromotionID] = code
+				}
+			}
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, err
+		}
+		found := false
+		for _, p := range promotions {
+			if p.Code != "" && strings.EqualFold(p.Code, code) {
+				codes[p.ID] = code
+				found = true
+			}
+		}
+		if !found {
+			skipped = append(skipped, SkippedPromotion{Name: code, Reason: "unknown or inactive code"})
+		}
+	}
+
+	candidates := []promotionCandidate{}
+	for _, p := range promotions {
+		if p.RequireVoucher && codes[p.ID] == "" {
+			continue
+		}
+		reason, err := s.usageLimitReason(s.db, &p, cart.ContactID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reason != "" {
+			skipped = append(skipped, SkippedPromotion{PromotionID: p.ID, Name: p.Name, Reason: reason})
+			continue
+		}
+		scope, reason := checkRules(cart, &p)
+		if reason != "" {
+			skipped = append(skipped, SkippedPromotion{PromotionID: p.ID, Name: p.Name, Reason: reason})
+			continue
+		}
+		candidates = append(candidates, promotionCandidate{
+			promotion: p,
+			scope:     scope,
+			voucher:   vouchers[p.ID],
+			code:      codes[p.ID],
+		})
+	}
+	return candidates, skipped, nil
+}
+
+// usageLimitReason returns why the usage limits of a promotion are exhausted, or an empty string.
+func (s *PromotionService) usageLimitReason(db *gorm.DB, promotion *models.PromotionModel, contactID *string) (string, error) {
+	if promotion.UsageLimit > 0 && promotion.UsageCount >= promotion.UsageLimit {
+		return "usage limit reached", nil
+	}
+	if promotion.UsageLimitPerCustomer > 0 && contactID != nil {
+		var count int64
+		if err := db.Model(&models.PromotionUsageModel{}).
+			Where("promotion_id = ? AND contact_id = ? AND status = ?", promotion.ID, *contactID, "APPLIED").
+			Count(&count).Error; err != nil {
+			return "", err
+		}
+		if int(count) >= promotion.UsageLimitPerCustomer {
+			return "usage limit per customer reached", nil
+		}
+	}
+	return "", nil
+}
+
+// checkRules evaluates the rules of a promotion against a cart. It returns the indexes of the
+// lines the promotion applies to, or the reason the cart is not eligible.
+//
+// PRODUCTS, CATEGORY and CATEGORIES rules narrow the lines; without them every line is in scope.
+// TIME_OF_DAY ("10:00-14:00", may wrap past midnight) and DAYS_OF_WEEK ("1,2,3", 0 = Sunday)
+// restrict the moment of the sale, e.g. for happy hours.
+func checkRules(cart *PromotionCart, promotion *models.PromotionModel) ([]int, string) {
+	var productIDs, categoryIDs []string
+	for _, rule := range promotion.Rules {
+		switch rule.RuleType {
+		case "PRODUCTS":
+			productIDs = append(productIDs, splitValues(rule.RuleValue)...)
+		case "CATEGORY", "CATEGORIES":
+			categoryIDs = append(categoryIDs, splitValues(rule.RuleValue)...)
+		}
+	}
+	scope := []int{}
+	for i, v := range cart.Items {
+		if len(productIDs) == 0 && len(categoryIDs) == 0 {
+			scope = append(scope, i)
+			continue
+		}
+		if utils.ContainsString(productIDs, v.ProductID) ||
+			(v.CategoryID != nil && utils.ContainsString(categoryIDs, *v.CategoryID)) {
+			scope = append(scope, i)
+		}
+	}
+	if len(scope) == 0 {
+		return nil, "no cart item matches the promotion products or categories"
+	}
+
+	var subtotal, quantity float64
+	for _, v := range cart.Items {
+		subtotal += v.Quantity * v.UnitPrice
+	}
+	for _, i := range scope {
+		quantity += cart.Items[i].Quantity
+	}
+
+	for _, rule := range promotion.Rules {
+		switch rule.RuleType {
+		case "PRODUCTS", "CATEGORY", "CATEGORIES":
+		case "MIN_PURCHASE":
+			value, err := strconv.ParseFloat(rule.RuleValue, 64)
+			if err != nil {
+				return nil, "invalid MIN_PURCHASE rule"
+			}
+			if subtotal+amountEpsilon < value {
+				return nil, fmt.Sprintf("minimum purchase of %.2f not reached", value)
+			}
+		case "MAX_PURCHASE":
+			value, err := strconv.ParseFloat(rule.RuleValue, 64)
+			if err != nil {
+				return nil, "invalid MAX_PURCHASE rule"
+			}
+			if subtotal > value+amountEpsilon {
+				return nil, fmt.Sprintf("purchase exceeds maximum of %.2f", value)
+			}
+		case "MIN_QUANTITY":
+			value, err := strconv.ParseFloat(rule.RuleValue, 64)
+			if err != nil {
+				return nil, "invalid MIN_QUANTITY rule"
+			}
+			if quantity+amountEpsilon < value {
+				return nil, fmt.Sprintf("minimum quantity of %.0f not reached", value)
+			}
+		case "CUSTOMER_LEVEL":
+			if !utils.ContainsString(splitValues(rule.RuleValue), cart.CustomerLevel) {
+				return nil, "customer level not eligible"
+			}
+		case "TIME_OF_DAY":
+			ok, err := inTimeWindow(rule.RuleValue, cart.Date)
+			if err != nil {
+				return nil, "invalid TIME_OF_DAY rule"
+			}
+			if !ok {
+				return nil, fmt.Sprintf("only valid between %s", rule.RuleValue)
+			}
+		case "DAYS_OF_WEEK":
+			if !utils.ContainsString(splitValues(rule.RuleValue), strconv.Itoa(int(cart.Date.Weekday()))) {
+				return nil, "not valid on this day of the week"
+			}
+		default:
+			return nil, fmt.Sprintf("unknown rule type %s", rule.RuleType)
+		}
+	}
+	return scope, ""
+}
+
+// applyCombination applies the promotions in order on a fresh copy of the cart.
+func (s *PromotionService) applyCombination(cart *PromotionCart, combination []promotionCandidate) *resolveState {
+	state := &resolveState{cart: cart}
+	for _, v := range cart.Items {
+		subtotal := v.Quantity * v.UnitPrice
+		state.lines = append(state.lines, PromotionLineResult{
+			LineID:      v.LineID,
+			ProductID:   v.ProductID,
+			VariantID:   v.VariantID,
+			Quantity:    v.Quantity,
+			UnitPrice:   v.UnitPrice,
+			Subtotal:    subtotal,
+			Total:       subtotal,
+			Adjustments: []PromotionAdjustment{},
+		})
+	}
+	for _, v := range combination {
+		state.apply(v)
+	}
+	return state
+}
+
+// apply applies every action of a promotion to the lines in its scope.
+func (st *resolveState) apply(candidate promotionCandidate) {
+	p := candidate.promotion
+	var discount, shippingDiscount float64
+	var errs []string
+	for _, action := range p.Actions {
+		amounts, shipping, description, err := st.actionAmounts(candidate, action)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", action.ActionType, err.Error()))
+			continue
+		}
+		for i, amount := range amounts {
+			amount = math.Min(amount, st.lines[i].Total)
+			if amount <= amountEpsilon {
+				continue
+			}
+			st.lines[i].Discount += amount
+			st.lines[i].Total -= amount
+			st.lines[i].Adjustments = append(st.lines[i].Adjustments, PromotionAdjustment{
+				PromotionID:   p.ID,
+				PromotionName: p.Name,
+				ActionType:    action.ActionType,
+				Amount:        amount,
+				Description:   description,
+			})
+			discount += amount
+		}
+		shipping = math.Min(shipping, st.cart.ShippingFee-st.shippingDiscount)
+		if shipping > amountEpsilon {
+			st.shippingDiscount += shipping
+			shippingDiscount += shipping
+		}
+	}
+	if discount+shippingDiscount <= amountEpsilon {
+		reason := "promotion gives no discount on this cart"
+		if len(errs) > 0 {
+			reason = strings.Join(errs, "; ")
+		}
+		st.skipped = append(st.skipped, SkippedPromotion{PromotionID: p.ID, Name: p.Name, Reason: reason})
+		return
+	}
+	applied := AppliedPromotion{
+		PromotionID:      p.ID,
+		Name:             p.Name,
+		Priority:         p.Priority,
+		Exclusive:        p.Exclusive,
+		VoucherCode:      candidate.code,
+		Discount:         discount,
+		ShippingDiscount: shippingDiscount,
+	}
+	if candidate.voucher != nil {
+		applied.VoucherID = &candidate.voucher.ID
+	}
+	st.applied = append(st.applied, applied)
+}
+
+// actionAmounts calculates the discount of one action per line index and on shipping,
+// based on what is left of the lines, and describes it.
+func (st *resolveState) actionAmounts(candidate promotionCandidate, action models.PromotionActionModel) (map[int]float64, float64, string, error) {
+	amounts := map[int]float64{}
+	scope := candidate.scope
+	remainingShipping := st.cart.ShippingFee - st.shippingDiscount
+	switch action.ActionType {
+	case "DISCOUNT":
+		value, err := strconv.ParseFloat(action.ActionValue, 64)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		st.distribute(amounts, scope, value)
+		return amounts, 0, fmt.Sprintf("%.2f off, spread over eligible items", value), nil
+	case "DISCOUNT_PERCENT":
+		value, err := strconv.ParseFloat(action.ActionValue, 64)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		for _, i := range scope {
+			amounts[i] = st.lines[i].Total * value / 100
+		}
+		return amounts, 0, fmt.Sprintf("%.2f%% off", value), nil
+	case "TIERED_DISCOUNT":
+		tiers, err := action.ParseTiers()
+		if err != nil {
+			return nil, 0, "", err
+		}
+		var spend float64
+		for _, i := range scope {
+			spend += st.lines[i].Subtotal
+		}
+		var tier *models.PromotionTier
+		for j := range tiers {
+			if spend+amountEpsilon >= tiers[j].MinSpend && (tier == nil || tiers[j].MinSpend > tier.MinSpend) {
+				tier = &tiers[j]
+			}
+		}
+		if tier == nil {
+			return nil, 0, "", fmt.Errorf("spend %.2f is below the first tier", spend)
+		}
+		value := tier.DiscountAmount
+		description := fmt.Sprintf("spend %.2f reaches tier %.2f: %.2f off", spend, tier.MinSpend, tier.DiscountAmount)
+		if tier.DiscountPercent > 0 {
+			value = spend * tier.DiscountPercent / 100
+			description = fmt.Sprintf("spend %.2f reaches tier %.2f: %.2f%% off", spend, tier.MinSpend, tier.DiscountPercent)
+		}
+		st.distribute(amounts, scope, value)
+		return amounts, 0, description, nil
+	case "BUY_X_GET_Y":
+		config, err := action.ParseBuyXGetY()
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if config.BuyQuantity <= 0 || config.GetQuantity <= 0 {
+			return nil, 0, "", errors.New("buy and get quantity must be greater than zero")
+		}
+		lines := scope
+		if len(config.ProductIDs) > 0 {
+			lines = []int{}
+			for i, v := range st.lines {
+				if utils.ContainsString(config.ProductIDs, v.ProductID) {
+					lines = append(lines, i)
+				}
+			}
+		}
+		type unit struct {
+			line  int
+			price float64
+		}
+		units := []unit{}
+		for _, i := range lines {
+			if st.lines[i].Quantity <= 0 {
+				continue
+			}
+			price := st.lines[i].Total / st.lines[i].Quantity
+			for n := 0; n < int(math.Floor(st.lines[i].Quantity+amountEpsilon)); n++ {
+				units = append(units, unit{line: i, price: price})
+			}
+		}
+		sort.SliceStable(units, func(a, b int) bool {
+			if units[a].price != units[b].price {
+				return units[a].price > units[b].price
+			}
+			return units[a].line < units[b].line
+		})
+		group := config.BuyQuantity + config.GetQuantity
+		free := 0
+		for g := 0; (g+1)*group <= len(units); g++ {
+			for n := g*group + config.BuyQuantity; n < (g+1)*group; n++ {
+				amounts[units[n].line] += units[n].price * config.DiscountPercent / 100
+				free++
+			}
+		}
+		if free == 0 {
+			return nil, 0, "", fmt.Errorf("needs at least %d eligible units", group)
+		}
+		return amounts, 0, fmt.Sprintf("buy %d get %d at %.0f%% off: %d unit(s), cheapest first", config.BuyQuantity, config.GetQuantity, config.DiscountPercent, free), nil
+	case "BUNDLE_PRICE":
+		bundle, err := action.ParseBundle()
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if len(bundle.Items) == 0 {
+			return nil, 0, "", errors.New("bundle has no items")
+		}
+		count := math.MaxFloat64
+		unitPrices := map[string]float64{}
+		productLines := map[string][]int{}
+		for _, item := range bundle.Items {
+			if item.Quantity <= 0 {
+				return nil, 0, "", errors.New("bundle item quantity must be greater than zero")
+			}
+			var quantity, total float64
+			for i, v := range st.lines {
+				if v.ProductID == item.ProductID {
+					quantity += v.Quantity
+					total += v.Total
+					productLines[item.ProductID] = append(productLines[item.ProductID], i)
+				}
+			}
+			if quantity > 0 {
+				unitPrices[item.ProductID] = total / quantity
+			}
+			count = math.Min(count, math.Floor(quantity/item.Quantity+amountEpsilon))
+		}
+		if count < 1 {
+			return nil, 0, "", errors.New("cart does not contain a complete bundle")
+		}
+		var normal float64
+		for _, item := range bundle.Items {
+			normal += item.Quantity * unitPrices[item.ProductID]
+		}
+		saving := normal - bundle.Price
+		if saving <= amountEpsilon {
+			return nil, 0, "", errors.New("bundle price is not lower than the normal price")
+		}
+		for _, item := range bundle.Items {
+			share := saving * count * item.Quantity * unitPrices[item.ProductID] / normal
+			st.distribute(amounts, productLines[item.ProductID], share)
+		}
+		return amounts, 0, fmt.Sprintf("%.0f bundle(s) at %.2f instead of %.2f", count, bundle.Price, normal), nil
+	case "FREE_ITEM":
+		for i, v := range st.lines {
+			if v.ProductID == action.ActionValue {
+				amounts[i] = v.Total
+			}
+		}
+		if len(amounts) == 0 {
+			return nil, 0, "", errors.New("free item is not in the cart")
+		}
+		return amounts, 0, "free item", nil
+	case "FREE_SHIPPING":
+		return amounts, remainingShipping, "free shipping", nil
+	case "DISCOUNT_SHIPPING":
+		value, err := strconv.ParseFloat(action.ActionValue, 64)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		return amounts, remainingShipping * value / 100, fmt.Sprintf("%.2f%% off shipping", value), nil
+	case "DISCOUNT_AMOUNT_SHIPPING":
+		value, err := strconv.ParseFloat(action.ActionValue, 64)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		return amounts, value, fmt.Sprintf("%.2f off shipping", value), nil
+	}
+	return nil, 0, "", errors.New("unknown action type")
+}
+
+// distribute spreads an amount over lines in proportion to what is left of them.
+func (st *resolveState) distribute(amounts map[int]float64, lines []int, amount float64) {
+	var total float64
+	for _, i := range lines {
+		total += st.lines[i].Total - amounts[i]
+	}
+	if total <= amountEpsilon || amount <= 0 {
+		return
+	}
+	amount = math.Min(amount, total)
+	for _, i := range lines {
+		amounts[i] += amount * (st.lines[i].Total - amounts[i]) / total
+	}
+}
+
+func (st *resolveState) totalDiscount() float64 {
+	var discount float64
+	for _, v := range st.applied {
+		discount += v.Discount + v.ShippingDiscount
+	}
+	return discount
+}
+
+func (st *resolveState) resolution() *PromotionResolution {
+	result := PromotionResolution{
+		Date:             st.cart.Date,
+		ShippingFee:      st.cart.ShippingFee,
+		ShippingDiscount: st.shippingDiscount,
+		Applied:          st.applied,
+		Skipped:          st.skipped,
+		Lines:            st.lines,
+		Explanation:      []string{},
+	}
+	for _, v := range st.lines {
+		result.Subtotal += v.Subtotal
+		result.Discount += v.Discount
+	}
+	result.Total = result.Subtotal - result.Discount + result.ShippingFee - result.ShippingDiscount
+	for _, v := range st.applied {
+		line := fmt.Sprintf("%s (priority %d): %.2f off items", v.Name, v.Priority, v.Discount)
+		if v.ShippingDiscount > 0 {
+			line += fmt.Sprintf(", %.2f off shipping", v.ShippingDiscount)
+		}
+		result.Explanation = append(result.Explanation, line)
+	}
+	for _, v := range st.skipped {
+		result.Explanation = append(result.Explanation, fmt.Sprintf("%s not applied: %s", v.Name, v.Reason))
+	}
+	if result.Applied == nil {
+		result.Applied = []AppliedPromotion{}
+	}
+	if result.Skipped == nil {
+		result.Skipped = []SkippedPromotion{}
+	}
+	return &result
+}
+
+// inTimeWindow reports whether the time of day of t lies in a "HH:MM-HH:MM" window.
+// A window whose end is before its start wraps past midnight.
+func inTimeWindow(window string, t time.Time) (bool, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return false, errors.New("invalid time window")
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return false, err
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err != nil {
+		return false, err
+	}
+	minute := t.Hour()*60 + t.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return minute >= from && minute < to, nil
+	}
+	return minute >= from || minute < to, nil
+}
+
+func splitValues(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -36,13 +36,19 @@ func NewPromotionService(db *gorm.DB, ctx *context.ERPContext) *PromotionService
 	return &PromotionService{db: db, ctx: ctx, inventoryService: inventoryService}
 }
 
+// SetDB sets the database connection of the service, e.g. the transaction of a sale, so the
+// promotions are resolved and redeemed within it.
+func (s *PromotionService) SetDB(db *gorm.DB) {
+	s.db = db
+}
+
 // Migrate applies the necessary database migrations for the promotion models.
 //
 // It ensures that the underlying database schema is up to date with the
 // current version of the PromotionModel, PromotionRuleModel, and
 // PromotionActionModel.
 func Migrate(db *gorm.DB) error {
-	return db.AutoMigrate(&models.PromotionModel{}, &models.PromotionRuleModel{}, &models.PromotionActionModel{})
+	return db.AutoMigrate(&models.PromotionModel{}, &models.PromotionRuleModel{}, &models.PromotionActionModel{}, &models.PromotionVoucherModel{}, &models.PromotionUsageModel{})
 }
 
 // CheckPromotionEligibilityByPosSales checks if a given POS sale is eligible for a promotion rule.
@@ -208,6 +214,9 @@ func (s *PromotionService) CheckPromotionEligibility(promotionID string, ruleTyp
 // The function first retrieves all actions associated with the promotion.
 // It then applies each action to the order, calculating the discount, free shipping, and free items.
 // The function finally returns the PromotionResult.
+//
+// ApplyPromotion does not check rules, usage limits or vouchers and ignores the BUY_X_GET_Y,
+// BUNDLE_PRICE and TIERED_DISCOUNT actions; use ResolvePromotions to evaluate a full cart.
 func (s *PromotionService) ApplyPromotion(promotionID string, orderTotal float64, cartItems map[string]int) (*PromotionResult, error) {
 	var actions []models.PromotionActionModel
 	err := s.ctx.DB.Where("promotion_id = ?", promotionID).Find(&actions).Error
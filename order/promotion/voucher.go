@@ -0,0 +1,196 @@
+package promotion
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/google/uuid"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// voucherAlphabet leaves out characters that are easily confused (0/O, 1/I/L).
+const voucherAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// MaxVoucherBatch is the largest number of vouchers GenerateVouchers creates at once.
+const MaxVoucherBatch = 100000
+
+// GenerateVouchers generates quantity unique single-use voucher codes for a promotion.
+//
+// Each code is prefix followed by length random characters. Codes are unique across all
+// promotions; collisions with existing codes are regenerated. The promotion is marked as
+// RequireVoucher so it is only applied with one of its codes. All vouchers of one call share
+// a batch ID.
+func (s *PromotionService) GenerateVouchers(promotionID string, quantity int, prefix string, length int, expiresAt *time.Time) ([]models.PromotionVoucherModel, error) {
+	if quantity <= 0 || quantity > MaxVoucherBatch {
+		return nil, errors.New("invalid voucher quantity")
+	}
+	if length < 6 {
+		length = 8
+	}
+	var promotion models.PromotionModel
+	if err := s.db.Select("id", "company_id", "end_date").Where("id = ?", promotionID).First(&promotion).Error; err != nil {
+		return nil, err
+	}
+	if expiresAt == nil {
+		expiresAt = &promotion.EndDate
+	}
+	prefix = strings.ToUpper(strings.TrimSpace(prefix))
+	batchID := uuid.New().String()
+
+	codes := map[string]bool{}
+	for attempt := 0; len(codes) < quantity; attempt++ {
+		if attempt > 10 {
+			return nil, errors.New("unable to generate unique voucher codes, use a longer code")
+		}
+		batch := []string{}
+		inBatch := map[string]bool{}
+		for len(codes)+len(batch) < quantity {
+			code, err := randomVoucherCode(prefix, length)
+			if err != nil {
+				return nil, err
+			}
+			if codes[code] || inBatch[code] {
+				continue
+			}
+			inBatch[code] = true
+			batch = append(batch, code)
+		}
+		existing := map[string]bool{}
+		for start := 0; start < len(batch); start += 1000 {
+			end := start + 1000
+			if end > len(batch) {
+				end = len(batch)
+			}
+			var found []string
+			if err := s.db.Model(&models.PromotionVoucherModel{}).Unscoped().
+				Where("code IN (?)", batch[start:end]).Pluck("code", &found).Error; err != nil {
+				return nil, err
+			}
+			for _, code := range found {
+				existing[code] = true
+			}
+		}
+		for _, code := range batch {
+			if !existing[code] {
+				codes[code] = true
+			}
+		}
+	}
+
+	vouchers := make([]models.PromotionVoucherModel, 0, quantity)
+	for code := range codes {
+		vouchers = append(vouchers, models.PromotionVoucherModel{
+			PromotionID: promotionID,
+			Code:        code,
+			BatchID:     batchID,
+			Status:      "AVAILABLE",
+			ExpiresAt:   expiresAt,
+			CompanyID:   promotion.CompanyID,
+		})
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(&vouchers, 500).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.PromotionModel{}).Where("id = ?", promotionID).Update("require_voucher", true).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vouchers, nil
+}
+
+// GetVoucherByCode retrieves a voucher and its promotion by code.
+func (s *PromotionService) GetVoucherByCode(code string) (*models.PromotionVoucherModel, error) {
+	var voucher models.PromotionVoucherModel
+	err := s.db.Preload("Promotion").Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&voucher).Error
+	return &voucher, err
+}
+
+// VoidVoucher makes an unused voucher unusable.
+func (s *PromotionService) VoidVoucher(id string) error {
+	result := s.db.Model(&models.PromotionVoucherModel{}).Where("id = ? AND status = ?", id, "AVAILABLE").Update("status", "VOID")
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("voucher is not available")
+	}
+	return nil
+}
+
+// GetVouchers retrieves a paginated list of vouchers.
+//
+// The list can be filtered with the promotion_id, batch_id and status query parameters and is
+// scoped to the company in the ID-Company header.
+func (s *PromotionService) GetVouchers(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Promotion", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	})
+	if search != "" {
+		stmt = stmt.Where("code ILIKE ?", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("promotion_id") != "" {
+		stmt = stmt.Where("promotion_id = ?", request.URL.Query().Get("promotion_id"))
+	}
+	if request.URL.Query().Get("batch_id") != "" {
+		stmt = stmt.Where("batch_id = ?", request.URL.Query().Get("batch_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Model(&models.PromotionVoucherModel{}).Order("created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.PromotionVoucherModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetPromotionUsages retrieves a paginated list of promotion usages, filtered with the
+// promotion_id, contact_id and status query parameters.
+func (s *PromotionService) GetPromotionUsages(request http.Request) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Promotion", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	}).Preload("Voucher", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "code")
+	})
+	if request.URL.Query().Get("promotion_id") != "" {
+		stmt = stmt.Where("promotion_id = ?", request.URL.Query().Get("promotion_id"))
+	}
+	if request.URL.Query().Get("contact_id") != "" {
+		stmt = stmt.Where("contact_id = ?", request.URL.Query().Get("contact_id"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Model(&models.PromotionUsageModel{}).Order("date desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.PromotionUsageModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+func randomVoucherCode(prefix string, length int) (string, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(voucherAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = voucherAlphabet[n.Int64()]
+	}
+	return prefix + string(b), nil
+}
@@ -0,0 +1,545 @@
+package sales
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// quantityEpsilon absorbs floating point noise when comparing quantities.
+const quantityEpsilon = 0.000001
+
+// chainRefTypes are the ref types used between the documents of the sales chain.
+var chainRefTypes = []string{"sales_quote", "sales_order"}
+
+// ConvertQuoteToOrder creates a draft sales order from the open quantities of a sales quote.
+//
+// quantities maps sales quote item IDs to the quantity to order. When it is nil, every line
+// is ordered for its open quantity. A quantity may not exceed the open quantity of the quote
+// line. The lines are copied with RefItemID pointing to the quote line, and the ordered
+// quantity of each quote line is increased. Stock is reserved for the product lines of the
+// order (see ReserveSalesOrder). The quote is marked CONVERTED once every line is fully
+// ordered, or PARTIAL otherwise.
+func (s *SalesService) ConvertQuoteToOrder(quoteID string, quantities map[string]float64, userID string, date time.Time) (*models.SalesModel, error) {
+	quote, err := s.getChainDocument(quoteID)
+	if err != nil {
+		return nil, err
+	}
+	if quote.DocumentType != models.SALES_QUOTE {
+		return nil, errors.New("document is not a sales quote")
+	}
+	order := s.copySalesHeader(quote, models.SALES_ORDER, "sales_quote", userID, date)
+	converted := true
+	for _, v := range quote.Items {
+		open := v.Quantity - v.OrderedQuantity
+		qty := open
+		if quantities != nil {
+			qty = quantities[v.ID]
+		}
+		if qty > open+quantityEpsilon {
+			return nil, fmt.Errorf("order quantity of %s exceeds open quantity %.2f", v.Description, open)
+		}
+		if open-math.Max(qty, 0) > quantityEpsilon {
+			converted = false
+		}
+		if qty <= quantityEpsilon {
+			continue
+		}
+		order.Items = append(order.Items, copySalesItem(v, qty))
+	}
+	if len(order.Items) == 0 {
+		return nil, errors.New("sales quote has been fully ordered")
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.createChainDocument(tx, &order); err != nil {
+			return err
+		}
+		for _, v := range order.Items {
+			if err := tx.Model(&models.SalesItemModel{}).Where("id = ?", *v.RefItemID).
+				Update("ordered_quantity", gorm.Expr("ordered_quantity + ?", v.Quantity)).Error; err != nil {
+				return err
+			}
+		}
+		if err := s.reserveOrderItems(tx, &order, nil); err != nil {
+			return err
+		}
+		status := "PARTIAL"
+		if converted {
+			status = "CONVERTED"
+		}
+		return tx.Model(&models.SalesModel{}).Where("id = ?", quote.ID).Update("status", status).Error
+	})
+	s.inventoryService.StockReservationService.SetDB(s.db)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// CreateDeliveryFromOrder creates a draft delivery for a sales order.
+//
+// quantities maps sales order item IDs to the quantity to deliver. When it is nil,
+// every product line is delivered for its open quantity. Lines without a product are
+// not delivered. A quantity may not exceed the open quantity of the order line. A cancelled
+// sales order cannot be delivered.
+func (s *SalesService) CreateDeliveryFromOrder(orderID string, quantities map[string]float64, userID string, date time.Time) (*models.SalesModel, error) {
+	order, err := s.getChainDocument(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.DocumentType != models.SALES_ORDER {
+		return nil, errors.New("document is not a sales order")
+	}
+	if order.Status == "CANCELLED" {
+		return nil, errors.New("sales order is cancelled")
+	}
+	delivery := s.copySalesHeader(order, models.DELIVERY, "sales_order", userID, date)
+	for _, v := range order.Items {
+		if v.ProductID == nil || v.IsCost {
+			continue
+		}
+		open := v.Quantity - v.DeliveredQuantity
+		qty := open
+		if quantities != nil {
+			q, ok := quantities[v.ID]
+			if !ok {
+				continue
+			}
+			qty = q
+		}
+		if qty <= 0 {
+			continue
+		}
+		if qty > open+quantityEpsilon {
+			return nil, fmt.Errorf("delivery quantity of %s exceeds open quantity %.2f", v.Description, open)
+		}
+		delivery.Items = append(delivery.Items, copySalesItem(v, qty))
+	}
+	if len(delivery.Items) == 0 {
+		return nil, errors.New("sales order has no open item to deliver")
+	}
+	if err := s.createChainDocument(s.db, &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// PostDelivery posts a draft delivery.
+//
+// Every line moves stock out of its warehouse, credits the inventory account and debits
+// the COGS account at the line's base price, and increases the delivered quantity of the
+// sales order line. The delivered quantity is taken from the stock reservations of the order.
+// The stock status of the sales order becomes "partial" or "delivered". A delivery of a sales
+// order cancelled in the meantime cannot be posted.
+func (s *SalesService) PostDelivery(deliveryID string, userID string, date time.Time) error {
+	delivery, err := s.getChainDocument(deliveryID)
+	if err != nil {
+		return err
+	}
+	if delivery.DocumentType != models.DELIVERY {
+		return errors.New("document is not a delivery")
+	}
+	if delivery.Status == "POSTED" {
+		return errors.New("delivery already posted")
+	}
+	if delivery.CompanyID == nil {
+		return errors.New("company ID is required")
+	}
+	var cogsAccount models.AccountModel
+	if err := s.db.Where("is_cogs_account = ? and company_id = ?", true, *delivery.CompanyID).First(&cogsAccount).Error; err != nil {
+		return errors.New("cogs account not found")
+	}
+	var inventoryAccount models.AccountModel
+	if err := s.db.Where("is_inventory_account = ? and company_id = ?", true, *delivery.CompanyID).First(&inventoryAccount).Error; err != nil {
+		return errors.New("inventory account not found")
+	}
+
+	refType := "delivery"
+	secRefType := "sales_item"
+	now := time.Now()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if delivery.RefID != nil {
+			var order models.SalesModel
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "status").
+				Where("id = ?", *delivery.RefID).First(&order).Error; err != nil {
+				return err
+			}
+			if order.Status == "CANCELLED" {
+				return errors.New("sales order is cancelled")
+			}
+		}
+		s.inventoryService.StockMovementService.SetDB(tx)
+		s.inventoryService.StockReservationService.SetDB(tx)
+		for _, v := range delivery.Items {
+			if v.ProductID == nil {
+				continue
+			}
+			if v.WarehouseID == nil {
+				return errors.New("warehouse ID is required")
+			}
+			if v.RefItemID != nil {
+				var orderItem models.SalesItemModel
+				if err := tx.Where("id = ?", *v.RefItemID).First(&orderItem).Error; err != nil {
+					return err
+				}
+				if orderItem.DeliveredQuantity+v.Quantity > orderItem.Quantity+quantityEpsilon {
+					return fmt.Errorf("delivery quantity of %s exceeds open quantity %.2f", v.Description, orderItem.Quantity-orderItem.DeliveredQuantity)
+				}
+				if err := tx.Model(&models.SalesItemModel{}).Where("id = ?", orderItem.ID).
+					Update("delivered_quantity", gorm.Expr("delivered_quantity + ?", v.Quantity)).Error; err != nil {
+					return err
+				}
+				if err := s.inventoryService.StockReservationService.Fulfil("sales_order", *orderItem.SalesID, &orderItem.ID, v.Quantity*v.UnitValue); err != nil {
+					return err
+				}
+			}
+
+			movement, err := s.inventoryService.StockMovementService.AddMovement(
+				date,
+				*v.ProductID,
+				*v.WarehouseID,
+				v.VariantID,
+				nil,
+				nil,
+				delivery.CompanyID,
+				-v.Quantity,
+				models.MovementTypeSale,
+				delivery.ID,
+				fmt.Sprintf("Delivery %s (%s)", delivery.SalesNumber, v.Description))
+			if err != nil {
+				return err
+			}
+			movement.ReferenceType = &refType
+			movement.SecondaryRefID = &v.ID
+			movement.SecondaryRefType = &secRefType
+			movement.Value = v.UnitValue
+			movement.UnitID = v.UnitID
+			if err := tx.Save(movement).Error; err != nil {
+				return err
+			}
+
+			unitCost, err := stockmovement.UnitCost(tx, *v.ProductID, v.BasePrice)
+			if err != nil {
+				return err
+			}
+			cost := unitCost * v.Quantity * v.UnitValue
+			if cost == 0 {
+				continue
+			}
+			if err := s.createDeliveryTransaction(tx, delivery, movement.ID, &cogsAccount.ID, "HPP ", v.Description, cost, 0, userID, date); err != nil {
+				return err
+			}
+			if err := s.createDeliveryTransaction(tx, delivery, movement.ID, &inventoryAccount.ID, "Persediaan ", v.Description, 0, cost, userID, date); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&models.SalesModel{}).Where("id = ?", delivery.ID).Updates(map[string]any{
+			"status":          "POSTED",
+			"stock_status":    "delivered",
+			"published_at":    now,
+			"published_by_id": userID,
+		}).Error; err != nil {
+			return err
+		}
+		if delivery.RefID == nil {
+			return nil
+		}
+		return s.updateOrderStockStatus(tx, *delivery.RefID)
+	})
+	s.inventoryService.StockMovementService.SetDB(s.db)
+	s.inventoryService.StockReservationService.SetDB(s.db)
+	return err
+}
+
+// CreateInvoiceFromOrder creates a draft invoice for the delivered but not yet invoiced quantities of a sales order.
+//
+// Lines without a product are invoiced for their ordered quantity that is not invoiced yet.
+// The invoice lines reference the sales order lines, so PostInvoice does not move stock again.
+func (s *SalesService) CreateInvoiceFromOrder(orderID string, userID string, date time.Time) (*models.SalesModel, error) {
+	order, err := s.getChainDocument(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.DocumentType != models.SALES_ORDER {
+		return nil, errors.New("document is not a sales order")
+	}
+	invoice := s.copySalesHeader(order, models.INVOICE, "sales_order", userID, date)
+	for _, v := range order.Items {
+		qty := v.Quantity - v.InvoicedQuantity
+		if v.ProductID != nil && !v.IsCost {
+			qty = v.DeliveredQuantity - v.InvoicedQuantity
+		}
+		if qty <= quantityEpsilon {
+			continue
+		}
+		invoice.Items = append(invoice.Items, copySalesItem(v, qty))
+	}
+	if len(invoice.Items) == 0 {
+		return nil, errors.New("sales order has nothing to invoice")
+	}
+	if err := s.createChainDocument(s.db, &invoice); err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// GetDocumentFlow returns the whole document chain (quote, orders, deliveries and invoices)
+// the given sales document belongs to, starting from the first document of the chain.
+func (s *SalesService) GetDocumentFlow(id string) (*models.SalesDocumentFlow, error) {
+	var doc models.SalesModel
+	if err := s.db.Select("id", "ref_id", "ref_type").Where("id = ?", id).First(&doc).Error; err != nil {
+		return nil, err
+	}
+	rootID := doc.ID
+	visited := map[string]bool{rootID: true}
+	for doc.RefID != nil && doc.RefType != nil && utils.ContainsString(chainRefTypes, *doc.RefType) && !visited[*doc.RefID] {
+		var parent models.SalesModel
+		if err := s.db.Select("id", "ref_id", "ref_type").Where("id = ?", *doc.RefID).First(&parent).Error; err != nil {
+			break
+		}
+		rootID = parent.ID
+		visited[rootID] = true
+		doc = parent
+	}
+	flow, err := s.buildFlow(rootID, id, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	return flow, nil
+}
+
+func (s *SalesService) buildFlow(id, currentID string, visited map[string]bool) (*models.SalesDocumentFlow, error) {
+	visited[id] = true
+	var doc models.SalesModel
+	err := s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at ASC")
+	}).
+		Where("id = ?", id).First(&doc).Error
+	if err != nil {
+		return nil, err
+	}
+	node := models.SalesDocumentFlow{
+		ID:           doc.ID,
+		SalesNumber:  doc.SalesNumber,
+		DocumentType: doc.DocumentType,
+		Status:       doc.Status,
+		StockStatus:  doc.StockStatus,
+		SalesDate:    doc.SalesDate,
+		Total:        doc.Total,
+		IsCurrent:    doc.ID == currentID,
+		Items:        []models.SalesDocumentFlowItem{},
+		Children:     []models.SalesDocumentFlow{},
+	}
+	for _, v := range doc.Items {
+		node.Items = append(node.Items, models.SalesDocumentFlowItem{
+			ID:                v.ID,
+			RefItemID:         v.RefItemID,
+			Description:       v.Description,
+			Quantity:          v.Quantity,
+			OrderedQuantity:   v.OrderedQuantity,
+			DeliveredQuantity: v.DeliveredQuantity,
+			InvoicedQuantity:  v.InvoicedQuantity,
+		})
+	}
+	var childIDs []string
+	if err := s.db.Model(&models.SalesModel{}).
+		Where("ref_id = ? AND ref_type IN (?)", doc.ID, chainRefTypes).
+		Order("sales_date ASC, created_at ASC").
+		Pluck("id", &childIDs).Error; err != nil {
+		return nil, err
+	}
+	for _, childID := range childIDs {
+		if visited[childID] {
+			continue
+		}
+		child, err := s.buildFlow(childID, currentID, visited)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, *child)
+	}
+	return &node, nil
+}
+
+func (s *SalesService) getChainDocument(id string) (*models.SalesModel, error) {
+	var doc models.SalesModel
+	err := s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Tax").Order("created_at ASC")
+	}).Preload("Taxes").Where("id = ?", id).First(&doc).Error
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (s *SalesService) copySalesHeader(src *models.SalesModel, docType models.SalesDocType, refType string, userID string, date time.Time) models.SalesModel {
+	prefix := map[models.SalesDocType]string{
+		models.SALES_ORDER: "SO",
+		models.DELIVERY:    "DO",
+		models.INVOICE:     "INV",
+	}[docType]
+	return models.SalesModel{
+		SalesNumber:      fmt.Sprintf("%s-%s", prefix, utils.RandomStringNumber(8, false)),
+		Code:             utils.RandString(10, false),
+		Description:      src.Description,
+		Notes:            src.Notes,
+		Status:           "DRAFT",
+		SalesDate:        date,
+		PaymentTerms:     src.PaymentTerms,
+		PaymentTermsCode: src.PaymentTermsCode,
+		TermCondition:    src.TermCondition,
+		CompanyID:        src.CompanyID,
+		UserID:           &userID,
+		ContactID:        src.ContactID,
+		ContactData:      src.ContactData,
+		DeliveryID:       src.DeliveryID,
+		DeliveryData:     src.DeliveryData,
+		Type:             src.Type,
+		DocumentType:     docType,
+		Taxes:            src.Taxes,
+		IsCompound:       src.IsCompound,
+		TaxBreakdown:     "{}",
+		RefID:            &src.ID,
+		RefType:          &refType,
+		PaymentAccountID: src.PaymentAccountID,
+		SalesUserID:      src.SalesUserID,
+		EmployeeID:       src.EmployeeID,
+		MemberID:         src.MemberID,
+	}
+}
+
+// copySalesItem copies a sales line for a follow-up document with the given quantity,
+// recalculating its totals the same way UpdateItem does.
+func copySalesItem(src models.SalesItemModel, qty float64) models.SalesItemModel {
+	item := models.SalesItemModel{
+		Description:     src.Description,
+		Notes:           src.Notes,
+		Quantity:        qty,
+		BasePrice:       src.BasePrice,
+		UnitPrice:       src.UnitPrice,
+		DiscountPercent: src.DiscountPercent,
+		ProductID:       src.ProductID,
+		VariantID:       src.VariantID,
+		WarehouseID:     src.WarehouseID,
+		SaleAccountID:   src.SaleAccountID,
+		AssetAccountID:  src.AssetAccountID,
+		TaxID:           src.TaxID,
+		UnitID:          src.UnitID,
+		UnitValue:       src.UnitValue,
+		IsCost:          src.IsCost,
+		RefItemID:       &src.ID,
+	}
+	if item.UnitValue == 0 {
+		item.UnitValue = 1
+	}
+	if src.DiscountPercent == 0 && src.Quantity > 0 {
+		item.DiscountAmount = src.DiscountAmount * qty / src.Quantity
+	}
+	taxPercent := 0.0
+	if src.Tax != nil {
+		taxPercent = src.Tax.Amount
+	}
+	item.SubtotalBeforeDisc = (item.Quantity * item.UnitValue) * item.UnitPrice
+	if item.DiscountPercent > 0 {
+		item.DiscountAmount = item.SubtotalBeforeDisc * item.DiscountPercent / 100
+	}
+	item.SubTotal = item.SubtotalBeforeDisc - item.DiscountAmount
+	item.TotalTax = item.SubTotal * (taxPercent / 100)
+	item.Total = item.SubTotal + item.TotalTax
+	return item
+}
+
+func (s *SalesService) createChainDocument(tx *gorm.DB, doc *models.SalesModel) error {
+	if err := tx.Omit("Taxes.*").Create(doc).Error; err != nil {
+		return err
+	}
+	var totalBeforeTax, totalBeforeDisc, itemsTax, totalDisc float64
+	for _, v := range doc.Items {
+		totalBeforeDisc += v.SubtotalBeforeDisc
+		totalBeforeTax += v.SubTotal
+		itemsTax += v.TotalTax
+		totalDisc += v.DiscountAmount
+	}
+	afterTax, salesTaxAmount, _ := s.CalculateTaxes(totalBeforeTax, doc.IsCompound, doc.Taxes)
+	doc.TotalBeforeTax = totalBeforeTax
+	doc.TotalBeforeDisc = totalBeforeDisc
+	doc.Subtotal = afterTax
+	doc.TotalTax = itemsTax + salesTaxAmount
+	doc.Total = doc.Subtotal + doc.TotalTax
+	doc.TotalDiscount = totalDisc
+	return tx.Omit(clause.Associations).Save(doc).Error
+}
+
+// addInvoicedQuantity increases the invoiced quantity of the sales order line an invoice line refers to.
+func (s *SalesService) addInvoicedQuantity(tx *gorm.DB, item models.SalesItemModel) error {
+	var orderItem models.SalesItemModel
+	if err := tx.Where("id = ?", *item.RefItemID).First(&orderItem).Error; err != nil {
+		return err
+	}
+	allowed := orderItem.Quantity
+	if orderItem.ProductID != nil && !orderItem.IsCost {
+		allowed = orderItem.DeliveredQuantity
+	}
+	if orderItem.InvoicedQuantity+item.Quantity > allowed+quantityEpsilon {
+		return fmt.Errorf("invoiced quantity of %s exceeds %.2f", item.Description, allowed-orderItem.InvoicedQuantity)
+	}
+	return tx.Model(&models.SalesItemModel{}).Where("id = ?", orderItem.ID).
+		Update("invoiced_quantity", gorm.Expr("invoiced_quantity + ?", item.Quantity)).Error
+}
+
+func (s *SalesService) updateOrderStockStatus(tx *gorm.DB, orderID string) error {
+	var items []models.SalesItemModel
+	if err := tx.Where("sales_id = ?", orderID).Find(&items).Error; err != nil {
+		return err
+	}
+	delivered := 0
+	complete := true
+	for _, v := range items {
+		if v.ProductID == nil || v.IsCost {
+			continue
+		}
+		if v.DeliveredQuantity > 0 {
+			delivered++
+		}
+		if v.DeliveredQuantity+quantityEpsilon < v.Quantity {
+			complete = false
+		}
+	}
+	status := "pending"
+	if delivered > 0 {
+		status = "partial"
+		if complete {
+			status = "delivered"
+		}
+	}
+	return tx.Model(&models.SalesModel{}).Where("id = ? AND document_type = ?", orderID, models.SALES_ORDER).Update("stock_status", status).Error
+}
+
+func (s *SalesService) createDeliveryTransaction(tx *gorm.DB, delivery *models.SalesModel, movementID string, accountID *string, label, notes string, debit, credit float64, userID string, date time.Time) error {
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: utils.Uuid()},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   accountID,
+		Description:                 label + delivery.SalesNumber,
+		Notes:                       notes,
+		TransactionRefID:            &movementID,
+		TransactionRefType:          "stock_movement",
+		TransactionSecondaryRefID:   &delivery.ID,
+		TransactionSecondaryRefType: "delivery",
+		CompanyID:                   delivery.CompanyID,
+		Debit:                       debit,
+		Credit:                      credit,
+		Amount:                      debit + credit,
+		UserID:                      &userID,
+	}).Error
+}
@@ -0,0 +1,528 @@
+package sales
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/AMETORY/ametory-erp-modules/utils/fin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// installmentEpsilon absorbs rounding differences between installments and payments.
+const installmentEpsilon = 0.005
+
+// GenerateInstallmentSchedule generates the installment schedule of a plan from its principal,
+// down payment, number of installments, interest type and rate, and admin fee. It fills the
+// totals of the plan and returns the schedule without saving it, so it also serves as a preview.
+//
+// The down payment is installment 0, due on its own due date or the plan date. The installments
+// are due every IntervalMonths months from the first due date, on the same day of the month or the
+// last day of shorter months. The rounding difference of the principal goes to the last
+// installment.
+func (s *SalesService) GenerateInstallmentSchedule(plan *models.SalesInstallmentPlanModel) ([]models.SalesInstallmentModel, error) {
+	if plan.Installments < 1 {
+		return nil, errors.New("installments must be at least 1")
+	}
+	if plan.DownPayment < 0 || plan.DownPayment >= plan.Principal {
+		return nil, errors.New("down payment must be less than the principal")
+	}
+	if plan.InterestRate < 0 || plan.AdminFee < 0 {
+		return nil, errors.New("invalid interest rate or admin fee")
+	}
+	if plan.IntervalMonths < 1 {
+		plan.IntervalMonths = 1
+	}
+	if plan.InterestType == "" {
+		plan.InterestType = models.SalesInstallmentInterestNone
+	}
+	if plan.Date.IsZero() {
+		plan.Date = time.Now()
+	}
+	firstDueDate := addMonths(plan.Date, plan.IntervalMonths)
+	if plan.FirstDueDate != nil {
+		firstDueDate = *plan.FirstDueDate
+	}
+
+	schedule := []models.SalesInstallmentModel{}
+	if plan.DownPayment > 0 {
+		dueDate := plan.Date
+		if plan.DownPaymentDueDate != nil {
+			dueDate = *plan.DownPaymentDueDate
+		}
+		schedule = append(schedule, models.SalesInstallmentModel{
+			Number:    0,
+			DueDate:   dueDate,
+			Principal: utils.AmountRound(plan.DownPayment, 2),
+			Amount:    utils.AmountRound(plan.DownPayment, 2),
+			Status:    models.SalesInstallmentUnpaid,
+		})
+	}
+
+	financed := plan.Principal - plan.DownPayment
+	n := plan.Installments
+	periodRate := plan.InterestRate / 100 / 12 * float64(plan.IntervalMonths)
+	evenPrincipal := utils.AmountRound(financed/float64(n), 2)
+	annuity := 0.0
+	if plan.InterestType == models.SalesInstallmentInterestAnuity && periodRate > 0 {
+		pmt, err := fin.Payment(periodRate, n, -financed, 0, fin.PayEnd)
+		if err != nil {
+			return nil, err
+		}
+		annuity = pmt
+	}
+
+	remaining := financed
+	plan.TotalInterest = 0
+	plan.TotalFee = 0
+	for i := 1; i <= n; i++ {
+		var principal, interest float64
+		switch plan.InterestType {
+		case models.SalesInstallmentInterestNone:
+			principal = evenPrincipal
+		case models.SalesInstallmentInterestFlat:
+			principal = evenPrincipal
+			interest = financed * periodRate
+		case models.SalesInstallmentInterestAnuity:
+			interest = remaining * periodRate
+			principal = evenPrincipal
+			if annuity > 0 {
+				principal = utils.AmountRound(annuity-interest, 2)
+			}
+		case models.SalesInstallmentInterestDeclining:
+			principal = evenPrincipal
+			interest = remaining * periodRate
+		default:
+			return nil, fmt.Errorf("unsupported interest type: %s", plan.InterestType)
+		}
+		if i == n {
+			principal = utils.AmountRound(remaining, 2)
+		}
+		interest = utils.AmountRound(interest, 2)
+		fee := utils.AmountRound(plan.AdminFee, 2)
+		remaining -= principal
+		schedule = append(schedule, models.SalesInstallmentModel{
+			Number:    i,
+			DueDate:   addMonths(firstDueDate, (i-1)*plan.IntervalMonths),
+			Principal: principal,
+			Interest:  interest,
+			Fee:       fee,
+			Amount:    utils.AmountRound(principal+interest+fee, 2),
+			Status:    models.SalesInstallmentUnpaid,
+		})
+		plan.TotalInterest += interest
+		plan.TotalFee += fee
+	}
+	plan.TotalInterest = utils.AmountRound(plan.TotalInterest, 2)
+	plan.TotalFee = utils.AmountRound(plan.TotalFee, 2)
+	plan.TotalAmount = utils.AmountRound(plan.Principal+plan.TotalInterest+plan.TotalFee, 2)
+	return schedule, nil
+}
+
+// CreateInstallmentPlan puts the outstanding balance of a posted invoice on an installment plan.
+//
+// The principal of the plan is what is left of the invoice after its payments. Interest and admin
+// fees are added to the receivable of the invoice against the unearned account of the plan and
+// recognized on its income account per installment as the installments are paid. The due date of
+// the invoice becomes the due date of the last installment.
+func (s *SalesService) CreateInstallmentPlan(salesID string, plan *models.SalesInstallmentPlanModel, userID string) error {
+	sales, err := s.GetSalesByID(salesID)
+	if err != nil {
+		return err
+	}
+	if sales.DocumentType != models.INVOICE {
+		return errors.New("document type is not invoice")
+	}
+	if sales.Status == "DRAFT" {
+		return errors.New("invoice is not posted")
+	}
+	plan.Principal = utils.AmountRound(sales.Total-sales.Paid, 2)
+	if plan.Principal <= installmentEpsilon {
+		return errors.New("invoice is already paid")
+	}
+	schedule, err := s.GenerateInstallmentSchedule(plan)
+	if err != nil {
+		return err
+	}
+	charges := plan.TotalInterest + plan.TotalFee
+	if charges > 0 && (plan.IncomeAccountID == nil || plan.UnearnedAccountID == nil || sales.PaymentAccountID == nil) {
+		return errors.New("income account, unearned account and receivable account of the invoice are required for interest and fees")
+	}
+	if plan.ID == "" {
+		plan.ID = utils.Uuid()
+	}
+	plan.SalesID = &sales.ID
+	plan.CompanyID = sales.CompanyID
+	plan.ContactID = sales.ContactID
+	plan.Status = models.SalesInstallmentPlanActive
+	plan.PaidAmount = 0
+	plan.PreviousDueDate = sales.DueDate
+	plan.UserID = &userID
+	for i := range schedule {
+		schedule[i].SalesID = &sales.ID
+	}
+	plan.Schedule = schedule
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+			First(&models.SalesModel{}, "id = ?", sales.ID).Error; err != nil {
+			return err
+		}
+		var count int64
+		if err := tx.Model(&models.SalesInstallmentPlanModel{}).
+			Where("sales_id = ? AND status != ?", sales.ID, models.SalesInstallmentPlanCanceled).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("invoice already has an installment plan")
+		}
+		if err := tx.Create(plan).Error; err != nil {
+			return err
+		}
+		if charges > 0 {
+			description := fmt.Sprintf("Bunga dan biaya cicilan %s", sales.SalesNumber)
+			if err := postInstallmentJournal(tx, sales.CompanyID, plan.Date, description, plan.Notes, sales.PaymentAccountID, plan.UnearnedAccountID, charges, plan.ID, "sales_installment_plan", &userID); err != nil {
+				return err
+			}
+		}
+		dueDate := schedule[len(schedule)-1].DueDate
+		return tx.Model(&models.SalesModel{}).Where("id = ?", sales.ID).Update("due_date", dueDate).Error
+	})
+}
+
+// CancelInstallmentPlan cancels the installment plan of an invoice that has no payment allocated
+// yet, removes the journal of its interest and fees and restores the due date the invoice had
+// before the plan.
+func (s *SalesService) CancelInstallmentPlan(salesID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var plan models.SalesInstallmentPlanModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("sales_id = ? AND status = ?", salesID, models.SalesInstallmentPlanActive).First(&plan).Error; err != nil {
+			return err
+		}
+		if plan.PaidAmount > installmentEpsilon {
+			return errors.New("installment plan already has payments")
+		}
+		if err := tx.Where("transaction_secondary_ref_id = ? AND transaction_secondary_ref_type = ?", plan.ID, "sales_installment_plan").
+			Delete(&models.TransactionModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.SalesModel{}).Where("id = ?", salesID).Update("due_date", plan.PreviousDueDate).Error; err != nil {
+			return err
+		}
+		return tx.Model(&plan).Update("status", models.SalesInstallmentPlanCanceled).Error
+	})
+}
+
+// GetInstallmentPlan retrieves the installment plan of an invoice with its schedule and
+// allocations; a canceled plan is only returned when there is no other.
+func (s *SalesService) GetInstallmentPlan(salesID string) (*models.SalesInstallmentPlanModel, error) {
+	var plan models.SalesInstallmentPlanModel
+	err := s.db.Preload("Schedule", func(db *gorm.DB) *gorm.DB {
+		return db.Order("number asc")
+	}).Preload("Allocations", func(db *gorm.DB) *gorm.DB {
+		return db.Order("date asc")
+	}).Preload("IncomeAccount").Preload("UnearnedAccount").Where("sales_id = ?", salesID).
+		Order(clause.Expr{SQL: "CASE WHEN status = ? THEN 1 ELSE 0 END, created_at desc", Vars: []any{models.SalesInstallmentPlanCanceled}}).
+		First(&plan).Error
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// InstallmentCharges returns the interest and fees an installment plan added to the receivable
+// of an invoice.
+func (s *SalesService) InstallmentCharges(salesID string) float64 {
+	var charges float64
+	s.db.Model(&models.SalesInstallmentPlanModel{}).Select("COALESCE(SUM(total_interest + total_fee), 0)").
+		Where("sales_id = ? AND status != ?", salesID, models.SalesInstallmentPlanCanceled).Scan(&charges)
+	return charges
+}
+
+// allocateInstallments allocates a payment of an invoice to the open installments of its plan, the
+// earliest first. Invoices without an active plan are ignored.
+//
+// The share of the interest and fees in the allocated amount is recognized as income: it moves
+// from the unearned account to the income account of the plan, the remainder when the installment
+// is paid in full.
+func (s *SalesService) allocateInstallments(tx *gorm.DB, salesID string, salesPaymentID *string, date time.Time, amount float64) error {
+	var plan models.SalesInstallmentPlanModel
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("sales_id = ? AND status = ?", salesID, models.SalesInstallmentPlanActive).First(&plan).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var installments []models.SalesInstallmentModel
+	if err := tx.Where("plan_id = ? AND status != ?", plan.ID, models.SalesInstallmentPaid).
+		Order("number asc").Find(&installments).Error; err != nil {
+		return err
+	}
+	left := amount
+	var salesNumber string
+	for _, installment := range installments {
+		if left <= installmentEpsilon {
+			break
+		}
+		allocated := math.Min(left, installment.Amount-installment.PaidAmount)
+		if allocated <= installmentEpsilon {
+			continue
+		}
+		allocated = utils.AmountRound(allocated, 2)
+		installmentID := installment.ID
+		if err := tx.Create(&models.SalesInstallmentAllocationModel{
+			PlanID:         &plan.ID,
+			InstallmentID:  &installmentID,
+			SalesID:        &salesID,
+			SalesPaymentID: salesPaymentID,
+			Date:           date,
+			Amount:         allocated,
+		}).Error; err != nil {
+			return err
+		}
+		updates := map[string]any{
+			"paid_amount": gorm.Expr("paid_amount + ?", allocated),
+			"status":      models.SalesInstallmentPartial,
+		}
+		paidInFull := installment.PaidAmount+allocated >= installment.Amount-installmentEpsilon
+		if paidInFull {
+			updates["status"] = models.SalesInstallmentPaid
+			updates["paid_at"] = date
+		}
+		if charges := installment.Interest + installment.Fee; charges > 0 && plan.UnearnedAccountID != nil {
+			recognized := utils.AmountRound(allocated*charges/installment.Amount, 2)
+			if paidInFull || installment.Recognized+recognized > charges {
+				recognized = utils.AmountRound(charges-installment.Recognized, 2)
+			}
+			if recognized > 0 {
+				if salesNumber == "" {
+					tx.Model(&models.SalesModel{}).Select("sales_number").Where("id = ?", salesID).Scan(&salesNumber)
+				}
+				description := fmt.Sprintf("Pendapatan bunga dan biaya cicilan %d %s", installment.Number, salesNumber)
+				if err := postInstallmentJournal(tx, plan.CompanyID, date, description, plan.Notes, plan.UnearnedAccountID, plan.IncomeAccountID, recognized, installment.ID, "sales_installment", nil); err != nil {
+					return err
+				}
+				updates["recognized"] = gorm.Expr("recognized + ?", recognized)
+			}
+		}
+		if err := tx.Model(&models.SalesInstallmentModel{}).Where("id = ?", installment.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		left -= allocated
+		plan.PaidAmount += allocated
+	}
+	status := plan.Status
+	if plan.PaidAmount >= plan.TotalAmount-installmentEpsilon {
+		status = models.SalesInstallmentPlanPaid
+	}
+	return tx.Model(&models.SalesInstallmentPlanModel{}).Where("id = ?", plan.ID).Updates(map[string]any{
+		"paid_amount": utils.AmountRound(plan.PaidAmount, 2),
+		"status":      status,
+	}).Error
+}
+
+// postInstallmentJournal posts amount on the debit account against the credit account, with the
+// installment plan or installment as secondary reference.
+func postInstallmentJournal(tx *gorm.DB, companyID *string, date time.Time, description, notes string, debitAccountID, creditAccountID *string, amount float64, refID, refType string, userID *string) error {
+	debitID := utils.Uuid()
+	creditID := utils.Uuid()
+	err := tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: debitID},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   debitAccountID,
+		Description:                 description,
+		Notes:                       notes,
+		TransactionRefID:            &creditID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &refID,
+		TransactionSecondaryRefType: refType,
+		CompanyID:                   companyID,
+		Debit:                       amount,
+		Amount:                      amount,
+		UserID:                      userID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: creditID},
+		Code:                        utils.RandString(10, false),
+		Date:                        date,
+		AccountID:                   creditAccountID,
+		Description:                 description,
+		Notes:                       notes,
+		TransactionRefID:            &debitID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &refID,
+		TransactionSecondaryRefType: refType,
+		CompanyID:                   companyID,
+		Credit:                      amount,
+		Amount:                      amount,
+		UserID:                      userID,
+	}).Error
+}
+
+// GetReceivableAging reports the open receivables of a company per installment as of a date,
+// grouped by days past due: current, 1-30, 31-60, 61-90 and over 90 days. Invoices without an
+// installment plan are reported as a single line due on the due date of the invoice (or its date).
+// contactID is optional and narrows the report to one customer.
+//
+// The outstanding amounts are the current ones; asOf only sets the days past due.
+func (s *SalesService) GetReceivableAging(companyID, contactID string, asOf time.Time) (*models.ReceivableAgingReport, error) {
+	report := models.ReceivableAgingReport{AsOf: asOf, Lines: []models.ReceivableAgingLine{}, Contacts: []models.ReceivableAgingContact{}}
+
+	var installments []struct {
+		ID          string
+		PlanID      string
+		SalesID     string
+		SalesNumber string
+		ContactID   *string
+		ContactName string
+		Number      int
+		DueDate     time.Time
+		Amount      float64
+		PaidAmount  float64
+	}
+	stmt := s.db.Model(&models.SalesInstallmentModel{}).
+		Select("sales_installments.id, sales_installments.plan_id, sales_installments.sales_id, sales.sales_number, sales_installment_plans.contact_id, COALESCE(contacts.name, '') AS contact_name, sales_installments.number, sales_installments.due_date, sales_installments.amount, sales_installments.paid_amount").
+		Joins("JOIN sales_installment_plans ON sales_installment_plans.id = sales_installments.plan_id AND sales_installment_plans.deleted_at IS NULL").
+		Joins("JOIN sales ON sales.id = sales_installments.sales_id").
+		Joins("LEFT JOIN contacts ON contacts.id = sales_installment_plans.contact_id").
+		Where("sales_installment_plans.company_id = ? AND sales_installment_plans.status = ?", companyID, models.SalesInstallmentPlanActive).
+		Where("sales_installments.status != ?", models.SalesInstallmentPaid)
+	if contactID != "" {
+		stmt = stmt.Where("sales_installment_plans.contact_id = ?", contactID)
+	}
+	if err := stmt.Scan(&installments).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range installments {
+		planID, installmentID, number := v.PlanID, v.ID, v.Number
+		report.Lines = append(report.Lines, models.ReceivableAgingLine{
+			ContactID:         v.ContactID,
+			ContactName:       v.ContactName,
+			SalesID:           v.SalesID,
+			SalesNumber:       v.SalesNumber,
+			PlanID:            &planID,
+			InstallmentID:     &installmentID,
+			InstallmentNumber: &number,
+			DueDate:           v.DueDate,
+			Amount:            v.Amount,
+			Paid:              v.PaidAmount,
+			Outstanding:       utils.AmountRound(v.Amount-v.PaidAmount, 2),
+		})
+	}
+
+	var invoices []struct {
+		ID          string
+		SalesNumber string
+		ContactID   *string
+		ContactName string
+		SalesDate   time.Time
+		DueDate     *time.Time
+		Total       float64
+		Paid        float64
+	}
+	stmt = s.db.Model(&models.SalesModel{}).
+		Select("sales.id, sales.sales_number, sales.contact_id, COALESCE(contacts.name, '') AS contact_name, sales.sales_date, sales.due_date, sales.total, COALESCE((SELECT SUM(sales_payments.amount) FROM sales_payments WHERE sales_payments.sales_id = sales.id AND sales_payments.deleted_at IS NULL), 0) AS paid").
+		Joins("LEFT JOIN contacts ON contacts.id = sales.contact_id").
+		Joins("LEFT JOIN accounts ON accounts.id = sales.payment_account_id").
+		Where("sales.company_id = ? AND sales.document_type = ? AND UPPER(sales.status) NOT IN ?", companyID, models.INVOICE, []string{"DRAFT", "CANCELED"}).
+		Where("accounts.type IS NULL OR accounts.type != ?", models.ASSET).
+		Where("NOT EXISTS (SELECT 1 FROM sales_installment_plans WHERE sales_installment_plans.sales_id = sales.id AND sales_installment_plans.status != ? AND sales_installment_plans.deleted_at IS NULL)", models.SalesInstallmentPlanCanceled)
+	if contactID != "" {
+		stmt = stmt.Where("sales.contact_id = ?", contactID)
+	}
+	if err := stmt.Scan(&invoices).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range invoices {
+		if v.Total-v.Paid <= installmentEpsilon {
+			continue
+		}
+		dueDate := v.SalesDate
+		if v.DueDate != nil {
+			dueDate = *v.DueDate
+		}
+		report.Lines = append(report.Lines, models.ReceivableAgingLine{
+			ContactID:   v.ContactID,
+			ContactName: v.ContactName,
+			SalesID:     v.ID,
+			SalesNumber: v.SalesNumber,
+			DueDate:     dueDate,
+			Amount:      v.Total,
+			Paid:        v.Paid,
+			Outstanding: utils.AmountRound(v.Total-v.Paid, 2),
+		})
+	}
+
+	sort.Slice(report.Lines, func(i, j int) bool {
+		if report.Lines[i].ContactName != report.Lines[j].ContactName {
+			return report.Lines[i].ContactName < report.Lines[j].ContactName
+		}
+		return report.Lines[i].DueDate.Before(report.Lines[j].DueDate)
+	})
+	contacts := map[string]int{}
+	for i, line := range report.Lines {
+		line.DaysOverdue = 0
+		if asOf.After(line.DueDate) {
+			line.DaysOverdue = int(asOf.Sub(line.DueDate).Hours() / 24)
+		}
+		key := ""
+		if line.ContactID != nil {
+			key = *line.ContactID
+		}
+		idx, ok := contacts[key]
+		if !ok {
+			report.Contacts = append(report.Contacts, models.ReceivableAgingContact{ContactID: line.ContactID, ContactName: line.ContactName})
+			idx = len(report.Contacts) - 1
+			contacts[key] = idx
+		}
+		line.Bucket = addToAgingBucket(&report.Contacts[idx].ReceivableAgingBuckets, line.DaysOverdue, line.Outstanding)
+		addToAgingBucket(&report.Totals, line.DaysOverdue, line.Outstanding)
+		report.Lines[i] = line
+	}
+	return &report, nil
+}
+
+// addToAgingBucket adds an outstanding amount to its aging bucket and returns the bucket name.
+func addToAgingBucket(buckets *models.ReceivableAgingBuckets, daysOverdue int, amount float64) string {
+	buckets.Total += amount
+	switch {
+	case daysOverdue <= 0:
+		buckets.Current += amount
+		return "CURRENT"
+	case daysOverdue <= 30:
+		buckets.Days1To30 += amount
+		return "1-30"
+	case daysOverdue <= 60:
+		buckets.Days31To60 += amount
+		return "31-60"
+	case daysOverdue <= 90:
+		buckets.Days61To90 += amount
+		return "61-90"
+	default:
+		buckets.Over90 += amount
+		return "90+"
+	}
+}
+
+// addMonths adds months to a date, keeping the day of the month or the last day of a shorter month.
+func addMonths(date time.Time, months int) time.Time {
+	first := time.Date(date.Year(), date.Month()+time.Month(months), 1, date.Hour(), date.Minute(), date.Second(), 0, date.Location())
+	day := date.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
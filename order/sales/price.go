@@ -0,0 +1,52 @@
+package sales
+
+import (
+	"errors"
+
+	"github.com/AMETORY/ametory-erp-modules/inventory/product"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+// ResolveItemPrice returns the price of a product, or of its variant, on a sales document. The
+// price lists of the customer of the document, its customer groups and the sales channel are
+// applied on the date of the document; the resolution explains which entry won and why the
+// others did not.
+func (s *SalesService) ResolveItemPrice(sales *models.SalesModel, productID string, variantID *string, quantity float64) (*product.PriceResolution, error) {
+	if s.inventoryService == nil {
+		return nil, errors.New("inventory service is not initialized")
+	}
+	return s.inventoryService.PriceListService.ResolvePrice(product.PriceRequest{
+		CompanyID: sales.CompanyID,
+		ProductID: productID,
+		VariantID: variantID,
+		ContactID: sales.ContactID,
+		Channel:   models.PriceChannelSales,
+		Quantity:  quantity,
+		Date:      sales.SalesDate,
+	})
+}
+
+// applyItemPrice prices a sales item from the price lists of the document. When a price list
+// entry applies, the unit price of the item becomes the list price; a DISCOUNT entry keeps the
+// base price of the product as unit price and sets the discount percent instead. It reports
+// whether an entry applied; otherwise the unit price and discount of the item are kept.
+func (s *SalesService) applyItemPrice(sales *models.SalesModel, item *models.SalesItemModel) (bool, error) {
+	resolution, err := s.ResolveItemPrice(sales, *item.ProductID, item.VariantID, item.Quantity)
+	if err != nil {
+		return false, err
+	}
+	item.PriceListItemID = nil
+	if resolution.Rule == nil {
+		return false, nil
+	}
+	item.PriceListItemID = &resolution.Rule.ItemID
+	item.DiscountAmount = 0
+	if resolution.Rule.Method == models.PriceListItemDiscount && resolution.BasePrice > 0 {
+		item.UnitPrice = resolution.BasePrice
+		item.DiscountPercent = (resolution.BasePrice - resolution.Price) / resolution.BasePrice * 100
+	} else {
+		item.UnitPrice = resolution.Price
+		item.DiscountPercent = 0
+	}
+	return true, nil
+}
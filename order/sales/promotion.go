@@ -0,0 +1,76 @@
+package sales
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/promotion"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm"
+)
+
+// applyPromotions resolves the promotions of the company for the lines of an invoice within tx,
+// adds their discount to the discounted lines, recalculates the totals of the invoice and
+// redeems the promotions, so the invoice is not posted when a usage limit or voucher was taken
+// in the meantime.
+func (s *SalesService) applyPromotions(tx *gorm.DB, sales *models.SalesModel, userID string, date time.Time) error {
+	if s.promotionService == nil || sales.CompanyID == nil {
+		return nil
+	}
+	cart := promotion.PromotionCart{
+		ContactID: sales.ContactID,
+		Date:      date,
+		CompanyID: sales.CompanyID,
+	}
+	if sales.VoucherCode != "" {
+		cart.VoucherCodes = []string{sales.VoucherCode}
+	}
+	for i, v := range sales.Items {
+		if v.ProductID == nil || v.Quantity <= 0 || v.SubTotal <= 0 {
+			continue
+		}
+		unitValue := v.UnitValue
+		if unitValue == 0 {
+			unitValue = 1
+		}
+		cart.Items = append(cart.Items, promotion.PromotionCartItem{
+			LineID:    strconv.Itoa(i),
+			ProductID: *v.ProductID,
+			VariantID: v.VariantID,
+			Quantity:  v.Quantity * unitValue,
+			UnitPrice: v.SubTotal / (v.Quantity * unitValue),
+		})
+	}
+	if len(cart.Items) == 0 {
+		return nil
+	}
+	s.promotionService.SetDB(tx)
+	defer s.promotionService.SetDB(s.db)
+	resolution, err := s.promotionService.ResolvePromotions(cart)
+	if err != nil {
+		return err
+	}
+	if len(resolution.Applied) == 0 {
+		return nil
+	}
+	for _, line := range resolution.Lines {
+		if line.Discount <= 0 {
+			continue
+		}
+		i, err := strconv.Atoi(line.LineID)
+		if err != nil || i >= len(sales.Items) {
+			continue
+		}
+		item := &sales.Items[i]
+		subTotal := item.SubTotal - line.Discount
+		item.TotalTax = item.TotalTax * subTotal / item.SubTotal
+		item.DiscountAmount += line.Discount
+		if item.SubtotalBeforeDisc > 0 {
+			item.DiscountPercent = item.DiscountAmount / item.SubtotalBeforeDisc * 100
+		}
+		item.SubTotal = subTotal
+		item.Total = item.SubTotal + item.TotalTax
+	}
+	s.sumTotal(sales)
+	return s.promotionService.RedeemPromotions(resolution, sales.ContactID, &userID, sales.ID, "sales")
+}
@@ -0,0 +1,114 @@
+package sales
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"gorm.io/gorm"
+)
+
+// ReserveSalesOrder reserves stock for the undelivered product lines of a sales order.
+//
+// Existing active reservations of the order are replaced. expiresAt is optional; when it is
+// nil the due date of the order is used when it lies in the future; otherwise the stock is
+// reserved until the order is delivered or cancelled.
+func (s *SalesService) ReserveSalesOrder(orderID string, expiresAt *time.Time) error {
+	order, err := s.getChainDocument(orderID)
+	if err != nil {
+		return err
+	}
+	if order.DocumentType != models.SALES_ORDER {
+		return errors.New("document is not a sales order")
+	}
+	if order.Status == "CANCELLED" {
+		return errors.New("sales order is cancelled")
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		return s.reserveOrderItems(tx, order, expiresAt)
+	})
+	s.inventoryService.StockReservationService.SetDB(s.db)
+	return err
+}
+
+// CancelSalesOrder cancels a sales order and releases its stock reservations.
+//
+// Deliveries that are already posted stay as they are; only the open quantities are released.
+// An order that is fully invoiced cannot be cancelled.
+func (s *SalesService) CancelSalesOrder(orderID string, reason string) error {
+	order, err := s.getChainDocument(orderID)
+	if err != nil {
+		return err
+	}
+	if order.DocumentType != models.SALES_ORDER {
+		return errors.New("document is not a sales order")
+	}
+	if order.Status == "CANCELLED" {
+		return errors.New("sales order already cancelled")
+	}
+	invoiced := len(order.Items) > 0
+	for _, v := range order.Items {
+		if v.InvoicedQuantity+quantityEpsilon < v.Quantity {
+			invoiced = false
+			break
+		}
+	}
+	if invoiced {
+		return errors.New("sales order has been fully invoiced")
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		s.inventoryService.StockReservationService.SetDB(tx)
+		if err := s.inventoryService.StockReservationService.Release("sales_order", order.ID, reason); err != nil {
+			return err
+		}
+		return tx.Model(&models.SalesModel{}).Where("id = ?", order.ID).Update("status", "CANCELLED").Error
+	})
+	s.inventoryService.StockReservationService.SetDB(s.db)
+	return err
+}
+
+// reserveOrderItems releases the active reservations of a sales order and reserves the open
+// base quantity of each product line again. The caller resets the reservation service DB.
+func (s *SalesService) reserveOrderItems(tx *gorm.DB, order *models.SalesModel, expiresAt *time.Time) error {
+	reservationSrv := s.inventoryService.StockReservationService
+	reservationSrv.SetDB(tx)
+	if err := reservationSrv.Release("sales_order", order.ID, "re-reserved"); err != nil {
+		return err
+	}
+	if expiresAt == nil && order.DueDate != nil && order.DueDate.After(time.Now()) {
+		expiresAt = order.DueDate
+	}
+	secRefType := "sales_item"
+	for _, v := range order.Items {
+		if v.ProductID == nil || v.IsCost {
+			continue
+		}
+		open := v.Quantity - v.DeliveredQuantity
+		if open <= quantityEpsilon {
+			continue
+		}
+		unitValue := v.UnitValue
+		if unitValue == 0 {
+			unitValue = 1
+		}
+		itemID := v.ID
+		if err := reservationSrv.Reserve(&models.StockReservationModel{
+			Date:             order.SalesDate,
+			Description:      fmt.Sprintf("Sales Order %s (%s)", order.SalesNumber, v.Description),
+			ProductID:        *v.ProductID,
+			VariantID:        v.VariantID,
+			WarehouseID:      v.WarehouseID,
+			CompanyID:        order.CompanyID,
+			Quantity:         open * unitValue,
+			ReferenceID:      order.ID,
+			ReferenceType:    "sales_order",
+			SecondaryRefID:   &itemID,
+			SecondaryRefType: &secRefType,
+			ExpiresAt:        expiresAt,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
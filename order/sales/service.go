@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -11,6 +12,10 @@ import (
 	"github.com/AMETORY/ametory-erp-modules/context"
 	"github.com/AMETORY/ametory-erp-modules/finance"
 	"github.com/AMETORY/ametory-erp-modules/inventory"
+	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/order/loyalty"
+	"github.com/AMETORY/ametory-erp-modules/order/promotion"
+	"github.com/AMETORY/ametory-erp-modules/order/sales_commission"
 	"github.com/AMETORY/ametory-erp-modules/shared"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
 	"github.com/AMETORY/ametory-erp-modules/utils"
@@ -21,18 +26,21 @@ import (
 )
 
 type SalesService struct {
-	ctx              *context.ERPContext
-	db               *gorm.DB
-	financeService   *finance.FinanceService
-	inventoryService *inventory.InventoryService
+	ctx               *context.ERPContext
+	db                *gorm.DB
+	financeService    *finance.FinanceService
+	inventoryService  *inventory.InventoryService
+	loyaltyService    *loyalty.LoyaltyService
+	commissionService *sales_commission.SalesCommissionService
+	promotionService  *promotion.PromotionService
 }
 
 // Migrate applies database schema changes for the sales module.
 // It automates the migration of sales-related models, ensuring that the database schema
-// is up to date with the current definitions of SalesModel, SalesItemModel, and SalesPaymentModel.
+// is up to date with the current definitions of SalesModel, SalesItemModel, SalesPaymentModel and the installment plan models.
 // If successful, it returns nil; otherwise, it returns an error indicating what went wrong.
 func Migrate(db *gorm.DB) error {
-	return db.AutoMigrate(&models.SalesModel{}, &models.SalesItemModel{}, &models.SalesPaymentModel{})
+	return db.AutoMigrate(&models.SalesModel{}, &models.SalesItemModel{}, &models.SalesPaymentModel{}, &models.SalesInstallmentPlanModel{}, &models.SalesInstallmentModel{}, &models.SalesInstallmentAllocationModel{})
 }
 
 // NewSalesService creates a new instance of SalesService with the given database connection, context, finance service and inventory service.
@@ -40,6 +48,33 @@ func NewSalesService(db *gorm.DB, ctx *context.ERPContext, financeService *finan
 	return &SalesService{db: db, ctx: ctx, financeService: financeService, inventoryService: inventoryService}
 }
 
+// SetDB sets the database connection of the service and of the transaction and stock movement
+// services it posts with, e.g. to post an invoice within the transaction of the caller.
+func (s *SalesService) SetDB(db *gorm.DB) {
+	s.db = db
+	s.financeService.TransactionService.SetDB(db)
+	if s.inventoryService != nil {
+		s.inventoryService.StockMovementService.SetDB(db)
+	}
+}
+
+// SetLoyaltyService sets the loyalty service. When it is set, posted invoices earn loyalty points.
+func (s *SalesService) SetLoyaltyService(loyaltyService *loyalty.LoyaltyService) {
+	s.loyaltyService = loyaltyService
+}
+
+// SetCommissionService sets the sales commission service. When it is set, invoice payments earn
+// commission for the salesperson of the invoice.
+func (s *SalesService) SetCommissionService(commissionService *sales_commission.SalesCommissionService) {
+	s.commissionService = commissionService
+}
+
+// SetPromotionService sets the promotion service. When it is set, posted invoices redeem the
+// promotions of their company.
+func (s *SalesService) SetPromotionService(promotionService *promotion.PromotionService) {
+	s.promotionService = promotionService
+}
+
 // CreateSales creates a new sales document in the database and performs relevant accounting entries.
 // If the sales document has items with a sale account and/or an asset account, transactions will be created
 // for the sale and the asset account. If the sales document has a payment account, the sales document will be
@@ -138,8 +173,9 @@ func (s *SalesService) CreateSales(data *models.SalesModel) error {
 //     - AccountID: the ID of the account receivable associated with the sales order
 //     - Credit: the payment amount
 //  5. Updates the sales order record in the database with the new paid amount.
-//  6. If the paid amount is equal to the total amount, it updates the status of the sales order to "paid".
-//  7. Commits the transaction if all operations are successful. Otherwise, it rolls back the transaction.
+//  6. If the paid amount covers the total amount and the installment charges, it updates the status of the sales order to "paid".
+//  7. If the commission service is set, it records the commission earned by the payment, keyed to the asset transaction.
+//  8. Commits the transaction if all operations are successful. Otherwise, it rolls back the transaction.
 //
 // Returns an error if any of the operations fail.
 func (s *SalesService) CreatePayment(salesID string, date time.Time, amount float64, accountReceivableID *string, accountAssetID string) error {
@@ -148,18 +184,20 @@ func (s *SalesService) CreatePayment(salesID string, date time.Time, amount floa
 		compID := s.ctx.Request.Header.Get("ID-Company")
 		companyID = &compID
 	}
-	return s.db.Transaction(func(tx *gorm.DB) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		s.financeService.TransactionService.SetDB(tx)
 
 		var data models.SalesModel
 		if err := tx.Where("id = ?", salesID).First(&data).Error; err != nil {
 			return err
 		}
 
-		if data.Paid+amount > data.Total {
+		charges := s.InstallmentCharges(data.ID)
+		if data.Paid+amount > data.Total+charges+installmentEpsilon {
 			return errors.New("amount is greater than total")
 		}
 
-		if err := s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
+		assetTransaction := models.TransactionModel{
 			Date:               date,
 			AccountID:          &accountAssetID,
 			Description:        "Pembayaran " + data.SalesNumber,
@@ -167,7 +205,8 @@ func (s *SalesService) CreatePayment(salesID string, date time.Time, amount floa
 			TransactionRefID:   &data.ID,
 			TransactionRefType: "sales",
 			CompanyID:          companyID,
-		}, amount); err != nil {
+		}
+		if err := s.financeService.TransactionService.CreateTransaction(&assetTransaction, amount); err != nil {
 			return err
 		}
 		if accountReceivableID != nil {
@@ -188,16 +227,28 @@ func (s *SalesService) CreatePayment(salesID string, date time.Time, amount floa
 		if err := tx.Save(data).Error; err != nil {
 			return err
 		}
+		if err := s.allocateInstallments(tx, data.ID, nil, date, amount); err != nil {
+			return err
+		}
 
-		if data.Paid == data.Total {
+		if data.Paid+installmentEpsilon >= data.Total+charges {
 			data.Status = "paid"
 			if err := tx.Save(data).Error; err != nil {
 				return err
 			}
 		}
 
+		if s.commissionService != nil {
+			s.commissionService.SetDB(tx)
+			defer s.commissionService.SetDB(s.db)
+			if _, err := s.commissionService.EarnFromPayment(salesID, nil, &assetTransaction.ID, date, amount); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
+	s.financeService.TransactionService.SetDB(s.db)
+	return err
 }
 
 // UpdateSales updates the sales order data with the given ID.
@@ -227,6 +278,10 @@ func (s *SalesService) DeleteSales(id string) error {
 		if err != nil {
 			return err
 		}
+		err = tx.Where("reference_id = ?", id).Delete(&models.StockReservationModel{}).Error
+		if err != nil {
+			return err
+		}
 		return tx.Where("id = ?", id).Delete(&models.SalesModel{}).Error
 	})
 
@@ -451,8 +506,10 @@ func (s *SalesService) CreateSalesFromOrderRequest(orderRequest *models.OrderReq
 //
 // It takes a sales document and a new item as input, and returns an error if the operation fails.
 //
-// The function first loads the product associated with the item, and sets the item's base price
-// to the product's price. If the product has a tax set, the item is also set to have the same tax.
+// The function first loads the product associated with the item and sets the item's base price
+// to the price of the product. When a price list of the customer applies (see ResolveItemPrice),
+// the unit price and discount of the item are taken from it and the item is recalculated.
+// If the product has a tax set, the item is also set to have the same tax.
 //
 // The function then creates the item in the database, and returns an error if the operation fails.
 //
@@ -464,6 +521,13 @@ func (s *SalesService) AddItem(sales *models.SalesModel, item *models.SalesItemM
 			return err
 		}
 		item.BasePrice = product.Price
+		applied, err := s.applyItemPrice(sales, item)
+		if err != nil {
+			return err
+		}
+		if applied {
+			s.calculateItem(item)
+		}
 
 		if product.TaxID != nil {
 			item.TaxID = product.TaxID
@@ -526,6 +590,12 @@ func (s *SalesService) GetItems(id string) ([]models.SalesItemModel, error) {
 // Finally, the function updates the sales document in the database, and returns an error if the operation fails.
 func (s *SalesService) UpdateTotal(sales *models.SalesModel) error {
 	s.db.Preload("Items").Model(sales).Find(sales)
+	s.sumTotal(sales)
+	return s.db.Omit(clause.Associations).Save(&sales).Error
+}
+
+// sumTotal recalculates the totals of a sales document from its loaded items and taxes.
+func (s *SalesService) sumTotal(sales *models.SalesModel) {
 	var totalBeforeTax, totalBeforeDisc, subTotal, itemsTax, totalDisc float64
 	for _, v := range sales.Items {
 		totalBeforeDisc += v.SubtotalBeforeDisc
@@ -545,8 +615,6 @@ func (s *SalesService) UpdateTotal(sales *models.SalesModel) error {
 	sales.TotalDiscount = totalDisc
 	b, _ := json.Marshal(taxBreakdown)
 	sales.TaxBreakdown = string(b)
-
-	return s.db.Omit(clause.Associations).Save(&sales).Error
 }
 
 // DeleteItem deletes an item from a sales document.
@@ -567,8 +635,9 @@ func (s *SalesService) DeleteItem(sales *models.SalesModel, itemID string) error
 //
 // It takes a sales document, an item ID, and an updated item as input, and returns an error if the operation fails.
 //
-// The function first loads the product associated with the item, and sets the item's base price
-// to the product's price. If the product has a tax set, the item is also set to have the same tax.
+// The function first loads the product associated with the item and sets the item's base price
+// to the price of the product. When a price list of the customer applies (see ResolveItemPrice),
+// the unit price and discount of the item are taken from it. The item is then recalculated.
 //
 // The function then updates the item in the database, and returns an error if the operation fails.
 //
@@ -580,7 +649,21 @@ func (s *SalesService) UpdateItem(sales *models.SalesModel, itemID string, item
 			return err
 		}
 		item.BasePrice = product.Price
+		if _, err := s.applyItemPrice(sales, item); err != nil {
+			return err
+		}
 	}
+	s.calculateItem(item)
+	err := s.db.Where("sales_id = ? AND id = ?", sales.ID, itemID).Omit("sales_id").Save(item).Error
+	if err != nil {
+		return err
+	}
+	return s.UpdateTotal(sales)
+}
+
+// calculateItem recalculates the unit value, subtotal, discount and tax of a sales item from its
+// quantity, unit price and discount.
+func (s *SalesService) calculateItem(item *models.SalesItemModel) {
 	taxPercent := 0.0
 	taxAmount := 0.0
 
@@ -592,7 +675,7 @@ func (s *SalesService) UpdateItem(sales *models.SalesModel, itemID string, item
 		item.UnitValue = 1
 	}
 
-	if item.TaxID != nil {
+	if item.TaxID != nil && item.Tax != nil {
 		taxPercent = item.Tax.Amount
 	}
 	item.SubtotalBeforeDisc = (item.Quantity * item.UnitValue) * item.UnitPrice
@@ -607,11 +690,6 @@ func (s *SalesService) UpdateItem(sales *models.SalesModel, itemID string, item
 	}
 	item.TotalTax = taxAmount
 	item.Total = item.SubTotal + taxAmount
-	err := s.db.Where("sales_id = ? AND id = ?", sales.ID, itemID).Omit("sales_id").Save(item).Error
-	if err != nil {
-		return err
-	}
-	return s.UpdateTotal(sales)
 }
 
 // CalculateTaxes computes the total amount after applying taxes to a base amount.
@@ -764,7 +842,10 @@ func (s *SalesService) PublishSales(data *models.SalesModel) error {
 // It verifies that the document type is "INVOICE" and that there are items present in the sales model.
 // It updates the status of the invoice to "POSTED", sets the published at and published by fields, and manages payment terms if applicable.
 // It retrieves the necessary accounts for cost of goods sold (COGS) and inventory, and creates financial transactions for each item in the sales model.
-// It also manages stock movements for products associated with the invoice.
+// It also manages stock movements for products associated with the invoice. Lines that reference a sales order
+// line (see CreateInvoiceFromOrder) only update the invoiced quantity, their stock was moved by the delivery.
+// When the promotion service is set, the promotions of the company, including the VoucherCode of
+// the invoice, are applied to the lines and redeemed within the same transaction.
 // The function executes these operations within a transaction to ensure data consistency.
 // Returns an error if any of the operations fail.
 func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID string, date time.Time) error {
@@ -811,12 +892,14 @@ func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID st
 	if err != nil {
 		return errors.New("inventory account not found")
 	}
-	if data.PaymentAccount.Type == "ASSET" {
-		data.Paid = data.Total
-
-	}
 	assetID := utils.Uuid()
 	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.applyPromotions(tx, data, userID, date); err != nil {
+			return err
+		}
+		if data.PaymentAccount.Type == "ASSET" {
+			data.Paid = data.Total
+		}
 		s.financeService.TransactionService.SetDB(tx)
 		s.inventoryService.StockMovementService.SetDB(tx)
 		totalPayment := 0.0
@@ -888,7 +971,14 @@ func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID st
 
 			}
 
-			if v.ProductID != nil {
+			if v.RefItemID != nil {
+				// stock and COGS of sales order lines are posted on delivery
+				if err := s.addInvoicedQuantity(tx, v); err != nil {
+					return err
+				}
+			}
+
+			if v.ProductID != nil && v.RefItemID == nil {
 				if v.WarehouseID == nil {
 					return errors.New("warehouse ID is required")
 				}
@@ -919,6 +1009,11 @@ func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID st
 				if err != nil {
 					return err
 				}
+				unitCost, err := stockmovement.UnitCost(tx, *v.ProductID, v.BasePrice)
+				if err != nil {
+					return err
+				}
+				cost := unitCost * v.Quantity * v.UnitValue
 				// ADD SUPPLY TRANSACTION
 				err = s.financeService.TransactionService.CreateTransaction(&models.TransactionModel{
 					Date:                        date,
@@ -930,9 +1025,9 @@ func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID st
 					TransactionSecondaryRefID:   &data.ID,
 					TransactionSecondaryRefType: refType,
 					CompanyID:                   data.CompanyID,
-					Credit:                      v.BasePrice * v.Quantity * v.UnitValue,
+					Credit:                      cost,
 					UserID:                      &userID,
-				}, v.BasePrice*v.Quantity*v.UnitValue)
+				}, cost)
 				if err != nil {
 					return err
 				}
@@ -948,9 +1043,9 @@ func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID st
 					TransactionSecondaryRefID:   &data.ID,
 					TransactionSecondaryRefType: refType,
 					CompanyID:                   data.CompanyID,
-					Debit:                       v.BasePrice * v.Quantity * v.UnitValue,
+					Debit:                       cost,
 					UserID:                      &userID,
-				}, v.BasePrice*v.Quantity*v.UnitValue)
+				}, cost)
 				if err != nil {
 					return err
 				}
@@ -978,6 +1073,16 @@ func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID st
 	})
 	s.financeService.TransactionService.SetDB(s.db)
 	s.inventoryService.StockMovementService.SetDB(s.db)
+	if err == nil && s.loyaltyService != nil {
+		if _, err := s.loyaltyService.EarnFromSales(data.ID); err != nil {
+			log.Println("ERROR LOYALTY", err)
+		}
+	}
+	if err == nil && s.inventoryService.ConsignmentService != nil {
+		if _, err := s.inventoryService.ConsignmentService.RecordSalesInvoice(data.ID, userID); err != nil {
+			log.Println("ERROR CONSIGNMENT", err)
+		}
+	}
 	return err
 }
 
@@ -985,7 +1090,8 @@ func (s *SalesService) PostInvoice(id string, data *models.SalesModel, userID st
 //
 // If the payment account is an asset account, it returns 0 immediately.
 // Otherwise, it calculates the total payment amount made to the sales order,
-// and returns the difference between the sales order total and the total payment.
+// and returns the difference between the sales order total, including the interest and fees
+// of its installment plan, and the total payment.
 // If the payment is more than the total, it returns an error.
 func (s *SalesService) GetBalance(sales *models.SalesModel) (float64, error) {
 	if sales.PaymentAccount.Type == "ASSET" {
@@ -998,8 +1104,10 @@ func (s *SalesService) GetBalance(sales *models.SalesModel) (float64, error) {
 	if err != nil {
 		return 0, err
 	}
-	if sales.Total > amount.Sum {
-		return sales.Total - amount.Sum, nil
+	// interest and fees of an installment plan are part of the receivable
+	total := sales.Total + s.InstallmentCharges(sales.ID)
+	if total > amount.Sum {
+		return total - amount.Sum, nil
 	}
 	return 0, errors.New("payment is more than total")
 }
@@ -1025,7 +1133,8 @@ func (s *SalesService) GetBalance(sales *models.SalesModel) (float64, error) {
 //     - AccountID: the ID of the contra revenue account associated with the company
 //     - Debit: the discount amount
 //  6. Saves the sales payment data in the database.
-//  7. Commits the transaction if all operations are successful. Otherwise, it rolls back the transaction.
+//  7. If the commission service is set, it records the commission earned by the payment.
+//  8. Commits the transaction if all operations are successful. Otherwise, it rolls back the transaction.
 //
 // Returns an error if any of the operations fail.
 func (s *SalesService) CreateSalesPayment(sales *models.SalesModel, salesPayment *models.SalesPaymentModel) error {
@@ -1126,7 +1235,20 @@ func (s *SalesService) CreateSalesPayment(sales *models.SalesModel, salesPayment
 
 		salesPayment.ID = paymentID
 
-		return tx.Create(salesPayment).Error
+		if err := tx.Create(salesPayment).Error; err != nil {
+			return err
+		}
+		if err := s.allocateInstallments(tx, sales.ID, &salesPayment.ID, salesPayment.PaymentDate, salesPayment.Amount); err != nil {
+			return err
+		}
+		if s.commissionService != nil {
+			s.commissionService.SetDB(tx)
+			defer s.commissionService.SetDB(s.db)
+			if _, err := s.commissionService.EarnFromSalesPayment(salesPayment.ID); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	s.financeService.TransactionService.SetDB(s.db)
 	return err
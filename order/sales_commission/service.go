@@ -0,0 +1,741 @@
+package sales_commission
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// periodFormat is the layout of a commission or target period (YYYY-MM).
+const periodFormat = "2006-01"
+
+// SalesCommissionService manages sales commission plans, the commission ledger of employees and
+// their monthly sales targets.
+//
+// The salesperson of an invoice is its employee, or else the employee linked to its sales user
+// or, failing that, to the user who created it. Commissions are earned when an invoice is paid,
+// in proportion to the paid share of the invoice, and clawed back when a return of the invoice
+// is released. Earned commissions wait for approval; approved commissions are paid through
+// payroll.
+type SalesCommissionService struct {
+	db  *gorm.DB
+	ctx *context.ERPContext
+}
+
+// NewSalesCommissionService creates a new instance of SalesCommissionService with the given database connection and context.
+func NewSalesCommissionService(db *gorm.DB, ctx *context.ERPContext) *SalesCommissionService {
+	return &SalesCommissionService{db: db, ctx: ctx}
+}
+
+// SetDB sets the database connection of the service, e.g. the transaction of a payment, so the
+// commission is earned within it.
+func (s *SalesCommissionService) SetDB(db *gorm.DB) {
+	s.db = db
+}
+
+// Migrate migrates the sales commission models.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.SalesCommissionPlanModel{},
+		&models.SalesCommissionRuleModel{},
+		&models.SalesCommissionAssignmentModel{},
+		&models.SalesCommissionModel{},
+		&models.SalesTargetModel{},
+	)
+}
+
+// commissionLine is the commission base of an invoice line.
+type commissionLine struct {
+	ProductID  *string
+	VariantID  *string
+	CategoryID *string
+	Quantity   float64
+	Base       float64
+}
+
+// GetPlans retrieves a paginated list of commission plans.
+func (s *SalesCommissionService) GetPlans(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db
+	if search != "" {
+		stmt = stmt.Where("name ILIKE ? OR description ILIKE ?",
+			"%"+search+"%",
+			"%"+search+"%",
+		)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	stmt = stmt.Model(&models.SalesCommissionPlanModel{})
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.SalesCommissionPlanModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetPlanByID retrieves a commission plan with its category rules and assigned employees.
+func (s *SalesCommissionService) GetPlanByID(id string) (*models.SalesCommissionPlanModel, error) {
+	var plan models.SalesCommissionPlanModel
+	err := s.db.Preload("Rules.Category").Preload("Assignments.Employee").Where("id = ?", id).First(&plan).Error
+	return &plan, err
+}
+
+// CreatePlan creates a new commission plan.
+func (s *SalesCommissionService) CreatePlan(data *models.SalesCommissionPlanModel) error {
+	if err := validatePlan(data); err != nil {
+		return err
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdatePlan updates a commission plan. Its rules and assignments are managed separately.
+func (s *SalesCommissionService) UpdatePlan(id string, data *models.SalesCommissionPlanModel) error {
+	if err := validatePlan(data); err != nil {
+		return err
+	}
+	var plan models.SalesCommissionPlanModel
+	if err := s.db.Where("id = ?", id).First(&plan).Error; err != nil {
+		return err
+	}
+	plan.Name = data.Name
+	plan.Description = data.Description
+	plan.Basis = data.Basis
+	plan.Percent = data.Percent
+	plan.Tiers = data.Tiers
+	if plan.Tiers == nil {
+		plan.Tiers = []models.SalesCommissionTier{}
+	}
+	plan.IsActive = data.IsActive
+	return s.db.Omit(clause.Associations).Save(&plan).Error
+}
+
+// DeletePlan deletes a commission plan. The commissions it already produced are kept.
+func (s *SalesCommissionService) DeletePlan(id string) error {
+	return s.db.Where("id = ?", id).Delete(&models.SalesCommissionPlanModel{}).Error
+}
+
+// AddRule adds a commission rate for a product category to a plan. A category has at most one
+// rule per plan.
+func (s *SalesCommissionService) AddRule(planID string, data *models.SalesCommissionRuleModel) error {
+	if data.CategoryID == nil {
+		return errors.New("category is required")
+	}
+	if err := validateRate(data.Percent, data.Tiers); err != nil {
+		return err
+	}
+	var count int64
+	s.db.Model(&models.SalesCommissionRuleModel{}).Where("plan_id = ? AND category_id = ?", planID, *data.CategoryID).Count(&count)
+	if count > 0 {
+		return errors.New("category already has a rule in this plan")
+	}
+	data.PlanID = &planID
+	return s.db.Create(data).Error
+}
+
+// DeleteRule deletes a category rule of a plan.
+func (s *SalesCommissionService) DeleteRule(ruleID string) error {
+	return s.db.Where("id = ?", ruleID).Delete(&models.SalesCommissionRuleModel{}).Error
+}
+
+// AssignPlan assigns a commission plan to an employee from startDate until endDate (nil for no
+// end). The assignment must not overlap another assignment of the employee.
+func (s *SalesCommissionService) AssignPlan(planID, employeeID string, startDate time.Time, endDate *time.Time) (*models.SalesCommissionAssignmentModel, error) {
+	if endDate != nil && endDate.Before(startDate) {
+		return nil, errors.New("end date is before start date")
+	}
+	stmt := s.db.Model(&models.SalesCommissionAssignmentModel{}).
+		Where("employee_id = ?", employeeID).
+		Where("end_date IS NULL OR end_date >= ?", startDate)
+	if endDate != nil {
+		stmt = stmt.Where("start_date <= ?", *endDate)
+	}
+	var count int64
+	stmt.Count(&count)
+	if count > 0 {
+		return nil, errors.New("employee already has a commission plan in this period")
+	}
+	assignment := models.SalesCommissionAssignmentModel{
+		PlanID:     &planID,
+		EmployeeID: &employeeID,
+		StartDate:  startDate,
+		EndDate:    endDate,
+	}
+	if err := s.db.Create(&assignment).Error; err != nil {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+// EndAssignment ends an assignment of a commission plan on endDate.
+func (s *SalesCommissionService) EndAssignment(assignmentID string, endDate time.Time) error {
+	return s.db.Model(&models.SalesCommissionAssignmentModel{}).Where("id = ?", assignmentID).Update("end_date", endDate).Error
+}
+
+// DeleteAssignment deletes an assignment of a commission plan.
+func (s *SalesCommissionService) DeleteAssignment(assignmentID string) error {
+	return s.db.Where("id = ?", assignmentID).Delete(&models.SalesCommissionAssignmentModel{}).Error
+}
+
+// GetEmployeePlan returns the active commission plan assigned to an employee on date, with its
+// category rules.
+func (s *SalesCommissionService) GetEmployeePlan(employeeID string, date time.Time) (*models.SalesCommissionPlanModel, error) {
+	var assignment models.SalesCommissionAssignmentModel
+	err := s.db.Joins("JOIN sales_commission_plans ON sales_commission_plans.id = sales_commission_assignments.plan_id").
+		Where("sales_commission_assignments.employee_id = ?", employeeID).
+		Where("sales_commission_plans.is_active = ? AND sales_commission_plans.deleted_at IS NULL", true).
+		Where("sales_commission_assignments.start_date <= ?", date).
+		Where("sales_commission_assignments.end_date IS NULL OR sales_commission_assignments.end_date >= ?", date).
+		Order("sales_commission_assignments.start_date desc").
+		First(&assignment).Error
+	if err != nil {
+		return nil, err
+	}
+	var plan models.SalesCommissionPlanModel
+	if err := s.db.Preload("Rules").Where("id = ?", *assignment.PlanID).First(&plan).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// GetCommissions retrieves a paginated commission ledger, newest first. The employee_id, period,
+// type and status query parameters filter the ledger.
+func (s *SalesCommissionService) GetCommissions(request http.Request) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Employee").Preload("Sales", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "sales_number", "sales_date", "total")
+	})
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	for _, key := range []string{"employee_id", "period", "type", "status"} {
+		if request.URL.Query().Get(key) != "" {
+			stmt = stmt.Where(key+" = ?", request.URL.Query().Get(key))
+		}
+	}
+	stmt = stmt.Model(&models.SalesCommissionModel{}).Order("date desc, created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.SalesCommissionModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// EarnFromSalesPayment records the commission earned by a payment of a sales invoice. See
+// EarnFromPayment.
+func (s *SalesCommissionService) EarnFromSalesPayment(salesPaymentID string) (*models.SalesCommissionModel, error) {
+	var payment models.SalesPaymentModel
+	if err := s.db.Where("id = ?", salesPaymentID).First(&payment).Error; err != nil {
+		return nil, err
+	}
+	if payment.SalesID == nil || payment.IsRefund {
+		return nil, nil
+	}
+	return s.EarnFromPayment(*payment.SalesID, &payment.ID, nil, payment.PaymentDate, payment.Amount)
+}
+
+// EarnFromPayment records the commission earned by a payment of amount on a sales invoice.
+//
+// The commission base of every line of the invoice (its subtotal, less its standard cost for
+// a MARGIN plan) is taken in proportion to the paid share of the invoice total. The rate of a
+// line comes from the category rule of the plan, or else the plan itself; tiered rates are
+// picked by the commission base of the salesperson in the month of the payment, this payment
+// included.
+//
+// The payment is referenced by its sales payment or, for a payment recorded without one, by the
+// journal transaction of the payment; one of them is required. It does nothing when the invoice
+// has no salesperson or the salesperson has no commission plan on the payment date. It is
+// idempotent per payment reference.
+func (s *SalesCommissionService) EarnFromPayment(salesID string, salesPaymentID, transactionID *string, date time.Time, amount float64) (*models.SalesCommissionModel, error) {
+	stmt := s.db.Where("type = ?", models.SalesCommissionEarned)
+	switch {
+	case salesPaymentID != nil:
+		stmt = stmt.Where("sales_payment_id = ?", *salesPaymentID)
+	case transactionID != nil:
+		stmt = stmt.Where("transaction_id = ?", *transactionID)
+	default:
+		return nil, errors.New("payment reference is required")
+	}
+	var existing models.SalesCommissionModel
+	err := stmt.First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var sales models.SalesModel
+	if err := s.db.Preload("Items").Where("id = ?", salesID).First(&sales).Error; err != nil {
+		return nil, err
+	}
+	if sales.DocumentType != models.INVOICE {
+		return nil, errors.New("document is not an invoice")
+	}
+	if sales.Total <= 0 || amount <= 0 {
+		return nil, nil
+	}
+	employeeID, err := s.salesEmployee(&sales)
+	if err != nil {
+		return nil, err
+	}
+	if employeeID == nil {
+		return nil, nil
+	}
+	plan, err := s.GetEmployeePlan(*employeeID, date)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := s.commissionLines(&sales, plan.Basis)
+	if err != nil {
+		return nil, err
+	}
+	share := math.Min(amount/sales.Total, 1)
+	var base float64
+	for _, line := range lines {
+		base += line.Base * share
+	}
+	if base <= 0 {
+		return nil, nil
+	}
+
+	period := date.Format(periodFormat)
+	volume := s.monthlyBase(*employeeID, period) + base
+	var commission float64
+	for _, line := range lines {
+		commission += line.Base * share * ratePercent(plan, line.CategoryID, volume) / 100
+	}
+	commission = utils.AmountRound(commission, 2)
+	if commission == 0 {
+		return nil, nil
+	}
+
+	entry := models.SalesCommissionModel{
+		CompanyID:      sales.CompanyID,
+		EmployeeID:     employeeID,
+		PlanID:         &plan.ID,
+		SalesID:        &sales.ID,
+		SalesPaymentID: salesPaymentID,
+		TransactionID:  transactionID,
+		Type:           models.SalesCommissionEarned,
+		Date:           date,
+		Period:         period,
+		Basis:          plan.Basis,
+		BaseAmount:     utils.AmountRound(base, 2),
+		Percent:        utils.AmountRound(commission/base*100, 4),
+		Amount:         commission,
+		Description:    fmt.Sprintf("Komisi pembayaran %s", sales.SalesNumber),
+		Status:         models.SalesCommissionPending,
+	}
+	if err := s.db.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ClawbackForReturn takes back the commission of the returned part of an invoice when its
+// return is released.
+//
+// The commission earned on the invoice is taken back in the share of the commission base of the
+// returned lines against the commission base of the invoice, but never more than what is left of
+// it. It is idempotent per return.
+func (s *SalesCommissionService) ClawbackForReturn(returnID string) (*models.SalesCommissionModel, error) {
+	var count int64
+	if err := s.db.Model(&models.SalesCommissionModel{}).Where("return_id = ? AND type = ?", returnID, models.SalesCommissionClawback).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, nil
+	}
+
+	var returnData models.ReturnModel
+	if err := s.db.Preload("Items").Where("id = ?", returnID).First(&returnData).Error; err != nil {
+		return nil, err
+	}
+	if returnData.Status != "RELEASED" {
+		return nil, errors.New("return is not released")
+	}
+
+	var earned []models.SalesCommissionModel
+	if err := s.db.Where("sales_id = ?", returnData.RefID).Order("date asc").Find(&earned).Error; err != nil {
+		return nil, err
+	}
+	var earnedAmount, netAmount float64
+	var first *models.SalesCommissionModel
+	for i, v := range earned {
+		if v.Status == models.SalesCommissionRejected {
+			continue
+		}
+		if v.Type == models.SalesCommissionEarned {
+			earnedAmount += v.Amount
+			if first == nil {
+				first = &earned[i]
+			}
+		}
+		netAmount += v.Amount
+	}
+	if first == nil || netAmount <= 0 {
+		return nil, nil
+	}
+
+	var sales models.SalesModel
+	if err := s.db.Preload("Items").Where("id = ?", returnData.RefID).First(&sales).Error; err != nil {
+		return nil, err
+	}
+	lines, err := s.commissionLines(&sales, first.Basis)
+	if err != nil {
+		return nil, err
+	}
+	var invoiceBase, returnedBase float64
+	for _, line := range lines {
+		invoiceBase += line.Base
+	}
+	for _, item := range returnData.Items {
+		for _, line := range lines {
+			if line.Quantity == 0 || !sameID(line.ProductID, item.ProductID) || !sameID(line.VariantID, item.VariantID) {
+				continue
+			}
+			returnedBase += line.Base / line.Quantity * math.Min(item.Quantity, line.Quantity)
+			break
+		}
+	}
+	if invoiceBase <= 0 || returnedBase <= 0 {
+		return nil, nil
+	}
+
+	clawback := utils.AmountRound(math.Min(earnedAmount*math.Min(returnedBase/invoiceBase, 1), netAmount), 2)
+	if clawback <= 0 {
+		return nil, nil
+	}
+	date := returnData.Date
+	if returnData.ReleasedAt != nil {
+		date = *returnData.ReleasedAt
+	}
+	entry := models.SalesCommissionModel{
+		CompanyID:   sales.CompanyID,
+		EmployeeID:  first.EmployeeID,
+		PlanID:      first.PlanID,
+		SalesID:     &sales.ID,
+		ReturnID:    &returnData.ID,
+		Type:        models.SalesCommissionClawback,
+		Date:        date,
+		Period:      date.Format(periodFormat),
+		Basis:       first.Basis,
+		BaseAmount:  -utils.AmountRound(returnedBase, 2),
+		Percent:     utils.AmountRound(clawback/returnedBase*100, 4),
+		Amount:      -clawback,
+		Description: fmt.Sprintf("Retur %s atas %s", returnData.ReturnNumber, sales.SalesNumber),
+		Status:      models.SalesCommissionPending,
+	}
+	if err := s.db.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ApproveCommissions approves pending commissions, both earnings and clawbacks, so they are
+// paid through the next payroll of the employee.
+func (s *SalesCommissionService) ApproveCommissions(ids []string, userID string) error {
+	now := time.Now()
+	return s.db.Model(&models.SalesCommissionModel{}).
+		Where("id IN ? AND status = ?", ids, models.SalesCommissionPending).
+		Updates(map[string]any{
+			"status":         models.SalesCommissionApproved,
+			"approved_at":    now,
+			"approved_by_id": userID,
+		}).Error
+}
+
+// RejectCommissions rejects pending commissions; they are never paid.
+func (s *SalesCommissionService) RejectCommissions(ids []string, userID string) error {
+	now := time.Now()
+	return s.db.Model(&models.SalesCommissionModel{}).
+		Where("id IN ? AND status = ?", ids, models.SalesCommissionPending).
+		Updates(map[string]any{
+			"status":         models.SalesCommissionRejected,
+			"approved_at":    now,
+			"approved_by_id": userID,
+		}).Error
+}
+
+// SetTarget creates or replaces the monthly sales target of an employee.
+func (s *SalesCommissionService) SetTarget(data *models.SalesTargetModel) error {
+	if data.EmployeeID == nil {
+		return errors.New("employee is required")
+	}
+	if _, err := time.Parse(periodFormat, data.Period); err != nil {
+		return errors.New("period must be in YYYY-MM format")
+	}
+	if data.TargetAmount < 0 {
+		return errors.New("target amount must not be negative")
+	}
+	var target models.SalesTargetModel
+	err := s.db.Where("employee_id = ? AND period = ?", *data.EmployeeID, data.Period).First(&target).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return s.db.Create(data).Error
+	}
+	if err != nil {
+		return err
+	}
+	target.TargetAmount = data.TargetAmount
+	target.Notes = data.Notes
+	if err := s.db.Omit(clause.Associations).Save(&target).Error; err != nil {
+		return err
+	}
+	*data = target
+	return nil
+}
+
+// DeleteTarget deletes a sales target.
+func (s *SalesCommissionService) DeleteTarget(id string) error {
+	return s.db.Where("id = ?", id).Delete(&models.SalesTargetModel{}).Error
+}
+
+// GetTargets retrieves a paginated list of sales targets. The employee_id and period query
+// parameters filter the list.
+func (s *SalesCommissionService) GetTargets(request http.Request) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Employee")
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	for _, key := range []string{"employee_id", "period"} {
+		if request.URL.Query().Get(key) != "" {
+			stmt = stmt.Where(key+" = ?", request.URL.Query().Get(key))
+		}
+	}
+	stmt = stmt.Model(&models.SalesTargetModel{}).Order("period desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.SalesTargetModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetTargetAchievement returns the sales of an employee in a period (YYYY-MM) against the target
+// of that period.
+//
+// Invoiced is the subtotal before tax of the invoices issued in the period, Returned the subtotal
+// of the returns of the invoices of the employee released in the period and Collected the
+// payments received in the period. Achievement is NetSales against the target, in percent.
+func (s *SalesCommissionService) GetTargetAchievement(employeeID, period string) (*models.SalesTargetAchievement, error) {
+	start, err := time.Parse(periodFormat, period)
+	if err != nil {
+		return nil, errors.New("period must be in YYYY-MM format")
+	}
+	end := start.AddDate(0, 1, 0)
+	var employee models.EmployeeModel
+	if err := s.db.Select("id", "user_id").Where("id = ?", employeeID).First(&employee).Error; err != nil {
+		return nil, err
+	}
+
+	result := models.SalesTargetAchievement{EmployeeID: employeeID, Period: period}
+	var target models.SalesTargetModel
+	if err := s.db.Where("employee_id = ? AND period = ?", employeeID, period).First(&target).Error; err == nil {
+		result.Target = target.TargetAmount
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	invoices := s.employeeInvoices(&employee)
+	if err := invoices.
+		Where("sales.sales_date >= ? AND sales.sales_date < ?", start, end).
+		Select("COALESCE(SUM(sales.total_before_tax), 0)").
+		Scan(&result.Invoiced).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.ReturnItemModel{}).
+		Joins("JOIN returns ON returns.id = return_items.return_id").
+		Where("returns.status = ? AND returns.deleted_at IS NULL", "RELEASED").
+		Where("COALESCE(returns.released_at, returns.date) >= ? AND COALESCE(returns.released_at, returns.date) < ?", start, end).
+		Where("returns.ref_id IN (?)", s.employeeInvoices(&employee).Select("sales.id")).
+		Select("COALESCE(SUM(return_items.sub_total), 0)").
+		Scan(&result.Returned).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.SalesPaymentModel{}).
+		Where("payment_date >= ? AND payment_date < ?", start, end).
+		Where("is_refund = ?", false).
+		Where("sales_id IN (?)", s.employeeInvoices(&employee).Select("sales.id")).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&result.Collected).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.SalesCommissionModel{}).
+		Where("employee_id = ? AND period = ? AND status <> ?", employeeID, period, models.SalesCommissionRejected).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&result.Commission).Error; err != nil {
+		return nil, err
+	}
+
+	result.NetSales = result.Invoiced - result.Returned
+	if result.Target > 0 {
+		result.Achievement = utils.AmountRound(result.NetSales/result.Target*100, 2)
+	}
+	return &result, nil
+}
+
+// salesEmployee returns the salesperson of a sales document: its employee, or else the employee
+// of its sales user or of the user who created it.
+func (s *SalesCommissionService) salesEmployee(sales *models.SalesModel) (*string, error) {
+	if sales.EmployeeID != nil {
+		return sales.EmployeeID, nil
+	}
+	for _, userID := range []*string{sales.SalesUserID, sales.UserID} {
+		if userID == nil {
+			continue
+		}
+		var employee models.EmployeeModel
+		stmt := s.db.Select("id").Where("user_id = ?", *userID)
+		if sales.CompanyID != nil {
+			stmt = stmt.Where("company_id = ?", *sales.CompanyID)
+		}
+		err := stmt.First(&employee).Error
+		if err == nil {
+			return &employee.ID, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// employeeInvoices returns the issued invoices whose salesperson is the employee. See
+// salesEmployee.
+func (s *SalesCommissionService) employeeInvoices(employee *models.EmployeeModel) *gorm.DB {
+	stmt := s.db.Model(&models.SalesModel{}).
+		Where("sales.document_type = ?", models.INVOICE).
+		Where("UPPER(sales.status) NOT IN ?", []string{"DRAFT", "CANCELED"})
+	if employee.UserID == nil {
+		return stmt.Where("sales.employee_id = ?", employee.ID)
+	}
+	return stmt.Where("sales.employee_id = ? OR (sales.employee_id IS NULL AND (sales.sales_user_id = ? OR (sales.sales_user_id IS NULL AND sales.user_id = ?)))",
+		employee.ID, *employee.UserID, *employee.UserID)
+}
+
+// commissionLines returns the commission base of the lines of an invoice for a basis.
+func (s *SalesCommissionService) commissionLines(sales *models.SalesModel, basis string) ([]commissionLine, error) {
+	productIDs := []string{}
+	for _, v := range sales.Items {
+		if v.ProductID != nil {
+			productIDs = append(productIDs, *v.ProductID)
+		}
+	}
+	products := map[string]models.ProductModel{}
+	if len(productIDs) > 0 {
+		var list []models.ProductModel
+		if err := s.db.Select("id", "category_id", "standard_cost").Where("id IN ?", productIDs).Find(&list).Error; err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			products[v.ID] = v
+		}
+	}
+
+	lines := []commissionLine{}
+	for _, v := range sales.Items {
+		if v.IsCost {
+			continue
+		}
+		line := commissionLine{ProductID: v.ProductID, VariantID: v.VariantID, Quantity: v.Quantity, Base: v.SubTotal}
+		if v.ProductID != nil {
+			product := products[*v.ProductID]
+			line.CategoryID = product.CategoryID
+			if basis == models.SalesCommissionBasisMargin {
+				unitValue := v.UnitValue
+				if unitValue == 0 {
+					unitValue = 1
+				}
+				line.Base -= product.StandardCost * v.Quantity * unitValue
+			}
+		}
+		if line.Base < 0 {
+			line.Base = 0
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// monthlyBase returns the commission base of an employee in a period, net of clawbacks.
+func (s *SalesCommissionService) monthlyBase(employeeID, period string) float64 {
+	var base float64
+	s.db.Model(&models.SalesCommissionModel{}).
+		Where("employee_id = ? AND period = ? AND status <> ?", employeeID, period, models.SalesCommissionRejected).
+		Select("COALESCE(SUM(base_amount), 0)").
+		Scan(&base)
+	return base
+}
+
+// ratePercent returns the commission rate of a category in a plan for a monthly commission base.
+func ratePercent(plan *models.SalesCommissionPlanModel, categoryID *string, volume float64) float64 {
+	if categoryID != nil {
+		for _, rule := range plan.Rules {
+			if rule.CategoryID != nil && *rule.CategoryID == *categoryID {
+				return tierPercent(rule.Percent, rule.Tiers, volume)
+			}
+		}
+	}
+	return tierPercent(plan.Percent, plan.Tiers, volume)
+}
+
+// tierPercent returns the percent of the highest tier reached by volume, or percent when no
+// tier is reached.
+func tierPercent(percent float64, tiers []models.SalesCommissionTier, volume float64) float64 {
+	sorted := append([]models.SalesCommissionTier{}, tiers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinAmount < sorted[j].MinAmount })
+	for _, tier := range sorted {
+		if volume < tier.MinAmount {
+			break
+		}
+		percent = tier.Percent
+	}
+	return percent
+}
+
+func validatePlan(data *models.SalesCommissionPlanModel) error {
+	if data.Name == "" {
+		return errors.New("name is required")
+	}
+	if data.Basis == "" {
+		data.Basis = models.SalesCommissionBasisRevenue
+	}
+	if data.Basis != models.SalesCommissionBasisRevenue && data.Basis != models.SalesCommissionBasisMargin {
+		return fmt.Errorf("invalid commission basis %s", data.Basis)
+	}
+	return validateRate(data.Percent, data.Tiers)
+}
+
+func validateRate(percent float64, tiers []models.SalesCommissionTier) error {
+	if percent < 0 || percent > 100 {
+		return errors.New("percent must be between 0 and 100")
+	}
+	for _, tier := range tiers {
+		if tier.MinAmount < 0 {
+			return errors.New("tier minimum amount must not be negative")
+		}
+		if tier.Percent < 0 || tier.Percent > 100 {
+			return errors.New("tier percent must be between 0 and 100")
+		}
+	}
+	return nil
+}
+
+func sameID(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
@@ -3,13 +3,17 @@ package sales_return
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/AMETORY/ametory-erp-modules/context"
 	"github.com/AMETORY/ametory-erp-modules/finance"
 	stockmovement "github.com/AMETORY/ametory-erp-modules/inventory/stock_movement"
+	"github.com/AMETORY/ametory-erp-modules/order/loyalty"
 	"github.com/AMETORY/ametory-erp-modules/order/sales"
+	"github.com/AMETORY/ametory-erp-modules/order/sales_commission"
+	"github.com/AMETORY/ametory-erp-modules/order/stored_value"
 	"github.com/AMETORY/ametory-erp-modules/shared"
 	"github.com/AMETORY/ametory-erp-modules/shared/models"
 	"github.com/AMETORY/ametory-erp-modules/utils"
@@ -27,6 +31,9 @@ type SalesReturnService struct {
 	financeService       *finance.FinanceService
 	stockMovementService *stockmovement.StockMovementService
 	salesService         *sales.SalesService
+	loyaltyService       *loyalty.LoyaltyService
+	storedValueService   *stored_value.StoredValueService
+	commissionService    *sales_commission.SalesCommissionService
 }
 
 // NewSalesReturnService creates a new instance of SalesReturnService with the given database connection, context, finance service, stock movement service and sales service.
@@ -40,6 +47,24 @@ func NewSalesReturnService(db *gorm.DB, ctx *context.ERPContext, financeService
 	}
 }
 
+// SetLoyaltyService sets the loyalty service. When it is set, released returns take back the
+// loyalty points the returned part of the sale earned.
+func (s *SalesReturnService) SetLoyaltyService(loyaltyService *loyalty.LoyaltyService) {
+	s.loyaltyService = loyaltyService
+}
+
+// SetStoredValueService sets the stored value service, which is required to refund returns to
+// store credit.
+func (s *SalesReturnService) SetStoredValueService(storedValueService *stored_value.StoredValueService) {
+	s.storedValueService = storedValueService
+}
+
+// SetCommissionService sets the sales commission service. When it is set, released returns
+// claw back the commission the returned part of the invoice earned.
+func (s *SalesReturnService) SetCommissionService(commissionService *sales_commission.SalesCommissionService) {
+	s.commissionService = commissionService
+}
+
 // Migrate migrates the database schema to the latest version.
 func Migrate(db *gorm.DB) error {
 	return db.AutoMigrate(&models.ReturnModel{}, &models.ReturnItemModel{})
@@ -211,6 +236,34 @@ func (s *SalesReturnService) CreateReturn(returnPurchase *models.ReturnModel) er
 // It also updates the associated sales by subtracting the return total from the paid amount.
 // Finally, it updates the status of the return to RELEASED and sets the released at date and released by ID.
 func (s *SalesReturnService) ReleaseReturn(returnID string, userID string, date time.Time, notes string, accountID *string) error {
+	return s.releaseReturn(returnID, userID, date, notes, accountID, false)
+}
+
+// ReleaseReturnToStoreCredit releases a sales return like ReleaseReturn and refunds the returned
+// amount to the store credit of the customer instead of paying it back from an account.
+//
+// The refund is credited to the deferred revenue account of the company and the store credit of
+// the customer of the invoice is topped up with the returned amount. The invoice must be paid at
+// least for the returned amount.
+func (s *SalesReturnService) ReleaseReturnToStoreCredit(returnID string, userID string, date time.Time, notes string) error {
+	if s.storedValueService == nil {
+		return errors.New("stored value service is not set")
+	}
+	returnPurchase, err := s.GetReturnByID(returnID)
+	if err != nil {
+		return err
+	}
+	if returnPurchase.CompanyID == nil {
+		return errors.New("company ID is required")
+	}
+	account, err := s.storedValueService.LiabilityAccount(*returnPurchase.CompanyID)
+	if err != nil {
+		return err
+	}
+	return s.releaseReturn(returnID, userID, date, notes, &account.ID, true)
+}
+
+func (s *SalesReturnService) releaseReturn(returnID string, userID string, date time.Time, notes string, accountID *string, toStoreCredit bool) error {
 	returnPurchase, err := s.GetReturnByID(returnID)
 	if err != nil {
 		return err
@@ -221,6 +274,9 @@ func (s *SalesReturnService) ReleaseReturn(returnID string, userID string, date
 	if err != nil {
 		return err
 	}
+	if toStoreCredit && sales.ContactID == nil {
+		return errors.New("sales has no customer to refund to store credit")
+	}
 
 	if len(returnPurchase.Items) == 0 {
 		return errors.New("return items is empty")
@@ -494,7 +550,7 @@ func (s *SalesReturnService) ReleaseReturn(returnID string, userID string, date
 				return err
 			}
 
-			if account.Type == models.ASSET {
+			if account.Type == models.ASSET || toStoreCredit {
 				if sales.Paid < returnTotal {
 					return errors.New("paid is less than return total")
 				}
@@ -509,12 +565,32 @@ func (s *SalesReturnService) ReleaseReturn(returnID string, userID string, date
 				})
 			}
 		}
+		if toStoreCredit {
+			// the refund is already credited to the deferred revenue account above
+			s.storedValueService.SetDB(tx)
+			defer s.storedValueService.SetDB(s.db)
+			_, err = s.storedValueService.CreditStoreCredit(*sales.CompanyID, *sales.ContactID, returnTotal, nil, date, &returnID, "return_sales", fmt.Sprintf("Retur %s", returnPurchase.ReturnNumber), &userID)
+			if err != nil {
+				return err
+			}
+		}
 		return s.UpdateReturn(returnID, returnPurchase)
 	})
 
 	s.financeService.TransactionService.SetDB(s.db)
 	s.stockMovementService.SetDB(s.db)
 
+	if err == nil && s.loyaltyService != nil {
+		if _, err := s.loyaltyService.ReverseForReturn(returnID); err != nil {
+			log.Println("ERROR LOYALTY", err)
+		}
+	}
+	if err == nil && s.commissionService != nil {
+		if _, err := s.commissionService.ClawbackForReturn(returnID); err != nil {
+			log.Println("ERROR COMMISSION", err)
+		}
+	}
+
 	return err
 }
 
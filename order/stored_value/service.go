@@ -0,0 +1,754 @@
+package stored_value
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// amountEpsilon absorbs floating point noise when comparing balances.
+const amountEpsilon = 0.000001
+
+// codeAlphabet leaves out characters that are easily confused (0/O, 1/I/L).
+const codeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+var (
+	// ErrInvalidPin is returned when the PIN of a gift card does not match.
+	ErrInvalidPin = errors.New("invalid PIN")
+	// ErrNotUsable is returned when an instrument is expired, void or inactive.
+	ErrNotUsable = errors.New("stored value is not usable")
+	// ErrInsufficientBalance is returned when an instrument has no balance left.
+	ErrInsufficientBalance = errors.New("insufficient stored value balance")
+)
+
+// StoredValueService manages stored-value instruments: gift cards and customer store credit.
+//
+// The balance of every instrument is a liability of the company, kept in a deferred revenue
+// account (an account flagged is_deferred_revenue, or the liability account of the
+// instrument). Issuing and topping up credit the deferred revenue account against the account
+// that received the money; redeeming debits it against the settlement account of the order the
+// instrument pays for (e.g. the payment account of a POS sale or sales invoice), so the revenue
+// is recognized when the goods are delivered. Breakage of expired balances is recognized as
+// income.
+type StoredValueService struct {
+	db  *gorm.DB
+	ctx *context.ERPContext
+}
+
+// NewStoredValueService creates a new instance of StoredValueService with the given database connection and context.
+func NewStoredValueService(db *gorm.DB, ctx *context.ERPContext) *StoredValueService {
+	return &StoredValueService{db: db, ctx: ctx}
+}
+
+// SetDB sets the database connection of the service, e.g. to run it inside a transaction.
+func (s *StoredValueService) SetDB(db *gorm.DB) {
+	s.db = db
+}
+
+// Migrate migrates the stored value models.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&models.StoredValueModel{}, &models.StoredValueTransactionModel{})
+}
+
+// IssueRequest describes a new gift card or store credit.
+//
+// AccountID is the account debited against the deferred revenue account: the cash or bank
+// account that received the money of a sold gift card, or an expense account for promotional
+// cards. Code is generated when empty; a 6 digit PIN is generated when GeneratePin is set.
+type IssueRequest struct {
+	Type               models.StoredValueType `json:"type"`
+	CompanyID          *string                `json:"company_id"`
+	ContactID          *string                `json:"contact_id"`
+	Amount             float64                `json:"amount"`
+	Code               string                 `json:"code"`
+	Pin                string                 `json:"pin"`
+	GeneratePin        bool                   `json:"generate_pin"`
+	ExpiresAt          *time.Time             `json:"expires_at"`
+	AccountID          *string                `json:"account_id"`
+	LiabilityAccountID *string                `json:"liability_account_id"`
+	Date               time.Time              `json:"date"`
+	ReferenceID        *string                `json:"reference_id"`
+	ReferenceType      string                 `json:"reference_type"`
+	Notes              string                 `json:"notes"`
+	UserID             *string                `json:"user_id"`
+}
+
+// IssueResult is the issued instrument. Pin is the plain PIN, it is only available here.
+type IssueResult struct {
+	StoredValue *models.StoredValueModel `json:"stored_value"`
+	Pin         string                   `json:"pin,omitempty"`
+}
+
+// RedeemRequest describes a payment with a stored-value instrument.
+//
+// The instrument is identified by Code (and Pin for gift cards with a PIN) or by
+// StoredValueID. Amount is the amount to pay; when the balance is lower only the balance is
+// redeemed and the rest has to be paid with another tender. SettlementAccountID is credited
+// against the deferred revenue account.
+type RedeemRequest struct {
+	CompanyID           string     `json:"company_id"`
+	StoredValueID       string     `json:"stored_value_id"`
+	Code                string     `json:"code"`
+	Pin                 string     `json:"pin"`
+	Amount              float64    `json:"amount"`
+	SettlementAccountID *string    `json:"settlement_account_id"`
+	Date                time.Time  `json:"date"`
+	ReferenceID         *string    `json:"reference_id"`
+	ReferenceType       string     `json:"reference_type"` // pos, sales, order
+	Description         string     `json:"description"`
+	UserID              *string    `json:"user_id"`
+	Now                 *time.Time `json:"-"`
+}
+
+// BalanceInquiry is the public view of an instrument balance.
+type BalanceInquiry struct {
+	Code      string                   `json:"code"`
+	Type      models.StoredValueType   `json:"type"`
+	Status    models.StoredValueStatus `json:"status"`
+	Balance   float64                  `json:"balance"`
+	ExpiresAt *time.Time               `json:"expires_at,omitempty"`
+}
+
+// LiabilityAccount returns the deferred revenue account of a company.
+func (s *StoredValueService) LiabilityAccount(companyID string) (*models.AccountModel, error) {
+	var account models.AccountModel
+	err := s.db.Where("is_deferred_revenue = ? and company_id = ?", true, companyID).First(&account).Error
+	if err != nil {
+		return nil, errors.New("deferred revenue account not found")
+	}
+	return &account, nil
+}
+
+// Issue issues a gift card or a store credit and posts its liability.
+//
+// Store credit is kept in one instrument per contact: issuing store credit to a contact that
+// already has one tops the existing instrument up.
+func (s *StoredValueService) Issue(req IssueRequest) (*IssueResult, error) {
+	if req.CompanyID == nil {
+		return nil, errors.New("company ID is required")
+	}
+	if req.Amount < 0 {
+		return nil, errors.New("amount must not be negative")
+	}
+	if req.Amount > amountEpsilon && req.AccountID == nil {
+		return nil, errors.New("account ID is required")
+	}
+	if req.Type == "" {
+		req.Type = models.StoredValueGiftCard
+	}
+	if req.Type != models.StoredValueGiftCard && req.Type != models.StoredValueStoreCredit {
+		return nil, errors.New("invalid stored value type")
+	}
+	if req.Date.IsZero() {
+		req.Date = time.Now()
+	}
+	if req.Type == models.StoredValueStoreCredit {
+		if req.ContactID == nil {
+			return nil, errors.New("contact ID is required for store credit")
+		}
+		var existing models.StoredValueModel
+		err := s.db.Where("type = ? and company_id = ? and contact_id = ? and status = ?", models.StoredValueStoreCredit, *req.CompanyID, *req.ContactID, models.StoredValueActive).
+			First(&existing).Error
+		if err == nil {
+			if req.Amount > amountEpsilon {
+				if _, err := s.TopUp(existing.ID, req.Amount, req.AccountID, req.Date, req.ReferenceID, req.ReferenceType, req.Notes, req.UserID); err != nil {
+					return nil, err
+				}
+			}
+			storedValue, err := s.GetStoredValueByID(existing.ID)
+			if err != nil {
+				return nil, err
+			}
+			return &IssueResult{StoredValue: storedValue}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	liabilityAccountID := req.LiabilityAccountID
+	if liabilityAccountID == nil {
+		account, err := s.LiabilityAccount(*req.CompanyID)
+		if err != nil {
+			return nil, err
+		}
+		liabilityAccountID = &account.ID
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if code == "" {
+		prefix := "GC"
+		if req.Type == models.StoredValueStoreCredit {
+			prefix = "SC"
+		}
+		generated, err := s.generateCode(prefix, 16)
+		if err != nil {
+			return nil, err
+		}
+		code = generated
+	}
+	pin := req.Pin
+	if pin == "" && req.GeneratePin {
+		generated, err := randomString("0123456789", 6)
+		if err != nil {
+			return nil, err
+		}
+		pin = generated
+	}
+
+	storedValue := models.StoredValueModel{
+		BaseModel:          shared.BaseModel{ID: utils.Uuid()},
+		Type:               req.Type,
+		Code:               code,
+		ContactID:          req.ContactID,
+		CompanyID:          req.CompanyID,
+		LiabilityAccountID: liabilityAccountID,
+		InitialAmount:      req.Amount,
+		Balance:            req.Amount,
+		Status:             models.StoredValueActive,
+		IssuedAt:           req.Date,
+		ExpiresAt:          req.ExpiresAt,
+		Notes:              req.Notes,
+		UserID:             req.UserID,
+	}
+	if err := storedValue.SetPin(pin); err != nil {
+		return nil, err
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&storedValue).Error; err != nil {
+			return err
+		}
+		if req.Amount <= amountEpsilon {
+			return nil
+		}
+		entry := models.StoredValueTransactionModel{
+			StoredValueID: storedValue.ID,
+			CompanyID:     req.CompanyID,
+			Date:          req.Date,
+			Type:          models.StoredValueTxIssue,
+			Amount:        req.Amount,
+			BalanceAfter:  req.Amount,
+			AccountID:     req.AccountID,
+			ReferenceID:   req.ReferenceID,
+			ReferenceType: req.ReferenceType,
+			Description:   fmt.Sprintf("Penerbitan %s", storedValue.Code),
+			UserID:        req.UserID,
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		return s.postJournal(tx, &storedValue, &entry, req.AccountID, storedValue.LiabilityAccountID, req.Amount)
+	})
+	if err != nil {
+		return nil, err
+	}
+	storedValue.HasPin = storedValue.PinHash != ""
+	return &IssueResult{StoredValue: &storedValue, Pin: pin}, nil
+}
+
+// TopUp adds balance to an active instrument; accountID is the account that received the money.
+func (s *StoredValueService) TopUp(id string, amount float64, accountID *string, date time.Time, refID *string, refType, description string, userID *string) (*models.StoredValueTransactionModel, error) {
+	if amount <= amountEpsilon {
+		return nil, errors.New("amount must be greater than zero")
+	}
+	if accountID == nil {
+		return nil, errors.New("account ID is required")
+	}
+	return s.credit(id, models.StoredValueTxTopUp, amount, accountID, date, refID, refType, description, userID)
+}
+
+// CreditStoreCredit adds balance to the store credit of a contact, creating it when needed.
+//
+// When accountID is nil no journal is posted; the caller posts the credit to the deferred
+// revenue account itself (e.g. a sales return refunded to store credit).
+func (s *StoredValueService) CreditStoreCredit(companyID, contactID string, amount float64, accountID *string, date time.Time, refID *string, refType, description string, userID *string) (*models.StoredValueTransactionModel, error) {
+	if amount <= amountEpsilon {
+		return nil, errors.New("amount must be greater than zero")
+	}
+	var storedValue models.StoredValueModel
+	err := s.db.Where("type = ? and company_id = ? and contact_id = ? and status = ?", models.StoredValueStoreCredit, companyID, contactID, models.StoredValueActive).
+		First(&storedValue).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		result, err := s.Issue(IssueRequest{
+			Type:      models.StoredValueStoreCredit,
+			CompanyID: &companyID,
+			ContactID: &contactID,
+			Date:      date,
+			UserID:    userID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		storedValue = *result.StoredValue
+	} else if err != nil {
+		return nil, err
+	}
+	return s.credit(storedValue.ID, models.StoredValueTxRefund, amount, accountID, date, refID, refType, description, userID)
+}
+
+// GetStoreCredit retrieves the active store credit of a contact.
+func (s *StoredValueService) GetStoreCredit(companyID, contactID string) (*models.StoredValueModel, error) {
+	var storedValue models.StoredValueModel
+	err := s.db.Where("type = ? and company_id = ? and contact_id = ? and status = ?", models.StoredValueStoreCredit, companyID, contactID, models.StoredValueActive).
+		First(&storedValue).Error
+	return &storedValue, err
+}
+
+// Redeem pays (part of) an order with a stored-value instrument.
+//
+// It returns the redemption entry; its Amount is negative and may be lower than the requested
+// amount when the balance is not enough. Only instruments of the company of the request can be
+// redeemed. A sale redeeming a voucher runs it within its own transaction (see SetDB), as the POS
+// does for its VOUCHER tenders, so a failed sale does not keep the redemption.
+func (s *StoredValueService) Redeem(req RedeemRequest) (*models.StoredValueTransactionModel, error) {
+	if req.CompanyID == "" {
+		return nil, errors.New("company ID is required")
+	}
+	if req.Amount <= amountEpsilon {
+		return nil, errors.New("amount must be greater than zero")
+	}
+	if req.SettlementAccountID == nil {
+		return nil, errors.New("settlement account ID is required")
+	}
+	now := time.Now()
+	if req.Now != nil {
+		now = *req.Now
+	}
+	if req.Date.IsZero() {
+		req.Date = now
+	}
+
+	var entry models.StoredValueTransactionModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		stmt := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("company_id = ?", req.CompanyID)
+		if req.StoredValueID != "" {
+			stmt = stmt.Where("id = ?", req.StoredValueID)
+		} else {
+			stmt = stmt.Where("code = ?", strings.ToUpper(strings.TrimSpace(req.Code)))
+		}
+		var storedValue models.StoredValueModel
+		if err := stmt.First(&storedValue).Error; err != nil {
+			return err
+		}
+		if req.StoredValueID == "" && !storedValue.CheckPin(req.Pin) {
+			return ErrInvalidPin
+		}
+		if !isUsable(&storedValue, now) {
+			return ErrNotUsable
+		}
+		if storedValue.Balance <= amountEpsilon {
+			return ErrInsufficientBalance
+		}
+		amount := req.Amount
+		if amount > storedValue.Balance {
+			amount = storedValue.Balance
+		}
+		description := req.Description
+		if description == "" {
+			description = fmt.Sprintf("Penukaran %s", storedValue.Code)
+		}
+		storedValue.Balance -= amount
+		storedValue.LastUsedAt = &now
+		entry = models.StoredValueTransactionModel{
+			StoredValueID: storedValue.ID,
+			CompanyID:     storedValue.CompanyID,
+			Date:          req.Date,
+			Type:          models.StoredValueTxRedeem,
+			Amount:        -amount,
+			BalanceAfter:  storedValue.Balance,
+			AccountID:     req.SettlementAccountID,
+			ReferenceID:   req.ReferenceID,
+			ReferenceType: req.ReferenceType,
+			Description:   description,
+			UserID:        req.UserID,
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&storedValue).Updates(map[string]any{
+			"balance":      storedValue.Balance,
+			"last_used_at": storedValue.LastUsedAt,
+		}).Error; err != nil {
+			return err
+		}
+		return s.postJournal(tx, &storedValue, &entry, storedValue.LiabilityAccountID, req.SettlementAccountID, amount)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RedeemStoreCredit pays (part of) an order with the store credit of a contact.
+func (s *StoredValueService) RedeemStoreCredit(companyID, contactID string, req RedeemRequest) (*models.StoredValueTransactionModel, error) {
+	storedValue, err := s.GetStoreCredit(companyID, contactID)
+	if err != nil {
+		return nil, err
+	}
+	req.CompanyID = companyID
+	req.StoredValueID = storedValue.ID
+	return s.Redeem(req)
+}
+
+// ReverseRedemptions gives back the balance redeemed for a reference, e.g. when the POS sale or
+// order it paid for is cancelled or refunded to its original tender. Redemptions that were
+// already reversed are skipped.
+func (s *StoredValueService) ReverseRedemptions(refType, refID string, date time.Time, userID *string) ([]models.StoredValueTransactionModel, error) {
+	var redemptions []models.StoredValueTransactionModel
+	err := s.db.Where("reference_type = ? and reference_id = ? and type = ?", refType, refID, models.StoredValueTxRedeem).
+		Where("id NOT IN (?)", s.db.Model(&models.StoredValueTransactionModel{}).Select("reversal_of_id").Where("reversal_of_id IS NOT NULL")).
+		Find(&redemptions).Error
+	if err != nil {
+		return nil, err
+	}
+	reversals := []models.StoredValueTransactionModel{}
+	for _, redemption := range redemptions {
+		var reversal models.StoredValueTransactionModel
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var storedValue models.StoredValueModel
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", redemption.StoredValueID).First(&storedValue).Error; err != nil {
+				return err
+			}
+			amount := -redemption.Amount
+			storedValue.Balance += amount
+			reversal = models.StoredValueTransactionModel{
+				StoredValueID: storedValue.ID,
+				CompanyID:     storedValue.CompanyID,
+				Date:          date,
+				Type:          models.StoredValueTxReversal,
+				Amount:        amount,
+				BalanceAfter:  storedValue.Balance,
+				AccountID:     redemption.AccountID,
+				ReferenceID:   redemption.ReferenceID,
+				ReferenceType: redemption.ReferenceType,
+				ReversalOfID:  &redemption.ID,
+				Description:   fmt.Sprintf("Pembatalan penukaran %s", storedValue.Code),
+				UserID:        userID,
+			}
+			if err := tx.Create(&reversal).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&storedValue).Update("balance", storedValue.Balance).Error; err != nil {
+				return err
+			}
+			return s.postJournal(tx, &storedValue, &reversal, redemption.AccountID, storedValue.LiabilityAccountID, amount)
+		})
+		if err != nil {
+			return reversals, err
+		}
+		reversals = append(reversals, reversal)
+	}
+	return reversals, nil
+}
+
+// Inquire returns the balance of an instrument of a company by code and PIN.
+func (s *StoredValueService) Inquire(companyID, code, pin string) (*BalanceInquiry, error) {
+	var storedValue models.StoredValueModel
+	if err := s.db.Where("company_id = ? AND code = ?", companyID, strings.ToUpper(strings.TrimSpace(code))).First(&storedValue).Error; err != nil {
+		return nil, err
+	}
+	if !storedValue.CheckPin(pin) {
+		return nil, ErrInvalidPin
+	}
+	status := storedValue.Status
+	if status == models.StoredValueActive && storedValue.ExpiresAt != nil && !storedValue.ExpiresAt.After(time.Now()) {
+		status = models.StoredValueExpired
+	}
+	return &BalanceInquiry{
+		Code:      storedValue.Code,
+		Type:      storedValue.Type,
+		Status:    status,
+		Balance:   storedValue.Balance,
+		ExpiresAt: storedValue.ExpiresAt,
+	}, nil
+}
+
+// SetPin replaces the PIN of an instrument; an empty PIN removes it.
+func (s *StoredValueService) SetPin(id, pin string) error {
+	var storedValue models.StoredValueModel
+	if err := storedValue.SetPin(pin); err != nil {
+		return err
+	}
+	return s.db.Model(&models.StoredValueModel{}).Where("id = ?", id).Update("pin_hash", storedValue.PinHash).Error
+}
+
+// Void makes an instrument unusable. A remaining balance is taken out of the deferred revenue
+// account against accountID (the cash account when the balance is paid back, or an income
+// account when it is forfeited).
+func (s *StoredValueService) Void(id string, accountID *string, reason string, userID *string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var storedValue models.StoredValueModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&storedValue).Error; err != nil {
+			return err
+		}
+		if storedValue.Status == models.StoredValueVoid {
+			return errors.New("stored value is already void")
+		}
+		if storedValue.Balance > amountEpsilon {
+			if accountID == nil {
+				return errors.New("account ID is required to void a stored value with balance")
+			}
+			if err := s.close(tx, &storedValue, models.StoredValueTxVoid, accountID, time.Now(), fmt.Sprintf("Pembatalan %s %s", storedValue.Code, reason), userID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&storedValue).Update("status", models.StoredValueVoid).Error
+	})
+}
+
+// ExpireStoredValues expires the active instruments of a company whose expiry date has passed.
+// Their remaining balance is recognized as breakage income in breakageAccountID. It returns
+// the number of expired instruments.
+func (s *StoredValueService) ExpireStoredValues(companyID string, now time.Time, breakageAccountID string) (int, error) {
+	var ids []string
+	err := s.db.Model(&models.StoredValueModel{}).
+		Where("company_id = ? and status = ? and expires_at IS NOT NULL and expires_at <= ?", companyID, models.StoredValueActive, now).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, id := range ids {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var storedValue models.StoredValueModel
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? and status = ?", id, models.StoredValueActive).First(&storedValue).Error; err != nil {
+				return err
+			}
+			if storedValue.Balance > amountEpsilon {
+				if err := s.close(tx, &storedValue, models.StoredValueTxExpire, &breakageAccountID, now, fmt.Sprintf("Kedaluwarsa %s", storedValue.Code), nil); err != nil {
+					return err
+				}
+			}
+			return tx.Model(&storedValue).Update("status", models.StoredValueExpired).Error
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// GetStoredValueByID retrieves an instrument by ID.
+func (s *StoredValueService) GetStoredValueByID(id string) (*models.StoredValueModel, error) {
+	var storedValue models.StoredValueModel
+	err := s.db.Preload("Contact").Where("id = ?", id).First(&storedValue).Error
+	return &storedValue, err
+}
+
+// GetStoredValueByCode retrieves an instrument by code.
+func (s *StoredValueService) GetStoredValueByCode(code string) (*models.StoredValueModel, error) {
+	var storedValue models.StoredValueModel
+	err := s.db.Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&storedValue).Error
+	return &storedValue, err
+}
+
+// GetStoredValues retrieves a paginated list of instruments.
+//
+// The list can be filtered with the type, status and contact_id query parameters and is scoped
+// to the company in the ID-Company header.
+func (s *StoredValueService) GetStoredValues(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Contact", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	})
+	if search != "" {
+		stmt = stmt.Where("code ILIKE ? OR notes ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("type") != "" {
+		stmt = stmt.Where("type = ?", request.URL.Query().Get("type"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	if request.URL.Query().Get("contact_id") != "" {
+		stmt = stmt.Where("contact_id = ?", request.URL.Query().Get("contact_id"))
+	}
+	stmt = stmt.Model(&models.StoredValueModel{}).Order("created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.StoredValueModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetTransactions retrieves a paginated list of the balance mutations of an instrument.
+func (s *StoredValueService) GetTransactions(request http.Request, storedValueID string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Where("stored_value_id = ?", storedValueID)
+	if request.URL.Query().Get("type") != "" {
+		stmt = stmt.Where("type = ?", request.URL.Query().Get("type"))
+	}
+	stmt = stmt.Model(&models.StoredValueTransactionModel{}).Order("date desc, created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.StoredValueTransactionModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// credit adds balance to an active instrument and posts it against accountID when set.
+func (s *StoredValueService) credit(id string, txType models.StoredValueTransactionType, amount float64, accountID *string, date time.Time, refID *string, refType, description string, userID *string) (*models.StoredValueTransactionModel, error) {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var entry models.StoredValueTransactionModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var storedValue models.StoredValueModel
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&storedValue).Error; err != nil {
+			return err
+		}
+		if !isUsable(&storedValue, time.Now()) {
+			return ErrNotUsable
+		}
+		if description == "" {
+			description = fmt.Sprintf("Isi ulang %s", storedValue.Code)
+		}
+		storedValue.Balance += amount
+		entry = models.StoredValueTransactionModel{
+			StoredValueID: storedValue.ID,
+			CompanyID:     storedValue.CompanyID,
+			Date:          date,
+			Type:          txType,
+			Amount:        amount,
+			BalanceAfter:  storedValue.Balance,
+			AccountID:     accountID,
+			ReferenceID:   refID,
+			ReferenceType: refType,
+			Description:   description,
+			UserID:        userID,
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&storedValue).Update("balance", storedValue.Balance).Error; err != nil {
+			return err
+		}
+		if accountID == nil {
+			return nil
+		}
+		return s.postJournal(tx, &storedValue, &entry, accountID, storedValue.LiabilityAccountID, amount)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// close takes the whole balance of a locked instrument out of the deferred revenue account.
+func (s *StoredValueService) close(tx *gorm.DB, storedValue *models.StoredValueModel, txType models.StoredValueTransactionType, accountID *string, date time.Time, description string, userID *string) error {
+	amount := storedValue.Balance
+	storedValue.Balance = 0
+	entry := models.StoredValueTransactionModel{
+		StoredValueID: storedValue.ID,
+		CompanyID:     storedValue.CompanyID,
+		Date:          date,
+		Type:          txType,
+		Amount:        -amount,
+		AccountID:     accountID,
+		Description:   description,
+		UserID:        userID,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(storedValue).Update("balance", 0).Error; err != nil {
+		return err
+	}
+	return s.postJournal(tx, storedValue, &entry, storedValue.LiabilityAccountID, accountID, amount)
+}
+
+// postJournal posts a balanced journal for a stored value mutation.
+func (s *StoredValueService) postJournal(tx *gorm.DB, storedValue *models.StoredValueModel, entry *models.StoredValueTransactionModel, debitAccountID, creditAccountID *string, amount float64) error {
+	if debitAccountID == nil || creditAccountID == nil {
+		return errors.New("journal accounts are required")
+	}
+	debitID := utils.Uuid()
+	creditID := utils.Uuid()
+	err := tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: debitID},
+		Code:                        utils.RandString(10, false),
+		Date:                        entry.Date,
+		AccountID:                   debitAccountID,
+		Description:                 entry.Description,
+		TransactionRefID:            &creditID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &entry.ID,
+		TransactionSecondaryRefType: "stored_value",
+		CompanyID:                   storedValue.CompanyID,
+		Debit:                       amount,
+		Amount:                      amount,
+		UserID:                      entry.UserID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.TransactionModel{
+		BaseModel:                   shared.BaseModel{ID: creditID},
+		Code:                        utils.RandString(10, false),
+		Date:                        entry.Date,
+		AccountID:                   creditAccountID,
+		Description:                 entry.Description,
+		TransactionRefID:            &debitID,
+		TransactionRefType:          "transaction",
+		TransactionSecondaryRefID:   &entry.ID,
+		TransactionSecondaryRefType: "stored_value",
+		CompanyID:                   storedValue.CompanyID,
+		Credit:                      amount,
+		Amount:                      amount,
+		UserID:                      entry.UserID,
+	}).Error
+}
+
+// generateCode generates an instrument code that is not used yet.
+func (s *StoredValueService) generateCode(prefix string, length int) (string, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		random, err := randomString(codeAlphabet, length)
+		if err != nil {
+			return "", err
+		}
+		code := prefix + random
+		var count int64
+		if err := s.db.Model(&models.StoredValueModel{}).Unscoped().Where("code = ?", code).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return code, nil
+		}
+	}
+	return "", errors.New("unable to generate a unique stored value code")
+}
+
+func isUsable(storedValue *models.StoredValueModel, now time.Time) bool {
+	if storedValue.Status != models.StoredValueActive {
+		return false
+	}
+	return storedValue.ExpiresAt == nil || storedValue.ExpiresAt.After(now)
+}
+
+func randomString(alphabet string, length int) (string, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,569 @@
+package subscription
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+)
+
+// maxCatchUpPeriods bounds the periods a single billing run invoices for one subscription
+// that was not billed for a while.
+const maxCatchUpPeriods = 24
+
+// Subscription invoice statuses.
+const (
+	InvoiceOpen   = "OPEN"
+	InvoicePaid   = "PAID"
+	InvoiceFailed = "FAILED"
+	InvoiceVoid   = "VOID"
+)
+
+// Subscription invoice types.
+const (
+	InvoiceRecurring = "RECURRING"
+	InvoiceProration = "PRORATION"
+)
+
+// BillingRunResult summarizes a billing run.
+type BillingRunResult struct {
+	Activated int      `json:"activated"` // trials converted to paid subscriptions
+	Resumed   int      `json:"resumed"`
+	Invoiced  int      `json:"invoiced"`
+	Cancelled int      `json:"cancelled"` // cancelled at period end or by dunning
+	Charged   int      `json:"charged"`   // payment attempts through the payment provider
+	Paid      int      `json:"paid"`
+	Retried   int      `json:"retried"` // unpaid invoices rescheduled by dunning
+	Failed    int      `json:"failed"`  // invoices that ran out of dunning retries
+	Errors    []string `json:"errors"`
+}
+
+// invoiceLine is a line of a subscription invoice.
+type invoiceLine struct {
+	Description string
+	Quantity    float64
+	UnitPrice   float64
+	Discount    float64
+}
+
+// RunBilling runs the billing of a company at now. It is meant to be called periodically.
+//
+// It resumes paused subscriptions whose resume date passed, converts ended trials, applies
+// cancellations and plan changes scheduled for the end of the period, invoices every due period
+// (deducting the credit balance of the subscription) and charges the invoices of subscriptions
+// with AutoCharge. It then runs the dunning of unpaid invoices. Errors of single subscriptions
+// are collected in the result and do not stop the run.
+//
+// The user ID is recorded as publisher of the invoices and is required.
+func (s *SubscriptionService) RunBilling(companyID string, userID string, now time.Time) (*BillingRunResult, error) {
+	if userID == "" {
+		return nil, errors.New("user ID is required")
+	}
+	result := &BillingRunResult{Errors: []string{}}
+
+	var paused []models.SubscriptionModel
+	if err := s.db.Select("id", "resume_at").Where("company_id = ? AND status = ? AND resume_at <= ?", companyID, models.SubscriptionPaused, now).Find(&paused).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range paused {
+		if err := s.ResumeSubscription(v.ID, userID, *v.ResumeAt); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", v.ID, err))
+			continue
+		}
+		result.Resumed++
+	}
+
+	var due []models.SubscriptionModel
+	if err := s.db.Select("id").Where("company_id = ? AND status IN (?) AND next_billing_date <= ?", companyID, []models.SubscriptionStatus{
+		models.SubscriptionTrialing,
+		models.SubscriptionActive,
+		models.SubscriptionPastDue,
+	}, now).Order("next_billing_date asc").Find(&due).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range due {
+		if err := s.billSubscription(v.ID, userID, now, result); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", v.ID, err))
+		}
+	}
+
+	if err := s.runDunning(companyID, userID, now, result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// GetInvoices retrieves a paginated list of the invoices of a subscription, or of all
+// subscriptions of the company in the ID-Company header when subscriptionID is empty. The
+// list can be filtered with the status query parameter.
+func (s *SubscriptionService) GetInvoices(request http.Request, subscriptionID string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Sales", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "sales_number", "total", "paid", "status", "due_date", "contact_data", "delivery_data", "tax_breakdown")
+	}).Model(&models.SubscriptionInvoiceModel{})
+	if subscriptionID != "" {
+		stmt = stmt.Where("subscription_id = ?", subscriptionID)
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	stmt = stmt.Order("period_start desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.SubscriptionInvoiceModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// RecordPayment records a payment of a subscription invoice on its sales invoice and marks the
+// invoice paid once it is settled. The payment needs an asset account.
+func (s *SubscriptionService) RecordPayment(invoiceID string, payment *models.SalesPaymentModel) error {
+	var invoice models.SubscriptionInvoiceModel
+	if err := s.db.Where("id = ?", invoiceID).First(&invoice).Error; err != nil {
+		return err
+	}
+	sales, err := s.salesService.GetSalesByID(invoice.SalesID)
+	if err != nil {
+		return err
+	}
+	payment.SalesID = &sales.ID
+	payment.CompanyID = sales.CompanyID
+	if payment.PaymentDate.IsZero() {
+		payment.PaymentDate = time.Now()
+	}
+	if err := s.salesService.CreateSalesPayment(sales, payment); err != nil {
+		return err
+	}
+	_, err = s.syncInvoice(&invoice, payment.PaymentDate)
+	return err
+}
+
+// SyncInvoicePayment checks the payments of the sales invoice of a subscription invoice, for
+// example after a payment provider callback, and marks it paid when it is settled. A past due
+// subscription without other overdue invoices becomes active again.
+func (s *SubscriptionService) SyncInvoicePayment(invoiceID string, now time.Time) (bool, error) {
+	var invoice models.SubscriptionInvoiceModel
+	if err := s.db.Where("id = ?", invoiceID).First(&invoice).Error; err != nil {
+		return false, err
+	}
+	return s.syncInvoice(&invoice, now)
+}
+
+// billSubscription invoices the due periods of a subscription.
+func (s *SubscriptionService) billSubscription(id string, userID string, now time.Time, result *BillingRunResult) error {
+	for i := 0; i < maxCatchUpPeriods; i++ {
+		subscription, err := s.GetSubscriptionByID(id)
+		if err != nil {
+			return err
+		}
+		if !isBillable(subscription.Status) || subscription.NextBillingDate == nil || subscription.NextBillingDate.After(now) {
+			return nil
+		}
+		if err := s.billPeriod(subscription, userID, now, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// billPeriod applies the changes scheduled for the next billing date of a subscription and
+// invoices the period starting there. Everything happens within one transaction on the locked
+// subscription, so a concurrent cancellation or plan change is either applied or waits for it.
+func (s *SubscriptionService) billPeriod(subscription *models.SubscriptionModel, userID string, now time.Time, result *BillingRunResult) error {
+	periodStart := *subscription.NextBillingDate
+	cancelled := false
+	activated := false
+	var invoice *models.SubscriptionInvoiceModel
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		locked, err := s.lockedSubscription(tx, subscription)
+		if err != nil {
+			return err
+		}
+		if locked.NextBillingDate == nil || !locked.NextBillingDate.Equal(periodStart) {
+			return errors.New("subscription was billed concurrently")
+		}
+		subscription = locked
+
+		if subscription.CancelAtPeriodEnd {
+			cancelled = true
+			return s.cancel(tx, subscription, subscription.CancelReason, userID, periodStart)
+		}
+		if subscription.PendingPlanID != nil {
+			newPlan, err := s.GetPlanByID(*subscription.PendingPlanID)
+			if err != nil {
+				return err
+			}
+			quantity := subscription.PendingQuantity
+			if quantity <= 0 {
+				quantity = subscription.Quantity
+			}
+			if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", subscription.ID).Updates(map[string]any{
+				"plan_id":          newPlan.ID,
+				"quantity":         quantity,
+				"pending_plan_id":  nil,
+				"pending_quantity": 0,
+			}).Error; err != nil {
+				return err
+			}
+			mrrDelta := 0.0
+			if countsForMRR(subscription.Status) {
+				mrrDelta = newPlan.MonthlyAmount(quantity) - subscription.Plan.MonthlyAmount(subscription.Quantity)
+			}
+			if err := s.recordEvent(tx, subscription, models.SubscriptionEventPlanChanged, periodStart, &subscription.PlanID, &newPlan.ID, mrrDelta, 0, fmt.Sprintf("%s x%v -> %s x%v", subscription.Plan.Name, subscription.Quantity, newPlan.Name, quantity), &userID); err != nil {
+				return err
+			}
+			subscription.PlanID = newPlan.ID
+			subscription.Plan = newPlan
+			subscription.Quantity = quantity
+			subscription.PendingPlanID = nil
+			subscription.PendingQuantity = 0
+		}
+		if subscription.Status == models.SubscriptionTrialing {
+			if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", subscription.ID).Update("status", models.SubscriptionActive).Error; err != nil {
+				return err
+			}
+			if err := s.recordEvent(tx, subscription, models.SubscriptionEventActivated, periodStart, nil, &subscription.PlanID, subscription.Plan.MonthlyAmount(subscription.Quantity), 1, "", &userID); err != nil {
+				return err
+			}
+			subscription.Status = models.SubscriptionActive
+			activated = true
+		}
+
+		plan := subscription.Plan
+		periodEnd := plan.NextPeriod(periodStart)
+		credit := subscription.CreditBalance
+		if amount := plan.Price * subscription.Quantity; credit > amount {
+			credit = amount
+		}
+
+		var existing int64
+		if err := tx.Model(&models.SubscriptionInvoiceModel{}).
+			Where("subscription_id = ? AND type = ? AND period_start = ?", subscription.ID, InvoiceRecurring, periodStart).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing == 0 {
+			lines := []invoiceLine{{
+				Description: fmt.Sprintf("%s (%s - %s)", plan.Name, periodStart.Format("02/01/2006"), periodEnd.AddDate(0, 0, -1).Format("02/01/2006")),
+				Quantity:    subscription.Quantity,
+				UnitPrice:   plan.Price,
+				Discount:    credit,
+			}}
+			invoice, err = s.createInvoice(tx, subscription, plan, InvoiceRecurring, periodStart, periodEnd, lines, userID, now)
+			if err != nil {
+				return err
+			}
+		} else {
+			credit = 0
+		}
+
+		if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", subscription.ID).Updates(map[string]any{
+			"current_period_start": periodStart,
+			"current_period_end":   periodEnd,
+			"next_billing_date":    periodEnd,
+			"credit_balance":       subscription.CreditBalance - credit,
+		}).Error; err != nil {
+			return err
+		}
+		if invoice == nil {
+			return nil
+		}
+		return s.recordEvent(tx, subscription, models.SubscriptionEventInvoiced, periodStart, nil, &subscription.PlanID, 0, 0, fmt.Sprintf("%v", invoice.Amount), &userID)
+	})
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		result.Cancelled++
+		return nil
+	}
+	if activated {
+		result.Activated++
+	}
+	if invoice != nil {
+		result.Invoiced++
+		if s.attemptPayment(subscription, invoice, now) {
+			result.Charged++
+		}
+	}
+	return nil
+}
+
+// createInvoice creates and posts the sales invoice of a subscription within tx and links it to
+// the subscription. The invoice is booked on the sale and receivable accounts of the plan.
+func (s *SubscriptionService) createInvoice(tx *gorm.DB, subscription *models.SubscriptionModel, plan *models.SubscriptionPlanModel, invoiceType string, periodStart, periodEnd time.Time, lines []invoiceLine, userID string, now time.Time) (*models.SubscriptionInvoiceModel, error) {
+	if plan.SaleAccountID == nil {
+		return nil, errors.New("plan sale account is required")
+	}
+	if plan.ReceivableAccountID == nil {
+		return nil, errors.New("plan receivable account is required")
+	}
+	var receivableAccount models.AccountModel
+	if err := tx.Where("id = ?", *plan.ReceivableAccountID).First(&receivableAccount).Error; err != nil {
+		return nil, err
+	}
+	if receivableAccount.Type != models.RECEIVABLE {
+		return nil, errors.New("plan receivable account type must be RECEIVABLE")
+	}
+	var contact models.ContactModel
+	if err := tx.Select("id", "name", "email", "phone", "address").Where("id = ?", subscription.ContactID).First(&contact).Error; err != nil {
+		return nil, err
+	}
+	contactData, _ := json.Marshal(map[string]any{
+		"name":    contact.Name,
+		"email":   contact.Email,
+		"phone":   contact.Phone,
+		"address": contact.Address,
+	})
+
+	due := now.AddDate(0, 0, plan.InvoiceDueDays)
+	refType := "subscription"
+	sales := models.SalesModel{
+		SalesNumber:      fmt.Sprintf("INV-%s", utils.RandomStringNumber(8, false)),
+		Code:             utils.RandString(10, false),
+		Description:      fmt.Sprintf("Tagihan langganan %s", subscription.Number),
+		Notes:            fmt.Sprintf("Periode %s - %s", periodStart.Format("02/01/2006"), periodEnd.AddDate(0, 0, -1).Format("02/01/2006")),
+		Status:           "DRAFT",
+		SalesDate:        now,
+		DueDate:          &due,
+		CompanyID:        subscription.CompanyID,
+		UserID:           &userID,
+		ContactID:        &subscription.ContactID,
+		ContactData:      string(contactData),
+		DeliveryData:     "{}",
+		TaxBreakdown:     "{}",
+		DocumentType:     models.INVOICE,
+		RefID:            &subscription.ID,
+		RefType:          &refType,
+		PaymentAccountID: plan.ReceivableAccountID,
+	}
+	sales.ID = utils.Uuid()
+	taxPercent := 0.0
+	if plan.Tax != nil {
+		taxPercent = plan.Tax.Amount
+	}
+	for _, line := range lines {
+		item := models.SalesItemModel{
+			SalesID:       &sales.ID,
+			Description:   line.Description,
+			Quantity:      line.Quantity,
+			UnitPrice:     line.UnitPrice,
+			UnitValue:     1,
+			SaleAccountID: plan.SaleAccountID,
+			TaxID:         plan.TaxID,
+			Tax:           plan.Tax,
+		}
+		item.ID = utils.Uuid()
+		item.SubtotalBeforeDisc = item.Quantity * item.UnitPrice
+		item.DiscountAmount = line.Discount
+		item.SubTotal = item.SubtotalBeforeDisc - item.DiscountAmount
+		item.TotalTax = item.SubTotal * (taxPercent / 100)
+		item.Total = item.SubTotal + item.TotalTax
+		sales.Items = append(sales.Items, item)
+
+		sales.TotalBeforeDisc += item.SubtotalBeforeDisc
+		sales.TotalBeforeTax += item.SubTotal
+		sales.Subtotal += item.SubTotal
+		sales.TotalTax += item.TotalTax
+		sales.TotalDiscount += item.DiscountAmount
+	}
+	sales.Total = sales.Subtotal + sales.TotalTax
+
+	if err := tx.Create(&sales).Error; err != nil {
+		return nil, err
+	}
+	sales.PaymentAccount = &receivableAccount
+	s.salesService.SetDB(tx)
+	defer s.salesService.SetDB(s.db)
+	if err := s.salesService.PostInvoice(sales.ID, &sales, userID, now); err != nil {
+		return nil, err
+	}
+
+	invoice := models.SubscriptionInvoiceModel{
+		SubscriptionID: subscription.ID,
+		CompanyID:      subscription.CompanyID,
+		SalesID:        sales.ID,
+		Type:           invoiceType,
+		PeriodStart:    periodStart,
+		PeriodEnd:      periodEnd,
+		Amount:         sales.Total,
+		Status:         InvoiceOpen,
+		DueDate:        due,
+		NextRetryAt:    &due,
+	}
+	if sales.Total <= amountEpsilon {
+		// fully paid by the credit balance
+		invoice.Status = InvoicePaid
+		invoice.PaidAt = &now
+		invoice.NextRetryAt = nil
+	}
+	if err := tx.Create(&invoice).Error; err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// attemptPayment charges an open invoice of a subscription with AutoCharge through the payment
+// service. A dunning retry reuses the payment link of the previous attempt instead of creating
+// another one; a new link is only created when the previous attempt failed. The response of the provider is kept on the invoice; the invoice is marked paid once
+// the payment is recorded (RecordPayment / SyncInvoicePayment).
+func (s *SubscriptionService) attemptPayment(subscription *models.SubscriptionModel, invoice *models.SubscriptionInvoiceModel, now time.Time) bool {
+	if !subscription.AutoCharge || invoice.Status != InvoiceOpen || s.buildPaymentRequest == nil ||
+		s.paymentService == nil || len(s.paymentService.PaymentProvider) == 0 {
+		return false
+	}
+	data := map[string]any{"last_attempt_at": now}
+	if len(invoice.PaymentResponse) > 0 && invoice.LastError == "" {
+		// the link of the previous attempt stays the one to pay, a second link could be paid too
+		if err := s.db.Model(&models.SubscriptionInvoiceModel{}).Where("id = ?", invoice.ID).Updates(data).Error; err != nil {
+			log.Println("ERROR SUBSCRIPTION PAYMENT", err)
+		}
+		return true
+	}
+	var sales models.SalesModel
+	if err := s.db.Preload("Contact").Where("id = ?", invoice.SalesID).First(&sales).Error; err != nil {
+		log.Println("ERROR SUBSCRIPTION PAYMENT", err)
+		return false
+	}
+	resp, err := s.paymentService.CreatePaymentLink(s.buildPaymentRequest(subscription, &sales))
+	if err != nil {
+		log.Println("ERROR SUBSCRIPTION PAYMENT", err)
+		data["last_error"] = err.Error()
+	} else {
+		b, _ := json.Marshal(resp)
+		data["payment_response"] = b
+		data["last_error"] = ""
+	}
+	if err := s.db.Model(&models.SubscriptionInvoiceModel{}).Where("id = ?", invoice.ID).Updates(data).Error; err != nil {
+		log.Println("ERROR SUBSCRIPTION PAYMENT", err)
+	}
+	return true
+}
+
+// runDunning retries the unpaid invoices of a company whose retry date passed.
+//
+// An invoice that is still unpaid puts its subscription PAST_DUE and is retried every
+// DunningIntervalDays days of the plan. After DunningMaxRetries retries the invoice fails and
+// the DunningAction of the plan cancels or pauses the subscription.
+func (s *SubscriptionService) runDunning(companyID string, userID string, now time.Time, result *BillingRunResult) error {
+	var invoices []models.SubscriptionInvoiceModel
+	if err := s.db.Where("company_id = ? AND status = ? AND next_retry_at <= ?", companyID, InvoiceOpen, now).Order("next_retry_at asc").Find(&invoices).Error; err != nil {
+		return err
+	}
+	for i := range invoices {
+		invoice := &invoices[i]
+		paid, err := s.syncInvoice(invoice, now)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", invoice.ID, err))
+			continue
+		}
+		if paid {
+			result.Paid++
+			continue
+		}
+		subscription, err := s.GetSubscriptionByID(invoice.SubscriptionID)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", invoice.ID, err))
+			continue
+		}
+		plan := subscription.Plan
+		invoice.Attempts++
+		exhausted := invoice.Attempts > plan.DunningMaxRetries
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			data := map[string]any{"attempts": invoice.Attempts}
+			if exhausted {
+				data["status"] = InvoiceFailed
+				data["next_retry_at"] = nil
+			} else {
+				data["next_retry_at"] = now.AddDate(0, 0, plan.DunningIntervalDays)
+			}
+			if err := tx.Model(&models.SubscriptionInvoiceModel{}).Where("id = ?", invoice.ID).Updates(data).Error; err != nil {
+				return err
+			}
+			if subscription.Status == models.SubscriptionActive {
+				if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", subscription.ID).Update("status", models.SubscriptionPastDue).Error; err != nil {
+					return err
+				}
+				subscription.Status = models.SubscriptionPastDue
+			}
+			if err := s.recordEvent(tx, subscription, models.SubscriptionEventPaymentFailed, now, nil, &subscription.PlanID, 0, 0, fmt.Sprintf("%s attempt %d", invoice.SalesID, invoice.Attempts), &userID); err != nil {
+				return err
+			}
+			if !exhausted || !countsForMRR(subscription.Status) {
+				return nil
+			}
+			if plan.DunningAction == models.SubscriptionDunningPause {
+				return s.pause(tx, subscription, nil, false, userID, now, "dunning")
+			}
+			return s.cancel(tx, subscription, "dunning", userID, now)
+		})
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", invoice.ID, err))
+			continue
+		}
+		if exhausted {
+			result.Failed++
+			if plan.DunningAction != models.SubscriptionDunningPause {
+				result.Cancelled++
+			}
+			continue
+		}
+		result.Retried++
+		if s.attemptPayment(subscription, invoice, now) {
+			result.Charged++
+		}
+	}
+	return nil
+}
+
+// syncInvoice marks an invoice paid when its sales invoice is settled.
+func (s *SubscriptionService) syncInvoice(invoice *models.SubscriptionInvoiceModel, now time.Time) (bool, error) {
+	if invoice.Status == InvoicePaid {
+		return true, nil
+	}
+	sales, err := s.salesService.GetSalesByID(invoice.SalesID)
+	if err != nil {
+		return false, err
+	}
+	if sales.Paid+amountEpsilon < sales.Total {
+		return false, nil
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.SubscriptionInvoiceModel{}).Where("id = ?", invoice.ID).Updates(map[string]any{
+			"status":        InvoicePaid,
+			"paid_at":       now,
+			"next_retry_at": nil,
+		}).Error; err != nil {
+			return err
+		}
+		invoice.Status = InvoicePaid
+		subscription, err := lockSubscription(tx, invoice.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		if subscription.Status != models.SubscriptionPastDue {
+			return nil
+		}
+		var overdue int64
+		tx.Model(&models.SubscriptionInvoiceModel{}).
+			Where("subscription_id = ? AND status = ? AND due_date < ? AND id <> ?", subscription.ID, InvoiceOpen, now, invoice.ID).
+			Count(&overdue)
+		if overdue > 0 {
+			return nil
+		}
+		if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", subscription.ID).Update("status", models.SubscriptionActive).Error; err != nil {
+			return err
+		}
+		return s.recordEvent(tx, subscription, models.SubscriptionEventPaymentRecovered, now, nil, &subscription.PlanID, 0, 0, sales.SalesNumber, nil)
+	})
+	return err == nil, err
+}
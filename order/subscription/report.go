@@ -0,0 +1,135 @@
+package subscription
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+// SubscriptionMetrics is the MRR and churn report of a period.
+//
+// MRR movements are taken from the subscription events of the period: new MRR comes from
+// activations (including converted trials), reactivation MRR from resumed subscriptions,
+// expansion and contraction MRR from plan changes, churned MRR from cancellations and paused MRR
+// from pauses.
+type SubscriptionMetrics struct {
+	StartDate          time.Time    `json:"start_date"`
+	EndDate            time.Time    `json:"end_date"`
+	MRRStart           float64      `json:"mrr_start"`
+	MRREnd             float64      `json:"mrr_end"`
+	ARR                float64      `json:"arr"`
+	NewMRR             float64      `json:"new_mrr"`
+	ExpansionMRR       float64      `json:"expansion_mrr"`
+	ContractionMRR     float64      `json:"contraction_mrr"`
+	ChurnedMRR         float64      `json:"churned_mrr"`
+	PausedMRR          float64      `json:"paused_mrr"`
+	ReactivationMRR    float64      `json:"reactivation_mrr"`
+	NetNewMRR          float64      `json:"net_new_mrr"`
+	ActiveStart        int          `json:"active_start"`
+	ActiveEnd          int          `json:"active_end"`
+	NewSubscriptions   int          `json:"new_subscriptions"`
+	ChurnedSubscribers int          `json:"churned_subscribers"`
+	ARPU               float64      `json:"arpu"`
+	CustomerChurnRate  float64      `json:"customer_churn_rate"`   // percent of the subscriptions active at start
+	RevenueChurnRate   float64      `json:"revenue_churn_rate"`    // churned and contraction MRR, percent of MRR at start
+	NetRevenueRetained float64      `json:"net_revenue_retention"` // percent of MRR at start kept by existing subscriptions
+	ByPlan             []PlanMetric `json:"by_plan"`
+}
+
+// PlanMetric is the current MRR of a plan.
+type PlanMetric struct {
+	PlanID        string  `json:"plan_id"`
+	PlanName      string  `json:"plan_name"`
+	Subscriptions int     `json:"subscriptions"`
+	MRR           float64 `json:"mrr"`
+}
+
+// GetMetrics computes the MRR and churn report of a company between start and end.
+func (s *SubscriptionService) GetMetrics(companyID string, start, end time.Time) (*SubscriptionMetrics, error) {
+	metrics := SubscriptionMetrics{StartDate: start, EndDate: end, ByPlan: []PlanMetric{}}
+
+	var opening, closing struct {
+		MRR    float64
+		Active int
+	}
+	if err := s.db.Model(&models.SubscriptionEventModel{}).
+		Select("COALESCE(SUM(mrr_delta), 0) AS mrr, COALESCE(SUM(active_delta), 0) AS active").
+		Where("company_id = ? AND date < ?", companyID, start).
+		Scan(&opening).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.SubscriptionEventModel{}).
+		Select("COALESCE(SUM(mrr_delta), 0) AS mrr, COALESCE(SUM(active_delta), 0) AS active").
+		Where("company_id = ? AND date <= ?", companyID, end).
+		Scan(&closing).Error; err != nil {
+		return nil, err
+	}
+	metrics.MRRStart = opening.MRR
+	metrics.ActiveStart = opening.Active
+	metrics.MRREnd = closing.MRR
+	metrics.ActiveEnd = closing.Active
+	metrics.ARR = metrics.MRREnd * 12
+
+	var events []models.SubscriptionEventModel
+	if err := s.db.Select("type", "mrr_delta", "active_delta").
+		Where("company_id = ? AND date >= ? AND date <= ?", companyID, start, end).
+		Where("mrr_delta <> 0 OR active_delta <> 0").
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range events {
+		switch v.Type {
+		case models.SubscriptionEventActivated:
+			metrics.NewMRR += v.MRRDelta
+			metrics.NewSubscriptions++
+		case models.SubscriptionEventResumed:
+			metrics.ReactivationMRR += v.MRRDelta
+		case models.SubscriptionEventPlanChanged:
+			if v.MRRDelta > 0 {
+				metrics.ExpansionMRR += v.MRRDelta
+			} else {
+				metrics.ContractionMRR -= v.MRRDelta
+			}
+		case models.SubscriptionEventCancelled:
+			metrics.ChurnedMRR -= v.MRRDelta
+			if v.ActiveDelta < 0 {
+				metrics.ChurnedSubscribers++
+			}
+		case models.SubscriptionEventPaused:
+			metrics.PausedMRR -= v.MRRDelta
+		}
+	}
+	metrics.NetNewMRR = metrics.NewMRR + metrics.ReactivationMRR + metrics.ExpansionMRR - metrics.ContractionMRR - metrics.ChurnedMRR - metrics.PausedMRR
+	if metrics.ActiveEnd > 0 {
+		metrics.ARPU = metrics.MRREnd / float64(metrics.ActiveEnd)
+	}
+	if metrics.ActiveStart > 0 {
+		metrics.CustomerChurnRate = float64(metrics.ChurnedSubscribers) / float64(metrics.ActiveStart) * 100
+	}
+	if metrics.MRRStart > 0 {
+		metrics.RevenueChurnRate = (metrics.ChurnedMRR + metrics.ContractionMRR) / metrics.MRRStart * 100
+		metrics.NetRevenueRetained = (metrics.MRRStart + metrics.ExpansionMRR - metrics.ContractionMRR - metrics.ChurnedMRR - metrics.PausedMRR) / metrics.MRRStart * 100
+	}
+
+	var subscriptions []models.SubscriptionModel
+	if err := s.db.Preload("Plan").Select("id", "plan_id", "quantity").
+		Where("company_id = ? AND status IN (?)", companyID, []models.SubscriptionStatus{models.SubscriptionActive, models.SubscriptionPastDue}).
+		Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	byPlan := map[string]int{}
+	for _, v := range subscriptions {
+		if v.Plan == nil {
+			continue
+		}
+		i, ok := byPlan[v.PlanID]
+		if !ok {
+			i = len(metrics.ByPlan)
+			byPlan[v.PlanID] = i
+			metrics.ByPlan = append(metrics.ByPlan, PlanMetric{PlanID: v.PlanID, PlanName: v.Plan.Name})
+		}
+		metrics.ByPlan[i].Subscriptions++
+		metrics.ByPlan[i].MRR += v.Plan.MonthlyAmount(v.Quantity)
+	}
+	return &metrics, nil
+}
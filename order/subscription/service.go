@@ -0,0 +1,523 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/context"
+	"github.com/AMETORY/ametory-erp-modules/order/payment"
+	"github.com/AMETORY/ametory-erp-modules/order/sales"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+	"github.com/AMETORY/ametory-erp-modules/utils"
+	"github.com/morkid/paginate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// amountEpsilon absorbs floating point noise when comparing amounts.
+const amountEpsilon = 0.005
+
+// Plan change timings accepted by ChangePlan.
+const (
+	ChangeImmediately = "IMMEDIATE"
+	ChangeAtPeriodEnd = "PERIOD_END"
+)
+
+// PaymentRequestBuilder builds the provider specific payment request used to charge an
+// invoice of a subscription through the active payment provider.
+type PaymentRequestBuilder func(subscription *models.SubscriptionModel, invoice *models.SalesModel) interface{}
+
+// SubscriptionService manages subscription plans, customer subscriptions and their billing.
+//
+// A billing run (RunBilling) invoices every subscription whose next billing date has passed
+// with a posted sales invoice, optionally charges it through the payment service, and retries
+// unpaid invoices (dunning) until the dunning action of the plan applies. Every change of a
+// subscription is recorded as an event, from which the MRR and churn report is computed.
+type SubscriptionService struct {
+	db                  *gorm.DB
+	ctx                 *context.ERPContext
+	salesService        *sales.SalesService
+	paymentService      *payment.PaymentService
+	buildPaymentRequest PaymentRequestBuilder
+}
+
+// NewSubscriptionService creates a new instance of SubscriptionService with the given database connection, context, sales service and payment service.
+func NewSubscriptionService(db *gorm.DB, ctx *context.ERPContext, salesService *sales.SalesService, paymentService *payment.PaymentService) *SubscriptionService {
+	return &SubscriptionService{
+		db:             db,
+		ctx:            ctx,
+		salesService:   salesService,
+		paymentService: paymentService,
+	}
+}
+
+// SetPaymentRequestBuilder sets the builder of payment requests. Subscriptions with AutoCharge
+// are only charged when it is set.
+func (s *SubscriptionService) SetPaymentRequestBuilder(builder PaymentRequestBuilder) {
+	s.buildPaymentRequest = builder
+}
+
+// Migrate migrates the subscription models.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(
+		&models.SubscriptionPlanModel{},
+		&models.SubscriptionModel{},
+		&models.SubscriptionInvoiceModel{},
+		&models.SubscriptionEventModel{},
+	)
+}
+
+// CreatePlan creates a new subscription plan.
+func (s *SubscriptionService) CreatePlan(data *models.SubscriptionPlanModel) error {
+	if data.Price < 0 {
+		return errors.New("price must not be negative")
+	}
+	if data.BillingInterval <= 0 {
+		data.BillingInterval = 1
+	}
+	return s.db.Create(data).Error
+}
+
+// UpdatePlan updates a subscription plan. Price changes apply to the next invoices of the
+// existing subscriptions.
+func (s *SubscriptionService) UpdatePlan(id string, data *models.SubscriptionPlanModel) error {
+	return s.db.Where("id = ?", id).Updates(data).Error
+}
+
+// DeletePlan deletes a subscription plan that has no subscriptions.
+func (s *SubscriptionService) DeletePlan(id string) error {
+	var count int64
+	s.db.Model(&models.SubscriptionModel{}).Where("plan_id = ?", id).Count(&count)
+	if count > 0 {
+		return errors.New("plan has subscriptions, deactivate it instead")
+	}
+	return s.db.Where("id = ?", id).Delete(&models.SubscriptionPlanModel{}).Error
+}
+
+// GetPlanByID retrieves a subscription plan by ID.
+func (s *SubscriptionService) GetPlanByID(id string) (*models.SubscriptionPlanModel, error) {
+	var plan models.SubscriptionPlanModel
+	err := s.db.Preload("Tax").Where("id = ?", id).First(&plan).Error
+	return &plan, err
+}
+
+// GetPlans retrieves a paginated list of subscription plans scoped to the company in the
+// ID-Company header.
+func (s *SubscriptionService) GetPlans(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Model(&models.SubscriptionPlanModel{})
+	if search != "" {
+		stmt = stmt.Where("name ILIKE ? OR code ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("is_active") != "" {
+		stmt = stmt.Where("is_active = ?", request.URL.Query().Get("is_active") == "true")
+	}
+	stmt = stmt.Order("price asc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.SubscriptionPlanModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// CreateSubscription subscribes a contact to a plan.
+//
+// Subscriptions of plans with trial days start TRIALING and are billed when the trial ends;
+// the others start ACTIVE and are billed for their first period by the next billing run.
+func (s *SubscriptionService) CreateSubscription(data *models.SubscriptionModel) error {
+	plan, err := s.GetPlanByID(data.PlanID)
+	if err != nil {
+		return err
+	}
+	if !plan.IsActive {
+		return errors.New("plan is not active")
+	}
+	if data.ContactID == "" {
+		return errors.New("contact ID is required")
+	}
+	if data.Quantity <= 0 {
+		data.Quantity = 1
+	}
+	if data.StartDate.IsZero() {
+		data.StartDate = time.Now()
+	}
+	if data.CompanyID == nil {
+		data.CompanyID = plan.CompanyID
+	}
+	data.Number = fmt.Sprintf("SUB-%s", utils.RandomStringNumber(8, false))
+	start := data.StartDate
+	if plan.TrialDays > 0 {
+		trialEnd := start.AddDate(0, 0, plan.TrialDays)
+		data.Status = models.SubscriptionTrialing
+		data.TrialEndsAt = &trialEnd
+		data.CurrentPeriodStart = &start
+		data.CurrentPeriodEnd = &trialEnd
+		data.NextBillingDate = &trialEnd
+	} else {
+		data.Status = models.SubscriptionActive
+		data.NextBillingDate = &start
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(data).Error; err != nil {
+			return err
+		}
+		if err := s.recordEvent(tx, data, models.SubscriptionEventCreated, start, nil, &plan.ID, 0, 0, "", data.UserID); err != nil {
+			return err
+		}
+		if data.Status == models.SubscriptionActive {
+			return s.recordEvent(tx, data, models.SubscriptionEventActivated, start, nil, &plan.ID, plan.MonthlyAmount(data.Quantity), 1, "", data.UserID)
+		}
+		return nil
+	})
+}
+
+// GetSubscriptionByID retrieves a subscription with its plan and contact.
+func (s *SubscriptionService) GetSubscriptionByID(id string) (*models.SubscriptionModel, error) {
+	var subscription models.SubscriptionModel
+	err := s.db.Preload("Plan.Tax").Preload("PendingPlan").Preload("Contact").Where("id = ?", id).First(&subscription).Error
+	return &subscription, err
+}
+
+// GetSubscriptions retrieves a paginated list of subscriptions.
+//
+// The list can be filtered with the status, plan_id and contact_id query parameters and is
+// scoped to the company in the ID-Company header.
+func (s *SubscriptionService) GetSubscriptions(request http.Request, search string) (paginate.Page, error) {
+	pg := paginate.New()
+	stmt := s.db.Preload("Plan", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name", "price", "billing_period", "billing_interval")
+	}).Preload("Contact", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "name")
+	})
+	if search != "" {
+		stmt = stmt.Where("number ILIKE ? OR notes ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if request.Header.Get("ID-Company") != "" {
+		stmt = stmt.Where("company_id = ?", request.Header.Get("ID-Company"))
+	}
+	if request.URL.Query().Get("status") != "" {
+		stmt = stmt.Where("status = ?", request.URL.Query().Get("status"))
+	}
+	if request.URL.Query().Get("plan_id") != "" {
+		stmt = stmt.Where("plan_id = ?", request.URL.Query().Get("plan_id"))
+	}
+	if request.URL.Query().Get("contact_id") != "" {
+		stmt = stmt.Where("contact_id = ?", request.URL.Query().Get("contact_id"))
+	}
+	stmt = stmt.Model(&models.SubscriptionModel{}).Order("created_at desc")
+	utils.FixRequest(&request)
+	page := pg.With(stmt).Request(request).Response(&[]models.SubscriptionModel{})
+	page.Page = page.Page + 1
+	return page, nil
+}
+
+// GetEvents retrieves the history of a subscription.
+func (s *SubscriptionService) GetEvents(subscriptionID string) ([]models.SubscriptionEventModel, error) {
+	var events []models.SubscriptionEventModel
+	err := s.db.Where("subscription_id = ?", subscriptionID).Order("date asc, created_at asc").Find(&events).Error
+	return events, err
+}
+
+// ChangePlan moves a subscription to another plan and/or quantity (upgrade or downgrade).
+//
+// With timing IMMEDIATE the change applies now, together with its proration invoice, within one
+// transaction on the locked subscription. When the new plan prorates, the unused part of the
+// current period is credited (unless the period is past due, i.e. unpaid) and the new plan is
+// charged for the rest of the period (or for a whole new period when the billing periods
+// differ); a positive difference is invoiced at once and a negative one is kept as credit for
+// the next invoice. With timing PERIOD_END the change applies at the next billing date. An empty timing applies upgrades immediately and downgrades
+// at the end of the period. It returns the proration invoice, if any.
+func (s *SubscriptionService) ChangePlan(id string, planID string, quantity float64, timing string, userID string, now time.Time) (*models.SubscriptionInvoiceModel, error) {
+	subscription, err := s.GetSubscriptionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !isBillable(subscription.Status) {
+		return nil, errors.New("subscription cannot be changed")
+	}
+	newPlan, err := s.GetPlanByID(planID)
+	if err != nil {
+		return nil, err
+	}
+	if !newPlan.IsActive {
+		return nil, errors.New("plan is not active")
+	}
+	if quantity <= 0 {
+		quantity = subscription.Quantity
+	}
+	oldPlan := subscription.Plan
+	oldMRR := oldPlan.MonthlyAmount(subscription.Quantity)
+	newMRR := newPlan.MonthlyAmount(quantity)
+	if timing == "" {
+		timing = ChangeImmediately
+		if newMRR < oldMRR {
+			timing = ChangeAtPeriodEnd
+		}
+	}
+
+	if timing == ChangeAtPeriodEnd && subscription.Status != models.SubscriptionTrialing {
+		return nil, s.db.Model(&models.SubscriptionModel{}).Where("id = ?", id).Updates(map[string]any{
+			"pending_plan_id":  newPlan.ID,
+			"pending_quantity": quantity,
+		}).Error
+	}
+
+	var invoice *models.SubscriptionInvoiceModel
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		subscription, err = s.lockedSubscription(tx, subscription)
+		if err != nil {
+			return err
+		}
+		if !isBillable(subscription.Status) {
+			return errors.New("subscription cannot be changed")
+		}
+		oldPlan := subscription.Plan
+		oldMRR := oldPlan.MonthlyAmount(subscription.Quantity)
+
+		var prorationAmount float64
+		data := map[string]any{
+			"plan_id":          newPlan.ID,
+			"quantity":         quantity,
+			"pending_plan_id":  nil,
+			"pending_quantity": 0,
+		}
+		periodEnd := subscription.CurrentPeriodEnd
+		if subscription.Status != models.SubscriptionTrialing && newPlan.ProrationMode != models.SubscriptionProrationNone &&
+			subscription.CurrentPeriodStart != nil && periodEnd != nil && now.Before(*periodEnd) {
+			fraction := remainingFraction(*subscription.CurrentPeriodStart, *periodEnd, now)
+			credit := 0.0
+			if subscription.Status != models.SubscriptionPastDue {
+				// the unpaid period of a past due subscription has no unused time to credit
+				credit = oldPlan.Price * subscription.Quantity * fraction
+			}
+			charge := newPlan.Price * quantity * fraction
+			if !samePeriod(oldPlan, newPlan) {
+				charge = newPlan.Price * quantity
+				end := newPlan.NextPeriod(now)
+				periodEnd = &end
+				data["current_period_start"] = now
+				data["current_period_end"] = end
+				data["next_billing_date"] = end
+			}
+			prorationAmount = charge - credit
+			if prorationAmount < -amountEpsilon {
+				data["credit_balance"] = subscription.CreditBalance - prorationAmount
+			}
+		}
+
+		if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", id).Updates(data).Error; err != nil {
+			return err
+		}
+		mrrDelta := 0.0
+		if countsForMRR(subscription.Status) {
+			mrrDelta = newPlan.MonthlyAmount(quantity) - oldMRR
+		}
+		if err := s.recordEvent(tx, subscription, models.SubscriptionEventPlanChanged, now, &oldPlan.ID, &newPlan.ID, mrrDelta, 0, fmt.Sprintf("%s x%v -> %s x%v", oldPlan.Name, subscription.Quantity, newPlan.Name, quantity), &userID); err != nil {
+			return err
+		}
+		if prorationAmount <= amountEpsilon {
+			return nil
+		}
+		subscription.PlanID = newPlan.ID
+		subscription.Plan = newPlan
+		subscription.Quantity = quantity
+		lines := []invoiceLine{{
+			Description: fmt.Sprintf("Prorata perubahan paket %s ke %s", oldPlan.Name, newPlan.Name),
+			Quantity:    1,
+			UnitPrice:   prorationAmount,
+		}}
+		invoice, err = s.createInvoice(tx, subscription, newPlan, InvoiceProration, now, *periodEnd, lines, userID, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if invoice != nil {
+		s.attemptPayment(subscription, invoice, now)
+	}
+	return invoice, nil
+}
+
+// PauseSubscription pauses an active subscription; it is not billed until it is resumed. When
+// the plan prorates, the unused part of the current period is kept as credit. With resumeAt the
+// billing run resumes the subscription automatically.
+func (s *SubscriptionService) PauseSubscription(id string, resumeAt *time.Time, userID string, now time.Time) error {
+	subscription, err := s.GetSubscriptionByID(id)
+	if err != nil {
+		return err
+	}
+	if subscription.Status != models.SubscriptionActive && subscription.Status != models.SubscriptionPastDue {
+		return errors.New("only active subscriptions can be paused")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return s.pause(tx, subscription, resumeAt, true, userID, now, "")
+	})
+}
+
+// ResumeSubscription resumes a paused subscription. A new billing period starts now.
+func (s *SubscriptionService) ResumeSubscription(id string, userID string, now time.Time) error {
+	subscription, err := s.GetSubscriptionByID(id)
+	if err != nil {
+		return err
+	}
+	if subscription.Status != models.SubscriptionPaused {
+		return errors.New("subscription is not paused")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", id).Updates(map[string]any{
+			"status":               models.SubscriptionActive,
+			"paused_at":            nil,
+			"resume_at":            nil,
+			"current_period_start": nil,
+			"current_period_end":   nil,
+			"next_billing_date":    now,
+		}).Error; err != nil {
+			return err
+		}
+		return s.recordEvent(tx, subscription, models.SubscriptionEventResumed, now, nil, &subscription.PlanID, subscription.Plan.MonthlyAmount(subscription.Quantity), 1, "", &userID)
+	})
+}
+
+// CancelSubscription cancels a subscription, at the end of the current period when atPeriodEnd
+// is set or else immediately. Invoices already issued stay receivable.
+func (s *SubscriptionService) CancelSubscription(id string, atPeriodEnd bool, reason string, userID string, now time.Time) error {
+	subscription, err := s.GetSubscriptionByID(id)
+	if err != nil {
+		return err
+	}
+	if subscription.Status == models.SubscriptionCancelled {
+		return errors.New("subscription is already cancelled")
+	}
+	if atPeriodEnd && isBillable(subscription.Status) {
+		return s.db.Model(&models.SubscriptionModel{}).Where("id = ?", id).Updates(map[string]any{
+			"cancel_at_period_end": true,
+			"cancel_reason":        reason,
+		}).Error
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return s.cancel(tx, subscription, reason, userID, now)
+	})
+}
+
+// UndoCancel keeps a subscription that was set to cancel at the end of its period.
+func (s *SubscriptionService) UndoCancel(id string) error {
+	return s.db.Model(&models.SubscriptionModel{}).Where("id = ? AND status <> ?", id, models.SubscriptionCancelled).Updates(map[string]any{
+		"cancel_at_period_end": false,
+		"cancel_reason":        "",
+	}).Error
+}
+
+// pause pauses a subscription. With creditUnused the unused part of the current period is kept
+// as credit when the plan prorates and the period is not past due.
+func (s *SubscriptionService) pause(tx *gorm.DB, subscription *models.SubscriptionModel, resumeAt *time.Time, creditUnused bool, userID string, now time.Time, notes string) error {
+	credit := 0.0
+	plan := subscription.Plan
+	if creditUnused && subscription.Status != models.SubscriptionPastDue && plan.ProrationMode != models.SubscriptionProrationNone && subscription.CurrentPeriodStart != nil &&
+		subscription.CurrentPeriodEnd != nil && now.Before(*subscription.CurrentPeriodEnd) {
+		credit = plan.Price * subscription.Quantity * remainingFraction(*subscription.CurrentPeriodStart, *subscription.CurrentPeriodEnd, now)
+	}
+	if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", subscription.ID).Updates(map[string]any{
+		"status":            models.SubscriptionPaused,
+		"paused_at":         now,
+		"resume_at":         resumeAt,
+		"next_billing_date": nil,
+		"credit_balance":    subscription.CreditBalance + credit,
+	}).Error; err != nil {
+		return err
+	}
+	return s.recordEvent(tx, subscription, models.SubscriptionEventPaused, now, &subscription.PlanID, nil, -plan.MonthlyAmount(subscription.Quantity), -1, notes, &userID)
+}
+
+func (s *SubscriptionService) cancel(tx *gorm.DB, subscription *models.SubscriptionModel, reason string, userID string, now time.Time) error {
+	if err := tx.Model(&models.SubscriptionModel{}).Where("id = ?", subscription.ID).Updates(map[string]any{
+		"status":            models.SubscriptionCancelled,
+		"cancelled_at":      now,
+		"cancel_reason":     reason,
+		"next_billing_date": nil,
+		"pending_plan_id":   nil,
+	}).Error; err != nil {
+		return err
+	}
+	mrrDelta, activeDelta := 0.0, 0
+	if countsForMRR(subscription.Status) {
+		mrrDelta = -subscription.Plan.MonthlyAmount(subscription.Quantity)
+		activeDelta = -1
+	}
+	return s.recordEvent(tx, subscription, models.SubscriptionEventCancelled, now, &subscription.PlanID, nil, mrrDelta, activeDelta, reason, &userID)
+}
+
+func (s *SubscriptionService) recordEvent(tx *gorm.DB, subscription *models.SubscriptionModel, eventType models.SubscriptionEventType, date time.Time, fromPlanID, toPlanID *string, mrrDelta float64, activeDelta int, notes string, userID *string) error {
+	if userID != nil && *userID == "" {
+		userID = nil
+	}
+	return tx.Create(&models.SubscriptionEventModel{
+		SubscriptionID: subscription.ID,
+		CompanyID:      subscription.CompanyID,
+		ContactID:      subscription.ContactID,
+		Type:           eventType,
+		Date:           date,
+		FromPlanID:     fromPlanID,
+		ToPlanID:       toPlanID,
+		MRRDelta:       mrrDelta,
+		ActiveDelta:    activeDelta,
+		Notes:          notes,
+		UserID:         userID,
+	}).Error
+}
+
+// lockSubscription reloads a subscription with a row lock inside a transaction.
+// lockedSubscription locks a subscription loaded with GetSubscriptionByID and returns its locked
+// row with the plan and contact of the subscription; the plan is reloaded when it changed.
+func (s *SubscriptionService) lockedSubscription(tx *gorm.DB, subscription *models.SubscriptionModel) (*models.SubscriptionModel, error) {
+	locked, err := lockSubscription(tx, subscription.ID)
+	if err != nil {
+		return nil, err
+	}
+	locked.Plan, locked.Contact = subscription.Plan, subscription.Contact
+	if locked.PlanID != subscription.PlanID {
+		if locked.Plan, err = s.GetPlanByID(locked.PlanID); err != nil {
+			return nil, err
+		}
+	}
+	return locked, nil
+}
+
+func lockSubscription(tx *gorm.DB, id string) (*models.SubscriptionModel, error) {
+	var subscription models.SubscriptionModel
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&subscription).Error
+	return &subscription, err
+}
+
+// isBillable reports whether a subscription with the status is still billed.
+func isBillable(status models.SubscriptionStatus) bool {
+	return status == models.SubscriptionTrialing || status == models.SubscriptionActive || status == models.SubscriptionPastDue
+}
+
+// countsForMRR reports whether a subscription with the status counts for MRR.
+func countsForMRR(status models.SubscriptionStatus) bool {
+	return status == models.SubscriptionActive || status == models.SubscriptionPastDue
+}
+
+func samePeriod(a, b *models.SubscriptionPlanModel) bool {
+	return a.BillingPeriod == b.BillingPeriod && a.BillingInterval == b.BillingInterval
+}
+
+// remainingFraction returns the part of the period [start, end) that is left at now.
+func remainingFraction(start, end, now time.Time) float64 {
+	total := end.Sub(start).Seconds()
+	if total <= 0 {
+		return 0
+	}
+	fraction := end.Sub(now).Seconds() / total
+	if fraction < 0 {
+		return 0
+	}
+	if fraction > 1 {
+		return 1
+	}
+	return fraction
+}
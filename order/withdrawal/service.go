@@ -148,7 +148,8 @@ func (w *WithdrawalService) GetWithdrawals(request http.Request, search string,
 //
 // It takes an HTTP request, search string, and merchant ID as parameters and returns
 // a paginated page and an error if the operation fails. It preloads the product,
-// variant, and payment.
+// variant, and payment. Orders credited to the merchant balance ledger are paid out
+// through payout batches and are not withdrawable here.
 func (w *WithdrawalService) GetOrderWithdrawable(request http.Request, search string, merchantID string) (paginate.Page, error) {
 	pg := paginate.New()
 	stmt := w.db.Preload("Merchant").Preload("Items", func(tx *gorm.DB) *gorm.DB {
@@ -161,7 +162,8 @@ func (w *WithdrawalService) GetOrderWithdrawable(request http.Request, search st
 		Where("payments.status = ?", "COMPLETE").
 		Where("pos_sales.status = ?", "COMPLETED").
 		Where("pos_sales.user_payment_status = ?", "PAID").
-		Where("payments.payment_method <> ?", "CASH")
+		Where("payments.payment_method <> ?", "CASH").
+		Where("NOT EXISTS (SELECT 1 FROM merchant_ledger_entries WHERE merchant_ledger_entries.ref_id = pos_sales.id AND merchant_ledger_entries.type = ? AND merchant_ledger_entries.deleted_at IS NULL)", models.MerchantLedgerSale)
 	if search != "" {
 		stmt = stmt.Where("pos_sales.code ILIKE ? OR pos_sales.description ILIKE ? OR pos_sales.sales_number ILIKE ?",
 			"%"+search+"%",
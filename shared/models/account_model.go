@@ -68,6 +68,7 @@ type AccountModel struct {
 	IsAmortization             bool          `json:"is_amortization,omitempty" gorm:"default:false;not null"`
 	IsCogmAccount              bool          `json:"is_cogm_account,omitempty" gorm:"default:false;not null"`
 	IsStockOpnameAccount       bool          `json:"is_stock_opname_account,omitempty" gorm:"default:false;not null"`
+	IsDeferredRevenue          bool          `json:"is_deferred_revenue,omitempty" gorm:"default:false;not null"` // akun pendapatan diterima di muka (kartu hadiah, store credit)
 
 	// Transactions          []Transaction `gorm:"constraint:OnDelete:CASCADE;"`
 }
@@ -16,11 +16,13 @@ type CartModel struct {
 	Merchant               *MerchantModel  `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
 	Items                  []CartItemModel `gorm:"foreignKey:CartID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
 	Status                 string          `gorm:"type:varchar(50);not null;default:'ACTIVE'" json:"status,omitempty"`
+	VoucherCode            string          `gorm:"type:varchar(100)" json:"voucher_code,omitempty"` // kode voucher atau kode promosi yang dimasukkan pelanggan
 	SubTotal               float64         `gorm:"-" json:"sub_total,omitempty"`
 	SubTotalBeforeDiscount float64         `gorm:"-" json:"sub_total_before_discount,omitempty"`
 	Total                  float64         `gorm:"-" json:"total,omitempty"`
 	TaxAmount              float64         `gorm:"-" json:"tax_amount,omitempty"`
 	DiscountAmount         float64         `gorm:"-" json:"discount_amount,omitempty"`
+	PromotionDiscount      float64         `gorm:"-" json:"promotion_discount,omitempty"` // potongan promosi, sudah termasuk dalam SubTotal dan DiscountAmount
 	CustomerData           string          `gorm:"-" json:"-"`
 	CustomerDataResponse   interface{}     `gorm:"-" json:"customer_data_response,omitempty"`
 	Tax                    float64         `gorm:"-" json:"tax"`
@@ -50,6 +52,7 @@ type CartItemModel struct {
 	Variant                *VariantModel         `gorm:"foreignKey:VariantID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
 	Quantity               float64               `gorm:"not null" json:"quantity,omitempty"`
 	Price                  float64               `gorm:"not null" json:"price,omitempty"`
+	PriceListItemID        *string               `gorm:"size:36" json:"price_list_item_id,omitempty"` // aturan daftar harga yang menentukan Price
 	OriginalPrice          float64               `gorm:"-" json:"original_price,omitempty"`
 	DiscountAmount         float64               `gorm:"-" json:"discount_amount,omitempty"`
 	DiscountType           string                `gorm:"-" json:"discount_type,omitempty"`
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	MovementTypeConsignmentIn  MovementType = "CONSIGNMENT_IN"  // Stok titipan masuk dari pemasok
+	MovementTypeConsignmentOut MovementType = "CONSIGNMENT_OUT" // Stok titipan dikembalikan ke pemasok
+)
+
+type ConsignmentBasis string
+
+const (
+	ConsignmentBasisPrice      ConsignmentBasis = "PRICE"      // hutang sebesar harga konsinyasi per unit
+	ConsignmentBasisCommission ConsignmentBasis = "COMMISSION" // hutang sebesar harga jual dikurangi komisi
+)
+
+type ConsignmentStatus string
+
+const (
+	ConsignmentActive ConsignmentStatus = "ACTIVE"
+	ConsignmentEnded  ConsignmentStatus = "ENDED"
+)
+
+type ConsignmentSaleStatus string
+
+const (
+	ConsignmentSaleOpen     ConsignmentSaleStatus = "OPEN"
+	ConsignmentSaleSettled  ConsignmentSaleStatus = "SETTLED"
+	ConsignmentSaleReversed ConsignmentSaleStatus = "REVERSED"
+)
+
+type ConsignmentSettlementStatus string
+
+const (
+	ConsignmentSettlementPosted ConsignmentSettlementStatus = "POSTED"
+	ConsignmentSettlementPaid   ConsignmentSettlementStatus = "PAID"
+)
+
+// ConsignmentAgreementModel adalah perjanjian titip jual dengan pemasok.
+//
+// Barang titipan tetap milik pemasok (SupplierID) walaupun disimpan di gudang kita, sehingga
+// tidak dicatat di akun persediaan. Saat barang terjual, hutang konsinyasi dicatat sebesar harga
+// konsinyasi (Basis PRICE) atau harga jual dikurangi komisi (Basis COMMISSION) ke PayableAccountID
+// (bertipe LIABILITY) dengan lawan CostAccountID (kosong = akun HPP perusahaan).
+type ConsignmentAgreementModel struct {
+	shared.BaseModel
+	Number            string                          `gorm:"type:varchar(50);index" json:"number"`
+	CompanyID         *string                         `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company           *CompanyModel                   `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	SupplierID        string                          `gorm:"type:char(36);index" json:"supplier_id"`
+	Supplier          *ContactModel                   `gorm:"foreignKey:SupplierID;constraint:OnDelete:RESTRICT" json:"supplier,omitempty"`
+	Basis             ConsignmentBasis                `gorm:"type:varchar(20);default:'PRICE'" json:"basis"`
+	CommissionPercent float64                         `json:"commission_percent"`
+	StartDate         time.Time                       `json:"start_date"`
+	EndDate           *time.Time                      `json:"end_date,omitempty"`
+	PayableAccountID  *string                         `gorm:"size:36" json:"payable_account_id,omitempty"`
+	PayableAccount    *AccountModel                   `gorm:"foreignKey:PayableAccountID;constraint:OnDelete:SET NULL" json:"payable_account,omitempty"`
+	CostAccountID     *string                         `gorm:"size:36" json:"cost_account_id,omitempty"`
+	CostAccount       *AccountModel                   `gorm:"foreignKey:CostAccountID;constraint:OnDelete:SET NULL" json:"cost_account,omitempty"`
+	PaymentTermsCode  string                          `json:"payment_terms_code"`
+	Status            ConsignmentStatus               `gorm:"type:varchar(20);default:'ACTIVE';index" json:"status"`
+	Notes             string                          `json:"notes"`
+	Items             []ConsignmentAgreementItemModel `gorm:"foreignKey:AgreementID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
+	UserID            *string                         `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (ConsignmentAgreementModel) TableName() string {
+	return "consignment_agreements"
+}
+
+func (c *ConsignmentAgreementModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// ConsignmentAgreementItemModel adalah produk yang dititipkan beserta harga konsinyasinya.
+// CommissionPercent lebih dari 0 menggantikan komisi perjanjian untuk produk ini.
+type ConsignmentAgreementItemModel struct {
+	shared.BaseModel
+	AgreementID       string                     `gorm:"type:char(36);index" json:"agreement_id"`
+	Agreement         *ConsignmentAgreementModel `gorm:"foreignKey:AgreementID;constraint:OnDelete:CASCADE" json:"agreement,omitempty"`
+	ProductID         string                     `gorm:"type:char(36);index" json:"product_id"`
+	Product           *ProductModel              `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID         *string                    `gorm:"size:36" json:"variant_id,omitempty"`
+	Variant           *VariantModel              `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE" json:"variant,omitempty"`
+	ConsignmentPrice  float64                    `json:"consignment_price"`
+	CommissionPercent float64                    `json:"commission_percent"`
+}
+
+func (ConsignmentAgreementItemModel) TableName() string {
+	return "consignment_agreement_items"
+}
+
+func (c *ConsignmentAgreementItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// ConsignmentSaleModel adalah penjualan barang titipan beserta hutang ke pemasoknya.
+//
+// ReferenceType / ReferenceID menunjuk dokumen penjualan ("sales" atau "pos_sales"),
+// StockMovementID menunjuk pergerakan stok milik pemasok yang keluar karena penjualan tersebut.
+type ConsignmentSaleModel struct {
+	shared.BaseModel
+	AgreementID      string                      `gorm:"type:char(36);index" json:"agreement_id"`
+	Agreement        *ConsignmentAgreementModel  `gorm:"foreignKey:AgreementID;constraint:OnDelete:RESTRICT" json:"agreement,omitempty"`
+	CompanyID        *string                     `gorm:"size:36;index" json:"company_id,omitempty"`
+	SupplierID       string                      `gorm:"type:char(36);index" json:"supplier_id"`
+	Date             time.Time                   `gorm:"index" json:"date"`
+	ProductID        string                      `gorm:"type:char(36);index" json:"product_id"`
+	Product          *ProductModel               `gorm:"foreignKey:ProductID;constraint:OnDelete:RESTRICT" json:"product,omitempty"`
+	VariantID        *string                     `gorm:"size:36" json:"variant_id,omitempty"`
+	WarehouseID      string                      `gorm:"type:char(36)" json:"warehouse_id"`
+	Quantity         float64                     `json:"quantity"`
+	SaleAmount       float64                     `json:"sale_amount"`
+	CommissionAmount float64                     `json:"commission_amount"`
+	PayableAmount    float64                     `json:"payable_amount"`
+	ReferenceID      string                      `gorm:"type:char(36);index" json:"reference_id"`
+	ReferenceType    string                      `gorm:"type:varchar(50)" json:"reference_type"`
+	ReferenceItemID  *string                     `gorm:"size:36" json:"reference_item_id,omitempty"`
+	StockMovementID  *string                     `gorm:"size:36" json:"stock_movement_id,omitempty"`
+	SettlementID     *string                     `gorm:"size:36;index" json:"settlement_id,omitempty"`
+	Settlement       *ConsignmentSettlementModel `gorm:"foreignKey:SettlementID;constraint:OnDelete:SET NULL" json:"settlement,omitempty"`
+	Status           ConsignmentSaleStatus       `gorm:"type:varchar(20);default:'OPEN';index" json:"status"`
+}
+
+func (ConsignmentSaleModel) TableName() string {
+	return "consignment_sales"
+}
+
+func (c *ConsignmentSaleModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// ConsignmentSettlementModel adalah laporan penyelesaian konsinyasi pemasok untuk satu periode.
+//
+// Setiap penyelesaian membuat tagihan (PurchaseOrderModel BILL) atas hutang konsinyasi yang
+// dibayar melalui CreatePurchasePayment.
+type ConsignmentSettlementModel struct {
+	shared.BaseModel
+	Number          string                      `gorm:"type:varchar(50);index" json:"number"`
+	AgreementID     string                      `gorm:"type:char(36);index" json:"agreement_id"`
+	Agreement       *ConsignmentAgreementModel  `gorm:"foreignKey:AgreementID;constraint:OnDelete:RESTRICT" json:"agreement,omitempty"`
+	CompanyID       *string                     `gorm:"size:36;index" json:"company_id,omitempty"`
+	SupplierID      string                      `gorm:"type:char(36);index" json:"supplier_id"`
+	Supplier        *ContactModel               `gorm:"foreignKey:SupplierID;constraint:OnDelete:RESTRICT" json:"supplier,omitempty"`
+	PeriodStart     time.Time                   `json:"period_start"`
+	PeriodEnd       time.Time                   `json:"period_end"`
+	TotalQuantity   float64                     `json:"total_quantity"`
+	TotalSales      float64                     `json:"total_sales"`
+	TotalCommission float64                     `json:"total_commission"`
+	TotalPayable    float64                     `json:"total_payable"`
+	PurchaseID      *string                     `gorm:"size:36" json:"purchase_id,omitempty"`
+	Purchase        *PurchaseOrderModel         `gorm:"foreignKey:PurchaseID;constraint:OnDelete:SET NULL" json:"purchase,omitempty"`
+	Status          ConsignmentSettlementStatus `gorm:"type:varchar(20);default:'POSTED';index" json:"status"`
+	Sales           []ConsignmentSaleModel      `gorm:"foreignKey:SettlementID" json:"sales,omitempty"`
+	UserID          *string                     `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (ConsignmentSettlementModel) TableName() string {
+	return "consignment_settlements"
+}
+
+func (c *ConsignmentSettlementModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
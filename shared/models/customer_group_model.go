@@ -0,0 +1,29 @@
+package models
+
+import (
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CustomerGroupModel adalah kelompok pelanggan, misalnya grosir atau reseller, yang dapat diberi
+// daftar harga tersendiri.
+type CustomerGroupModel struct {
+	shared.BaseModel
+	Name        string         `gorm:"type:varchar(255);not null" json:"name"`
+	Description string         `json:"description,omitempty"`
+	CompanyID   *string        `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company     *CompanyModel  `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Contacts    []ContactModel `gorm:"many2many:contact_customer_groups;constraint:OnDelete:CASCADE;" json:"contacts,omitempty"`
+}
+
+func (CustomerGroupModel) TableName() string {
+	return "customer_groups"
+}
+
+func (m *CustomerGroupModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CustomerPortalAccessModel adalah akses portal pelanggan untuk satu kontak: token publik yang
+// dibagikan ke pelanggan, atau tautan ke pengguna (UserID) yang masuk dengan akunnya sendiri.
+// Semua data portal dibatasi pada kontak dan perusahaan akses ini.
+//
+// Hanya hash SHA-256 token yang disimpan (TokenHash); Token hanya terisi saat token dibuat
+// sehingga token tidak bisa dibaca kembali dari database.
+type CustomerPortalAccessModel struct {
+	shared.BaseModel
+	CompanyID   *string       `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company     *CompanyModel `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	ContactID   string        `gorm:"size:36;index" json:"contact_id"`
+	Contact     *ContactModel `gorm:"foreignKey:ContactID;constraint:OnDelete:CASCADE" json:"contact,omitempty"`
+	UserID      *string       `gorm:"size:36;index" json:"user_id,omitempty"`
+	User        *UserModel    `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"user,omitempty"`
+	TokenHash   string        `gorm:"type:varchar(64);uniqueIndex" json:"-"`
+	Token       string        `gorm:"-" json:"token,omitempty"`
+	Label       string        `json:"label,omitempty"`
+	ExpiresAt   *time.Time    `json:"expires_at,omitempty"`
+	RevokedAt   *time.Time    `json:"revoked_at,omitempty"`
+	LastUsedAt  *time.Time    `json:"last_used_at,omitempty"`
+	CreatedByID *string       `gorm:"size:36" json:"created_by_id,omitempty"`
+}
+
+func (CustomerPortalAccessModel) TableName() string {
+	return "customer_portal_accesses"
+}
+
+func (m *CustomerPortalAccessModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type PurchaseMatchStatus string
+
+const (
+	MatchStatusUnmatched             PurchaseMatchStatus = "UNMATCHED"
+	MatchStatusMatched               PurchaseMatchStatus = "MATCHED"
+	MatchStatusQuantityVariance      PurchaseMatchStatus = "QUANTITY_VARIANCE"
+	MatchStatusPriceVariance         PurchaseMatchStatus = "PRICE_VARIANCE"
+	MatchStatusQuantityPriceVariance PurchaseMatchStatus = "QUANTITY_PRICE_VARIANCE"
+)
+
+// GoodsReceiptModel adalah dokumen penerimaan barang atas suatu purchase order.
+//
+// Satu purchase order bisa memiliki beberapa penerimaan (penerimaan sebagian).
+type GoodsReceiptModel struct {
+	shared.BaseModel
+	ReceiptNumber string                  `gorm:"type:varchar(255)" json:"receipt_number"`
+	Date          time.Time               `json:"date"`
+	PurchaseID    string                  `gorm:"type:char(36);index" json:"purchase_id"`
+	Purchase      *PurchaseOrderModel     `gorm:"foreignKey:PurchaseID;constraint:OnDelete:CASCADE" json:"purchase,omitempty"`
+	ContactID     *string                 `gorm:"size:36" json:"contact_id,omitempty"`
+	Contact       *ContactModel           `gorm:"foreignKey:ContactID;constraint:OnDelete:SET NULL" json:"contact,omitempty"`
+	Description   string                  `json:"description"`
+	Notes         string                  `gorm:"type:text" json:"notes"`
+	Status        string                  `gorm:"type:varchar(50);default:'DRAFT'" json:"status"` // DRAFT, POSTED, CANCELLED
+	PostedAt      *time.Time              `json:"posted_at,omitempty"`
+	PostedByID    *string                 `gorm:"size:36" json:"posted_by_id,omitempty"`
+	PostedBy      *UserModel              `gorm:"foreignKey:PostedByID;constraint:OnDelete:SET NULL" json:"posted_by,omitempty"`
+	Total         float64                 `json:"total"`
+	UserID        *string                 `gorm:"size:36" json:"user_id,omitempty"`
+	User          *UserModel              `gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL" json:"user,omitempty"`
+	CompanyID     *string                 `json:"company_id,omitempty"`
+	Company       *CompanyModel           `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Items         []GoodsReceiptItemModel `gorm:"foreignKey:GoodsReceiptID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
+}
+
+func (GoodsReceiptModel) TableName() string {
+	return "goods_receipts"
+}
+
+func (g *GoodsReceiptModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if g.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// GoodsReceiptItemModel adalah baris penerimaan barang yang mengacu ke baris purchase order
+type GoodsReceiptItemModel struct {
+	shared.BaseModel
+	GoodsReceiptID string                  `gorm:"type:char(36);index" json:"goods_receipt_id"`
+	GoodsReceipt   *GoodsReceiptModel      `gorm:"foreignKey:GoodsReceiptID;constraint:OnDelete:CASCADE" json:"goods_receipt,omitempty"`
+	PurchaseItemID string                  `gorm:"type:char(36);index" json:"purchase_item_id"`
+	PurchaseItem   *PurchaseOrderItemModel `gorm:"foreignKey:PurchaseItemID;constraint:OnDelete:CASCADE" json:"purchase_item,omitempty"`
+	Description    string                  `json:"description"`
+	ProductID      *string                 `gorm:"size:36" json:"product_id,omitempty"`
+	Product        *ProductModel           `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID      *string                 `gorm:"size:36" json:"variant_id,omitempty"`
+	Variant        *VariantModel           `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE" json:"variant,omitempty"`
+	WarehouseID    *string                 `gorm:"size:36" json:"warehouse_id,omitempty"`
+	Warehouse      *WarehouseModel         `gorm:"foreignKey:WarehouseID;constraint:OnDelete:SET NULL" json:"warehouse,omitempty"`
+	UnitID         *string                 `gorm:"size:36" json:"unit_id,omitempty"`
+	Unit           *UnitModel              `gorm:"foreignKey:UnitID;constraint:OnDelete:SET NULL" json:"unit,omitempty"`
+	UnitValue      float64                 `gorm:"default:1" json:"unit_value"`
+	Quantity       float64                 `json:"quantity"`
+	UnitCost       float64                 `json:"unit_cost"` // nilai persediaan per unit saat diterima (harga PO atau standard cost)
+	Total          float64                 `json:"total"`
+	BilledQuantity float64                 `gorm:"default:0" json:"billed_quantity"`  // kuantitas yang sudah ditagih vendor
+	LandedCost     float64                 `gorm:"default:0" json:"landed_cost"`      // total biaya tambahan (landed cost) yang dialokasikan
+	LandedUnitCost float64                 `gorm:"default:0" json:"landed_unit_cost"` // UnitCost ditambah landed cost per unit
+}
+
+func (GoodsReceiptItemModel) TableName() string {
+	return "goods_receipt_items"
+}
+
+func (g *GoodsReceiptItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if g.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PurchaseMatchSettingModel adalah pengaturan three-way matching per perusahaan.
+//
+// Toleransi dinyatakan dalam persen; PriceToleranceAmount adalah batas selisih
+// harga per unit dalam nominal (0 berarti tidak dipakai).
+type PurchaseMatchSettingModel struct {
+	shared.BaseModel
+	CompanyID               *string       `gorm:"size:36;uniqueIndex" json:"company_id,omitempty"`
+	Company                 *CompanyModel `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	QuantityTolerance       float64       `gorm:"default:0" json:"quantity_tolerance"`
+	PriceTolerance          float64       `gorm:"default:0" json:"price_tolerance"`
+	PriceToleranceAmount    float64       `gorm:"default:0" json:"price_tolerance_amount"`
+	CostBasis               string        `gorm:"type:varchar(50);default:'PO'" json:"cost_basis"` // PO, STANDARD
+	HoldOnMismatch          bool          `gorm:"default:true" json:"hold_on_mismatch"`
+	AccruedPayableAccountID *string       `gorm:"size:36" json:"accrued_payable_account_id,omitempty"` // barang diterima belum ditagih
+	AccruedPayableAccount   *AccountModel `gorm:"foreignKey:AccruedPayableAccountID;constraint:OnDelete:SET NULL" json:"accrued_payable_account,omitempty"`
+	PriceVarianceAccountID  *string       `gorm:"size:36" json:"price_variance_account_id,omitempty"`
+	PriceVarianceAccount    *AccountModel `gorm:"foreignKey:PriceVarianceAccountID;constraint:OnDelete:SET NULL" json:"price_variance_account,omitempty"`
+}
+
+func (PurchaseMatchSettingModel) TableName() string {
+	return "purchase_match_settings"
+}
+
+func (p *PurchaseMatchSettingModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PurchaseMatchModel adalah hasil pencocokan satu baris tagihan vendor terhadap
+// baris purchase order dan penerimaan barangnya
+type PurchaseMatchModel struct {
+	shared.BaseModel
+	BillID              string              `gorm:"type:char(36);index" json:"bill_id"`
+	BillItemID          string              `gorm:"type:char(36);index" json:"bill_item_id"`
+	PurchaseID          *string             `gorm:"size:36" json:"purchase_id,omitempty"`
+	PurchaseItemID      *string             `gorm:"size:36" json:"purchase_item_id,omitempty"`
+	Description         string              `json:"description"`
+	OrderedQuantity     float64             `json:"ordered_quantity"`
+	ReceivedQuantity    float64             `json:"received_quantity"`
+	BilledQuantity      float64             `json:"billed_quantity"` // termasuk tagihan lain atas baris PO yang sama
+	OrderedUnitPrice    float64             `json:"ordered_unit_price"`
+	BilledUnitPrice     float64             `json:"billed_unit_price"`
+	QuantityVariance    float64             `json:"quantity_variance"`
+	PriceVariance       float64             `json:"price_variance"`
+	PriceVariancePct    float64             `json:"price_variance_pct"`
+	PriceVarianceAmount float64             `json:"price_variance_amount"`
+	Status              PurchaseMatchStatus `gorm:"type:varchar(50)" json:"status"`
+	Notes               string              `gorm:"type:text" json:"notes"`
+	MatchedAt           time.Time           `json:"matched_at"`
+}
+
+func (PurchaseMatchModel) TableName() string {
+	return "purchase_matches"
+}
+
+func (p *PurchaseMatchModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type LandedCostAllocationMethod string
+
+const (
+	AllocateByQuantity LandedCostAllocationMethod = "QUANTITY"
+	AllocateByValue    LandedCostAllocationMethod = "VALUE"
+	AllocateByWeight   LandedCostAllocationMethod = "WEIGHT"
+	AllocateByVolume   LandedCostAllocationMethod = "VOLUME"
+)
+
+// LandedCostVoucherModel adalah voucher biaya tambahan pembelian (ongkos kirim, bea masuk,
+// asuransi, dll.) yang dibebankan ke persediaan dari satu atau beberapa penerimaan barang
+type LandedCostVoucherModel struct {
+	shared.BaseModel
+	VoucherNumber    string                      `gorm:"type:varchar(255)" json:"voucher_number"`
+	Date             time.Time                   `json:"date"`
+	Description      string                      `json:"description"`
+	Notes            string                      `gorm:"type:text" json:"notes"`
+	AllocationMethod LandedCostAllocationMethod  `gorm:"type:varchar(50);default:'VALUE'" json:"allocation_method"`
+	Total            float64                     `json:"total"`
+	Status           string                      `gorm:"type:varchar(50);default:'DRAFT'" json:"status"` // DRAFT, POSTED, CANCELLED
+	ContactID        *string                     `gorm:"size:36" json:"contact_id,omitempty"`            // vendor jasa (forwarder, bea cukai, dll.)
+	Contact          *ContactModel               `gorm:"foreignKey:ContactID;constraint:OnDelete:SET NULL" json:"contact,omitempty"`
+	CreditAccountID  *string                     `gorm:"size:36" json:"credit_account_id,omitempty"` // akun hutang atau kas/bank
+	CreditAccount    *AccountModel               `gorm:"foreignKey:CreditAccountID;constraint:OnDelete:SET NULL" json:"credit_account,omitempty"`
+	PostedAt         *time.Time                  `json:"posted_at,omitempty"`
+	PostedByID       *string                     `gorm:"size:36" json:"posted_by_id,omitempty"`
+	PostedBy         *UserModel                  `gorm:"foreignKey:PostedByID;constraint:OnDelete:SET NULL" json:"posted_by,omitempty"`
+	UserID           *string                     `gorm:"size:36" json:"user_id,omitempty"`
+	User             *UserModel                  `gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL" json:"user,omitempty"`
+	CompanyID        *string                     `json:"company_id,omitempty"`
+	Company          *CompanyModel               `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	GoodsReceipts    []*GoodsReceiptModel        `gorm:"many2many:landed_cost_voucher_receipts;constraint:OnDelete:CASCADE;" json:"goods_receipts,omitempty"`
+	Charges          []LandedCostChargeModel     `gorm:"foreignKey:VoucherID;constraint:OnDelete:CASCADE" json:"charges,omitempty"`
+	Allocations      []LandedCostAllocationModel `gorm:"foreignKey:VoucherID;constraint:OnDelete:CASCADE" json:"allocations,omitempty"`
+}
+
+func (LandedCostVoucherModel) TableName() string {
+	return "landed_cost_vouchers"
+}
+
+func (l *LandedCostVoucherModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// LandedCostChargeModel adalah komponen biaya pada voucher landed cost
+type LandedCostChargeModel struct {
+	shared.BaseModel
+	VoucherID   string  `gorm:"type:char(36);index" json:"voucher_id"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+func (LandedCostChargeModel) TableName() string {
+	return "landed_cost_charges"
+}
+
+func (l *LandedCostChargeModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// LandedCostAllocationModel adalah hasil alokasi voucher landed cost ke satu baris penerimaan barang.
+//
+// Bagian untuk barang yang sudah terjual sejak diterima (CogsAmount) dibebankan ke HPP,
+// sisanya (InventoryAmount) menambah nilai persediaan.
+type LandedCostAllocationModel struct {
+	shared.BaseModel
+	VoucherID          string                 `gorm:"type:char(36);index" json:"voucher_id"`
+	GoodsReceiptItemID string                 `gorm:"type:char(36);index" json:"goods_receipt_item_id"`
+	GoodsReceiptItem   *GoodsReceiptItemModel `gorm:"foreignKey:GoodsReceiptItemID;constraint:OnDelete:CASCADE" json:"goods_receipt_item,omitempty"`
+	ProductID          *string                `gorm:"size:36" json:"product_id,omitempty"`
+	Product            *ProductModel          `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID          *string                `gorm:"size:36" json:"variant_id,omitempty"`
+	WarehouseID        *string                `gorm:"size:36" json:"warehouse_id,omitempty"`
+	Quantity           float64                `json:"quantity"`
+	Basis              float64                `json:"basis"` // nilai dasar alokasi (kuantitas, nilai, berat atau volume)
+	Amount             float64                `json:"amount"`
+	SoldQuantity       float64                `json:"sold_quantity"`
+	InventoryAmount    float64                `json:"inventory_amount"`
+	CogsAmount         float64                `json:"cogs_amount"`
+}
+
+func (LandedCostAllocationModel) TableName() string {
+	return "landed_cost_allocations"
+}
+
+func (l *LandedCostAllocationModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
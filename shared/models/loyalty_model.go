@@ -0,0 +1,189 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type LoyaltyRuleType string
+
+const (
+	LoyaltyRuleSpend    LoyaltyRuleType = "SPEND"    // Poin per kelipatan belanja (IDR)
+	LoyaltyRuleProduct  LoyaltyRuleType = "PRODUCT"  // Poin untuk produk tertentu
+	LoyaltyRuleCategory LoyaltyRuleType = "CATEGORY" // Poin untuk kategori produk tertentu
+)
+
+type LoyaltyLedgerType string
+
+const (
+	LoyaltyLedgerEarn     LoyaltyLedgerType = "EARN"
+	LoyaltyLedgerRedeem   LoyaltyLedgerType = "REDEEM"
+	LoyaltyLedgerExpire   LoyaltyLedgerType = "EXPIRE"
+	LoyaltyLedgerAdjust   LoyaltyLedgerType = "ADJUST"
+	LoyaltyLedgerReversal LoyaltyLedgerType = "REVERSAL"
+)
+
+type LoyaltyRedeemMode string
+
+const (
+	LoyaltyRedeemPayment  LoyaltyRedeemMode = "PAYMENT"  // Poin dipakai sebagai metode pembayaran
+	LoyaltyRedeemDiscount LoyaltyRedeemMode = "DISCOUNT" // Poin dipakai sebagai potongan harga
+)
+
+// LoyaltyProgramModel adalah program loyalitas pelanggan milik perusahaan.
+//
+// PointValue adalah nilai rupiah satu poin saat ditukar. PointExpiryDays adalah masa berlaku
+// poin sejak diperoleh (0 = tidak kedaluwarsa). TierPeriodDays adalah periode belanja bergulir
+// yang dipakai untuk menentukan tier anggota.
+type LoyaltyProgramModel struct {
+	shared.BaseModel
+	Name             string             `gorm:"type:varchar(255)" json:"name"`
+	Description      string             `json:"description"`
+	CompanyID        *string            `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company          *CompanyModel      `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	IsActive         bool               `gorm:"default:true" json:"is_active"`
+	PointValue       float64            `gorm:"default:1" json:"point_value"`
+	PointExpiryDays  int                `gorm:"default:365" json:"point_expiry_days"`
+	MinRedeemPoints  float64            `gorm:"default:0" json:"min_redeem_points"`
+	MaxRedeemPercent float64            `gorm:"default:100" json:"max_redeem_percent"` // batas persentase total transaksi yang boleh dibayar dengan poin
+	TierPeriodDays   int                `gorm:"default:365" json:"tier_period_days"`
+	AutoEnroll       bool               `gorm:"default:true" json:"auto_enroll"` // pelanggan otomatis menjadi anggota saat transaksi pertama
+	Rules            []LoyaltyRuleModel `gorm:"foreignKey:ProgramID;constraint:OnDelete:CASCADE" json:"rules,omitempty"`
+	Tiers            []LoyaltyTierModel `gorm:"foreignKey:ProgramID;constraint:OnDelete:CASCADE" json:"tiers,omitempty"`
+}
+
+func (LoyaltyProgramModel) TableName() string {
+	return "loyalty_programs"
+}
+
+func (l *LoyaltyProgramModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// LoyaltyRuleModel adalah aturan perolehan poin.
+//
+// Untuk setiap kelipatan SpendAmount dari nilai belanja yang memenuhi aturan, pelanggan
+// mendapat Points poin. Bila PerQuantity aktif, Points diberikan per unit produk.
+// Source membatasi sumber transaksi (pos, sales); kosong berarti semua.
+type LoyaltyRuleModel struct {
+	shared.BaseModel
+	ProgramID   string                `gorm:"type:char(36);index" json:"program_id"`
+	Program     *LoyaltyProgramModel  `gorm:"foreignKey:ProgramID;constraint:OnDelete:CASCADE" json:"program,omitempty"`
+	Name        string                `gorm:"type:varchar(255)" json:"name"`
+	RuleType    LoyaltyRuleType       `gorm:"type:varchar(20)" json:"rule_type"`
+	SpendAmount float64               `json:"spend_amount"`
+	Points      float64               `json:"points"`
+	PerQuantity bool                  `gorm:"default:false" json:"per_quantity"`
+	ProductID   *string               `gorm:"size:36" json:"product_id,omitempty"`
+	Product     *ProductModel         `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	CategoryID  *string               `gorm:"size:36" json:"category_id,omitempty"`
+	Category    *ProductCategoryModel `gorm:"foreignKey:CategoryID;constraint:OnDelete:CASCADE" json:"category,omitempty"`
+	Source      string                `gorm:"type:varchar(20)" json:"source"`
+	StartDate   *time.Time            `json:"start_date,omitempty"`
+	EndDate     *time.Time            `json:"end_date,omitempty"`
+	IsActive    bool                  `gorm:"default:true" json:"is_active"`
+}
+
+func (LoyaltyRuleModel) TableName() string {
+	return "loyalty_rules"
+}
+
+func (l *LoyaltyRuleModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// LoyaltyTierModel adalah tingkatan anggota. Anggota berada pada tier dengan MinSpend tertinggi
+// yang tidak melebihi belanja bergulirnya; poin yang diperoleh dikalikan Multiplier.
+type LoyaltyTierModel struct {
+	shared.BaseModel
+	ProgramID  string               `gorm:"type:char(36);index" json:"program_id"`
+	Program    *LoyaltyProgramModel `gorm:"foreignKey:ProgramID;constraint:OnDelete:CASCADE" json:"program,omitempty"`
+	Name       string               `gorm:"type:varchar(255)" json:"name"`
+	MinSpend   float64              `json:"min_spend"`
+	Multiplier float64              `gorm:"default:1" json:"multiplier"`
+}
+
+func (LoyaltyTierModel) TableName() string {
+	return "loyalty_tiers"
+}
+
+func (l *LoyaltyTierModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// LoyaltyMemberModel adalah keanggotaan seorang kontak pada program loyalitas
+type LoyaltyMemberModel struct {
+	shared.BaseModel
+	ProgramID       string               `gorm:"type:char(36);uniqueIndex:idx_loyalty_member_contact" json:"program_id"`
+	Program         *LoyaltyProgramModel `gorm:"foreignKey:ProgramID;constraint:OnDelete:CASCADE" json:"program,omitempty"`
+	ContactID       string               `gorm:"type:char(36);uniqueIndex:idx_loyalty_member_contact" json:"contact_id"`
+	Contact         *ContactModel        `gorm:"foreignKey:ContactID;constraint:OnDelete:CASCADE" json:"contact,omitempty"`
+	MemberNumber    string               `gorm:"type:varchar(50)" json:"member_number"`
+	TierID          *string              `gorm:"size:36" json:"tier_id,omitempty"`
+	Tier            *LoyaltyTierModel    `gorm:"foreignKey:TierID;constraint:OnDelete:SET NULL" json:"tier,omitempty"`
+	PointsBalance   float64              `json:"points_balance"`
+	LifetimePoints  float64              `json:"lifetime_points"`
+	RollingSpend    float64              `json:"rolling_spend"`
+	JoinedAt        time.Time            `json:"joined_at"`
+	TierEvaluatedAt *time.Time           `json:"tier_evaluated_at,omitempty"`
+}
+
+func (LoyaltyMemberModel) TableName() string {
+	return "loyalty_members"
+}
+
+func (l *LoyaltyMemberModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// LoyaltyLedgerModel adalah mutasi poin anggota.
+//
+// Points bertanda (positif = bertambah). Untuk mutasi yang menambah poin, RemainingPoints
+// adalah sisa poin yang belum dipakai atau kedaluwarsa; poin dipakai mulai dari yang paling
+// cepat kedaluwarsa. Amount adalah nilai belanja (EARN/REVERSAL) atau nilai rupiah penukaran (REDEEM).
+type LoyaltyLedgerModel struct {
+	shared.BaseModel
+	MemberID        string              `gorm:"type:char(36);index" json:"member_id"`
+	Member          *LoyaltyMemberModel `gorm:"foreignKey:MemberID;constraint:OnDelete:CASCADE" json:"member,omitempty"`
+	ProgramID       string              `gorm:"type:char(36);index" json:"program_id"`
+	ContactID       string              `gorm:"type:char(36);index" json:"contact_id"`
+	Date            time.Time           `json:"date"`
+	Type            LoyaltyLedgerType   `gorm:"type:varchar(20);index;index:idx_loyalty_ledger_earn,unique,where:type = 'EARN'" json:"type"`
+	Points          float64             `json:"points"`
+	RemainingPoints float64             `json:"remaining_points"`
+	ExpiresAt       *time.Time          `json:"expires_at,omitempty"`
+	Amount          float64             `json:"amount"`
+	Multiplier      float64             `gorm:"default:1" json:"multiplier"`
+	RedeemMode      LoyaltyRedeemMode   `gorm:"type:varchar(20)" json:"redeem_mode,omitempty"`
+	ReferenceID     *string             `gorm:"size:36;index;index:idx_loyalty_ledger_earn,unique" json:"reference_id,omitempty"`
+	ReferenceType   string              `gorm:"type:varchar(50);index;index:idx_loyalty_ledger_earn,unique" json:"reference_type,omitempty"` // pos, sales, sales_return, manual
+	ReversalOfID    *string             `gorm:"size:36" json:"reversal_of_id,omitempty"`
+	Description     string              `json:"description"`
+	UserID          *string             `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (LoyaltyLedgerModel) TableName() string {
+	return "loyalty_ledgers"
+}
+
+func (l *LoyaltyLedgerModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if l.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
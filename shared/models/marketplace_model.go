@@ -0,0 +1,251 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CommissionRuleModel adalah aturan komisi platform atas penjualan merchant.
+//
+// Aturan berlaku untuk produk tertentu, kategori produk, jenis merchant, atau semua penjualan
+// (semua referensi kosong); aturan yang paling spesifik yang dipakai untuk setiap baris pesanan.
+// Percent dihitung dari total baris, FixedFee dikenakan sekali per pesanan untuk setiap aturan
+// yang dipakai. Tiers mengganti Percent dan FixedFee berdasarkan omzet merchant pada bulan
+// berjalan.
+type CommissionRuleModel struct {
+	shared.BaseModel
+	Name           string                `gorm:"type:varchar(255)" json:"name"`
+	Description    string                `json:"description"`
+	CompanyID      *string               `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company        *CompanyModel         `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	MerchantTypeID *string               `gorm:"size:36;index" json:"merchant_type_id,omitempty"`
+	MerchantType   *MerchantTypeModel    `gorm:"foreignKey:MerchantTypeID;constraint:OnDelete:CASCADE" json:"merchant_type,omitempty"`
+	CategoryID     *string               `gorm:"size:36;index" json:"category_id,omitempty"`
+	Category       *ProductCategoryModel `gorm:"foreignKey:CategoryID;constraint:OnDelete:CASCADE" json:"category,omitempty"`
+	ProductID      *string               `gorm:"size:36;index" json:"product_id,omitempty"`
+	Product        *ProductModel         `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	Percent        float64               `json:"percent"`
+	FixedFee       float64               `json:"fixed_fee"`
+	Tiers          []CommissionTier      `gorm:"-" json:"tiers,omitempty"`
+	TierData       json.RawMessage       `gorm:"type:JSON;default:'[]'" json:"-"`
+	Priority       int                   `gorm:"default:0" json:"priority"` // aturan dengan prioritas lebih tinggi menang pada cakupan yang sama
+	StartDate      *time.Time            `json:"start_date,omitempty"`
+	EndDate        *time.Time            `json:"end_date,omitempty"`
+	IsActive       bool                  `gorm:"default:true" json:"is_active"`
+}
+
+func (CommissionRuleModel) TableName() string {
+	return "commission_rules"
+}
+
+func (c *CommissionRuleModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+func (c *CommissionRuleModel) BeforeSave(tx *gorm.DB) (err error) {
+	if c.Tiers != nil {
+		b, err := json.Marshal(c.Tiers)
+		if err != nil {
+			return err
+		}
+		c.TierData = b
+	}
+	return
+}
+
+func (c *CommissionRuleModel) AfterFind(tx *gorm.DB) (err error) {
+	if len(c.TierData) > 0 {
+		json.Unmarshal(c.TierData, &c.Tiers)
+	}
+	return
+}
+
+// CommissionTier adalah tingkatan komisi: berlaku jika omzet merchant pada bulan berjalan
+// (sebelum pesanan) sudah mencapai MinVolume.
+type CommissionTier struct {
+	MinVolume float64 `json:"min_volume"`
+	Percent   float64 `json:"percent"`
+	FixedFee  float64 `json:"fixed_fee"`
+}
+
+// MerchantCommissionModel adalah komisi platform atas satu pesanan merchant yang selesai.
+type MerchantCommissionModel struct {
+	shared.BaseModel
+	POSID            *string                       `gorm:"size:36;uniqueIndex" json:"pos_id,omitempty"`
+	POS              *POSModel                     `gorm:"foreignKey:POSID;constraint:OnDelete:CASCADE" json:"pos,omitempty"`
+	MerchantID       *string                       `gorm:"size:36;index" json:"merchant_id,omitempty"`
+	Merchant         *MerchantModel                `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	CompanyID        *string                       `gorm:"size:36;index" json:"company_id,omitempty"`
+	Date             time.Time                     `json:"date"`
+	OrderAmount      float64                       `gorm:"type:decimal(13,2);default:0" json:"order_amount"`
+	Volume           float64                       `gorm:"type:decimal(15,2);default:0" json:"volume"` // omzet bulan berjalan sebelum pesanan, dasar pemilihan tier
+	CommissionAmount float64                       `gorm:"type:decimal(13,2);default:0" json:"commission_amount"`
+	ReversedAmount   float64                       `gorm:"type:decimal(13,2);default:0" json:"reversed_amount"` // komisi yang dikembalikan karena refund
+	Collected        bool                          `json:"collected"`                                           // dana pesanan diterima platform (pembayaran online)
+	Lines            []MerchantCommissionLineModel `gorm:"foreignKey:CommissionID;constraint:OnDelete:CASCADE" json:"lines,omitempty"`
+}
+
+func (MerchantCommissionModel) TableName() string {
+	return "merchant_commissions"
+}
+
+func (m *MerchantCommissionModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// MerchantCommissionLineModel adalah rincian komisi per baris pesanan. Baris tanpa POSItemID
+// adalah biaya tetap aturan komisi.
+type MerchantCommissionLineModel struct {
+	shared.BaseModel
+	CommissionID *string `gorm:"size:36;index" json:"commission_id"`
+	POSItemID    *string `gorm:"size:36" json:"pos_item_id,omitempty"`
+	ProductID    *string `gorm:"size:36" json:"product_id,omitempty"`
+	Description  string  `json:"description"`
+	RuleID       *string `gorm:"size:36" json:"rule_id,omitempty"`
+	RuleName     string  `json:"rule_name"`
+	Basis        float64 `gorm:"type:decimal(13,2);default:0" json:"basis"`
+	Percent      float64 `json:"percent"`
+	Amount       float64 `gorm:"type:decimal(13,2);default:0" json:"amount"`
+}
+
+func (MerchantCommissionLineModel) TableName() string {
+	return "merchant_commission_lines"
+}
+
+func (m *MerchantCommissionLineModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+const (
+	MerchantLedgerSale               = "SALE"                // penjualan yang dananya diterima platform
+	MerchantLedgerCommission         = "COMMISSION"          // komisi platform
+	MerchantLedgerRefund             = "REFUND"              // penjualan yang dikembalikan ke pelanggan
+	MerchantLedgerCommissionReversal = "COMMISSION_REVERSAL" // komisi yang dikembalikan karena refund
+	MerchantLedgerPayout             = "PAYOUT"              // pencairan ke rekening merchant
+	MerchantLedgerPayoutReversal     = "PAYOUT_REVERSAL"     // pencairan yang gagal atau dibatalkan
+	MerchantLedgerAdjustment         = "ADJUSTMENT"
+)
+
+// MerchantLedgerEntryModel adalah mutasi saldo merchant di platform.
+//
+// Jumlah positif menambah saldo. Mutasi penjualan dan komisi ditahan sampai AvailableAt (masa
+// tahan / hold period merchant), baru setelah itu bisa dicairkan.
+type MerchantLedgerEntryModel struct {
+	shared.BaseModel
+	MerchantID  *string        `gorm:"size:36;index" json:"merchant_id,omitempty"`
+	Merchant    *MerchantModel `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	CompanyID   *string        `gorm:"size:36;index" json:"company_id,omitempty"`
+	Date        time.Time      `gorm:"index" json:"date"`
+	Type        string         `gorm:"type:varchar(30);index" json:"type"`
+	Amount      float64        `gorm:"type:decimal(13,2);default:0" json:"amount"`
+	AvailableAt time.Time      `gorm:"index" json:"available_at"`
+	RefID       *string        `gorm:"size:36;index" json:"ref_id,omitempty"`
+	RefType     string         `gorm:"type:varchar(50)" json:"ref_type"` // pos_sales, pos_refund, merchant_payout, ...
+	Description string         `json:"description"`
+	UserID      *string        `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (MerchantLedgerEntryModel) TableName() string {
+	return "merchant_ledger_entries"
+}
+
+func (m *MerchantLedgerEntryModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+const (
+	MerchantPayoutBatchDraft      = "DRAFT"
+	MerchantPayoutBatchProcessing = "PROCESSING"
+	MerchantPayoutBatchCompleted  = "COMPLETED"
+	MerchantPayoutBatchCanceled   = "CANCELED"
+)
+
+const (
+	MerchantPayoutPending    = "PENDING"
+	MerchantPayoutProcessing = "PROCESSING"
+	MerchantPayoutCompleted  = "COMPLETED"
+	MerchantPayoutFailed     = "FAILED"
+	MerchantPayoutCanceled   = "CANCELED"
+)
+
+// MerchantPayoutBatchModel adalah satu putaran pencairan saldo merchant melalui penyedia
+// disbursement.
+//
+// Jika CashAccountID dan PayableAccountID diisi, setiap pencairan yang berhasil dijurnal dari
+// akun utang merchant (debit) ke akun kas/bank (kredit).
+type MerchantPayoutBatchModel struct {
+	shared.BaseModel
+	Code             string                `gorm:"type:varchar(50);uniqueIndex" json:"code"`
+	CompanyID        *string               `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company          *CompanyModel         `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Date             time.Time             `json:"date"`
+	Provider         string                `gorm:"type:varchar(50)" json:"provider"`
+	Status           string                `gorm:"type:varchar(20);default:DRAFT;index" json:"status"`
+	TotalAmount      float64               `gorm:"type:decimal(15,2);default:0" json:"total_amount"`
+	PayoutCount      int                   `json:"payout_count"`
+	CompletedCount   int                   `json:"completed_count"`
+	FailedCount      int                   `json:"failed_count"`
+	CashAccountID    *string               `gorm:"size:36" json:"cash_account_id,omitempty"`
+	CashAccount      *AccountModel         `gorm:"foreignKey:CashAccountID;constraint:OnDelete:SET NULL" json:"cash_account,omitempty"`
+	PayableAccountID *string               `gorm:"size:36" json:"payable_account_id,omitempty"`
+	PayableAccount   *AccountModel         `gorm:"foreignKey:PayableAccountID;constraint:OnDelete:SET NULL" json:"payable_account,omitempty"`
+	Notes            string                `json:"notes"`
+	UserID           *string               `gorm:"size:36" json:"user_id,omitempty"`
+	Payouts          []MerchantPayoutModel `gorm:"foreignKey:BatchID;constraint:OnDelete:CASCADE" json:"payouts,omitempty"`
+}
+
+func (MerchantPayoutBatchModel) TableName() string {
+	return "merchant_payout_batches"
+}
+
+func (m *MerchantPayoutBatchModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// MerchantPayoutModel adalah pencairan saldo satu merchant dalam satu batch. ID pencairan
+// dikirim ke penyedia disbursement sebagai referensi (idempotency key).
+type MerchantPayoutModel struct {
+	shared.BaseModel
+	BatchID           *string        `gorm:"size:36;index" json:"batch_id"`
+	MerchantID        *string        `gorm:"size:36;index" json:"merchant_id,omitempty"`
+	Merchant          *MerchantModel `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	CompanyID         *string        `gorm:"size:36" json:"company_id,omitempty"`
+	Amount            float64        `gorm:"type:decimal(13,2);default:0" json:"amount"`
+	BankCode          string         `gorm:"type:varchar(50)" json:"bank_code"`
+	AccountNumber     string         `gorm:"type:varchar(50)" json:"account_number"`
+	AccountHolderName string         `gorm:"type:varchar(255)" json:"account_holder_name"`
+	Status            string         `gorm:"type:varchar(20);default:PENDING;index" json:"status"`
+	ProviderRef       string         `gorm:"type:varchar(255);index" json:"provider_ref,omitempty"`
+	FailureReason     string         `json:"failure_reason,omitempty"`
+	DisbursedAt       *time.Time     `json:"disbursed_at,omitempty"`
+}
+
+func (MerchantPayoutModel) TableName() string {
+	return "merchant_payouts"
+}
+
+func (m *MerchantPayoutModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
@@ -43,6 +43,12 @@ type MerchantModel struct {
 	XenditApiKey           string              `json:"xendit_api_key,omitempty" gorm:"type:varchar(255);"`
 	XenditApiKeyCensored   string              `json:"xendit_api_key_censored,omitempty" gorm:"-"`
 	Xendit                 *XenditModel        `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE;" json:"xendit,omitempty"`
+	RequireOpenShift       bool                `json:"require_open_shift" gorm:"default:false"` // tolak penjualan POS jika tidak ada shift kasir yang terbuka
+	RefundApprovalLimit    float64             `json:"refund_approval_limit" gorm:"default:0"`  // refund di atas jumlah ini perlu persetujuan manajer, 0 = tanpa persetujuan
+	PayoutHoldDays         int                 `json:"payout_hold_days" gorm:"default:0"`       // masa tahan saldo penjualan sebelum bisa dicairkan
+	PayoutBankCode         string              `json:"payout_bank_code,omitempty" gorm:"type:varchar(50)"`
+	PayoutAccountNumber    string              `json:"payout_account_number,omitempty" gorm:"type:varchar(50)"`
+	PayoutAccountName      string              `json:"payout_account_name,omitempty" gorm:"type:varchar(255)"`
 }
 
 func (m *MerchantModel) TableName() string {
@@ -88,6 +94,7 @@ type MerchantAvailableProductItem struct {
 	Quantity                float64     `json:"quantity"`
 	UnitPrice               float64     `json:"unit_price"`
 	UnitPriceBeforeDiscount float64     `json:"unit_price_before_discount"`
+	PriceListItemID         *string     `json:"price_list_item_id,omitempty"`
 	SubTotal                float64     `json:"sub_total"`
 	SubTotalBeforeDiscount  float64     `json:"sub_total_before_discount"`
 	DiscountAmount          float64     `json:"discount_amount"`
@@ -181,21 +188,35 @@ type MerchantOrder struct {
 	ContactPhone          string                 `json:"contact_phone" gorm:"-"`
 	ParentID              *string                `json:"parent_id" gorm:"index;constraint:OnDelete:CASCADE;"`
 	Parent                *MerchantOrder         `gorm:"foreignKey:ParentID;constraint:OnDelete:CASCADE;" json:"parent,omitempty"`
+	FiredCourse           int                    `json:"fired_course" gorm:"default:0"` // course tertinggi yang sudah dikirim ke dapur
 }
 
 type MerchantOrderItem struct {
-	ID                 string       `json:"id,omitempty"`
-	ProductID          string       `json:"product_id,omitempty"`
-	Product            ProductModel `json:"product,omitempty"`
-	Quantity           float64      `json:"quantity,omitempty"`
-	DiscountAmount     float64      `json:"discount_amount,omitempty"`
-	DiscountPercent    float64      `json:"discount_percent,omitempty"`
-	UnitPrice          float64      `json:"unit_price,omitempty"`
-	SubtotalBeforeDisc float64      `json:"subtotal_before_disc,omitempty"`
-	Subtotal           float64      `json:"subtotal,omitempty"`
-	UnitName           string       `json:"unit_name,omitempty"`
-	UnitValue          float64      `json:"unit_value,omitempty"`
-	Notes              string       `json:"notes,omitempty"`
+	ID                 string                      `json:"id,omitempty"`
+	ProductID          string                      `json:"product_id,omitempty"`
+	Product            ProductModel                `json:"product,omitempty"`
+	Quantity           float64                     `json:"quantity,omitempty"`
+	DiscountAmount     float64                     `json:"discount_amount,omitempty"`
+	DiscountPercent    float64                     `json:"discount_percent,omitempty"`
+	UnitPrice          float64                     `json:"unit_price,omitempty"`
+	SubtotalBeforeDisc float64                     `json:"subtotal_before_disc,omitempty"`
+	Subtotal           float64                     `json:"subtotal,omitempty"`
+	UnitName           string                      `json:"unit_name,omitempty"`
+	UnitValue          float64                     `json:"unit_value,omitempty"`
+	Notes              string                      `json:"notes,omitempty"`
+	Modifiers          []MerchantOrderItemModifier `json:"modifiers,omitempty"`
+	ModifierTotal      float64                     `json:"modifier_total,omitempty"` // total selisih harga modifier per unit
+	Course             int                         `json:"course,omitempty"`         // urutan penyajian (1 = pembuka, 2 = utama, ...); 0 = langsung
+}
+
+// MerchantOrderItemModifier adalah pilihan modifier pada item pesanan
+type MerchantOrderItemModifier struct {
+	GroupID    string  `json:"group_id"`
+	GroupName  string  `json:"group_name,omitempty"`
+	OptionID   string  `json:"option_id"`
+	OptionName string  `json:"option_name,omitempty"`
+	PriceDelta float64 `json:"price_delta"`
+	Quantity   float64 `json:"quantity,omitempty"`
 }
 type MerchantStation struct {
 	shared.BaseModel
@@ -203,6 +224,7 @@ type MerchantStation struct {
 	Merchant    *MerchantModel         `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE;" json:"merchant,omitempty"`
 	StationName string                 `json:"station_name"`
 	Description string                 `json:"description"`
+	SLAMinutes  int                    `json:"sla_minutes" gorm:"default:15"` // target waktu persiapan item
 	Orders      []MerchantStationOrder `gorm:"foreignKey:MerchantStationID;constraint:OnDelete:CASCADE;" json:"orders,omitempty"`
 	Products    []ProductModel         `gorm:"-" json:"products,omitempty"`
 }
@@ -217,6 +239,29 @@ type MerchantStationOrder struct {
 	Item              json.RawMessage  `gorm:"type:JSON;default:'{}'" json:"item,omitempty"`
 	MerchantDeskID    *string          `json:"merchant_desk_id" gorm:"index;constraint:OnDelete:CASCADE;"`
 	MerchantDesk      *MerchantDesk    `gorm:"foreignKey:MerchantDeskID;constraint:OnDelete:CASCADE;" json:"merchant_desk,omitempty"`
+	Course            int              `json:"course" gorm:"default:0"`
+	FiredAt           *time.Time       `json:"fired_at,omitempty"`
+	StartedAt         *time.Time       `json:"started_at,omitempty"`
+	ReadyAt           *time.Time       `json:"ready_at,omitempty"`
+	ServedAt          *time.Time       `json:"served_at,omitempty"`
+	DueAt             *time.Time       `json:"due_at,omitempty" gorm:"index"`
+	SLAAlertedAt      *time.Time       `json:"sla_alerted_at,omitempty"`
+	ElapsedSeconds    int64            `json:"elapsed_seconds" gorm:"-"`
+	IsLate            bool             `json:"is_late" gorm:"-"`
+}
+
+// AfterFind menghitung lama persiapan item sejak dikirim ke dapur dan apakah melewati target
+func (m *MerchantStationOrder) AfterFind(tx *gorm.DB) (err error) {
+	if m.FiredAt == nil {
+		return
+	}
+	end := time.Now()
+	if m.ReadyAt != nil {
+		end = *m.ReadyAt
+	}
+	m.ElapsedSeconds = int64(end.Sub(*m.FiredAt).Seconds())
+	m.IsLate = m.DueAt != nil && end.After(*m.DueAt)
+	return
 }
 
 type MerchantPayment struct {
@@ -236,4 +281,6 @@ type MerchantPayment struct {
 	ExternalProvider string          `gorm:"type:varchar(255)" json:"external_provider"`
 	ExternalURL      string          `gorm:"type:varchar(255)" json:"external_url"`
 	PaymentData      json.RawMessage `gorm:"type:JSON;default:'{}'" json:"payment_data"`
+	ShiftID          *string         `json:"shift_id,omitempty" gorm:"size:36;index"`
+	Shift            *POSShiftModel  `gorm:"foreignKey:ShiftID;constraint:OnDelete:SET NULL" json:"shift,omitempty"`
 }
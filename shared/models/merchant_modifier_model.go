@@ -0,0 +1,81 @@
+package models
+
+import (
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Status item pesanan di station dapur
+const (
+	StationOrderHold      = "HOLD"      // menunggu course sebelumnya disajikan
+	StationOrderPending   = "PENDING"   // sudah dikirim ke dapur
+	StationOrderPreparing = "PREPARING" // sedang disiapkan
+	StationOrderReady     = "READY"     // siap diantar
+	StationOrderServed    = "SERVED"    // sudah disajikan
+	StationOrderCancelled = "CANCELLED"
+)
+
+// MerchantModifierGroup adalah kelompok pilihan tambahan untuk produk merchant,
+// misalnya "Tingkat Pedas" atau "Topping".
+//
+// MinSelect dan MaxSelect membatasi jumlah pilihan (MaxSelect 0 = tidak dibatasi).
+// Kelompok yang IsRequired harus dipilih minimal satu.
+type MerchantModifierGroup struct {
+	shared.BaseModel
+	MerchantID  *string                  `json:"merchant_id" gorm:"index;constraint:OnDelete:CASCADE;"`
+	Merchant    *MerchantModel           `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE;" json:"merchant,omitempty"`
+	Name        string                   `gorm:"type:varchar(255)" json:"name"`
+	Description string                   `json:"description"`
+	MinSelect   int                      `json:"min_select" gorm:"default:0"`
+	MaxSelect   int                      `json:"max_select" gorm:"default:1"`
+	IsRequired  bool                     `json:"is_required" gorm:"default:false"`
+	Options     []MerchantModifierOption `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;" json:"options,omitempty"`
+	ProductIDs  []string                 `gorm:"-" json:"product_ids,omitempty"`
+}
+
+func (MerchantModifierGroup) TableName() string {
+	return "merchant_modifier_groups"
+}
+
+func (m *MerchantModifierGroup) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// MerchantModifierOption adalah satu pilihan dalam kelompok modifier beserta selisih harganya
+type MerchantModifierOption struct {
+	shared.BaseModel
+	GroupID     string                 `json:"group_id" gorm:"type:char(36);index"`
+	Group       *MerchantModifierGroup `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;" json:"group,omitempty"`
+	Name        string                 `gorm:"type:varchar(255)" json:"name"`
+	PriceDelta  float64                `json:"price_delta"`
+	IsDefault   bool                   `json:"is_default" gorm:"default:false"`
+	IsAvailable bool                   `json:"is_available" gorm:"default:true"`
+	Position    int                    `json:"position" gorm:"default:0"`
+}
+
+func (MerchantModifierOption) TableName() string {
+	return "merchant_modifier_options"
+}
+
+func (m *MerchantModifierOption) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// MerchantProductModifierGroup menghubungkan produk merchant dengan kelompok modifiernya
+type MerchantProductModifierGroup struct {
+	MerchantID string `gorm:"primaryKey;type:char(36)" json:"merchant_id"`
+	ProductID  string `gorm:"primaryKey;type:char(36)" json:"product_id"`
+	GroupID    string `gorm:"primaryKey;type:char(36)" json:"group_id"`
+	Position   int    `json:"position" gorm:"default:0"`
+}
+
+func (MerchantProductModifierGroup) TableName() string {
+	return "merchant_product_modifier_groups"
+}
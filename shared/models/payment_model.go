@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/AMETORY/ametory-erp-modules/shared"
 	"github.com/google/uuid"
@@ -25,6 +26,49 @@ type PaymentModel struct {
 	RefType             string      `gorm:"type:varchar(255);default:ORDER" json:"ref_type"`
 	PaymentFee          float64     `gorm:"type:decimal(10,2);not null;default:0" json:"payment_fee"`
 	Status              string      `gorm:"type:varchar(50);default:PENDING;not null" json:"status"`
+	CompanyID           *string     `gorm:"size:36;index" json:"company_id,omitempty"`
+	ProviderRef         string      `gorm:"type:varchar(255);index" json:"provider_ref,omitempty"` // ID transaksi di penyedia pembayaran
+	AssetAccountID      *string     `gorm:"size:36" json:"asset_account_id,omitempty"`             // Akun penampung dana dari penyedia pembayaran
+	ExpiresAt           *time.Time  `json:"expires_at,omitempty"`
+	PaidAt              *time.Time  `json:"paid_at,omitempty"`
+	PaidAmount          float64     `gorm:"type:decimal(13,2);default:0" json:"paid_amount"`
+	RefundedAt          *time.Time  `json:"refunded_at,omitempty"`
+	RefundedAmount      float64     `gorm:"type:decimal(13,2);default:0" json:"refunded_amount"`
+	FailureReason       string      `json:"failure_reason,omitempty"`
+	SettledAt           *time.Time  `json:"settled_at,omitempty"` // Waktu dokumen terkait (POS, penjualan, donasi) dilunasi
+}
+
+const (
+	PaymentStatusPending  = "PENDING"
+	PaymentStatusPaid     = "PAID"
+	PaymentStatusExpired  = "EXPIRED"
+	PaymentStatusFailed   = "FAILED"
+	PaymentStatusRefunded = "REFUNDED"
+)
+
+// paymentTransitions adalah perpindahan status pembayaran yang diizinkan.
+//
+// Pembayaran yang sudah kedaluwarsa atau gagal masih bisa menjadi PAID karena dana bisa masuk
+// terlambat (misalnya transfer ke virtual account setelah batas waktu).
+var paymentTransitions = map[string][]string{
+	PaymentStatusPending: {PaymentStatusPaid, PaymentStatusExpired, PaymentStatusFailed},
+	PaymentStatusExpired: {PaymentStatusPaid},
+	PaymentStatusFailed:  {PaymentStatusPaid},
+	PaymentStatusPaid:    {PaymentStatusRefunded},
+}
+
+// CanTransitionTo mengembalikan true jika status pembayaran boleh berpindah ke status baru.
+func (pm *PaymentModel) CanTransitionTo(status string) bool {
+	from := pm.Status
+	if from == "" {
+		from = PaymentStatusPending
+	}
+	for _, v := range paymentTransitions[from] {
+		if v == status {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *PaymentModel) TableName() string {
@@ -55,6 +99,37 @@ func (pm *PaymentModel) AfterFind(tx *gorm.DB) (err error) {
 	return
 }
 
+// PaymentEventModel adalah notifikasi (webhook) dari penyedia pembayaran yang sudah diterima.
+//
+// Kombinasi Provider dan EventID unik sehingga notifikasi yang dikirim ulang tidak diproses dua kali.
+type PaymentEventModel struct {
+	shared.BaseModel
+	Provider       string        `gorm:"type:varchar(50);uniqueIndex:idx_payment_event" json:"provider"`
+	EventID        string        `gorm:"type:varchar(255);uniqueIndex:idx_payment_event" json:"event_id"`
+	PaymentID      *string       `gorm:"size:36;index" json:"payment_id,omitempty"`
+	Payment        *PaymentModel `gorm:"foreignKey:PaymentID;constraint:OnDelete:SET NULL" json:"payment,omitempty"`
+	ProviderRef    string        `gorm:"type:varchar(255)" json:"provider_ref"`
+	ReferenceID    string        `gorm:"type:varchar(255)" json:"reference_id"`
+	Status         string        `gorm:"type:varchar(50)" json:"status"`          // status yang dilaporkan penyedia
+	PreviousStatus string        `gorm:"type:varchar(50)" json:"previous_status"` // status pembayaran sebelum notifikasi
+	Amount         float64       `json:"amount"`
+	Result         string        `gorm:"type:varchar(20)" json:"result"` // APPLIED, IGNORED, UNMATCHED
+	Notes          string        `json:"notes"`
+	Payload        string        `gorm:"type:text" json:"-"`
+	ReceivedAt     time.Time     `json:"received_at"`
+}
+
+func (PaymentEventModel) TableName() string {
+	return "payment_events"
+}
+
+func (pe *PaymentEventModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if pe.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
 var BankCodes = map[string]string{
 	"002": "Bank BRI",
 	"008": "Bank Mandiri",
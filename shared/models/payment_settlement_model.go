@@ -0,0 +1,98 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	PaymentSettlementDraft  = "DRAFT"
+	PaymentSettlementPosted = "POSTED"
+)
+
+const (
+	SettlementItemMatched   = "MATCHED"   // cocok dengan pembayaran dan jumlahnya sama
+	SettlementItemMismatch  = "MISMATCH"  // cocok dengan pembayaran tetapi jumlah atau statusnya berbeda
+	SettlementItemUnmatched = "UNMATCHED" // tidak ada pembayaran yang cocok
+	SettlementItemDuplicate = "DUPLICATE" // pembayaran sudah tercakup settlement lain
+)
+
+// PaymentSettlementModel adalah laporan settlement (pencairan dana) dari penyedia pembayaran.
+//
+// Dana settlement masuk ke rekening bank setelah dipotong biaya. Saat diposting, jumlah bersih
+// dicatat ke akun bank, biaya ke akun beban dan jumlah kotor mengurangi akun kliring (akun
+// penampung dana dari penyedia pembayaran).
+type PaymentSettlementModel struct {
+	shared.BaseModel
+	Code              string                       `gorm:"type:varchar(50);uniqueIndex" json:"code"`
+	CompanyID         *string                      `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company           *CompanyModel                `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Provider          string                       `gorm:"type:varchar(50);index" json:"provider"`
+	ReportRef         string                       `gorm:"type:varchar(255);index" json:"report_ref"` // ID settlement / batch di penyedia pembayaran
+	SettlementDate    time.Time                    `json:"settlement_date"`
+	ClearingAccountID *string                      `gorm:"size:36" json:"clearing_account_id,omitempty"`
+	ClearingAccount   *AccountModel                `gorm:"foreignKey:ClearingAccountID;constraint:OnDelete:SET NULL" json:"clearing_account,omitempty"`
+	BankAccountID     *string                      `gorm:"size:36" json:"bank_account_id,omitempty"`
+	BankAccount       *AccountModel                `gorm:"foreignKey:BankAccountID;constraint:OnDelete:SET NULL" json:"bank_account,omitempty"`
+	FeeAccountID      *string                      `gorm:"size:36" json:"fee_account_id,omitempty"`
+	FeeAccount        *AccountModel                `gorm:"foreignKey:FeeAccountID;constraint:OnDelete:SET NULL" json:"fee_account,omitempty"`
+	GrossAmount       float64                      `gorm:"type:decimal(13,2);default:0" json:"gross_amount"`
+	FeeAmount         float64                      `gorm:"type:decimal(13,2);default:0" json:"fee_amount"`
+	NetAmount         float64                      `gorm:"type:decimal(13,2);default:0" json:"net_amount"`
+	MatchedCount      int                          `json:"matched_count"`
+	MismatchCount     int                          `json:"mismatch_count"`
+	UnmatchedCount    int                          `json:"unmatched_count"`
+	DuplicateCount    int                          `json:"duplicate_count"`
+	Status            string                       `gorm:"type:varchar(20);default:DRAFT" json:"status"`
+	PostedAt          *time.Time                   `json:"posted_at,omitempty"`
+	Notes             string                       `json:"notes"`
+	UserID            *string                      `gorm:"size:36" json:"user_id,omitempty"`
+	Items             []PaymentSettlementItemModel `gorm:"foreignKey:SettlementID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
+}
+
+func (PaymentSettlementModel) TableName() string {
+	return "payment_settlements"
+}
+
+func (ps *PaymentSettlementModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if ps.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PaymentSettlementItemModel adalah satu baris laporan settlement beserta hasil pencocokannya
+// dengan pembayaran.
+type PaymentSettlementItemModel struct {
+	shared.BaseModel
+	SettlementID    *string       `gorm:"size:36;index" json:"settlement_id"`
+	Line            int           `json:"line"`
+	PaymentID       *string       `gorm:"size:36;index" json:"payment_id,omitempty"`
+	Payment         *PaymentModel `gorm:"foreignKey:PaymentID;constraint:OnDelete:SET NULL" json:"payment,omitempty"`
+	ProviderRef     string        `gorm:"type:varchar(255)" json:"provider_ref"`
+	ReferenceID     string        `gorm:"type:varchar(255)" json:"reference_id"`
+	TransactionDate *time.Time    `json:"transaction_date,omitempty"`
+	GrossAmount     float64       `gorm:"type:decimal(13,2);default:0" json:"gross_amount"`
+	FeeAmount       float64       `gorm:"type:decimal(13,2);default:0" json:"fee_amount"`
+	NetAmount       float64       `gorm:"type:decimal(13,2);default:0" json:"net_amount"`
+	ExpectedAmount  float64       `gorm:"type:decimal(13,2);default:0" json:"expected_amount"` // jumlah yang dibayar menurut pembayaran
+	RefID           string        `gorm:"type:varchar(255)" json:"ref_id"`                     // dokumen / order yang dilunasi pembayaran
+	RefType         string        `gorm:"type:varchar(50)" json:"ref_type"`
+	Status          string        `gorm:"type:varchar(20);index" json:"status"`
+	DuplicateOfID   *string       `gorm:"size:36" json:"duplicate_of_id,omitempty"` // item settlement yang lebih dulu mencakup pembayaran
+	Notes           string        `json:"notes"`
+}
+
+func (PaymentSettlementItemModel) TableName() string {
+	return "payment_settlement_items"
+}
+
+func (pi *PaymentSettlementItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if pi.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
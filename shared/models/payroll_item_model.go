@@ -8,7 +8,7 @@ import (
 
 type PayrollItemModel struct {
 	shared.BaseModel
-	ItemType           string              `gorm:"type:varchar(20);not null" json:"item_type" ` //'SALARY', 'ALLOWANCE', 'OVERTIME', 'DEDUCTION', 'REIMBURSEMENT'
+	ItemType           string              `gorm:"type:varchar(20);not null" json:"item_type" ` //'SALARY', 'ALLOWANCE', 'OVERTIME', 'DEDUCTION', 'REIMBURSEMENT', 'COMMISSION'
 	AccountPayableID   *string             `json:"account_payable_id"`
 	Title              string              `json:"title"`
 	Notes              string              `json:"notes"`
@@ -73,6 +73,8 @@ type POSModel struct {
 	PaymentType            string                 `json:"payment_type,omitempty" gorm:"column:payment_type"`
 	PaymentProviderType    PaymentProviderType    `json:"payment_provider_type,omitempty" gorm:"column:payment_provider_type"`
 	Items                  []POSSalesItemModel    `json:"items,omitempty" gorm:"foreignKey:SalesID;constraint:OnDelete:CASCADE"`
+	Tenders                []POSTenderModel       `json:"tenders,omitempty" gorm:"foreignKey:POSID;constraint:OnDelete:CASCADE"`
+	Change                 float64                `json:"change" gorm:"column:change;default:0"`
 	SaleAccountID          *string                `json:"sale_account_id,omitempty" gorm:"column:sale_account_id"`
 	SaleAccount            *AccountModel          `gorm:"foreignKey:SaleAccountID;constraint:OnDelete:CASCADE" json:"sale_account,omitempty"`
 	AssetAccountID         *string                `json:"asset_account_id,omitempty" gorm:"column:asset_account_id"`
@@ -86,10 +88,13 @@ type POSModel struct {
 	CompletedAt            *time.Time             `json:"completed_at,omitempty" gorm:"column:completed_at"`
 	ReturnedAt             *time.Time             `json:"returned_at,omitempty" gorm:"column:returned_at"`
 	RefundedAt             *time.Time             `json:"refunded_at,omitempty" gorm:"column:refunded_at"`
+	RefundedAmount         float64                `json:"refunded_amount" gorm:"column:refunded_amount;default:0"`
 	WithdrawalID           *string                `json:"withdrawal_id,omitempty" gorm:"column:withdrawal_id"`
 	Withdrawal             *WithdrawalModel       `gorm:"foreignKey:WithdrawalID;constraint:OnDelete:CASCADE" json:"withdrawal,omitempty"`
 	TotalDiscount          float64                `json:"total_discount"`
 	CanBeWithdrawed        bool                   `json:"can_be_withdrawed" gorm:"_"`
+	ShiftID                *string                `json:"shift_id,omitempty" gorm:"column:shift_id;size:36;index"`
+	Shift                  *POSShiftModel         `gorm:"foreignKey:ShiftID;constraint:OnDelete:SET NULL" json:"shift,omitempty"`
 }
 
 type POSSalesItemModel struct {
@@ -100,6 +105,7 @@ type POSSalesItemModel struct {
 	Quantity                float64         `json:"quantity,omitempty"`
 	UnitPrice               float64         `json:"unit_price,omitempty"`
 	UnitPriceBeforeDiscount float64         `json:"unit_price_before_discount,omitempty"`
+	PriceListItemID         *string         `gorm:"size:36" json:"price_list_item_id,omitempty"` // aturan daftar harga yang menentukan UnitPrice
 	Total                   float64         `json:"total,omitempty"`
 	DiscountPercent         float64         `json:"discount_percent,omitempty"`
 	DiscountAmount          float64         `json:"discount_amount,omitempty"`
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	POSRefundFull    = "FULL"    // seluruh sisa penjualan dikembalikan
+	POSRefundPartial = "PARTIAL" // sebagian baris atau sebagian jumlah
+)
+
+const (
+	POSRefundMethodProvider    = "PROVIDER"     // dikembalikan lewat penyedia pembayaran asal
+	POSRefundMethodCash        = "CASH"         // dikembalikan tunai dari laci kasir
+	POSRefundMethodStoreCredit = "STORE_CREDIT" // dikembalikan sebagai saldo store credit pelanggan
+)
+
+const (
+	POSRefundPendingApproval = "PENDING_APPROVAL" // menunggu persetujuan manajer
+	POSRefundApproved        = "APPROVED"         // disetujui, dana belum dikembalikan
+	POSRefundCompleted       = "COMPLETED"
+	POSRefundRejected        = "REJECTED"
+	POSRefundFailed          = "FAILED" // gagal di penyedia pembayaran atau saat posting, bisa diproses ulang
+)
+
+// POSRefundModel adalah pengembalian dana (refund) penjualan POS atau pesanan online merchant.
+//
+// Refund di atas batas persetujuan merchant (RefundApprovalLimit) menunggu persetujuan manajer
+// sebelum dana dikembalikan, stok dikembalikan dan jurnal pembalik diposting.
+type POSRefundModel struct {
+	shared.BaseModel
+	Code                     string               `gorm:"type:varchar(50);uniqueIndex" json:"code"`
+	Date                     time.Time            `json:"date"`
+	POSID                    *string              `gorm:"size:36;index" json:"pos_id,omitempty"`
+	POS                      *POSModel            `gorm:"foreignKey:POSID;constraint:OnDelete:CASCADE" json:"pos,omitempty"`
+	MerchantID               *string              `gorm:"size:36;index" json:"merchant_id,omitempty"`
+	Merchant                 *MerchantModel       `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	CompanyID                *string              `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company                  *CompanyModel        `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	ContactID                *string              `gorm:"size:36" json:"contact_id,omitempty"`
+	Contact                  *ContactModel        `gorm:"foreignKey:ContactID;constraint:OnDelete:SET NULL" json:"contact,omitempty"`
+	Type                     string               `gorm:"type:varchar(20)" json:"type"`   // FULL, PARTIAL
+	Method                   string               `gorm:"type:varchar(20)" json:"method"` // PROVIDER, CASH, STORE_CREDIT
+	Amount                   float64              `gorm:"type:decimal(13,2);default:0" json:"amount"`
+	Reason                   string               `json:"reason"`
+	Status                   string               `gorm:"type:varchar(20);index" json:"status"`
+	AccountID                *string              `gorm:"size:36" json:"account_id,omitempty"` // akun sumber dana refund (kas, kliring, atau pendapatan ditangguhkan)
+	Account                  *AccountModel        `gorm:"foreignKey:AccountID;constraint:OnDelete:SET NULL" json:"account,omitempty"`
+	ShiftID                  *string              `gorm:"size:36;index" json:"shift_id,omitempty"` // shift kasir untuk refund tunai
+	Shift                    *POSShiftModel       `gorm:"foreignKey:ShiftID;constraint:OnDelete:SET NULL" json:"shift,omitempty"`
+	PaymentID                *string              `gorm:"size:36" json:"payment_id,omitempty"`
+	ProviderRef              string               `gorm:"type:varchar(255)" json:"provider_ref,omitempty"` // ID refund di penyedia pembayaran
+	ProviderStatus           string               `gorm:"type:varchar(20)" json:"provider_status,omitempty"`
+	StoredValueTransactionID *string              `gorm:"size:36" json:"stored_value_transaction_id,omitempty"`
+	RequestedByID            *string              `gorm:"size:36" json:"requested_by_id,omitempty"`
+	RequestedBy              *UserModel           `gorm:"foreignKey:RequestedByID;constraint:OnDelete:SET NULL" json:"requested_by,omitempty"`
+	ApprovedByID             *string              `gorm:"size:36" json:"approved_by_id,omitempty"`
+	ApprovedBy               *UserModel           `gorm:"foreignKey:ApprovedByID;constraint:OnDelete:SET NULL" json:"approved_by,omitempty"`
+	ApprovedAt               *time.Time           `json:"approved_at,omitempty"`
+	CompletedAt              *time.Time           `json:"completed_at,omitempty"`
+	Notes                    string               `json:"notes"` // alasan penolakan atau kegagalan
+	Items                    []POSRefundItemModel `gorm:"foreignKey:RefundID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
+}
+
+func (POSRefundModel) TableName() string {
+	return "pos_refunds"
+}
+
+func (r *POSRefundModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// POSRefundItemModel adalah baris penjualan yang dikembalikan dalam satu refund.
+type POSRefundItemModel struct {
+	shared.BaseModel
+	RefundID        *string            `gorm:"size:36;index" json:"refund_id"`
+	POSItemID       *string            `gorm:"size:36;index" json:"pos_item_id,omitempty"`
+	POSItem         *POSSalesItemModel `gorm:"foreignKey:POSItemID;constraint:OnDelete:SET NULL" json:"pos_item,omitempty"`
+	Description     string             `json:"description"`
+	ProductID       *string            `gorm:"size:36" json:"product_id,omitempty"`
+	VariantID       *string            `gorm:"size:36" json:"variant_id,omitempty"`
+	WarehouseID     *string            `gorm:"size:36" json:"warehouse_id,omitempty"`
+	Quantity        float64            `json:"quantity"`
+	Amount          float64            `gorm:"type:decimal(13,2);default:0" json:"amount"`
+	Restock         bool               `json:"restock"`                                    // barang kembali ke stok (false untuk barang rusak)
+	StockMovementID *string            `gorm:"size:36" json:"stock_movement_id,omitempty"` // pergerakan stok RETURN saat barang dikembalikan
+}
+
+func (POSRefundItemModel) TableName() string {
+	return "pos_refund_items"
+}
+
+func (r *POSRefundItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type POSShiftEventType string
+
+const (
+	POSShiftCashIn  POSShiftEventType = "CASH_IN"  // Kas masuk ke laci (tambahan modal, dll.)
+	POSShiftCashOut POSShiftEventType = "CASH_OUT" // Kas keluar dari laci (setor, biaya kecil, dll.)
+)
+
+// POSTerminalModel adalah mesin kasir (terminal) milik merchant.
+//
+// CashAccountID adalah akun kas laci kasir; OverShortAccountID adalah akun selisih kas
+// (cash over/short) untuk mencatat selisih saat shift ditutup.
+type POSTerminalModel struct {
+	shared.BaseModel
+	Name               string         `gorm:"type:varchar(255)" json:"name"`
+	Code               string         `gorm:"type:varchar(50)" json:"code"`
+	Description        string         `json:"description"`
+	Status             string         `gorm:"type:varchar(20);default:'ACTIVE'" json:"status"`
+	MerchantID         *string        `gorm:"size:36;index" json:"merchant_id,omitempty"`
+	Merchant           *MerchantModel `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	CompanyID          *string        `gorm:"size:36" json:"company_id,omitempty"`
+	Company            *CompanyModel  `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	CashAccountID      *string        `gorm:"size:36" json:"cash_account_id,omitempty"`
+	CashAccount        *AccountModel  `gorm:"foreignKey:CashAccountID;constraint:OnDelete:SET NULL" json:"cash_account,omitempty"`
+	OverShortAccountID *string        `gorm:"size:36" json:"over_short_account_id,omitempty"`
+	OverShortAccount   *AccountModel  `gorm:"foreignKey:OverShortAccountID;constraint:OnDelete:SET NULL" json:"over_short_account,omitempty"`
+}
+
+func (POSTerminalModel) TableName() string {
+	return "pos_terminals"
+}
+
+func (p *POSTerminalModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// POSShiftModel adalah sesi kasir (shift) pada satu terminal.
+//
+// Kas yang diharapkan (ExpectedCash) adalah modal awal ditambah penjualan tunai dan kas masuk,
+// dikurangi kas keluar dan refund tunai. Selisih (Variance) adalah hasil hitung fisik dikurangi kas yang diharapkan.
+type POSShiftModel struct {
+	shared.BaseModel
+	ShiftNumber           string                   `gorm:"type:varchar(255)" json:"shift_number"`
+	MerchantID            *string                  `gorm:"size:36;index" json:"merchant_id,omitempty"`
+	Merchant              *MerchantModel           `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	TerminalID            *string                  `gorm:"size:36;index" json:"terminal_id,omitempty"`
+	Terminal              *POSTerminalModel        `gorm:"foreignKey:TerminalID;constraint:OnDelete:CASCADE" json:"terminal,omitempty"`
+	CashierID             *string                  `gorm:"size:36" json:"cashier_id,omitempty"`
+	Cashier               *UserModel               `gorm:"foreignKey:CashierID;constraint:OnDelete:SET NULL" json:"cashier,omitempty"`
+	CompanyID             *string                  `gorm:"size:36" json:"company_id,omitempty"`
+	Company               *CompanyModel            `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Status                string                   `gorm:"type:varchar(20);default:'OPEN';index" json:"status"` // OPEN, CLOSED
+	OpenedAt              time.Time                `json:"opened_at"`
+	ClosedAt              *time.Time               `json:"closed_at,omitempty"`
+	ClosedByID            *string                  `gorm:"size:36" json:"closed_by_id,omitempty"`
+	ClosedBy              *UserModel               `gorm:"foreignKey:ClosedByID;constraint:OnDelete:SET NULL" json:"closed_by,omitempty"`
+	OpeningFloat          float64                  `json:"opening_float"`
+	CashIn                float64                  `json:"cash_in"`
+	CashOut               float64                  `json:"cash_out"`
+	ExpectedCash          float64                  `json:"expected_cash"`
+	CountedCash           float64                  `json:"counted_cash"`
+	Variance              float64                  `json:"variance"`
+	Notes                 string                   `gorm:"type:text" json:"notes"`
+	Denominations         []POSShiftDenomination   `gorm:"-" json:"denominations,omitempty"`
+	DenominationData      json.RawMessage          `gorm:"type:JSON;default:'[]'" json:"-"`
+	PaymentSummary        []POSShiftPaymentSummary `gorm:"-" json:"payment_summary,omitempty"`
+	PaymentSummaryData    json.RawMessage          `gorm:"type:JSON;default:'[]'" json:"-"`
+	VarianceTransactionID *string                  `gorm:"size:36" json:"variance_transaction_id,omitempty"`
+	ZReportCount          int                      `gorm:"default:0" json:"z_report_count"`
+	Events                []POSShiftEventModel     `gorm:"foreignKey:ShiftID;constraint:OnDelete:CASCADE" json:"events,omitempty"`
+}
+
+func (POSShiftModel) TableName() string {
+	return "pos_shifts"
+}
+
+func (p *POSShiftModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+func (p *POSShiftModel) BeforeSave(tx *gorm.DB) (err error) {
+	if p.Denominations != nil {
+		b, err := json.Marshal(p.Denominations)
+		if err != nil {
+			return err
+		}
+		p.DenominationData = b
+	}
+	if p.PaymentSummary != nil {
+		b, err := json.Marshal(p.PaymentSummary)
+		if err != nil {
+			return err
+		}
+		p.PaymentSummaryData = b
+	}
+	return
+}
+
+func (p *POSShiftModel) AfterFind(tx *gorm.DB) (err error) {
+	if len(p.DenominationData) > 0 {
+		json.Unmarshal(p.DenominationData, &p.Denominations)
+	}
+	if len(p.PaymentSummaryData) > 0 {
+		json.Unmarshal(p.PaymentSummaryData, &p.PaymentSummary)
+	}
+	return
+}
+
+// POSShiftDenomination adalah hasil hitung fisik satu pecahan uang saat shift ditutup
+type POSShiftDenomination struct {
+	Value float64 `json:"value"`
+	Count int     `json:"count"`
+	Total float64 `json:"total"`
+}
+
+// POSShiftPaymentSummary adalah rekap per metode pembayaran dalam satu shift.
+//
+// Counted dan Variance hanya terisi saat shift ditutup; untuk metode tunai Expected
+// sudah termasuk modal awal, kas masuk/keluar dan refund tunai.
+type POSShiftPaymentSummary struct {
+	PaymentMethod string  `json:"payment_method"`
+	Count         int     `json:"count"`
+	Amount        float64 `json:"amount"`
+	Expected      float64 `json:"expected"`
+	Refund        float64 `json:"refund"` // refund tunai yang dibayar dari laci selama shift
+	Counted       float64 `json:"counted"`
+	Variance      float64 `json:"variance"`
+}
+
+// POSShiftEventModel adalah kas masuk atau kas keluar laci kasir selama shift
+type POSShiftEventModel struct {
+	shared.BaseModel
+	ShiftID   string            `gorm:"type:char(36);index" json:"shift_id"`
+	Shift     *POSShiftModel    `gorm:"foreignKey:ShiftID;constraint:OnDelete:CASCADE" json:"shift,omitempty"`
+	Date      time.Time         `json:"date"`
+	Type      POSShiftEventType `gorm:"type:varchar(20)" json:"type"`
+	Amount    float64           `json:"amount"`
+	Reason    string            `json:"reason"`
+	AccountID *string           `gorm:"size:36" json:"account_id,omitempty"` // akun lawan (opsional), mis. kas besar atau biaya
+	Account   *AccountModel     `gorm:"foreignKey:AccountID;constraint:OnDelete:SET NULL" json:"account,omitempty"`
+	UserID    *string           `gorm:"size:36" json:"user_id,omitempty"`
+	User      *UserModel        `gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL" json:"user,omitempty"`
+}
+
+func (POSShiftEventModel) TableName() string {
+	return "pos_shift_events"
+}
+
+func (p *POSShiftEventModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type POSSyncStatus string
+
+const (
+	POSSyncApplied             POSSyncStatus = "APPLIED"               // Transaksi berhasil diproses
+	POSSyncAppliedWithConflict POSSyncStatus = "APPLIED_WITH_CONFLICT" // Transaksi diproses meskipun stok tidak mencukupi
+	POSSyncDuplicate           POSSyncStatus = "DUPLICATE"             // Idempotency key sudah pernah diproses
+	POSSyncRejected            POSSyncStatus = "REJECTED"              // Transaksi ditolak (data tidak valid atau konflik stok)
+)
+
+type POSSyncConflictPolicy string
+
+const (
+	POSSyncConflictAccept POSSyncConflictPolicy = "ACCEPT" // Penjualan offline tetap dicatat, stok boleh minus, konflik ditandai
+	POSSyncConflictReject POSSyncConflictPolicy = "REJECT" // Penjualan offline ditolak bila stok tidak mencukupi
+)
+
+// POSSyncLogModel adalah catatan setiap transaksi offline yang diunggah terminal.
+//
+// IdempotencyKey unik per merchant sehingga unggahan ulang transaksi yang sama tidak
+// membuat penjualan ganda; hasil unggahan pertama dikembalikan kembali.
+type POSSyncLogModel struct {
+	shared.BaseModel
+	MerchantID      *string           `gorm:"size:36;uniqueIndex:idx_pos_sync_idempotency" json:"merchant_id,omitempty"`
+	Merchant        *MerchantModel    `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	TerminalID      *string           `gorm:"size:36;index" json:"terminal_id,omitempty"`
+	Terminal        *POSTerminalModel `gorm:"foreignKey:TerminalID;constraint:OnDelete:SET NULL" json:"terminal,omitempty"`
+	IdempotencyKey  string            `gorm:"type:varchar(255);uniqueIndex:idx_pos_sync_idempotency" json:"idempotency_key"`
+	ClientID        string            `gorm:"type:varchar(255);index" json:"client_id"`
+	Sequence        int64             `json:"sequence"`
+	ClientCreatedAt time.Time         `json:"client_created_at"`
+	SyncedAt        time.Time         `json:"synced_at"`
+	Status          POSSyncStatus     `gorm:"type:varchar(30);index" json:"status"`
+	Message         string            `json:"message"`
+	POSID           *string           `gorm:"size:36;index" json:"pos_id,omitempty"`
+	POS             *POSModel         `gorm:"foreignKey:POSID;constraint:OnDelete:SET NULL" json:"pos,omitempty"`
+	UserID          *string           `gorm:"size:36" json:"user_id,omitempty"`
+	Conflicts       []POSSyncConflict `gorm:"-" json:"conflicts,omitempty"`
+	ConflictData    json.RawMessage   `gorm:"type:JSON;default:'[]'" json:"-"`
+	Payload         json.RawMessage   `gorm:"type:JSON;default:'{}'" json:"payload,omitempty"`
+}
+
+func (POSSyncLogModel) TableName() string {
+	return "pos_sync_logs"
+}
+
+func (p *POSSyncLogModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+func (p *POSSyncLogModel) BeforeSave(tx *gorm.DB) (err error) {
+	if p.Conflicts != nil {
+		b, err := json.Marshal(p.Conflicts)
+		if err != nil {
+			return err
+		}
+		p.ConflictData = b
+	}
+	return
+}
+
+func (p *POSSyncLogModel) AfterFind(tx *gorm.DB) (err error) {
+	if len(p.ConflictData) > 0 {
+		json.Unmarshal(p.ConflictData, &p.Conflicts)
+	}
+	return
+}
+
+// POSSyncStateModel adalah posisi sinkronisasi terakhir sebuah terminal
+type POSSyncStateModel struct {
+	shared.BaseModel
+	MerchantID     *string           `gorm:"size:36;index" json:"merchant_id,omitempty"`
+	TerminalID     string            `gorm:"size:36;uniqueIndex" json:"terminal_id"`
+	Terminal       *POSTerminalModel `gorm:"foreignKey:TerminalID;constraint:OnDelete:CASCADE" json:"terminal,omitempty"`
+	LastCursor     string            `gorm:"type:varchar(50)" json:"last_cursor"`
+	LastSequence   int64             `json:"last_sequence"`
+	LastSnapshotAt *time.Time        `json:"last_snapshot_at,omitempty"`
+	LastUploadAt   *time.Time        `json:"last_upload_at,omitempty"`
+}
+
+func (POSSyncStateModel) TableName() string {
+	return "pos_sync_states"
+}
+
+func (p *POSSyncStateModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// POSSyncTransaction adalah transaksi POS yang dibuat terminal saat offline.
+//
+// ClientID adalah ID yang dibuat terminal; bila berupa UUID, ID tersebut dipakai sebagai ID
+// penjualan di server. Sequence menentukan urutan pemrosesan. SaleAccountID dan AssetAccountID
+// adalah akun jurnal penjualan, sama seperti penjualan POS online.
+type POSSyncTransaction struct {
+	ClientID            string              `json:"client_id"`
+	IdempotencyKey      string              `json:"idempotency_key"`
+	Sequence            int64               `json:"sequence"`
+	CreatedAt           time.Time           `json:"created_at"`
+	SalesNumber         string              `json:"sales_number"`
+	ContactID           *string             `json:"contact_id,omitempty"`
+	ContactData         json.RawMessage     `json:"contact_data,omitempty"`
+	ShiftID             *string             `json:"shift_id,omitempty"`
+	Description         string              `json:"description"`
+	Notes               string              `json:"notes"`
+	PaymentType         string              `json:"payment_type"`
+	PaymentProviderType PaymentProviderType `json:"payment_provider_type"`
+	Paid                float64             `json:"paid"`
+	Tax                 float64             `json:"tax"`
+	TaxType             string              `json:"tax_type"`
+	TaxAmount           float64             `json:"tax_amount"`
+	ServiceFee          float64             `json:"service_fee"`
+	SaleAccountID       *string             `json:"sale_account_id,omitempty"`
+	AssetAccountID      *string             `json:"asset_account_id,omitempty"`
+	Items               []POSSyncItem       `json:"items"`
+}
+
+// POSSyncItem adalah baris penjualan dari transaksi offline
+type POSSyncItem struct {
+	ProductID       string  `json:"product_id"`
+	VariantID       *string `json:"variant_id,omitempty"`
+	Description     string  `json:"description"`
+	Quantity        float64 `json:"quantity"`
+	UnitPrice       float64 `json:"unit_price"`
+	DiscountPercent float64 `json:"discount_percent"`
+	DiscountAmount  float64 `json:"discount_amount"`
+}
+
+// POSSyncConflict adalah kekurangan stok yang ditemukan saat transaksi offline diproses
+type POSSyncConflict struct {
+	ProductID string  `json:"product_id"`
+	VariantID *string `json:"variant_id,omitempty"`
+	Requested float64 `json:"requested"`
+	Available float64 `json:"available"`
+	Shortage  float64 `json:"shortage"`
+}
+
+// POSSyncResult adalah hasil pemrosesan satu transaksi offline
+type POSSyncResult struct {
+	ClientID       string            `json:"client_id"`
+	IdempotencyKey string            `json:"idempotency_key"`
+	Sequence       int64             `json:"sequence"`
+	Status         POSSyncStatus     `json:"status"`
+	Message        string            `json:"message,omitempty"`
+	POSID          *string           `json:"pos_id,omitempty"`
+	SalesNumber    string            `json:"sales_number,omitempty"`
+	Conflicts      []POSSyncConflict `json:"conflicts,omitempty"`
+}
+
+// POSSyncStock adalah posisi stok produk di gudang default merchant
+type POSSyncStock struct {
+	ProductID string  `json:"product_id"`
+	VariantID *string `json:"variant_id,omitempty"`
+	OnHand    float64 `json:"on_hand"`
+	Reserved  float64 `json:"reserved"`
+	Available float64 `json:"available"`
+}
+
+// POSSyncProduct adalah produk yang dijual merchant beserta harga merchant
+type POSSyncProduct struct {
+	ProductModel
+	MerchantPrice     float64 `json:"merchant_price"`
+	AdjustmentPrice   float64 `json:"adjustment_price"`
+	MerchantStationID *string `json:"merchant_station_id,omitempty"`
+}
+
+// POSSyncSnapshot adalah data master yang diunduh terminal untuk bekerja offline.
+//
+// Version adalah cursor yang dipakai terminal pada unggahan atau delta berikutnya.
+type POSSyncSnapshot struct {
+	Version     string            `json:"version"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	Merchant    *MerchantModel    `json:"merchant"`
+	Products    []POSSyncProduct  `json:"products"`
+	Prices      []PriceModel      `json:"prices"`
+	Promotions  []PromotionModel  `json:"promotions"`
+	Desks       []MerchantDesk    `json:"desks"`
+	Stations    []MerchantStation `json:"stations"`
+	Stocks      []POSSyncStock    `json:"stocks"`
+}
+
+// POSSyncDelta adalah perubahan data master sejak cursor terakhir terminal.
+//
+// Deleted berisi ID yang dihapus per jenis data (products, prices, promotions, desks, stations).
+// ProductIDs berisi seluruh ID produk merchant saat ini sehingga terminal dapat membuang produk
+// yang sudah tidak dijual merchant.
+type POSSyncDelta struct {
+	Since      string              `json:"since"`
+	Version    string              `json:"version"`
+	ProductIDs []string            `json:"product_ids"`
+	Products   []POSSyncProduct    `json:"products"`
+	Prices     []PriceModel        `json:"prices"`
+	Promotions []PromotionModel    `json:"promotions"`
+	Desks      []MerchantDesk      `json:"desks"`
+	Stations   []MerchantStation   `json:"stations"`
+	Stocks     []POSSyncStock      `json:"stocks"`
+	Deleted    map[string][]string `json:"deleted"`
+}
+
+// POSSyncUploadResponse adalah respon unggahan transaksi offline
+type POSSyncUploadResponse struct {
+	Results []POSSyncResult `json:"results"`
+	Delta   *POSSyncDelta   `json:"delta"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	POSTenderCash         = "CASH" // satu-satunya metode yang boleh memberi kembalian
+	POSTenderCard         = "CARD"
+	POSTenderQRIS         = "QRIS"
+	POSTenderEWallet      = "E_WALLET"
+	POSTenderBankTransfer = "BANK_TRANSFER"
+	POSTenderVoucher      = "VOUCHER" // voucher atau gift card (Code/Pin), ditukar saat penjualan disimpan; ProviderRef berisi ID transaksi penukarannya
+	POSTenderPoints       = "POINTS"  // poin loyalitas, ditukar saat penjualan disimpan; ProviderRef berisi ID ledger penukarannya
+)
+
+// POSTenderModel adalah satu pembayaran (tender) dari penjualan POS yang dibayar dengan beberapa
+// metode, mis. sebagian tunai dan sebagian QRIS.
+//
+// Amount adalah uang yang diterima dari pelanggan; kembalian (Change) hanya ada pada tender tunai,
+// sehingga nilai yang masuk ke akun tender adalah Amount - Change.
+type POSTenderModel struct {
+	shared.BaseModel
+	POSID       string              `gorm:"size:36;index" json:"pos_id"`
+	Method      string              `gorm:"type:varchar(30)" json:"method"`                  // CASH, CARD, QRIS, E_WALLET, BANK_TRANSFER, VOUCHER, POINTS
+	Provider    PaymentProviderType `gorm:"type:varchar(30)" json:"provider,omitempty"`      // mis. BCA, GOPAY
+	ProviderRef string              `gorm:"type:varchar(255)" json:"provider_ref,omitempty"` // nomor approval EDC, referensi QRIS, dsb.
+	Amount      float64             `gorm:"type:decimal(13,2);default:0" json:"amount"`      // diterima dari pelanggan
+	Change      float64             `gorm:"type:decimal(13,2);default:0" json:"change"`      // kembalian, hanya tunai
+	AccountID   *string             `gorm:"size:36" json:"account_id,omitempty"`             // akun kas/bank tujuan, kosong memakai akun aset penjualan
+	Account     *AccountModel       `gorm:"foreignKey:AccountID;constraint:OnDelete:SET NULL" json:"account,omitempty"`
+	ShiftID     *string             `gorm:"size:36;index" json:"shift_id,omitempty"`
+	Notes       string              `json:"notes,omitempty"`
+	Code        string              `gorm:"-" json:"code,omitempty"` // kode voucher/gift card yang ditukar, tidak disimpan
+	Pin         string              `gorm:"-" json:"pin,omitempty"`  // PIN voucher/gift card, tidak disimpan
+}
+
+func (POSTenderModel) TableName() string {
+	return "pos_tenders"
+}
+
+func (m *POSTenderModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
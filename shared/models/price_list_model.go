@@ -0,0 +1,143 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	PriceListAssignContact       = "CONTACT"
+	PriceListAssignCustomerGroup = "CUSTOMER_GROUP"
+	PriceListAssignMerchant      = "MERCHANT"
+	PriceListAssignChannel       = "CHANNEL"
+)
+
+// Kanal penjualan yang dipakai saat menentukan harga.
+const (
+	PriceChannelPOS      = "POS"      // kasir
+	PriceChannelOnline   = "ONLINE"   // keranjang belanja online
+	PriceChannelSales    = "SALES"    // dokumen penjualan (penawaran, pesanan, faktur)
+	PriceChannelOffering = "OFFERING" // penawaran merchant atas order request
+)
+
+const (
+	PriceListItemFixed    = "FIXED"     // harga tetap
+	PriceListItemCostPlus = "COST_PLUS" // harga pokok (standard cost) + persen markup
+	PriceListItemDiscount = "DISCOUNT"  // harga dasar - persen diskon
+	PriceListItemTiered   = "TIERED"    // harga menurut jumlah pembelian
+)
+
+// PriceListModel adalah daftar harga khusus. Daftar harga tanpa penugasan berlaku untuk semua
+// transaksi perusahaan; bila ada penugasan, daftar harga hanya berlaku jika salah satunya cocok
+// dengan pelanggan, kelompok pelanggan, merchant atau kanal penjualan.
+//
+// Jika beberapa daftar harga berlaku, yang menang adalah yang paling spesifik (kontak, lalu
+// kelompok pelanggan, merchant, kanal, umum), kemudian prioritas tertinggi.
+type PriceListModel struct {
+	shared.BaseModel
+	Name        string                     `gorm:"type:varchar(255);not null" json:"name"`
+	Code        string                     `gorm:"type:varchar(50)" json:"code,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	CompanyID   *string                    `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company     *CompanyModel              `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Priority    int                        `gorm:"default:0" json:"priority"`
+	StartDate   *time.Time                 `json:"start_date,omitempty"`
+	EndDate     *time.Time                 `json:"end_date,omitempty"`
+	IsActive    bool                       `gorm:"default:true" json:"is_active"`
+	Assignments []PriceListAssignmentModel `gorm:"foreignKey:PriceListID;constraint:OnDelete:CASCADE" json:"assignments,omitempty"`
+	Items       []PriceListItemModel       `gorm:"foreignKey:PriceListID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
+}
+
+func (PriceListModel) TableName() string {
+	return "price_lists"
+}
+
+func (m *PriceListModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PriceListAssignmentModel menugaskan daftar harga ke kontak, kelompok pelanggan, merchant
+// (ReferenceID) atau kanal penjualan (Channel).
+type PriceListAssignmentModel struct {
+	shared.BaseModel
+	PriceListID *string `gorm:"size:36;index" json:"price_list_id"`
+	Type        string  `gorm:"type:varchar(20);index" json:"type"`
+	ReferenceID *string `gorm:"size:36;index" json:"reference_id,omitempty"`
+	Channel     string  `gorm:"type:varchar(20)" json:"channel,omitempty"`
+}
+
+func (PriceListAssignmentModel) TableName() string {
+	return "price_list_assignments"
+}
+
+func (m *PriceListAssignmentModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PriceListTier adalah satu tingkat harga: harga per unit mulai dari MinQuantity.
+type PriceListTier struct {
+	MinQuantity float64 `json:"min_quantity"`
+	Price       float64 `json:"price"`
+}
+
+// PriceListItemModel adalah satu aturan harga dalam daftar harga untuk varian, produk atau
+// kategori produk. Aturan varian lebih spesifik dari aturan produk, dan aturan produk lebih
+// spesifik dari aturan kategori.
+type PriceListItemModel struct {
+	shared.BaseModel
+	PriceListID *string               `gorm:"size:36;index" json:"price_list_id"`
+	PriceList   *PriceListModel       `gorm:"foreignKey:PriceListID;constraint:OnDelete:CASCADE" json:"price_list,omitempty"`
+	ProductID   *string               `gorm:"size:36;index" json:"product_id,omitempty"`
+	Product     *ProductModel         `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID   *string               `gorm:"size:36;index" json:"variant_id,omitempty"`
+	Variant     *VariantModel         `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE" json:"variant,omitempty"`
+	CategoryID  *string               `gorm:"size:36;index" json:"category_id,omitempty"`
+	Category    *ProductCategoryModel `gorm:"foreignKey:CategoryID;constraint:OnDelete:CASCADE" json:"category,omitempty"`
+	Method      string                `gorm:"type:varchar(20);default:FIXED" json:"method"`
+	Value       float64               `json:"value"`        // harga (FIXED) atau persen (COST_PLUS, DISCOUNT)
+	MinQuantity float64               `json:"min_quantity"` // aturan hanya berlaku mulai jumlah ini
+	Tiers       []PriceListTier       `gorm:"-" json:"tiers,omitempty"`
+	TierData    json.RawMessage       `gorm:"type:JSON;default:'[]'" json:"-"`
+	StartDate   *time.Time            `json:"start_date,omitempty"`
+	EndDate     *time.Time            `json:"end_date,omitempty"`
+	Notes       string                `json:"notes,omitempty"`
+}
+
+func (PriceListItemModel) TableName() string {
+	return "price_list_items"
+}
+
+func (m *PriceListItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+func (m *PriceListItemModel) BeforeSave(tx *gorm.DB) (err error) {
+	if m.Tiers != nil {
+		b, err := json.Marshal(m.Tiers)
+		if err != nil {
+			return err
+		}
+		m.TierData = b
+	}
+	return
+}
+
+func (m *PriceListItemModel) AfterFind(tx *gorm.DB) (err error) {
+	if len(m.TierData) > 0 {
+		json.Unmarshal(m.TierData, &m.Tiers)
+	}
+	return
+}
@@ -18,6 +18,8 @@ type ProductModel struct {
 	SKU               *string                `gorm:"type:varchar(255)" json:"sku,omitempty"`
 	Barcode           *string                `gorm:"type:varchar(255)" json:"barcode,omitempty"`
 	Price             float64                `gorm:"not null;default:0" json:"price,omitempty"`
+	StandardCost      float64                `gorm:"default:0" json:"standard_cost,omitempty"`
+	AverageCost       float64                `gorm:"default:0" json:"average_cost,omitempty"` // harga pokok rata-rata per satuan dasar stok milik sendiri, termasuk landed cost
 	CompanyID         *string                `json:"company_id,omitempty"`
 	Company           *CompanyModel          `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
 	DistributorID     *string                `gorm:"foreignKey:DistributorID;references:ID;constraint:OnDelete:CASCADE" json:"distributor_id,omitempty"`
@@ -31,6 +33,8 @@ type ProductModel struct {
 	BrandID           *string                `json:"brand_id,omitempty"`
 	ProductImages     []FileModel            `gorm:"-" json:"product_images,omitempty"`
 	TotalStock        float64                `gorm:"-" json:"total_stock,omitempty"`
+	ReservedStock     float64                `gorm:"-" json:"reserved_stock,omitempty"`
+	AvailableStock    float64                `gorm:"-" json:"available_stock,omitempty"` // stok fisik dikurangi reservasi aktif
 	SalesCount        float64                `gorm:"-" json:"sales_count,omitempty"`
 	LastUpdatedStock  *time.Time             `gorm:"-" json:"last_updated_stock,omitempty"`
 	LastStock         float64                `gorm:"-" json:"last_stock,omitempty"`
@@ -172,6 +176,7 @@ type ProductMerchant struct {
 	Price             float64    `gorm:"column:price" json:"price"`
 	AdjustmentPrice   float64    `gorm:"column:adjustment_price;default:0" json:"adjustment_price"`
 	MerchantStationID *string    `gorm:"column:merchant_station_id" json:"merchant_station_id"`
+	PrepMinutes       int        `gorm:"column:prep_minutes;default:0" json:"prep_minutes"` // target waktu persiapan, 0 = ikut target station
 }
 
 func (v *ProductModel) GenerateDisplayName(tx *gorm.DB) {
@@ -21,6 +21,8 @@ type VariantModel struct {
 	Attributes       []VariantProductAttributeModel `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE" json:"attributes,omitempty"`
 	DisplayName      string                         `gorm:"type:varchar(255)" json:"display_name,omitempty"`
 	TotalStock       float64                        `gorm:"-" json:"total_stock,omitempty"`
+	ReservedStock    float64                        `gorm:"-" json:"reserved_stock,omitempty"`
+	AvailableStock   float64                        `gorm:"-" json:"available_stock,omitempty"`
 	SalesCount       float64                        `gorm:"-" json:"sales_count,omitempty"`
 	Tags             []*TagModel                    `gorm:"many2many:variant_tags;constraint:OnDelete:CASCADE;" json:"tags,omitempty"`
 	PriceList        []float64                      `gorm:"-" json:"price_list,omitempty"`
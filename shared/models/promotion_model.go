@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"strings"
 	"time"
 
@@ -21,6 +22,18 @@ type PromotionModel struct {
 	Rules       []PromotionRuleModel   `gorm:"foreignKey:PromotionID;constraint:OnDelete:CASCADE" json:"rules,omitempty"`
 	Actions     []PromotionActionModel `gorm:"foreignKey:PromotionID;constraint:OnDelete:CASCADE" json:"actions,omitempty"`
 	IsEligible  bool                   `gorm:"-" json:"is_eligible,omitempty"`
+	// Kode promosi umum (boleh dipakai berulang); kode sekali pakai ada di PromotionVoucherModel
+	Code      string  `gorm:"type:varchar(50);index" json:"code,omitempty"`
+	CompanyID *string `gorm:"size:36;index" json:"company_id,omitempty"`
+	// Priority menentukan urutan penerapan; nilai lebih besar diterapkan lebih dulu
+	Priority int `gorm:"default:0" json:"priority"`
+	// Exclusive berarti promosi tidak dapat digabung dengan promosi lain
+	Exclusive bool `gorm:"default:false" json:"exclusive"`
+	// RequireVoucher berarti promosi hanya berlaku bila pelanggan memasukkan kode
+	RequireVoucher        bool `gorm:"default:false" json:"require_voucher"`
+	UsageLimit            int  `gorm:"default:0" json:"usage_limit"`              // 0 = tanpa batas
+	UsageLimitPerCustomer int  `gorm:"default:0" json:"usage_limit_per_customer"` // 0 = tanpa batas
+	UsageCount            int  `gorm:"default:0" json:"usage_count"`
 }
 
 func (PromotionModel) TableName() string {
@@ -70,8 +83,8 @@ type PromotionActionModel struct {
 	shared.BaseModel
 	PromotionID string         `gorm:"type:char(36);not null;index" json:"promotion_id,omitempty"`
 	Promotion   PromotionModel `gorm:"foreignKey:PromotionID;constraint:OnDelete:CASCADE" json:"promotion,omitempty"`
-	ActionType  string         `gorm:"type:varchar(50);not null" json:"action_type,omitempty"` // discount, free_shipping, free_item
-	ActionValue string         `gorm:"not null" json:"action_value,omitempty"`                 // Bisa angka (persentase atau nominal) atau item ID untuk free item
+	ActionType  string         `gorm:"type:varchar(50);not null" json:"action_type,omitempty"` // discount, free_shipping, free_item, buy_x_get_y, bundle_price, tiered_discount
+	ActionValue string         `gorm:"not null" json:"action_value,omitempty"`                 // Bisa angka (persentase atau nominal), item ID untuk free item, atau JSON untuk buy_x_get_y, bundle_price dan tiered_discount
 	// MinOrderQty int    `gorm:"default:0"`                 // Minimal jumlah item yang harus dibeli (untuk Buy 1 Get 1)
 }
 
@@ -92,3 +105,122 @@ func (b *PromotionModel) AfterFind(tx *gorm.DB) (err error) {
 	b.Images = images
 	return err
 }
+
+// PromotionBuyXGetY adalah nilai aksi BUY_X_GET_Y dalam format JSON.
+//
+// Dari setiap kelompok BuyQuantity + GetQuantity unit produk yang memenuhi syarat, GetQuantity
+// unit termurah mendapat potongan DiscountPercent (default 100 = gratis). ProductIDs membatasi
+// produk yang dihitung; bila kosong dipakai produk dari aturan PRODUCTS/CATEGORIES.
+type PromotionBuyXGetY struct {
+	BuyQuantity     int      `json:"buy_quantity"`
+	GetQuantity     int      `json:"get_quantity"`
+	DiscountPercent float64  `json:"discount_percent"`
+	ProductIDs      []string `json:"product_ids,omitempty"`
+}
+
+// PromotionBundle adalah nilai aksi BUNDLE_PRICE dalam format JSON: paket produk dengan harga tetap
+type PromotionBundle struct {
+	Items []PromotionBundleItem `json:"items"`
+	Price float64               `json:"price"`
+}
+
+type PromotionBundleItem struct {
+	ProductID string  `json:"product_id"`
+	Quantity  float64 `json:"quantity"`
+}
+
+// PromotionTier adalah satu tingkat aksi TIERED_DISCOUNT (nilai aksi berupa array JSON).
+//
+// Tingkat dengan MinSpend tertinggi yang terpenuhi yang berlaku; potongan berupa persen atau nominal.
+type PromotionTier struct {
+	MinSpend        float64 `json:"min_spend"`
+	DiscountPercent float64 `json:"discount_percent"`
+	DiscountAmount  float64 `json:"discount_amount"`
+}
+
+// ParseBuyXGetY membaca nilai aksi BUY_X_GET_Y
+func (p PromotionActionModel) ParseBuyXGetY() (*PromotionBuyXGetY, error) {
+	var data PromotionBuyXGetY
+	if err := json.Unmarshal([]byte(p.ActionValue), &data); err != nil {
+		return nil, err
+	}
+	if data.DiscountPercent == 0 {
+		data.DiscountPercent = 100
+	}
+	return &data, nil
+}
+
+// ParseBundle membaca nilai aksi BUNDLE_PRICE
+func (p PromotionActionModel) ParseBundle() (*PromotionBundle, error) {
+	var data PromotionBundle
+	if err := json.Unmarshal([]byte(p.ActionValue), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// ParseTiers membaca nilai aksi TIERED_DISCOUNT
+func (p PromotionActionModel) ParseTiers() ([]PromotionTier, error) {
+	var data []PromotionTier
+	if err := json.Unmarshal([]byte(p.ActionValue), &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// PromotionVoucherModel adalah kode voucher unik sekali pakai milik sebuah promosi
+type PromotionVoucherModel struct {
+	shared.BaseModel
+	PromotionID   string          `gorm:"type:char(36);not null;index" json:"promotion_id,omitempty"`
+	Promotion     *PromotionModel `gorm:"foreignKey:PromotionID;constraint:OnDelete:CASCADE" json:"promotion,omitempty"`
+	Code          string          `gorm:"type:varchar(50);uniqueIndex;not null" json:"code"`
+	BatchID       string          `gorm:"type:char(36);index" json:"batch_id"`
+	Status        string          `gorm:"type:varchar(20);default:'AVAILABLE';index" json:"status"` // AVAILABLE, REDEEMED, VOID
+	ExpiresAt     *time.Time      `json:"expires_at,omitempty"`
+	RedeemedAt    *time.Time      `json:"redeemed_at,omitempty"`
+	ContactID     *string         `gorm:"size:36" json:"contact_id,omitempty"` // pelanggan yang memakai voucher
+	Contact       *ContactModel   `gorm:"foreignKey:ContactID;constraint:OnDelete:SET NULL" json:"contact,omitempty"`
+	ReferenceID   *string         `gorm:"size:36" json:"reference_id,omitempty"`
+	ReferenceType string          `gorm:"type:varchar(50)" json:"reference_type,omitempty"`
+	CompanyID     *string         `gorm:"size:36;index" json:"company_id,omitempty"`
+}
+
+func (PromotionVoucherModel) TableName() string {
+	return "promotion_vouchers"
+}
+
+func (p *PromotionVoucherModel) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == "" {
+		p.ID = uuid.New().String()
+	}
+	return nil
+}
+
+// PromotionUsageModel adalah catatan pemakaian promosi pada sebuah transaksi,
+// dipakai untuk membatasi pemakaian global dan per pelanggan
+type PromotionUsageModel struct {
+	shared.BaseModel
+	PromotionID    string                 `gorm:"type:char(36);not null;index" json:"promotion_id"`
+	Promotion      *PromotionModel        `gorm:"foreignKey:PromotionID;constraint:OnDelete:CASCADE" json:"promotion,omitempty"`
+	VoucherID      *string                `gorm:"size:36" json:"voucher_id,omitempty"`
+	Voucher        *PromotionVoucherModel `gorm:"foreignKey:VoucherID;constraint:OnDelete:SET NULL" json:"voucher,omitempty"`
+	ContactID      *string                `gorm:"size:36;index" json:"contact_id,omitempty"`
+	UserID         *string                `gorm:"size:36" json:"user_id,omitempty"`
+	Date           time.Time              `json:"date"`
+	DiscountAmount float64                `json:"discount_amount"`
+	ReferenceID    string                 `gorm:"type:char(36);index" json:"reference_id"`
+	ReferenceType  string                 `gorm:"type:varchar(50)" json:"reference_type"`                 // pos, sales, merchant_order, cart
+	Status         string                 `gorm:"type:varchar(20);default:'APPLIED';index" json:"status"` // APPLIED, REVERSED
+	ReversedAt     *time.Time             `json:"reversed_at,omitempty"`
+}
+
+func (PromotionUsageModel) TableName() string {
+	return "promotion_usages"
+}
+
+func (p *PromotionUsageModel) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == "" {
+		p.ID = uuid.New().String()
+	}
+	return nil
+}
@@ -41,6 +41,7 @@ type PurchaseOrderModel struct {
 	PurchaseDate          time.Time                `json:"purchase_date,omitempty"`
 	DueDate               *time.Time               `json:"due_date,omitempty"`
 	DiscountDueDate       *time.Time               `json:"discount_due_date,omitempty"`
+	ExpectedDeliveryDate  *time.Time               `json:"expected_delivery_date,omitempty"`
 	PaymentAccountID      *string                  `json:"payment_account_id,omitempty"`
 	PaymentAccount        *AccountModel            `json:"payment_account,omitempty" gorm:"foreignKey:PaymentAccountID;constraint:OnDelete:CASCADE"`
 	PaymentDiscountAmount float64                  `json:"payment_discount_amount,omitempty"`
@@ -76,6 +77,9 @@ type PurchaseOrderModel struct {
 	MemberID              *string                  `json:"member_id,omitempty" gorm:"size:36"`
 	CooperativeMember     *CooperativeMemberModel  `json:"cooperative_member,omitempty" gorm:"-"`
 	Member                *MemberModel             `json:"member,omitempty" gorm:"-"`
+	MatchStatus           PurchaseMatchStatus      `json:"match_status,omitempty" gorm:"type:varchar(50)"`
+	PaymentHold           bool                     `json:"payment_hold,omitempty" gorm:"default:false"`
+	PaymentHoldReason     string                   `json:"payment_hold_reason,omitempty"`
 }
 
 func (s *PurchaseOrderModel) TableName() string {
@@ -131,6 +135,9 @@ type PurchaseOrderItemModel struct {
 	Unit               *UnitModel          `gorm:"foreignKey:UnitID;constraint:OnDelete:CASCADE" json:"unit,omitempty"`
 	UnitValue          float64             `json:"unit_value,omitempty" gorm:"default:1"`
 	IsCost             bool                `json:"is_cost,omitempty" gorm:"default:false"`
+	RefItemID          *string             `json:"ref_item_id,omitempty" gorm:"size:36"` // baris purchase order yang ditagih (khusus BILL)
+	ReceivedQuantity   float64             `json:"received_quantity,omitempty" gorm:"default:0"`
+	BilledQuantity     float64             `json:"billed_quantity,omitempty" gorm:"default:0"`
 }
 
 func (s *PurchaseOrderItemModel) TableName() string {
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type PurchaseRequisitionStatus string
+
+const (
+	RequisitionStatusDraft     PurchaseRequisitionStatus = "DRAFT"
+	RequisitionStatusSubmitted PurchaseRequisitionStatus = "SUBMITTED"
+	RequisitionStatusApproved  PurchaseRequisitionStatus = "APPROVED"
+	RequisitionStatusRejected  PurchaseRequisitionStatus = "REJECTED"
+	RequisitionStatusConverted PurchaseRequisitionStatus = "CONVERTED"
+	RequisitionStatusCancelled PurchaseRequisitionStatus = "CANCELLED"
+)
+
+// PurchaseRequisitionModel adalah permintaan pembelian dari karyawan atau departemen
+// sebelum dibuatkan purchase order
+type PurchaseRequisitionModel struct {
+	shared.BaseModel
+	RequisitionNumber string                             `gorm:"type:varchar(255)" json:"requisition_number"`
+	Date              time.Time                          `json:"date"`
+	RequiredDate      *time.Time                         `json:"required_date,omitempty"`
+	Description       string                             `json:"description"`
+	Notes             string                             `gorm:"type:text" json:"notes"`
+	Total             float64                            `json:"total"`
+	ApprovedTotal     float64                            `json:"approved_total"`
+	Status            PurchaseRequisitionStatus          `gorm:"type:varchar(50);default:'DRAFT'" json:"status"`
+	ApprovalLevel     int                                `gorm:"default:0" json:"approval_level"` // level terakhir yang sudah disetujui
+	ApprovedAt        *time.Time                         `json:"approved_at,omitempty"`
+	EmployeeID        *string                            `gorm:"size:36" json:"employee_id,omitempty"`
+	Employee          *EmployeeModel                     `gorm:"foreignKey:EmployeeID;constraint:OnDelete:SET NULL" json:"employee,omitempty"`
+	OrganizationID    *string                            `gorm:"size:36" json:"organization_id,omitempty"` // departemen peminta
+	Organization      *OrganizationModel                 `gorm:"foreignKey:OrganizationID;constraint:OnDelete:SET NULL" json:"organization,omitempty"`
+	BranchID          *string                            `gorm:"size:36" json:"branch_id,omitempty"`
+	Branch            *BranchModel                       `gorm:"foreignKey:BranchID;constraint:OnDelete:SET NULL" json:"branch,omitempty"`
+	UserID            *string                            `gorm:"size:36" json:"user_id,omitempty"`
+	User              *UserModel                         `gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL" json:"user,omitempty"`
+	CompanyID         *string                            `json:"company_id,omitempty"`
+	Company           *CompanyModel                      `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Items             []PurchaseRequisitionItemModel     `gorm:"foreignKey:RequisitionID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
+	Approvals         []PurchaseRequisitionApprovalModel `gorm:"foreignKey:RequisitionID;constraint:OnDelete:CASCADE" json:"approvals,omitempty"`
+	PendingRule       *PurchaseApprovalRuleModel         `gorm:"-" json:"pending_rule,omitempty"`
+	PurchaseOrders    []PurchaseOrderModel               `gorm:"-" json:"purchase_orders,omitempty"`
+}
+
+func (PurchaseRequisitionModel) TableName() string {
+	return "purchase_requisitions"
+}
+
+func (p *PurchaseRequisitionModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PurchaseRequisitionItemModel adalah baris barang pada permintaan pembelian
+type PurchaseRequisitionItemModel struct {
+	shared.BaseModel
+	RequisitionID     string                `gorm:"type:char(36);index" json:"requisition_id"`
+	Description       string                `json:"description"`
+	Notes             string                `gorm:"type:text" json:"notes"`
+	ProductID         *string               `gorm:"size:36" json:"product_id,omitempty"`
+	Product           *ProductModel         `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID         *string               `gorm:"size:36" json:"variant_id,omitempty"`
+	Variant           *VariantModel         `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE" json:"variant,omitempty"`
+	ProductCategoryID *string               `gorm:"size:36" json:"product_category_id,omitempty"`
+	ProductCategory   *ProductCategoryModel `gorm:"foreignKey:ProductCategoryID;constraint:OnDelete:SET NULL" json:"product_category,omitempty"`
+	Quantity          float64               `json:"quantity"`
+	UnitID            *string               `gorm:"size:36" json:"unit_id,omitempty"`
+	Unit              *UnitModel            `gorm:"foreignKey:UnitID;constraint:OnDelete:SET NULL" json:"unit,omitempty"`
+	UnitValue         float64               `gorm:"default:1" json:"unit_value"`
+	EstimatedPrice    float64               `json:"estimated_price"`
+	Total             float64               `json:"total"`
+	VendorID          *string               `gorm:"size:36" json:"vendor_id,omitempty"` // vendor yang disarankan
+	Vendor            *ContactModel         `gorm:"foreignKey:VendorID;constraint:OnDelete:SET NULL" json:"vendor,omitempty"`
+	WarehouseID       *string               `gorm:"size:36" json:"warehouse_id,omitempty"`
+	Warehouse         *WarehouseModel       `gorm:"foreignKey:WarehouseID;constraint:OnDelete:SET NULL" json:"warehouse,omitempty"`
+	PurchaseID        *string               `gorm:"size:36" json:"purchase_id,omitempty"` // purchase order hasil konversi
+}
+
+func (PurchaseRequisitionItemModel) TableName() string {
+	return "purchase_requisition_items"
+}
+
+func (p *PurchaseRequisitionItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PurchaseApprovalRuleModel adalah aturan persetujuan bertingkat untuk permintaan pembelian.
+//
+// Aturan berlaku bila total permintaan >= MinAmount dan (MaxAmount kosong atau
+// total <= MaxAmount), serta cabang dan kategori produk sesuai (kosong berarti semua).
+type PurchaseApprovalRuleModel struct {
+	shared.BaseModel
+	Name              string                `gorm:"type:varchar(255)" json:"name"`
+	Level             int                   `gorm:"not null;default:1" json:"level"`
+	MinAmount         float64               `gorm:"default:0" json:"min_amount"`
+	MaxAmount         *float64              `json:"max_amount,omitempty"`
+	BranchID          *string               `gorm:"size:36" json:"branch_id,omitempty"`
+	Branch            *BranchModel          `gorm:"foreignKey:BranchID;constraint:OnDelete:CASCADE" json:"branch,omitempty"`
+	ProductCategoryID *string               `gorm:"size:36" json:"product_category_id,omitempty"`
+	ProductCategory   *ProductCategoryModel `gorm:"foreignKey:ProductCategoryID;constraint:OnDelete:CASCADE" json:"product_category,omitempty"`
+	PermissionName    string                `gorm:"type:varchar(255)" json:"permission_name"` // permission RBAC yang dibutuhkan approver
+	ApproverUserID    *string               `gorm:"size:36" json:"approver_user_id,omitempty"`
+	ApproverUser      *UserModel            `gorm:"foreignKey:ApproverUserID;constraint:OnDelete:SET NULL" json:"approver_user,omitempty"`
+	IsActive          bool                  `gorm:"default:true" json:"is_active"`
+	CompanyID         *string               `json:"company_id,omitempty"`
+	Company           *CompanyModel         `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+}
+
+func (PurchaseApprovalRuleModel) TableName() string {
+	return "purchase_approval_rules"
+}
+
+func (p *PurchaseApprovalRuleModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// PurchaseRequisitionApprovalModel adalah riwayat persetujuan permintaan pembelian
+type PurchaseRequisitionApprovalModel struct {
+	shared.BaseModel
+	RequisitionID string                     `gorm:"type:char(36);index" json:"requisition_id"`
+	RuleID        *string                    `gorm:"size:36" json:"rule_id,omitempty"`
+	Rule          *PurchaseApprovalRuleModel `gorm:"foreignKey:RuleID;constraint:OnDelete:SET NULL" json:"rule,omitempty"`
+	Level         int                        `json:"level"`
+	Action        string                     `gorm:"type:varchar(50)" json:"action"` // SUBMITTED, APPROVED, REJECTED, REAPPROVAL, CANCELLED, CONVERTED
+	Amount        float64                    `json:"amount"`
+	Date          time.Time                  `json:"date"`
+	Notes         string                     `gorm:"type:text" json:"notes"`
+	UserID        *string                    `gorm:"size:36" json:"user_id,omitempty"`
+	User          *UserModel                 `gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL" json:"user,omitempty"`
+}
+
+func (PurchaseRequisitionApprovalModel) TableName() string {
+	return "purchase_requisition_approvals"
+}
+
+func (p *PurchaseRequisitionApprovalModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
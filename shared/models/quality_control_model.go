@@ -0,0 +1,208 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type InspectionType string
+type InspectionStatus string
+
+const (
+	InspectionTypeIncoming  InspectionType = "INCOMING"   // Penerimaan pembelian
+	InspectionTypeInProcess InspectionType = "IN_PROCESS" // Proses produksi
+	InspectionTypeOutgoing  InspectionType = "OUTGOING"   // Pengiriman keluar
+)
+
+const (
+	InspectionStatusPending     InspectionStatus = "PENDING"
+	InspectionStatusPassed      InspectionStatus = "PASSED"
+	InspectionStatusFailed      InspectionStatus = "FAILED"
+	InspectionStatusQuarantined InspectionStatus = "QUARANTINED"
+)
+
+// InspectionPlanModel adalah model database untuk rencana inspeksi (QC)
+type InspectionPlanModel struct {
+	shared.BaseModel
+	Name           string                     `gorm:"type:varchar(255);not null" json:"name"`
+	Code           string                     `gorm:"type:varchar(255)" json:"code"`
+	Description    string                     `gorm:"type:text" json:"description"`
+	InspectionType InspectionType             `gorm:"type:varchar(50);not null" json:"inspection_type"`
+	ProductID      *string                    `gorm:"size:36" json:"product_id,omitempty"`
+	Product        *ProductModel              `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	SampleSize     float64                    `gorm:"default:0" json:"sample_size"` // 0 berarti seluruh kuantitas diperiksa
+	IsActive       bool                       `gorm:"default:true" json:"is_active"`
+	CompanyID      *string                    `json:"company_id,omitempty"`
+	Company        *CompanyModel              `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Parameters     []InspectionParameterModel `gorm:"foreignKey:InspectionPlanID;constraint:OnDelete:CASCADE" json:"parameters,omitempty"`
+}
+
+func (InspectionPlanModel) TableName() string {
+	return "inspection_plans"
+}
+
+func (p *InspectionPlanModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// InspectionParameterModel adalah parameter checklist pada rencana inspeksi
+type InspectionParameterModel struct {
+	shared.BaseModel
+	InspectionPlanID string   `gorm:"type:char(36);index" json:"inspection_plan_id"`
+	Name             string   `gorm:"type:varchar(255);not null" json:"name"`
+	ParameterType    string   `gorm:"type:varchar(50);default:'NUMERIC'" json:"parameter_type"` // NUMERIC, BOOLEAN, TEXT
+	MinValue         *float64 `json:"min_value,omitempty"`
+	MaxValue         *float64 `json:"max_value,omitempty"`
+	ExpectedValue    string   `gorm:"type:varchar(255)" json:"expected_value,omitempty"`
+	UnitOfMeasure    string   `gorm:"type:varchar(50)" json:"unit_of_measure,omitempty"`
+	IsMandatory      bool     `gorm:"default:true" json:"is_mandatory"`
+	Sequence         int      `gorm:"default:1" json:"sequence"`
+}
+
+func (InspectionParameterModel) TableName() string {
+	return "inspection_parameters"
+}
+
+func (p *InspectionParameterModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// InspectionModel adalah model database untuk hasil inspeksi atas suatu dokumen
+// (penerimaan pembelian, proses produksi atau pengiriman)
+type InspectionModel struct {
+	shared.BaseModel
+	InspectionNumber      string                  `gorm:"type:varchar(255)" json:"inspection_number"`
+	Date                  time.Time               `json:"date"`
+	InspectionPlanID      *string                 `gorm:"size:36" json:"inspection_plan_id,omitempty"`
+	InspectionPlan        *InspectionPlanModel    `gorm:"foreignKey:InspectionPlanID;constraint:OnDelete:SET NULL" json:"inspection_plan,omitempty"`
+	InspectionType        InspectionType          `gorm:"type:varchar(50);not null" json:"inspection_type"`
+	RefID                 string                  `gorm:"type:varchar(255);index" json:"ref_id"`
+	RefType               string                  `gorm:"type:varchar(50)" json:"ref_type"` // purchase, production_process, shipment
+	SecondaryRefID        *string                 `json:"secondary_ref_id,omitempty"`
+	SecondaryRefType      *string                 `json:"secondary_ref_type,omitempty"`
+	ProductID             *string                 `gorm:"size:36" json:"product_id,omitempty"`
+	Product               *ProductModel           `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID             *string                 `gorm:"size:36" json:"variant_id,omitempty"`
+	Variant               *VariantModel           `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE" json:"variant,omitempty"`
+	WarehouseID           *string                 `gorm:"size:36" json:"warehouse_id,omitempty"`
+	Warehouse             *WarehouseModel         `gorm:"foreignKey:WarehouseID;constraint:OnDelete:CASCADE" json:"warehouse,omitempty"`
+	QuarantineWarehouseID *string                 `gorm:"size:36" json:"quarantine_warehouse_id,omitempty"`
+	QuarantineWarehouse   *WarehouseModel         `gorm:"foreignKey:QuarantineWarehouseID;constraint:OnDelete:SET NULL" json:"quarantine_warehouse,omitempty"`
+	Quantity              float64                 `json:"quantity"`
+	AcceptedQuantity      float64                 `json:"accepted_quantity"`
+	RejectedQuantity      float64                 `json:"rejected_quantity"`
+	QuarantinedQuantity   float64                 `json:"quarantined_quantity"`
+	Status                InspectionStatus        `gorm:"type:varchar(50);default:'PENDING'" json:"status"`
+	Notes                 string                  `gorm:"type:text" json:"notes"`
+	InspectedAt           *time.Time              `json:"inspected_at,omitempty"`
+	InspectedByID         *string                 `gorm:"size:36" json:"inspected_by_id,omitempty"`
+	InspectedBy           *UserModel              `gorm:"foreignKey:InspectedByID;constraint:OnDelete:SET NULL" json:"inspected_by,omitempty"`
+	PurchaseReturnID      *string                 `gorm:"size:36" json:"purchase_return_id,omitempty"`
+	CompanyID             *string                 `json:"company_id,omitempty"`
+	Company               *CompanyModel           `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Results               []InspectionResultModel `gorm:"foreignKey:InspectionID;constraint:OnDelete:CASCADE" json:"results,omitempty"`
+}
+
+func (InspectionModel) TableName() string {
+	return "inspections"
+}
+
+func (p *InspectionModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// InspectionResultModel adalah nilai hasil pengukuran per parameter inspeksi
+type InspectionResultModel struct {
+	shared.BaseModel
+	InspectionID string                    `gorm:"type:char(36);index" json:"inspection_id"`
+	ParameterID  *string                   `gorm:"size:36" json:"parameter_id,omitempty"`
+	Parameter    *InspectionParameterModel `gorm:"foreignKey:ParameterID;constraint:OnDelete:SET NULL" json:"parameter,omitempty"`
+	Name         string                    `gorm:"type:varchar(255)" json:"name"`
+	NumericValue *float64                  `json:"numeric_value,omitempty"`
+	TextValue    string                    `gorm:"type:varchar(255)" json:"text_value,omitempty"`
+	BoolValue    *bool                     `json:"bool_value,omitempty"`
+	Passed       bool                      `json:"passed"`
+	Notes        string                    `gorm:"type:text" json:"notes"`
+}
+
+func (InspectionResultModel) TableName() string {
+	return "inspection_results"
+}
+
+func (p *InspectionResultModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// NonConformanceReportModel adalah laporan ketidaksesuaian (NCR) dari hasil inspeksi
+type NonConformanceReportModel struct {
+	shared.BaseModel
+	NCRNumber         string                  `gorm:"type:varchar(255)" json:"ncr_number"`
+	Date              time.Time               `json:"date"`
+	InspectionID      *string                 `gorm:"size:36" json:"inspection_id,omitempty"`
+	Inspection        *InspectionModel        `gorm:"foreignKey:InspectionID;constraint:OnDelete:SET NULL" json:"inspection,omitempty"`
+	Title             string                  `gorm:"type:varchar(255)" json:"title"`
+	Description       string                  `gorm:"type:text" json:"description"`
+	Severity          string                  `gorm:"type:varchar(50);default:'MINOR'" json:"severity"` // MINOR, MAJOR, CRITICAL
+	RootCause         string                  `gorm:"type:text" json:"root_cause"`
+	Disposition       string                  `gorm:"type:varchar(50)" json:"disposition"`           // USE_AS_IS, REWORK, RETURN_TO_VENDOR, SCRAP
+	Status            string                  `gorm:"type:varchar(50);default:'OPEN'" json:"status"` // OPEN, IN_PROGRESS, CLOSED
+	ClosedAt          *time.Time              `json:"closed_at,omitempty"`
+	ClosedByID        *string                 `gorm:"size:36" json:"closed_by_id,omitempty"`
+	ClosedBy          *UserModel              `gorm:"foreignKey:ClosedByID;constraint:OnDelete:SET NULL" json:"closed_by,omitempty"`
+	ReportedByID      *string                 `gorm:"size:36" json:"reported_by_id,omitempty"`
+	ReportedBy        *UserModel              `gorm:"foreignKey:ReportedByID;constraint:OnDelete:SET NULL" json:"reported_by,omitempty"`
+	CompanyID         *string                 `json:"company_id,omitempty"`
+	Company           *CompanyModel           `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	CorrectiveActions []CorrectiveActionModel `gorm:"foreignKey:NCRID;constraint:OnDelete:CASCADE" json:"corrective_actions,omitempty"`
+}
+
+func (NonConformanceReportModel) TableName() string {
+	return "non_conformance_reports"
+}
+
+func (p *NonConformanceReportModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// CorrectiveActionModel adalah tindakan perbaikan atas suatu NCR
+type CorrectiveActionModel struct {
+	shared.BaseModel
+	NCRID        string     `gorm:"type:char(36);index" json:"ncr_id"`
+	Description  string     `gorm:"type:text" json:"description"`
+	ActionType   string     `gorm:"type:varchar(50);default:'CORRECTIVE'" json:"action_type"` // CORRECTIVE, PREVENTIVE
+	AssignedToID *string    `gorm:"size:36" json:"assigned_to_id,omitempty"`
+	AssignedTo   *UserModel `gorm:"foreignKey:AssignedToID;constraint:OnDelete:SET NULL" json:"assigned_to,omitempty"`
+	DueDate      *time.Time `json:"due_date,omitempty"`
+	Status       string     `gorm:"type:varchar(50);default:'OPEN'" json:"status"` // OPEN, DONE, VERIFIED
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	Notes        string     `gorm:"type:text" json:"notes"`
+}
+
+func (CorrectiveActionModel) TableName() string {
+	return "corrective_actions"
+}
+
+func (p *CorrectiveActionModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if p.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
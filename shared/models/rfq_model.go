@@ -0,0 +1,176 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RequestForQuotationModel adalah permintaan penawaran harga (RFQ) yang dikirim ke beberapa vendor
+type RequestForQuotationModel struct {
+	shared.BaseModel
+	RFQNumber       string                    `gorm:"type:varchar(255)" json:"rfq_number"`
+	Title           string                    `gorm:"type:varchar(255)" json:"title"`
+	Description     string                    `gorm:"type:text" json:"description"`
+	Date            time.Time                 `json:"date"`
+	Deadline        *time.Time                `json:"deadline,omitempty"`                             // batas akhir pengajuan penawaran
+	Status          string                    `gorm:"type:varchar(50);default:'DRAFT'" json:"status"` // DRAFT, SENT, CLOSED, AWARDED, CANCELLED
+	PriceWeight     float64                   `gorm:"default:0.5" json:"price_weight"`
+	LeadTimeWeight  float64                   `gorm:"default:0.3" json:"lead_time_weight"`
+	DeliveryWeight  float64                   `gorm:"default:0.2" json:"delivery_weight"`
+	RequisitionID   *string                   `gorm:"size:36" json:"requisition_id,omitempty"`
+	Requisition     *PurchaseRequisitionModel `gorm:"foreignKey:RequisitionID;constraint:OnDelete:SET NULL" json:"requisition,omitempty"`
+	AwardedVendorID *string                   `gorm:"size:36" json:"awarded_vendor_id,omitempty"`
+	AwardedVendor   *ContactModel             `gorm:"foreignKey:AwardedVendorID;constraint:OnDelete:SET NULL" json:"awarded_vendor,omitempty"`
+	PurchaseID      *string                   `gorm:"size:36" json:"purchase_id,omitempty"`
+	UserID          *string                   `gorm:"size:36" json:"user_id,omitempty"`
+	User            *UserModel                `gorm:"foreignKey:UserID;constraint:OnDelete:SET NULL" json:"user,omitempty"`
+	CompanyID       *string                   `json:"company_id,omitempty"`
+	Company         *CompanyModel             `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Items           []RFQItemModel            `gorm:"foreignKey:RFQID;constraint:OnDelete:CASCADE" json:"items,omitempty"`
+	Vendors         []RFQVendorModel          `gorm:"foreignKey:RFQID;constraint:OnDelete:CASCADE" json:"vendors,omitempty"`
+}
+
+func (RequestForQuotationModel) TableName() string {
+	return "request_for_quotations"
+}
+
+func (r *RequestForQuotationModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// RFQItemModel adalah baris barang yang diminta penawarannya
+type RFQItemModel struct {
+	shared.BaseModel
+	RFQID       string          `gorm:"type:char(36);index" json:"rfq_id"`
+	Description string          `json:"description"`
+	Notes       string          `gorm:"type:text" json:"notes"`
+	ProductID   *string         `gorm:"size:36" json:"product_id,omitempty"`
+	Product     *ProductModel   `gorm:"foreignKey:ProductID;constraint:OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID   *string         `gorm:"size:36" json:"variant_id,omitempty"`
+	Variant     *VariantModel   `gorm:"foreignKey:VariantID;constraint:OnDelete:CASCADE" json:"variant,omitempty"`
+	Quantity    float64         `json:"quantity"`
+	UnitID      *string         `gorm:"size:36" json:"unit_id,omitempty"`
+	Unit        *UnitModel      `gorm:"foreignKey:UnitID;constraint:OnDelete:SET NULL" json:"unit,omitempty"`
+	UnitValue   float64         `gorm:"default:1" json:"unit_value"`
+	WarehouseID *string         `gorm:"size:36" json:"warehouse_id,omitempty"`
+	Warehouse   *WarehouseModel `gorm:"foreignKey:WarehouseID;constraint:OnDelete:SET NULL" json:"warehouse,omitempty"`
+	// RequisitionItemID adalah baris permintaan pembelian asal item RFQ
+	RequisitionItemID *string `gorm:"size:36;index" json:"requisition_item_id,omitempty"`
+}
+
+func (RFQItemModel) TableName() string {
+	return "rfq_items"
+}
+
+func (r *RFQItemModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// RFQVendorModel adalah vendor yang diundang pada RFQ beserta token publik
+// untuk mengisi penawaran sendiri
+type RFQVendorModel struct {
+	shared.BaseModel
+	RFQID       string                    `gorm:"type:char(36);index" json:"rfq_id"`
+	RFQ         *RequestForQuotationModel `gorm:"foreignKey:RFQID;constraint:OnDelete:CASCADE" json:"rfq,omitempty"`
+	ContactID   string                    `gorm:"type:char(36);index" json:"contact_id"`
+	Contact     *ContactModel             `gorm:"foreignKey:ContactID;constraint:OnDelete:CASCADE" json:"contact,omitempty"`
+	Token       string                    `gorm:"type:varchar(64);uniqueIndex" json:"token"`
+	Status      string                    `gorm:"type:varchar(50);default:'INVITED'" json:"status"` // INVITED, SUBMITTED, DECLINED, AWARDED, LOST
+	SubmittedAt *time.Time                `json:"submitted_at,omitempty"`
+	Notes       string                    `gorm:"type:text" json:"notes"`
+	Quotes      []VendorQuoteLineModel    `gorm:"foreignKey:RFQVendorID;constraint:OnDelete:CASCADE" json:"quotes,omitempty"`
+}
+
+func (RFQVendorModel) TableName() string {
+	return "rfq_vendors"
+}
+
+func (r *RFQVendorModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	if r.Token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		r.Token = hex.EncodeToString(b)
+	}
+	return
+}
+
+// VendorQuoteLineModel adalah penawaran vendor untuk satu baris RFQ
+type VendorQuoteLineModel struct {
+	shared.BaseModel
+	RFQVendorID  string        `gorm:"type:char(36);index" json:"rfq_vendor_id"`
+	RFQItemID    string        `gorm:"type:char(36);index" json:"rfq_item_id"`
+	RFQItem      *RFQItemModel `gorm:"foreignKey:RFQItemID;constraint:OnDelete:CASCADE" json:"rfq_item,omitempty"`
+	UnitPrice    float64       `json:"unit_price"`
+	Quantity     float64       `json:"quantity"` // kuantitas yang bisa dipenuhi vendor
+	LeadTimeDays int           `json:"lead_time_days"`
+	ValidUntil   *time.Time    `json:"valid_until,omitempty"`
+	Notes        string        `gorm:"type:text" json:"notes"`
+}
+
+func (VendorQuoteLineModel) TableName() string {
+	return "vendor_quote_lines"
+}
+
+func (r *VendorQuoteLineModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// RFQComparison adalah matriks perbandingan penawaran vendor pada suatu RFQ
+type RFQComparison struct {
+	RFQID   string              `json:"rfq_id"`
+	Lines   []RFQComparisonLine `json:"lines"`
+	Vendors []RFQVendorScore    `json:"vendors"`
+	BestID  *string             `json:"best_vendor_id,omitempty"`
+}
+
+// RFQComparisonLine adalah perbandingan penawaran untuk satu baris RFQ
+type RFQComparisonLine struct {
+	RFQItemID   string                  `json:"rfq_item_id"`
+	Description string                  `json:"description"`
+	Quantity    float64                 `json:"quantity"`
+	Quotes      []RFQComparisonLineCell `json:"quotes"`
+}
+
+// RFQComparisonLineCell adalah penawaran satu vendor pada satu baris RFQ
+type RFQComparisonLineCell struct {
+	ContactID    string     `json:"contact_id"`
+	UnitPrice    float64    `json:"unit_price"`
+	Total        float64    `json:"total"`
+	LeadTimeDays int        `json:"lead_time_days"`
+	ValidUntil   *time.Time `json:"valid_until,omitempty"`
+	IsExpired    bool       `json:"is_expired"`
+	IsLowest     bool       `json:"is_lowest"`
+}
+
+// RFQVendorScore adalah skor gabungan satu vendor pada suatu RFQ
+type RFQVendorScore struct {
+	ContactID       string  `json:"contact_id"`
+	ContactName     string  `json:"contact_name"`
+	QuotedLines     int     `json:"quoted_lines"`
+	Total           float64 `json:"total"`
+	AvgLeadTimeDays float64 `json:"avg_lead_time_days"`
+	OnTimeRate      float64 `json:"on_time_rate"`
+	PriceScore      float64 `json:"price_score"`
+	LeadTimeScore   float64 `json:"lead_time_score"`
+	DeliveryScore   float64 `json:"delivery_score"`
+	Score           float64 `json:"score"`
+}
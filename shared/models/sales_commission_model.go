@@ -0,0 +1,227 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Dasar perhitungan komisi penjualan.
+const (
+	SalesCommissionBasisRevenue = "REVENUE" // persen dari pendapatan (subtotal setelah diskon, sebelum pajak)
+	SalesCommissionBasisMargin  = "MARGIN"  // persen dari pendapatan dikurangi harga pokok (standard cost)
+)
+
+const (
+	SalesCommissionEarned   = "EARNED"   // komisi atas pembayaran faktur
+	SalesCommissionClawback = "CLAWBACK" // penarikan kembali komisi atas retur
+)
+
+const (
+	SalesCommissionPending  = "PENDING"
+	SalesCommissionApproved = "APPROVED"
+	SalesCommissionRejected = "REJECTED"
+	SalesCommissionPaid     = "PAID" // sudah masuk ke penggajian
+)
+
+// SalesCommissionTier adalah satu tingkat komisi: persen yang berlaku bila dasar komisi
+// karyawan dalam bulan berjalan sudah mencapai MinAmount.
+type SalesCommissionTier struct {
+	MinAmount float64 `json:"min_amount"`
+	Percent   float64 `json:"percent"`
+}
+
+// SalesCommissionPlanModel adalah skema komisi penjualan yang ditugaskan ke karyawan. Komisi
+// dihitung dari Percent atau, bila ada, dari tingkat (Tiers) menurut dasar komisi bulanan
+// karyawan. Aturan per kategori produk (Rules) menggantikan persen skema untuk produk di
+// kategori tersebut.
+type SalesCommissionPlanModel struct {
+	shared.BaseModel
+	Name        string                           `gorm:"type:varchar(255);not null" json:"name"`
+	Description string                           `json:"description,omitempty"`
+	CompanyID   *string                          `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company     *CompanyModel                    `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Basis       string                           `gorm:"type:varchar(20);default:REVENUE" json:"basis"`
+	Percent     float64                          `json:"percent"`
+	Tiers       []SalesCommissionTier            `gorm:"-" json:"tiers,omitempty"`
+	TierData    json.RawMessage                  `gorm:"type:JSON;default:'[]'" json:"-"`
+	IsActive    bool                             `gorm:"default:true" json:"is_active"`
+	Rules       []SalesCommissionRuleModel       `gorm:"foreignKey:PlanID;constraint:OnDelete:CASCADE" json:"rules,omitempty"`
+	Assignments []SalesCommissionAssignmentModel `gorm:"foreignKey:PlanID;constraint:OnDelete:CASCADE" json:"assignments,omitempty"`
+}
+
+func (SalesCommissionPlanModel) TableName() string {
+	return "sales_commission_plans"
+}
+
+func (m *SalesCommissionPlanModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+func (m *SalesCommissionPlanModel) BeforeSave(tx *gorm.DB) (err error) {
+	if m.Tiers != nil {
+		b, err := json.Marshal(m.Tiers)
+		if err != nil {
+			return err
+		}
+		m.TierData = b
+	}
+	return
+}
+
+func (m *SalesCommissionPlanModel) AfterFind(tx *gorm.DB) (err error) {
+	if len(m.TierData) > 0 {
+		json.Unmarshal(m.TierData, &m.Tiers)
+	}
+	return
+}
+
+// SalesCommissionRuleModel adalah persen atau tingkat komisi khusus untuk satu kategori produk
+// dalam skema komisi.
+type SalesCommissionRuleModel struct {
+	shared.BaseModel
+	PlanID     *string                   `gorm:"size:36;index" json:"plan_id"`
+	Plan       *SalesCommissionPlanModel `gorm:"foreignKey:PlanID;constraint:OnDelete:CASCADE" json:"plan,omitempty"`
+	CategoryID *string                   `gorm:"size:36;index" json:"category_id"`
+	Category   *ProductCategoryModel     `gorm:"foreignKey:CategoryID;constraint:OnDelete:CASCADE" json:"category,omitempty"`
+	Percent    float64                   `json:"percent"`
+	Tiers      []SalesCommissionTier     `gorm:"-" json:"tiers,omitempty"`
+	TierData   json.RawMessage           `gorm:"type:JSON;default:'[]'" json:"-"`
+}
+
+func (SalesCommissionRuleModel) TableName() string {
+	return "sales_commission_rules"
+}
+
+func (m *SalesCommissionRuleModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+func (m *SalesCommissionRuleModel) BeforeSave(tx *gorm.DB) (err error) {
+	if m.Tiers != nil {
+		b, err := json.Marshal(m.Tiers)
+		if err != nil {
+			return err
+		}
+		m.TierData = b
+	}
+	return
+}
+
+func (m *SalesCommissionRuleModel) AfterFind(tx *gorm.DB) (err error) {
+	if len(m.TierData) > 0 {
+		json.Unmarshal(m.TierData, &m.Tiers)
+	}
+	return
+}
+
+// SalesCommissionAssignmentModel menugaskan skema komisi ke karyawan untuk suatu rentang
+// tanggal. EndDate kosong berarti berlaku seterusnya.
+type SalesCommissionAssignmentModel struct {
+	shared.BaseModel
+	PlanID     *string                   `gorm:"size:36;index" json:"plan_id"`
+	Plan       *SalesCommissionPlanModel `gorm:"foreignKey:PlanID;constraint:OnDelete:CASCADE" json:"plan,omitempty"`
+	EmployeeID *string                   `gorm:"size:36;index" json:"employee_id"`
+	Employee   *EmployeeModel            `gorm:"foreignKey:EmployeeID;constraint:OnDelete:CASCADE" json:"employee,omitempty"`
+	StartDate  time.Time                 `json:"start_date"`
+	EndDate    *time.Time                `json:"end_date,omitempty"`
+}
+
+func (SalesCommissionAssignmentModel) TableName() string {
+	return "sales_commission_assignments"
+}
+
+func (m *SalesCommissionAssignmentModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// SalesCommissionModel adalah satu baris buku komisi karyawan: komisi atas pembayaran faktur
+// (EARNED) atau penarikan kembali atas retur (CLAWBACK, Amount negatif). Komisi yang sudah
+// disetujui dibayarkan lewat penggajian sebagai item payroll.
+type SalesCommissionModel struct {
+	shared.BaseModel
+	CompanyID      *string                   `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company        *CompanyModel             `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	EmployeeID     *string                   `gorm:"size:36;index" json:"employee_id"`
+	Employee       *EmployeeModel            `gorm:"foreignKey:EmployeeID;constraint:OnDelete:CASCADE" json:"employee,omitempty"`
+	PlanID         *string                   `gorm:"size:36;index" json:"plan_id,omitempty"`
+	Plan           *SalesCommissionPlanModel `gorm:"foreignKey:PlanID;constraint:OnDelete:SET NULL" json:"plan,omitempty"`
+	SalesID        *string                   `gorm:"size:36;index" json:"sales_id"`
+	Sales          *SalesModel               `gorm:"foreignKey:SalesID;constraint:OnDelete:CASCADE" json:"sales,omitempty"`
+	SalesPaymentID *string                   `gorm:"size:36;uniqueIndex" json:"sales_payment_id,omitempty"`
+	TransactionID  *string                   `gorm:"size:36;uniqueIndex" json:"transaction_id,omitempty"` // jurnal pembayaran tanpa sales payment
+	ReturnID       *string                   `gorm:"size:36;index" json:"return_id,omitempty"`
+	Type           string                    `gorm:"type:varchar(20);index" json:"type"`
+	Date           time.Time                 `json:"date"`
+	Period         string                    `gorm:"type:varchar(7);index" json:"period"` // YYYY-MM
+	Basis          string                    `gorm:"type:varchar(20)" json:"basis"`
+	BaseAmount     float64                   `json:"base_amount"`
+	Percent        float64                   `json:"percent"` // persen efektif
+	Amount         float64                   `json:"amount"`
+	Description    string                    `json:"description,omitempty"`
+	Status         string                    `gorm:"type:varchar(20);default:PENDING;index" json:"status"`
+	ApprovedAt     *time.Time                `json:"approved_at,omitempty"`
+	ApprovedByID   *string                   `gorm:"size:36" json:"approved_by_id,omitempty"`
+	PayRollID      *string                   `gorm:"size:36;index" json:"pay_roll_id,omitempty"`
+	PayrollItemID  *string                   `gorm:"size:36;index" json:"payroll_item_id,omitempty"`
+}
+
+func (SalesCommissionModel) TableName() string {
+	return "sales_commissions"
+}
+
+func (m *SalesCommissionModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// SalesTargetModel adalah target penjualan bulanan karyawan. Realisasinya dihitung dari faktur
+// yang diterbitkan, retur dan pembayaran pada bulan tersebut.
+type SalesTargetModel struct {
+	shared.BaseModel
+	CompanyID    *string        `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company      *CompanyModel  `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	EmployeeID   *string        `gorm:"size:36;uniqueIndex:idx_sales_target_employee_period" json:"employee_id"`
+	Employee     *EmployeeModel `gorm:"foreignKey:EmployeeID;constraint:OnDelete:CASCADE" json:"employee,omitempty"`
+	Period       string         `gorm:"type:varchar(7);uniqueIndex:idx_sales_target_employee_period" json:"period"` // YYYY-MM
+	TargetAmount float64        `json:"target_amount"`
+	Notes        string         `json:"notes,omitempty"`
+}
+
+func (SalesTargetModel) TableName() string {
+	return "sales_targets"
+}
+
+func (m *SalesTargetModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// SalesTargetAchievement adalah realisasi target penjualan karyawan dalam satu bulan.
+type SalesTargetAchievement struct {
+	EmployeeID  string  `json:"employee_id"`
+	Period      string  `json:"period"`
+	Target      float64 `json:"target"`
+	Invoiced    float64 `json:"invoiced"`    // subtotal faktur yang diterbitkan
+	Returned    float64 `json:"returned"`    // subtotal retur yang dirilis
+	NetSales    float64 `json:"net_sales"`   // Invoiced - Returned
+	Collected   float64 `json:"collected"`   // pembayaran faktur yang diterima
+	Commission  float64 `json:"commission"`  // komisi bersih (EARNED + CLAWBACK)
+	Achievement float64 `json:"achievement"` // persen NetSales terhadap Target
+}
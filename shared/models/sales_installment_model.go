@@ -0,0 +1,173 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	SalesInstallmentInterestNone      = "NONE"
+	SalesInstallmentInterestFlat      = "FLAT"      // bunga dari pokok awal, sama setiap cicilan
+	SalesInstallmentInterestAnuity    = "ANUITY"    // cicilan tetap, bunga dari sisa pokok
+	SalesInstallmentInterestDeclining = "DECLINING" // pokok tetap, bunga dari sisa pokok
+)
+
+const (
+	SalesInstallmentPlanActive   = "ACTIVE"
+	SalesInstallmentPlanPaid     = "PAID"
+	SalesInstallmentPlanCanceled = "CANCELED"
+)
+
+const (
+	SalesInstallmentUnpaid  = "UNPAID"
+	SalesInstallmentPartial = "PARTIAL"
+	SalesInstallmentPaid    = "PAID"
+)
+
+// SalesInstallmentPlanModel adalah rencana cicilan (pay later) pelanggan atas sisa tagihan faktur
+// penjualan: uang muka, N cicilan dengan jatuh tempo bulanan, serta bunga dan biaya admin opsional.
+//
+// Bunga dan biaya admin menambah piutang faktur saat rencana dibuat (debit akun piutang faktur,
+// kredit UnearnedAccountID) dan diakui sebagai pendapatan per cicilan saat cicilan dibayar (debit
+// UnearnedAccountID, kredit IncomeAccountID). Pembayaran faktur dialokasikan ke cicilan secara
+// berurutan.
+type SalesInstallmentPlanModel struct {
+	shared.BaseModel
+	SalesID            *string                           `gorm:"size:36;index" json:"sales_id"`
+	Sales              *SalesModel                       `gorm:"foreignKey:SalesID;constraint:OnDelete:CASCADE" json:"sales,omitempty"`
+	CompanyID          *string                           `gorm:"size:36;index" json:"company_id,omitempty"`
+	ContactID          *string                           `gorm:"size:36;index" json:"contact_id,omitempty"`
+	Contact            *ContactModel                     `gorm:"foreignKey:ContactID;constraint:OnDelete:SET NULL" json:"contact,omitempty"`
+	Date               time.Time                         `json:"date"`
+	Principal          float64                           `gorm:"type:decimal(15,2);default:0" json:"principal"` // sisa tagihan faktur saat rencana dibuat
+	DownPayment        float64                           `gorm:"type:decimal(15,2);default:0" json:"down_payment"`
+	DownPaymentDueDate *time.Time                        `json:"down_payment_due_date,omitempty"`
+	Installments       int                               `json:"installments"` // jumlah cicilan di luar uang muka
+	IntervalMonths     int                               `gorm:"default:1" json:"interval_months"`
+	FirstDueDate       *time.Time                        `json:"first_due_date,omitempty"` // kosong: tanggal rencana + IntervalMonths
+	InterestType       string                            `gorm:"type:varchar(20);default:NONE" json:"interest_type"`
+	InterestRate       float64                           `json:"interest_rate"`                                 // persen per tahun
+	AdminFee           float64                           `gorm:"type:decimal(13,2);default:0" json:"admin_fee"` // biaya admin per cicilan
+	TotalInterest      float64                           `gorm:"type:decimal(15,2);default:0" json:"total_interest"`
+	TotalFee           float64                           `gorm:"type:decimal(15,2);default:0" json:"total_fee"`
+	TotalAmount        float64                           `gorm:"type:decimal(15,2);default:0" json:"total_amount"` // pokok + bunga + biaya admin
+	PaidAmount         float64                           `gorm:"type:decimal(15,2);default:0" json:"paid_amount"`
+	Status             string                            `gorm:"type:varchar(20);default:ACTIVE;index" json:"status"`
+	IncomeAccountID    *string                           `gorm:"size:36" json:"income_account_id,omitempty"` // akun pendapatan bunga dan biaya admin
+	IncomeAccount      *AccountModel                     `gorm:"foreignKey:IncomeAccountID;constraint:OnDelete:SET NULL" json:"income_account,omitempty"`
+	UnearnedAccountID  *string                           `gorm:"size:36" json:"unearned_account_id,omitempty"` // akun pendapatan bunga dan biaya admin yang belum diakui
+	UnearnedAccount    *AccountModel                     `gorm:"foreignKey:UnearnedAccountID;constraint:OnDelete:SET NULL" json:"unearned_account,omitempty"`
+	PreviousDueDate    *time.Time                        `json:"previous_due_date,omitempty"` // jatuh tempo faktur sebelum rencana dibuat, dikembalikan saat rencana dibatalkan
+	Notes              string                            `json:"notes"`
+	UserID             *string                           `gorm:"size:36" json:"user_id,omitempty"`
+	Schedule           []SalesInstallmentModel           `gorm:"foreignKey:PlanID;constraint:OnDelete:CASCADE" json:"schedule,omitempty"`
+	Allocations        []SalesInstallmentAllocationModel `gorm:"foreignKey:PlanID;constraint:OnDelete:CASCADE" json:"allocations,omitempty"`
+}
+
+func (SalesInstallmentPlanModel) TableName() string {
+	return "sales_installment_plans"
+}
+
+func (m *SalesInstallmentPlanModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// SalesInstallmentModel adalah satu baris jadwal cicilan. Nomor 0 adalah uang muka.
+type SalesInstallmentModel struct {
+	shared.BaseModel
+	PlanID     *string    `gorm:"size:36;index" json:"plan_id"`
+	SalesID    *string    `gorm:"size:36;index" json:"sales_id"`
+	Number     int        `json:"number"`
+	DueDate    time.Time  `gorm:"index" json:"due_date"`
+	Principal  float64    `gorm:"type:decimal(15,2);default:0" json:"principal"`
+	Interest   float64    `gorm:"type:decimal(15,2);default:0" json:"interest"`
+	Fee        float64    `gorm:"type:decimal(13,2);default:0" json:"fee"`
+	Amount     float64    `gorm:"type:decimal(15,2);default:0" json:"amount"` // pokok + bunga + biaya
+	PaidAmount float64    `gorm:"type:decimal(15,2);default:0" json:"paid_amount"`
+	Recognized float64    `gorm:"type:decimal(15,2);default:0" json:"recognized"` // bunga dan biaya yang sudah diakui sebagai pendapatan
+	Status     string     `gorm:"type:varchar(20);default:UNPAID;index" json:"status"`
+	PaidAt     *time.Time `json:"paid_at,omitempty"`
+}
+
+func (SalesInstallmentModel) TableName() string {
+	return "sales_installments"
+}
+
+func (m *SalesInstallmentModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// SalesInstallmentAllocationModel adalah bagian pembayaran faktur yang dialokasikan ke satu
+// cicilan.
+type SalesInstallmentAllocationModel struct {
+	shared.BaseModel
+	PlanID         *string   `gorm:"size:36;index" json:"plan_id"`
+	InstallmentID  *string   `gorm:"size:36;index" json:"installment_id"`
+	SalesID        *string   `gorm:"size:36;index" json:"sales_id"`
+	SalesPaymentID *string   `gorm:"size:36;index" json:"sales_payment_id,omitempty"`
+	Date           time.Time `json:"date"`
+	Amount         float64   `gorm:"type:decimal(15,2);default:0" json:"amount"`
+}
+
+func (SalesInstallmentAllocationModel) TableName() string {
+	return "sales_installment_allocations"
+}
+
+func (m *SalesInstallmentAllocationModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if m.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// ReceivableAgingBuckets adalah sisa piutang per kelompok umur keterlambatan.
+type ReceivableAgingBuckets struct {
+	Current    float64 `json:"current"` // belum jatuh tempo
+	Days1To30  float64 `json:"days_1_30"`
+	Days31To60 float64 `json:"days_31_60"`
+	Days61To90 float64 `json:"days_61_90"`
+	Over90     float64 `json:"over_90"`
+	Total      float64 `json:"total"`
+}
+
+// ReceivableAgingLine adalah satu cicilan, atau satu faktur tanpa rencana cicilan, yang belum
+// lunas.
+type ReceivableAgingLine struct {
+	ContactID         *string   `json:"contact_id,omitempty"`
+	ContactName       string    `json:"contact_name"`
+	SalesID           string    `json:"sales_id"`
+	SalesNumber       string    `json:"sales_number"`
+	PlanID            *string   `json:"plan_id,omitempty"`
+	InstallmentID     *string   `json:"installment_id,omitempty"`
+	InstallmentNumber *int      `json:"installment_number,omitempty"`
+	DueDate           time.Time `json:"due_date"`
+	DaysOverdue       int       `json:"days_overdue"`
+	Amount            float64   `json:"amount"`
+	Paid              float64   `json:"paid"`
+	Outstanding       float64   `json:"outstanding"`
+	Bucket            string    `json:"bucket"` // CURRENT, 1-30, 31-60, 61-90, 90+
+}
+
+// ReceivableAgingContact adalah rekap umur piutang satu pelanggan.
+type ReceivableAgingContact struct {
+	ContactID   *string `json:"contact_id,omitempty"`
+	ContactName string  `json:"contact_name"`
+	ReceivableAgingBuckets
+}
+
+// ReceivableAgingReport adalah laporan umur piutang per cicilan pada suatu tanggal.
+type ReceivableAgingReport struct {
+	AsOf     time.Time                `json:"as_of"`
+	Lines    []ReceivableAgingLine    `json:"lines"`
+	Contacts []ReceivableAgingContact `json:"contacts"`
+	Totals   ReceivableAgingBuckets   `json:"totals"`
+}
@@ -38,6 +38,7 @@ type SalesModel struct {
 	TotalBeforeDisc       float64                 `json:"total_before_disc"`
 	TotalTax              float64                 `json:"total_tax"`
 	TotalDiscount         float64                 `json:"total_discount"`
+	VoucherCode           string                  `json:"voucher_code,omitempty" gorm:"type:varchar(100)"` // kode voucher atau kode promosi yang dipakai saat faktur diposting
 	Status                string                  `json:"status"`
 	StockStatus           string                  `json:"stock_status" gorm:"default:'pending'"`
 	SalesDate             time.Time               `json:"sales_date"`
@@ -126,6 +127,7 @@ type SalesItemModel struct {
 	Quantity           float64         `json:"quantity,omitempty"`
 	BasePrice          float64         `json:"base_price,omitempty"`
 	UnitPrice          float64         `json:"unit_price,omitempty"`
+	PriceListItemID    *string         `gorm:"size:36" json:"price_list_item_id,omitempty"` // aturan daftar harga yang menentukan UnitPrice
 	Total              float64         `json:"total,omitempty"`
 	SubTotal           float64         `json:"sub_total,omitempty"`
 	DiscountPercent    float64         `json:"discount_percent,omitempty"`
@@ -148,6 +150,10 @@ type SalesItemModel struct {
 	Unit               *UnitModel      `gorm:"foreignKey:UnitID;constraint:OnDelete:CASCADE" json:"unit,omitempty"`
 	UnitValue          float64         `json:"unit_value,omitempty" gorm:"default:1"`
 	IsCost             bool            `json:"is_cost,omitempty" gorm:"default:false"`
+	RefItemID          *string         `json:"ref_item_id,omitempty" gorm:"size:36"`          // baris dokumen asal (penawaran / pesanan)
+	OrderedQuantity    float64         `json:"ordered_quantity,omitempty" gorm:"default:0"`   // kuantitas penawaran yang sudah dijadikan pesanan
+	DeliveredQuantity  float64         `json:"delivered_quantity,omitempty" gorm:"default:0"` // kuantitas pesanan yang sudah dikirim
+	InvoicedQuantity   float64         `json:"invoiced_quantity,omitempty" gorm:"default:0"`  // kuantitas pesanan yang sudah difakturkan
 }
 
 func (s *SalesModel) TableName() string {
@@ -210,3 +216,29 @@ type SalesList struct {
 	Balance     float64    `json:"balance" sql:"balance"`
 	DueDate     *time.Time `json:"due_date" sql:"due_date"`
 }
+
+// SalesDocumentFlow adalah satu dokumen pada alur penjualan
+// (penawaran → pesanan → pengiriman → faktur) beserta dokumen turunannya
+type SalesDocumentFlow struct {
+	ID           string                  `json:"id"`
+	SalesNumber  string                  `json:"sales_number"`
+	DocumentType SalesDocType            `json:"document_type"`
+	Status       string                  `json:"status"`
+	StockStatus  string                  `json:"stock_status"`
+	SalesDate    time.Time               `json:"sales_date"`
+	Total        float64                 `json:"total"`
+	IsCurrent    bool                    `json:"is_current"`
+	Items        []SalesDocumentFlowItem `json:"items"`
+	Children     []SalesDocumentFlow     `json:"children"`
+}
+
+// SalesDocumentFlowItem adalah ringkasan kuantitas satu baris dokumen pada alur penjualan
+type SalesDocumentFlowItem struct {
+	ID                string  `json:"id"`
+	RefItemID         *string `json:"ref_item_id,omitempty"`
+	Description       string  `json:"description"`
+	Quantity          float64 `json:"quantity"`
+	OrderedQuantity   float64 `json:"ordered_quantity"`
+	DeliveredQuantity float64 `json:"delivered_quantity"`
+	InvoicedQuantity  float64 `json:"invoiced_quantity"`
+}
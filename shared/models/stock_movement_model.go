@@ -51,6 +51,8 @@ type StockMovementModel struct {
 	SecondaryRefType  *string             `gorm:"secondary_ref_type" json:"secondary_ref_type,omitempty"`
 	UnitID            *string             `json:"unit_id,omitempty"` // Relasi ke unit
 	Unit              *UnitModel          `gorm:"foreignKey:UnitID;constraint:OnDelete:CASCADE" json:"unit,omitempty"`
+	OwnerID           *string             `gorm:"size:36;index" json:"owner_id,omitempty"` // Pemilik stok titipan (kontak pemasok), kosong = milik perusahaan
+	Owner             *ContactModel       `gorm:"foreignKey:OwnerID;constraint:OnDelete:RESTRICT" json:"owner,omitempty"`
 	SalesRef          *SalesModel         `gorm:"-" json:"sales_ref,omitempty"`
 	PurchaseRef       *PurchaseOrderModel `gorm:"-" json:"purchase_ref,omitempty"`
 	ReturnRef         *ReturnModel        `gorm:"-" json:"return_ref,omitempty"`
@@ -67,3 +69,55 @@ func (p *StockMovementModel) BeforeCreate(tx *gorm.DB) (err error) {
 	}
 	return
 }
+
+type ReservationStatus string
+
+const (
+	ReservationStatusActive    ReservationStatus = "ACTIVE"    // Stok sedang dipesan
+	ReservationStatusReleased  ReservationStatus = "RELEASED"  // Dilepas karena dokumen dibatalkan
+	ReservationStatusFulfilled ReservationStatus = "FULFILLED" // Stok sudah keluar (terkirim / terjual)
+	ReservationStatusExpired   ReservationStatus = "EXPIRED"   // Melewati batas waktu pemesanan
+)
+
+// StockReservationModel adalah pemesanan stok (reservasi) oleh sales order, keranjang yang sudah
+// di-checkout atau penawaran (offer) yang sudah diterima.
+//
+// Reservasi tidak mengubah stok fisik; stok yang bisa dijanjikan (available to promise) adalah
+// stok fisik dikurangi sisa reservasi yang masih aktif dan belum kedaluwarsa.
+// Quantity dan FulfilledQuantity dinyatakan dalam satuan dasar produk.
+type StockReservationModel struct {
+	shared.BaseModel
+	Date              time.Time         `gorm:"not null" json:"date"`
+	Description       string            `json:"description"`
+	ProductID         string            `gorm:"type:char(36);not null;index" json:"product_id"`
+	Product           *ProductModel     `gorm:"foreignKey:ProductID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"product,omitempty"`
+	VariantID         *string           `gorm:"size:36;index" json:"variant_id,omitempty"`
+	Variant           *VariantModel     `gorm:"foreignKey:VariantID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"variant,omitempty"`
+	WarehouseID       *string           `gorm:"size:36;index" json:"warehouse_id,omitempty"`
+	Warehouse         *WarehouseModel   `gorm:"foreignKey:WarehouseID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"warehouse,omitempty"`
+	MerchantID        *string           `gorm:"size:36" json:"merchant_id,omitempty"`
+	Merchant          *MerchantModel    `gorm:"foreignKey:MerchantID;constraint:OnDelete:CASCADE" json:"merchant,omitempty"`
+	CompanyID         *string           `gorm:"size:36" json:"company_id,omitempty"`
+	Company           *CompanyModel     `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Quantity          float64           `gorm:"not null" json:"quantity"`
+	FulfilledQuantity float64           `gorm:"default:0" json:"fulfilled_quantity"`
+	Status            ReservationStatus `gorm:"type:varchar(20);default:'ACTIVE';index" json:"status"`
+	ReferenceID       string            `gorm:"type:char(36);index" json:"reference_id"`      // ID dokumen pemesan (sales order, cart, offer)
+	ReferenceType     string            `gorm:"type:varchar(50);index" json:"reference_type"` // sales_order, cart, offer
+	SecondaryRefID    *string           `gorm:"size:36" json:"secondary_ref_id,omitempty"`    // ID baris dokumen
+	SecondaryRefType  *string           `gorm:"type:varchar(50)" json:"secondary_ref_type,omitempty"`
+	ExpiresAt         *time.Time        `json:"expires_at,omitempty"` // kosong berarti tidak kedaluwarsa
+	ClosedAt          *time.Time        `json:"closed_at,omitempty"`
+	ClosedReason      string            `json:"closed_reason,omitempty"`
+}
+
+func (StockReservationModel) TableName() string {
+	return "stock_reservations"
+}
+
+func (s *StockReservationModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
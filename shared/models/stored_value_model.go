@@ -0,0 +1,137 @@
+package models
+
+import (
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+type StoredValueType string
+
+const (
+	StoredValueGiftCard    StoredValueType = "GIFT_CARD"    // Kartu hadiah yang dijual / diberikan, dipakai dengan kode (dan PIN)
+	StoredValueStoreCredit StoredValueType = "STORE_CREDIT" // Saldo toko milik pelanggan, misalnya dari pengembalian dana
+)
+
+type StoredValueStatus string
+
+const (
+	StoredValueActive   StoredValueStatus = "ACTIVE"
+	StoredValueInactive StoredValueStatus = "INACTIVE" // belum diaktifkan / diblokir sementara
+	StoredValueExpired  StoredValueStatus = "EXPIRED"
+	StoredValueVoid     StoredValueStatus = "VOID"
+)
+
+type StoredValueTransactionType string
+
+const (
+	StoredValueTxIssue    StoredValueTransactionType = "ISSUE"
+	StoredValueTxTopUp    StoredValueTransactionType = "TOPUP"
+	StoredValueTxRedeem   StoredValueTransactionType = "REDEEM"
+	StoredValueTxRefund   StoredValueTransactionType = "REFUND" // pengembalian dana penjualan ke store credit
+	StoredValueTxReversal StoredValueTransactionType = "REVERSAL"
+	StoredValueTxExpire   StoredValueTransactionType = "EXPIRE"
+	StoredValueTxVoid     StoredValueTransactionType = "VOID"
+)
+
+// StoredValueModel adalah instrumen bernilai simpan (kartu hadiah atau store credit).
+//
+// Saldo instrumen adalah kewajiban perusahaan yang dicatat pada LiabilityAccountID (akun
+// pendapatan diterima di muka). Penerbitan dan isi ulang mengkredit akun tersebut, penukaran
+// mendebitnya. Store credit dimiliki satu kontak; kartu hadiah boleh tanpa pemilik dan dipakai
+// oleh siapa saja yang mengetahui kode dan PIN-nya.
+type StoredValueModel struct {
+	shared.BaseModel
+	Type               StoredValueType   `gorm:"type:varchar(20);index" json:"type"`
+	Code               string            `gorm:"type:varchar(50);uniqueIndex" json:"code"`
+	PinHash            string            `gorm:"type:varchar(255)" json:"-"`
+	HasPin             bool              `gorm:"-" json:"has_pin"`
+	ContactID          *string           `gorm:"size:36;index" json:"contact_id,omitempty"`
+	Contact            *ContactModel     `gorm:"foreignKey:ContactID;constraint:OnDelete:SET NULL" json:"contact,omitempty"`
+	CompanyID          *string           `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company            *CompanyModel     `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	LiabilityAccountID *string           `gorm:"size:36" json:"liability_account_id,omitempty"`
+	LiabilityAccount   *AccountModel     `gorm:"foreignKey:LiabilityAccountID;constraint:OnDelete:SET NULL" json:"liability_account,omitempty"`
+	InitialAmount      float64           `json:"initial_amount"`
+	Balance            float64           `json:"balance"`
+	Status             StoredValueStatus `gorm:"type:varchar(20);default:'ACTIVE';index" json:"status"`
+	IssuedAt           time.Time         `json:"issued_at"`
+	ExpiresAt          *time.Time        `json:"expires_at,omitempty"`
+	LastUsedAt         *time.Time        `json:"last_used_at,omitempty"`
+	Notes              string            `json:"notes"`
+	UserID             *string           `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (StoredValueModel) TableName() string {
+	return "stored_values"
+}
+
+func (s *StoredValueModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+func (s *StoredValueModel) AfterFind(tx *gorm.DB) (err error) {
+	s.HasPin = s.PinHash != ""
+	return
+}
+
+// SetPin menyimpan hash PIN instrumen; PIN kosong menghapus PIN
+func (s *StoredValueModel) SetPin(pin string) error {
+	if pin == "" {
+		s.PinHash = ""
+		return nil
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.PinHash = string(hashed)
+	return nil
+}
+
+// CheckPin memeriksa PIN instrumen. Instrumen tanpa PIN selalu lolos.
+func (s *StoredValueModel) CheckPin(pin string) bool {
+	if s.PinHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(s.PinHash), []byte(pin)) == nil
+}
+
+// StoredValueTransactionModel adalah mutasi saldo instrumen bernilai simpan.
+//
+// Amount bertanda (positif = saldo bertambah). AccountID adalah akun lawan jurnal: akun kas
+// saat penerbitan/isi ulang, atau akun penyelesaian transaksi saat penukaran.
+type StoredValueTransactionModel struct {
+	shared.BaseModel
+	StoredValueID string                     `gorm:"type:char(36);index" json:"stored_value_id"`
+	StoredValue   *StoredValueModel          `gorm:"foreignKey:StoredValueID;constraint:OnDelete:CASCADE" json:"stored_value,omitempty"`
+	CompanyID     *string                    `gorm:"size:36;index" json:"company_id,omitempty"`
+	Date          time.Time                  `json:"date"`
+	Type          StoredValueTransactionType `gorm:"type:varchar(20);index" json:"type"`
+	Amount        float64                    `json:"amount"`
+	BalanceAfter  float64                    `json:"balance_after"`
+	AccountID     *string                    `gorm:"size:36" json:"account_id,omitempty"`
+	Account       *AccountModel              `gorm:"foreignKey:AccountID;constraint:OnDelete:SET NULL" json:"account,omitempty"`
+	ReferenceID   *string                    `gorm:"size:36;index" json:"reference_id,omitempty"`
+	ReferenceType string                     `gorm:"type:varchar(50);index" json:"reference_type,omitempty"` // pos, sales, return_sales, manual
+	ReversalOfID  *string                    `gorm:"size:36" json:"reversal_of_id,omitempty"`
+	Description   string                     `json:"description"`
+	UserID        *string                    `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (StoredValueTransactionModel) TableName() string {
+	return "stored_value_transactions"
+}
+
+func (s *StoredValueTransactionModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
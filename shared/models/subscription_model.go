@@ -0,0 +1,246 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/shared"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type SubscriptionBillingPeriod string
+
+const (
+	SubscriptionPeriodDay   SubscriptionBillingPeriod = "DAY"
+	SubscriptionPeriodWeek  SubscriptionBillingPeriod = "WEEK"
+	SubscriptionPeriodMonth SubscriptionBillingPeriod = "MONTH"
+	SubscriptionPeriodYear  SubscriptionBillingPeriod = "YEAR"
+)
+
+type SubscriptionProrationMode string
+
+const (
+	SubscriptionProrate       SubscriptionProrationMode = "PRORATE" // perubahan paket langsung ditagih / dikreditkan sebanding sisa periode
+	SubscriptionProrationNone SubscriptionProrationMode = "NONE"    // harga baru berlaku mulai tagihan berikutnya
+)
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionTrialing  SubscriptionStatus = "TRIALING"
+	SubscriptionActive    SubscriptionStatus = "ACTIVE"
+	SubscriptionPastDue   SubscriptionStatus = "PAST_DUE"
+	SubscriptionPaused    SubscriptionStatus = "PAUSED"
+	SubscriptionCancelled SubscriptionStatus = "CANCELLED"
+)
+
+type SubscriptionDunningAction string
+
+const (
+	SubscriptionDunningCancel SubscriptionDunningAction = "CANCEL"
+	SubscriptionDunningPause  SubscriptionDunningAction = "PAUSE"
+)
+
+type SubscriptionEventType string
+
+const (
+	SubscriptionEventCreated          SubscriptionEventType = "CREATED"
+	SubscriptionEventActivated        SubscriptionEventType = "ACTIVATED"
+	SubscriptionEventPlanChanged      SubscriptionEventType = "PLAN_CHANGED"
+	SubscriptionEventPaused           SubscriptionEventType = "PAUSED"
+	SubscriptionEventResumed          SubscriptionEventType = "RESUMED"
+	SubscriptionEventCancelled        SubscriptionEventType = "CANCELLED"
+	SubscriptionEventInvoiced         SubscriptionEventType = "INVOICED"
+	SubscriptionEventPaymentFailed    SubscriptionEventType = "PAYMENT_FAILED"
+	SubscriptionEventPaymentRecovered SubscriptionEventType = "PAYMENT_RECOVERED"
+)
+
+// SubscriptionPlanModel adalah paket langganan.
+//
+// Tagihan dibuat setiap BillingInterval x BillingPeriod sebesar Price per unit. Faktur langganan
+// memakai SaleAccountID sebagai akun pendapatan dan ReceivableAccountID (bertipe RECEIVABLE)
+// sebagai akun piutang. Faktur yang belum dibayar ditagih ulang setiap DunningIntervalDays hari
+// sebanyak DunningMaxRetries kali, setelah itu DunningAction dijalankan.
+type SubscriptionPlanModel struct {
+	shared.BaseModel
+	Name                string                    `gorm:"type:varchar(255)" json:"name"`
+	Code                string                    `gorm:"type:varchar(50);index" json:"code"`
+	Description         string                    `json:"description"`
+	CompanyID           *string                   `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company             *CompanyModel             `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	Price               float64                   `json:"price"`
+	BillingPeriod       SubscriptionBillingPeriod `gorm:"type:varchar(10);default:'MONTH'" json:"billing_period"`
+	BillingInterval     int                       `gorm:"default:1" json:"billing_interval"`
+	TrialDays           int                       `gorm:"default:0" json:"trial_days"`
+	ProrationMode       SubscriptionProrationMode `gorm:"type:varchar(20);default:'PRORATE'" json:"proration_mode"`
+	InvoiceDueDays      int                       `gorm:"default:7" json:"invoice_due_days"`
+	DunningMaxRetries   int                       `gorm:"default:3" json:"dunning_max_retries"`
+	DunningIntervalDays int                       `gorm:"default:3" json:"dunning_interval_days"`
+	DunningAction       SubscriptionDunningAction `gorm:"type:varchar(20);default:'CANCEL'" json:"dunning_action"`
+	SaleAccountID       *string                   `gorm:"size:36" json:"sale_account_id,omitempty"`
+	SaleAccount         *AccountModel             `gorm:"foreignKey:SaleAccountID;constraint:OnDelete:SET NULL" json:"sale_account,omitempty"`
+	ReceivableAccountID *string                   `gorm:"size:36" json:"receivable_account_id,omitempty"`
+	ReceivableAccount   *AccountModel             `gorm:"foreignKey:ReceivableAccountID;constraint:OnDelete:SET NULL" json:"receivable_account,omitempty"`
+	TaxID               *string                   `gorm:"size:36" json:"tax_id,omitempty"`
+	Tax                 *TaxModel                 `gorm:"foreignKey:TaxID;constraint:OnDelete:SET NULL" json:"tax,omitempty"`
+	IsActive            bool                      `gorm:"default:true" json:"is_active"`
+}
+
+func (SubscriptionPlanModel) TableName() string {
+	return "subscription_plans"
+}
+
+func (s *SubscriptionPlanModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// NextPeriod mengembalikan awal periode tagihan berikutnya setelah start
+func (s *SubscriptionPlanModel) NextPeriod(start time.Time) time.Time {
+	interval := s.BillingInterval
+	if interval <= 0 {
+		interval = 1
+	}
+	switch s.BillingPeriod {
+	case SubscriptionPeriodDay:
+		return start.AddDate(0, 0, interval)
+	case SubscriptionPeriodWeek:
+		return start.AddDate(0, 0, 7*interval)
+	case SubscriptionPeriodYear:
+		return start.AddDate(interval, 0, 0)
+	default:
+		return start.AddDate(0, interval, 0)
+	}
+}
+
+// MonthlyAmount mengembalikan nilai bulanan (MRR) paket untuk quantity unit
+func (s *SubscriptionPlanModel) MonthlyAmount(quantity float64) float64 {
+	interval := float64(s.BillingInterval)
+	if interval <= 0 {
+		interval = 1
+	}
+	amount := s.Price * quantity
+	switch s.BillingPeriod {
+	case SubscriptionPeriodDay:
+		return amount * 365 / 12 / interval
+	case SubscriptionPeriodWeek:
+		return amount * 52 / 12 / interval
+	case SubscriptionPeriodYear:
+		return amount / 12 / interval
+	default:
+		return amount / interval
+	}
+}
+
+// SubscriptionModel adalah langganan pelanggan pada sebuah paket.
+//
+// NextBillingDate adalah tanggal tagihan berikutnya (awal periode berikutnya, atau akhir masa
+// percobaan). PendingPlanID / PendingQuantity berlaku pada awal periode berikutnya (misalnya
+// downgrade). CreditBalance adalah sisa kredit prorata yang dipotongkan ke tagihan berikutnya.
+type SubscriptionModel struct {
+	shared.BaseModel
+	Number             string                 `gorm:"type:varchar(50);index" json:"number"`
+	CompanyID          *string                `gorm:"size:36;index" json:"company_id,omitempty"`
+	Company            *CompanyModel          `gorm:"foreignKey:CompanyID;constraint:OnDelete:CASCADE" json:"company,omitempty"`
+	ContactID          string                 `gorm:"type:char(36);index" json:"contact_id"`
+	Contact            *ContactModel          `gorm:"foreignKey:ContactID;constraint:OnDelete:CASCADE" json:"contact,omitempty"`
+	PlanID             string                 `gorm:"type:char(36);index" json:"plan_id"`
+	Plan               *SubscriptionPlanModel `gorm:"foreignKey:PlanID;constraint:OnDelete:RESTRICT" json:"plan,omitempty"`
+	Quantity           float64                `gorm:"default:1" json:"quantity"`
+	Status             SubscriptionStatus     `gorm:"type:varchar(20);index" json:"status"`
+	StartDate          time.Time              `json:"start_date"`
+	TrialEndsAt        *time.Time             `json:"trial_ends_at,omitempty"`
+	CurrentPeriodStart *time.Time             `json:"current_period_start,omitempty"`
+	CurrentPeriodEnd   *time.Time             `json:"current_period_end,omitempty"`
+	NextBillingDate    *time.Time             `gorm:"index" json:"next_billing_date,omitempty"`
+	PendingPlanID      *string                `gorm:"size:36" json:"pending_plan_id,omitempty"`
+	PendingPlan        *SubscriptionPlanModel `gorm:"foreignKey:PendingPlanID;constraint:OnDelete:SET NULL" json:"pending_plan,omitempty"`
+	PendingQuantity    float64                `json:"pending_quantity,omitempty"`
+	CreditBalance      float64                `json:"credit_balance"`
+	CancelAtPeriodEnd  bool                   `json:"cancel_at_period_end"`
+	CancelledAt        *time.Time             `json:"cancelled_at,omitempty"`
+	CancelReason       string                 `json:"cancel_reason,omitempty"`
+	PausedAt           *time.Time             `json:"paused_at,omitempty"`
+	ResumeAt           *time.Time             `json:"resume_at,omitempty"`
+	AutoCharge         bool                   `gorm:"default:false" json:"auto_charge"` // coba tagih otomatis melalui payment provider
+	Notes              string                 `json:"notes"`
+	UserID             *string                `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (SubscriptionModel) TableName() string {
+	return "subscriptions"
+}
+
+func (s *SubscriptionModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// SubscriptionInvoiceModel menghubungkan faktur penjualan dengan periode langganan dan
+// mencatat upaya penagihannya (dunning).
+type SubscriptionInvoiceModel struct {
+	shared.BaseModel
+	SubscriptionID  string             `gorm:"type:char(36);index" json:"subscription_id"`
+	Subscription    *SubscriptionModel `gorm:"foreignKey:SubscriptionID;constraint:OnDelete:CASCADE" json:"subscription,omitempty"`
+	CompanyID       *string            `gorm:"size:36;index" json:"company_id,omitempty"`
+	SalesID         string             `gorm:"type:char(36);index" json:"sales_id"`
+	Sales           *SalesModel        `gorm:"foreignKey:SalesID;constraint:OnDelete:CASCADE" json:"sales,omitempty"`
+	Type            string             `gorm:"type:varchar(20)" json:"type"` // RECURRING, PRORATION
+	PeriodStart     time.Time          `json:"period_start"`
+	PeriodEnd       time.Time          `json:"period_end"`
+	Amount          float64            `json:"amount"`
+	Status          string             `gorm:"type:varchar(20);index;default:'OPEN'" json:"status"` // OPEN, PAID, FAILED, VOID
+	DueDate         time.Time          `json:"due_date"`
+	Attempts        int                `json:"attempts"`
+	LastAttemptAt   *time.Time         `json:"last_attempt_at,omitempty"`
+	NextRetryAt     *time.Time         `gorm:"index" json:"next_retry_at,omitempty"`
+	LastError       string             `json:"last_error,omitempty"`
+	PaymentResponse json.RawMessage    `gorm:"type:JSON" json:"payment_response,omitempty"`
+	PaidAt          *time.Time         `json:"paid_at,omitempty"`
+}
+
+func (SubscriptionInvoiceModel) TableName() string {
+	return "subscription_invoices"
+}
+
+func (s *SubscriptionInvoiceModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
+
+// SubscriptionEventModel adalah riwayat perubahan langganan untuk laporan MRR dan churn.
+//
+// MRRDelta adalah perubahan nilai bulanan langganan; ActiveDelta adalah perubahan jumlah
+// langganan aktif (+1 aktif, -1 berhenti).
+type SubscriptionEventModel struct {
+	shared.BaseModel
+	SubscriptionID string                `gorm:"type:char(36);index" json:"subscription_id"`
+	CompanyID      *string               `gorm:"size:36;index" json:"company_id,omitempty"`
+	ContactID      string                `gorm:"type:char(36)" json:"contact_id"`
+	Type           SubscriptionEventType `gorm:"type:varchar(30);index" json:"type"`
+	Date           time.Time             `gorm:"index" json:"date"`
+	FromPlanID     *string               `gorm:"size:36" json:"from_plan_id,omitempty"`
+	ToPlanID       *string               `gorm:"size:36" json:"to_plan_id,omitempty"`
+	MRRDelta       float64               `json:"mrr_delta"`
+	ActiveDelta    int                   `json:"active_delta"`
+	Notes          string                `json:"notes"`
+	UserID         *string               `gorm:"size:36" json:"user_id,omitempty"`
+}
+
+func (SubscriptionEventModel) TableName() string {
+	return "subscription_events"
+}
+
+func (s *SubscriptionEventModel) BeforeCreate(tx *gorm.DB) (err error) {
+	if s.ID == "" {
+		tx.Statement.SetColumn("id", uuid.New().String())
+	}
+	return
+}
@@ -95,6 +95,7 @@ type OyCreatePaymentVACallback struct {
 type OyCreatePaymentEWalletCallback struct {
 	Success            bool    `json:"success"`
 	TrxID              string  `json:"trx_id"`
+	PartnerTrxID       string  `json:"partner_trx_id"`
 	CustomerID         string  `json:"customer_id"`
 	Amount             float64 `json:"amount"`
 	EwalletCode        string  `json:"ewallet_code"`
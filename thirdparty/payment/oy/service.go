@@ -20,6 +20,8 @@ type OyPaymentService struct {
 	APIKey      string
 	Environment objects.EnvironmentType
 	BaseURL     string
+	// CallbackToken is the shared token carried by the callbacks of OY, see ParseWebhook.
+	CallbackToken string
 	// Add fields specific to OyPaymentService
 }
 
@@ -0,0 +1,337 @@
+package oy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+const (
+	// CallbackTokenHeader is the header carrying the callback token of OY callbacks.
+	CallbackTokenHeader = "X-Callback-Token"
+	// CallbackTokenQuery is the query parameter carrying the callback token when it is part of the
+	// callback URL registered at OY.
+	CallbackTokenQuery = "token"
+
+	oySuccessCode        = "000"
+	oyDateTimeLayout     = "2006-01-02 15:04:05"
+	defaultExpiryMinutes = 24 * 60
+	qrisOnlyDisabled     = "VA,CREDIT_CARD,EWALLET,BANK_TRANSFER"
+)
+
+var (
+	_ payment_provider.TypedPaymentProvider = (*OyPaymentService)(nil)
+	_ payment_provider.WebhookParser        = (*OyPaymentService)(nil)
+)
+
+// SetCallbackToken sets the token the callbacks of OY must carry.
+//
+// OY does not sign its callbacks, so the callback URL registered at OY carries a secret token,
+// either as the X-Callback-Token header or as the token query parameter, which ParseWebhook
+// compares with this token.
+func (o *OyPaymentService) SetCallbackToken(token string) {
+	o.CallbackToken = token
+}
+
+// CreatePayment creates a VA, e-wallet, QRIS or payment link payment.
+//
+// QRIS payments are payment links with every other payment method disabled. The reference ID
+// of the request is sent as the partner transaction ID, which OY sends back in its callbacks.
+func (o *OyPaymentService) CreatePayment(req payment_provider.PaymentRequest) (*payment_provider.PaymentResponse, error) {
+	amount := int64(math.Round(req.Amount))
+	expiryMinutes := int64(defaultExpiryMinutes)
+	if req.ExpiresAt != nil {
+		expiryMinutes = int64(math.Ceil(time.Until(*req.ExpiresAt).Minutes()))
+		if expiryMinutes < 1 {
+			return nil, errors.New("payment expiry is in the past")
+		}
+	}
+	expiresAt := time.Now().Add(time.Duration(expiryMinutes) * time.Minute)
+
+	switch req.Method {
+	case payment_provider.PaymentMethodVA:
+		customerID := req.CustomerID
+		if customerID == "" {
+			customerID = req.ReferenceID
+		}
+		resp, err := o.CreatePaymentVA(OyCreatePaymentVARequest{
+			PartnerUserID:     customerID,
+			BankCode:          req.BankCode,
+			Amount:            amount,
+			IsSingleUse:       true,
+			ExpirationTime:    expiryMinutes,
+			UsernameDisplay:   req.CustomerName,
+			Email:             req.Email,
+			TrxExpirationTime: expiryMinutes,
+			PartnerTrxID:      req.ReferenceID,
+			TrxCounter:        1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		va := resp.(OyCreatePaymentVAResponse)
+		if va.Status.Code != oySuccessCode {
+			return nil, fmt.Errorf("oy: %s", va.Status.Message)
+		}
+		return &payment_provider.PaymentResponse{
+			ProviderRef: va.ID,
+			ReferenceID: req.ReferenceID,
+			Method:      req.Method,
+			Status:      oyStatus(va.VAStatus),
+			Amount:      va.Amount,
+			VANumber:    va.VANumber,
+			BankCode:    va.BankCode,
+			ExpiresAt:   &expiresAt,
+			Raw:         va,
+		}, nil
+	case payment_provider.PaymentMethodEWallet:
+		resp, err := o.CreatePaymentEWallet(OyCreatePaymentEWalletRequest{
+			CustomerID:         req.CustomerID,
+			PartnerTxID:        req.ReferenceID,
+			Amount:             amount,
+			Email:              req.Email,
+			EwalletCode:        req.EWalletCode,
+			MobileNumber:       req.Phone,
+			SuccessRedirectURL: req.SuccessRedirectURL,
+			ExpirationTime:     int(expiryMinutes),
+		})
+		if err != nil {
+			return nil, err
+		}
+		ewallet := resp.(OyCreatePaymentEWalletResponse)
+		if ewallet.Status.Code != oySuccessCode {
+			return nil, fmt.Errorf("oy: %s", ewallet.Status.Message)
+		}
+		return &payment_provider.PaymentResponse{
+			ProviderRef: ewallet.TrxID,
+			ReferenceID: req.ReferenceID,
+			Method:      req.Method,
+			Status:      oyStatus(ewallet.EwalletTrxStatus),
+			Amount:      float64(ewallet.Amount),
+			PaymentURL:  ewallet.EwalletURL,
+			ExpiresAt:   &expiresAt,
+			Raw:         ewallet,
+		}, nil
+	case payment_provider.PaymentMethodLink, payment_provider.PaymentMethodQRIS:
+		link := OyCreatePaymentLinkRequest{
+			Description: req.Description,
+			PartnerTxID: req.ReferenceID,
+			SenderName:  req.CustomerName,
+			Amount:      amount,
+			Email:       req.Email,
+			PhoneNumber: req.Phone,
+			Expiration:  expiresAt.Format(oyDateTimeLayout),
+		}
+		if req.Method == payment_provider.PaymentMethodQRIS {
+			link.ListDisabledPayment = qrisOnlyDisabled
+		}
+		resp, err := o.CreatePaymentLink(link)
+		if err != nil {
+			return nil, err
+		}
+		created := resp.(OyCreatePaymentLinkResponse)
+		if !created.Status {
+			return nil, fmt.Errorf("oy: %s", created.Message)
+		}
+		return &payment_provider.PaymentResponse{
+			ProviderRef: created.PaymentLinkID,
+			ReferenceID: req.ReferenceID,
+			Method:      req.Method,
+			Status:      models.PaymentStatusPending,
+			Amount:      float64(amount),
+			PaymentURL:  created.URL,
+			ExpiresAt:   &expiresAt,
+			Raw:         created,
+		}, nil
+	}
+	return nil, fmt.Errorf("payment method %s is not supported", req.Method)
+}
+
+// GetPayment looks up a payment at OY. VA payments are looked up by the VA ID of OY, e-wallet
+// and payment link payments by our reference.
+func (o *OyPaymentService) GetPayment(method payment_provider.PaymentMethod, providerRef, referenceID string) (*payment_provider.PaymentResponse, error) {
+	switch method {
+	case payment_provider.PaymentMethodVA:
+		resp, err := o.DetailPaymentVA([]interface{}{providerRef})
+		if err != nil {
+			return nil, err
+		}
+		va := resp.(OyCreatePaymentVAResponse)
+		if va.Status.Code != oySuccessCode {
+			return nil, fmt.Errorf("oy: %s", va.Status.Message)
+		}
+		status := oyStatus(va.VAStatus)
+		paid := 0.0
+		if status == models.PaymentStatusPaid {
+			paid = va.Amount
+		}
+		return &payment_provider.PaymentResponse{
+			ProviderRef: va.ID,
+			ReferenceID: va.PartnerTrxID,
+			Method:      method,
+			Status:      status,
+			Amount:      va.Amount,
+			PaidAmount:  paid,
+			VANumber:    va.VANumber,
+			BankCode:    va.BankCode,
+			Raw:         va,
+		}, nil
+	case payment_provider.PaymentMethodEWallet:
+		resp, err := o.DetailPaymentEWallet([]interface{}{referenceID})
+		if err != nil {
+			return nil, err
+		}
+		ewallet := resp.(OyCreatePaymentEWalletResponse)
+		if ewallet.Status.Code != oySuccessCode {
+			return nil, fmt.Errorf("oy: %s", ewallet.Status.Message)
+		}
+		status := oyStatus(ewallet.EwalletTrxStatus)
+		paid := 0.0
+		if status == models.PaymentStatusPaid {
+			paid = float64(ewallet.Amount)
+		}
+		return &payment_provider.PaymentResponse{
+			ProviderRef: ewallet.TrxID,
+			ReferenceID: ewallet.PartnerTxID,
+			Method:      method,
+			Status:      status,
+			Amount:      float64(ewallet.Amount),
+			PaidAmount:  paid,
+			PaymentURL:  ewallet.EwalletURL,
+			Raw:         ewallet,
+		}, nil
+	case payment_provider.PaymentMethodLink, payment_provider.PaymentMethodQRIS:
+		resp, err := o.DetailPayment([]interface{}{referenceID, false})
+		if err != nil {
+			return nil, err
+		}
+		detail := resp.(OyPaymentResponse)
+		if !detail.Success {
+			return nil, fmt.Errorf("oy: %v", detail.Reason)
+		}
+		return &payment_provider.PaymentResponse{
+			ProviderRef: detail.Data.TxRefNumber,
+			ReferenceID: detail.Data.PartnerTxID,
+			Method:      method,
+			Status:      oyStatus(detail.Data.Status),
+			Amount:      detail.Data.Amount,
+			PaidAmount:  detail.Data.PaidAmount,
+			PaidAt:      parseOyTime(detail.Data.PaymentReceivedTime),
+			Raw:         detail,
+		}, nil
+	}
+	return nil, fmt.Errorf("payment method %s is not supported", method)
+}
+
+// ParseWebhook verifies and parses a payment link, VA or e-wallet callback of OY.
+//
+// OY has no event ID, so the event ID is the transaction reference of OY with the reported
+// status: a retried callback maps to the same event while a later status change does not.
+func (o *OyPaymentService) ParseWebhook(req payment_provider.WebhookRequest) (*payment_provider.WebhookEvent, error) {
+	if o.CallbackToken == "" {
+		return nil, errors.New("oy callback token is not configured")
+	}
+	token := req.Header.Get(CallbackTokenHeader)
+	if token == "" && req.Query != nil {
+		token = req.Query.Get(CallbackTokenQuery)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(o.CallbackToken)) != 1 {
+		return nil, payment_provider.ErrInvalidCallbackToken
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(req.Body, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["partner_tx_id"]; ok {
+		var callback OyCallback
+		if err := json.Unmarshal(req.Body, &callback); err != nil {
+			return nil, err
+		}
+		method := payment_provider.PaymentMethodLink
+		if strings.EqualFold(callback.PaymentMethod, "QRIS") {
+			method = payment_provider.PaymentMethodQRIS
+		}
+		status := oyStatus(callback.Status)
+		return &payment_provider.WebhookEvent{
+			EventID:     fmt.Sprintf("%s:%s", callback.TxRefNumber, status),
+			ProviderRef: callback.TxRefNumber,
+			ReferenceID: callback.PartnerTxID,
+			Method:      method,
+			Status:      status,
+			Amount:      callback.PaidAmount,
+			PaidAt:      parseOyTime(callback.PaymentReceivedTime),
+		}, nil
+	}
+	if _, ok := fields["va_number"]; ok {
+		var callback OyCreatePaymentVACallback
+		if err := json.Unmarshal(req.Body, &callback); err != nil {
+			return nil, err
+		}
+		status := models.PaymentStatusFailed
+		if callback.Success {
+			status = models.PaymentStatusPaid
+		}
+		return &payment_provider.WebhookEvent{
+			EventID:     fmt.Sprintf("%s:%s", callback.TrxID, status),
+			ProviderRef: callback.TrxID,
+			ReferenceID: callback.PartnerTrxID,
+			Method:      payment_provider.PaymentMethodVA,
+			Status:      status,
+			Amount:      callback.Amount,
+			PaidAt:      parseOyTime(callback.TxDate),
+		}, nil
+	}
+	var callback OyCreatePaymentEWalletCallback
+	if err := json.Unmarshal(req.Body, &callback); err != nil {
+		return nil, err
+	}
+	if callback.TrxID == "" {
+		return nil, errors.New("unknown oy callback")
+	}
+	status := models.PaymentStatusFailed
+	if callback.Success {
+		status = models.PaymentStatusPaid
+	}
+	return &payment_provider.WebhookEvent{
+		EventID:     fmt.Sprintf("%s:%s", callback.TrxID, status),
+		ProviderRef: callback.TrxID,
+		ReferenceID: callback.PartnerTrxID,
+		Method:      payment_provider.PaymentMethodEWallet,
+		Status:      status,
+		Amount:      callback.Amount,
+	}, nil
+}
+
+// oyStatus maps the transaction statuses of OY to payment statuses.
+func oyStatus(status string) string {
+	switch strings.ToUpper(status) {
+	case "COMPLETE", "SUCCESS", "PAID":
+		return models.PaymentStatusPaid
+	case "EXPIRED", "STATIC_TRX_EXPIRED":
+		return models.PaymentStatusExpired
+	case "FAILED", "DECLINED":
+		return models.PaymentStatusFailed
+	case "REFUNDED":
+		return models.PaymentStatusRefunded
+	}
+	return models.PaymentStatusPending
+}
+
+func parseOyTime(value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	t, err := time.ParseInLocation(oyDateTimeLayout, value, time.Local)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
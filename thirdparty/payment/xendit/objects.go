@@ -66,3 +66,186 @@ type XenditGetQRPaymentResponse struct {
 	Data    []XenditQRPayment `json:"data"`
 	HasMore bool              `json:"has_more"`
 }
+
+// XenditError is the error body of the Xendit API.
+type XenditError struct {
+	ErrorCode string `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+type XenditCustomer struct {
+	GivenNames   string `json:"given_names,omitempty"`
+	Email        string `json:"email,omitempty"`
+	MobileNumber string `json:"mobile_number,omitempty"`
+}
+
+type XenditInvoiceRequest struct {
+	ExternalID         string          `json:"external_id"`
+	Amount             float64         `json:"amount"`
+	PayerEmail         string          `json:"payer_email,omitempty"`
+	Description        string          `json:"description,omitempty"`
+	InvoiceDuration    int64           `json:"invoice_duration,omitempty"` // in seconds
+	Customer           *XenditCustomer `json:"customer,omitempty"`
+	SuccessRedirectURL string          `json:"success_redirect_url,omitempty"`
+	FailureRedirectURL string          `json:"failure_redirect_url,omitempty"`
+	Currency           string          `json:"currency,omitempty"`
+	PaymentMethods     []string        `json:"payment_methods,omitempty"`
+	Metadata           map[string]any  `json:"metadata,omitempty"`
+}
+
+type XenditInvoice struct {
+	ID                     string  `json:"id"`
+	ExternalID             string  `json:"external_id"`
+	UserID                 string  `json:"user_id"`
+	Status                 string  `json:"status"` // PENDING, PAID, SETTLED, EXPIRED
+	MerchantName           string  `json:"merchant_name"`
+	Amount                 float64 `json:"amount"`
+	PaidAmount             float64 `json:"paid_amount"`
+	FeesPaidAmount         float64 `json:"fees_paid_amount"`
+	AdjustedReceivedAmount float64 `json:"adjusted_received_amount"`
+	PayerEmail             string  `json:"payer_email"`
+	Description            string  `json:"description"`
+	InvoiceURL             string  `json:"invoice_url"`
+	ExpiryDate             string  `json:"expiry_date"`
+	PaidAt                 string  `json:"paid_at"`
+	PaymentMethod          string  `json:"payment_method"`
+	PaymentChannel         string  `json:"payment_channel"`
+	PaymentDestination     string  `json:"payment_destination"`
+	Currency               string  `json:"currency"`
+	Created                string  `json:"created"`
+	Updated                string  `json:"updated"`
+}
+
+type XenditVARequest struct {
+	ExternalID     string  `json:"external_id"`
+	BankCode       string  `json:"bank_code"` // BCA, BNI, BRI, MANDIRI, PERMATA, BSI, CIMB, ...
+	Name           string  `json:"name"`
+	ExpectedAmount float64 `json:"expected_amount,omitempty"`
+	IsClosed       bool    `json:"is_closed"`
+	IsSingleUse    bool    `json:"is_single_use"`
+	ExpirationDate string  `json:"expiration_date,omitempty"` // RFC3339
+	Description    string  `json:"description,omitempty"`
+}
+
+type XenditVA struct {
+	ID             string  `json:"id"`
+	OwnerID        string  `json:"owner_id"`
+	ExternalID     string  `json:"external_id"`
+	BankCode       string  `json:"bank_code"`
+	MerchantCode   string  `json:"merchant_code"`
+	Name           string  `json:"name"`
+	AccountNumber  string  `json:"account_number"`
+	ExpectedAmount float64 `json:"expected_amount"`
+	IsClosed       bool    `json:"is_closed"`
+	IsSingleUse    bool    `json:"is_single_use"`
+	ExpirationDate string  `json:"expiration_date"`
+	Status         string  `json:"status"` // PENDING, ACTIVE, INACTIVE
+	Currency       string  `json:"currency"`
+	Created        string  `json:"created"`
+	Updated        string  `json:"updated"`
+}
+
+// XenditVAPayment is the callback of a payment into a virtual account.
+type XenditVAPayment struct {
+	ID                       string  `json:"id"`
+	PaymentID                string  `json:"payment_id"`
+	CallbackVirtualAccountID string  `json:"callback_virtual_account_id"`
+	OwnerID                  string  `json:"owner_id"`
+	ExternalID               string  `json:"external_id"`
+	AccountNumber            string  `json:"account_number"`
+	BankCode                 string  `json:"bank_code"`
+	Amount                   float64 `json:"amount"`
+	TransactionTimestamp     string  `json:"transaction_timestamp"`
+	MerchantCode             string  `json:"merchant_code"`
+	Created                  string  `json:"created"`
+	Updated                  string  `json:"updated"`
+}
+
+type XenditEWalletChannelProperties struct {
+	MobileNumber       string `json:"mobile_number,omitempty"`
+	SuccessRedirectURL string `json:"success_redirect_url,omitempty"`
+	FailureRedirectURL string `json:"failure_redirect_url,omitempty"`
+}
+
+type XenditEWalletChargeRequest struct {
+	ReferenceID       string                         `json:"reference_id"`
+	Currency          string                         `json:"currency"`
+	Amount            float64                        `json:"amount"`
+	CheckoutMethod    string                         `json:"checkout_method"`
+	ChannelCode       string                         `json:"channel_code"` // ID_OVO, ID_DANA, ID_SHOPEEPAY, ID_LINKAJA, ...
+	ChannelProperties XenditEWalletChannelProperties `json:"channel_properties"`
+	Metadata          map[string]any                 `json:"metadata,omitempty"`
+}
+
+type XenditEWalletCharge struct {
+	ID                 string  `json:"id"`
+	BusinessID         string  `json:"business_id"`
+	ReferenceID        string  `json:"reference_id"`
+	Status             string  `json:"status"` // PENDING, SUCCEEDED, FAILED, VOIDED, REFUNDED
+	Currency           string  `json:"currency"`
+	ChargeAmount       float64 `json:"charge_amount"`
+	CaptureAmount      float64 `json:"capture_amount"`
+	RefundedAmount     float64 `json:"refunded_amount"`
+	CheckoutMethod     string  `json:"checkout_method"`
+	ChannelCode        string  `json:"channel_code"`
+	FailureCode        string  `json:"failure_code"`
+	IsRedirectRequired bool    `json:"is_redirect_required"`
+	Actions            struct {
+		DesktopWebCheckoutURL     string `json:"desktop_web_checkout_url"`
+		MobileWebCheckoutURL      string `json:"mobile_web_checkout_url"`
+		MobileDeeplinkCheckoutURL string `json:"mobile_deeplink_checkout_url"`
+		QRCheckoutString          string `json:"qr_checkout_string"`
+	} `json:"actions"`
+	Created string `json:"created"`
+	Updated string `json:"updated"`
+}
+
+type XenditRefundRequest struct {
+	ReferenceID string  `json:"reference_id,omitempty"`
+	InvoiceID   string  `json:"invoice_id,omitempty"`
+	Amount      float64 `json:"amount,omitempty"`
+	Reason      string  `json:"reason"` // REQUESTED_BY_CUSTOMER, CANCELLATION, DUPLICATE, FRAUDULENT, OTHERS
+	Currency    string  `json:"currency,omitempty"`
+}
+
+type XenditRefund struct {
+	ID               string  `json:"id"`
+	PaymentID        string  `json:"payment_id"`
+	InvoiceID        string  `json:"invoice_id"`
+	ChargeID         string  `json:"charge_id"` // e-wallet refunds
+	PaymentRequestID string  `json:"payment_request_id"`
+	ReferenceID      string  `json:"reference_id"`
+	Amount           float64 `json:"amount"`
+	RefundAmount     float64 `json:"refund_amount"` // e-wallet refunds
+	Currency         string  `json:"currency"`
+	Status           string  `json:"status"` // PENDING, SUCCEEDED, FAILED
+	Reason           string  `json:"reason"`
+	FailureCode      string  `json:"failure_code"`
+	Created          string  `json:"created"`
+	Updated          string  `json:"updated"`
+}
+
+type XenditDisbursementRequest struct {
+	ExternalID        string   `json:"external_id"`
+	BankCode          string   `json:"bank_code"`
+	AccountHolderName string   `json:"account_holder_name"`
+	AccountNumber     string   `json:"account_number"`
+	Description       string   `json:"description"`
+	Amount            float64  `json:"amount"`
+	EmailTo           []string `json:"email_to,omitempty"`
+}
+
+type XenditDisbursement struct {
+	ID                      string  `json:"id"`
+	UserID                  string  `json:"user_id"`
+	ExternalID              string  `json:"external_id"`
+	Amount                  float64 `json:"amount"`
+	BankCode                string  `json:"bank_code"`
+	AccountHolderName       string  `json:"account_holder_name"`
+	DisbursementDescription string  `json:"disbursement_description"`
+	Status                  string  `json:"status"` // PENDING, COMPLETED, FAILED
+	FailureCode             string  `json:"failure_code"`
+	IsInstant               bool    `json:"is_instant"`
+	Created                 string  `json:"created"`
+	Updated                 string  `json:"updated"`
+}
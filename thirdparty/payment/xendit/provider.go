@@ -0,0 +1,531 @@
+package xendit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+const (
+	defaultCurrency  = "IDR"
+	defaultExpiry    = 24 * time.Hour
+	idempotencyKey   = "X-IDEMPOTENCY-KEY"
+	refundReason     = "REQUESTED_BY_CUSTOMER"
+	oneTimeCheckout  = "ONE_TIME_PAYMENT"
+	dynamicQRType    = "DYNAMIC"
+	qrPaymentSuccess = "SUCCEEDED"
+)
+
+var (
+	_ payment_provider.PaymentProvider      = (*XenditService)(nil)
+	_ payment_provider.TypedPaymentProvider = (*XenditService)(nil)
+	_ payment_provider.WebhookParser        = (*XenditService)(nil)
+	_ payment_provider.RefundProvider       = (*XenditService)(nil)
+	_ payment_provider.DisbursementProvider = (*XenditService)(nil)
+)
+
+// CreatePaymentLink creates a Xendit invoice. dataPayment must be a XenditInvoiceRequest; the
+// response is a XenditInvoice.
+func (s *XenditService) CreatePaymentLink(dataPayment interface{}) (interface{}, error) {
+	data, ok := dataPayment.(XenditInvoiceRequest)
+	if !ok {
+		return nil, fmt.Errorf("invalid data type")
+	}
+	return s.CreateInvoice(data)
+}
+
+// CreatePaymentVA creates a closed, single use Xendit virtual account. dataPayment must be a
+// XenditVARequest; the response is a XenditVA.
+func (s *XenditService) CreatePaymentVA(dataPayment interface{}) (interface{}, error) {
+	data, ok := dataPayment.(XenditVARequest)
+	if !ok {
+		return nil, fmt.Errorf("invalid data type")
+	}
+	return s.CreateVA(data)
+}
+
+// CreatePaymentEWallet creates a Xendit e-wallet charge. dataPayment must be a
+// XenditEWalletChargeRequest; the response is a XenditEWalletCharge.
+func (s *XenditService) CreatePaymentEWallet(dataPayment interface{}) (interface{}, error) {
+	data, ok := dataPayment.(XenditEWalletChargeRequest)
+	if !ok {
+		return nil, fmt.Errorf("invalid data type")
+	}
+	return s.CreateEWalletCharge(data)
+}
+
+// DetailPayment retrieves a Xendit invoice. The first element of data must be a slice of
+// interfaces holding the invoice ID.
+func (s *XenditService) DetailPayment(data ...interface{}) (interface{}, error) {
+	id, err := firstID(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetInvoice(id)
+}
+
+// DetailPaymentVA retrieves a Xendit virtual account. The first element of data must be a slice
+// of interfaces holding the virtual account ID.
+func (s *XenditService) DetailPaymentVA(data ...interface{}) (interface{}, error) {
+	id, err := firstID(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetVA(id)
+}
+
+// DetailPaymentEWallet retrieves a Xendit e-wallet charge. The first element of data must be a
+// slice of interfaces holding the charge ID.
+func (s *XenditService) DetailPaymentEWallet(data ...interface{}) (interface{}, error) {
+	id, err := firstID(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetEWalletCharge(id)
+}
+
+// CreateInvoice creates an invoice, a hosted payment page accepting every payment method enabled
+// on the Xendit account.
+func (s *XenditService) CreateInvoice(req XenditInvoiceRequest) (*XenditInvoice, error) {
+	var response XenditInvoice
+	err := s.call("POST", "/v2/invoices", req, &response, nil)
+	return &response, err
+}
+
+// GetInvoice retrieves an invoice by its ID.
+func (s *XenditService) GetInvoice(id string) (*XenditInvoice, error) {
+	var response XenditInvoice
+	err := s.call("GET", "/v2/invoices/"+id, nil, &response, nil)
+	return &response, err
+}
+
+// CreateVA creates a fixed virtual account.
+func (s *XenditService) CreateVA(req XenditVARequest) (*XenditVA, error) {
+	var response XenditVA
+	err := s.call("POST", "/callback_virtual_accounts", req, &response, nil)
+	return &response, err
+}
+
+// GetVA retrieves a fixed virtual account by its ID.
+func (s *XenditService) GetVA(id string) (*XenditVA, error) {
+	var response XenditVA
+	err := s.call("GET", "/callback_virtual_accounts/"+id, nil, &response, nil)
+	return &response, err
+}
+
+// CreateEWalletCharge creates an e-wallet charge.
+func (s *XenditService) CreateEWalletCharge(req XenditEWalletChargeRequest) (*XenditEWalletCharge, error) {
+	var response XenditEWalletCharge
+	err := s.call("POST", "/ewallets/charges", req, &response, nil)
+	return &response, err
+}
+
+// GetEWalletCharge retrieves an e-wallet charge by its ID.
+func (s *XenditService) GetEWalletCharge(id string) (*XenditEWalletCharge, error) {
+	var response XenditEWalletCharge
+	err := s.call("GET", "/ewallets/charges/"+id, nil, &response, nil)
+	return &response, err
+}
+
+// CreateRefund refunds a paid invoice, fully or partially.
+func (s *XenditService) CreateRefund(req XenditRefundRequest) (*XenditRefund, error) {
+	var response XenditRefund
+	err := s.call("POST", "/refunds", req, &response, nil)
+	return &response, err
+}
+
+// CreateEWalletRefund refunds a succeeded e-wallet charge, fully or partially.
+func (s *XenditService) CreateEWalletRefund(chargeID string, amount float64, reason string) (*XenditRefund, error) {
+	var response XenditRefund
+	err := s.call("POST", fmt.Sprintf("/ewallets/charges/%s/refunds", chargeID), map[string]any{
+		"amount": amount,
+		"reason": reason,
+	}, &response, nil)
+	return &response, err
+}
+
+// CreateDisbursement pays out money to a bank account. The external ID is sent as idempotency
+// key so that a retried request does not pay twice.
+func (s *XenditService) CreateDisbursement(req XenditDisbursementRequest) (*XenditDisbursement, error) {
+	var response XenditDisbursement
+	err := s.call("POST", "/disbursements", req, &response, map[string]string{idempotencyKey: req.ExternalID})
+	return &response, err
+}
+
+// GetDisbursementByID retrieves a disbursement by its ID.
+func (s *XenditService) GetDisbursementByID(id string) (*XenditDisbursement, error) {
+	var response XenditDisbursement
+	err := s.call("GET", "/disbursements/"+id, nil, &response, nil)
+	return &response, err
+}
+
+// CreatePayment creates an invoice (payment link), fixed virtual account, e-wallet charge or
+// dynamic QRIS code. The reference ID of the request is sent as the external / reference ID,
+// which Xendit sends back in its callbacks.
+func (s *XenditService) CreatePayment(req payment_provider.PaymentRequest) (*payment_provider.PaymentResponse, error) {
+	currency := req.Currency
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	expiresAt := time.Now().Add(defaultExpiry)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			return nil, errors.New("payment expiry is in the past")
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	switch req.Method {
+	case payment_provider.PaymentMethodLink:
+		invoice, err := s.CreateInvoice(XenditInvoiceRequest{
+			ExternalID:      req.ReferenceID,
+			Amount:          req.Amount,
+			PayerEmail:      req.Email,
+			Description:     req.Description,
+			InvoiceDuration: int64(math.Ceil(time.Until(expiresAt).Seconds())),
+			Customer: &XenditCustomer{
+				GivenNames:   req.CustomerName,
+				Email:        req.Email,
+				MobileNumber: req.Phone,
+			},
+			SuccessRedirectURL: req.SuccessRedirectURL,
+			FailureRedirectURL: req.FailureRedirectURL,
+			Currency:           currency,
+			Metadata:           req.Metadata,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return invoiceResponse(invoice), nil
+	case payment_provider.PaymentMethodVA:
+		va, err := s.CreateVA(XenditVARequest{
+			ExternalID:     req.ReferenceID,
+			BankCode:       req.BankCode,
+			Name:           req.CustomerName,
+			ExpectedAmount: req.Amount,
+			IsClosed:       true,
+			IsSingleUse:    true,
+			ExpirationDate: expiresAt.UTC().Format(time.RFC3339),
+			Description:    req.Description,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return vaResponse(va), nil
+	case payment_provider.PaymentMethodEWallet:
+		charge, err := s.CreateEWalletCharge(XenditEWalletChargeRequest{
+			ReferenceID:    req.ReferenceID,
+			Currency:       currency,
+			Amount:         req.Amount,
+			CheckoutMethod: oneTimeCheckout,
+			ChannelCode:    req.EWalletCode,
+			ChannelProperties: XenditEWalletChannelProperties{
+				MobileNumber:       req.Phone,
+				SuccessRedirectURL: req.SuccessRedirectURL,
+				FailureRedirectURL: req.FailureRedirectURL,
+			},
+			Metadata: req.Metadata,
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp := chargeResponse(charge)
+		resp.ExpiresAt = &expiresAt
+		return resp, nil
+	case payment_provider.PaymentMethodQRIS:
+		qr, err := s.CreateQR(XenditQRrequest{
+			ReferenceID: req.ReferenceID,
+			Type:        dynamicQRType,
+			Currency:    currency,
+			Amount:      req.Amount,
+			ExpiresAt:   expiresAt.UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if qr.ID == "" {
+			return nil, errors.New("xendit: QR code was not created")
+		}
+		return &payment_provider.PaymentResponse{
+			ProviderRef: qr.ID,
+			ReferenceID: qr.ReferenceID,
+			Method:      req.Method,
+			Status:      models.PaymentStatusPending,
+			Amount:      qr.Amount,
+			QRString:    qr.QRString,
+			ExpiresAt:   parseXenditTime(qr.ExpiresAt),
+			Raw:         qr,
+		}, nil
+	}
+	return nil, fmt.Errorf("payment method %s is not supported", req.Method)
+}
+
+// GetPayment looks up a payment by the ID of its invoice, virtual account, e-wallet charge or QR
+// code.
+//
+// A fixed virtual account does not report its payments; they are confirmed by the paid callback
+// of the virtual account, so a virtual account is only reported EXPIRED once it is inactive after
+// its expiration date.
+func (s *XenditService) GetPayment(method payment_provider.PaymentMethod, providerRef, referenceID string) (*payment_provider.PaymentResponse, error) {
+	switch method {
+	case payment_provider.PaymentMethodLink:
+		invoice, err := s.GetInvoice(providerRef)
+		if err != nil {
+			return nil, err
+		}
+		return invoiceResponse(invoice), nil
+	case payment_provider.PaymentMethodVA:
+		va, err := s.GetVA(providerRef)
+		if err != nil {
+			return nil, err
+		}
+		return vaResponse(va), nil
+	case payment_provider.PaymentMethodEWallet:
+		charge, err := s.GetEWalletCharge(providerRef)
+		if err != nil {
+			return nil, err
+		}
+		return chargeResponse(charge), nil
+	case payment_provider.PaymentMethodQRIS:
+		payments, err := s.GetQRPayments(providerRef)
+		if err != nil {
+			return nil, err
+		}
+		resp := &payment_provider.PaymentResponse{
+			ProviderRef: providerRef,
+			ReferenceID: referenceID,
+			Method:      method,
+			Status:      models.PaymentStatusPending,
+			Raw:         payments,
+		}
+		for _, v := range payments {
+			if v.Status == qrPaymentSuccess {
+				resp.Status = models.PaymentStatusPaid
+				resp.Amount = v.Amount
+				resp.PaidAmount = v.Amount
+				resp.PaidAt = parseXenditTime(v.Created)
+				break
+			}
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("payment method %s is not supported", method)
+}
+
+// RefundPayment refunds a paid invoice or e-wallet charge. Virtual account and QRIS payments
+// cannot be refunded through the API.
+func (s *XenditService) RefundPayment(req payment_provider.RefundRequest) (*payment_provider.RefundResponse, error) {
+	reason := req.Reason
+	if reason == "" {
+		reason = refundReason
+	}
+	var refund *XenditRefund
+	var err error
+	switch req.Method {
+	case payment_provider.PaymentMethodLink:
+		refund, err = s.CreateRefund(XenditRefundRequest{
+			ReferenceID: req.ReferenceID,
+			InvoiceID:   req.ProviderRef,
+			Amount:      req.Amount,
+			Reason:      reason,
+			Currency:    defaultCurrency,
+		})
+	case payment_provider.PaymentMethodEWallet:
+		refund, err = s.CreateEWalletRefund(req.ProviderRef, req.Amount, reason)
+	default:
+		return nil, fmt.Errorf("refund of %s payments is not supported", req.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	amount := refund.Amount
+	if amount == 0 {
+		amount = refund.RefundAmount
+	}
+	referenceID := refund.ReferenceID
+	if referenceID == "" {
+		referenceID = req.ReferenceID
+	}
+	return &payment_provider.RefundResponse{
+		ProviderRef: refund.ID,
+		ReferenceID: referenceID,
+		Status:      refundStatus(refund.Status),
+		Amount:      amount,
+		Raw:         refund,
+	}, nil
+}
+
+// Disburse pays out money to a bank account.
+func (s *XenditService) Disburse(req payment_provider.DisbursementRequest) (*payment_provider.DisbursementResponse, error) {
+	disbursement, err := s.CreateDisbursement(XenditDisbursementRequest{
+		ExternalID:        req.ReferenceID,
+		BankCode:          req.BankCode,
+		AccountHolderName: req.AccountHolderName,
+		AccountNumber:     req.AccountNumber,
+		Description:       req.Description,
+		Amount:            req.Amount,
+		EmailTo:           req.EmailTo,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disbursementResponse(disbursement), nil
+}
+
+// GetDisbursement looks a disbursement up by its Xendit ID.
+func (s *XenditService) GetDisbursement(providerRef string) (*payment_provider.DisbursementResponse, error) {
+	disbursement, err := s.GetDisbursementByID(providerRef)
+	if err != nil {
+		return nil, err
+	}
+	return disbursementResponse(disbursement), nil
+}
+
+// call sends a request to the Xendit API and decodes the response into out. Responses with an
+// error status are returned as errors holding the error code and message of Xendit.
+func (s *XenditService) call(method, path string, body any, out any, headers map[string]string) error {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewBuffer(jsonData)
+	}
+	httpReq, err := http.NewRequest(method, s.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("api-version", s.apiVersion)
+	for k, v := range headers {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.SetBasicAuth(s.apiKey, "")
+	client := &http.Client{}
+	client.Timeout = 30 * time.Second
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var xenditErr XenditError
+		if err := json.NewDecoder(resp.Body).Decode(&xenditErr); err != nil || xenditErr.ErrorCode == "" {
+			return fmt.Errorf("xendit: %s", resp.Status)
+		}
+		return fmt.Errorf("xendit: %s: %s", xenditErr.ErrorCode, xenditErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func firstID(data []interface{}) (string, error) {
+	if len(data) < 1 {
+		return "", fmt.Errorf("invalid data")
+	}
+	ids, ok := data[0].([]interface{})
+	if !ok || len(ids) < 1 {
+		return "", fmt.Errorf("invalid data")
+	}
+	id, ok := ids[0].(string)
+	if !ok {
+		return "", fmt.Errorf("invalid data")
+	}
+	return id, nil
+}
+
+func invoiceResponse(invoice *XenditInvoice) *payment_provider.PaymentResponse {
+	return &payment_provider.PaymentResponse{
+		ProviderRef: invoice.ID,
+		ReferenceID: invoice.ExternalID,
+		Method:      payment_provider.PaymentMethodLink,
+		Status:      xenditStatus(invoice.Status),
+		Amount:      invoice.Amount,
+		PaidAmount:  invoice.PaidAmount,
+		PaymentURL:  invoice.InvoiceURL,
+		ExpiresAt:   parseXenditTime(invoice.ExpiryDate),
+		PaidAt:      parseXenditTime(invoice.PaidAt),
+		Raw:         invoice,
+	}
+}
+
+func vaResponse(va *XenditVA) *payment_provider.PaymentResponse {
+	status := models.PaymentStatusPending
+	expiresAt := parseXenditTime(va.ExpirationDate)
+	if va.Status == "INACTIVE" && expiresAt != nil && expiresAt.Before(time.Now()) {
+		status = models.PaymentStatusExpired
+	}
+	return &payment_provider.PaymentResponse{
+		ProviderRef: va.ID,
+		ReferenceID: va.ExternalID,
+		Method:      payment_provider.PaymentMethodVA,
+		Status:      status,
+		Amount:      va.ExpectedAmount,
+		VANumber:    va.AccountNumber,
+		BankCode:    va.BankCode,
+		ExpiresAt:   expiresAt,
+		Raw:         va,
+	}
+}
+
+func chargeResponse(charge *XenditEWalletCharge) *payment_provider.PaymentResponse {
+	url := charge.Actions.MobileWebCheckoutURL
+	if url == "" {
+		url = charge.Actions.DesktopWebCheckoutURL
+	}
+	if url == "" {
+		url = charge.Actions.MobileDeeplinkCheckoutURL
+	}
+	resp := &payment_provider.PaymentResponse{
+		ProviderRef: charge.ID,
+		ReferenceID: charge.ReferenceID,
+		Method:      payment_provider.PaymentMethodEWallet,
+		Status:      xenditStatus(charge.Status),
+		Amount:      charge.ChargeAmount,
+		PaymentURL:  url,
+		QRString:    charge.Actions.QRCheckoutString,
+		Raw:         charge,
+	}
+	if resp.Status == models.PaymentStatusPaid || resp.Status == models.PaymentStatusRefunded {
+		resp.PaidAmount = charge.CaptureAmount
+		resp.PaidAt = parseXenditTime(charge.Updated)
+	}
+	return resp
+}
+
+func disbursementResponse(disbursement *XenditDisbursement) *payment_provider.DisbursementResponse {
+	status := payment_provider.DisbursementPending
+	switch disbursement.Status {
+	case "COMPLETED":
+		status = payment_provider.DisbursementCompleted
+	case "FAILED":
+		status = payment_provider.DisbursementFailed
+	}
+	return &payment_provider.DisbursementResponse{
+		ProviderRef:   disbursement.ID,
+		ReferenceID:   disbursement.ExternalID,
+		Status:        status,
+		Amount:        disbursement.Amount,
+		FailureReason: disbursement.FailureCode,
+		Raw:           disbursement,
+	}
+}
+
+func refundStatus(status string) string {
+	switch status {
+	case "SUCCEEDED", "COMPLETED":
+		return payment_provider.RefundSucceeded
+	case "FAILED", "CANCELLED":
+		return payment_provider.RefundFailed
+	}
+	return payment_provider.RefundPending
+}
@@ -9,9 +9,10 @@ import (
 )
 
 type XenditService struct {
-	apiKey     string
-	BaseURL    string
-	apiVersion string
+	apiKey        string
+	BaseURL       string
+	apiVersion    string
+	callbackToken string
 }
 
 // NewXenditService creates a new instance of XenditService with the default values:
@@ -0,0 +1,451 @@
+package xendit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+const (
+	testAPIKey        = "xnd_development_test"
+	testCallbackToken = "callback-token"
+)
+
+// stubRequest is a request received by the Xendit stand-in.
+type stubRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   map[string]any
+}
+
+// newStub starts a Xendit stand-in answering every request with the given status and body.
+func newStub(t *testing.T, status int, response string) (*XenditService, *[]stubRequest) {
+	t.Helper()
+	requests := []stubRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received := stubRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone()}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &received.Body); err != nil {
+				t.Errorf("request body is not JSON: %s", body)
+			}
+		}
+		requests = append(requests, received)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+
+	service := NewXenditService()
+	service.BaseURL = server.URL
+	service.SetAPIKey(testAPIKey)
+	service.SetCallbackToken(testCallbackToken)
+	return service, &requests
+}
+
+func lastRequest(t *testing.T, requests *[]stubRequest) stubRequest {
+	t.Helper()
+	if len(*requests) == 0 {
+		t.Fatal("no request was sent to xendit")
+	}
+	req := (*requests)[len(*requests)-1]
+	user, _, ok := (&http.Request{Header: req.Header}).BasicAuth()
+	if !ok || user != testAPIKey {
+		t.Errorf("request is not authenticated with the API key, got %q", user)
+	}
+	return req
+}
+
+func TestCreatePayment(t *testing.T) {
+	expiresAt := time.Now().Add(2 * time.Hour)
+	tests := []struct {
+		name        string
+		req         payment_provider.PaymentRequest
+		response    string
+		path        string
+		body        map[string]any
+		providerRef string
+		check       func(t *testing.T, resp *payment_provider.PaymentResponse)
+	}{
+		{
+			name: "payment link",
+			req: payment_provider.PaymentRequest{
+				ReferenceID: "PAY-1", Method: payment_provider.PaymentMethodLink, Amount: 150000,
+				Email: "buyer@example.com", CustomerName: "Budi", ExpiresAt: &expiresAt,
+			},
+			response:    `{"id":"inv-1","external_id":"PAY-1","status":"PENDING","amount":150000,"invoice_url":"https://checkout.xendit.co/web/inv-1","expiry_date":"2030-01-01T00:00:00Z"}`,
+			path:        "/v2/invoices",
+			body:        map[string]any{"external_id": "PAY-1", "amount": 150000.0, "currency": "IDR", "payer_email": "buyer@example.com"},
+			providerRef: "inv-1",
+			check: func(t *testing.T, resp *payment_provider.PaymentResponse) {
+				if resp.PaymentURL != "https://checkout.xendit.co/web/inv-1" {
+					t.Errorf("payment URL = %q", resp.PaymentURL)
+				}
+				if resp.ExpiresAt == nil {
+					t.Error("expiry date is not parsed")
+				}
+			},
+		},
+		{
+			name: "virtual account",
+			req: payment_provider.PaymentRequest{
+				ReferenceID: "PAY-2", Method: payment_provider.PaymentMethodVA, Amount: 250000,
+				CustomerName: "Budi", BankCode: "BNI",
+			},
+			response:    `{"id":"va-1","external_id":"PAY-2","bank_code":"BNI","account_number":"8808999912345","expected_amount":250000,"status":"PENDING","expiration_date":"2030-01-01T00:00:00Z"}`,
+			path:        "/callback_virtual_accounts",
+			body:        map[string]any{"external_id": "PAY-2", "bank_code": "BNI", "expected_amount": 250000.0, "is_closed": true, "is_single_use": true},
+			providerRef: "va-1",
+			check: func(t *testing.T, resp *payment_provider.PaymentResponse) {
+				if resp.VANumber != "8808999912345" || resp.BankCode != "BNI" {
+					t.Errorf("virtual account = %s %s", resp.BankCode, resp.VANumber)
+				}
+			},
+		},
+		{
+			name: "e-wallet",
+			req: payment_provider.PaymentRequest{
+				ReferenceID: "PAY-3", Method: payment_provider.PaymentMethodEWallet, Amount: 50000,
+				EWalletCode: "ID_DANA", SuccessRedirectURL: "https://shop.example.com/paid",
+			},
+			response:    `{"id":"ewc-1","reference_id":"PAY-3","status":"PENDING","charge_amount":50000,"actions":{"desktop_web_checkout_url":"https://dana.id/checkout/1"}}`,
+			path:        "/ewallets/charges",
+			body:        map[string]any{"reference_id": "PAY-3", "channel_code": "ID_DANA", "checkout_method": "ONE_TIME_PAYMENT", "amount": 50000.0},
+			providerRef: "ewc-1",
+			check: func(t *testing.T, resp *payment_provider.PaymentResponse) {
+				if resp.PaymentURL != "https://dana.id/checkout/1" {
+					t.Errorf("payment URL = %q", resp.PaymentURL)
+				}
+			},
+		},
+		{
+			name: "qris",
+			req: payment_provider.PaymentRequest{
+				ReferenceID: "PAY-4", Method: payment_provider.PaymentMethodQRIS, Amount: 75000,
+			},
+			response:    `{"id":"qr-1","reference_id":"PAY-4","type":"DYNAMIC","amount":75000,"qr_string":"00020101","status":"ACTIVE","expires_at":"2030-01-01T00:00:00Z"}`,
+			path:        "/qr_codes",
+			body:        map[string]any{"reference_id": "PAY-4", "type": "DYNAMIC", "currency": "IDR", "amount": 75000.0},
+			providerRef: "qr-1",
+			check: func(t *testing.T, resp *payment_provider.PaymentResponse) {
+				if resp.QRString != "00020101" {
+					t.Errorf("QR string = %q", resp.QRString)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, requests := newStub(t, http.StatusOK, tt.response)
+			resp, err := service.CreatePayment(tt.req)
+			if err != nil {
+				t.Fatalf("CreatePayment() error = %v", err)
+			}
+			req := lastRequest(t, requests)
+			if req.Method != http.MethodPost || req.Path != tt.path {
+				t.Errorf("request = %s %s, want POST %s", req.Method, req.Path, tt.path)
+			}
+			for k, v := range tt.body {
+				if req.Body[k] != v {
+					t.Errorf("request %s = %v, want %v", k, req.Body[k], v)
+				}
+			}
+			if resp.ProviderRef != tt.providerRef || resp.ReferenceID != tt.req.ReferenceID {
+				t.Errorf("response refs = %s %s", resp.ProviderRef, resp.ReferenceID)
+			}
+			if resp.Status != models.PaymentStatusPending {
+				t.Errorf("status = %s, want %s", resp.Status, models.PaymentStatusPending)
+			}
+			tt.check(t, resp)
+		})
+	}
+}
+
+func TestCreatePaymentError(t *testing.T) {
+	service, _ := newStub(t, http.StatusBadRequest, `{"error_code":"API_VALIDATION_ERROR","message":"amount is required"}`)
+	_, err := service.CreatePayment(payment_provider.PaymentRequest{ReferenceID: "PAY-1", Method: payment_provider.PaymentMethodLink})
+	if err == nil || err.Error() != "xendit: API_VALIDATION_ERROR: amount is required" {
+		t.Errorf("CreatePayment() error = %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if _, err := service.CreatePayment(payment_provider.PaymentRequest{Method: payment_provider.PaymentMethodLink, ExpiresAt: &past}); err == nil {
+		t.Error("a payment expiring in the past should be rejected")
+	}
+	if _, err := service.CreatePayment(payment_provider.PaymentRequest{Method: "CARD"}); err == nil {
+		t.Error("an unsupported method should be rejected")
+	}
+}
+
+func TestGetPayment(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      payment_provider.PaymentMethod
+		providerRef string
+		response    string
+		path        string
+		status      string
+		paidAmount  float64
+	}{
+		{
+			name: "paid invoice", method: payment_provider.PaymentMethodLink, providerRef: "inv-1",
+			response: `{"id":"inv-1","external_id":"PAY-1","status":"PAID","amount":150000,"paid_amount":150000,"paid_at":"2024-05-01T10:00:00Z"}`,
+			path:     "/v2/invoices/inv-1", status: models.PaymentStatusPaid, paidAmount: 150000,
+		},
+		{
+			name: "settled invoice", method: payment_provider.PaymentMethodLink, providerRef: "inv-2",
+			response: `{"id":"inv-2","external_id":"PAY-2","status":"SETTLED","amount":100000,"paid_amount":100000}`,
+			path:     "/v2/invoices/inv-2", status: models.PaymentStatusPaid, paidAmount: 100000,
+		},
+		{
+			name: "expired invoice", method: payment_provider.PaymentMethodLink, providerRef: "inv-3",
+			response: `{"id":"inv-3","external_id":"PAY-3","status":"EXPIRED","amount":100000}`,
+			path:     "/v2/invoices/inv-3", status: models.PaymentStatusExpired,
+		},
+		{
+			name: "expired virtual account", method: payment_provider.PaymentMethodVA, providerRef: "va-1",
+			response: `{"id":"va-1","external_id":"PAY-4","status":"INACTIVE","expiration_date":"2020-01-01T00:00:00Z"}`,
+			path:     "/callback_virtual_accounts/va-1", status: models.PaymentStatusExpired,
+		},
+		{
+			name: "inactive virtual account before expiry", method: payment_provider.PaymentMethodVA, providerRef: "va-2",
+			response: `{"id":"va-2","external_id":"PAY-5","status":"INACTIVE","expiration_date":"2099-01-01T00:00:00Z"}`,
+			path:     "/callback_virtual_accounts/va-2", status: models.PaymentStatusPending,
+		},
+		{
+			name: "succeeded e-wallet charge", method: payment_provider.PaymentMethodEWallet, providerRef: "ewc-1",
+			response: `{"id":"ewc-1","reference_id":"PAY-6","status":"SUCCEEDED","charge_amount":50000,"capture_amount":50000,"updated":"2024-05-01T10:00:00Z"}`,
+			path:     "/ewallets/charges/ewc-1", status: models.PaymentStatusPaid, paidAmount: 50000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, requests := newStub(t, http.StatusOK, tt.response)
+			resp, err := service.GetPayment(tt.method, tt.providerRef, "")
+			if err != nil {
+				t.Fatalf("GetPayment() error = %v", err)
+			}
+			req := lastRequest(t, requests)
+			if req.Method != http.MethodGet || req.Path != tt.path {
+				t.Errorf("request = %s %s, want GET %s", req.Method, req.Path, tt.path)
+			}
+			if resp.Status != tt.status {
+				t.Errorf("status = %s, want %s", resp.Status, tt.status)
+			}
+			if resp.PaidAmount != tt.paidAmount {
+				t.Errorf("paid amount = %v, want %v", resp.PaidAmount, tt.paidAmount)
+			}
+		})
+	}
+}
+
+func TestRefundPayment(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      payment_provider.RefundRequest
+		response string
+		path     string
+		status   string
+		amount   float64
+	}{
+		{
+			name:     "invoice",
+			req:      payment_provider.RefundRequest{ReferenceID: "RF-1", ProviderRef: "inv-1", Method: payment_provider.PaymentMethodLink, Amount: 40000},
+			response: `{"id":"rfd-1","invoice_id":"inv-1","reference_id":"RF-1","amount":40000,"status":"PENDING"}`,
+			path:     "/refunds", status: payment_provider.RefundPending, amount: 40000,
+		},
+		{
+			name:     "e-wallet",
+			req:      payment_provider.RefundRequest{ReferenceID: "RF-2", ProviderRef: "ewc-1", Method: payment_provider.PaymentMethodEWallet, Amount: 50000},
+			response: `{"id":"ewr-1","charge_id":"ewc-1","refund_amount":50000,"status":"SUCCEEDED"}`,
+			path:     "/ewallets/charges/ewc-1/refunds", status: payment_provider.RefundSucceeded, amount: 50000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, requests := newStub(t, http.StatusOK, tt.response)
+			resp, err := service.RefundPayment(tt.req)
+			if err != nil {
+				t.Fatalf("RefundPayment() error = %v", err)
+			}
+			req := lastRequest(t, requests)
+			if req.Method != http.MethodPost || req.Path != tt.path {
+				t.Errorf("request = %s %s, want POST %s", req.Method, req.Path, tt.path)
+			}
+			if req.Body["amount"] != tt.req.Amount {
+				t.Errorf("request amount = %v, want %v", req.Body["amount"], tt.req.Amount)
+			}
+			if req.Body["reason"] != refundReason {
+				t.Errorf("request reason = %v", req.Body["reason"])
+			}
+			if resp.Status != tt.status || resp.Amount != tt.amount || resp.ReferenceID != tt.req.ReferenceID {
+				t.Errorf("response = %+v", resp)
+			}
+		})
+	}
+
+	service, requests := newStub(t, http.StatusOK, `{}`)
+	if _, err := service.RefundPayment(payment_provider.RefundRequest{Method: payment_provider.PaymentMethodVA}); err == nil {
+		t.Error("refunding a virtual account payment should be rejected")
+	}
+	if len(*requests) != 0 {
+		t.Error("an unsupported refund should not reach xendit")
+	}
+}
+
+func TestDisburse(t *testing.T) {
+	service, requests := newStub(t, http.StatusOK, `{"id":"disb-1","external_id":"PO-1","amount":1000000,"bank_code":"BCA","status":"PENDING"}`)
+	resp, err := service.Disburse(payment_provider.DisbursementRequest{
+		ReferenceID: "PO-1", BankCode: "BCA", AccountNumber: "1234567890",
+		AccountHolderName: "Toko Maju", Amount: 1000000, Description: "Payout",
+	})
+	if err != nil {
+		t.Fatalf("Disburse() error = %v", err)
+	}
+	req := lastRequest(t, requests)
+	if req.Method != http.MethodPost || req.Path != "/disbursements" {
+		t.Errorf("request = %s %s", req.Method, req.Path)
+	}
+	if req.Header.Get(idempotencyKey) != "PO-1" {
+		t.Errorf("idempotency key = %q", req.Header.Get(idempotencyKey))
+	}
+	if req.Body["account_number"] != "1234567890" || req.Body["account_holder_name"] != "Toko Maju" {
+		t.Errorf("request body = %v", req.Body)
+	}
+	if resp.ProviderRef != "disb-1" || resp.Status != payment_provider.DisbursementPending {
+		t.Errorf("response = %+v", resp)
+	}
+
+	service, requests = newStub(t, http.StatusOK, `{"id":"disb-1","external_id":"PO-1","amount":1000000,"status":"FAILED","failure_code":"INVALID_DESTINATION"}`)
+	resp, err = service.GetDisbursement("disb-1")
+	if err != nil {
+		t.Fatalf("GetDisbursement() error = %v", err)
+	}
+	if req := lastRequest(t, requests); req.Path != "/disbursements/disb-1" {
+		t.Errorf("request path = %s", req.Path)
+	}
+	if resp.Status != payment_provider.DisbursementFailed || resp.FailureReason != "INVALID_DESTINATION" {
+		t.Errorf("response = %+v", resp)
+	}
+}
+
+func webhookRequest(token, webhookID, body string) payment_provider.WebhookRequest {
+	header := http.Header{}
+	header.Set(CallbackTokenHeader, token)
+	if webhookID != "" {
+		header.Set(WebhookIDHeader, webhookID)
+	}
+	return payment_provider.WebhookRequest{Header: header, Body: []byte(body)}
+}
+
+func TestParseWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		webhookID string
+		body      string
+		want      payment_provider.WebhookEvent
+	}{
+		{
+			name: "paid invoice",
+			body: `{"id":"inv-1","external_id":"PAY-1","status":"PAID","amount":150000,"paid_amount":150000,"fees_paid_amount":4500,"paid_at":"2024-05-01T10:00:00Z"}`,
+			want: payment_provider.WebhookEvent{EventID: "inv-1:PAID", ProviderRef: "inv-1", ReferenceID: "PAY-1", Method: payment_provider.PaymentMethodLink, Status: models.PaymentStatusPaid, Amount: 150000, Fee: 4500},
+		},
+		{
+			name:      "expired invoice",
+			webhookID: "wh-2",
+			body:      `{"id":"inv-2","external_id":"PAY-2","status":"EXPIRED","amount":150000,"invoice_url":"https://checkout.xendit.co/web/inv-2"}`,
+			want:      payment_provider.WebhookEvent{EventID: "wh-2", ProviderRef: "inv-2", ReferenceID: "PAY-2", Method: payment_provider.PaymentMethodLink, Status: models.PaymentStatusExpired, Amount: 150000},
+		},
+		{
+			name: "paid virtual account",
+			body: `{"id":"fvap-1","payment_id":"pay-1","callback_virtual_account_id":"va-1","external_id":"PAY-3","bank_code":"BNI","account_number":"8808999912345","amount":250000,"transaction_timestamp":"2024-05-01T10:00:00Z"}`,
+			want: payment_provider.WebhookEvent{EventID: "pay-1", ProviderRef: "va-1", ReferenceID: "PAY-3", Method: payment_provider.PaymentMethodVA, Status: models.PaymentStatusPaid, Amount: 250000},
+		},
+		{
+			name: "active virtual account",
+			body: `{"id":"va-2","external_id":"PAY-4","bank_code":"BNI","account_number":"8808999900000","status":"ACTIVE","updated":"2024-05-01T09:00:00Z"}`,
+			want: payment_provider.WebhookEvent{EventID: "va-2:ACTIVE:2024-05-01T09:00:00Z", ProviderRef: "va-2", ReferenceID: "PAY-4", Method: payment_provider.PaymentMethodVA},
+		},
+		{
+			name: "captured e-wallet charge",
+			body: `{"event":"ewallet.capture","data":{"id":"ewc-1","reference_id":"PAY-5","status":"SUCCEEDED","charge_amount":50000,"capture_amount":50000,"updated":"2024-05-01T10:00:00Z"}}`,
+			want: payment_provider.WebhookEvent{EventID: "ewc-1:PAID", ProviderRef: "ewc-1", ReferenceID: "PAY-5", Method: payment_provider.PaymentMethodEWallet, Status: models.PaymentStatusPaid, Amount: 50000},
+		},
+		{
+			name: "succeeded qr payment",
+			body: `{"event":"qr.payment","data":{"id":"qrpy-1","qr_id":"qr-1","reference_id":"PAY-6","status":"SUCCEEDED","amount":75000,"created":"2024-05-01T10:00:00Z"}}`,
+			want: payment_provider.WebhookEvent{EventID: "qrpy-1", ProviderRef: "qr-1", ReferenceID: "PAY-6", Method: payment_provider.PaymentMethodQRIS, Status: models.PaymentStatusPaid, Amount: 75000},
+		},
+		{
+			name: "succeeded invoice refund",
+			body: `{"event":"refund.succeeded","data":{"id":"rfd-1","invoice_id":"inv-1","amount":40000,"status":"SUCCEEDED","updated":"2024-05-02T10:00:00Z"}}`,
+			want: payment_provider.WebhookEvent{EventID: "rfd-1:SUCCEEDED", ProviderRef: "inv-1", Method: payment_provider.PaymentMethodLink, Status: models.PaymentStatusRefunded, Amount: 40000},
+		},
+		{
+			name: "failed e-wallet refund",
+			body: `{"event":"refund.failed","data":{"id":"ewr-1","charge_id":"ewc-1","refund_amount":50000,"status":"FAILED","failure_code":"INSUFFICIENT_BALANCE"}}`,
+			want: payment_provider.WebhookEvent{EventID: "ewr-1:FAILED", ProviderRef: "ewc-1", Method: payment_provider.PaymentMethodEWallet, Amount: 50000, Reason: "refund ewr-1 failed: INSUFFICIENT_BALANCE"},
+		},
+	}
+	service := NewXenditService()
+	service.SetCallbackToken(testCallbackToken)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.ParseWebhook(webhookRequest(testCallbackToken, tt.webhookID, tt.body))
+			if err != nil {
+				t.Fatalf("ParseWebhook() error = %v", err)
+			}
+			if tt.want.Status == models.PaymentStatusPaid && got.PaidAt == nil {
+				t.Error("paid at is not parsed")
+			}
+			got.PaidAt = nil
+			if *got != tt.want {
+				t.Errorf("ParseWebhook() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWebhookInvalid(t *testing.T) {
+	service := NewXenditService()
+	if _, err := service.ParseWebhook(webhookRequest("", "", `{}`)); err == nil {
+		t.Error("callbacks should be rejected without a configured callback token")
+	}
+
+	service.SetCallbackToken(testCallbackToken)
+	body := `{"id":"inv-1","external_id":"PAY-1","status":"PAID","paid_amount":1}`
+	if _, err := service.ParseWebhook(webhookRequest("wrong-token", "", body)); !errors.Is(err, payment_provider.ErrInvalidCallbackToken) {
+		t.Errorf("ParseWebhook() error = %v, want ErrInvalidCallbackToken", err)
+	}
+	if _, err := service.ParseWebhook(webhookRequest(testCallbackToken, "", `{"event":"payment_method.activated","data":{}}`)); err == nil {
+		t.Error("unsupported events should be rejected")
+	}
+	if _, err := service.ParseWebhook(webhookRequest(testCallbackToken, "", `{"foo":"bar"}`)); err == nil {
+		t.Error("unknown callbacks should be rejected")
+	}
+}
+
+func TestParseDisbursementWebhook(t *testing.T) {
+	service := NewXenditService()
+	service.SetCallbackToken(testCallbackToken)
+	body := `{"id":"disb-1","external_id":"PO-1","amount":1000000,"bank_code":"BCA","account_holder_name":"Toko Maju","status":"COMPLETED"}`
+	got, err := service.ParseDisbursementWebhook(webhookRequest(testCallbackToken, "", body))
+	if err != nil {
+		t.Fatalf("ParseDisbursementWebhook() error = %v", err)
+	}
+	if got.ProviderRef != "disb-1" || got.ReferenceID != "PO-1" || got.Status != payment_provider.DisbursementCompleted || got.Amount != 1000000 {
+		t.Errorf("ParseDisbursementWebhook() = %+v", got)
+	}
+	if _, err := service.ParseDisbursementWebhook(webhookRequest("wrong-token", "", body)); !errors.Is(err, payment_provider.ErrInvalidCallbackToken) {
+		t.Errorf("ParseDisbursementWebhook() error = %v, want ErrInvalidCallbackToken", err)
+	}
+}
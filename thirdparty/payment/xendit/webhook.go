@@ -0,0 +1,264 @@
+package xendit
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AMETORY/ametory-erp-modules/order/payment/payment_provider"
+	"github.com/AMETORY/ametory-erp-modules/shared/models"
+)
+
+const (
+	// CallbackTokenHeader is the header carrying the verification token of Xendit callbacks.
+	CallbackTokenHeader = "X-Callback-Token"
+	// WebhookIDHeader is the header carrying the unique ID of a Xendit callback.
+	WebhookIDHeader = "Webhook-Id"
+)
+
+// XenditWebhookEvent is the envelope of the event callbacks of Xendit.
+type XenditWebhookEvent struct {
+	Event      string          `json:"event"`
+	APIVersion string          `json:"api_version"`
+	BusinessID string          `json:"business_id"`
+	Created    string          `json:"created"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// SetCallbackToken sets the verification token of the Xendit account, which every callback of
+// Xendit carries in the X-Callback-Token header.
+func (s *XenditService) SetCallbackToken(token string) {
+	s.callbackToken = token
+}
+
+// ParseWebhook verifies and parses a callback of Xendit.
+//
+// Invoice and fixed virtual account callbacks are plain objects; QR code, e-wallet and refund
+// callbacks are events wrapped in a XenditWebhookEvent. A succeeded refund is reported as
+// REFUNDED with the refunded amount, so partial refunds add up. Callbacks that do not change the
+// status of a payment, such as a virtual account becoming active or a failed refund, have an
+// empty status; the failure of a refund is kept as reason.
+//
+// The event ID is the Webhook-Id header of the callback, which stays the same when Xendit
+// retries it, or the ID of the payment with the reported status when the header is missing.
+func (s *XenditService) ParseWebhook(req payment_provider.WebhookRequest) (*payment_provider.WebhookEvent, error) {
+	if err := s.verifyCallback(req); err != nil {
+		return nil, err
+	}
+
+	var envelope XenditWebhookEvent
+	if err := json.Unmarshal(req.Body, &envelope); err != nil {
+		return nil, err
+	}
+	var event *payment_provider.WebhookEvent
+	var err error
+	switch {
+	case envelope.Event == "":
+		event, err = parseObjectCallback(req.Body)
+	case strings.HasPrefix(envelope.Event, "qr."):
+		var payment XenditQRPayment
+		if err := json.Unmarshal(envelope.Data, &payment); err != nil {
+			return nil, err
+		}
+		event = &payment_provider.WebhookEvent{
+			ProviderRef: payment.QRID,
+			ReferenceID: payment.ReferenceID,
+			Method:      payment_provider.PaymentMethodQRIS,
+			Status:      xenditStatus(payment.Status),
+			Amount:      payment.Amount,
+			PaidAt:      parseXenditTime(payment.Created),
+		}
+		if event.Status == models.PaymentStatusPaid {
+			event.EventID = payment.ID
+		}
+	case strings.HasPrefix(envelope.Event, "ewallet."):
+		var charge XenditEWalletCharge
+		if err := json.Unmarshal(envelope.Data, &charge); err != nil {
+			return nil, err
+		}
+		event = &payment_provider.WebhookEvent{
+			ProviderRef: charge.ID,
+			ReferenceID: charge.ReferenceID,
+			Method:      payment_provider.PaymentMethodEWallet,
+			Status:      xenditStatus(charge.Status),
+			Amount:      charge.CaptureAmount,
+			Reason:      charge.FailureCode,
+		}
+		if event.Status == models.PaymentStatusPaid {
+			event.PaidAt = parseXenditTime(charge.Updated)
+		}
+		if event.Status == models.PaymentStatusRefunded {
+			// the refund is applied by its own refund event
+			event.Status = ""
+		}
+	case strings.HasPrefix(envelope.Event, "refund."):
+		var refund XenditRefund
+		if err := json.Unmarshal(envelope.Data, &refund); err != nil {
+			return nil, err
+		}
+		event, err = refundEvent(refund)
+	default:
+		return nil, fmt.Errorf("unsupported xendit callback %s", envelope.Event)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if id := req.Header.Get(WebhookIDHeader); id != "" {
+		event.EventID = id
+	}
+	if event.EventID == "" {
+		event.EventID = fmt.Sprintf("%s:%s", event.ProviderRef, event.Status)
+	}
+	return event, nil
+}
+
+// ParseDisbursementWebhook verifies and parses the callback of a disbursement.
+func (s *XenditService) ParseDisbursementWebhook(req payment_provider.WebhookRequest) (*payment_provider.DisbursementResponse, error) {
+	if err := s.verifyCallback(req); err != nil {
+		return nil, err
+	}
+	var disbursement XenditDisbursement
+	if err := json.Unmarshal(req.Body, &disbursement); err != nil {
+		return nil, err
+	}
+	if disbursement.ID == "" {
+		return nil, errors.New("xendit disbursement callback has no ID")
+	}
+	return disbursementResponse(&disbursement), nil
+}
+
+func (s *XenditService) verifyCallback(req payment_provider.WebhookRequest) error {
+	if s.callbackToken == "" {
+		return errors.New("xendit callback token is not configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get(CallbackTokenHeader)), []byte(s.callbackToken)) != 1 {
+		return payment_provider.ErrInvalidCallbackToken
+	}
+	return nil
+}
+
+// parseObjectCallback parses the invoice and fixed virtual account callbacks, which are sent
+// without an event envelope.
+func parseObjectCallback(body []byte) (*payment_provider.WebhookEvent, error) {
+	var probe struct {
+		CallbackVirtualAccountID string   `json:"callback_virtual_account_id"`
+		AccountNumber            string   `json:"account_number"`
+		InvoiceURL               string   `json:"invoice_url"`
+		PaidAmount               *float64 `json:"paid_amount"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+	switch {
+	case probe.CallbackVirtualAccountID != "":
+		var payment XenditVAPayment
+		if err := json.Unmarshal(body, &payment); err != nil {
+			return nil, err
+		}
+		paidAt := parseXenditTime(payment.TransactionTimestamp)
+		if paidAt == nil {
+			paidAt = parseXenditTime(payment.Created)
+		}
+		return &payment_provider.WebhookEvent{
+			EventID:     payment.PaymentID,
+			ProviderRef: payment.CallbackVirtualAccountID,
+			ReferenceID: payment.ExternalID,
+			Method:      payment_provider.PaymentMethodVA,
+			Status:      models.PaymentStatusPaid,
+			Amount:      payment.Amount,
+			PaidAt:      paidAt,
+		}, nil
+	case probe.InvoiceURL != "" || probe.PaidAmount != nil:
+		var invoice XenditInvoice
+		if err := json.Unmarshal(body, &invoice); err != nil {
+			return nil, err
+		}
+		event := &payment_provider.WebhookEvent{
+			ProviderRef: invoice.ID,
+			ReferenceID: invoice.ExternalID,
+			Method:      payment_provider.PaymentMethodLink,
+			Status:      xenditStatus(invoice.Status),
+			Amount:      invoice.PaidAmount,
+			Fee:         invoice.FeesPaidAmount,
+			PaidAt:      parseXenditTime(invoice.PaidAt),
+		}
+		if event.Amount == 0 {
+			event.Amount = invoice.Amount
+		}
+		return event, nil
+	case probe.AccountNumber != "":
+		var va XenditVA
+		if err := json.Unmarshal(body, &va); err != nil {
+			return nil, err
+		}
+		event := vaResponse(&va)
+		status := ""
+		if event.Status == models.PaymentStatusExpired {
+			status = event.Status
+		}
+		return &payment_provider.WebhookEvent{
+			EventID:     fmt.Sprintf("%s:%s:%s", va.ID, va.Status, va.Updated),
+			ProviderRef: va.ID,
+			ReferenceID: va.ExternalID,
+			Method:      payment_provider.PaymentMethodVA,
+			Status:      status,
+		}, nil
+	}
+	return nil, errors.New("unsupported xendit callback")
+}
+
+func refundEvent(refund XenditRefund) (*payment_provider.WebhookEvent, error) {
+	event := &payment_provider.WebhookEvent{
+		EventID:     fmt.Sprintf("%s:%s", refund.ID, refund.Status),
+		ProviderRef: refund.InvoiceID,
+		Amount:      refund.Amount,
+		Method:      payment_provider.PaymentMethodLink,
+	}
+	if event.ProviderRef == "" {
+		event.ProviderRef = refund.ChargeID
+		event.Method = payment_provider.PaymentMethodEWallet
+	}
+	if event.ProviderRef == "" {
+		return nil, errors.New("xendit refund callback has no payment")
+	}
+	if event.Amount == 0 {
+		event.Amount = refund.RefundAmount
+	}
+	switch refundStatus(refund.Status) {
+	case payment_provider.RefundSucceeded:
+		event.Status = models.PaymentStatusRefunded
+		event.PaidAt = parseXenditTime(refund.Updated)
+	case payment_provider.RefundFailed:
+		event.Reason = fmt.Sprintf("refund %s failed: %s", refund.ID, refund.FailureCode)
+	}
+	return event, nil
+}
+
+// xenditStatus maps the payment statuses of Xendit to payment statuses.
+func xenditStatus(status string) string {
+	switch strings.ToUpper(status) {
+	case "SUCCEEDED", "COMPLETED", "PAID", "SETTLED", "SUCCESS":
+		return models.PaymentStatusPaid
+	case "EXPIRED", "INACTIVE":
+		return models.PaymentStatusExpired
+	case "FAILED", "VOIDED", "CANCELLED":
+		return models.PaymentStatusFailed
+	case "REFUNDED":
+		return models.PaymentStatusRefunded
+	}
+	return models.PaymentStatusPending
+}
+
+func parseXenditTime(value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
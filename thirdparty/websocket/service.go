@@ -1,7 +1,9 @@
 package websocket
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
 	"gopkg.in/olahol/melody.v1"
 )
@@ -22,3 +24,31 @@ func NewWebsocketService() *WebsocketService {
 		Client: mel,
 	}
 }
+
+// Subscribe upgrades the request to a websocket session subscribed to channel. The caller must
+// authenticate the request and check that its user may read channel before subscribing it.
+func (s *WebsocketService) Subscribe(w http.ResponseWriter, r *http.Request, channel string) error {
+	if channel == "" {
+		return errors.New("channel is required")
+	}
+	return s.Client.HandleRequestWithKeys(w, r, map[string]interface{}{"channel": channel})
+}
+
+// BroadcastChannel sends msg to the sessions subscribed to channel.
+//
+// Only sessions subscribed with Subscribe (the "channel" key of the session) receive channel
+// messages. Channels are hierarchical: a session subscribed to "kds:merchant" also receives the
+// messages of "kds:merchant:station".
+func (s *WebsocketService) BroadcastChannel(channel string, msg []byte) error {
+	return s.Client.BroadcastFilter(msg, func(session *melody.Session) bool {
+		value, ok := session.Get("channel")
+		if !ok {
+			return false
+		}
+		subscribed, _ := value.(string)
+		if subscribed == "" {
+			return false
+		}
+		return channel == subscribed || strings.HasPrefix(channel, subscribed+":")
+	})
+}
@@ -332,6 +332,19 @@ func GenerateOrderReceipt(data ReceiptData, templatePath string) ([]byte, error)
 	if templatePath == "" {
 		templatePath = "templates/invoice.html"
 	}
+	return generateReceiptPDF(data, templatePath)
+}
+
+// GenerateShiftReport renders a POS shift report (X or Z report) on receipt paper,
+// the same way GenerateOrderReceipt renders an order receipt.
+func GenerateShiftReport(data ShiftReportData, templatePath string) ([]byte, error) {
+	if templatePath == "" {
+		templatePath = "templates/shift_report.html"
+	}
+	return generateReceiptPDF(data, templatePath)
+}
+
+func generateReceiptPDF(data any, templatePath string) ([]byte, error) {
 	tmpl, err := template.ParseFiles(templatePath)
 	if err != nil {
 		return nil, err
@@ -44,6 +44,39 @@ type ReceiptItem struct {
 	Notes           string `json:"notes"`
 }
 
+type ShiftReportData struct {
+	ReportType      string            `json:"report_type"` // X, Z
+	ShiftNumber     string            `json:"shift_number"`
+	MerchantName    string            `json:"merchant_name"`
+	MerchantAddress string            `json:"merchant_address"`
+	TerminalName    string            `json:"terminal_name"`
+	CashierName     string            `json:"cashier_name"`
+	OpenedAt        string            `json:"opened_at"`
+	ClosedAt        string            `json:"closed_at"`
+	PrintedAt       string            `json:"printed_at"`
+	OpeningFloat    string            `json:"opening_float"`
+	CashIn          string            `json:"cash_in"`
+	CashOut         string            `json:"cash_out"`
+	CashRefund      string            `json:"cash_refund"`
+	ExpectedCash    string            `json:"expected_cash"`
+	CountedCash     string            `json:"counted_cash"`
+	Variance        string            `json:"variance"`
+	TotalSales      string            `json:"total_sales"`
+	TotalCount      int               `json:"total_count"`
+	Payments        []ShiftReportLine `json:"payments"`
+	Denominations   []ShiftReportLine `json:"denominations"`
+	PrintCount      int               `json:"print_count"`
+}
+
+type ShiftReportLine struct {
+	Description string `json:"description"`
+	Count       string `json:"count"`
+	Amount      string `json:"amount"`
+	Expected    string `json:"expected"`
+	Counted     string `json:"counted"`
+	Variance    string `json:"variance"`
+}
+
 type InvoicePDFItem struct {
 	No                 int
 	Description        string